@@ -0,0 +1,184 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/archive"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var archiveCommand = cli.Command{
+	Name:  "archive",
+	Usage: "packs an OCI layout into a single archive",
+	ArgsUsage: `--layout <image-path> <archive>
+
+Where "<image-path>" is the path to the OCI image, and "<archive>" is the path
+of the archive to create (or "-" to write the archive to stdout).
+
+The archive contains the entire image layout (every blob and reference), and
+can be used directly with --image and --layout (such as "umoci unpack --image
+image.tar:latest bundle") as a read-only image, or converted back to a
+directory layout with umoci-unarchive(1). Unlike umoci-export(1), no blobs or
+references are left out of the archive.
+
+The format of the archive is "tar" unless "<archive>" ends with ".zip", and can
+be overridden with --format.`,
+
+	// archive reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format of the archive (tar or zip)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <archive>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("archive path cannot be empty")
+		}
+		if ctx.IsSet("format") {
+			if _, err := archive.ParseFormat(ctx.String("format")); err != nil {
+				return errors.Wrap(err, "invalid --format")
+			}
+		}
+		return nil
+	},
+
+	Action: archiveLayout,
+}
+
+func archiveLayout(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	archivePath := ctx.Args().First()
+
+	format := archive.FormatFromPath(archivePath)
+	if ctx.IsSet("format") {
+		format, _ = archive.ParseFormat(ctx.String("format"))
+	}
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	var w io.Writer = os.Stdout
+	if archivePath != "-" {
+		fh, err := os.Create(archivePath)
+		if err != nil {
+			return errors.Wrap(err, "create archive")
+		}
+		defer fh.Close()
+		w = fh
+	}
+
+	if err := archive.Write(context.Background(), w, engine, format); err != nil {
+		if archivePath != "-" {
+			os.Remove(archivePath)
+		}
+		return errors.Wrap(err, "write archive")
+	}
+
+	log.Infof("archived %s to %s archive: %s", imagePath, format, archivePath)
+	return nil
+}
+
+var unarchiveCommand = cli.Command{
+	Name:  "unarchive",
+	Usage: "converts an archived OCI layout to a directory",
+	ArgsUsage: `--layout <image-path> <archive>
+
+Where "<image-path>" is the path of the OCI image to create, and "<archive>" is
+the path of a tar or zip archive containing an OCI image layout (such as one
+created by umoci-archive(1) or "docker buildx build -o type=oci").
+
+Archived images can be used directly with --image and --layout, but are
+read-only. umoci-unarchive(1) converts the archive to a directory layout
+containing every blob and reference in the archive, which can then be
+modified. The digest of every blob is verified.`,
+
+	// unarchive creates an image layout.
+	Category: "layout",
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <archive>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("archive path cannot be empty")
+		}
+		return nil
+	},
+
+	Action: unarchiveLayout,
+}
+
+func unarchiveLayout(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	archivePath := ctx.Args().First()
+
+	if _, err := os.Stat(imagePath); !os.IsNotExist(err) {
+		if err == nil {
+			err = fmt.Errorf("path already exists: %s", imagePath)
+		}
+		return errors.Wrap(err, "image layout creation")
+	}
+
+	src, err := archive.Open(archivePath)
+	if err != nil {
+		return errors.Wrap(err, "open archive")
+	}
+	defer src.Close()
+
+	if err := cas.Create(imagePath); err != nil {
+		return errors.Wrap(err, "image layout creation")
+	}
+	dst, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer dst.Close()
+
+	if err := archive.Copy(context.Background(), dst, src); err != nil {
+		os.RemoveAll(imagePath)
+		return errors.Wrap(err, "copy archive")
+	}
+
+	log.Infof("unarchived %s to %s", archivePath, imagePath)
+	return nil
+}
@@ -0,0 +1,375 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// defaultArtifactBlobMediaType is the media type used for artifact blobs if
+// none is given to umoci-artifact-put(1).
+const defaultArtifactBlobMediaType = "application/octet-stream"
+
+var artifactSubcommand = cli.Command{
+	Name:  "artifact",
+	Usage: "stores and extracts non-image artifacts",
+	ArgsUsage: `artifact <command> [<args>...]
+
+The umoci-artifact(1) subcommands allow an OCI image layout to be used as a
+generic content store for artifacts which are not container images (such as
+Helm charts or WASM modules). Artifacts are stored as ordinary image manifests
+whose config has a custom media type (the "artifact type"), so they can be
+tagged, copied and garbage collected like any other image. umoci-unpack(1)
+and other commands which need an image configuration refuse to operate on
+artifacts.`,
+
+	Subcommands: []cli.Command{
+		artifactPushBlobCommand,
+		artifactPutCommand,
+		artifactExtractCommand,
+	},
+}
+
+var artifactPushBlobCommand = cli.Command{
+	Name:  "push-blob",
+	Usage: "stores a file as a blob in an OCI image",
+	ArgsUsage: `--layout <image-path> <file>
+
+Where "<image-path>" is the path to the OCI image and "<file>" is the file to
+store (or "-" to read from stdin). The digest of the blob is written to
+stdout, and can be given to umoci-artifact-put(1) in place of a file.
+
+Note that the blob is not referenced by anything, and will be removed by
+umoci-gc(1) unless it is included in an artifact.`,
+
+	// push-blob modifies an image layout.
+	Category: "layout",
+
+	Action: artifactPushBlob,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <file>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("file path cannot be empty")
+		}
+		ctx.App.Metadata["file"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func artifactPushBlob(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	path := ctx.App.Metadata["file"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "open file")
+		}
+		defer fh.Close()
+		reader = fh
+	}
+
+	blobDigest, blobSize, err := engineExt.PutBlob(context.Background(), reader)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	log.Infof("stored blob %s (%d bytes)", blobDigest, blobSize)
+	fmt.Println(blobDigest)
+	return nil
+}
+
+var artifactPutCommand = cli.Command{
+	Name:  "put",
+	Usage: "stores an artifact in an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>] --artifact-type <type> [<blob>[:<media-type>]...]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to create (if not specified, defaults to "latest"), "<type>" is the media
+type of the artifact's config and each "<blob>" is either a file or the digest
+of an existing blob (see umoci-artifact-push-blob(1)). The blobs are stored
+as the artifact's layers in the order given, with the given "<media-type>"
+(if not specified, defaults to "application/octet-stream"). The name of each
+file is stored in its "org.opencontainers.image.title" annotation.
+
+If --config is specified, the contents of the given file are used as the
+artifact's config. Otherwise the config is an empty JSON object. Manifest
+annotations can be set with --manifest.annotation.`,
+
+	// put modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "artifact-type",
+			Usage: "media type of the artifact's config",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "file containing the artifact's config",
+		},
+		cli.StringSliceFlag{
+			Name:  "manifest.annotation",
+			Usage: "annotation of the artifact's manifest (of the form key=value)",
+		},
+	},
+
+	Action: artifactPut,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.String("artifact-type") == "" {
+			return errors.Errorf("missing mandatory argument: --artifact-type")
+		}
+		for _, annotation := range ctx.StringSlice("manifest.annotation") {
+			if !strings.Contains(annotation, "=") {
+				return errors.Errorf("--manifest.annotation must be of the form key=value: %q", annotation)
+			}
+		}
+		for _, arg := range ctx.Args() {
+			if arg == "" {
+				return errors.Errorf("blob cannot be empty")
+			}
+		}
+		return nil
+	},
+}
+
+// parseArtifactBlob parses a "<blob>[:<media-type>]" argument given to
+// umoci-artifact-put(1). The media type is only split off if it contains a
+// '/', so that digests (which contain a ':') can be given without one.
+func parseArtifactBlob(arg string) (string, string) {
+	if sep := strings.LastIndex(arg, ":"); sep != -1 && strings.Contains(arg[sep+1:], "/") {
+		return arg[:sep], arg[sep+1:]
+	}
+	return arg, defaultArtifactBlobMediaType
+}
+
+func artifactPut(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var config io.Reader
+	if path := ctx.String("config"); path != "" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "open config")
+		}
+		defer fh.Close()
+		config = fh
+	}
+
+	var annotations map[string]string
+	for _, annotation := range ctx.StringSlice("manifest.annotation") {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		parts := strings.SplitN(annotation, "=", 2)
+		annotations[parts[0]] = parts[1]
+	}
+
+	var blobs []casext.ArtifactBlob
+	for _, arg := range ctx.Args() {
+		source, mediaType := parseArtifactBlob(arg)
+		blob := casext.ArtifactBlob{
+			MediaType: mediaType,
+		}
+
+		// Existing blobs are referred to by their digest.
+		if blobDigest, err := digest.Parse(source); err == nil {
+			reader, err := engineExt.GetBlob(context.Background(), blobDigest)
+			if err != nil {
+				return errors.Wrapf(err, "get blob %s", blobDigest)
+			}
+			defer reader.Close()
+			blob.Reader = reader
+		} else {
+			fh, err := os.Open(source)
+			if err != nil {
+				return errors.Wrap(err, "open blob")
+			}
+			defer fh.Close()
+			blob.Reader = fh
+			blob.Annotations = map[string]string{
+				ispec.AnnotationTitle: filepath.Base(source),
+			}
+		}
+		blobs = append(blobs, blob)
+	}
+
+	descriptor, err := engineExt.PutArtifact(context.Background(), ctx.String("artifact-type"), config, blobs, annotations)
+	if err != nil {
+		return errors.Wrap(err, "put artifact")
+	}
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "put reference")
+	}
+
+	log.Infof("created new artifact: %q -> %s", tagName, descriptor.Digest)
+	return nil
+}
+
+var artifactExtractCommand = cli.Command{
+	Name:  "extract",
+	Usage: "extracts the blobs of an artifact in an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>] <directory>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+artifact to extract (if not specified, defaults to "latest") and
+"<directory>" is the directory to extract the artifact's blobs into (it is
+created if it does not exist).
+
+Each blob is written to a file named after its "org.opencontainers.image.title"
+annotation (if it has one, and it is a plain file name) or otherwise the
+hex part of its digest. Existing files are never overwritten. The contents
+of every blob are verified against its digest.`,
+
+	// extract reads manifest information.
+	Category: "image",
+
+	Action: artifactExtract,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <directory>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("directory path cannot be empty")
+		}
+		ctx.App.Metadata["directory"] = ctx.Args().First()
+		return nil
+	},
+}
+
+// artifactBlobName returns the name of the file that the given artifact blob
+// is extracted to by umoci-artifact-extract(1).
+func artifactBlobName(descriptor ispec.Descriptor) string {
+	name := descriptor.Annotations[ispec.AnnotationTitle]
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return descriptor.Digest.Hex()
+	}
+	return name
+}
+
+// extractArtifactBlob writes the blob with the given descriptor to path,
+// verifying its contents against the descriptor.
+func extractArtifactBlob(engine casext.Engine, descriptor ispec.Descriptor, path string) (Err error) {
+	reader, err := engine.GetVerifiedBlob(context.Background(), descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create file")
+	}
+	defer func() {
+		if err := fh.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close file")
+		}
+		if Err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	_, err = io.Copy(fh, reader)
+	return errors.Wrap(err, "copy blob")
+}
+
+func artifactExtract(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	directory := ctx.App.Metadata["directory"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), descriptorPaths[0].Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return errors.Errorf("%s does not refer to a manifest: %s", fromName, manifestBlob.MediaType)
+	}
+	if !casext.IsArtifact(manifest) {
+		log.Warnf("%s is an image rather than an artifact, extracting its layer blobs", fromName)
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return errors.Wrap(err, "create directory")
+	}
+	for _, descriptor := range manifest.Layers {
+		path := filepath.Join(directory, artifactBlobName(descriptor))
+		if err := extractArtifactBlob(engineExt, descriptor, path); err != nil {
+			return errors.Wrapf(err, "extract blob %s", descriptor.Digest)
+		}
+		log.Infof("extracted %s (%s)", path, descriptor.MediaType)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/pkg/bench"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var benchCommand = cli.Command{
+	Name:  "bench",
+	Usage: "benchmarks umoci operations on synthetic images",
+	ArgsUsage: `[--workload <name>]...
+
+Benchmarks unpacking, repacking and garbage-collecting synthetic images, which
+are generated in a temporary directory (so the storage backing that directory
+is what is being measured). The images only depend on the workload, so results
+are comparable between runs and machines. The available workloads are:
+
+` + benchWorkloadList() + `
+All workloads are run if --workload is not specified. This command is intended
+for umoci developers and for profiling storage, and its output may change.`,
+
+	// This is an internal command.
+	Hidden: true,
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "workload",
+			Usage: "workload to run (can be specified multiple times)",
+		},
+		cli.Float64Flag{
+			Name:  "scale",
+			Usage: "multiply the number and size of the files in each workload",
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:  "tmpdir",
+			Usage: "directory in which the images are generated [default: $TMPDIR]",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "enable rootless unpacking support",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.Float64("scale") <= 0 {
+			return errors.Errorf("invalid --scale: must be positive")
+		}
+		return nil
+	},
+
+	Action: benchmark,
+}
+
+// benchWorkloadList returns the list of workloads for the help text.
+func benchWorkloadList() string {
+	var list string
+	for _, workload := range bench.Workloads {
+		list += fmt.Sprintf("  %-12s %s (%d files, %s)\n", workload.Name, workload.Description, workload.Files, units.BytesSize(float64(workload.Size())))
+	}
+	return list
+}
+
+func benchmark(ctx *cli.Context) error {
+	workloads := bench.Workloads
+	if ctx.IsSet("workload") {
+		workloads = nil
+		for _, name := range ctx.StringSlice("workload") {
+			workload, err := bench.GetWorkload(name)
+			if err != nil {
+				return errors.Wrap(err, "invalid --workload")
+			}
+			workloads = append(workloads, workload)
+		}
+	}
+
+	opt := bench.Options{Keywords: MtreeKeywords}
+	opt.MapOptions.Rootless = ctx.Bool("rootless")
+	if opt.MapOptions.Rootless {
+		// Use the same mappings as umoci-unpack(1) does by default.
+		opt.MapOptions.UIDMappings = []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}}
+		opt.MapOptions.GIDMappings = []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "WORKLOAD\tFILES\tSIZE\tPHASE\tDURATION\n")
+	for _, workload := range workloads {
+		workload = workload.Scale(ctx.Float64("scale"))
+
+		root, err := ioutil.TempDir(ctx.String("tmpdir"), "umoci-bench-")
+		if err != nil {
+			return errors.Wrap(err, "create temporary directory")
+		}
+		log.Infof("running workload %s in %s", workload.Name, root)
+		results, err := bench.Run(context.Background(), root, workload, opt)
+		if err := os.RemoveAll(root); err != nil {
+			log.Warnf("could not remove %s: %v", root, err)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "workload %s", workload.Name)
+		}
+		for _, result := range results {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", result.Workload, workload.Files, units.BytesSize(float64(workload.Size())), result.Phase, result.Duration)
+		}
+	}
+	return tw.Flush()
+}
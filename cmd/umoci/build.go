@@ -0,0 +1,584 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/buildfile"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// defaultBuildFile is the name of the build file used by umoci-build(1) if
+// --file is not specified, relative to the build context.
+const defaultBuildFile = "Umocifile"
+
+var buildCommand = cli.Command{
+	Name:  "build",
+	Usage: "builds an image from a simple declarative build file",
+	ArgsUsage: `--image <image-path>[:<new-tag>] [<context>]
+
+Where "<image-path>" is the path to the OCI image, "<new-tag>" is the name of
+the tag that the built image will be saved as (if not specified, defaults to
+"latest"), and "<context>" is the directory containing the build file and the
+files copied into the image (if not specified, defaults to the current
+directory).
+
+The build file (by default "<context>/Umocifile") contains a small subset of the
+Dockerfile syntax, with one instruction per line:
+
+    FROM <tag>|scratch
+    COPY <src>... <dest>
+    RUN <command>|["executable", "arg"...]
+    ENV <name>=<value>...
+    LABEL <name>=<value>...
+    CMD <command>|["executable", "arg"...]
+    ENTRYPOINT <command>|["executable", "arg"...]
+    WORKDIR <path>
+    USER <user>[:<group>]
+
+The base image given by FROM must be a tag in "<image-path>" (or "scratch" for
+an empty image). The build is equivalent to using umoci-unpack(1) on the base
+image, modifying the rootfs, using umoci-repack(1) and then umoci-config(1):
+all changes to the filesystem are stored in a single new layer. RUN commands are
+executed as root inside a chroot(2) of the rootfs, without any mounts or
+isolation, and so cannot be used with --rootless.`,
+
+	// build creates a new image, with a given tag.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "file, f",
+			Usage: "path to the build file (default: <context>/" + defaultBuildFile + ")",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "enable rootless building support",
+		},
+	},
+
+	Action: build,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() > 1 {
+			return errors.Errorf("invalid number of positional arguments: expected [<context>]")
+		}
+		buildContext := "."
+		if ctx.NArg() == 1 {
+			buildContext = ctx.Args().First()
+		}
+		if buildContext == "" {
+			return errors.Errorf("context path cannot be empty")
+		}
+		ctx.App.Metadata["context"] = buildContext
+		return nil
+	},
+}
+
+// builder contains the state of a single umoci-build(1) invocation.
+type builder struct {
+	// contextPath is the build context, from which files are copied.
+	contextPath string
+
+	// rootfsPath is the path of the unpacked rootfs of the image being built.
+	rootfsPath string
+
+	// mapOptions are the options used to unpack the rootfs and generate the
+	// new layer.
+	mapOptions layer.MapOptions
+
+	// g is the configuration of the image being built.
+	g *igen.Generator
+}
+
+func build(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	contextPath := ctx.App.Metadata["context"].(string)
+
+	buildFilePath := filepath.Join(contextPath, defaultBuildFile)
+	if ctx.IsSet("file") {
+		buildFilePath = ctx.String("file")
+	}
+	fh, err := os.Open(buildFilePath)
+	if err != nil {
+		return errors.Wrap(err, "open build file")
+	}
+	buildFile, err := buildfile.Parse(fh)
+	fh.Close()
+	if err != nil {
+		return errors.Wrapf(err, "parse build file %s", buildFilePath)
+	}
+
+	b := &builder{
+		contextPath: contextPath,
+	}
+	b.mapOptions.Rootless = ctx.Bool("rootless")
+	// Device nodes are recorded (as with umoci-unpack(1)) so that they are
+	// preserved in the lower layers without having to create them.
+	b.mapOptions.DevicePolicy = layer.DevicePolicyRecord
+	b.mapOptions.LayerCache = openLayerCache(ctx)
+	if b.mapOptions.Rootless {
+		b.mapOptions.UIDMappings = []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}}
+		b.mapOptions.GIDMappings = []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}}
+		for _, inst := range buildFile.Instructions {
+			if inst.Command == buildfile.Run {
+				return errors.Errorf("line %d: RUN is not supported with --rootless", inst.Line)
+			}
+		}
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var fromDescriptorPath casext.DescriptorPath
+	if buildFile.From == buildfile.Scratch {
+		descriptor, err := newManifest(context.Background(), engineExt)
+		if err != nil {
+			return errors.Wrap(err, "create scratch image")
+		}
+		fromDescriptorPath = casext.DescriptorPath{Walk: []ispec.Descriptor{descriptor}}
+	} else {
+		fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), buildFile.From)
+		if err != nil {
+			return errors.Wrap(err, "get descriptor")
+		}
+		if len(fromDescriptorPaths) == 0 {
+			return errors.Errorf("tag not found: %s", buildFile.From)
+		}
+		if len(fromDescriptorPaths) != 1 {
+			// TODO: Handle this more nicely.
+			return errors.Errorf("tag is ambiguous: %s", buildFile.From)
+		}
+		fromDescriptorPath = fromDescriptorPaths[0]
+	}
+	if !casext.IsManifestMediaType(fromDescriptorPath.Descriptor().MediaType) {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", fromDescriptorPath.Descriptor().MediaType), "invalid base descriptor")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPath)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	imageConfig, err := mutator.Config(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get base config")
+	}
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get base metadata")
+	}
+	annotations, err := mutator.Annotations(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get base annotations")
+	}
+	b.g, err = igen.NewFromImage(toImage(imageConfig, imageMeta))
+	if err != nil {
+		return errors.Wrap(err, "create new generator")
+	}
+
+	// Unpack the base image into a temporary directory.
+	tempDir, err := ioutil.TempDir("", "umoci-build")
+	if err != nil {
+		return errors.Wrap(err, "create temporary directory")
+	}
+	defer os.RemoveAll(tempDir)
+	b.rootfsPath = filepath.Join(tempDir, layer.RootfsName)
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptorPath.Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "get base manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	log.WithFields(log.Fields{
+		"image":  imagePath,
+		"from":   buildFile.From,
+		"rootfs": b.rootfsPath,
+	}).Debugf("umoci: unpacking base image")
+
+	log.Info("unpacking base image ...")
+	if err := layer.UnpackRootfs(context.Background(), engineExt, b.rootfsPath, manifest, &b.mapOptions); err != nil {
+		return errors.Wrap(err, "unpack base rootfs")
+	}
+	log.Info("... done")
+
+	fsEval := fseval.DefaultFsEval
+	if b.mapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	spec, err := mtree.Walk(b.rootfsPath, nil, MtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "generate mtree spec")
+	}
+
+	// Execute every instruction in order.
+	var layerSteps, configSteps []string
+	for _, inst := range buildFile.Instructions {
+		log.Infof("step: %s", inst.Original)
+		changesLayer, err := b.execute(inst)
+		if err != nil {
+			return errors.Wrapf(err, "line %d", inst.Line)
+		}
+		if changesLayer {
+			layerSteps = append(layerSteps, inst.Original)
+		} else {
+			configSteps = append(configSteps, inst.Original)
+		}
+	}
+
+	log.Info("computing filesystem diff ...")
+	diffs, err := mtreefilter.Check(b.rootfsPath, spec, MtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "check mtree")
+	}
+	log.Info("... done")
+
+	log.WithFields(log.Fields{
+		"ndiff": len(diffs),
+	}).Debugf("umoci: checked mtree spec")
+
+	created := time.Now()
+	if len(diffs) > 0 {
+		reader, err := layer.GenerateLayer(b.rootfsPath, diffs, &b.mapOptions)
+		if err != nil {
+			return errors.Wrap(err, "generate diff layer")
+		}
+		defer reader.Close()
+
+		history := ispec.History{
+			Author:     b.g.Author(),
+			Created:    &created,
+			CreatedBy:  "umoci build: " + strings.Join(layerSteps, "; "),
+			EmptyLayer: false,
+		}
+		if err := mutator.Add(context.Background(), reader, history); err != nil {
+			return errors.Wrap(err, "add diff layer")
+		}
+	}
+
+	if len(configSteps) > 0 {
+		history := ispec.History{
+			Author:     b.g.Author(),
+			Created:    &created,
+			CreatedBy:  "umoci build: " + strings.Join(configSteps, "; "),
+			EmptyLayer: true,
+		}
+		newConfig, newMeta := fromImage(b.g.Image())
+		if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
+			return errors.Wrap(err, "set modified configuration")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
+
+// execute applies a single instruction to the image being built, and returns
+// whether the instruction modifies the filesystem (rather than only the image
+// configuration).
+func (b *builder) execute(inst buildfile.Instruction) (bool, error) {
+	switch inst.Command {
+	case buildfile.Copy:
+		return true, b.copy(inst.Args[:len(inst.Args)-1], inst.Args[len(inst.Args)-1])
+	case buildfile.Run:
+		return true, b.run(inst.Args)
+	case buildfile.Workdir:
+		workdir := b.resolvePath(inst.Args[0])
+		b.g.SetConfigWorkingDir(workdir)
+		// The working directory must exist for RUN instructions.
+		dir, err := securejoin.SecureJoin(b.rootfsPath, workdir)
+		if err != nil {
+			return false, errors.Wrap(err, "resolve working directory")
+		}
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			return true, errors.Wrap(os.MkdirAll(dir, 0755), "create working directory")
+		}
+		return false, nil
+	case buildfile.Env:
+		for _, env := range inst.Args {
+			name, value, err := parseEnv(env)
+			if err != nil {
+				return false, err
+			}
+			b.g.AddConfigEnv(name, value)
+		}
+	case buildfile.Label:
+		for _, label := range inst.Args {
+			parts := strings.SplitN(label, "=", 2)
+			b.g.AddConfigLabel(parts[0], parts[1])
+		}
+	case buildfile.Cmd:
+		b.g.SetConfigCmd(inst.Args)
+	case buildfile.Entrypoint:
+		b.g.SetConfigEntrypoint(inst.Args)
+	case buildfile.User:
+		b.g.SetConfigUser(inst.Args[0])
+	default:
+		// Should _never_ be reached.
+		return false, errors.Errorf("[internal error] unknown instruction %s", inst.Command)
+	}
+	return false, nil
+}
+
+// resolvePath returns the absolute (in the image) path of the given path,
+// which is relative to the working directory if it isn't absolute.
+func (b *builder) resolvePath(unsafePath string) string {
+	if path.IsAbs(unsafePath) {
+		return path.Clean(unsafePath)
+	}
+	workdir := b.g.ConfigWorkingDir()
+	if workdir == "" {
+		workdir = "/"
+	}
+	return path.Join(workdir, unsafePath)
+}
+
+// copy copies the given paths (relative to the build context) into the rootfs.
+// If more than one source is given, or dest ends with "/" or is an existing
+// directory, the sources are copied into the dest directory.
+func (b *builder) copy(sources []string, dest string) error {
+	destPath := b.resolvePath(dest)
+	intoDir := len(sources) > 1 || strings.HasSuffix(dest, "/")
+	if !intoDir {
+		fullDest, err := securejoin.SecureJoin(b.rootfsPath, destPath)
+		if err != nil {
+			return errors.Wrap(err, "resolve destination")
+		}
+		if fi, err := os.Stat(fullDest); err == nil && fi.IsDir() {
+			intoDir = true
+		}
+	}
+
+	for _, source := range sources {
+		// Sources cannot be outside of the build context.
+		cleanSource := filepath.Clean(source)
+		if filepath.IsAbs(cleanSource) || cleanSource == ".." || strings.HasPrefix(cleanSource, "../") {
+			return errors.Errorf("COPY source is outside of the build context: %s", source)
+		}
+		sourcePath := filepath.Join(b.contextPath, cleanSource)
+
+		target := destPath
+		if intoDir {
+			fi, err := os.Lstat(sourcePath)
+			if err != nil {
+				return errors.Wrap(err, "stat COPY source")
+			}
+			// Like Dockerfiles, the contents of a directory are copied (rather
+			// than the directory itself).
+			if !fi.IsDir() {
+				target = path.Join(destPath, filepath.Base(sourcePath))
+			}
+		}
+		if err := b.copyPath(sourcePath, target); err != nil {
+			return errors.Wrapf(err, "copy %s", source)
+		}
+	}
+	return nil
+}
+
+// copyPath recursively copies the given host path to the given path in the
+// rootfs. Parent directories are created as necessary. Files are owned by root
+// (unless we are rootless), and their permissions are preserved.
+func (b *builder) copyPath(sourcePath, target string) error {
+	fi, err := os.Lstat(sourcePath)
+	if err != nil {
+		return errors.Wrap(err, "lstat source")
+	}
+
+	dirPath, err := securejoin.SecureJoin(b.rootfsPath, path.Dir(target))
+	if err != nil {
+		return errors.Wrap(err, "resolve parent directory")
+	}
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return errors.Wrap(err, "create parent directories")
+	}
+	fullPath := filepath.Join(dirPath, path.Base(target))
+
+	// Don't follow symlinks at the final component of the target, unless we
+	// are copying a directory (where we merge the contents).
+	if old, err := os.Lstat(fullPath); err == nil && !(fi.IsDir() && old.IsDir()) {
+		if err := os.RemoveAll(fullPath); err != nil {
+			return errors.Wrap(err, "remove old path")
+		}
+	}
+
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		if err := os.Mkdir(fullPath, mode.Perm()); err != nil && !os.IsExist(err) {
+			return errors.Wrap(err, "create directory")
+		}
+		names, err := ioutil.ReadDir(sourcePath)
+		if err != nil {
+			return errors.Wrap(err, "read directory")
+		}
+		for _, name := range names {
+			if err := b.copyPath(filepath.Join(sourcePath, name.Name()), path.Join(target, name.Name())); err != nil {
+				return err
+			}
+		}
+	case mode&os.ModeSymlink != 0:
+		linkname, err := os.Readlink(sourcePath)
+		if err != nil {
+			return errors.Wrap(err, "read symlink")
+		}
+		if err := os.Symlink(linkname, fullPath); err != nil {
+			return errors.Wrap(err, "create symlink")
+		}
+	case mode.IsRegular():
+		if err := copyFile(sourcePath, fullPath, mode.Perm()); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unsupported file type %s", mode.String())
+	}
+
+	if !b.mapOptions.Rootless {
+		if err := os.Lchown(fullPath, 0, 0); err != nil {
+			return errors.Wrap(err, "chown")
+		}
+	}
+	if mode := fi.Mode(); mode&os.ModeSymlink == 0 {
+		// Make sure the umask didn't affect the permissions.
+		if err := os.Chmod(fullPath, mode.Perm()); err != nil {
+			return errors.Wrap(err, "chmod")
+		}
+	}
+	return nil
+}
+
+// copyFile copies the contents of a regular file to a new file.
+func copyFile(sourcePath, fullPath string, perm os.FileMode) error {
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return errors.Wrap(err, "create file")
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return errors.Wrap(err, "copy file")
+	}
+	return errors.Wrap(dst.Close(), "close file")
+}
+
+// run executes the given command inside a chroot(2) of the rootfs, with the
+// environment and working directory of the image configuration.
+func (b *builder) run(args []string) error {
+	env := b.g.ConfigEnv()
+	executable, err := b.lookPath(args[0], env)
+	if err != nil {
+		return err
+	}
+
+	workdir := b.g.ConfigWorkingDir()
+	if workdir == "" {
+		workdir = "/"
+	}
+
+	cmd := &exec.Cmd{
+		Path:   executable,
+		Args:   args,
+		Env:    env,
+		Dir:    workdir,
+		Stdout: os.Stderr,
+		Stderr: os.Stderr,
+	}
+	if err := chroot(cmd, b.rootfsPath); err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "run %v", args)
+	}
+	return nil
+}
+
+// lookPath resolves the given executable using the PATH in the given
+// environment, inside the rootfs. The returned path is relative to the rootfs.
+func (b *builder) lookPath(executable string, env []string) (string, error) {
+	if strings.Contains(executable, "/") {
+		return executable, nil
+	}
+	searchPath := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			searchPath = strings.TrimPrefix(e, "PATH=")
+		}
+	}
+	for _, dir := range filepath.SplitList(searchPath) {
+		candidate := path.Join("/", dir, executable)
+		fullPath, err := securejoin.SecureJoin(b.rootfsPath, candidate)
+		if err != nil {
+			continue
+		}
+		if fi, err := os.Stat(fullPath); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", errors.Errorf("executable %q not found in PATH of image", executable)
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// chroot makes the given command run with the given root directory.
+func chroot(cmd *exec.Cmd, root string) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root}
+	return nil
+}
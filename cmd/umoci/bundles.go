@@ -0,0 +1,266 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+const (
+	// bundleOK is the status of a bundle which can be repacked.
+	bundleOK = "ok"
+
+	// bundleMissing is the status of a bundle which no longer exists (or is
+	// no longer a bundle).
+	bundleMissing = "missing"
+
+	// bundleReplaced is the status of a bundle whose path has since been used
+	// to unpack a different manifest.
+	bundleReplaced = "replaced"
+
+	// bundleOrphaned is the status of a bundle whose manifest no longer exists
+	// in the image, so it cannot be repacked.
+	bundleOrphaned = "orphaned"
+)
+
+var bundlesCommand = cli.Command{
+	Name:  "bundles",
+	Usage: "manages the bundles unpacked from an OCI image",
+	ArgsUsage: `bundles <command> [<args>...]
+
+Every bundle unpacked with umoci-unpack(1) is recorded in the image it was
+unpacked from, along with the manifest it was unpacked from and when. The
+umoci-bundles(1) subcommands allow for the recorded bundles to be listed, and
+for stale bundles to be cleaned up.`,
+
+	Subcommands: []cli.Command{
+		bundlesListCommand,
+		bundlesPruneCommand,
+	},
+}
+
+var bundlesListCommand = cli.Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Usage:   "lists the bundles unpacked from an OCI image",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+The status of each bundle is one of "ok", "missing" (the bundle no longer
+exists), "replaced" (a different manifest has since been unpacked to the same
+path) or "orphaned" (the manifest the bundle was unpacked from no longer exists
+in the image, so the bundle cannot be repacked).
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// list reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the bundles as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: bundlesList,
+}
+
+var bundlesPruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "removes the records of stale bundles from an OCI image",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+The records of bundles which are "missing" or "replaced" (see
+umoci-bundles-list(1)) are removed from the image. If --remove-orphaned is
+specified, bundles which are "orphaned" are deleted and their records are
+removed.`,
+
+	// prune modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "remove-orphaned",
+			Usage: "delete bundles whose manifest no longer exists in the image",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: bundlesPrune,
+}
+
+// BundleStatus is a bundle recorded in an image, as well as its status.
+type BundleStatus struct {
+	casext.BundleRecord
+
+	// Status is the status of the bundle (ok, missing, replaced or orphaned).
+	Status string `json:"status"`
+}
+
+// BundleStatuses returns the status of every bundle recorded in the image.
+func BundleStatuses(ctx context.Context, engine casext.Engine) ([]BundleStatus, error) {
+	records, err := engine.Bundles(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get bundles")
+	}
+
+	statuses := []BundleStatus{}
+	for _, record := range records {
+		status, err := bundleStatus(ctx, engine, record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get status of bundle %s", record.Path)
+		}
+		statuses = append(statuses, BundleStatus{
+			BundleRecord: record,
+			Status:       status,
+		})
+	}
+	return statuses, nil
+}
+
+// bundleStatus returns the status of the given bundle.
+func bundleStatus(ctx context.Context, engine casext.Engine, record casext.BundleRecord) (string, error) {
+	meta, err := ReadBundleMeta(record.Path)
+	if os.IsNotExist(errors.Cause(err)) {
+		return bundleMissing, nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "read umoci.json metadata")
+	}
+	if meta.From.Descriptor().Digest != record.Manifest {
+		return bundleReplaced, nil
+	}
+
+	blob, err := engine.GetBlob(ctx, record.Manifest)
+	if os.IsNotExist(errors.Cause(err)) {
+		return bundleOrphaned, nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "get manifest")
+	}
+	blob.Close()
+	return bundleOK, nil
+}
+
+// formatBundles formats the given bundles using the default formatting, and
+// writes the result to the given writer.
+func formatBundles(w io.Writer, statuses []BundleStatus) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "PATH\tMANIFEST\tTAG\tUNPACKED\tSTATUS\n")
+	for _, status := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", status.Path, status.Manifest, status.RefName, status.Time.Format(igen.ISO8601), status.Status)
+	}
+	return tw.Flush()
+}
+
+func bundlesList(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	statuses, err := BundleStatuses(context.Background(), engineExt)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(statuses); err != nil {
+			return errors.Wrap(err, "encoding bundles")
+		}
+		return nil
+	}
+	return errors.Wrap(formatBundles(os.Stdout, statuses), "format bundles")
+}
+
+func bundlesPrune(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	statuses, err := BundleStatuses(context.Background(), engineExt)
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for _, status := range statuses {
+		switch status.Status {
+		case bundleMissing, bundleReplaced:
+		case bundleOrphaned:
+			if !ctx.Bool("remove-orphaned") {
+				continue
+			}
+			if err := os.RemoveAll(status.Path); err != nil {
+				return errors.Wrapf(err, "remove orphaned bundle %s", status.Path)
+			}
+			log.Infof("removed orphaned bundle: %s", status.Path)
+		default:
+			continue
+		}
+		log.Infof("pruning %s bundle: %s", status.Status, status.Path)
+		stale = append(stale, status.Path)
+	}
+
+	if err := engineExt.RemoveBundles(context.Background(), stale...); err != nil {
+		return errors.Wrap(err, "remove bundle records")
+	}
+	return nil
+}
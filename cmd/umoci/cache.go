@@ -0,0 +1,131 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// defaultCacheDir returns the default path of the per-user cache with the
+// given name, following the XDG base directory specification.
+func defaultCacheDir(name string) (string, error) {
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	if cacheHome == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", errors.Errorf("neither $XDG_CACHE_HOME nor $HOME are set")
+		}
+		cacheHome = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(cacheHome, "umoci", name), nil
+}
+
+// defaultPluginDir returns the default plugin directory, following the XDG
+// base directory specification.
+func defaultPluginDir() (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", errors.Errorf("neither $XDG_DATA_HOME nor $HOME are set")
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "umoci", "plugins"), nil
+}
+
+// openBlobCache opens the blob cache at the given path (which is an image
+// layout without any references), creating it if it doesn't exist.
+func openBlobCache(path string) (cas.Engine, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, errors.Wrap(err, "create blob cache parent")
+		}
+		// Another process might have created the cache in the meantime.
+		if err := cas.Create(path); err != nil && !os.IsExist(errors.Cause(err)) {
+			return nil, errors.Wrap(err, "create blob cache")
+		}
+	}
+	return cas.Open(path)
+}
+
+// openOptions returns the options used to open images, which are set by the
+// global --newer-versions and --force flags.
+func openOptions(ctx *cli.Context) cas.OpenOptions {
+	policy, _ := ctx.App.Metadata["--newer-versions"].(cas.NewerVersionPolicy)
+	return cas.OpenOptions{NewerVersions: policy}
+}
+
+// openEngine opens the image at the given path, using the blob cache if it
+// was enabled with --blob-cache (see cas.WithBlobCache).
+func openEngine(ctx *cli.Context, imagePath string) (cas.Engine, error) {
+	var (
+		engine cas.Engine
+		err    error
+	)
+	// umoci-daemon(1) keeps images open between requests.
+	if engines, ok := ctx.App.Metadata["--daemon.engines"].(*daemonEngines); ok {
+		engine, err = engines.open(imagePath, openOptions(ctx))
+	} else {
+		engine, err = cas.OpenWithOptions(imagePath, openOptions(ctx))
+	}
+	if err != nil {
+		return nil, err
+	}
+	// umoci-daemon(1) keeps the blob cache open between requests.
+	if cache, ok := ctx.App.Metadata["--daemon.blob-cache"].(cas.Engine); ok {
+		return cas.WithBlobCache(engine, sharedEngine{cache}), nil
+	}
+	cachePath, ok := ctx.App.Metadata["--blob-cache"].(string)
+	if !ok {
+		return engine, nil
+	}
+	cache, err := openBlobCache(cachePath)
+	if err != nil {
+		// The cache is only an optimisation.
+		log.Warnf("cannot open blob cache %s: %v", cachePath, err)
+		return engine, nil
+	}
+	return cas.WithBlobCache(engine, cache), nil
+}
+
+// openLayerCache returns the layer cache enabled with --layer-cache, or nil if
+// it is not enabled (or cannot be opened).
+func openLayerCache(ctx *cli.Context) *layer.LayerCache {
+	if cache, ok := ctx.App.Metadata["--daemon.layer-cache"].(*layer.LayerCache); ok {
+		return cache
+	}
+	cachePath, ok := ctx.App.Metadata["--layer-cache"].(string)
+	if !ok {
+		return nil
+	}
+	cache, err := layer.NewLayerCache(cachePath, ctx.App.Metadata["--layer-cache-size"].(int64))
+	if err != nil {
+		// The cache is only an optimisation.
+		log.Warnf("cannot open layer cache %s: %v", cachePath, err)
+		return nil
+	}
+	return cache
+}
@@ -0,0 +1,158 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+var checkBundleCommand = cli.Command{
+	Name:  "check-bundle",
+	Usage: "verifies that a bundle has not drifted from its source image",
+	ArgsUsage: `--layout <image-path> <bundle>
+
+Where "<image-path>" is the path to the OCI image that "<bundle>" was unpacked
+from (using umoci-unpack(1)).
+
+The rootfs of "<bundle>" is compared against the mtree specification that was
+generated when the bundle was unpacked, and the source manifest recorded in the
+bundle metadata is checked to still be present in "<image-path>". Each path
+that has drifted from the specification is printed (sorted by path) together
+with the type of change, and the command fails if any drift was found.`,
+
+	// check-bundle reads the layout.
+	Category: "layout",
+
+	Action: checkBundle,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		return nil
+	},
+}
+
+// bundleDeltas is a wrapper around []mtree.InodeDelta that allows for sorting
+// the set of deltas by the pathname, so that the output of check-bundle is
+// deterministic.
+type bundleDeltas []mtree.InodeDelta
+
+func (bd bundleDeltas) Len() int           { return len(bd) }
+func (bd bundleDeltas) Less(i, j int) bool { return bd[i].Path() < bd[j].Path() }
+func (bd bundleDeltas) Swap(i, j int)      { bd[i], bd[j] = bd[j], bd[i] }
+
+func checkBundle(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+
+	// Read the metadata first.
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+
+	log.WithFields(log.Fields{
+		"version":     meta.Version,
+		"from":        meta.From,
+		"map_options": meta.MapOptions,
+	}).Debugf("umoci: loaded UmociMeta metadata")
+
+	if meta.RootfsOnly {
+		return errors.Errorf("cannot check bundle unpacked with --rootfs-only: no mtree specification")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// Make sure that the source manifest still exists in the image. We only
+	// need to check that the blob can be opened, because the blob store is
+	// content-addressable.
+	fromDigest := meta.From.Descriptor().Digest
+	blob, err := engineExt.GetBlob(context.Background(), fromDigest)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			err = fmt.Errorf("source manifest %s no longer exists in image", fromDigest)
+		}
+		return errors.Wrap(err, "check source manifest")
+	}
+	blob.Close()
+
+	mtreePath := bundleMtreePath(bundlePath, meta)
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+
+	mfh, err := os.Open(mtreePath)
+	if err != nil {
+		return errors.Wrap(err, "open mtree")
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return errors.Wrap(err, "parse mtree")
+	}
+
+	fsEval := fseval.DefaultFsEval
+	if meta.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	if meta.MapOptions.Portable {
+		fsEval = fseval.PortableFsEval
+	}
+
+	log.Info("computing filesystem diff ...")
+	diffs, err := mtreefilter.Check(fullRootfsPath, spec, bundleMtreeKeywords(meta.MapOptions), fsEval)
+	if err != nil {
+		return errors.Wrap(err, "check mtree")
+	}
+	log.Info("... done")
+
+	sort.Sort(bundleDeltas(diffs))
+	for _, diff := range diffs {
+		fmt.Printf("%s\t%s\n", diff.Type(), diff.Path())
+	}
+
+	if len(diffs) > 0 {
+		return errors.Errorf("bundle has drifted from its source image: %d paths changed", len(diffs))
+	}
+	log.Infof("bundle matches source image: %s", fromDigest)
+	return nil
+}
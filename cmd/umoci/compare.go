@@ -0,0 +1,409 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var compareCommand = cli.Command{
+	Name:  "compare",
+	Usage: "displays the differences between two tagged images",
+	ArgsUsage: `--layout <image-path> <old-tag> <new-tag>
+
+Where "<image-path>" is the path to the OCI image, and "<old-tag>" and
+"<new-tag>" are the names of the tagged images to compare.
+
+The images are compared at the level of their manifests and configurations:
+the layers added and removed, the changes to the configuration (such as the
+environment, command and labels), the changes to the manifest annotations and
+the change in the total size of the image are reported. The contents of the
+layers are not compared.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// compare reads two images in a layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the comparison as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <old-tag> <new-tag>")
+		}
+		for _, tag := range ctx.Args() {
+			if !refRegexp.MatchString(tag) {
+				return errors.Errorf("tag is an invalid reference: %q", tag)
+			}
+		}
+		return nil
+	},
+
+	Action: compare,
+}
+
+// comparedImage describes one of the images in an ImageComparison.
+type comparedImage struct {
+	// Tag is the name of the tag.
+	Tag string `json:"tag"`
+
+	// Manifest is the descriptor of the image's manifest.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Size is the total size of the image's manifest, configuration and
+	// layers.
+	Size int64 `json:"size"`
+}
+
+// fieldChange describes a change to a single field of the configuration or
+// manifest of an image. Old is nil if the field was added, and New is nil if
+// the field was removed.
+type fieldChange struct {
+	Field string  `json:"field"`
+	Old   *string `json:"old"`
+	New   *string `json:"new"`
+}
+
+// ImageComparison is a report of the differences between two images.
+type ImageComparison struct {
+	// Old and New are the images which were compared.
+	Old comparedImage `json:"old"`
+	New comparedImage `json:"new"`
+
+	// SizeDelta is the change in size from Old to New.
+	SizeDelta int64 `json:"size_delta"`
+
+	// AddedLayers are the layers of New which are not used by Old, and
+	// RemovedLayers are the layers of Old which are not used by New. Both
+	// are in manifest order.
+	AddedLayers   []ispec.Descriptor `json:"added_layers"`
+	RemovedLayers []ispec.Descriptor `json:"removed_layers"`
+
+	// Config contains the changes to the image configuration, sorted by
+	// field name. Fields which are maps (such as the environment and labels)
+	// are compared per-key, and are named "<field>.<key>".
+	Config []fieldChange `json:"config"`
+
+	// Annotations contains the changes to the manifest annotations, sorted
+	// by annotation name.
+	Annotations []fieldChange `json:"annotations"`
+}
+
+// Format formats an ImageComparison using the default formatting, and writes
+// the result to the given writer.
+func (ic ImageComparison) Format(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "IMAGE\tTAG\tMANIFEST\tSIZE\n")
+	fmt.Fprintf(tw, "old\t%s\t%s\t%s\n", ic.Old.Tag, ic.Old.Manifest.Digest, units.HumanSize(float64(ic.Old.Size)))
+	fmt.Fprintf(tw, "new\t%s\t%s\t%s\n", ic.New.Tag, ic.New.Manifest.Digest, units.HumanSize(float64(ic.New.Size)))
+	sign := "+"
+	if ic.SizeDelta < 0 {
+		sign = "-"
+	}
+	fmt.Fprintf(tw, "delta\t\t\t%s%s\n", sign, units.HumanSize(float64(abs(ic.SizeDelta))))
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "LAYER\tDIGEST\tSIZE\n")
+	for _, layer := range ic.RemovedLayers {
+		fmt.Fprintf(tw, "-\t%s\t%s\n", layer.Digest, units.HumanSize(float64(layer.Size)))
+	}
+	for _, layer := range ic.AddedLayers {
+		fmt.Fprintf(tw, "+\t%s\t%s\n", layer.Digest, units.HumanSize(float64(layer.Size)))
+	}
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "FIELD\tOLD\tNEW\n")
+	for _, change := range ic.Config {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", formatField(&change.Field), formatField(change.Old), formatField(change.New))
+	}
+	for _, change := range ic.Annotations {
+		field := "annotations." + change.Field
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", formatField(&field), formatField(change.Old), formatField(change.New))
+	}
+	return tw.Flush()
+}
+
+// formatField formats a field name or value for the default formatting.
+func formatField(value *string) string {
+	if value == nil {
+		return "<none>"
+	}
+	return strings.Replace(*value, "\t", " ", -1)
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// compareMaps returns the changes between the old and new maps, with each key
+// prefixed with prefix.
+func compareMaps(prefix string, old, new map[string]string) []fieldChange {
+	var changes []fieldChange
+	for key, oldValue := range old {
+		oldValue := oldValue
+		newValue, ok := new[key]
+		switch {
+		case !ok:
+			changes = append(changes, fieldChange{Field: prefix + key, Old: &oldValue})
+		case oldValue != newValue:
+			changes = append(changes, fieldChange{Field: prefix + key, Old: &oldValue, New: &newValue})
+		}
+	}
+	for key, newValue := range new {
+		newValue := newValue
+		if _, ok := old[key]; !ok {
+			changes = append(changes, fieldChange{Field: prefix + key, New: &newValue})
+		}
+	}
+	return changes
+}
+
+// envMap converts a list of environment variables to a map.
+func envMap(env []string) map[string]string {
+	vars := map[string]string{}
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		vars[parts[0]] = parts[1]
+	}
+	return vars
+}
+
+// setMap converts a set (such as the exposed ports or volumes) to a map.
+func setMap(set map[string]struct{}) map[string]string {
+	values := map[string]string{}
+	for key := range set {
+		values[key] = ""
+	}
+	return values
+}
+
+// configFields returns the fields of the image configuration which are
+// compared as a whole (rather than per-key), JSON encoded.
+func configFields(config ispec.Image) (map[string]string, error) {
+	fields := map[string]interface{}{
+		"architecture":      config.Architecture,
+		"os":                config.OS,
+		"author":            config.Author,
+		"config.User":       config.Config.User,
+		"config.WorkingDir": config.Config.WorkingDir,
+		"config.Entrypoint": config.Config.Entrypoint,
+		"config.Cmd":        config.Config.Cmd,
+		"config.StopSignal": config.Config.StopSignal,
+		"rootfs.type":       config.RootFS.Type,
+	}
+	if config.Created != nil {
+		fields["created"] = config.Created.Format(igen.ISO8601)
+	}
+
+	values := map[string]string{}
+	for field, value := range fields {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encode %s", field)
+		}
+		values[field] = string(encoded)
+	}
+	return values, nil
+}
+
+// compareConfigs returns the changes between the old and new image
+// configurations.
+func compareConfigs(old, new ispec.Image) ([]fieldChange, error) {
+	oldFields, err := configFields(old)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := configFields(new)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := compareMaps("", oldFields, newFields)
+	changes = append(changes, compareMaps("config.Env.", envMap(old.Config.Env), envMap(new.Config.Env))...)
+	changes = append(changes, compareMaps("config.Labels.", old.Config.Labels, new.Config.Labels)...)
+	changes = append(changes, compareMaps("config.ExposedPorts.", setMap(old.Config.ExposedPorts), setMap(new.Config.ExposedPorts))...)
+	changes = append(changes, compareMaps("config.Volumes.", setMap(old.Config.Volumes), setMap(new.Config.Volumes))...)
+	return changes, nil
+}
+
+// sortChanges sorts changes by field name.
+func sortChanges(changes []fieldChange) []fieldChange {
+	if changes == nil {
+		changes = []fieldChange{}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+// layerDifference returns the layers in a which are not in b.
+func layerDifference(a, b []ispec.Descriptor) []ispec.Descriptor {
+	inB := map[digest.Digest]struct{}{}
+	for _, layer := range b {
+		inB[layer.Digest] = struct{}{}
+	}
+	difference := []ispec.Descriptor{}
+	for _, layer := range a {
+		if _, ok := inB[layer.Digest]; !ok {
+			difference = append(difference, layer)
+		}
+	}
+	return difference
+}
+
+// loadImage returns the manifest and configuration of the image with the
+// given tag.
+func loadImage(ctx context.Context, engine casext.Engine, tag string) (comparedImage, ispec.Manifest, ispec.Image, error) {
+	image := comparedImage{Tag: tag}
+
+	descriptorPaths, err := engine.ResolveReference(ctx, tag)
+	if err != nil {
+		return image, ispec.Manifest{}, ispec.Image{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return image, ispec.Manifest{}, ispec.Image{}, errors.Errorf("tag not found: %s", tag)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return image, ispec.Manifest{}, ispec.Image{}, errors.Errorf("tag is ambiguous: %s", tag)
+	}
+	image.Manifest = descriptorPaths[0].Descriptor()
+
+	// FIXME: Implement support for manifest lists.
+	if !casext.IsManifestMediaType(image.Manifest.MediaType) {
+		return image, ispec.Manifest{}, ispec.Image{}, errors.Errorf("tag %s does not point to a manifest: not implemented: %s", tag, image.Manifest.MediaType)
+	}
+
+	manifestBlob, err := engine.FromDescriptor(ctx, image.Manifest)
+	if err != nil {
+		return image, ispec.Manifest{}, ispec.Image{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return image, ispec.Manifest{}, ispec.Image{}, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	configBlob, err := engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return image, ispec.Manifest{}, ispec.Image{}, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return image, ispec.Manifest{}, ispec.Image{}, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+
+	image.Size = image.Manifest.Size + manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		image.Size += layer.Size
+	}
+	return image, manifest, config, nil
+}
+
+// Compare computes the ImageComparison of the images with the given tags.
+func Compare(ctx context.Context, engine casext.Engine, oldTag, newTag string) (ImageComparison, error) {
+	var comparison ImageComparison
+
+	oldImage, oldManifest, oldConfig, err := loadImage(ctx, engine, oldTag)
+	if err != nil {
+		return comparison, errors.Wrapf(err, "load %s", oldTag)
+	}
+	newImage, newManifest, newConfig, err := loadImage(ctx, engine, newTag)
+	if err != nil {
+		return comparison, errors.Wrapf(err, "load %s", newTag)
+	}
+
+	comparison.Old = oldImage
+	comparison.New = newImage
+	comparison.SizeDelta = newImage.Size - oldImage.Size
+	comparison.AddedLayers = layerDifference(newManifest.Layers, oldManifest.Layers)
+	comparison.RemovedLayers = layerDifference(oldManifest.Layers, newManifest.Layers)
+
+	configChanges, err := compareConfigs(oldConfig, newConfig)
+	if err != nil {
+		return comparison, errors.Wrap(err, "compare configs")
+	}
+	comparison.Config = sortChanges(configChanges)
+	comparison.Annotations = sortChanges(compareMaps("", oldManifest.Annotations, newManifest.Annotations))
+	return comparison, nil
+}
+
+func compare(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	comparison, err := Compare(context.Background(), engineExt, ctx.Args().Get(0), ctx.Args().Get(1))
+	if err != nil {
+		return errors.Wrap(err, "compare")
+	}
+
+	// Output the comparison.
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(comparison); err != nil {
+			return errors.Wrap(err, "encoding comparison")
+		}
+	} else {
+		if err := comparison.Format(os.Stdout); err != nil {
+			return errors.Wrap(err, "format comparison")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var completionCommand = cli.Command{
+	Name:  "completion",
+	Usage: "generates a shell completion script",
+	ArgsUsage: `<shell>
+
+Where "<shell>" is one of "bash", "zsh" or "fish".
+
+The completion script is written to stdout, and completes umoci's commands and
+flags. Tag names are completed for --image by running umoci-list(1) on the
+image path that has already been typed. For example, to enable completion in
+the current bash session:
+
+    source <(umoci completion bash)`,
+
+	Action: completion,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <shell>")
+		}
+		if _, ok := completionTemplates[ctx.Args().First()]; !ok {
+			return errors.Errorf("unsupported shell: %q", ctx.Args().First())
+		}
+		return nil
+	},
+}
+
+// completionFlag describes a flag for the purposes of completion.
+type completionFlag struct {
+	// Names is the set of names of the flag (without leading dashes).
+	Names []string
+
+	// Usage is the usage string of the flag.
+	Usage string
+
+	// TakesValue is whether the flag requires an argument.
+	TakesValue bool
+}
+
+// completionCmd describes a (possibly nested) command for the purposes of
+// completion.
+type completionCmd struct {
+	// Path is the list of names of the command and its parents, with each
+	// element containing all of the aliases of that command.
+	Path [][]string
+
+	// Usage is the usage string of the command.
+	Usage string
+
+	// Flags is the set of flags accepted by the command.
+	Flags []completionFlag
+
+	// Subcommands is the set of subcommands of the command.
+	Subcommands []completionCmd
+}
+
+// completionData is the data passed to the completion templates.
+type completionData struct {
+	Flags    []completionFlag
+	Commands []completionCmd
+}
+
+// AllCommands returns every command (including nested commands).
+func (cd completionData) AllCommands() []completionCmd {
+	var all []completionCmd
+	var walk func(cmds []completionCmd)
+	walk = func(cmds []completionCmd) {
+		for _, cmd := range cmds {
+			all = append(all, cmd)
+			walk(cmd.Subcommands)
+		}
+	}
+	walk(cd.Commands)
+	return all
+}
+
+// ValueFlags returns the names of every flag (of any command) which takes an
+// argument, so that the argument can be skipped when searching for the
+// command being completed.
+func (cd completionData) ValueFlags() []string {
+	seen := map[string]struct{}{}
+	var names []string
+	add := func(flags []completionFlag) {
+		for _, flag := range flags {
+			if !flag.TakesValue {
+				continue
+			}
+			for _, name := range flag.Names {
+				if _, ok := seen[name]; !ok {
+					seen[name] = struct{}{}
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	add(cd.Flags)
+	for _, cmd := range cd.AllCommands() {
+		add(cmd.Flags)
+	}
+	return names
+}
+
+// toCompletionFlags converts the given set of cli.Flags.
+func toCompletionFlags(flags []cli.Flag) []completionFlag {
+	var cflags []completionFlag
+	for _, flag := range flags {
+		cflag := completionFlag{TakesValue: true}
+		switch flag.(type) {
+		case cli.BoolFlag, cli.BoolTFlag:
+			cflag.TakesValue = false
+		}
+		for _, name := range strings.Split(flag.GetName(), ",") {
+			cflag.Names = append(cflag.Names, strings.TrimSpace(name))
+		}
+		// All of the cli.Flag implementations have a Usage field, but it
+		// isn't part of the cli.Flag interface.
+		if usage := reflect.ValueOf(flag).FieldByName("Usage"); usage.IsValid() && usage.Kind() == reflect.String {
+			cflag.Usage = usage.String()
+		}
+		cflags = append(cflags, cflag)
+	}
+	// The help flag is only added to the set of flags when the command is
+	// run, so we need to add it ourselves.
+	for _, cflag := range cflags {
+		if cflag.Names[0] == "help" {
+			return cflags
+		}
+	}
+	return append(cflags, completionFlag{
+		Names: []string{"help", "h"},
+		Usage: "show help",
+	})
+}
+
+// toCompletionCommands converts the given set of cli.Commands, with the given
+// parent path.
+func toCompletionCommands(parent [][]string, cmds []cli.Command) []completionCmd {
+	var ccmds []completionCmd
+	for _, cmd := range cmds {
+		if cmd.Hidden {
+			continue
+		}
+		path := append(append([][]string{}, parent...), cmd.Names())
+		ccmds = append(ccmds, completionCmd{
+			Path:        path,
+			Usage:       cmd.Usage,
+			Flags:       toCompletionFlags(cmd.Flags),
+			Subcommands: toCompletionCommands(path, cmd.Subcommands),
+		})
+	}
+	return ccmds
+}
+
+// completionFuncs are the helper functions available to completion templates.
+var completionFuncs = template.FuncMap{
+	"join": strings.Join,
+	// dashed returns the list of flag names with the appropriate dashes.
+	"dashed": func(names []string) []string {
+		var dashed []string
+		for _, name := range names {
+			if len(name) == 1 {
+				dashed = append(dashed, "-"+name)
+			} else {
+				dashed = append(dashed, "--"+name)
+			}
+		}
+		return dashed
+	},
+	// allFlags returns every name (with dashes) of every flag.
+	"allFlags": func(flags []completionFlag) string {
+		var names []string
+		for _, flag := range flags {
+			for _, name := range flag.Names {
+				if len(name) == 1 {
+					names = append(names, "-"+name)
+				} else {
+					names = append(names, "--"+name)
+				}
+			}
+		}
+		return strings.Join(names, " ")
+	},
+	// names returns the primary name of every command.
+	"names": func(cmds []completionCmd) string {
+		var names []string
+		for _, cmd := range cmds {
+			names = append(names, cmd.Path[len(cmd.Path)-1][0])
+		}
+		return strings.Join(names, " ")
+	},
+	// patterns returns a shell case pattern matching every combination of
+	// aliases of the given command path.
+	"patterns": func(path [][]string) string {
+		combos := []string{""}
+		for _, aliases := range path {
+			var next []string
+			for _, prefix := range combos {
+				for _, alias := range aliases {
+					next = append(next, strings.TrimSpace(prefix+" "+alias))
+				}
+			}
+			combos = next
+		}
+		for idx, combo := range combos {
+			combos[idx] = `"` + combo + `"`
+		}
+		return strings.Join(combos, "|")
+	},
+	// fishQuote quotes a string for use as a fish argument.
+	"fishQuote": func(s string) string {
+		return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `'`, `\'`, -1) + "'"
+	},
+	// fishSeen returns a fish condition which is true if the given command
+	// path has been typed.
+	"fishSeen": func(path [][]string) string {
+		var conds []string
+		for _, aliases := range path {
+			conds = append(conds, "__fish_seen_subcommand_from "+strings.Join(aliases, " "))
+		}
+		return strings.Join(conds, "; and ")
+	},
+	// fishFlags bundles a condition and set of flags for the "fishFlags"
+	// template.
+	"fishFlags": func(cond string, flags []completionFlag) map[string]interface{} {
+		return map[string]interface{}{"Cond": cond, "Flags": flags}
+	},
+	// parent returns the path of the parent of a command path.
+	"parent": func(path [][]string) [][]string {
+		return path[:len(path)-1]
+	},
+	// last returns the aliases of the command (rather than its parents).
+	"last": func(path [][]string) []string {
+		return path[len(path)-1]
+	},
+}
+
+const bashCompletionTemplate = `# bash completion for umoci.
+# Generated by "umoci completion bash".
+
+# _umoci_image completes an --image argument, which is either a directory or
+# (once a ':' has been typed) a tag in the image at that path.
+_umoci_image() {
+	local cur="$1"
+	if [[ "$cur" == *:* ]]; then
+		local path="${cur%%:*}" tag
+		COMPREPLY=()
+		for tag in $(umoci ls --layout "$path" 2>/dev/null); do
+			[[ "$path:$tag" == "$cur"* ]] && COMPREPLY+=("$path:$tag")
+		done
+		if declare -F __ltrim_colon_completions >/dev/null; then
+			__ltrim_colon_completions "$cur"
+		fi
+	else
+		compopt -o nospace 2>/dev/null
+		COMPREPLY=($(compgen -d -- "$cur"))
+	fi
+}
+
+_umoci() {
+	local cur prev comp_words comp_cword
+	if declare -F _get_comp_words_by_ref >/dev/null; then
+		_get_comp_words_by_ref -n =: -c cur -p prev -w comp_words -i comp_cword
+	else
+		comp_words=("${COMP_WORDS[@]}")
+		comp_cword=$COMP_CWORD
+		cur="${comp_words[comp_cword]}"
+		prev="${comp_words[comp_cword-1]}"
+	fi
+
+	# Figure out which (sub)command is being completed, skipping any flags and
+	# their arguments.
+	local cmd="" word i
+	for ((i = 1; i < comp_cword; i++)); do
+		word="${comp_words[i]}"
+		case "$word" in
+		{{join (dashed .ValueFlags) "|"}})
+			((i++))
+			;;
+		-*)
+			;;
+		*)
+			case "$cmd" in
+			"")
+				cmd="$word"
+				;;
+{{- range .AllCommands}}{{if .Subcommands}}
+			{{patterns .Path}})
+				cmd="$cmd $word"
+				;;
+{{- end}}{{end}}
+			esac
+			;;
+		esac
+	done
+
+	case "$prev" in
+	--image)
+		_umoci_image "$cur"
+		return
+		;;
+	--layout)
+		COMPREPLY=($(compgen -d -- "$cur"))
+		return
+		;;
+	--log)
+		COMPREPLY=($(compgen -W "debug info warn error fatal" -- "$cur"))
+		return
+		;;
+	{{join (dashed .ValueFlags) "|"}})
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	esac
+
+	local flags="" subcommands=""
+	case "$cmd" in
+	"")
+		flags="{{allFlags .Flags}}"
+		subcommands="{{names .Commands}}"
+		;;
+{{- range .AllCommands}}
+	{{patterns .Path}})
+		flags="{{allFlags .Flags}}"
+		subcommands="{{names .Subcommands}}"
+		;;
+{{- end}}
+	esac
+
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	elif [[ -n "$subcommands" ]]; then
+		COMPREPLY=($(compgen -W "$subcommands" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+
+complete -F _umoci umoci
+`
+
+// The zsh completion uses the bash completion through bashcompinit, since the
+// argument handling is identical.
+const zshCompletionTemplate = `#compdef umoci
+# zsh completion for umoci.
+# Generated by "umoci completion zsh".
+
+autoload -U +X bashcompinit && bashcompinit
+
+` + bashCompletionTemplate
+
+const fishCompletionTemplate = `# fish completion for umoci.
+# Generated by "umoci completion fish".
+
+# __umoci_image completes an --image argument, which is either a directory or
+# (once a ':' has been typed) a tag in the image at that path.
+function __umoci_image
+	set -l cur (commandline -ct | string replace -r -- '^--[a-z-]+=' '')
+	if string match -q -- '*:*' $cur
+		set -l path (string split -m1 -- ':' $cur)[1]
+		for tag in (umoci ls --layout $path 2>/dev/null)
+			echo "$path:$tag"
+		end
+	else
+		__fish_complete_directories $cur
+	end
+end
+
+{{define "fishFlags"}}{{$cond := .Cond}}{{range .Flags -}}
+complete -c umoci -n {{fishQuote $cond}}{{range .Names}}{{if eq (len .) 1}} -s {{.}}{{else}} -l {{.}}{{end}}{{end}}
+{{- if .TakesValue}}{{if eq (index .Names 0) "image"}} -x -a '(__umoci_image)'{{else if eq (index .Names 0) "layout"}} -x -a '(__fish_complete_directories)'{{else if eq (index .Names 0) "log"}} -x -a 'debug info warn error fatal'{{else}} -r{{end}}{{end}}{{if .Usage}} -d {{fishQuote .Usage}}{{end}}
+{{end}}{{end -}}
+
+{{template "fishFlags" (fishFlags "__fish_use_subcommand" .Flags)}}
+{{- range .Commands}}
+complete -c umoci -f -n '__fish_use_subcommand' -a {{fishQuote (join (last .Path) " ")}} -d {{fishQuote .Usage}}
+{{- end}}
+{{range .AllCommands}}
+{{- range .Subcommands}}
+complete -c umoci -f -n {{fishQuote (printf "%s; and not __fish_seen_subcommand_from %s" (fishSeen (parent .Path)) (join (last .Path) " "))}} -a {{fishQuote (join (last .Path) " ")}} -d {{fishQuote .Usage}}
+{{- end}}
+{{template "fishFlags" (fishFlags (fishSeen .Path) .Flags)}}
+{{- end}}`
+
+// completionTemplates maps shell names to their completion templates.
+var completionTemplates = map[string]string{
+	"bash": bashCompletionTemplate,
+	"zsh":  zshCompletionTemplate,
+	"fish": fishCompletionTemplate,
+}
+
+func completion(ctx *cli.Context) error {
+	shell := ctx.Args().First()
+
+	tmpl, err := template.New(shell).Funcs(completionFuncs).Parse(completionTemplates[shell])
+	if err != nil {
+		// Should _never_ be reached.
+		return errors.Wrapf(err, "[internal error] parse %s completion template", shell)
+	}
+
+	data := completionData{
+		Flags:    toCompletionFlags(ctx.App.Flags),
+		Commands: toCompletionCommands(nil, ctx.App.Commands),
+	}
+	return errors.Wrap(tmpl.Execute(os.Stdout, data), "generate completion")
+}
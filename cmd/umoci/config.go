@@ -18,6 +18,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"strings"
 	"time"
 
@@ -26,6 +29,9 @@ import (
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/shlex"
+	"github.com/openSUSE/umoci/third_party/user"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -43,7 +49,30 @@ Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
 the tagged image from which the config modifications will be based (if not
 specified, it defaults to "latest"). "<new-tag>" is the new reference name to
 save the new image as, if this is not specified then umoci will replace the old
-image.`,
+image.
+
+The user and group names in --config.user must exist in the /etc/passwd and
+/etc/group files of the image (numeric ids are accepted regardless), otherwise
+the image would fail to start. Use --no-user-check to skip this check.
+
+--config.entrypoint.string and --config.cmd.string set the entrypoint and
+command from a single value, which is either in the exec form of a Dockerfile
+(a JSON array of strings, such as '["/bin/sh", "-c", "echo $HOME"]') or a
+command line which is split into words using the quoting rules of sh(1). No
+shell is involved, so command lines containing unquoted shell operators (such
+as "|" or ";") or expansions (such as "$HOME") are rejected -- use the exec
+form with an explicit shell for those. With --strict-exec-form only the exec
+form is accepted.
+
+--rootfs.type sets the type of the root filesystem recorded in the image
+configuration. The image-spec only defines the "layers" type, so other types
+should only be used for interoperability with tools which require them.
+
+--extension sets a top-level field of the image configuration which is not
+defined by the image-spec (such as fields added by other tools), given as
+"<name>=<json-value>". Such fields are preserved when the configuration is
+modified, and --clear=extensions removes all of them. They are displayed by
+umoci-stat(1).`,
 
 	// config modifies a particular image manifest.
 	Category: "image",
@@ -59,27 +88,64 @@ image.`,
 		return nil
 	},
 
-	Flags: []cli.Flag{
-		cli.StringFlag{Name: "config.user"},
-		cli.StringSliceFlag{Name: "config.exposedports"},
-		cli.StringSliceFlag{Name: "config.env"},
-		cli.StringSliceFlag{Name: "config.entrypoint"}, // FIXME: This interface is weird.
-		cli.StringSliceFlag{Name: "config.cmd"},        // FIXME: This interface is weird.
-		cli.StringSliceFlag{Name: "config.volume"},
-		cli.StringSliceFlag{Name: "config.label"},
-		cli.StringFlag{Name: "config.workingdir"},
-		cli.StringFlag{Name: "config.stopsignal"},
-		cli.StringFlag{Name: "created"}, // FIXME: Implement TimeFlag.
-		cli.StringFlag{Name: "author"},
-		cli.StringFlag{Name: "architecture"},
-		cli.StringFlag{Name: "os"},
-		cli.StringSliceFlag{Name: "manifest.annotation"},
-		cli.StringSliceFlag{Name: "clear"},
-	},
+	Flags: append(configFlags, noUserCheckFlag, strictExecFormFlag, cli.BoolFlag{
+		Name:  "strict",
+		Usage: "validate the new image against the image-spec before tagging it",
+	}),
 
 	Action: config,
 }))
 
+// configFlags are the flags used to modify the image configuration, which are
+// shared by umoci-config(1) and umoci-insert(1). They are applied with
+// applyConfigFlags.
+var configFlags = []cli.Flag{
+	cli.StringFlag{Name: "config.user"},
+	cli.StringSliceFlag{Name: "config.exposedports"},
+	cli.StringSliceFlag{Name: "config.env"},
+	cli.StringSliceFlag{Name: "config.entrypoint"}, // FIXME: This interface is weird.
+	cli.StringSliceFlag{Name: "config.cmd"},        // FIXME: This interface is weird.
+	cli.StringFlag{Name: "config.entrypoint.string"},
+	cli.StringFlag{Name: "config.cmd.string"},
+	cli.StringSliceFlag{Name: "config.volume"},
+	cli.StringSliceFlag{Name: "config.label"},
+	cli.StringFlag{Name: "config.workingdir"},
+	cli.StringFlag{Name: "config.stopsignal"},
+	cli.StringFlag{Name: "created"}, // FIXME: Implement TimeFlag.
+	cli.StringFlag{Name: "author"},
+	cli.StringFlag{Name: "architecture"},
+	cli.StringFlag{Name: "os"},
+	cli.StringSliceFlag{Name: "manifest.annotation"},
+	cli.StringFlag{Name: "rootfs.type"},
+	cli.StringSliceFlag{Name: "extension"},
+	cli.StringSliceFlag{Name: "clear"},
+}
+
+// noUserCheckFlag disables the check (done by checkConfigUser) that the
+// --config.user given to umoci-config(1) and umoci-insert(1) exists.
+var noUserCheckFlag = cli.BoolFlag{
+	Name:  "no-user-check",
+	Usage: "do not check that the user and group in --config.user exist in the image",
+}
+
+// strictExecFormFlag requires the --config.entrypoint.string and
+// --config.cmd.string given to umoci-config(1) and umoci-insert(1) to be in
+// the exec form.
+var strictExecFormFlag = cli.BoolFlag{
+	Name:  "strict-exec-form",
+	Usage: "only accept --config.entrypoint.string and --config.cmd.string in the exec form (a JSON array)",
+}
+
+// configFlagsSet returns whether any of configFlags were specified.
+func configFlagsSet(ctx *cli.Context) bool {
+	for _, flag := range configFlags {
+		if ctx.IsSet(flag.GetName()) {
+			return true
+		}
+	}
+	return false
+}
+
 func toImage(config ispec.ImageConfig, meta mutate.Meta) ispec.Image {
 	created := meta.Created
 	return ispec.Image{
@@ -104,6 +170,58 @@ func fromImage(image ispec.Image) (ispec.ImageConfig, mutate.Meta) {
 	}
 }
 
+// newConfigGenerator returns a generator for the current configuration of the
+// mutator, including the rootfs.type and extensions of the configuration
+// (which are not part of the ispec.ImageConfig and mutate.Meta used by
+// mutate.Mutator.Set).
+func newConfigGenerator(ctx context.Context, mutator *mutate.Mutator) (*igen.Generator, error) {
+	imageConfig, err := mutator.Config(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get base config")
+	}
+	imageMeta, err := mutator.Meta(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get base metadata")
+	}
+	rootfsType, err := mutator.RootfsType(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get base rootfs type")
+	}
+	extensions, err := mutator.Extensions(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get base extensions")
+	}
+
+	image := toImage(imageConfig, imageMeta)
+	image.RootFS.Type = rootfsType
+	g, err := igen.NewFromImage(image)
+	if err != nil {
+		return nil, errors.Wrap(err, "create new generator")
+	}
+	for name, value := range extensions {
+		if err := g.SetExtension(name, value); err != nil {
+			return nil, errors.Wrap(err, "set base extension")
+		}
+	}
+	return g, nil
+}
+
+// setGeneratedConfig sets the configuration of the mutator (created with
+// newConfigGenerator) to the state of the generator.
+func setGeneratedConfig(ctx context.Context, mutator *mutate.Mutator, g *igen.Generator, annotations map[string]string, history ispec.History) error {
+	newConfig, newMeta := fromImage(g.Image())
+	if err := mutator.Set(ctx, newConfig, newMeta, annotations, history); err != nil {
+		return errors.Wrap(err, "set modified configuration")
+	}
+	if err := mutator.SetRootfsType(ctx, g.RootfsType()); err != nil {
+		return errors.Wrap(err, "set modified rootfs type")
+	}
+	if err := mutator.SetExtensions(ctx, g.Extensions()); err != nil {
+		return errors.Wrap(err, "set modified extensions")
+	}
+	return nil
+}
+
 // parseEnv splits a given environment variable (of the form name=value) into
 // (name, value). An error is returned if there is no "=" in the line or if the
 // name is empty.
@@ -131,7 +249,7 @@ func config(ctx *cli.Context) error {
 	}
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -152,26 +270,118 @@ func config(ctx *cli.Context) error {
 		return errors.Wrap(err, "create mutator for manifest")
 	}
 
-	imageConfig, err := mutator.Config(context.Background())
+	annotations, err := mutator.Annotations(context.Background())
 	if err != nil {
-		return errors.Wrap(err, "get base config")
+		return errors.Wrap(err, "get base annotations")
 	}
 
-	imageMeta, err := mutator.Meta(context.Background())
+	g, err := newConfigGenerator(context.Background(), mutator)
 	if err != nil {
-		return errors.Wrap(err, "get base metadata")
+		return err
 	}
 
-	annotations, err := mutator.Annotations(context.Background())
+	annotations, err = applyConfigFlags(ctx, g, annotations)
 	if err != nil {
-		return errors.Wrap(err, "get base annotations")
+		return err
+	}
+
+	created := time.Now()
+	history := ispec.History{
+		Author:     g.Author(),
+		Comment:    "",
+		Created:    &created,
+		CreatedBy:  "umoci config",
+		EmptyLayer: true,
+	}
+
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+		history.Comment = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.created"]; ok {
+		created, err := time.Parse(igen.ISO8601, val.(string))
+		if err != nil {
+			return errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = &created
+	}
+	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+		history.CreatedBy = val.(string)
+	}
+
+	if err := setGeneratedConfig(context.Background(), mutator, g, annotations, history); err != nil {
+		return err
 	}
 
-	g, err := igen.NewFromImage(toImage(imageConfig, imageMeta))
+	// The user is checked before any blobs are written.
+	if ctx.IsSet("config.user") && !ctx.Bool("no-user-check") {
+		if err := checkConfigUser(context.Background(), engine, mutator); err != nil {
+			return errors.Wrap(err, "check --config.user")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
 	if err != nil {
-		return errors.Wrap(err, "create new generator")
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if ctx.Bool("strict") {
+		if err := engineExt.Validate(context.Background(), newDescriptorPath.Root()); err != nil {
+			return errors.Wrap(err, "validate mutated image")
+		}
 	}
 
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
+
+// checkConfigUser checks that the user in the configuration being modified by
+// the given mutator can be resolved using the /etc/passwd and /etc/group files
+// in its root filesystem (including any layers added by the mutator), in the
+// same way as when the runtime configuration is generated by umoci-unpack(1).
+func checkConfigUser(ctx context.Context, engine cas.Engine, mutator *mutate.Mutator) error {
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+
+	// Both files are read in a single pass over the layers. Missing files are
+	// treated the same way as by umoci-unpack(1).
+	files, err := layer.ReadImageFiles(ctx, engine, manifest, "/etc/passwd", "/etc/group")
+	if err != nil {
+		return errors.Wrap(err, "read /etc/passwd and /etc/group")
+	}
+	var passwd, group io.Reader
+	if data, ok := files["/etc/passwd"]; ok {
+		passwd = bytes.NewReader(data)
+	}
+	if data, ok := files["/etc/group"]; ok {
+		group = bytes.NewReader(data)
+	}
+	execUser, err := user.GetExecUser(config.User, nil, passwd, group)
+	if err != nil {
+		return errors.Wrapf(err, "resolve user %q", config.User)
+	}
+	log.Debugf("resolved user %q to %d:%d", config.User, execUser.Uid, execUser.Gid)
+	return nil
+}
+
+// applyConfigFlags applies the modifications given by configFlags to the
+// given image configuration generator and manifest annotations, and returns
+// the modified annotations.
+func applyConfigFlags(ctx *cli.Context, g *igen.Generator, annotations map[string]string) (map[string]string, error) {
 	if ctx.IsSet("clear") {
 		for _, key := range ctx.StringSlice("clear") {
 			switch key {
@@ -187,13 +397,15 @@ func config(ctx *cli.Context) error {
 				g.ClearConfigVolumes()
 			case "rootfs.diffids":
 				//g.ClearRootfsDiffIDs()
-				return errors.Errorf("--clear=rootfs.diffids is not safe")
+				return nil, errors.Errorf("--clear=rootfs.diffids is not safe")
 			case "config.cmd":
 				g.ClearConfigCmd()
 			case "config.entrypoint":
 				g.ClearConfigEntrypoint()
+			case "extensions":
+				g.ClearExtensions()
 			default:
-				return errors.Errorf("unknown key to --clear: %s", key)
+				return nil, errors.Errorf("unknown key to --clear: %s", key)
 			}
 		}
 	}
@@ -202,7 +414,7 @@ func config(ctx *cli.Context) error {
 		// How do we handle other formats?
 		created, err := time.Parse(igen.ISO8601, ctx.String("created"))
 		if err != nil {
-			return errors.Wrap(err, "parse --created")
+			return nil, errors.Wrap(err, "parse --created")
 		}
 		g.SetCreated(created)
 	}
@@ -233,7 +445,7 @@ func config(ctx *cli.Context) error {
 		for _, env := range ctx.StringSlice("config.env") {
 			name, value, err := parseEnv(env)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			g.AddConfigEnv(name, value)
 		}
@@ -246,6 +458,24 @@ func config(ctx *cli.Context) error {
 	if ctx.IsSet("config.cmd") {
 		g.SetConfigCmd(ctx.StringSlice("config.cmd"))
 	}
+	for _, field := range []string{"config.entrypoint", "config.cmd"} {
+		flag := field + ".string"
+		if !ctx.IsSet(flag) {
+			continue
+		}
+		if ctx.IsSet(field) {
+			return nil, errors.Errorf("--%s cannot be used with --%s", flag, field)
+		}
+		args, err := shlex.ParseCommand(ctx.String(flag), ctx.Bool("strict-exec-form"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse --%s", flag)
+		}
+		if field == "config.entrypoint" {
+			g.SetConfigEntrypoint(args)
+		} else {
+			g.SetConfigCmd(args)
+		}
+	}
 	if ctx.IsSet("config.volume") {
 		for _, volume := range ctx.StringSlice("config.volume") {
 			g.AddConfigVolume(volume)
@@ -257,6 +487,27 @@ func config(ctx *cli.Context) error {
 			g.AddConfigLabel(parts[0], parts[1])
 		}
 	}
+	if ctx.IsSet("rootfs.type") {
+		rootfsType := ctx.String("rootfs.type")
+		if rootfsType == "" {
+			return nil, errors.Errorf("--rootfs.type cannot be empty")
+		}
+		if rootfsType != "layers" {
+			log.Warnf("rootfs.type %q is not defined by the image-spec: the image may not be usable by other tools", rootfsType)
+		}
+		g.SetRootfsType(rootfsType)
+	}
+	if ctx.IsSet("extension") {
+		for _, extension := range ctx.StringSlice("extension") {
+			parts := strings.SplitN(extension, "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("--extension must contain '=': %s", extension)
+			}
+			if err := g.SetExtension(parts[0], json.RawMessage(parts[1])); err != nil {
+				return nil, errors.Wrap(err, "parse --extension")
+			}
+		}
+	}
 	if ctx.IsSet("manifest.annotation") {
 		if annotations == nil {
 			annotations = map[string]string{}
@@ -266,49 +517,5 @@ func config(ctx *cli.Context) error {
 			annotations[parts[0]] = parts[1]
 		}
 	}
-
-	created := time.Now()
-	history := ispec.History{
-		Author:     g.Author(),
-		Comment:    "",
-		Created:    &created,
-		CreatedBy:  "umoci config",
-		EmptyLayer: true,
-	}
-
-	if val, ok := ctx.App.Metadata["--history.author"]; ok {
-		history.Author = val.(string)
-	}
-	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
-		history.Comment = val.(string)
-	}
-	if val, ok := ctx.App.Metadata["--history.created"]; ok {
-		created, err := time.Parse(igen.ISO8601, val.(string))
-		if err != nil {
-			return errors.Wrap(err, "parsing --history.created")
-		}
-		history.Created = &created
-	}
-	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
-		history.CreatedBy = val.(string)
-	}
-
-	newConfig, newMeta := fromImage(g.Image())
-	if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
-		return errors.Wrap(err, "set modified configuration")
-	}
-
-	newDescriptorPath, err := mutator.Commit(context.Background())
-	if err != nil {
-		return errors.Wrap(err, "commit mutated image")
-	}
-
-	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
-
-	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
-		return errors.Wrap(err, "add new tag")
-	}
-
-	log.Infof("created new tag for image manifest: %s", tagName)
-	return nil
+	return annotations, nil
 }
@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var convertCommand = uxTag(cli.Command{
+	Name:  "convert",
+	Usage: "converts an image between the OCI and Docker manifest formats",
+	ArgsUsage: `--image <image-path>[:<tag>] --to <format> [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to convert, and "<format>" is either "oci" or "docker".
+
+The media types of the manifest (or index, along with every manifest it
+references) and of the configuration and layers it references are rewritten to
+use the given format, and "<new-tag>" (which defaults to "<tag>") is updated to
+refer to the converted image. The contents of the configuration and layers are
+not modified. Images using Docker (version 2, schema 2) media types can be
+used by most umoci commands, but converting them to OCI media types allows
+them to be used by OCI-only tools, while converting images to Docker media
+types allows them to be pushed to older registries.
+
+Layers which have no Docker equivalent (such as zstd-compressed layers) cannot
+be converted to the Docker format.`,
+
+	// convert creates a new image, with a given tag.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "format to convert the image to (oci or docker)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("to") {
+			return errors.Errorf("missing mandatory argument: --to")
+		}
+		if _, err := casext.ParseManifestFormat(ctx.String("to")); err != nil {
+			return errors.Wrap(err, "invalid --to")
+		}
+		return nil
+	},
+
+	Action: convert,
+})
+
+func convert(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	format, _ := casext.ParseManifestFormat(ctx.String("to"))
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+	root := descriptorPaths[0].Root()
+
+	converted, err := engineExt.ConvertManifest(context.Background(), root, format)
+	if err != nil {
+		return errors.Wrap(err, "convert image")
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, converted); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"mediatype": converted.MediaType,
+		"digest":    converted.Digest,
+	}).Infof("converted %s to %s format: %s", fromName, format, tagName)
+	return nil
+}
@@ -0,0 +1,470 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/apex/log"
+	logcli "github.com/apex/log/handlers/cli"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// daemonCommands are the commands which can be run by umoci-daemon(1), along
+// with the flags of each command which are paths. Relative paths are resolved
+// against the directory of the client (see daemonBefore).
+var daemonCommands = map[string][]string{
+	"unpack": {"into-existing-snapshot", "mtree-output", "keep-blobs", "scan-report"},
+	"repack": {"prefetch-profile", "mtree", "scan-report"},
+	"config": nil,
+	"gc":     nil,
+}
+
+// daemonSocketFlag is the --socket flag of the umoci-daemon(1) subcommands.
+var daemonSocketFlag = cli.StringFlag{
+	Name:   "socket",
+	Usage:  "path of the unix socket of the daemon",
+	EnvVar: "UMOCI_DAEMON_SOCKET",
+}
+
+var daemonSubcommand = cli.Command{
+	Name:  "daemon",
+	Usage: "runs umoci commands in a long-running process",
+	ArgsUsage: `daemon <command> [<args>...]
+
+The umoci-daemon(1) subcommands allow a single long-running umoci process to
+run the umoci-unpack(1), umoci-repack(1), umoci-config(1) and umoci-gc(1)
+commands on behalf of clients, so that build systems which run many commands
+don't pay the cost of starting umoci (and opening the blob and layer caches)
+for each one. The daemon is started with umoci-daemon-start(1), and commands
+are run by it with umoci-daemon-exec(1).`,
+
+	Subcommands: []cli.Command{
+		daemonStartCommand,
+		daemonExecCommand,
+	},
+}
+
+var daemonStartCommand = cli.Command{
+	Name:  "start",
+	Usage: "starts a daemon listening on a unix socket",
+	ArgsUsage: `--socket <path>
+
+Where "<path>" is the path of the unix socket the daemon will listen on (which
+is only accessible by the user running the daemon). The daemon runs until it
+is sent SIGINT or SIGTERM.
+
+The global --log, --max-json-size, --blob-cache and --layer-cache options
+given to "umoci daemon start" apply to every command run by the daemon, and
+the caches are kept open for the lifetime of the daemon (as are images, unless
+they have a session in progress). Commands are run one at a time, as the user
+running the daemon.`,
+
+	Flags: []cli.Flag{daemonSocketFlag},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("socket") == "" {
+			return errors.Errorf("missing mandatory argument: --socket")
+		}
+		return nil
+	},
+
+	Action: daemonStart,
+}
+
+var daemonExecCommand = cli.Command{
+	Name:  "exec",
+	Usage: "runs a command using a daemon",
+	ArgsUsage: `--socket <path> <command> [<args>...]
+
+Where "<path>" is the path of the unix socket of a daemon started with
+umoci-daemon-start(1), and "<command>" is one of "unpack", "repack", "config"
+or "gc". The command is run by the daemon with the given arguments (relative
+paths are resolved against the current directory), and its output and log
+messages are written to stderr.`,
+
+	Flags: []cli.Flag{daemonSocketFlag},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <command>")
+		}
+		if ctx.String("socket") == "" {
+			return errors.Errorf("missing mandatory argument: --socket")
+		}
+		return nil
+	},
+
+	Action: daemonExec,
+}
+
+// DaemonRequest is a request to run a command by umoci-daemon(1).
+type DaemonRequest struct {
+	// Args are the arguments of the command, starting with its name.
+	Args []string
+
+	// Dir is the (absolute) directory which relative paths given to the
+	// command are resolved against.
+	Dir string
+}
+
+// DaemonResponse is the result of a DaemonRequest.
+type DaemonResponse struct {
+	// Stdout and Stderr are the output of the command.
+	Stdout string
+	Stderr string
+
+	// Log is the log output of the command.
+	Log string
+
+	// Error is the error returned by the command, if it failed.
+	Error string
+}
+
+// Daemon is the RPC service provided by umoci-daemon(1).
+type Daemon struct {
+	// mu is held while running a command (and protects engines). Commands
+	// have to be run one at a time because the logger of apex/log (and its
+	// level) is global to the process and is set by each command, so the log
+	// output of concurrent commands could not be returned to the right
+	// client.
+	mu sync.Mutex
+
+	// globalArgs are the global options given to each command.
+	globalArgs []string
+
+	// blobCache and layerCache are the caches used by every command (or nil
+	// if they are not enabled).
+	blobCache  cas.Engine
+	layerCache *layer.LayerCache
+
+	// engines are the images opened by earlier commands.
+	engines *daemonEngines
+}
+
+// Run runs the command described by req, and stores its output in resp. An
+// error is only returned if the command could not be run at all.
+func (d *Daemon) Run(req DaemonRequest, resp *DaemonResponse) error {
+	if len(req.Args) == 0 {
+		return errors.Errorf("missing command")
+	}
+	if _, ok := daemonCommands[req.Args[0]]; !ok {
+		return errors.Errorf("command %q cannot be run by the daemon", req.Args[0])
+	}
+	if !filepath.IsAbs(req.Dir) {
+		return errors.Errorf("directory %q is not absolute", req.Dir)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var stdout, stderr, logs bytes.Buffer
+	app := newApp()
+	app.Writer = &stdout
+	app.ErrWriter = &stderr
+	app.Metadata["--daemon.dir"] = req.Dir
+	app.Metadata["--daemon.log"] = &logs
+	app.Metadata["--daemon.engines"] = d.engines
+	if d.blobCache != nil {
+		app.Metadata["--daemon.blob-cache"] = sharedEngine{d.blobCache}
+	}
+	if d.layerCache != nil {
+		app.Metadata["--daemon.layer-cache"] = d.layerCache
+	}
+	for i, cmd := range app.Commands {
+		if cmd.Name == req.Args[0] {
+			app.Commands[i].Before = daemonBefore(cmd, req.Dir)
+		}
+	}
+
+	log.Infof("daemon: running %v in %s", req.Args, req.Dir)
+	args := append([]string{"umoci"}, d.globalArgs...)
+	err := app.Run(append(args, req.Args...))
+	// The command replaced the logger of the daemon.
+	log.SetHandler(logcli.New(os.Stderr))
+
+	resp.Stdout = stdout.String()
+	resp.Stderr = stderr.String()
+	resp.Log = logs.String()
+	if err != nil {
+		log.Infof("daemon: %v failed: %v", req.Args, err)
+		resp.Error = err.Error()
+	}
+	return nil
+}
+
+// daemonBefore wraps the Before of the given command so that the relative
+// paths given to it are resolved against dir (the directory of the client)
+// rather than the directory of the daemon.
+func daemonBefore(cmd cli.Command, dir string) cli.BeforeFunc {
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) || cas.URIScheme(path) != "" {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	oldBefore := cmd.Before
+	return func(ctx *cli.Context) error {
+		for _, name := range daemonCommands[cmd.Name] {
+			if ctx.IsSet(name) {
+				if err := ctx.Set(name, resolve(ctx.String(name))); err != nil {
+					return errors.Wrapf(err, "resolve --%s", name)
+				}
+			}
+		}
+		if oldBefore != nil {
+			if err := oldBefore(ctx); err != nil {
+				return err
+			}
+		}
+		// The image path (which can have a tag) and the bundle are only
+		// known once the Before of the command has parsed them.
+		for _, key := range []string{"--image-path", "bundle"} {
+			if path, ok := ctx.App.Metadata[key].(string); ok {
+				ctx.App.Metadata[key] = resolve(path)
+			}
+		}
+		return nil
+	}
+}
+
+// daemonEngines are the images kept open by umoci-daemon(1) between commands,
+// so that they don't have to be opened (and validated) by every command.
+type daemonEngines struct {
+	engines map[string]daemonEngine
+}
+
+// daemonEngine is an image kept open by daemonEngines.
+type daemonEngine struct {
+	engine cas.Engine
+
+	// dir is the image directory when the image was opened, so that images
+	// which have since been replaced are opened again.
+	dir os.FileInfo
+}
+
+// open returns the image at the given path, opening it if it isn't already
+// open. Images with a session in progress are opened by every command, as
+// the session can be committed or aborted by other processes (see
+// umoci-begin(1)).
+func (d *daemonEngines) open(path string, opt cas.OpenOptions) (cas.Engine, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		d.forget(path)
+		return cas.OpenWithOptions(path, opt)
+	}
+	if inSession, err := dir.InSession(path); err != nil || inSession {
+		d.forget(path)
+		return cas.OpenWithOptions(path, opt)
+	}
+
+	if cached, ok := d.engines[path]; ok && os.SameFile(fi, cached.dir) {
+		return sharedEngine{cached.engine}, nil
+	}
+	d.forget(path)
+
+	engine, err := cas.OpenWithOptions(path, opt)
+	if err != nil {
+		return nil, err
+	}
+	d.engines[path] = daemonEngine{engine: engine, dir: fi}
+	return sharedEngine{engine}, nil
+}
+
+// forget closes the image at the given path, if it is open.
+func (d *daemonEngines) forget(path string) {
+	if cached, ok := d.engines[path]; ok {
+		if err := cached.engine.Close(); err != nil {
+			log.Warnf("daemon: close image %s: %v", path, err)
+		}
+		delete(d.engines, path)
+	}
+}
+
+// Close closes every open image.
+func (d *daemonEngines) Close() error {
+	for path := range d.engines {
+		d.forget(path)
+	}
+	return nil
+}
+
+// sharedEngine is a cas.Engine which is shared by several users, and so is
+// not closed by Close.
+type sharedEngine struct {
+	cas.Engine
+}
+
+// Close does nothing.
+func (sharedEngine) Close() error {
+	return nil
+}
+
+// LockIndex locks the index of the shared engine.
+func (e sharedEngine) LockIndex(ctx context.Context) (func() error, error) {
+	return cas.LockIndex(ctx, e.Engine)
+}
+
+// NewerVersionPolicy returns the policy of the shared engine.
+func (e sharedEngine) NewerVersionPolicy() cas.NewerVersionPolicy {
+	return cas.GetNewerVersionPolicy(e.Engine)
+}
+
+// listenDaemon listens on the unix socket at the given path. Sockets left
+// behind by a daemon which is no longer running are replaced.
+func listenDaemon(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.Errorf("a daemon is already listening on %s", path)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s already exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "remove stale socket")
+		}
+	}
+
+	// Only the user running the daemon should be able to use it.
+	oldMask := system.SetUmask(0077)
+	listener, err := net.Listen("unix", path)
+	system.SetUmask(oldMask)
+	return listener, errors.Wrap(err, "listen")
+}
+
+func daemonStart(ctx *cli.Context) error {
+	daemon := &Daemon{
+		globalArgs: []string{
+			"--log", ctx.GlobalString("log"),
+			"--max-json-size", ctx.GlobalString("max-json-size"),
+			"--newer-versions", openOptions(ctx).NewerVersions.String(),
+		},
+		layerCache: openLayerCache(ctx),
+		engines:    &daemonEngines{engines: map[string]daemonEngine{}},
+	}
+	defer daemon.engines.Close()
+	// Each command is exported as its own trace.
+	if endpoint := ctx.GlobalString("trace-endpoint"); endpoint != "" {
+		daemon.globalArgs = append(daemon.globalArgs, "--trace-endpoint", endpoint)
+	}
+	if cachePath, ok := ctx.App.Metadata["--blob-cache"].(string); ok {
+		cache, err := openBlobCache(cachePath)
+		if err != nil {
+			return errors.Wrap(err, "open blob cache")
+		}
+		defer cache.Close()
+		daemon.blobCache = cache
+	}
+
+	server := rpc.NewServer()
+	if err := server.Register(daemon); err != nil {
+		return errors.Wrap(err, "register service")
+	}
+
+	listener, err := listenDaemon(ctx.String("socket"))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	// Stop accepting connections when we are told to stop. Commands which are
+	// already running are not interrupted.
+	var (
+		stopping bool
+		stopMu   sync.Mutex
+	)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		log.Infof("daemon: received %v, stopping", sig)
+		stopMu.Lock()
+		stopping = true
+		stopMu.Unlock()
+		listener.Close()
+	}()
+
+	log.Infof("daemon: listening on %s", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			stopMu.Lock()
+			defer stopMu.Unlock()
+			if stopping {
+				// Wait for the running command (if any) to finish.
+				daemon.mu.Lock()
+				defer daemon.mu.Unlock()
+				return nil
+			}
+			return errors.Wrap(err, "accept")
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+func daemonExec(ctx *cli.Context) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return errors.Wrap(err, "get current directory")
+	}
+
+	client, err := jsonrpc.Dial("unix", ctx.String("socket"))
+	if err != nil {
+		return errors.Wrap(err, "connect to daemon")
+	}
+	defer client.Close()
+
+	req := DaemonRequest{
+		Args: ctx.Args(),
+		Dir:  dir,
+	}
+	var resp DaemonResponse
+	if err := client.Call("Daemon.Run", req, &resp); err != nil {
+		return errors.Wrap(err, "run command")
+	}
+	os.Stdout.WriteString(resp.Stdout)
+	os.Stderr.WriteString(resp.Log)
+	os.Stderr.WriteString(resp.Stderr)
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
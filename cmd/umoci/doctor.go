@@ -0,0 +1,329 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var doctorCommand = cli.Command{
+	Name:  "doctor",
+	Usage: "checks which umoci features will work in this environment",
+	ArgsUsage: `[<path>]
+
+Where "<path>" is a directory on the filesystem which images will be unpacked
+to (the current directory if not provided).
+
+The environment is probed to find out whether umoci has the privileges it
+needs to act as root, whether user namespaces can be created (and whether
+newuidmap(1) and newgidmap(1) are available to map more than one id in them),
+whether overlayfs is supported, and whether the filesystem containing "<path>"
+supports extended attributes, reflinks and long file names. The results of the
+probes are then used to report which umoci features will work.
+
+A failed probe is not an error: umoci will still work, but without the
+features which depend on it (for instance --rootless must be used if umoci
+cannot act as root).
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the report as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() > 1 {
+			return errors.Errorf("invalid number of positional arguments: expected [<path>]")
+		}
+		return nil
+	},
+
+	Action: doctor,
+}
+
+// doctorProbe is the result of probing the environment for something umoci
+// depends on.
+type doctorProbe struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// doctorFeature describes whether a umoci feature will work, based on the
+// probes it requires.
+type doctorFeature struct {
+	Name      string   `json:"name"`
+	Available bool     `json:"available"`
+	Requires  []string `json:"requires,omitempty"`
+}
+
+// doctorReport is the report output by umoci-doctor(1).
+type doctorReport struct {
+	Path     string          `json:"path"`
+	Probes   []doctorProbe   `json:"probes"`
+	Features []doctorFeature `json:"features"`
+}
+
+// doctorFeatures are the umoci features reported by umoci-doctor(1), and the
+// names of the probes they require.
+var doctorFeatures = []struct {
+	name     string
+	requires []string
+}{
+	// Unpacking and repacking without --rootless.
+	{"unpack", []string{"capabilities"}},
+	{"unpack-rootless", nil},
+	{"reflink-duplicates", []string{"reflink"}},
+	// Extracting user.* and trusted.* xattrs from layers.
+	{"user-xattrs", []string{"xattrs"}},
+	{"trusted-xattrs", []string{"capabilities", "trusted-xattrs"}},
+	{"long-file-names", []string{"name-max"}},
+	{"build-run", []string{"capabilities", "chroot"}},
+	// Running bundles created with --rootless, with a single id or with
+	// every id of the image mapped.
+	{"rootless-containers", []string{"userns"}},
+	{"rootless-containers-multi-id", []string{"userns", "newidmap"}},
+}
+
+// probeCapabilities checks whether umoci can act as root when unpacking and
+// repacking images (see rootlessCapabilities).
+func probeCapabilities() doctorProbe {
+	probe := doctorProbe{Name: "capabilities"}
+	caps, err := system.EffectiveCapabilities()
+	if err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	var missing []string
+	for _, feature := range []string{"chown", "dac-override", "fowner", "mknod"} {
+		if !caps.Has(rootlessCapabilities[feature]) {
+			missing = append(missing, feature)
+		}
+	}
+	switch {
+	case os.Geteuid() != 0:
+		probe.Detail = fmt.Sprintf("not running as root (euid %d)", os.Geteuid())
+	case len(missing) > 0:
+		probe.Detail = "missing capabilities: " + strings.Join(missing, ", ")
+	default:
+		probe.Ok = true
+	}
+	return probe
+}
+
+// probeCapability checks whether umoci has the given capability.
+func probeCapability(name string, capability system.Capability) doctorProbe {
+	probe := doctorProbe{Name: name}
+	caps, err := system.EffectiveCapabilities()
+	if err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	probe.Ok = caps.Has(capability)
+	if !probe.Ok {
+		probe.Detail = "missing capability"
+	}
+	return probe
+}
+
+// probeNewIDMap checks whether newuidmap(1) and newgidmap(1) are installed
+// and privileged (either setuid or with file capabilities), which is needed to
+// map more than one id into a rootless container.
+func probeNewIDMap() doctorProbe {
+	probe := doctorProbe{Name: "newidmap"}
+	var problems []string
+	for _, binary := range []string{"newuidmap", "newgidmap"} {
+		path, err := exec.LookPath(binary)
+		if err != nil {
+			problems = append(problems, binary+" not found")
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if fi.Mode()&os.ModeSetuid == 0 {
+			if _, err := system.Lgetxattr(path, "security.capability"); err != nil {
+				problems = append(problems, path+" is neither setuid nor has file capabilities")
+			}
+		}
+	}
+	probe.Ok = len(problems) == 0
+	probe.Detail = strings.Join(problems, ", ")
+	return probe
+}
+
+// probeOverlay checks whether the kernel supports overlayfs. No umoci feature
+// depends on it, but container runtimes using bundles unpacked by umoci often
+// do. The overlay module may be loaded on demand, so this can give false
+// negatives.
+func probeOverlay() doctorProbe {
+	probe := doctorProbe{Name: "overlay"}
+	fh, err := os.Open("/proc/filesystems")
+	if err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+			probe.Ok = true
+			return probe
+		}
+	}
+	probe.Detail = "overlay is not in /proc/filesystems (the module may not be loaded)"
+	return probe
+}
+
+// probeXattr checks whether an extended attribute with the given name can be
+// set on a file in the given directory.
+func probeXattr(probeName, dir, name string) doctorProbe {
+	probe := doctorProbe{Name: probeName}
+	fh, err := ioutil.TempFile(dir, ".umoci-doctor-")
+	if err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if err := system.Lsetxattr(fh.Name(), name, []byte("umoci"), 0); err != nil {
+		probe.Detail = fmt.Sprintf("cannot set %s: %v", name, err)
+		return probe
+	}
+	probe.Ok = true
+	return probe
+}
+
+// probeReflink checks whether files in the given directory can be reflinked.
+func probeReflink(dir string) doctorProbe {
+	probe := doctorProbe{Name: "reflink"}
+	src, err := ioutil.TempFile(dir, ".umoci-doctor-")
+	if err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, ".umoci-doctor-")
+	if err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if _, err := src.Write([]byte("umoci")); err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	if err := system.Clonefile(dst.Fd(), src.Fd()); err != nil {
+		probe.Detail = err.Error()
+		return probe
+	}
+	probe.Ok = true
+	return probe
+}
+
+func doctor(ctx *cli.Context) error {
+	dir := ctx.Args().First()
+	if dir == "" {
+		dir = "."
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return errors.Wrap(err, "stat target")
+	} else if !fi.IsDir() {
+		return errors.Errorf("target %s is not a directory", dir)
+	}
+
+	report := doctorReport{
+		Path: dir,
+		Probes: []doctorProbe{
+			probeCapabilities(),
+			probeCapability("chroot", system.CapSysChroot),
+			probeUserNamespaces(),
+			probeNewIDMap(),
+			probeOverlay(),
+			probeXattr("xattrs", dir, "user.umoci.doctor"),
+			probeXattr("trusted-xattrs", dir, "trusted.umoci.doctor"),
+			probeReflink(dir),
+			probeNameMax(dir),
+		},
+	}
+	probes := map[string]bool{}
+	for _, probe := range report.Probes {
+		probes[probe.Name] = probe.Ok
+	}
+	for _, feature := range doctorFeatures {
+		available := true
+		for _, probe := range feature.requires {
+			available = available && probes[probe]
+		}
+		report.Features = append(report.Features, doctorFeature{
+			Name:      feature.name,
+			Available: available,
+			Requires:  feature.requires,
+		})
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return errors.Wrap(err, "encoding report")
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "PROBE\tSTATUS\tDETAIL\n")
+	for _, probe := range report.Probes {
+		status := "ok"
+		if !probe.Ok {
+			status = "failed"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", probe.Name, status, probe.Detail)
+	}
+	fmt.Fprintf(tw, "\nFEATURE\tAVAILABLE\tREQUIRES\n")
+	for _, feature := range report.Features {
+		available := "yes"
+		if !feature.Available {
+			available = "no"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", feature.Name, available, strings.Join(feature.Requires, ", "))
+	}
+	return errors.Wrap(tw.Flush(), "output report")
+}
@@ -0,0 +1,68 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// probeUserNamespaces checks whether an unprivileged user namespace can be
+// created, by running umoci --version inside one.
+func probeUserNamespaces() doctorProbe {
+	probe := doctorProbe{Name: "userns"}
+	cmd := exec.Command("/proc/self/exe", "--version")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}},
+	}
+	if err := cmd.Run(); err != nil {
+		probe.Detail = err.Error()
+		// Give a hint as to why user namespaces are disabled.
+		for _, sysctl := range []string{"/proc/sys/user/max_user_namespaces", "/proc/sys/kernel/unprivileged_userns_clone"} {
+			if value, err := ioutil.ReadFile(sysctl); err == nil && strings.TrimSpace(string(value)) == "0" {
+				probe.Detail += fmt.Sprintf(" (%s is 0)", sysctl)
+			}
+		}
+		return probe
+	}
+	probe.Ok = true
+	return probe
+}
+
+// probeNameMax checks that the filesystem containing the given directory
+// supports file names as long as those permitted in images by common
+// filesystems (255 bytes).
+func probeNameMax(dir string) doctorProbe {
+	probe := doctorProbe{Name: "name-max"}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		probe.Detail = (&os.PathError{Op: "statfs", Path: dir, Err: err}).Error()
+		return probe
+	}
+	probe.Ok = st.Namelen >= 255
+	probe.Detail = fmt.Sprintf("name_max=%d path_max=%d", st.Namelen, unix.PathMax)
+	return probe
+}
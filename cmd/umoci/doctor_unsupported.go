@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+// probeUserNamespaces reports that user namespaces are not available, as they
+// are a Linux-only feature.
+func probeUserNamespaces() doctorProbe {
+	return doctorProbe{Name: "userns", Detail: "not supported on this platform"}
+}
+
+// probeNameMax reports that the maximum file name length cannot be checked,
+// as statfs(2) does not return it on this platform.
+func probeNameMax(dir string) doctorProbe {
+	return doctorProbe{Name: "name-max", Detail: "not supported on this platform"}
+}
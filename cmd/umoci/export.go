@@ -0,0 +1,630 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/interop"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/diskimage"
+	"github.com/openSUSE/umoci/pkg/dmverity"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "exports an image to another container tool's format",
+	ArgsUsage: `--image <image-path>[:<tag>] oci-archive:<path>|composefs:<dir>|nspawn:<path>|lxd:<path>|disk:<path>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to export, "<path>" is the path of the archive to create (or "-" to write
+the archive to stdout) and "<dir>" is the directory to write a composefs image
+to.
+
+The archive is a tar archive of an OCI image layout containing only the tagged
+image, which can be imported with "ctr images import" (for containerd), the
+"oci-archive:" transport of skopeo(1) or umoci-import(1). If --name is given,
+containerd will use it as the name of the imported image.
+
+A composefs image consists of "<dir>/image.cfs" (an EROFS image containing the
+metadata of the root filesystem, generated with mkcomposefs(1) from the
+description in "<dir>/image.dump") and an objects directory containing the
+contents of every regular file, named by their fs-verity digest. It can be
+mounted with "mount -t composefs <dir>/image.cfs -o basedir=<dir>/objects".
+
+If --composefs.dm-verity is specified, a dm-verity hash tree for
+"<dir>/image.cfs" is appended to it (in the format used by veritysetup(8)), and
+the root hash and hash offset needed by "veritysetup open" are printed.
+
+The nspawn: transport writes the root filesystem of the image as a tar archive
+(or, with --nspawn.format=directory, as a directory) which can be imported with
+"machinectl import-tar" (or "machinectl import-fs") and run with
+systemd-nspawn(1). If the image has no os-release(5) file, one describing the
+image is added as /usr/lib/os-release. With --nspawn.unit, a systemd.nspawn(5)
+file running the entrypoint of the image (with its environment, working
+directory and user) is also written.
+
+The lxd: transport writes an LXD image tarball (containing metadata.yaml,
+templates generating /etc/hostname and /etc/environment, and the root
+filesystem of the image) which can be imported with "lxc image import".
+
+The disk: transport writes a disk image for virtual machines (in raw or qcow2
+format, see --disk.format) containing the root filesystem of the image in a
+filesystem generated with mkfs.ext4(8) (or see --disk.filesystem), in a GPT
+partition (or, with --disk.partition-table=none, as the whole disk, as used by
+Firecracker). If --disk.hook is given, it is run with the extracted root
+filesystem (to install a kernel) and with the finished disk (to install a
+bootloader).`,
+
+	// export reads an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "full name of the image for containerd (such as docker.io/library/foo:latest)",
+		},
+		cli.StringFlag{
+			Name:  "composefs.objects",
+			Usage: "objects directory for composefs: (can be shared between images, defaults to <dir>/objects)",
+		},
+		cli.StringFlag{
+			Name:  "composefs.mkcomposefs",
+			Usage: "mkcomposefs binary used to generate the composefs image",
+			Value: "mkcomposefs",
+		},
+		cli.BoolFlag{
+			Name:  "composefs.dump-only",
+			Usage: "only write the composefs description and objects, without running mkcomposefs",
+		},
+		cli.BoolFlag{
+			Name:  "composefs.dm-verity",
+			Usage: "append a dm-verity hash tree to the composefs image and print its root hash",
+		},
+		cli.StringFlag{
+			Name:  "composefs.dm-verity-salt",
+			Usage: "hex-encoded salt for the dm-verity hash tree (defaults to no salt)",
+		},
+		cli.StringFlag{
+			Name:  "nspawn.format",
+			Usage: "format of the nspawn: root filesystem (tar or directory)",
+			Value: "tar",
+		},
+		cli.StringFlag{
+			Name:  "nspawn.unit",
+			Usage: "path to write a systemd.nspawn(5) file running the image's entrypoint to",
+		},
+		cli.StringFlag{
+			Name:  "disk.format",
+			Usage: "format of the disk: image (raw or qcow2)",
+			Value: "raw",
+		},
+		cli.StringFlag{
+			Name:  "disk.filesystem",
+			Usage: "filesystem of the disk: image (ext4, btrfs, erofs or squashfs)",
+			Value: string(diskimage.Ext4),
+		},
+		cli.StringFlag{
+			Name:  "disk.size",
+			Usage: "size of writable disk: filesystems (defaults to an estimate based on the image)",
+		},
+		cli.StringFlag{
+			Name:  "disk.partition-table",
+			Usage: "partition table of the disk: image (gpt or none)",
+			Value: "gpt",
+		},
+		cli.StringFlag{
+			Name:  "disk.label",
+			Usage: "label of the disk: filesystem and partition",
+			Value: "root",
+		},
+		cli.StringFlag{
+			Name:  "disk.hook",
+			Usage: "executable run with the extracted rootfs and with the finished disk: image",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "extract the nspawn: directory or disk: rootfs without root privileges (ownership is not preserved)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected oci-archive:<path>, composefs:<dir>, nspawn:<path> or lxd:<path>")
+		}
+		target := ctx.Args().First()
+		var transport string
+		switch {
+		case strings.HasPrefix(target, "oci-archive:"):
+			transport = "oci-archive"
+		case strings.HasPrefix(target, "composefs:"):
+			transport = "composefs"
+			if ctx.IsSet("name") {
+				return errors.Errorf("--name is only supported for oci-archive:")
+			}
+			if ctx.Bool("composefs.dm-verity") && ctx.Bool("composefs.dump-only") {
+				return errors.Errorf("--composefs.dm-verity cannot be used with --composefs.dump-only")
+			}
+			if ctx.IsSet("composefs.dm-verity-salt") && !ctx.Bool("composefs.dm-verity") {
+				return errors.Errorf("--composefs.dm-verity-salt requires --composefs.dm-verity")
+			}
+		case strings.HasPrefix(target, "nspawn:"):
+			transport = "nspawn"
+			if ctx.IsSet("name") {
+				return errors.Errorf("--name is only supported for oci-archive:")
+			}
+			switch ctx.String("nspawn.format") {
+			case "tar":
+				if ctx.Bool("rootless") {
+					return errors.Errorf("--rootless is only supported for --nspawn.format=directory")
+				}
+			case "directory":
+				if target == "nspawn:-" {
+					return errors.Errorf("--nspawn.format=directory cannot be written to stdout")
+				}
+			default:
+				return errors.Errorf("unknown --nspawn.format: %q", ctx.String("nspawn.format"))
+			}
+		case strings.HasPrefix(target, "lxd:"):
+			transport = "lxd"
+			if ctx.IsSet("name") {
+				return errors.Errorf("--name is only supported for oci-archive:")
+			}
+		case strings.HasPrefix(target, "disk:"):
+			transport = "disk"
+			if ctx.IsSet("name") {
+				return errors.Errorf("--name is only supported for oci-archive:")
+			}
+			if target == "disk:-" {
+				return errors.Errorf("disk: images cannot be written to stdout")
+			}
+			if format := ctx.String("disk.format"); format != "raw" && format != "qcow2" {
+				return errors.Errorf("unknown --disk.format: %q", format)
+			}
+			if table := ctx.String("disk.partition-table"); table != "gpt" && table != "none" {
+				return errors.Errorf("unknown --disk.partition-table: %q", table)
+			}
+			fs, err := diskimage.ParseFilesystem(ctx.String("disk.filesystem"))
+			if err != nil {
+				return errors.Wrap(err, "parse --disk.filesystem")
+			}
+			if ctx.IsSet("disk.size") {
+				if fs.ReadOnly() {
+					return errors.Errorf("--disk.size is not supported for read-only %s filesystems", fs)
+				}
+				size, err := units.RAMInBytes(ctx.String("disk.size"))
+				if err != nil {
+					return errors.Wrap(err, "parse --disk.size")
+				}
+				if size <= 0 {
+					return errors.Errorf("--disk.size must be positive")
+				}
+				ctx.App.Metadata["--disk.size"] = size
+			}
+		default:
+			return errors.Errorf("unsupported transport: %q", target)
+		}
+		target = strings.TrimPrefix(target, transport+":")
+		if target == "" {
+			return errors.Errorf("%s path is empty", transport)
+		}
+		ctx.App.Metadata["export-transport"] = transport
+		ctx.App.Metadata["export-path"] = target
+		return nil
+	},
+
+	Action: exportImage,
+}
+
+func exportImage(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	archivePath := ctx.App.Metadata["export-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+	descriptor := descriptorPaths[0].Root()
+	switch ctx.App.Metadata["export-transport"].(string) {
+	case "composefs":
+		return exportComposefs(ctx, engineExt, descriptorPaths[0].Descriptor(), tagName, archivePath)
+	case "nspawn":
+		return exportNspawn(ctx, engineExt, descriptorPaths[0].Descriptor(), tagName, archivePath)
+	case "lxd":
+		return exportLXD(engineExt, descriptorPaths[0].Descriptor(), tagName, archivePath)
+	case "disk":
+		return exportDisk(ctx, engineExt, descriptorPaths[0].Descriptor(), tagName, archivePath)
+	}
+	descriptor.Annotations = map[string]string{
+		ispec.AnnotationRefName: tagName,
+	}
+	if ctx.IsSet("name") {
+		descriptor.Annotations[interop.AnnotationContainerdImageName] = ctx.String("name")
+	}
+
+	var w io.Writer = os.Stdout
+	if archivePath != "-" {
+		fh, err := os.Create(archivePath)
+		if err != nil {
+			return errors.Wrap(err, "create archive")
+		}
+		defer fh.Close()
+		w = fh
+	}
+
+	if err := interop.ExportArchive(context.Background(), engineExt, w, descriptor); err != nil {
+		if archivePath != "-" {
+			os.Remove(archivePath)
+		}
+		return errors.Wrap(err, "export archive")
+	}
+
+	log.Infof("exported %q to oci-archive:%s", tagName, archivePath)
+	return nil
+}
+
+// exportMapOptions returns the options used to extract the root filesystem of
+// the image for the transports which need to extract it.
+func exportMapOptions(ctx *cli.Context) layer.MapOptions {
+	var opt layer.MapOptions
+	opt.Rootless = ctx.Bool("rootless")
+	if opt.Rootless {
+		// Use the same mappings as umoci-unpack(1) does by default.
+		opt.UIDMappings = []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}}
+		opt.GIDMappings = []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}}
+	}
+	return opt
+}
+
+// getExportManifest returns the manifest the given descriptor points to.
+func getExportManifest(engineExt casext.Engine, descriptor ispec.Descriptor) (ispec.Manifest, error) {
+	// FIXME: Implement support for manifest lists.
+	if !casext.IsManifestMediaType(descriptor.MediaType) {
+		return ispec.Manifest{}, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", descriptor.MediaType)
+	}
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), descriptor)
+	if err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Manifest{}, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+	return manifest, nil
+}
+
+// getExportConfig returns the configuration of the image with the given
+// manifest.
+func getExportConfig(engineExt casext.Engine, manifest ispec.Manifest) (ispec.Image, error) {
+	configBlob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		return ispec.Image{}, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return ispec.Image{}, errors.Errorf("config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	return config, nil
+}
+
+// exportComposefs writes the image with the given manifest descriptor as a
+// composefs image in dir.
+func exportComposefs(ctx *cli.Context, engineExt casext.Engine, descriptor ispec.Descriptor, tagName, dir string) error {
+	manifest, err := getExportManifest(engineExt, descriptor)
+	if err != nil {
+		return err
+	}
+
+	objectsDir := filepath.Join(dir, "objects")
+	if ctx.IsSet("composefs.objects") {
+		objectsDir = ctx.String("composefs.objects")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "mkdir composefs directory")
+	}
+
+	dumpPath := filepath.Join(dir, "image.dump")
+	dump, err := os.Create(dumpPath)
+	if err != nil {
+		return errors.Wrap(err, "create composefs dump")
+	}
+	defer dump.Close()
+	if err := layer.WriteComposefsDump(context.Background(), engineExt, manifest, objectsDir, dump); err != nil {
+		return errors.Wrap(err, "write composefs dump")
+	}
+	if err := dump.Close(); err != nil {
+		return errors.Wrap(err, "close composefs dump")
+	}
+
+	if !ctx.Bool("composefs.dump-only") {
+		imagePath := filepath.Join(dir, "image.cfs")
+		mkcomposefs := ctx.String("composefs.mkcomposefs")
+		cmd := exec.Command(mkcomposefs, "--from-file", dumpPath, imagePath)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "run %s (use --composefs.dump-only to skip generating the composefs image)", mkcomposefs)
+		}
+
+		if ctx.Bool("composefs.dm-verity") {
+			salt, err := hex.DecodeString(ctx.String("composefs.dm-verity-salt"))
+			if err != nil {
+				return errors.Wrap(err, "parse --composefs.dm-verity-salt")
+			}
+			if err := appendDmVerity(imagePath, salt); err != nil {
+				return errors.Wrap(err, "append dm-verity hash tree")
+			}
+		}
+	}
+
+	log.Infof("exported %q to composefs:%s", tagName, dir)
+	return nil
+}
+
+// appendDmVerity appends a dm-verity hash tree to the filesystem image at
+// path, and prints the root hash and the offset of the hash tree to stdout.
+func appendDmVerity(path string, salt []byte) (Err error) {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrap(err, "open image")
+	}
+	defer func() {
+		if err := fh.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close image")
+		}
+	}()
+
+	tree, err := dmverity.Append(fh, salt)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"data_blocks": tree.DataBlocks,
+		"hash_offset": tree.HashOffset,
+	}).Infof("appended dm-verity hash tree to %s", path)
+	fmt.Printf("%s %d\n", tree.RootHashHex(), tree.HashOffset)
+	return nil
+}
+
+// exportNspawn writes the root filesystem of the image with the given
+// manifest descriptor to path, in a form which can be imported with
+// machinectl(1).
+func exportNspawn(ctx *cli.Context, engineExt casext.Engine, descriptor ispec.Descriptor, tagName, path string) error {
+	manifest, err := getExportManifest(engineExt, descriptor)
+	if err != nil {
+		return err
+	}
+	if casext.IsWasmManifest(manifest) {
+		return errors.Errorf("wasm images cannot be exported to nspawn:")
+	}
+	config, err := getExportConfig(engineExt, manifest)
+	if err != nil {
+		return err
+	}
+	osRelease := interop.NspawnOSRelease(manifest, config, tagName)
+
+	if ctx.String("nspawn.format") == "directory" {
+		opt := exportMapOptions(ctx)
+		if err := layer.UnpackRootfs(context.Background(), engineExt, path, manifest, &opt); err != nil {
+			return errors.Wrap(err, "unpack rootfs")
+		}
+		if err := interop.WriteNspawnOSRelease(path, osRelease); err != nil {
+			return errors.Wrap(err, "write os-release")
+		}
+	} else {
+		var w io.Writer = os.Stdout
+		if path != "-" {
+			fh, err := os.Create(path)
+			if err != nil {
+				return errors.Wrap(err, "create archive")
+			}
+			defer fh.Close()
+			w = fh
+		}
+		if err := interop.ExportNspawnArchive(context.Background(), engineExt, w, manifest, config, osRelease); err != nil {
+			if path != "-" {
+				os.Remove(path)
+			}
+			return errors.Wrap(err, "export nspawn archive")
+		}
+	}
+
+	if unitPath := ctx.String("nspawn.unit"); unitPath != "" {
+		unit := interop.NspawnUnit(config, fmt.Sprintf("Generated by umoci from %s.", tagName))
+		if err := ioutil.WriteFile(unitPath, unit, 0644); err != nil {
+			return errors.Wrap(err, "write nspawn unit")
+		}
+	}
+
+	log.Infof("exported %q to nspawn:%s", tagName, path)
+	return nil
+}
+
+// exportLXD writes the image with the given manifest descriptor to path as an
+// LXD image tarball.
+func exportLXD(engineExt casext.Engine, descriptor ispec.Descriptor, tagName, path string) error {
+	manifest, err := getExportManifest(engineExt, descriptor)
+	if err != nil {
+		return err
+	}
+	if casext.IsWasmManifest(manifest) {
+		return errors.Errorf("wasm images cannot be exported to lxd:")
+	}
+	config, err := getExportConfig(engineExt, manifest)
+	if err != nil {
+		return err
+	}
+	metadata := interop.NewLXDMetadata(manifest, config, tagName)
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		fh, err := os.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "create archive")
+		}
+		defer fh.Close()
+		w = fh
+	}
+	if err := interop.ExportLXDArchive(context.Background(), engineExt, w, manifest, config, metadata); err != nil {
+		if path != "-" {
+			os.Remove(path)
+		}
+		return errors.Wrap(err, "export lxd archive")
+	}
+
+	log.Infof("exported %q to lxd:%s", tagName, path)
+	return nil
+}
+
+// runDiskHook runs the --disk.hook executable (if any) for the given stage of
+// exportDisk, with the given arguments.
+func runDiskHook(ctx *cli.Context, stage string, args ...string) error {
+	hook := ctx.String("disk.hook")
+	if hook == "" {
+		return nil
+	}
+	cmd := exec.Command(hook, args...)
+	cmd.Env = append(os.Environ(), "UMOCI_DISK_STAGE="+stage)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return errors.Wrapf(cmd.Run(), "run %s hook %s", stage, hook)
+}
+
+// exportDisk writes the image with the given manifest descriptor to path as a
+// disk image for virtual machines.
+func exportDisk(ctx *cli.Context, engineExt casext.Engine, descriptor ispec.Descriptor, tagName, path string) error {
+	manifest, err := getExportManifest(engineExt, descriptor)
+	if err != nil {
+		return err
+	}
+	if casext.IsWasmManifest(manifest) {
+		return errors.Errorf("wasm images cannot be exported to disk:")
+	}
+	config, err := getExportConfig(engineExt, manifest)
+	if err != nil {
+		return err
+	}
+	fs, err := diskimage.ParseFilesystem(ctx.String("disk.filesystem"))
+	if err != nil {
+		return errors.Wrap(err, "parse --disk.filesystem")
+	}
+
+	// The rootfs and intermediate images are placed next to the output, since
+	// they may be too large for the temporary directory.
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return errors.Wrap(err, "get absolute disk path")
+	}
+	tempDir, err := ioutil.TempDir(filepath.Dir(path), ".umoci-disk-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary directory")
+	}
+	opt := exportMapOptions(ctx)
+	fsEval := fseval.DefaultFsEval
+	if opt.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	defer fsEval.RemoveAll(tempDir)
+
+	rootfsPath := filepath.Join(tempDir, "rootfs")
+	if err := layer.UnpackRootfs(context.Background(), engineExt, rootfsPath, manifest, &opt); err != nil {
+		return errors.Wrap(err, "unpack rootfs")
+	}
+	if err := runDiskHook(ctx, "rootfs", rootfsPath); err != nil {
+		return err
+	}
+
+	diskOpt := diskimage.Options{
+		Label: ctx.String("disk.label"),
+		Seed:  []byte(descriptor.Digest),
+	}
+	if !fs.ReadOnly() {
+		if size, ok := ctx.App.Metadata["--disk.size"].(int64); ok {
+			diskOpt.Size = size
+		} else if diskOpt.Size, err = diskimage.EstimateSize(rootfsPath); err != nil {
+			return errors.Wrap(err, "estimate filesystem size")
+		}
+	}
+	fsPath := filepath.Join(tempDir, "fs.img")
+	if err := diskimage.MakeFilesystem(fs, rootfsPath, fsPath, diskOpt); err != nil {
+		return errors.Wrapf(err, "make %s filesystem", fs)
+	}
+
+	diskPath, offset := fsPath, int64(0)
+	if ctx.String("disk.partition-table") == "gpt" {
+		diskPath = filepath.Join(tempDir, "disk.img")
+		partition, err := diskimage.WriteGPTDisk(diskPath, fsPath, diskimage.RootPartitionGUID(config.Architecture), diskOpt.Label, diskOpt)
+		if err != nil {
+			return errors.Wrap(err, "write gpt disk")
+		}
+		offset = partition.Offset
+	}
+	if err := runDiskHook(ctx, "disk", diskPath, strconv.FormatInt(offset, 10)); err != nil {
+		return err
+	}
+
+	if ctx.String("disk.format") == "qcow2" {
+		cmd := exec.Command("qemu-img", "convert", "-f", "raw", "-O", "qcow2", diskPath, path)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Wrap(err, "run qemu-img")
+		}
+	} else if err := os.Rename(diskPath, path); err != nil {
+		return errors.Wrap(err, "move disk image")
+	}
+
+	log.Infof("exported %q to disk:%s", tagName, path)
+	return nil
+}
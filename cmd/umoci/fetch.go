@@ -0,0 +1,224 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/interop"
+	"github.com/openSUSE/umoci/oci/registry"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var fetchCommand = uxRegistryClient(cli.Command{
+	Name:  "fetch",
+	Usage: "fetches an image and its blobs from peers",
+	ArgsUsage: `--image <image-path>[:<tag>] --peer <url> [--peer <url>...] [<peer-tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to create, "<url>" is the URL of a peer (of the form
+"http://host:port[/repository]") and "<peer-tag>" is the tag of the image on
+the peers (which defaults to "<tag>"). Proxies are configured by $HTTP_PROXY,
+$HTTPS_PROXY and $NO_PROXY.
+
+Peers are machines serving images with the registry API, such as those running
+umoci-serve(1). The image's manifest is resolved using the first peer which has
+"<peer-tag>", and every blob the image needs which is missing from
+"<image-path>" is fetched from the first peer which has it. Every blob is
+verified against its digest, so peers do not need to be trusted to provide
+the correct contents.
+
+If --delta is specified and "<tag>" already exists in "<image-path>", only the
+parts of each changed layer which differ from the corresponding layer of the
+existing image are fetched (from peers running umoci-serve(1)).
+
+Docker schema1 manifests (served by some legacy registries) are converted to
+OCI manifests, with an image configuration synthesised from their history.`,
+
+	// fetch modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "peer",
+			Usage: "URL of a peer to fetch blobs from (can be specified multiple times)",
+		},
+		cli.BoolFlag{
+			Name:  "delta",
+			Usage: "only fetch the parts of layers which differ from the existing image",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if len(ctx.StringSlice("peer")) == 0 {
+			return errors.Errorf("missing mandatory argument: --peer")
+		}
+		switch ctx.NArg() {
+		case 0:
+		case 1:
+			if !refRegexp.MatchString(ctx.Args().First()) {
+				return errors.Errorf("peer tag is an invalid reference: %q", ctx.Args().First())
+			}
+		default:
+			return errors.Errorf("invalid number of positional arguments: expected [<peer-tag>]")
+		}
+		return nil
+	},
+
+	Action: fetch,
+})
+
+func fetch(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	peerTag := tagName
+	if ctx.NArg() > 0 {
+		peerTag = ctx.Args().First()
+	}
+
+	client := registryClient(ctx)
+	opts := fetchOptions(ctx)
+
+	var peers []*registry.PeerResolver
+	for _, url := range ctx.StringSlice("peer") {
+		peer, err := registry.NewPeerResolver(url)
+		if err != nil {
+			return errors.Wrapf(err, "invalid --peer %q", url)
+		}
+		peer.Client = client
+		peers = append(peers, peer)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// Find a peer which has the tag.
+	var (
+		descriptor ispec.Descriptor
+		resolvers  []casext.BlobResolver
+		found      *registry.PeerResolver
+	)
+	for _, peer := range peers {
+		resolvers = append(resolvers, peer)
+		if found != nil {
+			continue
+		}
+		descriptor, err = peer.ResolveTag(context.Background(), peerTag)
+		if os.IsNotExist(errors.Cause(err)) {
+			log.Debugf("peer %s does not have tag %s", peer, peerTag)
+			continue
+		}
+		if err != nil {
+			log.Warnf("resolve tag %s on peer %s: %v", peerTag, peer, err)
+			continue
+		}
+		log.Infof("resolved %s on peer %s: %s", peerTag, peer, descriptor.Digest)
+		found = peer
+	}
+	if found == nil {
+		return errors.Errorf("no peer has tag: %s", peerTag)
+	}
+
+	// Schema1 manifests have to be converted to OCI manifests, which requires
+	// all of their layers to be fetched.
+	if interop.IsSchema1MediaType(descriptor.MediaType) {
+		if ctx.Bool("delta") {
+			log.Warnf("--delta is not supported for schema1 manifests, fetching entire layers")
+		}
+		descriptor, err = fetchSchema1(engineExt, found, descriptor, resolvers)
+		if err != nil {
+			return errors.Wrap(err, "fetch schema1 image")
+		}
+		log.Infof("converted schema1 manifest to %s", descriptor.Digest)
+	}
+
+	var fetched []digest.Digest
+	if ctx.Bool("delta") {
+		fetched, err = syncBlobs(engineExt, tagName, descriptor, resolvers, opts)
+	} else {
+		fetched, err = engineExt.FetchMissingBlobs(context.Background(), descriptor, resolvers, opts)
+	}
+	if err != nil {
+		return errors.Wrap(err, "fetch blobs")
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "put reference")
+	}
+	log.Infof("fetched %d blobs: %q -> %s", len(fetched), tagName, descriptor.Digest)
+	return nil
+}
+
+// fetchSchema1 fetches the schema1 manifest with the given descriptor from
+// the peer, and converts it to an OCI manifest (fetching its layers from the
+// resolvers). The descriptor of the converted manifest is returned.
+func fetchSchema1(engineExt casext.Engine, peer *registry.PeerResolver, descriptor ispec.Descriptor, resolvers []casext.BlobResolver) (ispec.Descriptor, error) {
+	reader, err := peer.ResolveManifest(context.Background(), descriptor)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get manifest")
+	}
+	manifestBlob, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read manifest")
+	}
+
+	// The digest of a signed manifest doesn't include the signatures, so we
+	// can't use a verifiedReader.
+	manifestDigest, err := interop.Schema1Digest(manifestBlob)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "compute manifest digest")
+	}
+	if manifestDigest != descriptor.Digest {
+		return ispec.Descriptor{}, errors.Errorf("manifest does not match digest %s: got %s", descriptor.Digest, manifestDigest)
+	}
+
+	return interop.ConvertSchema1(context.Background(), engineExt, manifestBlob, resolvers)
+}
+
+// syncBlobs fetches the blobs of the image with the given descriptor, using
+// the image currently tagged as tagName as the basis of delta transfers.
+func syncBlobs(engineExt casext.Engine, tagName string, descriptor ispec.Descriptor, resolvers []casext.BlobResolver, opts casext.FetchOptions) ([]digest.Digest, error) {
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return nil, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		log.Infof("no delta basis: tag %s does not exist", tagName)
+		return engineExt.FetchMissingBlobs(context.Background(), descriptor, resolvers, opts)
+	}
+	if len(descriptorPaths) != 1 {
+		log.Warnf("cannot use %s as delta basis: tag resolves to %d manifests", tagName, len(descriptorPaths))
+		return engineExt.FetchMissingBlobs(context.Background(), descriptor, resolvers, opts)
+	}
+	old := descriptorPaths[0].Descriptor()
+	log.Infof("using %s (%s) as delta basis", tagName, old.Digest)
+	return engineExt.SyncBlobs(context.Background(), old, descriptor, resolvers, opts)
+}
@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var fsckCommand = cli.Command{
+	Name:  "fsck",
+	Usage: "checks (and repairs) the consistency of an OCI image layout",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+This command checks for problems which make parts of the image layout unusable:
+blobs whose contents don't match their digest, entries in the top-level index
+which refer to missing blobs or have the wrong size, and blobs which are
+referenced by other blobs but are missing. If --adopt-orphans is specified,
+manifests which are not referenced by the top-level index are also reported.
+
+Unless --repair is specified the image is not modified, and the command fails
+if any problems were found. With --repair, misnamed blobs are renamed to the
+digest of their contents, dangling index entries are removed, index entries
+have their sizes fixed and orphaned manifests are tagged as
+"lost-found-<digest-prefix>". Missing blobs cannot be repaired.`,
+
+	// fsck modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "repair",
+			Usage: "repair any problems which are found",
+		},
+		cli.BoolFlag{
+			Name:  "adopt-orphans",
+			Usage: "report (and repair) manifests not referenced by the image index",
+		},
+		cli.StringFlag{
+			Name:  "log",
+			Usage: "append a JSON record of every repair applied to this file",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("log") && !ctx.Bool("repair") {
+			return errors.Errorf("--log can only be used with --repair")
+		}
+		return nil
+	},
+
+	Action: fsck,
+}
+
+func fsck(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	opt := casext.FsckOptions{
+		Repair:       ctx.Bool("repair"),
+		AdoptOrphans: ctx.Bool("adopt-orphans"),
+	}
+	if path := ctx.String("log"); path != "" {
+		fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "open fsck log")
+		}
+		defer fh.Close()
+		opt.Log = fh
+	}
+
+	issues, err := engineExt.Fsck(context.Background(), opt)
+	if err != nil {
+		return errors.Wrap(err, "fsck")
+	}
+
+	var unrepaired int
+	for _, issue := range issues {
+		if !issue.Repaired {
+			unrepaired++
+		}
+	}
+	if unrepaired > 0 {
+		return errors.Errorf("found %d problems (%d unrepaired)", len(issues), unrepaired)
+	}
+	if len(issues) > 0 {
+		log.Infof("repaired %d problems: %s", len(issues), imagePath)
+	} else {
+		log.Infof("no problems found: %s", imagePath)
+	}
+	return nil
+}
@@ -53,7 +53,7 @@ func gc(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/interop"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// importTransport imports the image at the given path (the part of the source
+// after the transport prefix) into the image layout.
+type importTransport func(ctx context.Context, engine casext.Engine, path string) (ispec.Descriptor, error)
+
+// importTransports are the transports supported by umoci-import(1), indexed
+// by their prefix.
+var importTransports = map[string]importTransport{
+	"dir":         interop.ImportSkopeoDir,
+	"oci-archive": importArchive,
+}
+
+// importArchive imports the archive at the given path (or stdin if the path is
+// "-"), which must contain exactly one image.
+func importArchive(ctx context.Context, engine casext.Engine, path string) (ispec.Descriptor, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "open archive")
+		}
+		defer fh.Close()
+		r = fh
+	}
+
+	descriptors, err := interop.ImportArchive(ctx, engine, r)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if len(descriptors) != 1 {
+		return ispec.Descriptor{}, errors.Errorf("archive must contain exactly one image: found %d", len(descriptors))
+	}
+
+	// The annotations in the archive's index (such as the reference name)
+	// don't apply to the new tag.
+	descriptor := descriptors[0]
+	descriptor.Annotations = nil
+	return descriptor, nil
+}
+
+var importCommand = cli.Command{
+	Name:  "import",
+	Usage: "imports an image from another container tool's format",
+	ArgsUsage: `--image <image-path>[:<tag>] <transport>:<source>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to create for the imported image, and "<transport>:<source>" describes the
+image to import.
+
+The supported "<transport>"s are "dir", where "<source>" is a directory in the
+format used by the "dir:" transport of skopeo(1), and "oci-archive", where
+"<source>" is a tar archive of an OCI image layout (such as those created by
+"ctr images export" or umoci-export(1)) or "-" to read the archive from stdin.
+Docker (schema1 and schema2) manifests are converted to OCI manifests during
+the import.`,
+
+	// import modifies an image layout.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <transport>:<source>")
+		}
+		source := ctx.Args().First()
+		sep := strings.Index(source, ":")
+		if sep == -1 {
+			return errors.Errorf("source is missing a transport: %q", source)
+		}
+		if _, ok := importTransports[source[:sep]]; !ok {
+			return errors.Errorf("unsupported transport: %q", source[:sep])
+		}
+		if source[sep+1:] == "" {
+			return errors.Errorf("source is empty: %q", source)
+		}
+		ctx.App.Metadata["import-transport"] = source[:sep]
+		ctx.App.Metadata["import-source"] = source[sep+1:]
+		return nil
+	},
+
+	Action: importImage,
+}
+
+func importImage(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	transport := ctx.App.Metadata["import-transport"].(string)
+	source := ctx.App.Metadata["import-source"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptor, err := importTransports[transport](context.Background(), engineExt, source)
+	if err != nil {
+		return errors.Wrapf(err, "import %s:%s", transport, source)
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "put reference")
+	}
+
+	log.Infof("imported %s:%s: %q -> %s", transport, source, tagName, descriptor.Digest)
+	return nil
+}
@@ -23,8 +23,10 @@ import (
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"golang.org/x/net/context"
 )
 
 var initCommand = cli.Command{
@@ -41,6 +43,13 @@ commands.`,
 	// create modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "reflog",
+			Usage: "record every change to the image's tags (see umoci-log(1))",
+		},
+	},
+
 	Action: initLayout,
 }
 
@@ -58,6 +67,18 @@ func initLayout(ctx *cli.Context) error {
 		return errors.Wrap(err, "image layout creation")
 	}
 
+	if ctx.Bool("reflog") {
+		engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+		if err != nil {
+			return errors.Wrap(err, "open CAS")
+		}
+		defer engine.Close()
+
+		if err := casext.NewEngine(engine).EnableRefLog(context.Background()); err != nil {
+			return errors.Wrap(err, "enable reflog")
+		}
+	}
+
 	log.Infof("created new OCI image: %s", imagePath)
 	return nil
 }
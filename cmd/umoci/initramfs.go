@@ -0,0 +1,260 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/interop"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var initramfsCommand = cli.Command{
+	Name:  "initramfs",
+	Usage: "assembles an initramfs (and optionally a unified kernel image) from an image",
+	ArgsUsage: `--image <image-path>[:<tag>] <initramfs>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag of the image and "<initramfs>" is the path of the initramfs to create (or
+"-" to write it to stdout).
+
+The initramfs contains the root filesystem of the image, which is read from
+the layers without extracting them. If the image has no /init, a symlink to the
+init of the image (see --init) is added, since that is what the kernel runs.
+
+The kernel of the image (see --kernel) can be extracted with --kernel-output.
+With --uki, a unified kernel image combining the kernel, the initramfs, the
+os-release of the image and a kernel command line is built with ukify(1).`,
+
+	// initramfs reads an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression of the initramfs (gzip, zstd or none)",
+			Value: "gzip",
+		},
+		cli.StringFlag{
+			Name:  "kernel",
+			Usage: "path of the kernel in the image (defaults to looking in /boot and /usr/lib/modules)",
+		},
+		cli.StringFlag{
+			Name:  "kernel-output",
+			Usage: "path to write the kernel of the image to",
+		},
+		cli.StringFlag{
+			Name:  "init",
+			Usage: "path in the image that /init is linked to if the image has no /init",
+		},
+		cli.StringFlag{
+			Name:  "uki",
+			Usage: "path to write a unified kernel image to",
+		},
+		cli.StringFlag{
+			Name:  "uki.cmdline",
+			Usage: "kernel command line embedded in the unified kernel image",
+		},
+		cli.StringFlag{
+			Name:  "uki.ukify",
+			Usage: "ukify binary used to build the unified kernel image",
+			Value: "ukify",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <initramfs>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("initramfs path cannot be empty")
+		}
+		switch ctx.String("compress") {
+		case "gzip", "zstd", "none":
+		default:
+			return errors.Errorf("unknown --compress: %q", ctx.String("compress"))
+		}
+		if ctx.IsSet("uki") && ctx.Args().First() == "-" {
+			return errors.Errorf("--uki cannot be used when writing the initramfs to stdout")
+		}
+		if (ctx.IsSet("uki.cmdline") || ctx.IsSet("uki.ukify")) && !ctx.IsSet("uki") {
+			return errors.Errorf("--uki.cmdline and --uki.ukify require --uki")
+		}
+		ctx.App.Metadata["initramfs"] = ctx.Args().First()
+		return nil
+	},
+
+	Action: initramfs,
+}
+
+// compressInitramfs wraps w with the compression given with --compress.
+func compressInitramfs(ctx *cli.Context, w io.Writer) (io.WriteCloser, error) {
+	switch ctx.String("compress") {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// nopWriteCloser is an io.WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func initramfs(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	initramfsPath := ctx.App.Metadata["initramfs"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+	manifest, err := getExportManifest(engineExt, descriptorPaths[0].Descriptor())
+	if err != nil {
+		return err
+	}
+	if casext.IsWasmManifest(manifest) {
+		return errors.Errorf("wasm images cannot be used as an initramfs")
+	}
+
+	// The UKI needs the kernel, even if it wasn't requested.
+	tempDir, err := ioutil.TempDir("", "umoci-initramfs")
+	if err != nil {
+		return errors.Wrap(err, "create temporary directory")
+	}
+	defer os.RemoveAll(tempDir)
+	kernelPath := ctx.String("kernel-output")
+	if kernelPath == "" && ctx.IsSet("uki") {
+		kernelPath = filepath.Join(tempDir, "vmlinuz")
+	}
+
+	var kernel io.Writer
+	if kernelPath != "" {
+		fh, err := os.Create(kernelPath)
+		if err != nil {
+			return errors.Wrap(err, "create kernel")
+		}
+		defer fh.Close()
+		kernel = fh
+	}
+
+	var w io.Writer = os.Stdout
+	if initramfsPath != "-" {
+		fh, err := os.Create(initramfsPath)
+		if err != nil {
+			return errors.Wrap(err, "create initramfs")
+		}
+		defer func() {
+			if err := fh.Close(); err != nil && Err == nil {
+				Err = errors.Wrap(err, "close initramfs")
+			}
+		}()
+		w = fh
+	}
+	cw, err := compressInitramfs(ctx, w)
+	if err != nil {
+		return errors.Wrap(err, "create compressor")
+	}
+
+	opt := interop.InitramfsOptions{
+		Kernel: ctx.String("kernel"),
+		Init:   ctx.String("init"),
+	}
+	info, err := interop.ExportInitramfs(context.Background(), engineExt, cw, manifest, opt, kernel)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		if initramfsPath != "-" {
+			os.Remove(initramfsPath)
+		}
+		if ctx.IsSet("kernel-output") {
+			os.Remove(kernelPath)
+		}
+		return errors.Wrap(err, "export initramfs")
+	}
+	log.WithFields(log.Fields{
+		"kernel": info.Kernel,
+		"init":   info.Init,
+	}).Infof("created initramfs %s from %q", initramfsPath, tagName)
+
+	if ctx.IsSet("uki") {
+		osRelease := info.OSRelease
+		if osRelease == nil {
+			config, err := getExportConfig(engineExt, manifest)
+			if err != nil {
+				return err
+			}
+			osRelease = interop.NspawnOSRelease(manifest, config, tagName)
+		}
+		osReleasePath := filepath.Join(tempDir, "os-release")
+		if err := ioutil.WriteFile(osReleasePath, osRelease, 0644); err != nil {
+			return errors.Wrap(err, "write os-release")
+		}
+
+		args := []string{
+			"build",
+			"--linux=" + kernelPath,
+			"--initrd=" + initramfsPath,
+			"--os-release=@" + osReleasePath,
+			"--output=" + ctx.String("uki"),
+		}
+		if ctx.IsSet("uki.cmdline") {
+			args = append(args, "--cmdline="+ctx.String("uki.cmdline"))
+		}
+		ukify := ctx.String("uki.ukify")
+		cmd := exec.Command(ukify, args...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "run %s", ukify)
+		}
+		log.Infof("created unified kernel image %s", ctx.String("uki"))
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var insertCommand = uxHistory(uxTag(cli.Command{
+	Name:  "insert",
+	Usage: "adds tar archives and files as new layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tar <archive>]... [--file <source>:<target>]... [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to modify, "<archive>" is the path to a tar archive (or "-" to
+read the archive from stdin), "<source>" is a file or directory on the host
+and "<target>" is the path in the image to add it at.
+
+Each archive and file is added as a new layer on top of the image (the --tar
+archives first, followed by the --file paths, each in the order given), any
+configuration changes (using the same --config.* and other flags as
+umoci-config(1)) are applied, and "<new-tag>" (which defaults to "<tag>") is
+updated to refer to the modified image. All of the changes are made as a single
+modification of the image, so only one new manifest and configuration are
+created regardless of the number of layers. This allows the output of tools
+which produce tar archives (such as "git archive") and other build artifacts to
+be added to an image directly, without having to unpack and repack the image.
+Archives compressed with gzip or zstd are decompressed automatically. As with
+umoci-config(1), the user in --config.user is checked against the /etc/passwd
+and /etc/group of the modified image (including the new layers) unless
+--no-user-check is given.
+
+Every entry of an archive is validated and normalised before it is added:
+absolute paths are made relative to the root of the archive, entries which
+would be extracted outside of the root (or with unsupported types) are
+rejected, and the root directory entry and PAX global headers are dropped.
+Whiteout entries (".wh.<name>") are kept, so paths from lower layers can be
+removed.`,
+
+	// insert creates a new image, with a given tag.
+	Category: "image",
+
+	Flags: append([]cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "tar",
+			Usage: "path to a tar archive to add as a new layer (or - for stdin)",
+		},
+		cli.StringSliceFlag{
+			Name:  "file",
+			Usage: "file or directory on the host to add as a new layer (<source>:<target>)",
+		},
+		cli.StringSliceFlag{
+			Name:  "chown",
+			Usage: "set the ownership of paths in the new layers matching a glob pattern (<pattern>:<uid>:<gid>)",
+		},
+		cli.StringSliceFlag{
+			Name:  "chmod",
+			Usage: "set the permissions of paths in the new layers matching a glob pattern (<pattern>:<mode>)",
+		},
+		cli.BoolFlag{
+			Name:  "subsecond-times",
+			Usage: "preserve the sub-second component of modification times in the new layers",
+		},
+		cli.BoolFlag{
+			Name:  "rootless",
+			Usage: "enable rootless insertion support (files added with --file are owned by root)",
+		},
+		noUserCheckFlag,
+		strictExecFormFlag,
+	}, configFlags...),
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if len(ctx.StringSlice("tar")) == 0 && len(ctx.StringSlice("file")) == 0 && !configFlagsSet(ctx) {
+			return errors.Errorf("missing mandatory argument: at least one of --tar, --file or a configuration change")
+		}
+		stdin := 0
+		for _, archive := range ctx.StringSlice("tar") {
+			if archive == "" {
+				return errors.Errorf("--tar cannot be empty")
+			}
+			if archive == "-" {
+				stdin++
+			}
+		}
+		if stdin > 1 {
+			return errors.Errorf("--tar - can only be specified once")
+		}
+		for _, file := range ctx.StringSlice("file") {
+			if _, _, err := parseInsertFile(file); err != nil {
+				return errors.Wrap(err, "invalid --file")
+			}
+		}
+		return nil
+	},
+
+	Action: insert,
+}))
+
+// parseInsertFile parses a --file argument of the form "<source>:<target>".
+// The source may contain ":", but the target cannot.
+func parseInsertFile(spec string) (string, string, error) {
+	idx := strings.LastIndex(spec, ":")
+	if idx < 0 {
+		return "", "", errors.Errorf("expected <source>:<target>: %s", spec)
+	}
+	source, target := spec[:idx], spec[idx+1:]
+	if source == "" || target == "" {
+		return "", "", errors.Errorf("source and target must not be empty: %s", spec)
+	}
+	return source, target, nil
+}
+
+// insertLayer is a single layer to be added by umoci-insert(1).
+type insertLayer struct {
+	// description is used for logging and error messages.
+	description string
+
+	// open returns the uncompressed layer archive.
+	open func() (io.ReadCloser, error)
+}
+
+func insert(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	var mapOptions layer.MapOptions
+	mapOptions.SubsecondTimes = ctx.Bool("subsecond-times")
+	mapOptions.Rootless = ctx.Bool("rootless")
+	if mapOptions.Rootless {
+		mapOptions.UIDMappings = []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}}
+		mapOptions.GIDMappings = []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}}
+	}
+	for _, spec := range ctx.StringSlice("chown") {
+		rule, err := layer.ParseChownRule(spec)
+		if err != nil {
+			return errors.Wrap(err, "parse --chown")
+		}
+		mapOptions.ChownRules = append(mapOptions.ChownRules, rule)
+	}
+	for _, spec := range ctx.StringSlice("chmod") {
+		rule, err := layer.ParseChmodRule(spec)
+		if err != nil {
+			return errors.Wrap(err, "parse --chmod")
+		}
+		mapOptions.ChmodRules = append(mapOptions.ChmodRules, rule)
+	}
+
+	var layers []insertLayer
+	for _, archivePath := range ctx.StringSlice("tar") {
+		archivePath := archivePath // copy iterator
+		layers = append(layers, insertLayer{
+			description: "--tar " + archivePath,
+			open: func() (io.ReadCloser, error) {
+				if archivePath == "-" {
+					return layer.NormaliseLayer(os.Stdin, &mapOptions), nil
+				}
+				fh, err := os.Open(archivePath)
+				if err != nil {
+					return nil, errors.Wrap(err, "open archive")
+				}
+				return closeBoth{layer.NormaliseLayer(fh, &mapOptions), fh}, nil
+			},
+		})
+	}
+	for _, file := range ctx.StringSlice("file") {
+		source, target, _ := parseInsertFile(file)
+		layers = append(layers, insertLayer{
+			description: "--file " + file,
+			open: func() (io.ReadCloser, error) {
+				if _, err := os.Lstat(source); err != nil {
+					return nil, errors.Wrap(err, "stat source")
+				}
+				return layer.GenerateInsertLayer(source, target, &mapOptions)
+			},
+		})
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+	fromDescriptorPath := fromDescriptorPaths[0]
+	if !casext.IsManifestMediaType(fromDescriptorPath.Descriptor().MediaType) {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", fromDescriptorPath.Descriptor().MediaType), "invalid tag descriptor")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPath)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	created := time.Now()
+	history := ispec.History{
+		Author:     imageMeta.Author,
+		Comment:    "",
+		Created:    &created,
+		CreatedBy:  "umoci insert",
+		EmptyLayer: false,
+	}
+
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+		history.Comment = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.created"]; ok {
+		created, err := time.Parse(igen.ISO8601, val.(string))
+		if err != nil {
+			return errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = &created
+	}
+	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+		history.CreatedBy = val.(string)
+	}
+
+	// Each layer gets its own history entry, but they are all part of the
+	// same (uncommitted) modification.
+	for _, newLayer := range layers {
+		log.Infof("adding layer: %s", newLayer.description)
+		reader, err := newLayer.open()
+		if err != nil {
+			return errors.Wrapf(err, "open layer %s", newLayer.description)
+		}
+		err = mutator.Add(context.Background(), reader, history)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "add layer %s", newLayer.description)
+		}
+	}
+
+	if configFlagsSet(ctx) {
+		annotations, err := mutator.Annotations(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "get base annotations")
+		}
+		g, err := newConfigGenerator(context.Background(), mutator)
+		if err != nil {
+			return err
+		}
+		annotations, err = applyConfigFlags(ctx, g, annotations)
+		if err != nil {
+			return err
+		}
+		if err := setGeneratedConfig(context.Background(), mutator, g, annotations, history); err != nil {
+			return err
+		}
+	}
+
+	// The user is checked against the new layers, before the image is
+	// committed.
+	if ctx.IsSet("config.user") && !ctx.Bool("no-user-check") {
+		if err := checkConfigUser(context.Background(), engine, mutator); err != nil {
+			return errors.Wrap(err, "check --config.user")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("updated tag for image manifest: %s", tagName)
+	return nil
+}
+
+// closeBoth is an io.ReadCloser which also closes another io.Closer when it
+// is closed.
+type closeBoth struct {
+	io.ReadCloser
+	other io.Closer
+}
+
+// Close implements io.Closer.
+func (c closeBoth) Close() error {
+	err := c.ReadCloser.Close()
+	if err2 := c.other.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
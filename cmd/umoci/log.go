@@ -0,0 +1,158 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var logCommand = cli.Command{
+	Name:  "log",
+	Usage: "shows the history of changes to an OCI image's tags",
+	ArgsUsage: `--layout <image-path> [<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tag to show the history of. If no "<tag>" is provided, changes to every tag
+are shown.
+
+Changes to tags are only recorded if the reflog of the image has been enabled,
+either with --enable or by creating the image with "umoci init --reflog". Each
+entry records when the tag was changed, by which user and command, and the
+digests the tag referred to before and after the change.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// log reads (and may modify) an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "enable",
+			Usage: "start recording changes to the image's tags",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the history as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		switch ctx.NArg() {
+		case 0:
+		case 1:
+			if !refRegexp.MatchString(ctx.Args().First()) {
+				return errors.Errorf("tag is an invalid reference: %q", ctx.Args().First())
+			}
+		default:
+			return errors.Errorf("invalid number of positional arguments: expected [<tag>]")
+		}
+		if ctx.Bool("enable") && ctx.NArg() != 0 {
+			return errors.Errorf("--enable cannot be used with a tag")
+		}
+		return nil
+	},
+
+	Action: refLog,
+}
+
+func refLog(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.Args().First()
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	if ctx.Bool("enable") {
+		if err := engineExt.EnableRefLog(context.Background()); err != nil {
+			return errors.Wrap(err, "enable reflog")
+		}
+		log.Infof("enabled reflog: %s", imagePath)
+		return nil
+	}
+
+	if enabled, err := engineExt.RefLogEnabled(context.Background()); err != nil {
+		return errors.Wrap(err, "check reflog")
+	} else if !enabled {
+		log.Warnf("reflog is not enabled for %s (use --enable)", imagePath)
+	}
+
+	entries, err := engineExt.RefLog(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get reflog")
+	}
+	if entries == nil {
+		entries = []casext.RefLogEntry{}
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			return errors.Wrap(err, "encoding reflog")
+		}
+		return nil
+	}
+	return errors.Wrap(formatRefLog(os.Stdout, entries), "format reflog")
+}
+
+// formatRefLog formats the given reflog entries using the default formatting,
+// and writes the result to the given writer.
+func formatRefLog(w io.Writer, entries []casext.RefLogEntry) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "TIME\tTAG\tOLD\tNEW\tUSER\tCOMMAND\n")
+	for _, entry := range entries {
+		var (
+			old  = "<none>"
+			new  = "<none>"
+			user = entry.User
+		)
+		if entry.Old != "" {
+			old = entry.Old.String()
+		}
+		if entry.New != "" {
+			new = entry.New.String()
+		}
+		if entry.Host != "" {
+			user += "@" + entry.Host
+		}
+		command := strings.Replace(strings.Join(entry.Command, " "), "\t", " ", -1)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Format(igen.ISO8601), entry.RefName, old, new, user, command)
+	}
+	return tw.Flush()
+}
@@ -19,10 +19,15 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/apex/log"
 	logcli "github.com/apex/log/handlers/cli"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/plugin"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
@@ -38,6 +43,19 @@ var version = ""
 // populated on build by make.
 var gitCommit = ""
 
+// versionString returns the full version of umoci, including the commit it
+// was built from (if known).
+func versionString() string {
+	v := "unknown"
+	if version != "" {
+		v = version
+	}
+	if gitCommit != "" {
+		v = fmt.Sprintf("%s~git%s", v, gitCommit)
+	}
+	return v
+}
+
 const (
 	usage = `umoci modifies Open Container images`
 
@@ -46,7 +64,9 @@ const (
 	categoryImage  = "image"
 )
 
-func main() {
+// newApp returns the umoci application. A new application is returned by each
+// call, so that umoci-daemon(1) can run each request with its own state.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "umoci"
 	app.Usage = usage
@@ -57,15 +77,7 @@ func main() {
 		},
 	}
 
-	// Fill the version.
-	v := "unknown"
-	if version != "" {
-		v = version
-	}
-	if gitCommit != "" {
-		v = fmt.Sprintf("%s~git%s", v, gitCommit)
-	}
-	app.Version = v
+	app.Version = versionString()
 
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
@@ -77,10 +89,89 @@ func main() {
 			Usage: "set the log level (debug, info, [warn], error, fatal)",
 			Value: "warn",
 		},
+		cli.BoolFlag{
+			Name:   "blob-cache",
+			Usage:  "use a per-user cache of blobs shared between image layouts",
+			EnvVar: "UMOCI_BLOB_CACHE",
+		},
+		cli.StringFlag{
+			Name:   "blob-cache-dir",
+			Usage:  "path of the blob cache (implies --blob-cache) [default: $XDG_CACHE_HOME/umoci/blobs]",
+			EnvVar: "UMOCI_BLOB_CACHE_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "layer-cache",
+			Usage:  "use a per-user cache of uncompressed layers to speed up unpacking",
+			EnvVar: "UMOCI_LAYER_CACHE",
+		},
+		cli.StringFlag{
+			Name:   "layer-cache-dir",
+			Usage:  "path of the layer cache (implies --layer-cache) [default: $XDG_CACHE_HOME/umoci/layers]",
+			EnvVar: "UMOCI_LAYER_CACHE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "layer-cache-size",
+			Usage:  "maximum size of the layer cache (such as 512M or 10G), or 0 for no limit",
+			Value:  "10G",
+			EnvVar: "UMOCI_LAYER_CACHE_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "max-json-size",
+			Usage:  "largest manifest, index or configuration blob which will be parsed (such as 64M)",
+			Value:  "64M",
+			EnvVar: "UMOCI_MAX_JSON_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "newer-versions",
+			Usage:  "how to handle images which use a newer version of the image-spec than supported (read-only, pass-through or force)",
+			Value:  cas.NewerVersionsReadOnly.String(),
+			EnvVar: "UMOCI_NEWER_VERSIONS",
+		},
+		cli.BoolFlag{
+			Name:   "force",
+			Usage:  "allow modifying images which use a newer version of the image-spec than supported (same as --newer-versions=force)",
+			EnvVar: "UMOCI_FORCE",
+		},
+		cli.StringFlag{
+			Name:   "plugin-dir",
+			Usage:  "directory containing transport and compressor plugins [default: $XDG_DATA_HOME/umoci/plugins]",
+			EnvVar: "UMOCI_PLUGIN_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "no-plugins",
+			Usage:  "do not load any plugins",
+			EnvVar: "UMOCI_NO_PLUGINS",
+		},
+		cli.StringFlag{
+			Name:  "cpuprofile",
+			Usage: "write a pprof CPU profile of the command to the given path",
+		},
+		cli.StringFlag{
+			Name:  "memprofile",
+			Usage: "write a pprof heap profile to the given path when the command finishes",
+		},
+		cli.StringFlag{
+			Name:  "trace",
+			Usage: "write a Go execution trace of the command to the given path",
+		},
+		cli.StringFlag{
+			Name:   "trace-endpoint",
+			Usage:  "export OpenTelemetry spans and counters of the command to the OTLP/HTTP collector at the given URL",
+			EnvVar: "UMOCI_TRACE_ENDPOINT",
+		},
 	}
 
 	app.Before = func(ctx *cli.Context) error {
-		log.SetHandler(logcli.New(os.Stderr))
+		// Logs are written to the same place as errors, except when running
+		// a request from umoci-daemon(1) (which returns them separately).
+		stderr := ctx.App.ErrWriter
+		if stderr == nil {
+			stderr = cli.ErrWriter
+		}
+		if logs, ok := ctx.App.Metadata["--daemon.log"].(io.Writer); ok {
+			stderr = logs
+		}
+		log.SetHandler(logcli.New(stderr))
 
 		if ctx.GlobalBool("verbose") {
 			if ctx.GlobalIsSet("log") {
@@ -99,6 +190,96 @@ func main() {
 		if level == log.DebugLevel {
 			errors.Debug(true)
 		}
+
+		// Start profiling as early as possible. The profiler is stopped by
+		// app.After, even if the command fails.
+		profiler, err := startProfiling(ctx)
+		ctx.App.Metadata["--profiler"] = profiler
+		if err != nil {
+			return err
+		}
+		tracer, err := startTracing(ctx)
+		if err != nil {
+			return err
+		}
+		if tracer != nil {
+			ctx.App.Metadata["--tracer"] = tracer
+		}
+
+		// Figure out where the blob cache is, if it is being used.
+		if cacheDir := ctx.GlobalString("blob-cache-dir"); cacheDir != "" {
+			ctx.App.Metadata["--blob-cache"] = cacheDir
+		} else if ctx.GlobalBool("blob-cache") {
+			cacheDir, err := defaultCacheDir("blobs")
+			if err != nil {
+				return errors.Wrap(err, "get default blob cache path")
+			}
+			ctx.App.Metadata["--blob-cache"] = cacheDir
+		}
+		if cacheDir := ctx.GlobalString("layer-cache-dir"); cacheDir != "" {
+			ctx.App.Metadata["--layer-cache"] = cacheDir
+		} else if ctx.GlobalBool("layer-cache") {
+			cacheDir, err := defaultCacheDir("layers")
+			if err != nil {
+				return errors.Wrap(err, "get default layer cache path")
+			}
+			ctx.App.Metadata["--layer-cache"] = cacheDir
+		}
+		cacheSize, err := units.RAMInBytes(ctx.GlobalString("layer-cache-size"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --layer-cache-size")
+		}
+		ctx.App.Metadata["--layer-cache-size"] = cacheSize
+
+		// Load the plugins. If the default plugin directory can't be found
+		// there are no plugins to load.
+		if ctx.GlobalBool("no-plugins") {
+			if ctx.GlobalIsSet("plugin-dir") {
+				return errors.New("--plugin-dir and --no-plugins are mutually exclusive")
+			}
+		} else {
+			pluginDir := ctx.GlobalString("plugin-dir")
+			if pluginDir == "" {
+				pluginDir, _ = defaultPluginDir()
+			}
+			if pluginDir != "" {
+				if _, err := plugin.Load(pluginDir); err != nil {
+					return errors.Wrap(err, "load plugins")
+				}
+			}
+		}
+
+		maxJSONSize, err := units.RAMInBytes(ctx.GlobalString("max-json-size"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --max-json-size")
+		}
+		if maxJSONSize <= 0 {
+			return errors.Wrap(fmt.Errorf("size must be positive"), "invalid --max-json-size")
+		}
+		casext.MaxJSONBlobSize = maxJSONSize
+
+		policy, err := cas.ParseNewerVersionPolicy(ctx.GlobalString("newer-versions"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --newer-versions")
+		}
+		if ctx.GlobalBool("force") {
+			if policy != cas.NewerVersionsReadOnly && policy != cas.NewerVersionsForce {
+				return errors.Errorf("--force and --newer-versions=%s are mutually exclusive", policy)
+			}
+			policy = cas.NewerVersionsForce
+		}
+		ctx.App.Metadata["--newer-versions"] = policy
+		return nil
+	}
+
+	app.After = func(ctx *cli.Context) error {
+		if tracer, ok := ctx.App.Metadata["--tracer"].(*tracer); ok {
+			commandErr, _ := ctx.App.Metadata["--error"].(error)
+			tracer.stop(commandErr)
+		}
+		if profiler, ok := ctx.App.Metadata["--profiler"].(*profiler); ok {
+			return errors.Wrap(profiler.stop(), "write profiles")
+		}
 		return nil
 	}
 
@@ -106,13 +287,47 @@ func main() {
 		configCommand,
 		unpackCommand,
 		repackCommand,
+		rebaseCommand,
+		convertCommand,
+		remapCommand,
+		buildCommand,
+		insertCommand,
 		gcCommand,
+		pruneCommand,
 		initCommand,
+		archiveCommand,
+		unarchiveCommand,
 		newCommand,
 		tagAddCommand,
 		tagRemoveCommand,
 		tagListCommand,
 		statCommand,
+		statsCommand,
+		compareCommand,
+		topFilesCommand,
+		wastedSpaceCommand,
+		checkBundleCommand,
+		verifyRootfsCommand,
+		bundlesCommand,
+		validateCommand,
+		fsckCommand,
+		beginCommand,
+		commitCommand,
+		rollbackCommand,
+		migrateCommand,
+		logCommand,
+		watchCommand,
+		importCommand,
+		exportCommand,
+		initramfsCommand,
+		serveCommand,
+		fetchCommand,
+		completionCommand,
+		benchCommand,
+		versionCommand,
+		doctorCommand,
+		daemonSubcommand,
+		artifactSubcommand,
 		rawSubcommand,
 	}
 
@@ -151,10 +366,24 @@ func main() {
 			}
 			*cmd = uxLayout(*cmd)
 		}
+
+		// app.After isn't given the error returned by the command, but it
+		// is needed to finish the trace of the command.
+		if action, ok := cmd.Action.(func(*cli.Context) error); ok {
+			cmd.Action = func(ctx *cli.Context) error {
+				err := action(ctx)
+				ctx.App.Metadata["--error"] = err
+				return err
+			}
+		}
 	}
 
+	return app
+}
+
+func main() {
 	// Actually run umoci.
-	if err := app.Run(os.Args); err != nil {
+	if err := newApp().Run(os.Args); err != nil {
 		// If an error is a permission based error, give a hint to the user
 		// that --rootless might help. We probably should only be doing this if
 		// we're an unprivileged user.
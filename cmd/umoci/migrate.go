@@ -0,0 +1,180 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var migrateCommand = cli.Command{
+	Name:  "migrate",
+	Usage: "upgrades an OCI image layout created with an old image-spec version",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+Image layouts created with pre-1.0 versions of the image-spec (which stored
+references in a "refs" directory rather than "index.json", and used different
+media types) are rewritten in place to the current image layout format. Any
+manifests and indexes using old media types are rewritten, and the references
+are moved to the index. Entries in the index which use the legacy
+"org.opencontainers.ref.name" annotation are converted to use
+"org.opencontainers.image.ref.name". No blobs are removed.
+
+A backup of the modified files is kept inside the image, so that the migration
+can be undone with --rollback. Once the migrated image has been checked, the
+backup can be removed with --discard-backup (a new migration cannot be started
+while a backup exists). If the migration fails, the image is rolled back
+automatically. --check only reports whether the image needs to be migrated,
+failing if it does.`,
+
+	// migrate modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "check",
+			Usage: "only check whether the image needs to be migrated",
+		},
+		cli.BoolFlag{
+			Name:  "rollback",
+			Usage: "undo a previous migration using its backup",
+		},
+		cli.BoolFlag{
+			Name:  "discard-backup",
+			Usage: "remove the backup of a previous migration",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		set := 0
+		for _, flag := range []string{"check", "rollback", "discard-backup"} {
+			if ctx.Bool(flag) {
+				set++
+			}
+		}
+		if set > 1 {
+			return errors.Errorf("--check, --rollback and --discard-backup are mutually exclusive")
+		}
+		return nil
+	},
+
+	Action: migrate,
+}
+
+func migrate(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	switch {
+	case ctx.Bool("check"):
+		needed, err := dir.NeedsMigration(imagePath)
+		if err != nil {
+			return errors.Wrap(err, "check migration")
+		}
+		if !needed {
+			legacy, err := countLegacyReferences(imagePath)
+			if err != nil {
+				return errors.Wrap(err, "check references")
+			}
+			needed = legacy > 0
+		}
+		if needed {
+			return errors.Errorf("image needs to be migrated: %s", imagePath)
+		}
+		fmt.Fprintf(ctx.App.Writer, "image does not need to be migrated: %s\n", imagePath)
+		return nil
+
+	case ctx.Bool("rollback"):
+		if err := dir.RollbackMigration(imagePath); err != nil {
+			return errors.Wrap(err, "rollback migration")
+		}
+		log.Infof("rolled back migration: %s", imagePath)
+		return nil
+
+	case ctx.Bool("discard-backup"):
+		if err := dir.DiscardMigrationBackup(imagePath); err != nil {
+			return errors.Wrap(err, "discard migration backup")
+		}
+		log.Infof("discarded migration backup: %s", imagePath)
+		return nil
+	}
+
+	migrated, err := dir.Migrate(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "migrate")
+	}
+
+	// Legacy reference names are converted separately, since they can also be
+	// found in images which are otherwise up to date.
+	engine, err := cas.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	converted, err := engineExt.MigrateReferences(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "migrate references")
+	}
+	if converted > 0 {
+		log.Infof("converted %d legacy reference names: %s", converted, imagePath)
+	}
+
+	switch {
+	case migrated:
+		log.Infof("migrated image (use --rollback to undo, or --discard-backup to remove the backup): %s", imagePath)
+	case converted == 0:
+		log.Infof("image does not need to be migrated: %s", imagePath)
+	}
+	return nil
+}
+
+// countLegacyReferences returns the number of entries in the top-level index
+// of the image which use casext.LegacyAnnotationRefName.
+func countLegacyReferences(imagePath string) (int, error) {
+	engine, err := cas.Open(imagePath)
+	if err != nil {
+		return 0, errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	index, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		return 0, errors.Wrap(err, "get top-level index")
+	}
+	count := 0
+	for _, descriptor := range index.Manifests {
+		if _, ok := descriptor.Annotations[casext.LegacyAnnotationRefName]; ok {
+			count++
+		}
+	}
+	return count, nil
+}
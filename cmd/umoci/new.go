@@ -22,7 +22,6 @@ import (
 	"time"
 
 	"github.com/apex/log"
-	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	imeta "github.com/opencontainers/image-spec/specs-go"
@@ -56,7 +55,7 @@ func newImage(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -68,6 +67,26 @@ func newImage(ctx *cli.Context) error {
 		"tag": tagName,
 	}).Debugf("creating new manifest")
 
+	descriptor, err := newManifest(context.Background(), engineExt)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("new image manifest created: %s", descriptor.Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+
+	return nil
+}
+
+// newManifest creates a new image configuration (with no layers and the
+// default settings) and a manifest referencing it, and returns the descriptor
+// of the manifest.
+func newManifest(ctx context.Context, engineExt casext.Engine) (ispec.Descriptor, error) {
 	// Create a new image config.
 	g := igen.New()
 	createTime := time.Now()
@@ -84,9 +103,9 @@ func newImage(ctx *cli.Context) error {
 
 	// Update config and create a new blob for it.
 	config := g.Image()
-	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), config)
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
 	if err != nil {
-		return errors.Wrap(err, "put config blob")
+		return ispec.Descriptor{}, errors.Wrap(err, "put config blob")
 	}
 
 	log.WithFields(log.Fields{
@@ -108,9 +127,9 @@ func newImage(ctx *cli.Context) error {
 		Layers: []ispec.Descriptor{},
 	}
 
-	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), manifest)
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
 	if err != nil {
-		return errors.Wrap(err, "put manifest blob")
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest blob")
 	}
 
 	log.WithFields(log.Fields{
@@ -118,23 +137,10 @@ func newImage(ctx *cli.Context) error {
 		"size":   manifestSize,
 	}).Debugf("umoci: added new manifest")
 
-	// Now create a new reference, and either add it to the engine or spew it
-	// to stdout.
-
-	descriptor := ispec.Descriptor{
+	return ispec.Descriptor{
 		// FIXME: Support manifest lists.
 		MediaType: ispec.MediaTypeImageManifest,
 		Digest:    manifestDigest,
 		Size:      manifestSize,
-	}
-
-	log.Infof("new image manifest created: %s", descriptor.Digest)
-
-	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
-		return errors.Wrap(err, "add new tag")
-	}
-
-	log.Infof("created new tag for image manifest: %s", tagName)
-
-	return nil
+	}, nil
 }
@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// profiler writes the profiles requested with the global --cpuprofile,
+// --memprofile and --trace flags, so that users can capture profiles of slow
+// operations without rebuilding umoci.
+type profiler struct {
+	cpuFile   *os.File
+	traceFile *os.File
+	memPath   string
+}
+
+// startProfiling starts the profiles requested by the global flags. The
+// returned profiler must be stopped (even if an error is returned) so that
+// the profiles which were started are written.
+func startProfiling(ctx *cli.Context) (*profiler, error) {
+	p := &profiler{memPath: ctx.GlobalString("memprofile")}
+
+	if path := ctx.GlobalString("cpuprofile"); path != "" {
+		fh, err := os.Create(path)
+		if err != nil {
+			return p, errors.Wrap(err, "create --cpuprofile")
+		}
+		if err := pprof.StartCPUProfile(fh); err != nil {
+			fh.Close()
+			return p, errors.Wrap(err, "start cpu profile")
+		}
+		p.cpuFile = fh
+	}
+
+	if path := ctx.GlobalString("trace"); path != "" {
+		fh, err := os.Create(path)
+		if err != nil {
+			return p, errors.Wrap(err, "create --trace")
+		}
+		if err := trace.Start(fh); err != nil {
+			fh.Close()
+			return p, errors.Wrap(err, "start trace")
+		}
+		p.traceFile = fh
+	}
+	return p, nil
+}
+
+// stop stops all of the running profiles and writes the memory profile (if
+// requested). All of the profiles are written even if there is an error.
+func (p *profiler) stop() error {
+	var Err error
+	if p.cpuFile != nil {
+		pprof.StopCPUProfile()
+		if err := p.cpuFile.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close --cpuprofile")
+		}
+		p.cpuFile = nil
+	}
+	if p.traceFile != nil {
+		trace.Stop()
+		if err := p.traceFile.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close --trace")
+		}
+		p.traceFile = nil
+	}
+	if p.memPath != "" {
+		if err := writeMemProfile(p.memPath); err != nil && Err == nil {
+			Err = err
+		}
+		p.memPath = ""
+	}
+	if Err == nil {
+		log.Debugf("umoci: wrote requested profiles")
+	}
+	return Err
+}
+
+// writeMemProfile writes a heap profile to the given path.
+func writeMemProfile(path string) (Err error) {
+	fh, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create --memprofile")
+	}
+	defer func() {
+		if err := fh.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close --memprofile")
+		}
+	}()
+
+	// Make sure the profile includes all of the garbage we've generated.
+	runtime.GC()
+	return errors.Wrap(pprof.WriteHeapProfile(fh), "write memory profile")
+}
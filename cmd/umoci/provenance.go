@@ -0,0 +1,172 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/provenance"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// repackBuildType is the SLSA build type of images created by umoci-repack(1).
+const repackBuildType = "https://github.com/openSUSE/umoci/repack@v1"
+
+const (
+	// AnnotationLayerHostname is the layer descriptor annotation key for the
+	// hostname of the machine the layer was created on.
+	AnnotationLayerHostname = "org.opensuse.umoci.layer.hostname"
+
+	// AnnotationLayerBundle is the layer descriptor annotation key for the
+	// digest of the absolute path of the bundle the layer was created from.
+	// Only the digest is recorded, so that the path is not disclosed.
+	AnnotationLayerBundle = "org.opensuse.umoci.layer.bundle"
+
+	// AnnotationLayerVersion is the layer descriptor annotation key for the
+	// version of umoci which created the layer.
+	AnnotationLayerVersion = "org.opensuse.umoci.layer.version"
+
+	// AnnotationLayerSource is the layer descriptor annotation key for the
+	// digest of the manifest the bundle the layer was created from was
+	// unpacked from.
+	AnnotationLayerSource = "org.opensuse.umoci.layer.source"
+)
+
+// layerProvenanceAnnotations is the set of annotations describing where a
+// layer came from, in the order they are displayed by umoci-stat(1).
+var layerProvenanceAnnotations = []string{
+	AnnotationLayerHostname,
+	AnnotationLayerBundle,
+	AnnotationLayerVersion,
+	AnnotationLayerSource,
+}
+
+// repackLayerAnnotations returns the annotations recording the provenance of
+// a layer created by umoci-repack(1) from the given bundle.
+func repackLayerAnnotations(ctx *cli.Context, bundlePath string, meta UmociMeta) (map[string]string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Wrap(err, "get hostname")
+	}
+	fullBundlePath, err := filepath.Abs(bundlePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "get absolute bundle path")
+	}
+	return map[string]string{
+		AnnotationLayerHostname: hostname,
+		AnnotationLayerBundle:   digest.SHA256.FromString(fullBundlePath).String(),
+		AnnotationLayerVersion:  ctx.App.Version,
+		AnnotationLayerSource:   meta.From.Descriptor().Digest.String(),
+	}, nil
+}
+
+// defaultBuilderID returns the SLSA builder ID used if --provenance-builder-id
+// is not specified.
+func defaultBuilderID(ctx *cli.Context) string {
+	return "https://github.com/openSUSE/umoci@" + ctx.App.Version
+}
+
+// fileDigest returns the SHA256 digest of the file at the given path.
+func fileDigest(path string) (digest.Digest, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	return digest.SHA256.FromReader(fh)
+}
+
+// attachRepackProvenance attaches a SLSA provenance statement (see
+// casext.PutAttestation) to the manifest created by umoci-repack(1) from the
+// given bundle. The materials are the descriptors the bundle was unpacked
+// from and the mtree specification used as the baseline of the new layer.
+func attachRepackProvenance(ctx *cli.Context, engine casext.Engine, tagName, bundlePath, mtreePath string, meta UmociMeta, manifest ispec.Descriptor, started time.Time) error {
+	var materials []provenance.Material
+	for _, descriptor := range meta.From.Walk {
+		materials = append(materials, provenance.Material{
+			URI:    "oci:" + descriptor.Digest.String(),
+			Digest: provenance.NewDigestSet(descriptor.Digest),
+		})
+	}
+	fullMtreePath, err := filepath.Abs(mtreePath)
+	if err != nil {
+		return errors.Wrap(err, "get absolute mtree path")
+	}
+	mtreeDigest, err := fileDigest(fullMtreePath)
+	if err != nil {
+		return errors.Wrap(err, "hash mtree")
+	}
+	materials = append(materials, provenance.Material{
+		URI:    "file://" + fullMtreePath,
+		Digest: provenance.NewDigestSet(mtreeDigest),
+	})
+
+	fullBundlePath, err := filepath.Abs(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "get absolute bundle path")
+	}
+	builderID := ctx.String("provenance-builder-id")
+	if builderID == "" {
+		builderID = defaultBuilderID(ctx)
+	}
+	finished := time.Now().UTC()
+	started = started.UTC()
+
+	statement := provenance.NewStatement(provenance.Provenance{
+		Builder:   provenance.Builder{ID: builderID},
+		BuildType: repackBuildType,
+		Invocation: provenance.Invocation{
+			Parameters: map[string]interface{}{
+				"tag":       tagName,
+				"bundle":    fullBundlePath,
+				"arguments": os.Args[1:],
+			},
+			Environment: map[string]interface{}{
+				"version": ctx.App.Version,
+				"os":      runtime.GOOS,
+				"arch":    runtime.GOARCH,
+			},
+		},
+		Metadata: &provenance.Metadata{
+			BuildStartedOn:  &started,
+			BuildFinishedOn: &finished,
+			Completeness: provenance.Completeness{
+				Parameters: true,
+			},
+		},
+		Materials: materials,
+	}, provenance.Subject{
+		Name:   tagName,
+		Digest: provenance.NewDigestSet(manifest.Digest),
+	})
+
+	if _, err := engine.PutAttestation(context.Background(), manifest.Digest, provenance.MediaTypeStatement, statement); err != nil {
+		return errors.Wrap(err, "attach provenance")
+	}
+	log.Infof("attached provenance: %s", casext.AttestationRefName(manifest.Digest))
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var pruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "removes old tags from an OCI image according to retention rules",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+Tags which are not kept by any of the retention rules are removed, after which
+the image is garbage collected (see umoci-gc(1)). The age of a tag is taken
+from the creation time of the image it refers to.
+
+--keep-last keeps the most recently created "<n>" tags whose names start with
+"<prefix>" (or every tag if no prefix is given), and can be specified several
+times. If it is specified, only tags which start with one of the prefixes are
+removed. --keep-newer-than keeps every tag created less than the given duration
+ago. --protect keeps every tag matching the given regular expression, and can
+be specified several times. At least one --keep-last or --keep-newer-than rule
+must be given.`,
+
+	// prune modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "keep-last",
+			Usage: "keep the most recent tags with the given prefix ([<prefix>=]<n>)",
+		},
+		cli.StringFlag{
+			Name:  "keep-newer-than",
+			Usage: "keep tags created less than this duration ago (such as 72h)",
+		},
+		cli.StringSliceFlag{
+			Name:  "protect",
+			Usage: "never remove tags matching this regular expression",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print the tags which would be removed",
+		},
+		cli.BoolFlag{
+			Name:  "no-gc",
+			Usage: "do not garbage collect the image after removing tags",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if len(ctx.StringSlice("keep-last")) == 0 && ctx.String("keep-newer-than") == "" {
+			return errors.Errorf("at least one of --keep-last or --keep-newer-than must be specified")
+		}
+		return nil
+	},
+
+	Action: prune,
+}
+
+// parseKeepLast parses a --keep-last argument of the form [<prefix>=]<n>.
+func parseKeepLast(value string) (casext.KeepLastRule, error) {
+	var rule casext.KeepLastRule
+	count := value
+	if idx := strings.LastIndex(value, "="); idx >= 0 {
+		rule.Prefix, count = value[:idx], value[idx+1:]
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return rule, errors.Wrap(err, "parse count")
+	}
+	if n < 0 {
+		return rule, errors.Errorf("count must not be negative: %d", n)
+	}
+	rule.Count = n
+	return rule, nil
+}
+
+func prune(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	var policy casext.RetentionPolicy
+	for _, value := range ctx.StringSlice("keep-last") {
+		rule, err := parseKeepLast(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid --keep-last %s", value)
+		}
+		policy.KeepLast = append(policy.KeepLast, rule)
+	}
+	if value := ctx.String("keep-newer-than"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid --keep-newer-than %s", value)
+		}
+		if duration <= 0 {
+			return errors.Errorf("invalid --keep-newer-than %s: must be positive", value)
+		}
+		policy.KeepNewerThan = duration
+	}
+	for _, value := range ctx.StringSlice("protect") {
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid --protect %s", value)
+		}
+		policy.Protect = append(policy.Protect, pattern)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	expired, err := engineExt.ExpiredReferences(context.Background(), policy)
+	if err != nil {
+		return errors.Wrap(err, "apply retention policy")
+	}
+
+	for _, name := range expired {
+		fmt.Println(name)
+		if ctx.Bool("dry-run") {
+			continue
+		}
+		if err := engineExt.DeleteReference(context.Background(), name); err != nil {
+			return errors.Wrapf(err, "delete reference %s", name)
+		}
+		log.Infof("removed tag: %s", name)
+	}
+
+	if ctx.Bool("dry-run") || ctx.Bool("no-gc") {
+		return nil
+	}
+	return errors.Wrap(engineExt.GC(context.Background()), "gc")
+}
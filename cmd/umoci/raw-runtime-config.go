@@ -22,7 +22,6 @@ import (
 	"os"
 
 	"github.com/apex/log"
-	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/openSUSE/umoci/pkg/idtools"
@@ -106,14 +105,14 @@ func rawConfig(ctx *cli.Context) error {
 	for _, uidmap := range ctx.StringSlice("uid-map") {
 		idMap, err := idtools.ParseMapping(uidmap)
 		if err != nil {
-			return errors.Wrapf(err, "failure parsing --uid-map %s: %s", uidmap)
+			return errors.Wrapf(err, "failure parsing --uid-map %s", uidmap)
 		}
 		meta.MapOptions.UIDMappings = append(meta.MapOptions.UIDMappings, idMap)
 	}
 	for _, gidmap := range ctx.StringSlice("gid-map") {
 		idMap, err := idtools.ParseMapping(gidmap)
 		if err != nil {
-			return errors.Wrapf(err, "failure parsing --gid-map %s: %s", gidmap)
+			return errors.Wrapf(err, "failure parsing --gid-map %s", gidmap)
 		}
 		meta.MapOptions.GIDMappings = append(meta.MapOptions.GIDMappings, idMap)
 	}
@@ -124,7 +123,7 @@ func rawConfig(ctx *cli.Context) error {
 	}).Debugf("parsed mappings")
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -147,7 +146,7 @@ func rawConfig(ctx *cli.Context) error {
 	}
 	defer manifestBlob.Close()
 
-	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+	if !casext.IsManifestMediaType(manifestBlob.MediaType) {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid --image tag")
 	}
 
@@ -0,0 +1,225 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rebaseCommand = uxHistory(uxTag(cli.Command{
+	Name:  "rebase",
+	Usage: "replaces the base layers of an image with those of another image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--old-base <old-base-tag>] --new-base <new-base-tag>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to rebase, and "<old-base-tag>" and "<new-base-tag>" are the names
+of tagged images in the same OCI image which are the current and new base
+images respectively.
+
+The layers of "<old-base-tag>" must be the first layers of "<tag>", and are
+replaced by the layers of "<new-base-tag>". The remaining layers, as well as
+the configuration of "<tag>", are kept. If "<old-base-tag>" is not specified,
+the base image recorded in the manifest annotations of "<tag>" (by a previous
+rebase) is used.
+
+Note that the layers of the image are not regenerated, so this is only safe if
+the layers built on top of the old base image are still valid on top of the
+new base image (such as when the new base image only contains security
+updates).`,
+
+	// rebase creates a new image, with a given tag.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "old-base",
+			Usage: "tag of the current base image (defaults to the base recorded in the image annotations)",
+		},
+		cli.StringFlag{
+			Name:  "new-base",
+			Usage: "tag of the base image to rebase onto",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "validate the new image against the image-spec before tagging it",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("new-base") == "" {
+			return errors.Errorf("missing mandatory argument: --new-base")
+		}
+		return nil
+	},
+
+	Action: rebase,
+}))
+
+// resolveManifest resolves the given tag name, which must refer to a single
+// image manifest.
+func resolveManifest(ctx context.Context, engine casext.Engine, name string) (casext.DescriptorPath, error) {
+	descriptorPaths, err := engine.ResolveReference(ctx, name)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Errorf("tag not found: %s", name)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return casext.DescriptorPath{}, errors.Errorf("tag is ambiguous: %s", name)
+	}
+	descriptorPath := descriptorPaths[0]
+
+	// FIXME: Implement support for manifest lists.
+	if mt := descriptorPath.Descriptor().MediaType; !casext.IsManifestMediaType(mt) {
+		return casext.DescriptorPath{}, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", mt)
+	}
+	return descriptorPath, nil
+}
+
+func rebase(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	newBaseName := ctx.String("new-base")
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPath, err := resolveManifest(context.Background(), engineExt, fromName)
+	if err != nil {
+		return errors.Wrap(err, "invalid --image tag")
+	}
+	newBasePath, err := resolveManifest(context.Background(), engineExt, newBaseName)
+	if err != nil {
+		return errors.Wrap(err, "invalid --new-base tag")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPath)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	var oldBase ispec.Descriptor
+	if oldBaseName := ctx.String("old-base"); oldBaseName != "" {
+		oldBasePath, err := resolveManifest(context.Background(), engineExt, oldBaseName)
+		if err != nil {
+			return errors.Wrap(err, "invalid --old-base tag")
+		}
+		oldBase = oldBasePath.Descriptor()
+	} else {
+		annotations, err := mutator.Annotations(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "get annotations")
+		}
+		baseDigest, ok := annotations[mutate.AnnotationBaseDigest]
+		if !ok {
+			return errors.Errorf("image has no %s annotation: --old-base must be specified", mutate.AnnotationBaseDigest)
+		}
+		parsed, err := digest.Parse(baseDigest)
+		if err != nil {
+			return errors.Wrapf(err, "parse %s annotation", mutate.AnnotationBaseDigest)
+		}
+		// The annotation doesn't record the size of the manifest.
+		oldBase = ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    parsed,
+			Size:      -1,
+		}
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	created := time.Now()
+	history := ispec.History{
+		Author:    imageMeta.Author,
+		Comment:   "",
+		Created:   &created,
+		CreatedBy: "umoci rebase",
+	}
+
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+		history.Comment = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.created"]; ok {
+		created, err := time.Parse(igen.ISO8601, val.(string))
+		if err != nil {
+			return errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = &created
+	}
+	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+		history.CreatedBy = val.(string)
+	}
+
+	log.Infof("rebasing %s from %s onto %s", fromName, oldBase.Digest, newBasePath.Descriptor().Digest)
+
+	if err := mutator.Rebase(context.Background(), oldBase, newBasePath.Descriptor(), newBaseName, history); err != nil {
+		return errors.Wrap(err, "rebase image")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if ctx.Bool("strict") {
+		if err := engineExt.Validate(context.Background(), newDescriptorPath.Root()); err != nil {
+			return errors.Wrap(err, "validate mutated image")
+		}
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var remapCommand = uxHistory(uxTag(cli.Command{
+	Name:  "remap",
+	Usage: "rewrites the ownership of the layers of an image for a different id mapping",
+	ArgsUsage: `--image <image-path>[:<tag>] --from-map <map> --to-map <map> [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to remap, and each "<map>" is an id mapping of the form
+"container:host:size" (the same form as the --uid-map option of
+umoci-unpack(1)). --from-map and --to-map may be specified more than once.
+
+The owner and group of every file in every layer of the image are treated as
+host ids under the --from-map mappings, and are rewritten to the host ids
+which correspond to the same container ids under the --to-map mappings. This
+allows images whose layers contain host ids (such as images built without id
+mapping in a user namespace) to be moved between hosts with different
+subordinate id allocations. The mappings apply to both uids and gids, unless
+--from-gid-map and --to-gid-map are given. It is an error for a layer to
+contain an id which is not covered by the mappings.
+
+The remapped layers are written as new blobs, and "<new-tag>" (which defaults
+to "<tag>") is updated to refer to the new image manifest.`,
+
+	// remap creates a new image, with a given tag.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "from-map",
+			Usage: "id mapping the layers currently use (container:host:size)",
+		},
+		cli.StringSliceFlag{
+			Name:  "to-map",
+			Usage: "id mapping to remap the layers to (container:host:size)",
+		},
+		cli.StringSliceFlag{
+			Name:  "from-gid-map",
+			Usage: "gid mapping the layers currently use, if different to --from-map (container:host:size)",
+		},
+		cli.StringSliceFlag{
+			Name:  "to-gid-map",
+			Usage: "gid mapping to remap the layers to, if different to --to-map (container:host:size)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("from-map") {
+			return errors.Errorf("missing mandatory argument: --from-map")
+		}
+		if !ctx.IsSet("to-map") {
+			return errors.Errorf("missing mandatory argument: --to-map")
+		}
+		return nil
+	},
+
+	Action: remap,
+}))
+
+// parseMappings parses the id mappings given to the named flag, falling back
+// to the flag named fallback if it was not set.
+func parseMappings(ctx *cli.Context, name, fallback string) ([]rspec.LinuxIDMapping, error) {
+	if !ctx.IsSet(name) {
+		name = fallback
+	}
+	var mappings []rspec.LinuxIDMapping
+	for _, spec := range ctx.StringSlice(name) {
+		idMap, err := idtools.ParseMapping(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failure parsing --%s %s", name, spec)
+		}
+		mappings = append(mappings, idMap)
+	}
+	return mappings, nil
+}
+
+func remap(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	var (
+		idRemap layer.IDRemap
+		err     error
+	)
+	if idRemap.FromUIDMappings, err = parseMappings(ctx, "from-map", "from-map"); err != nil {
+		return err
+	}
+	if idRemap.FromGIDMappings, err = parseMappings(ctx, "from-gid-map", "from-map"); err != nil {
+		return err
+	}
+	if idRemap.ToUIDMappings, err = parseMappings(ctx, "to-map", "to-map"); err != nil {
+		return err
+	}
+	if idRemap.ToGIDMappings, err = parseMappings(ctx, "to-gid-map", "to-map"); err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPath, err := resolveManifest(context.Background(), engineExt, fromName)
+	if err != nil {
+		return errors.Wrap(err, "invalid --image tag")
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPath)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	created := time.Now()
+	history := ispec.History{
+		Author:    imageMeta.Author,
+		Comment:   "",
+		Created:   &created,
+		CreatedBy: "umoci remap",
+	}
+
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+		history.Comment = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.created"]; ok {
+		created, err := time.Parse(igen.ISO8601, val.(string))
+		if err != nil {
+			return errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = &created
+	}
+	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+		history.CreatedBy = val.(string)
+	}
+
+	log.Infof("remapping the layers of %s", fromName)
+
+	if err := mutator.Remap(context.Background(), idRemap, history); err != nil {
+		return errors.Wrap(err, "remap image")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
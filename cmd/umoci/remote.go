@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/registry"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// remoteImagePrefix is the prefix of --image values which refer to an image in
+// a registry ("docker://host[:port]/repository[:tag]", or a short name such as
+// "docker://alpine:3") rather than an image layout.
+const remoteImagePrefix = "docker://"
+
+// isRemoteImage returns whether the given --image path refers to an image in
+// a registry.
+func isRemoteImage(imagePath string) bool {
+	return strings.HasPrefix(imagePath, remoteImagePrefix)
+}
+
+// keptImage is the image layout in which the blobs of an image in a registry
+// are stored with --keep-blobs.
+type keptImage struct {
+	engine cas.Engine
+	peer   *registry.PeerResolver
+	opts   casext.FetchOptions
+}
+
+// registryClient returns the HTTP client used to access registries, which is
+// configured using the flags added by uxRegistryClient. Proxies are configured
+// by $HTTP_PROXY, $HTTPS_PROXY and $NO_PROXY.
+func registryClient(ctx *cli.Context) *http.Client {
+	limitRate, _ := ctx.App.Metadata["--limit-rate"].(int64)
+	maxConnections, _ := ctx.App.Metadata["--max-connections"].(int)
+	return registry.NewClient(registry.ClientOptions{
+		LimitRate:      limitRate,
+		MaxConnections: maxConnections,
+	})
+}
+
+// fetchOptions returns the options used to fetch blobs from registries, which
+// are configured using the flags added by uxRegistryClient.
+func fetchOptions(ctx *cli.Context) casext.FetchOptions {
+	maxConnections, _ := ctx.App.Metadata["--max-connections"].(int)
+	return casext.FetchOptions{MaxParallel: maxConnections}
+}
+
+// openRemoteEngine returns a read-only engine which reads the image with the
+// given tag directly from the registry referred to by imagePath (see
+// registry.NewRemoteEngine). If --keep-blobs is set, the blobs are also
+// stored in the given image layout (which is created if it doesn't exist),
+// which is returned as well. The returned engine owns the layout's engine.
+func openRemoteEngine(ctx *cli.Context, imagePath, tag string) (cas.Engine, *keptImage, error) {
+	scheme := "https://"
+	if ctx.Bool("plain-http") {
+		scheme = "http://"
+	}
+	peer, err := resolveRemoteImage(registryClient(ctx), scheme, strings.TrimPrefix(imagePath, remoteImagePrefix), tag)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "resolve --image %q", imagePath)
+	}
+
+	keepPath := ctx.String("keep-blobs")
+	if keepPath == "" {
+		return registry.NewRemoteEngine(peer, tag, nil), nil, nil
+	}
+	if _, err := os.Stat(keepPath); os.IsNotExist(err) {
+		if err := cas.Create(keepPath); err != nil {
+			return nil, nil, errors.Wrap(err, "create --keep-blobs image")
+		}
+	}
+	keep, err := openEngine(ctx, keepPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open --keep-blobs image")
+	}
+	return registry.NewRemoteEngine(peer, tag, keep), &keptImage{engine: keep, peer: peer, opts: fetchOptions(ctx)}, nil
+}
+
+// resolveRemoteImage returns a PeerResolver for the repository with the given
+// name, which makes requests with the given client. Short names (see
+// registry.IsShortName) are resolved using the aliases and unqualified search
+// registries of the host (see containers-registries.conf(5)), by trying each
+// candidate in turn until one of them has the given tag.
+func resolveRemoteImage(client *http.Client, scheme, name, tag string) (*registry.PeerResolver, error) {
+	if !registry.IsShortName(name) {
+		peer, err := registry.NewPeerResolver(scheme + registry.NormalizeName(name))
+		if err != nil {
+			return nil, err
+		}
+		peer.Client = client
+		return peer, nil
+	}
+
+	paths, err := registry.ShortNamesPaths()
+	if err != nil {
+		return nil, errors.Wrap(err, "find registries.conf")
+	}
+	shortNames, err := registry.LoadShortNames(paths)
+	if err != nil {
+		return nil, errors.Wrap(err, "load registries.conf")
+	}
+	candidates, err := shortNames.Candidates(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []string
+	for _, candidate := range candidates {
+		peer, err := registry.NewPeerResolver(scheme + candidate)
+		if err == nil {
+			peer.Client = client
+			_, err = peer.ResolveTag(context.Background(), tag)
+		}
+		if err != nil {
+			log.Debugf("short name %q: %s: %v", name, candidate, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", candidate, err))
+			continue
+		}
+		log.Infof("resolved short name %q to %s", name, candidate)
+		return peer, nil
+	}
+	return nil, errors.Errorf("resolve short name %q: %s", name, strings.Join(failures, "; "))
+}
+
+// tag creates the given tag in the image layout, for the image the bundle was
+// unpacked from. Blobs which weren't read while unpacking (such as layers
+// found in the layer cache) are fetched from the registry first.
+func (k *keptImage) tag(tag string, meta UmociMeta) error {
+	engineExt := casext.NewEngine(k.engine)
+	descriptor := meta.From.Root()
+	fetched, err := engineExt.FetchMissingBlobs(context.Background(), descriptor, []casext.BlobResolver{k.peer}, k.opts)
+	if err != nil {
+		return errors.Wrap(err, "fetch blobs of kept image")
+	}
+	if len(fetched) > 0 {
+		log.Infof("fetched %d blobs which were not unpacked", len(fetched))
+	}
+	if err := engineExt.UpdateReference(context.Background(), tag, descriptor); err != nil {
+		return errors.Wrap(err, "tag kept image")
+	}
+	log.Infof("kept blobs of image: %q -> %s", tag, descriptor.Digest)
+	return nil
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,12 +27,12 @@ import (
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/mutate"
-	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -39,7 +40,7 @@ import (
 	"golang.org/x/net/context"
 )
 
-var repackCommand = uxHistory(cli.Command{
+var repackCommand = uxScan(uxFreeSpace(uxSpecialFiles(uxHistory(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -61,7 +62,49 @@ new layer.
 It should be noted that this is not the same as oci-create-layer because it
 uses go-mtree to create diff layers from runtime bundles unpacked with
 umoci-unpack(1). In addition, it modifies the image so that all of the relevant
-manifest and configuration information uses the new diff atop the old manifest.`,
+manifest and configuration information uses the new diff atop the old manifest.
+The mtree specification generated by umoci-unpack(1) is used as the baseline
+for the diff, unless a different specification is given with --mtree.
+
+If --ignore-keyword is specified, the given mtree keywords (such as "uid" or
+"mode") are not compared when computing the diff, so that files whose only
+changes are to the ignored keywords are not included in the new layer. Files
+which are included in the new layer because of other changes still have all of
+their current metadata.
+
+If --scan-cmd is specified, the uncompressed tar stream of the new layer is fed
+to the given command (such as a vulnerability scanner) as the layer is
+generated, and its findings are reported. With --scan-fail-on the tag is not
+updated if any finding is at least as severe as the given severity.
+
+If --sign-key is specified, an OpenPGP detached signature of the new manifest
+is created with gpg(1) using the given key, and stored in the image alongside
+"<new-tag>" (see umoci-unpack(1) --verify-key).
+
+If --provenance is specified (or UMOCI_PROVENANCE is set), an in-toto statement
+with a SLSA provenance predicate describing how the new manifest was created
+(the image and mtree specification it was based on, and the arguments used) is
+attached to the new manifest, using the tag "<algorithm>-<hex>.att" (where
+"<algorithm>:<hex>" is the digest of the new manifest).
+
+If --layer-provenance is specified (or UMOCI_LAYER_PROVENANCE is set), the
+hostname, the digest of the absolute bundle path, the umoci version and the
+digest of the manifest the bundle was unpacked from are recorded in the
+"org.opensuse.umoci.layer.*" annotations of the new layer's descriptor, and
+are displayed by umoci-stat(1). Because they depend on the host, the new
+manifest is not reproducible.
+
+If --prefetch-profile is specified, the entries of the new layer for the paths
+listed in the given file (one path per line, in the order they are accessed
+when the container starts) are placed at the start of the layer, followed by an
+estargz-style ".prefetch.landmark" entry. Lazy pulling implementations can then
+prefetch the entries before the landmark to improve container startup time. If
+none of the paths are in the new layer, a ".no.prefetch.landmark" entry is
+placed at the start of the layer instead. umoci-unpack(1) ignores landmark
+entries.
+
+The new layer is compressed with gzip, unless --compress gives the name of a
+compressor plugin (see umoci(1)) to use instead.`,
 
 	// repack creates a new image, with a given tag.
 	Category: "image",
@@ -75,6 +118,93 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "no-mask-volumes",
 			Usage: "do not add the Config.Volumes of the image to the set of masked paths",
 		},
+		cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "only include deltas for paths matching one of these glob patterns when generating new layers",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "set of glob patterns for paths in which deltas will be ignored when generating new layers",
+		},
+		cli.StringSliceFlag{
+			Name:  "chown",
+			Usage: "set the ownership of paths in the new layer matching a glob pattern (<pattern>:<uid>:<gid>)",
+		},
+		cli.StringSliceFlag{
+			Name:  "chmod",
+			Usage: "set the permissions of paths in the new layer matching a glob pattern (<pattern>:<mode>)",
+		},
+		cli.BoolFlag{
+			Name:  "subsecond-times",
+			Usage: "preserve the sub-second component of modification times in the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "preserve-hardlink-count",
+			Usage: "add new hardlinks to unchanged files as hardlinks (rather than copies) in the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "strip-acls",
+			Usage: "do not include the posix and nfsv4 acls of files in the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "owner-names",
+			Usage: "record the names of the owners of files in the new layer using the /etc/passwd and /etc/group of the rootfs",
+		},
+		cli.StringFlag{
+			Name:  "prefetch-profile",
+			Usage: "order the new layer so that the paths listed in this file (in access order) come first, followed by a prefetch landmark",
+		},
+		cli.StringFlag{
+			Name:  "mtree",
+			Usage: "use the mtree specification at this path rather than the one generated by umoci-unpack(1)",
+		},
+		cli.StringSliceFlag{
+			Name:  "ignore-keyword",
+			Usage: "comma-separated mtree keywords which are not compared when computing the diff (such as uid,gid)",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "validate the new image against the image-spec before tagging it",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression algorithm of the new layer (gzip, or the name of a compressor plugin)",
+			Value: "gzip",
+		},
+		cli.StringFlag{
+			Name:  "platform.os",
+			Usage: "override the operating system recorded in the descriptor of the new manifest",
+		},
+		cli.StringFlag{
+			Name:  "platform.architecture",
+			Usage: "override the architecture recorded in the descriptor of the new manifest",
+		},
+		cli.StringFlag{
+			Name:  "platform.variant",
+			Usage: "override the architecture variant recorded in the descriptor of the new manifest",
+		},
+		cli.StringFlag{
+			Name:  "platform.os.version",
+			Usage: "override the operating system version recorded in the descriptor of the new manifest",
+		},
+		cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "sign the new image with this gpg key",
+		},
+		cli.BoolFlag{
+			Name:   "provenance",
+			Usage:  "attach a SLSA provenance statement to the new manifest",
+			EnvVar: "UMOCI_PROVENANCE",
+		},
+		cli.StringFlag{
+			Name:  "provenance-builder-id",
+			Usage: "builder id recorded in the provenance statement (implies --provenance)",
+		},
+		cli.BoolFlag{
+			Name:   "layer-provenance",
+			Usage:  "record where the new layer came from in annotations of its descriptor",
+			EnvVar: "UMOCI_LAYER_PROVENANCE",
+		},
 	},
 
 	Action: repack,
@@ -87,11 +217,24 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		for _, flag := range []string{"platform.os", "platform.architecture"} {
+			if ctx.IsSet(flag) && ctx.String(flag) == "" {
+				return errors.Errorf("--%s cannot be empty", flag)
+			}
+		}
+		if name := ctx.String("compress"); name != layer.CompressionGzip.String() {
+			compressor := layer.GetCompressor(name)
+			if compressor == nil {
+				return errors.Errorf("--compress: unknown compression algorithm %q (is the plugin installed?)", name)
+			}
+			ctx.App.Metadata["--compress"] = compressor
+		}
 		return nil
 	},
-})
+}))))
 
 func repack(ctx *cli.Context) error {
+	started := time.Now()
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 	bundlePath := ctx.App.Metadata["bundle"].(string)
@@ -108,12 +251,62 @@ func repack(ctx *cli.Context) error {
 		"map_options": meta.MapOptions,
 	}).Debugf("umoci: loaded UmociMeta metadata")
 
-	if meta.From.Descriptor().MediaType != ispec.MediaTypeImageManifest {
+	if meta.RootfsOnly {
+		return errors.Errorf("cannot repack bundle unpacked with --rootfs-only: no mtree specification")
+	}
+	if meta.PartialLayers != nil {
+		return errors.Errorf("cannot repack partial bundle: only layers %s were unpacked", meta.PartialLayers)
+	}
+
+	// The special file policies default to those used by umoci-unpack(1).
+	if val, ok := ctx.App.Metadata["--fifo-policy"]; ok {
+		meta.MapOptions.FifoPolicy = val.(layer.SpecialFilePolicy)
+	}
+	if val, ok := ctx.App.Metadata["--socket-policy"]; ok {
+		meta.MapOptions.SocketPolicy = val.(layer.SpecialFilePolicy)
+	}
+
+	meta.MapOptions.SubsecondTimes = ctx.Bool("subsecond-times")
+	meta.MapOptions.PreserveHardlinks = ctx.Bool("preserve-hardlink-count")
+	if ctx.Bool("strip-acls") {
+		meta.MapOptions.StripACLs = true
+	}
+
+	if ctx.IsSet("prefetch-profile") {
+		fh, err := os.Open(ctx.String("prefetch-profile"))
+		if err != nil {
+			return errors.Wrap(err, "open --prefetch-profile")
+		}
+		profile, err := layer.ReadPrefetchProfile(fh)
+		fh.Close()
+		if err != nil {
+			return errors.Wrap(err, "read --prefetch-profile")
+		}
+		meta.MapOptions.PrefetchProfile = profile
+	}
+
+	// Ownership and permission rules only apply to the new layer.
+	for _, spec := range ctx.StringSlice("chown") {
+		rule, err := layer.ParseChownRule(spec)
+		if err != nil {
+			return errors.Wrap(err, "parse --chown")
+		}
+		meta.MapOptions.ChownRules = append(meta.MapOptions.ChownRules, rule)
+	}
+	for _, spec := range ctx.StringSlice("chmod") {
+		rule, err := layer.ParseChmodRule(spec)
+		if err != nil {
+			return errors.Wrap(err, "parse --chmod")
+		}
+		meta.MapOptions.ChmodRules = append(meta.MapOptions.ChmodRules, rule)
+	}
+
+	if !casext.IsManifestMediaType(meta.From.Descriptor().MediaType) {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType), "invalid saved from descriptor")
 	}
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := openEngine(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -125,11 +318,31 @@ func repack(ctx *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "create mutator for base image")
 	}
+	if compressor, ok := ctx.App.Metadata["--compress"].(layer.Compressor); ok {
+		mutator.SetCompressor(compressor)
+	}
+	if ctx.Bool("layer-provenance") {
+		annotations, err := repackLayerAnnotations(ctx, bundlePath, meta)
+		if err != nil {
+			return errors.Wrap(err, "get layer provenance")
+		}
+		mutator.SetLayerAnnotations(annotations)
+	}
 
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), "sha256:", "sha256_", 1)
-	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	mtreePath := bundleMtreePath(bundlePath, meta)
+	if ctx.IsSet("mtree") {
+		mtreePath = ctx.String("mtree")
+	}
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
+	if ctx.Bool("owner-names") || meta.OwnerNames {
+		names, err := layer.RootfsOwnerNames(fullRootfsPath)
+		if err != nil {
+			return errors.Wrap(err, "read owner names")
+		}
+		meta.MapOptions.OwnerNames = names
+	}
+
 	log.WithFields(log.Fields{
 		"image":  imagePath,
 		"bundle": bundlePath,
@@ -148,17 +361,25 @@ func repack(ctx *cli.Context) error {
 		return errors.Wrap(err, "parse mtree")
 	}
 
+	keywords, err := parseIgnoredKeywords(bundleMtreeKeywords(meta.MapOptions), ctx.StringSlice("ignore-keyword"))
+	if err != nil {
+		return errors.Wrap(err, "parse --ignore-keyword")
+	}
+
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
+		"keywords": keywords,
 	}).Debugf("umoci: parsed mtree spec")
 
 	fsEval := fseval.DefaultFsEval
 	if meta.MapOptions.Rootless {
 		fsEval = fseval.RootlessFsEval
 	}
+	if meta.MapOptions.Portable {
+		fsEval = fseval.PortableFsEval
+	}
 
 	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
+	diffs, err := mtreefilter.Check(fullRootfsPath, spec, keywords, fsEval)
 	if err != nil {
 		return errors.Wrap(err, "check mtree")
 	}
@@ -181,6 +402,37 @@ func repack(ctx *cli.Context) error {
 	}
 	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.MaskFilter(maskedPaths))
 
+	globFilter, err := mtreefilter.GlobFilter(ctx.StringSlice("include"), ctx.StringSlice("exclude"))
+	if err != nil {
+		return errors.Wrap(err, "create glob filter")
+	}
+	diffs = mtreefilter.FilterDeltas(diffs, globFilter)
+
+	// Device nodes which were recorded rather than created by umoci-unpack(1)
+	// are still present in the image, but changes to the same paths in the
+	// bundle will shadow them.
+	devices, err := layer.ReadDeviceRecords(fullRootfsPath)
+	if err != nil {
+		return errors.Wrap(err, "read device records")
+	}
+	for _, device := range devices {
+		for _, diff := range diffs {
+			path := filepath.Join("/", diff.Path())
+			if path == device.Path || (diff.Type() == mtree.Missing && strings.HasPrefix(device.Path, path+"/")) {
+				log.Warnf("recorded device node %s is shadowed by change to %s", device.Path, path)
+			}
+		}
+	}
+
+	// Make sure that there is enough space in the image for the new layer,
+	// rather than running out of space part-way through generating it.
+	if !ctx.App.Metadata["--skip-space-check"].(bool) {
+		size := layer.EstimateGenerateSize(fullRootfsPath, diffs)
+		if err := layer.CheckFreeSpace(imagePath, size+ctx.App.Metadata["--min-free-space"].(int64)); err != nil {
+			return errors.Wrap(err, "check free space")
+		}
+	}
+
 	reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &meta.MapOptions)
 	if err != nil {
 		return errors.Wrap(err, "generate diff layer")
@@ -218,23 +470,111 @@ func repack(ctx *cli.Context) error {
 		history.CreatedBy = val.(string)
 	}
 
+	// Scan the new layer as it is generated.
+	var layerReader io.Reader = reader
+	finishLayerScan := func(digest.Digest) error { return nil }
+	if val, ok := ctx.App.Metadata["--scan"]; ok {
+		layerReader, finishLayerScan = val.(*layer.LayerScan).Tee(reader)
+	}
+
 	// TODO: We should add a flag to allow for a new layer to be made
 	//       non-distributable.
-	if err := mutator.Add(context.Background(), reader, history); err != nil {
+	if err := mutator.Add(context.Background(), layerReader, history); err != nil {
+		finishLayerScan("")
 		return errors.Wrap(err, "add diff layer")
 	}
 
+	if err := overridePlatform(ctx, mutator); err != nil {
+		finishLayerScan("")
+		return errors.Wrap(err, "override platform")
+	}
+
 	newDescriptorPath, err := mutator.Commit(context.Background())
 	if err != nil {
+		finishLayerScan("")
 		return errors.Wrap(err, "commit mutated image")
 	}
 
+	// The scan must pass before the tag is updated.
+	if _, ok := ctx.App.Metadata["--scan"]; ok {
+		newLayer, err := lastLayer(context.Background(), engineExt, newDescriptorPath.Descriptor())
+		if err != nil {
+			finishLayerScan("")
+			return errors.Wrap(err, "get new layer")
+		}
+		if err := finishLayerScan(newLayer); err != nil {
+			return errors.Wrap(err, "scan new layer")
+		}
+		if err := finishScan(ctx); err != nil {
+			return errors.Wrap(err, "scan new layer")
+		}
+	}
+
 	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
 
+	if ctx.Bool("strict") {
+		if err := engineExt.Validate(context.Background(), newDescriptorPath.Root()); err != nil {
+			return errors.Wrap(err, "validate mutated image")
+		}
+	}
+
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return errors.Wrap(err, "add new tag")
 	}
 
 	log.Infof("created new tag for image manifest: %s", tagName)
+
+	if ctx.Bool("provenance") || ctx.String("provenance-builder-id") != "" {
+		if err := attachRepackProvenance(ctx, engineExt, tagName, bundlePath, mtreePath, meta, newDescriptorPath.Descriptor(), started); err != nil {
+			return err
+		}
+	}
+	if key := ctx.String("sign-key"); key != "" {
+		return signReference(engineExt, tagName, key)
+	}
 	return nil
 }
+
+// overridePlatform applies the --platform.* flags to the platform which will be
+// recorded in the descriptor of the new manifest.
+func overridePlatform(ctx *cli.Context, mutator *mutate.Mutator) error {
+	platform, err := mutator.Platform(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get platform")
+	}
+
+	changed := false
+	for flag, field := range map[string]*string{
+		"platform.os":           &platform.OS,
+		"platform.architecture": &platform.Architecture,
+		"platform.variant":      &platform.Variant,
+		"platform.os.version":   &platform.OSVersion,
+	} {
+		if ctx.IsSet(flag) {
+			*field = ctx.String(flag)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return mutator.SetPlatform(context.Background(), platform)
+}
+
+// lastLayer returns the digest of the last layer of the given manifest.
+func lastLayer(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor) (digest.Digest, error) {
+	manifestBlob, err := engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return "", errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+	if len(manifest.Layers) == 0 {
+		return "", errors.Errorf("manifest has no layers")
+	}
+	return manifest.Layers[len(manifest.Layers)-1].Digest, nil
+}
@@ -0,0 +1,179 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// reusableBundle is a bundle whose rootfs can be used to seed the rootfs of a
+// new bundle (see layer.SeedRootfs).
+type reusableBundle struct {
+	path   string
+	meta   UmociMeta
+	layers int
+}
+
+// findReusableBundles returns the bundles recorded in the image (see
+// umoci-bundles(1)) whose rootfs contains a prefix of the layers of the given
+// manifest, unpacked with the same options. The bundles are sorted by the
+// number of shared layers, most first. The rootfs of the bundles have not been
+// verified (see verifyBundle).
+func findReusableBundles(ctx context.Context, engine casext.Engine, bundlePath string, manifest ispec.Manifest, opt layer.MapOptions) ([]reusableBundle, error) {
+	fullBundlePath, err := filepath.Abs(bundlePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "get absolute bundle path")
+	}
+	wantOpts, err := json.Marshal(opt)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode map options")
+	}
+
+	records, err := engine.Bundles(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list bundles")
+	}
+
+	var bundles []reusableBundle
+	for _, record := range records {
+		if record.Path == fullBundlePath {
+			continue
+		}
+		meta, err := ReadBundleMeta(record.Path)
+		if err != nil {
+			log.Debugf("reuse bundles: skipping %s: %v", record.Path, err)
+			continue
+		}
+		// Partial or unverifiable rootfs cannot be reused.
+		if meta.RootfsOnly || meta.SkippedLayers > 0 || meta.PartialLayers != nil {
+			log.Debugf("reuse bundles: skipping %s: not a complete bundle", record.Path)
+			continue
+		}
+		// Owners resolved by name depend on the passwd and group files of
+		// the whole image, not just the shared layers.
+		if meta.OwnerNames || opt.OwnerNames != nil {
+			log.Debugf("reuse bundles: skipping %s: owners resolved by name", record.Path)
+			continue
+		}
+		gotOpts, err := json.Marshal(meta.MapOptions)
+		if err != nil || !bytes.Equal(gotOpts, wantOpts) {
+			log.Debugf("reuse bundles: skipping %s: unpacked with different options", record.Path)
+			continue
+		}
+
+		manifestBlob, err := engine.FromDescriptor(ctx, meta.From.Descriptor())
+		if err != nil {
+			log.Debugf("reuse bundles: skipping %s: %v", record.Path, err)
+			continue
+		}
+		base, ok := manifestBlob.Data.(ispec.Manifest)
+		manifestBlob.Close()
+		if !ok {
+			continue
+		}
+		if n := layer.SharedLayers(base, manifest); n > 0 {
+			bundles = append(bundles, reusableBundle{
+				path:   record.Path,
+				meta:   meta,
+				layers: n,
+			})
+		}
+	}
+
+	sort.SliceStable(bundles, func(i, j int) bool {
+		return bundles[i].layers > bundles[j].layers
+	})
+	return bundles, nil
+}
+
+// verifyBundle checks that the rootfs of the bundle has not been modified
+// since it was unpacked, by comparing it against its mtree specification.
+func verifyBundle(bundle reusableBundle) error {
+	mfh, err := os.Open(bundleMtreePath(bundle.path, bundle.meta))
+	if err != nil {
+		return errors.Wrap(err, "open mtree")
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return errors.Wrap(err, "parse mtree")
+	}
+
+	fsEval := fseval.DefaultFsEval
+	if bundle.meta.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	if bundle.meta.MapOptions.Portable {
+		fsEval = fseval.PortableFsEval
+	}
+
+	diffs, err := mtreefilter.Check(filepath.Join(bundle.path, layer.RootfsName), spec, bundleMtreeKeywords(bundle.meta.MapOptions), fsEval)
+	if err != nil {
+		return errors.Wrap(err, "check mtree")
+	}
+	if len(diffs) > 0 {
+		return errors.Errorf("bundle has drifted from its source image: %d paths changed", len(diffs))
+	}
+	return nil
+}
+
+// seedFromBundles seeds rootfsPath with the rootfs of the recorded bundle
+// which shares the most layers with the manifest (and has not been modified
+// since it was unpacked). It returns whether the rootfs was seeded, in which
+// case the unpack has to be resumed to apply the remaining layers.
+func seedFromBundles(ctx context.Context, engine casext.Engine, bundlePath string, manifest ispec.Manifest, opt *layer.MapOptions) (bool, error) {
+	// Wasm images don't have layers which could be shared.
+	if casext.IsWasmManifest(manifest) {
+		log.Info("wasm images cannot reuse bundles")
+		return false, nil
+	}
+	bundles, err := findReusableBundles(ctx, engine, bundlePath, manifest, *opt)
+	if err != nil {
+		return false, err
+	}
+	for _, bundle := range bundles {
+		if err := verifyBundle(bundle); err != nil {
+			log.Infof("cannot reuse bundle %s: %v", bundle.path, err)
+			continue
+		}
+		log.Infof("reusing %d of %d layers from bundle %s", bundle.layers, len(manifest.Layers), bundle.path)
+		srcRootfsPath := filepath.Join(bundle.path, layer.RootfsName)
+		rootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+		if err := layer.SeedRootfs(srcRootfsPath, rootfsPath, manifest, bundle.layers, opt); err != nil {
+			return false, errors.Wrapf(err, "seed rootfs from bundle %s", bundle.path)
+		}
+		return true, nil
+	}
+	log.Info("no bundle can be reused")
+	return false, nil
+}
@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os/exec"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// commandScanner is a layer.Scanner which runs a command (with "sh -c") for
+// each layer. The uncompressed tar stream of the layer is written to the
+// command's stdin, and the command must write a JSON array of layer.Finding
+// objects to its stdout (empty output is treated as no findings). The scan
+// fails if the command exits with a non-zero status.
+type commandScanner struct {
+	command string
+
+	// dir is the directory the command is run in (or "" for the current
+	// directory), and its stderr is written to stderr.
+	dir    string
+	stderr io.Writer
+}
+
+// ScanLayer implements layer.Scanner.
+func (s commandScanner) ScanLayer(r io.Reader) ([]layer.Finding, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", s.command)
+	cmd.Stdin = r
+	cmd.Stdout = &stdout
+	cmd.Stderr = s.stderr
+	cmd.Dir = s.dir
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "run scan command %q", s.command)
+	}
+
+	var findings []layer.Finding
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return findings, nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &findings); err != nil {
+		return nil, errors.Wrap(err, "parse scan command output")
+	}
+	return findings, nil
+}
+
+// finishScan reports the findings of the --scan-cmd scanner (if one was
+// used), and returns an error if any of them are at least as severe as
+// --scan-fail-on.
+func finishScan(ctx *cli.Context) error {
+	val, ok := ctx.App.Metadata["--scan"]
+	if !ok {
+		return nil
+	}
+	scan := val.(*layer.LayerScan)
+
+	findings := scan.Findings
+	if findings == nil {
+		findings = []layer.Finding{}
+	}
+	for _, finding := range findings {
+		log.WithFields(log.Fields{
+			"layer":    finding.Layer,
+			"severity": finding.Severity,
+			"package":  finding.Package,
+			"path":     finding.Path,
+		}).Infof("scan finding: %s", finding.ID)
+	}
+	log.Infof("scanner reported %d findings", len(findings))
+
+	if path, ok := ctx.App.Metadata["--scan-report"]; ok {
+		data, err := json.MarshalIndent(findings, "", "\t")
+		if err != nil {
+			return errors.Wrap(err, "encode scan report")
+		}
+		if err := ioutil.WriteFile(path.(string), append(data, '\n'), 0644); err != nil {
+			return errors.Wrap(err, "write scan report")
+		}
+	}
+
+	if threshold, ok := ctx.App.Metadata["--scan-fail-on"]; ok {
+		if exceeding := scan.Exceeding(threshold.(string)); len(exceeding) > 0 {
+			return errors.Errorf("scanner reported %d findings with severity of at least %s (first: %s in %s)", len(exceeding), threshold, exceeding[0].ID, exceeding[0].Layer)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/registry"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var serveCommand = cli.Command{
+	Name:  "serve",
+	Usage: "serves an OCI image layout as a read-only registry",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+The images in the layout are served over HTTP using the registry API (as used
+by "docker pull" and skopeo(1)), so that they can be pulled without a separate
+registry. Every tag is available in every repository, except for tags of the
+form "<name>:<tag>" which are only available as "<tag>" in the "<name>"
+repository. Only pulling is supported.
+
+The server does not support TLS or authentication, and by default only listens
+on localhost. Clients will need to be configured to treat it as an insecure
+registry.`,
+
+	// serve reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "address",
+			Usage: "address to listen on",
+			Value: "localhost:5000",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("address") == "" {
+			return errors.Errorf("--address cannot be empty")
+		}
+		return nil
+	},
+
+	Action: serve,
+}
+
+func serve(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := openEngine(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	listener, err := net.Listen("tcp", ctx.String("address"))
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+	defer listener.Close()
+
+	log.Infof("serving %s on http://%s", imagePath, listener.Addr())
+	return errors.Wrap(http.Serve(listener, registry.NewHandler(engineExt)), "serve")
+}
@@ -0,0 +1,121 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// sessionBefore is the Before function shared by the session commands.
+func sessionBefore(ctx *cli.Context) error {
+	if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+		return errors.Errorf("missing mandatory argument: --layout")
+	}
+	if ctx.NArg() != 0 {
+		return errors.Errorf("invalid number of positional arguments: expected none")
+	}
+	return nil
+}
+
+var beginCommand = cli.Command{
+	Name:  "begin",
+	Usage: "begins a session of staged modifications to an OCI image",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+Once a session has begun, all modifications made by umoci to the image (new
+blobs, changes to tags and garbage collection) are staged rather than applied.
+The staged modifications are visible to every umoci command operating on the
+image, but are not visible to other users of the image until they are applied
+atomically with "umoci commit", or discarded with "umoci rollback".`,
+
+	// begin modifies an image layout.
+	Category: "layout",
+
+	Before: sessionBefore,
+	Action: begin,
+}
+
+func begin(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	if err := dir.Begin(imagePath); err != nil {
+		return errors.Wrap(err, "begin session")
+	}
+	log.Infof("began session: %s", imagePath)
+	return nil
+}
+
+var commitCommand = cli.Command{
+	Name:  "commit",
+	Usage: "applies the modifications staged in a session to an OCI image",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+Every modification staged since "umoci begin" is applied to the image, and the
+session is ended. The new tags become visible atomically. If the commit is
+interrupted, running "umoci commit" again will finish it.`,
+
+	// commit modifies an image layout.
+	Category: "layout",
+
+	Before: sessionBefore,
+	Action: commit,
+}
+
+func commit(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	if err := dir.Commit(imagePath); err != nil {
+		return errors.Wrap(err, "commit session")
+	}
+	log.Infof("committed session: %s", imagePath)
+	return nil
+}
+
+var rollbackCommand = cli.Command{
+	Name:  "rollback",
+	Usage: "discards the modifications staged in a session of an OCI image",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+Every modification staged since "umoci begin" is discarded, and the session is
+ended. The image is left as it was before the session began.`,
+
+	// rollback modifies an image layout.
+	Category: "layout",
+
+	Before: sessionBefore,
+	Action: rollback,
+}
+
+func rollback(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	if err := dir.Rollback(imagePath); err != nil {
+		return errors.Wrap(err, "rollback session")
+	}
+	log.Infof("rolled back session: %s", imagePath)
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// gpgBinary is the name of the gpg(1) binary used for signing and verifying.
+var gpgBinary = "gpg"
+
+// gpgSigner is a casext.Signer which uses gpg(1) to produce ASCII-armoured
+// OpenPGP detached signatures with the given key.
+type gpgSigner struct {
+	key string
+}
+
+// Sign implements casext.Signer.
+func (s gpgSigner) Sign(data []byte) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(gpgBinary, "--batch", "--armor", "--detach-sign", "--local-user", s.key)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "run %s", gpgBinary)
+	}
+	return stdout.Bytes(), nil
+}
+
+// gpgVerifier is a casext.Verifier which uses gpg(1) to verify OpenPGP
+// detached signatures against the user's keyring. If key is not empty, the
+// signature must have been made by one of the keys it refers to (see
+// gpgFingerprints).
+type gpgVerifier struct {
+	key string
+}
+
+// Verify implements casext.Verifier.
+func (v gpgVerifier) Verify(data, signature []byte) error {
+	sigFile, err := ioutil.TempFile("", "umoci-signature")
+	if err != nil {
+		return errors.Wrap(err, "create temporary signature")
+	}
+	defer os.Remove(sigFile.Name())
+	defer sigFile.Close()
+	if _, err := sigFile.Write(signature); err != nil {
+		return errors.Wrap(err, "write temporary signature")
+	}
+
+	var status bytes.Buffer
+	cmd := exec.Command(gpgBinary, "--batch", "--status-fd", "1", "--verify", sigFile.Name(), "-")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &status
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "bad signature (%s)", gpgBinary)
+	}
+
+	// See doc/DETAILS in the GnuPG sources. The VALIDSIG line contains the
+	// fingerprint of the signing key, and (as the last field) the
+	// fingerprint of its primary key.
+	var fingerprints []string
+	scanner := bufio.NewScanner(&status)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[0] == "[GNUPG:]" && fields[1] == "VALIDSIG" {
+			fingerprints = append(fingerprints, fields[2], fields[len(fields)-1])
+		}
+	}
+	if len(fingerprints) == 0 {
+		return errors.Errorf("no valid signature reported by %s", gpgBinary)
+	}
+	log.Debugf("valid signature by %v", fingerprints)
+
+	if v.key == "" {
+		return nil
+	}
+	keyFingerprints, err := gpgFingerprints(v.key)
+	if err != nil {
+		return errors.Wrapf(err, "find key %s", v.key)
+	}
+	for _, fingerprint := range fingerprints {
+		for _, keyFingerprint := range keyFingerprints {
+			if strings.EqualFold(fingerprint, keyFingerprint) {
+				return nil
+			}
+		}
+	}
+	return errors.Errorf("signature was not made by key %s", v.key)
+}
+
+// gpgFingerprints returns the fingerprints of the keys (and subkeys) in the
+// user's keyring which match the given key specification (such as a key ID,
+// fingerprint or user ID).
+func gpgFingerprints(key string) ([]string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(gpgBinary, "--batch", "--with-colons", "--fingerprint", "--", key)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "run %s", gpgBinary)
+	}
+
+	// Fingerprints are stored in the tenth field of "fpr" records.
+	var fingerprints []string
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) >= 10 && fields[0] == "fpr" {
+			fingerprints = append(fingerprints, fields[9])
+		}
+	}
+	return fingerprints, nil
+}
+
+// signReference signs the image referred to by refname with the given gpg(1)
+// key (see casext.SignReference).
+func signReference(engine casext.Engine, refname, key string) error {
+	if err := engine.SignReference(context.Background(), refname, gpgSigner{key: key}); err != nil {
+		return errors.Wrap(err, "sign image")
+	}
+	log.Infof("signed %s with key %s", refname, key)
+	return nil
+}
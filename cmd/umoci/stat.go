@@ -21,16 +21,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"text/template"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
-	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
 )
 
-var statCommand = cli.Command{
+var statCommand = uxFormat(cli.Command{
 	Name:  "stat",
 	Usage: "displays status information of an image manifest",
 	ArgsUsage: `--image <image-path>[:<tag>]
@@ -38,9 +38,16 @@ var statCommand = cli.Command{
 Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
 the tagged image to stat.
 
-WARNING: Do not depend on the output of this tool unless you're using --json.
-The intention of the default formatting of this tool is that it is easy for
-humans to read, and might change in future versions.`,
+WARNING: Do not depend on the output of this tool unless you're using --json
+or --format. The intention of the default formatting of this tool is that it
+is easy for humans to read, and might change in future versions.
+
+If --format is given, it is a Go text/template which is executed (and followed
+by a newline) for every entry in the history of the image, rather than
+outputting the other status information. The fields available are .Layer (the
+layer descriptor, which is nil for empty layers), .DiffID, .Created,
+.CreatedBy, .Author, .Comment and .EmptyLayer. The "json" function outputs its
+argument as JSON.`,
 
 	// stat gives information about a manifest.
 	Category: "image",
@@ -53,14 +60,21 @@ humans to read, and might change in future versions.`,
 	},
 
 	Action: stat,
-}
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.Bool("json") && ctx.IsSet("format") {
+			return errors.Errorf("--json and --format are mutually exclusive")
+		}
+		return nil
+	},
+})
 
 func stat(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -78,7 +92,7 @@ func stat(ctx *cli.Context) error {
 	manifestDescriptor := manifestDescriptorPaths[0].Descriptor()
 
 	// FIXME: Implement support for manifest lists.
-	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+	if !casext.IsManifestMediaType(manifestDescriptor.MediaType) {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid saved from descriptor")
 	}
 
@@ -89,7 +103,14 @@ func stat(ctx *cli.Context) error {
 	}
 
 	// Output the stat information.
-	if ctx.Bool("json") {
+	if tmpl, ok := ctx.App.Metadata["--format"].(*template.Template); ok {
+		for _, entry := range ms.History {
+			if err := tmpl.Execute(os.Stdout, entry); err != nil {
+				return errors.Wrap(err, "format history entry")
+			}
+			fmt.Println()
+		}
+	} else if ctx.Bool("json") {
 		// Use JSON.
 		if err := json.NewEncoder(os.Stdout).Encode(ms); err != nil {
 			return errors.Wrap(err, "encoding stat")
@@ -0,0 +1,320 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var statsCommand = cli.Command{
+	Name:  "stats",
+	Usage: "displays size statistics for the images in an OCI layout",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+For every tagged image in the layout, the compressed and uncompressed size of
+each layer is reported along with the largest files in each layer. The total
+size of the layout is also split into blobs which are shared between several
+tags, and blobs which are only used by a single tag.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// stats reads all of the images in a layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "top",
+			Usage: "number of largest files to report for each layer",
+			Value: 10,
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the statistics as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.Int("top") < 0 {
+			return errors.Errorf("--top must not be negative")
+		}
+		return nil
+	},
+
+	Action: stats,
+}
+
+// LayoutStats contains size statistics about all of the images in a layout.
+type LayoutStats struct {
+	// Images contains the statistics of each tagged image, sorted by tag.
+	Images []imageStats `json:"images"`
+
+	// Layers contains the statistics of each distinct layer used by the
+	// tagged images, in the order they were first referenced.
+	Layers []layerStats `json:"layers"`
+
+	// TotalSize is the total size of all distinct blobs reachable from a tag.
+	TotalSize int64 `json:"total_size"`
+
+	// SharedSize is the total size of blobs reachable from more than one tag.
+	SharedSize int64 `json:"shared_size"`
+
+	// UniqueSize is the total size of blobs reachable from only one tag.
+	UniqueSize int64 `json:"unique_size"`
+}
+
+// imageStats contains size statistics about a single tagged image.
+type imageStats struct {
+	// Tag is the name of the tag.
+	Tag string `json:"tag"`
+
+	// Manifest is the descriptor of the image's manifest.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Size is the total size of all blobs reachable from the tag.
+	Size int64 `json:"size"`
+
+	// UncompressedSize is the total size of the image's layers when
+	// uncompressed.
+	UncompressedSize int64 `json:"uncompressed_size"`
+
+	// Layers is the list of layer digests of the image, in manifest order.
+	Layers []digest.Digest `json:"layers"`
+}
+
+// layerStats contains size statistics about a single layer.
+type layerStats struct {
+	// Layer is the descriptor of the layer.
+	Layer ispec.Descriptor `json:"layer"`
+
+	// Tags is the sorted list of tags which use this layer.
+	Tags []string `json:"tags"`
+
+	// Stats contains information about the contents of the layer. It is nil
+	// if the layer is non-distributable and not present in the layout.
+	Stats *layer.Stats `json:"stats"`
+}
+
+// Format formats a LayoutStats using the default formatting, and writes the
+// result to the given writer.
+func (ls LayoutStats) Format(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "TAG\tMANIFEST\tLAYERS\tSIZE\tUNCOMPRESSED\n")
+	for _, image := range ls.Images {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", image.Tag, image.Manifest.Digest, len(image.Layers), units.HumanSize(float64(image.Size)), units.HumanSize(float64(image.UncompressedSize)))
+	}
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "LAYER\tSIZE\tUNCOMPRESSED\tENTRIES\tTAGS\n")
+	for _, layerStat := range ls.Layers {
+		var (
+			uncompressed = "<none>"
+			entries      = "<none>"
+		)
+		if layerStat.Stats != nil {
+			uncompressed = units.HumanSize(float64(layerStat.Stats.UncompressedSize))
+			entries = fmt.Sprintf("%d", layerStat.Stats.Entries)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layerStat.Layer.Digest, units.HumanSize(float64(layerStat.Layer.Size)), uncompressed, entries, strings.Join(layerStat.Tags, ","))
+	}
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "LAYER\tFILE\tSIZE\n")
+	for _, layerStat := range ls.Layers {
+		if layerStat.Stats == nil {
+			continue
+		}
+		for _, file := range layerStat.Stats.LargestFiles {
+			path := strings.Replace(file.Path, "\t", " ", -1)
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", layerStat.Layer.Digest, path, units.HumanSize(float64(file.Size)))
+		}
+	}
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "TOTAL\tSHARED\tUNIQUE\n")
+	fmt.Fprintf(tw, "%s\t%s\t%s\n", units.HumanSize(float64(ls.TotalSize)), units.HumanSize(float64(ls.SharedSize)), units.HumanSize(float64(ls.UniqueSize)))
+	return tw.Flush()
+}
+
+// Stats computes the LayoutStats for every tag in the given image, including
+// at most top of the largest files of each layer.
+func Stats(ctx context.Context, engine casext.Engine, top int) (LayoutStats, error) {
+	var stats LayoutStats
+
+	names, err := engine.ListReferences(ctx)
+	if err != nil {
+		return stats, errors.Wrap(err, "list references")
+	}
+	sort.Strings(names)
+
+	// Maps from blob digests to the set of tags which can reach them.
+	blobSizes := map[digest.Digest]int64{}
+	blobTags := map[digest.Digest]map[string]struct{}{}
+	layerIdx := map[digest.Digest]int{}
+
+	for _, name := range names {
+		descriptorPaths, err := engine.ResolveReference(ctx, name)
+		if err != nil {
+			return stats, errors.Wrapf(err, "resolve %s", name)
+		}
+		if len(descriptorPaths) != 1 {
+			// TODO: Handle this more nicely.
+			return stats, errors.Errorf("tag is ambiguous: %s", name)
+		}
+		image := imageStats{
+			Tag:      name,
+			Manifest: descriptorPaths[0].Descriptor(),
+		}
+
+		reachable := map[digest.Digest]struct{}{}
+		if err := engine.Walk(ctx, image.Manifest, func(descriptorPath casext.DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			if _, ok := reachable[descriptor.Digest]; ok {
+				return nil
+			}
+			reachable[descriptor.Digest] = struct{}{}
+			image.Size += descriptor.Size
+
+			blobSizes[descriptor.Digest] = descriptor.Size
+			if blobTags[descriptor.Digest] == nil {
+				blobTags[descriptor.Digest] = map[string]struct{}{}
+			}
+			blobTags[descriptor.Digest][name] = struct{}{}
+
+			if !casext.IsManifestMediaType(descriptor.MediaType) {
+				return nil
+			}
+			manifestBlob, err := engine.FromDescriptor(ctx, descriptor)
+			if err != nil {
+				return errors.Wrap(err, "get manifest")
+			}
+			defer manifestBlob.Close()
+			manifest, ok := manifestBlob.Data.(ispec.Manifest)
+			if !ok {
+				// Should _never_ be reached.
+				return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+			}
+			for _, layerDescriptor := range manifest.Layers {
+				image.Layers = append(image.Layers, layerDescriptor.Digest)
+				if _, ok := layerIdx[layerDescriptor.Digest]; !ok {
+					layerIdx[layerDescriptor.Digest] = len(stats.Layers)
+					stats.Layers = append(stats.Layers, layerStats{Layer: layerDescriptor})
+				}
+			}
+			return nil
+		}); err != nil {
+			return stats, errors.Wrapf(err, "walk %s", name)
+		}
+		stats.Images = append(stats.Images, image)
+	}
+
+	// Compute the contents of each distinct layer once.
+	for idx := range stats.Layers {
+		layerStat := &stats.Layers[idx]
+		for tag := range blobTags[layerStat.Layer.Digest] {
+			layerStat.Tags = append(layerStat.Tags, tag)
+		}
+		sort.Strings(layerStat.Tags)
+
+		log.Infof("computing statistics for layer %s", layerStat.Layer.Digest)
+
+		contents, err := layer.LayerStats(ctx, engine, layerStat.Layer, top)
+		if err != nil {
+			if casext.IsNonDistributableMediaType(layerStat.Layer.MediaType) && os.IsNotExist(errors.Cause(err)) {
+				log.Warnf("skipping non-distributable layer not present in image: %s", layerStat.Layer.Digest)
+				continue
+			}
+			return stats, errors.Wrapf(err, "layer %s", layerStat.Layer.Digest)
+		}
+		layerStat.Stats = &contents
+	}
+
+	for idx := range stats.Images {
+		image := &stats.Images[idx]
+		for _, layerDigest := range image.Layers {
+			if contents := stats.Layers[layerIdx[layerDigest]].Stats; contents != nil {
+				image.UncompressedSize += contents.UncompressedSize
+			}
+		}
+	}
+
+	for blobDigest, size := range blobSizes {
+		stats.TotalSize += size
+		if len(blobTags[blobDigest]) > 1 {
+			stats.SharedSize += size
+		} else {
+			stats.UniqueSize += size
+		}
+	}
+	return stats, nil
+}
+
+func stats(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	ls, err := Stats(context.Background(), engineExt, ctx.Int("top"))
+	if err != nil {
+		return errors.Wrap(err, "stats")
+	}
+
+	// Output the statistics.
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(ls); err != nil {
+			return errors.Wrap(err, "encoding stats")
+		}
+	} else {
+		if err := ls.Format(os.Stdout); err != nil {
+			return errors.Wrap(err, "format stats")
+		}
+	}
+	return nil
+}
@@ -19,10 +19,15 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"text/template"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
@@ -31,17 +36,59 @@ import (
 var tagAddCommand = cli.Command{
 	Name:  "tag",
 	Usage: "creates a new tag in an OCI image",
-	ArgsUsage: `--image <image-path>[:<tag>] <new-tag>
+	ArgsUsage: `--image <image-path>[:<tag>] [--digest <digest>] [--expect-digest <old-digest>] <new-tag>
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the old name of
-the tag and "<new-tag>" is the new name of the tag.`,
+the tag and "<new-tag>" is the new name of the tag.
+
+If --digest is specified, "<new-tag>" will instead refer to the manifest or
+index blob with the given "<digest>", which must already exist in the image.
+"<tag>" cannot be specified in that case.
+
+If --expect-digest is specified, "<new-tag>" is only replaced if it currently
+refers to "<old-digest>" (or, if "<old-digest>" is empty, if it doesn't exist).
+Otherwise the tag is left unchanged and umoci fails, so that concurrent
+modifications of "<new-tag>" can be detected and retried.
+
+The signature of "<tag>" (if it has one) is also used for "<new-tag>". If
+--sign-key is specified, a new OpenPGP detached signature of the manifest is
+instead created with gpg(1) using the given key (see umoci-unpack(1)
+--verify-key).`,
 
 	// tag modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "digest",
+			Usage: "digest of an existing manifest or index blob to tag",
+		},
+		cli.StringFlag{
+			Name:  "expect-digest",
+			Usage: "only replace <new-tag> if it refers to this digest (empty if it must not exist)",
+		},
+		cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "sign the tagged image with this gpg key",
+		},
+	},
+
 	Action: tagAdd,
 
 	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("digest") {
+			if strings.Contains(ctx.String("image"), ":") {
+				return errors.Errorf("--digest cannot be used with a source tag")
+			}
+			if _, err := digest.Parse(ctx.String("digest")); err != nil {
+				return errors.Wrap(err, "invalid --digest")
+			}
+		}
+		if old := ctx.String("expect-digest"); old != "" {
+			if _, err := digest.Parse(old); err != nil {
+				return errors.Wrap(err, "invalid --expect-digest")
+			}
+		}
 		if ctx.NArg() != 1 {
 			return errors.Errorf("invalid number of positional arguments: expected <new-tag>")
 		}
@@ -62,7 +109,7 @@ func tagAdd(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["new-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -70,22 +117,49 @@ func tagAdd(ctx *cli.Context) error {
 	defer engine.Close()
 
 	// Get original descriptor.
-	descriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
-	if err != nil {
-		return errors.Wrap(err, "get descriptor")
-	}
-	if len(descriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+	var descriptor ispec.Descriptor
+	if ctx.IsSet("digest") {
+		blobDigest := digest.Digest(ctx.String("digest"))
+		descriptor, err = engineExt.ResolveDigest(context.Background(), blobDigest)
+		if err != nil {
+			return errors.Wrap(err, "get descriptor")
+		}
+		fromName = blobDigest.String()
+	} else {
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+		if err != nil {
+			return errors.Wrap(err, "get descriptor")
+		}
+		if len(descriptorPaths) != 1 {
+			// TODO: Handle this more nicely.
+			return errors.Errorf("tag is ambiguous: %s", fromName)
+		}
+		descriptor = descriptorPaths[0].Descriptor()
 	}
-	descriptor := descriptorPaths[0].Descriptor()
+
+	// The new tag refers to the same blob, so the signature is still valid.
+	signature, signed := descriptor.Annotations[casext.SignatureAnnotation]
 
 	// Add it.
-	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+	if ctx.IsSet("expect-digest") {
+		old := digest.Digest(ctx.String("expect-digest"))
+		if err := engineExt.SwapReference(context.Background(), tagName, old, descriptor); err != nil {
+			return errors.Wrap(err, "swap reference")
+		}
+	} else if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
 		return errors.Wrap(err, "put reference")
 	}
 
 	log.Infof("created new tag: %q -> %q", tagName, fromName)
+
+	if key := ctx.String("sign-key"); key != "" {
+		return signReference(engineExt, tagName, key)
+	}
+	if signed {
+		if err := engineExt.SetReferenceSignature(context.Background(), tagName, []byte(signature)); err != nil {
+			return errors.Wrap(err, "copy signature")
+		}
+	}
 	return nil
 }
 
@@ -110,7 +184,7 @@ func tagRemove(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -126,7 +200,7 @@ func tagRemove(ctx *cli.Context) error {
 	return nil
 }
 
-var tagListCommand = cli.Command{
+var tagListCommand = uxFormat(cli.Command{
 	Name:    "list",
 	Aliases: []string{"ls"},
 	Usage:   "lists the set of tags in an OCI image",
@@ -135,19 +209,35 @@ var tagListCommand = cli.Command{
 Where "<image-path>" is the path to the OCI image.
 
 Gives the full list of tags in an OCI image, with each tag name on a single
-line. See umoci-stat(1) to get more information about each tagged image.`,
+line. See umoci-stat(1) to get more information about each tagged image.
+
+If --format is given, it is a Go text/template which is executed (and
+followed by a newline) for every manifest referenced by each tag. The fields
+available are .Name (the tag name), .MediaType, .Digest, .Size and
+.Annotations (of the manifest descriptor). The "json" function outputs its
+argument as JSON.`,
 
 	// tag modifies an image layout.
 	Category: "layout",
 
 	Action: tagList,
+})
+
+// tagListEntry is the data passed to the --format template of umoci-list(1).
+type tagListEntry struct {
+	// Name is the name of the tag.
+	Name string
+
+	// Descriptor is the descriptor of the manifest the tag references. Its
+	// fields are accessible directly from the template.
+	ispec.Descriptor
 }
 
 func tagList(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -159,8 +249,27 @@ func tagList(ctx *cli.Context) error {
 		return errors.Wrap(err, "list references")
 	}
 
+	tmpl, _ := ctx.App.Metadata["--format"].(*template.Template)
 	for _, name := range names {
-		fmt.Println(name)
+		if tmpl == nil {
+			fmt.Println(name)
+			continue
+		}
+
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), name)
+		if err != nil {
+			return errors.Wrapf(err, "resolve %s", name)
+		}
+		for _, descriptorPath := range descriptorPaths {
+			entry := tagListEntry{
+				Name:       name,
+				Descriptor: descriptorPath.Descriptor(),
+			}
+			if err := tmpl.Execute(os.Stdout, entry); err != nil {
+				return errors.Wrapf(err, "format %s", name)
+			}
+			fmt.Println()
+		}
 	}
 	return nil
 }
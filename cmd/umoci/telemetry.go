@@ -0,0 +1,86 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/telemetry"
+	"github.com/openSUSE/umoci/pkg/telemetry/otlp"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// traceShutdownTimeout is how long we wait for the remaining telemetry of a
+// command to be exported once it has finished.
+const traceShutdownTimeout = 5 * time.Second
+
+// tracer exports the spans and counters of a command to the OTLP collector
+// given with the global --trace-endpoint flag, so that umoci's operations can
+// be observed by (for instance) build farms.
+type tracer struct {
+	recorder *otlp.Recorder
+	endRoot  func(error)
+}
+
+// startTracing starts exporting telemetry if it was requested with
+// --trace-endpoint. All of the spans of the command are part of a single
+// trace. The returned tracer (if not nil) must be stopped so that the
+// telemetry is exported.
+func startTracing(ctx *cli.Context) (*tracer, error) {
+	endpoint := ctx.GlobalString("trace-endpoint")
+	if endpoint == "" {
+		return nil, nil
+	}
+	recorder, err := otlp.NewRecorder(endpoint, otlp.Options{
+		ServiceVersion: version,
+		OnError: func(err error) {
+			log.Warnf("trace export: %v", err)
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --trace-endpoint")
+	}
+
+	name := "umoci"
+	if command := ctx.Args().First(); command != "" {
+		name += " " + command
+	}
+	t := &tracer{
+		recorder: recorder,
+		endRoot:  recorder.StartRoot(name, nil),
+	}
+	telemetry.SetRecorder(recorder)
+	return t, nil
+}
+
+// stop ends the trace of the command (which failed if err is not nil) and
+// exports any remaining telemetry. Failing to export telemetry doesn't cause
+// the command to fail, so errors are only logged.
+func (t *tracer) stop(err error) {
+	telemetry.SetRecorder(nil)
+	t.endRoot(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+	if err := t.recorder.Shutdown(ctx); err != nil {
+		log.Warnf("trace export: %v", err)
+	}
+}
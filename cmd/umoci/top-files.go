@@ -0,0 +1,220 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var topFilesCommand = cli.Command{
+	Name:  "top-files",
+	Usage: "displays the largest files in the merged filesystem of an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to analyse.
+
+The layers of the image are applied (in memory) in order, and the largest files
+and directories in the resulting filesystem are reported along with the layer
+which introduced them. Files which were added by a layer but then removed or
+overwritten by a later layer are reported as wasted space.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// top-files reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "top",
+			Usage: "number of files and directories to report",
+			Value: 10,
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the analysis as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.Int("top") < 0 {
+			return errors.Errorf("--top must not be negative")
+		}
+		return nil
+	},
+
+	Action: topFiles,
+}
+
+// topFile is a file in the merged view, annotated with the layer which
+// introduced it.
+type topFile struct {
+	layer.MergedFile
+	LayerDigest string `json:"layer_digest"`
+}
+
+// wastedFile is a hidden file, annotated with the layers which introduced and
+// removed it.
+type wastedFile struct {
+	layer.WastedFile
+	LayerDigest     string `json:"layer_digest"`
+	RemovedByDigest string `json:"removed_by_digest"`
+}
+
+// TopFiles contains the result of analysing the merged view of an image.
+type TopFiles struct {
+	// Files is the set of largest files in the merged view.
+	Files []topFile `json:"files"`
+
+	// Directories is the set of largest directories in the merged view.
+	Directories []layer.DirectoryStat `json:"directories"`
+
+	// Wasted is the set of largest files which are hidden in the merged view.
+	Wasted []wastedFile `json:"wasted"`
+
+	// TotalSize is the total size of all files in the merged view.
+	TotalSize int64 `json:"total_size"`
+
+	// WastedSize is the total size of all hidden files.
+	WastedSize int64 `json:"wasted_size"`
+}
+
+// Format formats TopFiles using the default formatting, and writes the result
+// to the given writer.
+func (tf TopFiles) Format(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "FILE\tSIZE\tLAYER\n")
+	for _, file := range tf.Files {
+		path := strings.Replace(file.Path, "\t", " ", -1)
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", path, units.HumanSize(float64(file.Size)), file.LayerDigest)
+	}
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "DIRECTORY\tSIZE\n")
+	for _, dir := range tf.Directories {
+		path := strings.Replace(dir.Path, "\t", " ", -1)
+		fmt.Fprintf(tw, "%s\t%s\n", path, units.HumanSize(float64(dir.Size)))
+	}
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "WASTED\tSIZE\tLAYER\tREMOVED BY\n")
+	for _, file := range tf.Wasted {
+		path := strings.Replace(file.Path, "\t", " ", -1)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", path, units.HumanSize(float64(file.Size)), file.LayerDigest, file.RemovedByDigest)
+	}
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "TOTAL\tWASTED\n")
+	fmt.Fprintf(tw, "%s\t%s\n", units.HumanSize(float64(tf.TotalSize)), units.HumanSize(float64(tf.WastedSize)))
+	return tw.Flush()
+}
+
+func topFiles(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	top := ctx.Int("top")
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestDescriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(manifestDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+	manifestDescriptor := manifestDescriptorPaths[0].Descriptor()
+
+	// FIXME: Implement support for manifest lists.
+	if !casext.IsManifestMediaType(manifestDescriptor.MediaType) {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid --image tag")
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	analysis, err := layer.AnalyzeManifest(context.Background(), engineExt, manifest)
+	if err != nil {
+		return errors.Wrap(err, "analyse layers")
+	}
+
+	tf := TopFiles{
+		Directories: analysis.LargestDirectories(top),
+		TotalSize:   analysis.TotalSize(),
+		WastedSize:  analysis.WastedSize(),
+	}
+	for _, file := range analysis.LargestFiles(top) {
+		tf.Files = append(tf.Files, topFile{
+			MergedFile:  file,
+			LayerDigest: manifest.Layers[file.Layer].Digest.String(),
+		})
+	}
+	for _, file := range analysis.LargestWasted(top) {
+		tf.Wasted = append(tf.Wasted, wastedFile{
+			WastedFile:      file,
+			LayerDigest:     manifest.Layers[file.Layer].Digest.String(),
+			RemovedByDigest: manifest.Layers[file.RemovedBy].Digest.String(),
+		})
+	}
+
+	// Output the analysis.
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(tf); err != nil {
+			return errors.Wrap(err, "encoding top-files")
+		}
+	} else {
+		if err := tf.Format(os.Stdout); err != nil {
+			return errors.Wrap(err, "format top-files")
+		}
+	}
+	return nil
+}
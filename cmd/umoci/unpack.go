@@ -21,14 +21,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -36,7 +38,7 @@ import (
 	"golang.org/x/net/context"
 )
 
-var unpackCommand = cli.Command{
+var unpackCommand = uxRemoteImage(uxScan(uxLayerLimits(uxFreeSpace(uxSpecialFiles(cli.Command{
 	Name:  "unpack",
 	Usage: "unpacks a reference into an OCI runtime bundle",
 	ArgsUsage: `--image <image-path>[:<tag>] <bundle>
@@ -47,7 +49,107 @@ is the destination to unpack the image to.
 
 It should be noted that this is not the same as oci-create-runtime-bundle,
 because this command also will create an mtree specification to allow for layer
-creation with umoci-repack(1).`,
+creation with umoci-repack(1).
+
+If --rootfs-only is specified, only the root filesystem is extracted. No
+runtime configuration or mtree specification is generated, which means that
+the bundle cannot be repacked with umoci-repack(1). --mtree-output can be used
+to write the mtree specification somewhere other than "<bundle>" (such as a
+different filesystem), in which case the path is recorded in the bundle
+metadata so that umoci-repack(1) can find it.
+
+If --resume is specified, an earlier unpack of the same image to "<bundle>"
+(with the same options) which was interrupted is continued. Layers which were
+already completely extracted are skipped.
+
+If --skip-base-layers is specified (which requires --rootfs-only), the layers
+of the base image recorded in the image's manifest annotations (see
+umoci-rebase(1)) are not extracted, producing a partial root filesystem which
+only contains the changes made on top of the base image. --base-layer can be
+used to instead skip every layer up to (and including) the given layer.
+
+--start-from-layer and --stop-at-layer can be used to only extract a range of
+the layers of the image (given by their zero-based indexes in the manifest,
+and including both ends of the range), which is useful for finding which layer
+introduces a problem. The range is recorded in "<bundle>/umoci.json", and such
+a partial bundle cannot be repacked with umoci-repack(1).
+
+By default, device nodes in the image are not created. Instead they are
+recorded in "<bundle>/rootfs.umoci-devices", so that images containing device
+nodes can be unpacked and repacked predictably. --device-policy=skip does not
+record them, while --allow-devices (or --device-policy=create) creates them
+(in rootless and portable mode they are replaced with empty files).
+
+Paths in the image which only differ in their Unicode normalisation form (or,
+with --case-insensitive, in their case) refer to the same file on some
+filesystems (such as those used by macOS). --path-collisions=error causes the
+unpack to fail if such paths are found, while --path-collisions=normalize
+renames them to whichever of the paths was extracted first.
+
+--conflict-policy can be used to audit suspicious interactions between layers,
+such as a layer replacing a directory with a symlink (or vice versa) or adding
+a path underneath a symlink. With --conflict-policy=warn each conflict is
+logged and recorded in "<bundle>/rootfs.umoci-conflicts", while
+--conflict-policy=error causes the unpack to fail.
+
+If --scan-cmd is specified, the uncompressed tar stream of each layer is fed
+to the given command (such as a vulnerability scanner) as the layer is
+extracted, and its findings are reported. With --scan-fail-on the unpack
+fails if any finding is at least as severe as the given severity.
+
+The modes of extracted files are applied exactly as recorded in the image, and
+parent directories missing from the image are created with mode 0755,
+regardless of the umask of the process. --apply-umask causes the umask to be
+applied to both.
+
+If --omit-times is specified, the access and modification times of every file
+are set to the Unix epoch (rather than the times recorded in the image), and
+file times are not recorded in the mtree specification. This means that
+umoci-repack(1) and umoci-check-bundle(1) only detect changes to the contents
+and metadata of files, and two bundles unpacked from images with the same
+contents are identical.
+
+If --reuse-bundles is specified, the bundles recorded in the image (see
+umoci-bundles(1)) are searched for one which was unpacked (with the same
+options) from an image whose layers are all shared with the image being
+unpacked. After verifying that its root filesystem has not been modified (in
+the same way as umoci-check-bundle(1)), its root filesystem is cloned and
+only the remaining layers are extracted. File contents are shared with
+reflinks on filesystems which support them, and are copied otherwise.
+
+If --fsverity is specified, fs-verity is enabled on every regular file once
+the rootfs has been extracted, so that the kernel verifies their contents
+whenever they are read and the contents can no longer be modified. The
+fs-verity digest of each file is recorded next to the rootfs (in
+"<bundle>/rootfs.umoci-verity"), and is checked by umoci-verify-rootfs(1).
+
+If --into-existing-snapshot is specified, a snapshot of the rootfs is saved in
+the given snapshot store after each layer is extracted (one for each chain of
+layers, keyed by the layers and the unpacking options). Unpacking an image
+whose first layers have already been extracted with the same options starts
+from a clone of the snapshot with the most layers, so only the remaining
+layers have to be extracted. With --snapshot-driver=btrfs (the default if the
+store is on btrfs), snapshots are read-only btrfs subvolumes and the rootfs is
+created as a subvolume. The copy driver clones snapshots file by file, sharing
+file contents with reflinks where supported.
+
+If --verify-key is specified, the OpenPGP signature of "<tag>" (created with
+--sign-key by umoci-repack(1) or umoci-tag(1)) is verified with gpg(1) before
+anything is unpacked, and must have been made by the given key. Use
+--verify-key="" to accept a valid signature by any key in the keyring.
+
+"<image-path>" can also refer to an image in a registry, of the form
+"docker://<host>[:<port>]/<repository>" (or a short name such as
+"docker://alpine", which is resolved using containers-registries.conf(5)), in
+which case the layers are streamed from the registry directly into the root
+filesystem without being stored (every blob is still verified against its
+digest). The registry must allow anonymous access, and --plain-http must be
+used for registries which do not support HTTPS. Proxies are configured by
+$HTTP_PROXY, $HTTPS_PROXY and $NO_PROXY, and --limit-rate and
+--max-connections limit the bandwidth and number of connections used. With
+--keep-blobs, the blobs are also stored in the given image layout (which is
+created if it doesn't exist) and "<tag>" is created there, so that the bundle
+can be repacked using that layout.`,
 
 	// unpack reads manifest information.
 	Category: "image",
@@ -65,6 +167,102 @@ creation with umoci-repack(1).`,
 			Name:  "rootless",
 			Usage: "enable rootless unpacking support",
 		},
+		cli.BoolFlag{
+			Name:  "portable",
+			Usage: "only use filesystem operations available on all host operating systems (enabled by default on non-Linux hosts)",
+		},
+		cli.StringFlag{
+			Name:  "device-policy",
+			Usage: "how device nodes in the image are handled (create, skip or record)",
+			Value: string(layer.DevicePolicyRecord),
+		},
+		cli.BoolFlag{
+			Name:  "allow-devices",
+			Usage: "create device nodes in the image (equivalent to --device-policy=create)",
+		},
+		cli.StringFlag{
+			Name:  "path-collisions",
+			Usage: "how paths which only differ in their unicode normalisation are handled (ignore, error or normalize)",
+			Value: string(layer.PathCollisionIgnore),
+		},
+		cli.BoolFlag{
+			Name:  "case-insensitive",
+			Usage: "also consider paths which only differ in case to collide (for --path-collisions)",
+		},
+		cli.StringFlag{
+			Name:  "conflict-policy",
+			Usage: "how suspicious interactions between layers are handled (ignore, warn or error)",
+			Value: string(layer.ConflictIgnore),
+		},
+		cli.BoolFlag{
+			Name:  "apply-umask",
+			Usage: "apply the process umask to the modes of extracted files",
+		},
+		cli.BoolFlag{
+			Name:  "omit-times",
+			Usage: "set the times of extracted files to the unix epoch and omit them from the mtree specification",
+		},
+		cli.BoolFlag{
+			Name:  "strip-acls",
+			Usage: "do not extract the posix and nfsv4 acls of files",
+		},
+		cli.BoolFlag{
+			Name:  "reflink-duplicates",
+			Usage: "reflink regular files which are duplicates of files extracted earlier (on filesystems supporting reflinks)",
+		},
+		cli.BoolFlag{
+			Name:  "fsverity",
+			Usage: "enable fs-verity on every extracted regular file and record their digests",
+		},
+		cli.BoolFlag{
+			Name:  "owner-names",
+			Usage: "resolve the owners of files by name using the /etc/passwd and /etc/group of the image",
+		},
+		cli.BoolFlag{
+			Name:  "rootfs-only",
+			Usage: "only extract the root filesystem (the bundle cannot be repacked)",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "continue an interrupted unpack of the same image to the bundle",
+		},
+		cli.BoolFlag{
+			Name:  "skip-base-layers",
+			Usage: "do not extract the layers of the base image recorded in the image annotations (requires --rootfs-only)",
+		},
+		cli.StringFlag{
+			Name:  "base-layer",
+			Usage: "do not extract any layers up to and including the layer with this digest (implies --skip-base-layers)",
+		},
+		cli.IntFlag{
+			Name:  "start-from-layer",
+			Usage: "only extract the layers starting from the layer with this (zero-based) index (the bundle cannot be repacked)",
+		},
+		cli.IntFlag{
+			Name:  "stop-at-layer",
+			Usage: "only extract the layers up to and including the layer with this (zero-based) index (the bundle cannot be repacked)",
+		},
+		cli.StringFlag{
+			Name:  "mtree-output",
+			Usage: "write the mtree specification of the rootfs to this path rather than the bundle",
+		},
+		cli.StringFlag{
+			Name:  "verify-key",
+			Usage: "require the image to have a valid gpg signature by this key",
+		},
+		cli.BoolFlag{
+			Name:  "reuse-bundles",
+			Usage: "clone the rootfs of an existing bundle sharing base layers with the image rather than extracting them",
+		},
+		cli.StringFlag{
+			Name:  "into-existing-snapshot",
+			Usage: "snapshot store used to start from a snapshot of already-extracted layers, and to store snapshots of new layers",
+		},
+		cli.StringFlag{
+			Name:  "snapshot-driver",
+			Usage: "driver used for --into-existing-snapshot (auto, btrfs or copy)",
+			Value: "auto",
+		},
 	},
 
 	Action: unpack,
@@ -76,9 +274,122 @@ creation with umoci-repack(1).`,
 		if ctx.Args().First() == "" {
 			return errors.Errorf("bundle path cannot be empty")
 		}
+		if ctx.Bool("allow-devices") && ctx.IsSet("device-policy") {
+			return errors.Errorf("--allow-devices and --device-policy are mutually exclusive")
+		}
+		if (ctx.Bool("skip-base-layers") || ctx.IsSet("base-layer")) && !ctx.Bool("rootfs-only") {
+			return errors.Errorf("--skip-base-layers and --base-layer require --rootfs-only")
+		}
+		if ctx.IsSet("start-from-layer") || ctx.IsSet("stop-at-layer") {
+			if ctx.Int("start-from-layer") < 0 || ctx.Int("stop-at-layer") < 0 {
+				return errors.Errorf("--start-from-layer and --stop-at-layer cannot be negative")
+			}
+			if ctx.Bool("skip-base-layers") || ctx.IsSet("base-layer") {
+				return errors.Errorf("--start-from-layer and --stop-at-layer cannot be used with --skip-base-layers or --base-layer")
+			}
+			if ctx.Bool("reuse-bundles") {
+				return errors.Errorf("--start-from-layer and --stop-at-layer cannot be used with --reuse-bundles")
+			}
+			if ctx.IsSet("into-existing-snapshot") {
+				return errors.Errorf("--start-from-layer and --stop-at-layer cannot be used with --into-existing-snapshot")
+			}
+		}
+		if ctx.Bool("reuse-bundles") {
+			if ctx.Bool("resume") {
+				return errors.Errorf("--reuse-bundles cannot be used with --resume")
+			}
+			if ctx.Bool("skip-base-layers") || ctx.IsSet("base-layer") {
+				return errors.Errorf("--reuse-bundles cannot be used with --skip-base-layers or --base-layer")
+			}
+		}
+		if ctx.IsSet("into-existing-snapshot") {
+			if ctx.String("into-existing-snapshot") == "" {
+				return errors.Errorf("--into-existing-snapshot path cannot be empty")
+			}
+			if ctx.Bool("reuse-bundles") {
+				return errors.Errorf("--into-existing-snapshot cannot be used with --reuse-bundles")
+			}
+			if ctx.Bool("skip-base-layers") || ctx.IsSet("base-layer") {
+				return errors.Errorf("--into-existing-snapshot cannot be used with --skip-base-layers or --base-layer")
+			}
+			if ctx.Bool("owner-names") {
+				return errors.Errorf("--into-existing-snapshot cannot be used with --owner-names")
+			}
+			driver, err := layer.ParseSnapshotDriver(ctx.String("snapshot-driver"))
+			if err != nil {
+				return errors.Wrap(err, "parse --snapshot-driver")
+			}
+			ctx.App.Metadata["--snapshot-driver"] = driver
+		} else if ctx.IsSet("snapshot-driver") {
+			return errors.Errorf("--snapshot-driver requires --into-existing-snapshot")
+		}
+		if isRemoteImage(ctx.App.Metadata["--image-path"].(string)) {
+			if ctx.Bool("reuse-bundles") {
+				return errors.Errorf("--reuse-bundles cannot be used with an image in a registry")
+			}
+			if ctx.IsSet("verify-key") {
+				return errors.Errorf("--verify-key cannot be used with an image in a registry")
+			}
+		}
+		if ctx.IsSet("mtree-output") {
+			if ctx.Bool("rootfs-only") {
+				return errors.Errorf("--mtree-output cannot be used with --rootfs-only")
+			}
+			if ctx.String("mtree-output") == "" {
+				return errors.Errorf("--mtree-output path cannot be empty")
+			}
+		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
 		return nil
 	},
+})))))
+
+// baseLayerCount returns the number of layers at the start of the manifest
+// which belong to its base image. If baseLayer is not empty, it is the digest
+// of the last base layer. Otherwise the base image recorded in the manifest
+// annotations is used, and must be present in the engine.
+func baseLayerCount(ctx context.Context, engine casext.Engine, manifest ispec.Manifest, baseLayer string) (int, error) {
+	if baseLayer != "" {
+		for idx, descriptor := range manifest.Layers {
+			if descriptor.Digest.String() == baseLayer {
+				return idx + 1, nil
+			}
+		}
+		return 0, errors.Errorf("layer %s is not in the image", baseLayer)
+	}
+
+	baseDigest, ok := manifest.Annotations[mutate.AnnotationBaseDigest]
+	if !ok {
+		return 0, errors.Errorf("image has no %s annotation", mutate.AnnotationBaseDigest)
+	}
+	parsed, err := digest.Parse(baseDigest)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse %s annotation", mutate.AnnotationBaseDigest)
+	}
+
+	baseBlob, err := engine.FromDescriptor(ctx, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    parsed,
+		Size:      -1,
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "get base image manifest")
+	}
+	defer baseBlob.Close()
+	base, ok := baseBlob.Data.(ispec.Manifest)
+	if !ok {
+		return 0, errors.Errorf("base image is not an image manifest: %s", baseBlob.MediaType)
+	}
+
+	if len(base.Layers) > len(manifest.Layers) {
+		return 0, errors.Errorf("base image has more layers than the image")
+	}
+	for idx, descriptor := range base.Layers {
+		if manifest.Layers[idx].Digest != descriptor.Digest {
+			return 0, errors.Errorf("layer %d of the image (%s) does not match the base image (%s)", idx, manifest.Layers[idx].Digest, descriptor.Digest)
+		}
+	}
+	return len(base.Layers), nil
 }
 
 func unpack(ctx *cli.Context) error {
@@ -92,6 +403,7 @@ func unpack(ctx *cli.Context) error {
 	// Parse map options.
 	// We need to set mappings if we're in rootless mode.
 	meta.MapOptions.Rootless = ctx.Bool("rootless")
+	meta.MapOptions.Portable = ctx.Bool("portable") || forcePortable
 	if meta.MapOptions.Rootless {
 		if !ctx.IsSet("uid-map") {
 			ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid()))
@@ -104,30 +416,104 @@ func unpack(ctx *cli.Context) error {
 	for _, uidmap := range ctx.StringSlice("uid-map") {
 		idMap, err := idtools.ParseMapping(uidmap)
 		if err != nil {
-			return errors.Wrapf(err, "failure parsing --uid-map %s: %s", uidmap)
+			return errors.Wrapf(err, "failure parsing --uid-map %s", uidmap)
 		}
 		meta.MapOptions.UIDMappings = append(meta.MapOptions.UIDMappings, idMap)
 	}
 	for _, gidmap := range ctx.StringSlice("gid-map") {
 		idMap, err := idtools.ParseMapping(gidmap)
 		if err != nil {
-			return errors.Wrapf(err, "failure parsing --gid-map %s: %s", gidmap)
+			return errors.Wrapf(err, "failure parsing --gid-map %s", gidmap)
 		}
 		meta.MapOptions.GIDMappings = append(meta.MapOptions.GIDMappings, idMap)
 	}
 
+	if ctx.Bool("allow-devices") {
+		meta.MapOptions.DevicePolicy = layer.DevicePolicyCreate
+	} else {
+		policy, err := layer.ParseDevicePolicy(ctx.String("device-policy"))
+		if err != nil {
+			return errors.Wrap(err, "parse --device-policy")
+		}
+		meta.MapOptions.DevicePolicy = policy
+	}
+
+	pathPolicy, err := layer.ParsePathCollisionPolicy(ctx.String("path-collisions"))
+	if err != nil {
+		return errors.Wrap(err, "parse --path-collisions")
+	}
+	meta.MapOptions.PathCollisionPolicy = pathPolicy
+	meta.MapOptions.CaseInsensitive = ctx.Bool("case-insensitive")
+
+	conflictPolicy, err := layer.ParseConflictPolicy(ctx.String("conflict-policy"))
+	if err != nil {
+		return errors.Wrap(err, "parse --conflict-policy")
+	}
+	meta.MapOptions.ConflictPolicy = conflictPolicy
+	meta.MapOptions.ApplyUmask = ctx.Bool("apply-umask")
+	meta.MapOptions.OmitTimes = ctx.Bool("omit-times")
+	meta.MapOptions.StripACLs = ctx.Bool("strip-acls")
+	meta.MapOptions.ReflinkDuplicates = ctx.Bool("reflink-duplicates")
+	meta.MapOptions.Verity = ctx.Bool("fsverity")
+
+	meta.MapOptions.MinFreeSpace = ctx.App.Metadata["--min-free-space"].(int64)
+	meta.MapOptions.SkipSpaceCheck = ctx.App.Metadata["--skip-space-check"].(bool)
+	meta.MapOptions.MaxLayerSize = ctx.App.Metadata["--max-layer-size"].(int64)
+	meta.MapOptions.MaxCompressionRatio = ctx.App.Metadata["--max-compression-ratio"].(int64)
+	meta.MapOptions.MaxLayerEntries = ctx.App.Metadata["--max-layer-entries"].(int64)
+	meta.MapOptions.MaxPathDepth = ctx.App.Metadata["--max-path-depth"].(int)
+	if val, ok := ctx.App.Metadata["--scan"]; ok {
+		meta.MapOptions.Scan = val.(*layer.LayerScan)
+	}
+	meta.MapOptions.LayerCache = openLayerCache(ctx)
+	if ctx.IsSet("into-existing-snapshot") {
+		snapshots, err := layer.NewSnapshotStore(ctx.String("into-existing-snapshot"), ctx.App.Metadata["--snapshot-driver"].(layer.SnapshotDriver))
+		if err != nil {
+			return errors.Wrap(err, "open snapshot store")
+		}
+		log.Infof("using %s snapshot store: %s", snapshots.Driver(), ctx.String("into-existing-snapshot"))
+		meta.MapOptions.Snapshots = snapshots
+	}
+
+	if val, ok := ctx.App.Metadata["--fifo-policy"]; ok {
+		meta.MapOptions.FifoPolicy = val.(layer.SpecialFilePolicy)
+	}
+	if val, ok := ctx.App.Metadata["--socket-policy"]; ok {
+		meta.MapOptions.SocketPolicy = val.(layer.SpecialFilePolicy)
+	}
+
 	log.WithFields(log.Fields{
 		"map.uid": meta.MapOptions.UIDMappings,
 		"map.gid": meta.MapOptions.GIDMappings,
 	}).Debugf("parsed mappings")
 
-	// Get a reference to the CAS.
-	engine, err := cas.Open(imagePath)
+	// Get a reference to the CAS. Bundles are recorded in the image, which
+	// for images in a registry is the --keep-blobs layout (if any).
+	var (
+		engine cas.Engine
+		keep   *keptImage
+	)
+	if isRemoteImage(imagePath) {
+		engine, keep, err = openRemoteEngine(ctx, imagePath, fromName)
+	} else {
+		engine, err = openEngine(ctx, imagePath)
+	}
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
+	recordEngine := engine
+	if keep != nil {
+		recordEngine = keep.engine
+	}
+
+	if ctx.IsSet("verify-key") {
+		if err := engineExt.VerifyReference(context.Background(), fromName, gpgVerifier{key: ctx.String("verify-key")}); err != nil {
+			return errors.Wrap(err, "verify signature")
+		}
+		log.Infof("verified signature of %s", fromName)
+	}
 
 	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
 	if err != nil {
@@ -145,12 +531,20 @@ func unpack(ctx *cli.Context) error {
 	}
 	defer manifestBlob.Close()
 
-	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+	if !casext.IsManifestMediaType(manifestBlob.MediaType) {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid --image tag")
 	}
 
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), "sha256:", "sha256_", 1)
-	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	// The mtree specification is stored outside of the bundle if requested,
+	// and the (absolute) path is recorded in the bundle metadata.
+	if ctx.IsSet("mtree-output") {
+		mtreeOutput, err := filepath.Abs(ctx.String("mtree-output"))
+		if err != nil {
+			return errors.Wrap(err, "get absolute --mtree-output path")
+		}
+		meta.MtreePath = mtreeOutput
+	}
+	mtreePath := bundleMtreePath(bundlePath, meta)
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
@@ -167,23 +561,135 @@ func unpack(ctx *cli.Context) error {
 		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
 	}
 
+	if ctx.Bool("owner-names") {
+		names, err := layer.ImageOwnerNames(context.Background(), engineExt, manifest)
+		if err != nil {
+			return errors.Wrap(err, "read owner names")
+		}
+		meta.MapOptions.OwnerNames = names
+		meta.OwnerNames = true
+	}
+
+	if ctx.IsSet("start-from-layer") || ctx.IsSet("stop-at-layer") {
+		layers := LayerRange{Start: 0, Stop: len(manifest.Layers) - 1}
+		if ctx.IsSet("start-from-layer") {
+			layers.Start = ctx.Int("start-from-layer")
+		}
+		if ctx.IsSet("stop-at-layer") {
+			layers.Stop = ctx.Int("stop-at-layer")
+		}
+		if layers.Start > layers.Stop || layers.Stop >= len(manifest.Layers) {
+			return errors.Errorf("invalid range of layers %s: image has %d layers", layers, len(manifest.Layers))
+		}
+		meta.PartialLayers = &layers
+		log.Warnf("only extracting layers %s of %d: the bundle will be partial and cannot be repacked", layers, len(manifest.Layers))
+	}
+
 	// Unpack the runtime bundle.
 	if err := os.MkdirAll(bundlePath, 0755); err != nil {
 		return errors.Wrap(err, "create bundle path")
 	}
 	// XXX: We should probably defer os.RemoveAll(bundlePath).
 
+	resume := ctx.Bool("resume")
+	if ctx.Bool("reuse-bundles") {
+		// A seeded rootfs only needs the remaining layers to be applied,
+		// which is the same as resuming an interrupted unpack.
+		seeded, err := seedFromBundles(context.Background(), engineExt, bundlePath, manifest, &meta.MapOptions)
+		if err != nil {
+			return errors.Wrap(err, "reuse bundles")
+		}
+		resume = seeded
+	}
+
+	unpackRootfs := layer.UnpackRootfs
+	unpackManifest := layer.UnpackManifest
+	if resume {
+		unpackRootfs = layer.ResumeUnpackRootfs
+		unpackManifest = layer.ResumeUnpackManifest
+	}
+	if layers := meta.PartialLayers; layers != nil {
+		start, end := layers.Start, layers.Stop+1
+		if resume {
+			// The layers before the range are already recorded as having
+			// been applied, so we only need to drop the layers after it.
+			resumeRootfs, resumeManifest := unpackRootfs, unpackManifest
+			unpackRootfs = func(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *layer.MapOptions) error {
+				manifest.Layers = manifest.Layers[:end]
+				return resumeRootfs(ctx, engine, rootfsPath, manifest, opt)
+			}
+			unpackManifest = func(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *layer.MapOptions) error {
+				manifest.Layers = manifest.Layers[:end]
+				return resumeManifest(ctx, engine, bundle, manifest, opt)
+			}
+		} else {
+			unpackRootfs = func(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *layer.MapOptions) error {
+				return layer.UnpackRootfsLayers(ctx, engine, rootfsPath, manifest, start, end, opt)
+			}
+			unpackManifest = func(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *layer.MapOptions) error {
+				return layer.UnpackManifestLayers(ctx, engine, bundle, manifest, start, end, opt)
+			}
+		}
+	}
+
+	// If we only need the rootfs, we can skip generating both the runtime
+	// configuration and the mtree specification.
+	if ctx.Bool("rootfs-only") {
+		meta.RootfsOnly = true
+
+		if ctx.Bool("skip-base-layers") || ctx.IsSet("base-layer") {
+			skip, err := baseLayerCount(context.Background(), engineExt, manifest, ctx.String("base-layer"))
+			if err != nil {
+				return errors.Wrap(err, "find base layers")
+			}
+			meta.SkippedLayers = skip
+
+			// When resuming, the skipped layers are already recorded as
+			// having been applied.
+			if !ctx.Bool("resume") {
+				unpackRootfs = func(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *layer.MapOptions) error {
+					return layer.UnpackRootfsSkipLayers(ctx, engine, rootfsPath, manifest, skip, opt)
+				}
+			}
+		}
+
+		log.Info("unpacking rootfs ...")
+		if err := unpackRootfs(context.Background(), engineExt, fullRootfsPath, manifest, &meta.MapOptions); err != nil {
+			return errors.Wrap(err, "create rootfs")
+		}
+		log.Info("... done")
+		if err := finishScan(ctx); err != nil {
+			return errors.Wrap(err, "scan layers")
+		}
+
+		if err := WriteBundleMeta(bundlePath, meta); err != nil {
+			return errors.Wrap(err, "write umoci.json metadata")
+		}
+		if keep != nil {
+			if err := keep.tag(fromName, meta); err != nil {
+				return err
+			}
+		}
+		recordBundle(casext.NewEngine(recordEngine), bundlePath, fromName, meta)
+
+		log.Infof("unpacked image rootfs: %s", fullRootfsPath)
+		return nil
+	}
+
 	// FIXME: Currently we only support OCI layouts, not tar archives. This
 	//        should be fixed once the CAS engine PR is merged into
 	//        image-tools. https://github.com/opencontainers/image-tools/pull/5
 	log.Info("unpacking bundle ...")
-	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &meta.MapOptions); err != nil {
+	if err := unpackManifest(context.Background(), engineExt, bundlePath, manifest, &meta.MapOptions); err != nil {
 		return errors.Wrap(err, "create runtime bundle")
 	}
 	log.Info("... done")
+	if err := finishScan(ctx); err != nil {
+		return errors.Wrap(err, "scan layers")
+	}
 
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
+		"keywords": bundleMtreeKeywords(meta.MapOptions),
 		"mtree":    mtreePath,
 	}).Debugf("umoci: generating mtree manifest")
 
@@ -191,9 +697,12 @@ func unpack(ctx *cli.Context) error {
 	if meta.MapOptions.Rootless {
 		fsEval = fseval.RootlessFsEval
 	}
+	if meta.MapOptions.Portable {
+		fsEval = fseval.PortableFsEval
+	}
 
 	log.Info("computing filesystem manifest ...")
-	dh, err := mtree.Walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
+	dh, err := mtree.Walk(fullRootfsPath, nil, bundleMtreeKeywords(meta.MapOptions), fsEval)
 	if err != nil {
 		return errors.Wrap(err, "generate mtree spec")
 	}
@@ -220,7 +729,33 @@ func unpack(ctx *cli.Context) error {
 	if err := WriteBundleMeta(bundlePath, meta); err != nil {
 		return errors.Wrap(err, "write umoci.json metadata")
 	}
+	if keep != nil {
+		if err := keep.tag(fromName, meta); err != nil {
+			return err
+		}
+	}
+	recordBundle(casext.NewEngine(recordEngine), bundlePath, fromName, meta)
 
 	log.Infof("unpacked image bundle: %s", bundlePath)
 	return nil
 }
+
+// recordBundle records that the bundle was unpacked from the image, so that it
+// can be found with umoci-bundles(1). Failing to record the bundle (such as
+// because the image is read-only) does not cause the unpack to fail.
+func recordBundle(engine casext.Engine, bundlePath, fromName string, meta UmociMeta) {
+	fullBundlePath, err := filepath.Abs(bundlePath)
+	if err == nil {
+		err = engine.AddBundle(context.Background(), casext.BundleRecord{
+			Path:     fullBundlePath,
+			Manifest: meta.From.Descriptor().Digest,
+			RefName:  fromName,
+			Time:     time.Now().UTC(),
+		})
+	}
+	if errors.Cause(err) == cas.ErrReadOnly {
+		log.Infof("image is read-only, not recording bundle")
+	} else if err != nil {
+		log.Warnf("could not record bundle in image: %v", err)
+	}
+}
@@ -22,8 +22,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/tabwriter"
 
@@ -59,6 +61,47 @@ var MtreeKeywords = []mtree.Keyword{
 	"xattr",
 }
 
+// bundleMtreeKeywords returns the subset of MtreeKeywords used for a bundle
+// unpacked with the given options. If the bundle was unpacked with
+// --omit-times, the times of files are not part of the specification (so that
+// only changes to the contents and metadata of files are detected).
+func bundleMtreeKeywords(opt layer.MapOptions) []mtree.Keyword {
+	if !opt.OmitTimes {
+		return MtreeKeywords
+	}
+	var keywords []mtree.Keyword
+	for _, keyword := range MtreeKeywords {
+		if keyword != "tar_time" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	return keywords
+}
+
+// parseIgnoredKeywords parses the keywords given to --ignore-keyword (each of
+// which is a comma-separated list of keywords in MtreeKeywords), and returns
+// keywords without them.
+func parseIgnoredKeywords(keywords []mtree.Keyword, values []string) ([]mtree.Keyword, error) {
+	ignored := map[mtree.Keyword]struct{}{}
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			keyword := mtree.Keyword(strings.TrimSpace(name))
+			if !mtree.InKeywordSlice(keyword, MtreeKeywords) {
+				return nil, errors.Errorf("unknown mtree keyword %q (must be one of %v)", name, MtreeKeywords)
+			}
+			ignored[keyword] = struct{}{}
+		}
+	}
+
+	var filtered []mtree.Keyword
+	for _, keyword := range keywords {
+		if _, ok := ignored[keyword]; !ok {
+			filtered = append(filtered, keyword)
+		}
+	}
+	return filtered, nil
+}
+
 // UmociMetaName is the name of umoci's metadata file that is stored in all
 // bundles extracted by umoci.
 const UmociMetaName = "umoci.json"
@@ -86,6 +129,55 @@ type UmociMeta struct {
 	// umoci-repack(1) calls, changing them is not recommended and so the
 	// default should be that they are the same.
 	MapOptions layer.MapOptions `json:"map_options"`
+
+	// RootfsOnly is set if the bundle was unpacked with --rootfs-only, in
+	// which case there is no mtree specification or runtime configuration
+	// and the bundle cannot be used with umoci-repack(1).
+	RootfsOnly bool `json:"rootfs_only,omitempty"`
+
+	// SkippedLayers is the number of base layers which were not extracted
+	// because of --skip-base-layers, in which case the rootfs only contains
+	// the changes made by the remaining layers.
+	SkippedLayers int `json:"skipped_layers,omitempty"`
+
+	// MtreePath is the path the mtree specification of the rootfs was written
+	// to, if it was not written to the bundle because of the --mtree-output
+	// argument to umoci-unpack(1).
+	MtreePath string `json:"mtree_path,omitempty"`
+
+	// OwnerNames is set if the bundle was unpacked with --owner-names, in
+	// which case the owners of files were resolved by name using the
+	// /etc/passwd and /etc/group files of the image.
+	OwnerNames bool `json:"owner_names,omitempty"`
+
+	// PartialLayers is set if the bundle was unpacked with --start-from-layer or
+	// --stop-at-layer, in which case the rootfs only contains the changes
+	// made by the given range of layers and the bundle cannot be used with
+	// umoci-repack(1).
+	PartialLayers *LayerRange `json:"partial_layers,omitempty"`
+}
+
+// LayerRange is an inclusive range of (zero-based) indexes of the layers in a
+// manifest.
+type LayerRange struct {
+	Start int `json:"start"`
+	Stop  int `json:"stop"`
+}
+
+// String returns the range in the form "[start, stop]".
+func (r LayerRange) String() string {
+	return fmt.Sprintf("[%d, %d]", r.Start, r.Stop)
+}
+
+// bundleMtreePath returns the path to the mtree specification of the given
+// bundle, which is stored in the bundle (and named after the digest of the
+// manifest it was unpacked from) unless the bundle metadata says otherwise.
+func bundleMtreePath(bundle string, meta UmociMeta) string {
+	if meta.MtreePath != "" {
+		return meta.MtreePath
+	}
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), "sha256:", "sha256_", 1)
+	return filepath.Join(bundle, mtreeName+".mtree")
 }
 
 // WriteTo writes a JSON-serialised version of UmociMeta to the given io.Writer.
@@ -136,6 +228,13 @@ type ManifestStat struct {
 
 	// History stores the history information for the manifest.
 	History []historyStat `json:"history"`
+
+	// RootfsType is the rootfs.type of the image configuration.
+	RootfsType string `json:"rootfs_type"`
+
+	// Extensions are the top-level fields of the image configuration which
+	// are not defined by the image-spec (see umoci-config(1) --extension).
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
 }
 
 // Format formats a ManifestStat using the default formatting, and writes the
@@ -166,6 +265,59 @@ func (ms ManifestStat) Format(w io.Writer) error {
 		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, comment)
 	}
 	tw.Flush()
+
+	// Output the unusual parts of the configuration.
+	if ms.RootfsType != "layers" {
+		fmt.Fprintf(w, "\nROOTFS TYPE: %s\n", ms.RootfsType)
+	}
+	if len(ms.Extensions) > 0 {
+		var names []string
+		for name := range ms.Extensions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(w, "\n")
+		tw = tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+		fmt.Fprintf(tw, "EXTENSION\tVALUE\n")
+		for _, name := range names {
+			fmt.Fprintf(tw, "%s\t%s\n", strings.Replace(name, "\t", " ", -1), strings.Replace(string(ms.Extensions[name]), "\t", " ", -1))
+		}
+		tw.Flush()
+	}
+
+	// Output the provenance of the layers which have it recorded (see
+	// umoci-repack(1) --layer-provenance).
+	var provenanced []*ispec.Descriptor
+	for _, histEntry := range ms.History {
+		if histEntry.Layer == nil {
+			continue
+		}
+		for _, key := range layerProvenanceAnnotations {
+			if _, ok := histEntry.Layer.Annotations[key]; ok {
+				provenanced = append(provenanced, histEntry.Layer)
+				break
+			}
+		}
+	}
+	if len(provenanced) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\n")
+	tw = tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "LAYER\tHOSTNAME\tBUNDLE\tVERSION\tSOURCE\n")
+	for _, descriptor := range provenanced {
+		fields := []string{descriptor.Digest.String()}
+		for _, key := range layerProvenanceAnnotations {
+			value := strings.Replace(descriptor.Annotations[key], "\t", " ", -1)
+			if value == "" {
+				value = "<none>"
+			}
+			fields = append(fields, value)
+		}
+		fmt.Fprintf(tw, "%s\n", strings.Join(fields, "\t"))
+	}
+	tw.Flush()
 	return nil
 }
 
@@ -192,7 +344,7 @@ type historyStat struct {
 func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) (ManifestStat, error) {
 	var stat ManifestStat
 
-	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+	if !casext.IsManifestMediaType(manifestDescriptor.MediaType) {
 		return stat, errors.Errorf("stat: cannot stat a non-manifest descriptor: invalid media type '%s'", manifestDescriptor.MediaType)
 	}
 
@@ -243,5 +395,22 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		stat.History = append(stat.History, info)
 	}
 
+	// ispec.Image only contains the fields defined by the image-spec, so the
+	// extensions have to be read from the raw blob.
+	stat.RootfsType = config.RootFS.Type
+	reader, err := engine.GetBlob(ctx, manifest.Config.Digest)
+	if err != nil {
+		return stat, errors.Wrap(err, "get config blob")
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return stat, errors.Wrap(err, "read config blob")
+	}
+	stat.Extensions, err = igen.ParseExtensions(data)
+	if err != nil {
+		return stat, errors.Wrap(err, "parse config extensions")
+	}
+
 	return stat, nil
 }
@@ -18,21 +18,31 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"regexp"
+	"os"
 	"strings"
+	"text/template"
 
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
 // refRegexp defines the regexp that a given OCI tag must obey.
-var refRegexp = regexp.MustCompile(`^([A-Za-z0-9._-]+)+$`)
+var refRegexp = casext.RefNameRegexp
 
 func flattenCommands(cmds []cli.Command) []*cli.Command {
 	var flatten []*cli.Command
-	for idx, cmd := range cmds {
-		flatten = append(flatten, &cmds[idx])
+	for idx := range cmds {
+		cmd := &cmds[idx]
+		// The subcommands are copied so that modifying them doesn't modify
+		// the (shared) subcommands of the global cli.Command.
+		cmd.Subcommands = append([]cli.Command(nil), cmd.Subcommands...)
+		flatten = append(flatten, cmd)
 		flatten = append(flatten, flattenCommands(cmd.Subcommands)...)
 	}
 	return flatten
@@ -125,6 +135,290 @@ func uxTag(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// uxSpecialFiles adds the --fifo-policy and --socket-policy flags to the given
+// cli.Command as well as adding relevant validation logic to the .Before of
+// the command. The values will be stored in ctx.Metadata["--fifo-policy"] and
+// ctx.Metadata["--socket-policy"] as layer.SpecialFilePolicy values (or nil if
+// the flags were not specified).
+func uxSpecialFiles(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "fifo-policy",
+			Usage: "how named pipes are handled when unpacking and repacking (include, skip or error)",
+		},
+		cli.StringFlag{
+			Name:  "socket-policy",
+			Usage: "how sockets are handled when repacking (skip or error)",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --fifo-policy.
+		if ctx.IsSet("fifo-policy") {
+			policy, err := layer.ParseSpecialFilePolicy(ctx.String("fifo-policy"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --fifo-policy")
+			}
+			ctx.App.Metadata["--fifo-policy"] = policy
+		}
+		// Verify --socket-policy.
+		if ctx.IsSet("socket-policy") {
+			policy, err := layer.ParseSpecialFilePolicy(ctx.String("socket-policy"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --socket-policy")
+			}
+			if policy == layer.SpecialFileInclude {
+				return errors.Wrap(fmt.Errorf("sockets cannot be included in layers"), "invalid --socket-policy")
+			}
+			ctx.App.Metadata["--socket-policy"] = policy
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxFreeSpace adds the --min-free-space and --skip-space-check flags to the
+// given cli.Command as well as adding relevant validation logic to the .Before
+// of the command. The values will be stored in ctx.Metadata["--min-free-space"]
+// (as an int64 number of bytes) and ctx.Metadata["--skip-space-check"] (as a
+// bool).
+func uxFreeSpace(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "min-free-space",
+			Usage: "amount of disk space which must remain free after the operation (such as 512M or 2G)",
+			Value: "0",
+		},
+		cli.BoolFlag{
+			Name:  "skip-space-check",
+			Usage: "do not check whether there is enough free disk space before starting",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --min-free-space.
+		size, err := units.RAMInBytes(ctx.String("min-free-space"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --min-free-space")
+		}
+		if size < 0 {
+			return errors.Wrap(fmt.Errorf("size cannot be negative"), "invalid --min-free-space")
+		}
+		if ctx.IsSet("min-free-space") && ctx.Bool("skip-space-check") {
+			return errors.Errorf("--min-free-space and --skip-space-check are mutually exclusive")
+		}
+		ctx.App.Metadata["--min-free-space"] = size
+		ctx.App.Metadata["--skip-space-check"] = ctx.Bool("skip-space-check")
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxLayerLimits adds the --max-layer-size, --max-compression-ratio,
+// --max-layer-entries and --max-path-depth flags to the given cli.Command as
+// well as adding relevant validation logic to the .Before of the command. The
+// values will be stored in ctx.Metadata["--max-layer-size"],
+// ctx.Metadata["--max-compression-ratio"], ctx.Metadata["--max-layer-entries"]
+// (as int64s) and ctx.Metadata["--max-path-depth"] (as an int), using the
+// conventions of layer.MapOptions.
+func uxLayerLimits(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "max-layer-size",
+			Usage: "largest decompressed size of a layer which will be extracted (such as 10G), or 0 for no limit",
+			Value: "0",
+		},
+		cli.Int64Flag{
+			Name:  "max-compression-ratio",
+			Usage: "largest ratio between the decompressed and compressed size of a layer, or 0 for no limit",
+			Value: layer.DefaultMaxCompressionRatio,
+		},
+		cli.Int64Flag{
+			Name:  "max-layer-entries",
+			Usage: "largest number of entries in a layer which will be extracted, or 0 for no limit",
+			Value: layer.DefaultMaxLayerEntries,
+		},
+		cli.IntFlag{
+			Name:  "max-path-depth",
+			Usage: "largest number of components in the path of a layer entry, or 0 for no limit",
+			Value: layer.DefaultMaxPathDepth,
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --max-layer-size.
+		size, err := units.RAMInBytes(ctx.String("max-layer-size"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --max-layer-size")
+		}
+		if size < 0 {
+			return errors.Wrap(fmt.Errorf("size cannot be negative"), "invalid --max-layer-size")
+		}
+		ctx.App.Metadata["--max-layer-size"] = size
+
+		// Verify --max-compression-ratio. MapOptions uses a negative ratio to
+		// disable the check, since zero means the default.
+		ratio := ctx.Int64("max-compression-ratio")
+		if ratio < 0 {
+			return errors.Wrap(fmt.Errorf("ratio cannot be negative"), "invalid --max-compression-ratio")
+		}
+		if ratio == 0 {
+			ratio = -1
+		}
+		ctx.App.Metadata["--max-compression-ratio"] = ratio
+
+		// Verify --max-layer-entries and --max-path-depth in the same way.
+		entries := ctx.Int64("max-layer-entries")
+		if entries < 0 {
+			return errors.Wrap(fmt.Errorf("count cannot be negative"), "invalid --max-layer-entries")
+		}
+		if entries == 0 {
+			entries = -1
+		}
+		ctx.App.Metadata["--max-layer-entries"] = entries
+		depth := ctx.Int("max-path-depth")
+		if depth < 0 {
+			return errors.Wrap(fmt.Errorf("depth cannot be negative"), "invalid --max-path-depth")
+		}
+		if depth == 0 {
+			depth = -1
+		}
+		ctx.App.Metadata["--max-path-depth"] = depth
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxScan adds the --scan-cmd, --scan-fail-on and --scan-report flags to the
+// given cli.Command as well as adding relevant validation logic to the .Before
+// of the command. If --scan-cmd is specified, a *layer.LayerScan will be
+// stored in ctx.App.Metadata["--scan"] (along with "--scan-fail-on" and
+// "--scan-report" as strings, if specified).
+func uxScan(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "scan-cmd",
+			Usage: "command (run with sh -c) which is fed the tar stream of each layer and outputs its findings as JSON",
+		},
+		cli.StringFlag{
+			Name:  "scan-fail-on",
+			Usage: "fail if the scanner reports a finding at least this severe (unknown, low, medium, high or critical)",
+		},
+		cli.StringFlag{
+			Name:  "scan-report",
+			Usage: "path to write the scanner's findings to (as JSON)",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.IsSet("scan-cmd") {
+			if ctx.String("scan-cmd") == "" {
+				return errors.Errorf("--scan-cmd cannot be empty")
+			}
+			// The command is run in the directory of the client when
+			// running a request from umoci-daemon(1).
+			dir, _ := ctx.App.Metadata["--daemon.dir"].(string)
+			stderr := ctx.App.ErrWriter
+			if stderr == nil {
+				stderr = os.Stderr
+			}
+			ctx.App.Metadata["--scan"] = &layer.LayerScan{
+				Scanner: commandScanner{
+					command: ctx.String("scan-cmd"),
+					dir:     dir,
+					stderr:  stderr,
+				},
+			}
+		} else if ctx.IsSet("scan-fail-on") || ctx.IsSet("scan-report") {
+			return errors.Errorf("--scan-fail-on and --scan-report require --scan-cmd")
+		}
+
+		// Verify --scan-fail-on.
+		if ctx.IsSet("scan-fail-on") {
+			if !layer.ValidSeverity(ctx.String("scan-fail-on")) {
+				return errors.Errorf("invalid --scan-fail-on: unknown severity %q", ctx.String("scan-fail-on"))
+			}
+			ctx.App.Metadata["--scan-fail-on"] = ctx.String("scan-fail-on")
+		}
+		if ctx.IsSet("scan-report") {
+			ctx.App.Metadata["--scan-report"] = ctx.String("scan-report")
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// remoteImageCommands is the set of commands (by name) which support images
+// in registries (see uxRemoteImage).
+var remoteImageCommands = map[string]bool{}
+
+// uxRemoteImage allows the --image of the given cli.Command to refer to an
+// image in a registry (see isRemoteImage), and adds the --keep-blobs and
+// --plain-http flags as well as the flags added by uxRegistryClient (which can
+// only be used with such images) to it.
+func uxRemoteImage(cmd cli.Command) cli.Command {
+	remoteImageCommands[cmd.Name] = true
+	cmd = uxRegistryClient(cmd)
+
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "keep-blobs",
+			Usage: "store the blobs of an image in a registry in this image layout",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "use HTTP rather than HTTPS to access an image in a registry",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		imagePath, _ := ctx.App.Metadata["--image-path"].(string)
+		if !isRemoteImage(imagePath) && (ctx.IsSet("keep-blobs") || ctx.Bool("plain-http") || ctx.IsSet("limit-rate") || ctx.IsSet("max-connections")) {
+			return errors.Errorf("--keep-blobs, --plain-http, --limit-rate and --max-connections can only be used with an image in a registry")
+		}
+		if ctx.IsSet("keep-blobs") && ctx.String("keep-blobs") == "" {
+			return errors.Errorf("--keep-blobs path cannot be empty")
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
 // uxImage adds an --image flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The values (image,
 // tag) will be stored in ctx.Metadata["--image-path"] and
@@ -142,8 +436,19 @@ func uxImage(cmd cli.Command) cli.Command {
 		if ctx.IsSet("image") {
 			image := ctx.String("image")
 
+			// The path cannot contain ':', but the tag can (such as with
+			// "opensuse/leap:42.3") so we split on the first ':'. Images in
+			// registries (or opened by transport plugins) are URIs which can
+			// have a port (but the tag can't contain '/'), so we split them
+			// on the last ':' after the scheme instead.
 			var dir, tag string
-			sep := strings.LastIndex(image, ":")
+			sep := strings.Index(image, ":")
+			if scheme := cas.URIScheme(image); scheme != "" {
+				sep = strings.LastIndex(image, ":")
+				if sep < len(scheme+"://") || strings.Contains(image[sep:], "/") {
+					sep = -1
+				}
+			}
 			if sep == -1 {
 				dir = image
 				tag = "latest"
@@ -153,12 +458,12 @@ func uxImage(cmd cli.Command) cli.Command {
 			}
 
 			// Verify directory value.
-			if strings.Contains(dir, ":") {
-				return errors.Wrap(fmt.Errorf("path contains ':' character: '%s'", dir), "invalid --image")
-			}
 			if dir == "" {
 				return errors.Wrap(fmt.Errorf("path is empty"), "invalid --image")
 			}
+			if isRemoteImage(dir) && !remoteImageCommands[cmd.Name] {
+				return errors.Wrap(fmt.Errorf("images in registries are not supported by umoci-%s(1)", cmd.Name), "invalid --image")
+			}
 
 			// Verify tag value.
 			if !refRegexp.MatchString(tag) {
@@ -196,8 +501,9 @@ func uxLayout(cmd cli.Command) cli.Command {
 		if ctx.IsSet("layout") {
 			layout := ctx.String("layout")
 
-			// Verify directory value.
-			if strings.Contains(layout, ":") {
+			// Verify directory value. URIs (such as those opened by
+			// transport plugins) contain a ':' after the scheme.
+			if strings.Contains(strings.TrimPrefix(layout, cas.URIScheme(layout)+"://"), ":") {
 				return errors.Wrap(fmt.Errorf("path contains ':' character: '%s'", layout), "invalid --layout")
 			}
 			if layout == "" {
@@ -215,3 +521,89 @@ func uxLayout(cmd cli.Command) cli.Command {
 
 	return cmd
 }
+
+// uxRegistryClient adds the --limit-rate and --max-connections flags (which
+// configure how registries are accessed, see registryClient) to the given
+// cli.Command as well as adding relevant validation logic to the .Before of
+// the command. The values will be stored in ctx.Metadata["--limit-rate"] (as
+// an int64) and ctx.Metadata["--max-connections"] (as an int).
+func uxRegistryClient(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "limit-rate",
+			Usage: "largest total rate at which data is downloaded from registries, per second (such as 512K or 10M), or 0 for no limit",
+			Value: "0",
+		},
+		cli.IntFlag{
+			Name:  "max-connections",
+			Usage: "largest number of connections to each registry (and of layers fetched at the same time), or 0 for no limit",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --limit-rate.
+		rate, err := units.RAMInBytes(ctx.String("limit-rate"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --limit-rate")
+		}
+		if rate < 0 {
+			return errors.Wrap(fmt.Errorf("rate cannot be negative"), "invalid --limit-rate")
+		}
+		ctx.App.Metadata["--limit-rate"] = rate
+
+		// Verify --max-connections.
+		connections := ctx.Int("max-connections")
+		if connections < 0 {
+			return errors.Wrap(fmt.Errorf("count cannot be negative"), "invalid --max-connections")
+		}
+		ctx.App.Metadata["--max-connections"] = connections
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// formatFuncs are the helper functions available to --format templates.
+var formatFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// uxFormat adds a --format flag to the given cli.Command as well as adding
+// relevant validation logic to the .Before of the command. The parsed Go
+// template will be stored in ctx.App.Metadata["--format"] as a
+// *template.Template (or nil if --format was not specified), and can use the
+// functions in formatFuncs.
+func uxFormat(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "format",
+		Usage: "format the output using the given Go template",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify and parse --format.
+		if ctx.IsSet("format") {
+			tmpl, err := template.New("format").Funcs(formatFuncs).Parse(ctx.String("format"))
+			if err != nil {
+				return errors.Wrap(err, "parse --format")
+			}
+			ctx.App.Metadata["--format"] = tmpl
+		}
+
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
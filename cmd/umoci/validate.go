@@ -0,0 +1,113 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var validateCommand = cli.Command{
+	Name:  "validate",
+	Usage: "validates an OCI image against the image-spec",
+	ArgsUsage: `--layout <image-path> [<tag>...]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+a tagged image to validate.
+
+If no "<tag>" is provided, the entire image layout is validated. This includes
+the top-level index, every blob reachable from it and the contents of every
+blob in the image (even those that are not reachable). Otherwise only the blobs
+reachable from the given tags are validated.
+
+Validation checks that all manifests, configurations and indexes contain the
+fields required by the image-spec, and that the size and digest of every
+descriptor match the blob they reference.`,
+
+	// validate reads the layout.
+	Category: "layout",
+
+	Action: validate,
+
+	Before: func(ctx *cli.Context) error {
+		for _, tag := range ctx.Args() {
+			if !refRegexp.MatchString(tag) {
+				return errors.Errorf("tag is an invalid reference: %q", tag)
+			}
+		}
+		return nil
+	},
+}
+
+func validate(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	if ctx.NArg() == 0 {
+		if err := engineExt.ValidateLayout(context.Background()); err != nil {
+			return errors.Wrap(err, "validate layout")
+		}
+		log.Infof("image layout is valid: %s", imagePath)
+		return nil
+	}
+
+	for _, tagName := range ctx.Args() {
+		if err := validateReference(context.Background(), engineExt, tagName); err != nil {
+			return errors.Wrapf(err, "validate %s", tagName)
+		}
+		log.Infof("image is valid: %s", tagName)
+	}
+	return nil
+}
+
+// validateReference validates every blob reachable from the top-level index
+// entries that match the given reference name. An error is returned if the
+// reference does not exist.
+func validateReference(ctx context.Context, engine casext.Engine, refname string) error {
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+
+	found := false
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] != refname {
+			continue
+		}
+		found = true
+		if err := engine.Validate(ctx, descriptor); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return errors.Errorf("no such tag: %s", refname)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var verifyRootfsCommand = cli.Command{
+	Name:  "verify-rootfs",
+	Usage: "verifies that a bundle's rootfs matches the layers of its source image",
+	ArgsUsage: `--layout <image-path> <bundle>
+
+Where "<image-path>" is the path to the OCI image that "<bundle>" was unpacked
+from (using umoci-unpack(1)).
+
+The expected contents of the rootfs of "<bundle>" are reconstructed from the
+layers of the source manifest recorded in the bundle metadata (verifying the
+DiffID of each layer against the image configuration), and compared with the
+rootfs. Unlike umoci-check-bundle(1), this does not depend on the mtree
+specification stored alongside the bundle. Each path whose type, mode,
+ownership, contents or link target differs from the layers is printed (sorted
+by path) together with the type of difference, and the command fails if any
+differences were found. For bundles unpacked with --fsverity, the fs-verity
+digest of each regular file (both as measured by the kernel and as recorded
+when unpacking) is also verified.`,
+
+	// verify-rootfs reads the layout.
+	Category: "layout",
+
+	Action: verifyRootfs,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func verifyRootfs(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+
+	// Read the metadata first.
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+
+	log.WithFields(log.Fields{
+		"version":     meta.Version,
+		"from":        meta.From,
+		"map_options": meta.MapOptions,
+	}).Debugf("umoci: loaded UmociMeta metadata")
+
+	if meta.SkippedLayers > 0 {
+		return errors.Errorf("cannot verify bundle unpacked without its %d base layers", meta.SkippedLayers)
+	}
+	if meta.PartialLayers != nil {
+		return errors.Errorf("cannot verify partial bundle: only layers %s were unpacked", meta.PartialLayers)
+	}
+	if !casext.IsManifestMediaType(meta.From.Descriptor().MediaType) {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType), "invalid saved from descriptor")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "get source manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+
+	// The owners must be resolved in the same way as when unpacking.
+	if meta.OwnerNames {
+		names, err := layer.ImageOwnerNames(context.Background(), engine, manifest)
+		if err != nil {
+			return errors.Wrap(err, "read owner names")
+		}
+		meta.MapOptions.OwnerNames = names
+	}
+
+	log.Info("verifying rootfs ...")
+	diffs, err := layer.VerifyRootfs(context.Background(), engine, fullRootfsPath, manifest, &meta.MapOptions)
+	if err != nil {
+		return errors.Wrap(err, "verify rootfs")
+	}
+	log.Info("... done")
+
+	for _, diff := range diffs {
+		if len(diff.Fields) > 0 {
+			fmt.Printf("%s\t%s\t%s\n", diff.Type, diff.Path, strings.Join(diff.Fields, ","))
+		} else {
+			fmt.Printf("%s\t%s\n", diff.Type, diff.Path)
+		}
+	}
+
+	if len(diffs) > 0 {
+		return errors.Errorf("rootfs does not match source image: %d paths differ", len(diffs))
+	}
+	log.Infof("rootfs matches source image: %s", meta.From.Descriptor().Digest)
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/system"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspecs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var versionCommand = cli.Command{
+	Name:  "version",
+	Usage: "shows information about this build of umoci",
+	ArgsUsage: `
+
+Shows the version of umoci and the commit it was built from, how it was built,
+the versions of the OCI specifications and the media types it supports, and
+which features are available to it. Layer media types added by compressor
+plugins (see --plugin-dir) are included.
+
+Features which depend on the privileges of umoci are detected at runtime: if
+umoci is running without root privileges (or without the capabilities it needs
+to create files owned by other users and device nodes), --rootless must be
+used when unpacking and repacking images.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the information as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: showVersion,
+}
+
+// versionMediaTypes are the media types supported by umoci, grouped by the
+// kind of blob they describe.
+type versionMediaTypes struct {
+	Indexes   []string `json:"indexes"`
+	Manifests []string `json:"manifests"`
+	Configs   []string `json:"configs"`
+	Layers    []string `json:"layers"`
+}
+
+// versionInfo is the information about this build of umoci shown by
+// umoci-version(1).
+type versionInfo struct {
+	Version     string            `json:"version"`
+	Commit      string            `json:"commit,omitempty"`
+	GoVersion   string            `json:"go_version"`
+	Platform    string            `json:"platform"`
+	Static      bool              `json:"static"`
+	ImageSpec   string            `json:"image_spec"`
+	ImageLayout string            `json:"image_layout"`
+	RuntimeSpec string            `json:"runtime_spec"`
+	MediaTypes  versionMediaTypes `json:"media_types"`
+	Features    map[string]bool   `json:"features"`
+}
+
+// rootlessCapabilities are the capabilities umoci needs to unpack and repack
+// images without --rootless, keyed by the name of the feature they provide.
+var rootlessCapabilities = map[string]system.Capability{
+	"chown":          system.CapChown,
+	"dac-override":   system.CapDacOverride,
+	"fowner":         system.CapFowner,
+	"mknod":          system.CapMknod,
+	"trusted-xattrs": system.CapSysAdmin,
+}
+
+// detectFeatures returns which features are available to umoci in the current
+// environment. Features which cannot be detected are reported as unavailable.
+func detectFeatures() map[string]bool {
+	features := map[string]bool{
+		"cgo": cgoEnabled,
+	}
+
+	caps, err := system.EffectiveCapabilities()
+	if err != nil {
+		log.Warnf("version: cannot detect capabilities: %v", err)
+	}
+	rootless := os.Geteuid() != 0
+	for feature, capability := range rootlessCapabilities {
+		features[feature] = caps.Has(capability)
+		if capability != system.CapSysAdmin && !caps.Has(capability) {
+			rootless = true
+		}
+	}
+	// --rootless is required if we are not root or are missing any of the
+	// capabilities we need to act like root (trusted.* xattrs are optional).
+	features["rootless"] = rootless
+	return features
+}
+
+func showVersion(ctx *cli.Context) error {
+	info := versionInfo{
+		Version:     versionString(),
+		Commit:      gitCommit,
+		GoVersion:   runtime.Version(),
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		Static:      !cgoEnabled,
+		ImageSpec:   ispecs.Version,
+		ImageLayout: ispec.ImageLayoutVersion,
+		RuntimeSpec: rspecs.Version,
+		MediaTypes: versionMediaTypes{
+			Indexes:   []string{ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList},
+			Manifests: []string{ispec.MediaTypeImageManifest, casext.MediaTypeDockerManifest},
+			Configs:   []string{ispec.MediaTypeImageConfig, casext.MediaTypeDockerConfig},
+			Layers:    casext.LayerMediaTypes(),
+		},
+		Features: detectFeatures(),
+	}
+
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(info); err != nil {
+			return errors.Wrap(err, "encoding version")
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "Version:\t%s\n", info.Version)
+	fmt.Fprintf(tw, "Go Version:\t%s\n", info.GoVersion)
+	fmt.Fprintf(tw, "Platform:\t%s\n", info.Platform)
+	fmt.Fprintf(tw, "Static:\t%v\n", info.Static)
+	fmt.Fprintf(tw, "Image Spec:\t%s (layout %s)\n", info.ImageSpec, info.ImageLayout)
+	fmt.Fprintf(tw, "Runtime Spec:\t%s\n", info.RuntimeSpec)
+	for _, group := range []struct {
+		name       string
+		mediaTypes []string
+	}{
+		{"Index Media Types", info.MediaTypes.Indexes},
+		{"Manifest Media Types", info.MediaTypes.Manifests},
+		{"Config Media Types", info.MediaTypes.Configs},
+		{"Layer Media Types", info.MediaTypes.Layers},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", group.name, strings.Join(group.mediaTypes, "\n\t"))
+	}
+	var features []string
+	for feature := range info.Features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	for idx, feature := range features {
+		name := ""
+		if idx == 0 {
+			name = "Features:"
+		}
+		fmt.Fprintf(tw, "%s\t%s=%v\n", name, feature, info.Features[feature])
+	}
+	return errors.Wrap(tw.Flush(), "output version")
+}
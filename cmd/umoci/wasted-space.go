@@ -0,0 +1,330 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var wastedSpaceCommand = uxHistory(uxTag(cli.Command{
+	Name:  "wasted-space",
+	Usage: "detects (and optionally reclaims) space wasted by hidden files in an image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to analyse.
+
+Files which are added by one layer and then removed or overwritten by a later
+layer still take up space in the image, even though they are not visible once
+the image has been unpacked. This space can only be reclaimed by squashing the
+layers which added and removed the files into a single layer. For each hidden
+file the layers which added and removed it are reported, along with the
+smallest set of layer ranges that would need to be squashed to reclaim the
+space.
+
+If --auto-squash is specified, each suggested range is squashed into a single
+layer and the resulting image is tagged as "<new-tag>" (if not specified, the
+original tag is replaced). Layers outside of the suggested ranges are left
+untouched, so they can still be shared with other images.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// wasted-space reads manifest information, and might create a new image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "min-size",
+			Usage: "only suggest squashing layer ranges which would reclaim at least this much space",
+			Value: "0",
+		},
+		cli.IntFlag{
+			Name:  "top",
+			Usage: "number of hidden files to report",
+			Value: 10,
+		},
+		cli.BoolFlag{
+			Name:  "auto-squash",
+			Usage: "squash the suggested layer ranges and tag the new image",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "validate the new image against the image-spec before tagging it",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the report as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.Int("top") < 0 {
+			return errors.Errorf("--top must not be negative")
+		}
+		if _, err := units.FromHumanSize(ctx.String("min-size")); err != nil {
+			return errors.Wrap(err, "parse --min-size")
+		}
+		return nil
+	},
+
+	Action: wastedSpace,
+}))
+
+// squashSuggestion is a layer.SquashRange, annotated with the digests of the
+// layers in the range.
+type squashSuggestion struct {
+	layer.SquashRange
+	Layers []string `json:"layers"`
+}
+
+// WastedSpace contains the result of analysing the space wasted by hidden
+// files in an image.
+type WastedSpace struct {
+	// Wasted is the set of largest files which are hidden in the merged view.
+	Wasted []wastedFile `json:"wasted"`
+
+	// WastedSize is the total size of all hidden files.
+	WastedSize int64 `json:"wasted_size"`
+
+	// Suggestions is the set of layer ranges which should be squashed in
+	// order to reclaim the wasted space.
+	Suggestions []squashSuggestion `json:"suggestions"`
+
+	// Reclaimable is the total amount of space which would be reclaimed by
+	// squashing all of the suggested layer ranges.
+	Reclaimable int64 `json:"reclaimable"`
+
+	// Squashed is true if the suggestions were applied.
+	Squashed bool `json:"squashed"`
+}
+
+// Format formats WastedSpace using the default formatting, and writes the
+// result to the given writer.
+func (ws WastedSpace) Format(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "WASTED\tSIZE\tLAYER\tREMOVED BY\n")
+	for _, file := range ws.Wasted {
+		path := strings.Replace(file.Path, "\t", " ", -1)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", path, units.HumanSize(float64(file.Size)), file.LayerDigest, file.RemovedByDigest)
+	}
+	fmt.Fprintf(tw, "\n")
+
+	squashed := ""
+	if ws.Squashed {
+		squashed = " (squashed)"
+	}
+	fmt.Fprintf(tw, "SQUASH%s\tFILES\tRECLAIMABLE\n", squashed)
+	for _, suggestion := range ws.Suggestions {
+		fmt.Fprintf(tw, "layers %d-%d\t%d\t%s\n", suggestion.Start, suggestion.End, suggestion.Files, units.HumanSize(float64(suggestion.Reclaimable)))
+	}
+	fmt.Fprintf(tw, "\n")
+
+	fmt.Fprintf(tw, "WASTED\tRECLAIMABLE\n")
+	fmt.Fprintf(tw, "%s\t%s\n", units.HumanSize(float64(ws.WastedSize)), units.HumanSize(float64(ws.Reclaimable)))
+	return tw.Flush()
+}
+
+func wastedSpace(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	minSize, _ := units.FromHumanSize(ctx.String("min-size"))
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+	fromDescriptorPath := fromDescriptorPaths[0]
+	manifestDescriptor := fromDescriptorPath.Descriptor()
+
+	// FIXME: Implement support for manifest lists.
+	if !casext.IsManifestMediaType(manifestDescriptor.MediaType) {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid --image tag")
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	analysis, err := layer.AnalyzeManifest(context.Background(), engineExt, manifest)
+	if err != nil {
+		return errors.Wrap(err, "analyse layers")
+	}
+
+	ws := WastedSpace{
+		WastedSize: analysis.WastedSize(),
+	}
+	for _, file := range analysis.LargestWasted(ctx.Int("top")) {
+		ws.Wasted = append(ws.Wasted, wastedFile{
+			WastedFile:      file,
+			LayerDigest:     manifest.Layers[file.Layer].Digest.String(),
+			RemovedByDigest: manifest.Layers[file.RemovedBy].Digest.String(),
+		})
+	}
+	for _, suggestion := range analysis.SquashSuggestions(minSize) {
+		var layers []string
+		for _, descriptor := range manifest.Layers[suggestion.Start : suggestion.End+1] {
+			layers = append(layers, descriptor.Digest.String())
+		}
+		ws.Suggestions = append(ws.Suggestions, squashSuggestion{
+			SquashRange: suggestion,
+			Layers:      layers,
+		})
+		ws.Reclaimable += suggestion.Reclaimable
+	}
+
+	if ctx.Bool("auto-squash") && len(ws.Suggestions) > 0 {
+		if err := autoSquash(ctx, engineExt, fromDescriptorPath, manifest, ws.Suggestions, tagName); err != nil {
+			return errors.Wrap(err, "auto-squash")
+		}
+		ws.Squashed = true
+	}
+
+	// Output the report.
+	if ctx.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(ws); err != nil {
+			return errors.Wrap(err, "encoding wasted-space")
+		}
+	} else {
+		if err := ws.Format(os.Stdout); err != nil {
+			return errors.Wrap(err, "format wasted-space")
+		}
+	}
+	return nil
+}
+
+// autoSquash squashes each of the suggested layer ranges of the given image,
+// and tags the result as tagName.
+func autoSquash(ctx *cli.Context, engineExt casext.Engine, fromDescriptorPath casext.DescriptorPath, manifest ispec.Manifest, suggestions []squashSuggestion, tagName string) error {
+	mutator, err := mutate.New(engineExt, fromDescriptorPath)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+
+	// Squash the ranges from the last to the first, so that the indices of
+	// the earlier ranges stay valid.
+	for idx := len(suggestions) - 1; idx >= 0; idx-- {
+		suggestion := suggestions[idx]
+
+		created := time.Now()
+		history := ispec.History{
+			Author:    imageMeta.Author,
+			Comment:   fmt.Sprintf("squashed layers %d-%d", suggestion.Start, suggestion.End),
+			Created:   &created,
+			CreatedBy: "umoci wasted-space --auto-squash",
+		}
+
+		if val, ok := ctx.App.Metadata["--history.author"]; ok {
+			history.Author = val.(string)
+		}
+		if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+			history.Comment = val.(string)
+		}
+		if val, ok := ctx.App.Metadata["--history.created"]; ok {
+			created, err := time.Parse(igen.ISO8601, val.(string))
+			if err != nil {
+				return errors.Wrap(err, "parsing --history.created")
+			}
+			history.Created = &created
+		}
+		if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+			history.CreatedBy = val.(string)
+		}
+
+		log.Infof("squashing layers %d-%d", suggestion.Start, suggestion.End)
+
+		reader := layer.SquashLayers(context.Background(), engineExt, manifest.Layers[suggestion.Start:suggestion.End+1])
+		err := mutator.Squash(context.Background(), suggestion.Start, suggestion.End, reader, history)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "squash layers %d-%d", suggestion.Start, suggestion.End)
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if ctx.Bool("strict") {
+		if err := engineExt.Validate(context.Background(), newDescriptorPath.Root()); err != nil {
+			return errors.Wrap(err, "validate mutated image")
+		}
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return nil
+}
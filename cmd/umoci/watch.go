@@ -0,0 +1,174 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var watchCommand = cli.Command{
+	Name:  "watch",
+	Usage: "reports changes to an OCI image's tags as they happen",
+	ArgsUsage: `--layout <image-path> [--exec <command>] [<tag>...]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+a tag to watch. If no "<tag>" is provided, every tag is watched.
+
+Until it is interrupted, umoci watches the image's index for modifications
+(made by any process) and outputs a line for every change made to the watched
+tags, giving the name of the tag and the digests it referred to before and
+after the change ("<none>" if the tag was created or removed). Changes made in
+quick succession may be reported as a single change.
+
+If --exec is specified, the output is replaced by running "<command>" (with
+"sh -c") for each change, with the name of the tag and the old and new digests
+in the $UMOCI_TAG, $UMOCI_OLD_DIGEST and $UMOCI_NEW_DIGEST environment
+variables (which are empty if the tag was created or removed). Failures of
+"<command>" are reported but do not stop umoci from watching the image.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// watch reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "exec",
+			Usage: "command to run (with sh -c) for each change",
+		},
+		cli.BoolFlag{
+			Name:  "once",
+			Usage: "stop watching after the first change",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output each change as a JSON encoded blob on a single line",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		for _, tag := range ctx.Args() {
+			if !refRegexp.MatchString(tag) {
+				return errors.Errorf("tag is an invalid reference: %q", tag)
+			}
+		}
+		if ctx.IsSet("exec") && ctx.String("exec") == "" {
+			return errors.Errorf("--exec cannot be empty")
+		}
+		if ctx.IsSet("exec") && ctx.Bool("json") {
+			return errors.Errorf("--json cannot be used with --exec")
+		}
+		return nil
+	},
+
+	Action: watch,
+}
+
+// errWatchDone is returned by the callback passed to WatchReferences to stop
+// watching after --once.
+var errWatchDone = errors.New("watch done")
+
+func watch(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS. Watching never modifies the image.
+	engine, err := cas.OpenWithOptions(imagePath, openOptions(ctx))
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(cas.ReadOnly(engine))
+	defer engine.Close()
+
+	// Stop watching when we are told to stop.
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if sig, ok := <-signals; ok {
+			log.Infof("watch: received %v, stopping", sig)
+			cancel()
+		}
+	}()
+
+	command := ctx.String("exec")
+	err = engineExt.WatchReferences(watchCtx, func(change casext.ReferenceChange) error {
+		if command != "" {
+			runWatchCommand(command, change)
+		} else if err := outputWatchChange(ctx.Bool("json"), change); err != nil {
+			return err
+		}
+		if ctx.Bool("once") {
+			return errWatchDone
+		}
+		return nil
+	}, ctx.Args()...)
+	if err == errWatchDone {
+		err = nil
+	}
+	return errors.Wrap(err, "watch references")
+}
+
+// outputWatchChange writes the given change to stdout, either using the
+// default formatting or as JSON.
+func outputWatchChange(asJSON bool, change casext.ReferenceChange) error {
+	if asJSON {
+		return errors.Wrap(json.NewEncoder(os.Stdout).Encode(change), "encoding change")
+	}
+	old, new := "<none>", "<none>"
+	if change.Old != "" {
+		old = change.Old.String()
+	}
+	if change.New != "" {
+		new = change.New.String()
+	}
+	_, err := fmt.Printf("%s\t%s -> %s\n", change.RefName, old, new)
+	return errors.Wrap(err, "output change")
+}
+
+// runWatchCommand runs the --exec command for the given change. Failures are
+// only logged, so that a single failure doesn't stop the watch.
+func runWatchCommand(command string, change casext.ReferenceChange) {
+	log.Infof("watch: %s changed from %q to %q", change.RefName, change.Old, change.New)
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"UMOCI_TAG="+change.RefName,
+		"UMOCI_OLD_DIGEST="+change.Old.String(),
+		"UMOCI_NEW_DIGEST="+change.New.String())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Warnf("watch: command failed for %s: %v", change.RefName, err)
+	}
+}
@@ -34,3 +34,7 @@ patch github.com/pkg/errors errors-0001-errors-add-Debug-function.patch
 
 # Backport https://github.com/opencontainers/runtime-tools/pull/359.
 patch github.com/opencontainers/runtime-tools runtime-tools-0001-generate-remove-validate-dependency.patch
+
+# generate/seccomp refers to Linux-only syscall constants, which breaks the
+# build on other platforms (such as macOS).
+patch github.com/opencontainers/runtime-tools runtime-tools-0002-generate-seccomp-fix-build-on-non-linux.patch
@@ -28,7 +28,7 @@ clean() {
 
 	# Important because different buildtags and platforms can have different
 	# import sets. It's very important to make sure this is kept up to date.
-	local platforms=( "linux/amd64" )
+	local platforms=( "linux/amd64" "darwin/amd64" "windows/amd64" )
 	local buildtagcombos=( "" )
 
 	# Remove non-top-level vendors.
@@ -125,7 +125,7 @@ clone github.com/opencontainers/runtime-spec v1.0.0
 clone github.com/opencontainers/runtime-tools 2d270b8764c02228eeb13e36f076f5ce6f2e3591
 clone github.com/syndtr/gocapability 2c00daeb6c3b45114c80ac44119e7b8801fdd852
 clone golang.org/x/crypto b8a2a83acfe6e6770b75de42d5ff4c67596675c0 https://github.com/golang/crypto
-clone golang.org/x/sys fb4cac33e3196ff7f507ab9b2d2a44b0142f5b5a https://github.com/golang/sys
+clone golang.org/x/sys v0.45.0 https://github.com/golang/sys
 clone github.com/docker/go-units v0.3.1
 clone github.com/pkg/errors v0.8.0
 clone github.com/apex/log afb2e76037a5f36542c77e88ef8aef9f469b09f8
@@ -133,6 +133,15 @@ clone github.com/urfave/cli v1.18.1
 clone github.com/cyphar/filepath-securejoin v0.2.1
 clone github.com/vbatts/go-mtree 711a89aa4c4a8f148d87eb915456eba8ee7c6a0b
 clone golang.org/x/net 45e771701b814666a7eb299e6c7a57d0b1799e91 https://github.com/golang/net
+clone golang.org/x/text v0.37.0 https://github.com/golang/text
+clone github.com/BurntSushi/toml v1.6.0
+clone github.com/klauspost/compress v1.18.0
+clone go.opentelemetry.io/otel v1.44.0 https://github.com/open-telemetry/opentelemetry-go
+clone go.opentelemetry.io/auto sdk/v1.2.1 https://github.com/open-telemetry/opentelemetry-go-instrumentation
+clone github.com/go-logr/logr v1.4.3
+clone github.com/go-logr/stdr v1.2.2
+clone github.com/google/uuid v1.6.0
+clone github.com/cespare/xxhash/v2 v2.3.0 https://github.com/cespare/xxhash
 # Used purely for testing.
 clone github.com/mohae/deepcopy 491d3605edfb866af34a48075bd4355ac1bf46ca
 
@@ -24,12 +24,18 @@ package mutate
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/rawjson"
+	"github.com/openSUSE/umoci/pkg/telemetry"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -63,6 +69,29 @@ type Mutator struct {
 	// Cached values of the configuration and manifest.
 	manifest *ispec.Manifest
 	config   *ispec.Image
+
+	// extensions are the fields of the cached configuration which are not
+	// defined by the image-spec (see igen.ParseExtensions), which are
+	// preserved by Commit.
+	extensions map[string]json.RawMessage
+
+	// rawManifest and rawConfig are the original encodings of the cached
+	// manifest and configuration (without the extensions), whose unknown
+	// nested fields are preserved by Commit (see rawjson.Preserve).
+	rawManifest []byte
+	rawConfig   []byte
+
+	// platform overrides the platform recorded in the descriptor of the new
+	// manifest (see SetPlatform).
+	platform *ispec.Platform
+
+	// compressor is used to compress new layers instead of gzip (see
+	// SetCompressor).
+	compressor layer.Compressor
+
+	// layerAnnotations are the annotations of the descriptors of new layers
+	// (see SetLayerAnnotations).
+	layerAnnotations map[string]string
 }
 
 // Meta is a wrapper around the "safe" fields in ispec.Image, which can be
@@ -106,6 +135,15 @@ func (m *Mutator) cache(ctx context.Context) error {
 
 		// Make a copy of the manifest.
 		m.manifest = manifestPtr(manifest)
+
+		// Docker manifests are converted to OCI manifests by Commit, so only
+		// the unknown fields of OCI manifests can be preserved.
+		if m.source.Descriptor().MediaType == ispec.MediaTypeImageManifest {
+			m.rawManifest, err = m.readBlob(ctx, m.source.Descriptor().Digest)
+			if err != nil {
+				return errors.Wrap(err, "read source manifest blob")
+			}
+		}
 	}
 
 	if m.config == nil {
@@ -123,16 +161,68 @@ func (m *Mutator) cache(ctx context.Context) error {
 
 		// Make a copy of the config and configDescriptor.
 		m.config = configPtr(config)
+
+		// ispec.Image only contains the fields defined by the image-spec, so
+		// we need to get any other fields from the raw blob.
+		data, err := m.readBlob(ctx, m.manifest.Config.Digest)
+		if err != nil {
+			return errors.Wrap(err, "read source config blob")
+		}
+		m.extensions, err = igen.ParseExtensions(data)
+		if err != nil {
+			return errors.Wrap(err, "parse source config extensions")
+		}
+		m.rawConfig, err = stripExtensions(data, m.extensions)
+		if err != nil {
+			return errors.Wrap(err, "parse source config")
+		}
 	}
 
 	return nil
 }
 
-// New creates a new Mutator for the given descriptor (which _must_ have a
-// MediaType of ispec.MediaTypeImageManifest.
+// readBlob returns the contents of the blob with the given digest.
+func (m *Mutator) readBlob(ctx context.Context, blobDigest digest.Digest) ([]byte, error) {
+	reader, err := m.engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// checkSchemaVersion returns an error if a manifest or index with the given
+// schemaVersion cannot be safely modified (see cas.NewerVersionPolicy).
+func (m *Mutator) checkSchemaVersion(schemaVersion int) error {
+	if cas.GetNewerVersionPolicy(m.engine.Engine) == cas.NewerVersionsForce {
+		return nil
+	}
+	return cas.CheckSchemaVersion(schemaVersion)
+}
+
+// stripExtensions returns the encoding of the configuration without the given
+// extensions, which are handled separately from the other unknown fields so
+// that they can be removed with SetExtensions.
+func stripExtensions(data []byte, extensions map[string]json.RawMessage) ([]byte, error) {
+	if len(extensions) == 0 {
+		return data, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name := range extensions {
+		delete(fields, name)
+	}
+	return json.Marshal(fields)
+}
+
+// New creates a new Mutator for the given descriptor (which _must_ be a
+// manifest, see casext.IsManifestMediaType). Docker manifests are converted to
+// OCI manifests by Commit.
 func New(engine cas.Engine, src casext.DescriptorPath) (*Mutator, error) {
 	// We currently only support changing a given manifest through a walk.
-	if mt := src.Descriptor().MediaType; mt != ispec.MediaTypeImageManifest {
+	if mt := src.Descriptor().MediaType; !casext.IsManifestMediaType(mt) {
 		return nil, errors.Errorf("unsupported source type: %s", mt)
 	}
 
@@ -172,6 +262,61 @@ func (m *Mutator) Meta(ctx context.Context) (Meta, error) {
 	}, nil
 }
 
+// RootfsType returns the rootfs.type of the current configuration.
+func (m *Mutator) RootfsType(ctx context.Context) (string, error) {
+	if err := m.cache(ctx); err != nil {
+		return "", errors.Wrap(err, "getting cache failed")
+	}
+
+	return m.config.RootFS.Type, nil
+}
+
+// SetRootfsType sets the rootfs.type of the configuration. The image-spec
+// only defines the "layers" type, so other types should only be used for
+// interoperability with tools which require them.
+func (m *Mutator) SetRootfsType(ctx context.Context, rootfsType string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.config.RootFS.Type = rootfsType
+	return nil
+}
+
+// Extensions returns a copy of the fields of the current configuration which
+// are not defined by the image-spec (see igen.ParseExtensions). Unless they
+// are modified with SetExtensions, they are preserved by Commit.
+func (m *Mutator) Extensions(ctx context.Context) (map[string]json.RawMessage, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	extensions := map[string]json.RawMessage{}
+	for name, value := range m.extensions {
+		extensions[name] = value
+	}
+	return extensions, nil
+}
+
+// SetExtensions replaces the fields of the configuration which are not
+// defined by the image-spec. An error is returned if any of the names are
+// fields defined by the image-spec.
+func (m *Mutator) SetExtensions(ctx context.Context, extensions map[string]json.RawMessage) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	newExtensions := map[string]json.RawMessage{}
+	for name, value := range extensions {
+		if igen.IsImageField(name) {
+			return errors.Errorf("extension %q is an image-spec field", name)
+		}
+		newExtensions[name] = value
+	}
+	m.extensions = newExtensions
+	return nil
+}
+
 // Annotations returns the set of annotations in the current manifest. This
 // does not include the annotations set in ispec.ImageConfig.Labels. This
 // should be used as the source for any modifications of the annotations using
@@ -188,6 +333,104 @@ func (m *Mutator) Annotations(ctx context.Context) (map[string]string, error) {
 	return annotations, nil
 }
 
+// Manifest returns a copy of the current manifest, including any layers added
+// (or squashed) since the Mutator was created. The config descriptor is only
+// updated by Commit, so it refers to the source configuration.
+func (m *Mutator) Manifest(ctx context.Context) (ispec.Manifest, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	manifest := *m.manifest
+	manifest.Layers = append([]ispec.Descriptor(nil), m.manifest.Layers...)
+	manifest.Annotations = map[string]string{}
+	for k, v := range m.manifest.Annotations {
+		manifest.Annotations[k] = v
+	}
+	return manifest, nil
+}
+
+// Platform returns the platform which will be recorded in the descriptor of
+// the new manifest by Commit, so that tools which select a manifest from an
+// index can do so without fetching its configuration. Unless it has been set
+// with SetPlatform, the platform is derived from the architecture and OS of the
+// current configuration (the remaining fields of the source descriptor's
+// platform are kept if the architecture and OS are unchanged).
+func (m *Mutator) Platform(ctx context.Context) (ispec.Platform, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	if m.platform != nil {
+		return *m.platform, nil
+	}
+	platform := ispec.Platform{
+		Architecture: m.config.Architecture,
+		OS:           m.config.OS,
+	}
+	if old := m.source.Descriptor().Platform; old != nil && old.Architecture == platform.Architecture && old.OS == platform.OS {
+		platform = *old
+	}
+	return platform, nil
+}
+
+// SetPlatform overrides the platform which will be recorded in the descriptor
+// of the new manifest by Commit. The configuration is not modified.
+func (m *Mutator) SetPlatform(ctx context.Context, platform ispec.Platform) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.platform = &platform
+	return nil
+}
+
+// SetCompressor sets the compression algorithm used for layers added by Add,
+// AddNonDistributable and Squash. If c is nil (the default), layers are
+// compressed with gzip.
+func (m *Mutator) SetCompressor(c layer.Compressor) {
+	m.compressor = c
+}
+
+// SetLayerAnnotations sets the annotations recorded in the descriptors of
+// layers added to the image by the Mutator after this call (such as to record
+// where the layers came from). Existing layers are not modified.
+func (m *Mutator) SetLayerAnnotations(annotations map[string]string) {
+	m.layerAnnotations = annotations
+}
+
+// layerDescriptor returns the descriptor of a new layer added by the Mutator.
+func (m *Mutator) layerDescriptor(nonDistributable bool, digest digest.Digest, size int64) ispec.Descriptor {
+	var annotations map[string]string
+	if len(m.layerAnnotations) > 0 {
+		annotations = make(map[string]string, len(m.layerAnnotations))
+		for key, value := range m.layerAnnotations {
+			annotations[key] = value
+		}
+	}
+	return ispec.Descriptor{
+		MediaType:   m.layerMediaType(nonDistributable),
+		Digest:      digest,
+		Size:        size,
+		Annotations: annotations,
+	}
+}
+
+// layerMediaType returns the media type of the layers added by the Mutator.
+func (m *Mutator) layerMediaType(nonDistributable bool) string {
+	if m.compressor != nil {
+		mediaType, nonDistributableMediaType := layer.CompressorMediaType(m.compressor)
+		if nonDistributable {
+			return nonDistributableMediaType
+		}
+		return mediaType
+	}
+	if nonDistributable {
+		return ispec.MediaTypeImageLayerNonDistributableGzip
+	}
+	return ispec.MediaTypeImageLayerGzip
+}
+
 // Set sets the image configuration and metadata to the given values. The
 // provided ispec.History entry is appended to the image's history and should
 // correspond to what operations were made to the configuration.
@@ -215,42 +458,54 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	return nil
 }
 
-// add adds the given layer to the CAS, and mutates the configuration to
-// include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+// add adds the given layer to the CAS. The first returned digest is the
+// diffID of the layer, and the second is the digest of the *compressed* layer
+// (which is compressed by us). The caller is responsible for updating the
+// configuration and manifest.
+func (m *Mutator) add(ctx context.Context, reader io.Reader) (_ digest.Digest, _ digest.Digest, _ int64, Err error) {
 	if err := m.cache(ctx); err != nil {
-		return "", -1, errors.Wrap(err, "getting cache failed")
+		return "", "", -1, errors.Wrap(err, "getting cache failed")
 	}
 
+	ctx, span := telemetry.StartSpan(ctx, "mutate.add_layer", nil)
+	defer func() { span.End(Err) }()
+
 	diffidDigester := cas.BlobAlgorithm.Digester()
 	hashReader := io.TeeReader(reader, diffidDigester.Hash())
 
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 
-	gzw := gzip.NewWriter(pipeWriter)
-	defer gzw.Close()
+	var compressor io.WriteCloser = gzip.NewWriter(pipeWriter)
+	if m.compressor != nil {
+		var err error
+		compressor, err = m.compressor.Compress(pipeWriter)
+		if err != nil {
+			return "", "", -1, errors.Wrapf(err, "create %s writer", m.compressor.Name())
+		}
+	}
+	defer compressor.Close()
 	go func() {
-		_, err := io.Copy(gzw, hashReader)
+		size, err := io.Copy(compressor, hashReader)
 		if err != nil {
 			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
 			return
 		}
-		gzw.Close()
+		telemetry.AddCounter(telemetry.CounterBytesUncompressed, size)
+		if err := compressor.Close(); err != nil {
+			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			return
+		}
 		pipeWriter.Close()
 	}()
 
 	layerDigest, layerSize, err := m.engine.PutBlob(ctx, pipeReader)
 	if err != nil {
-		return "", -1, errors.Wrap(err, "put layer blob")
+		return "", "", -1, errors.Wrap(err, "put layer blob")
 	}
+	telemetry.AddCounter(telemetry.CounterBytesCompressed, layerSize)
 
-	// Add DiffID to configuration.
-	layerDiffID := diffidDigester.Digest()
-	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, layerDiffID)
-
-	return layerDigest, layerSize, nil
+	return diffidDigester.Digest(), layerDigest, layerSize, nil
 }
 
 // Add adds a layer to the image, by reading the layer changeset blob from the
@@ -263,18 +518,16 @@ func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History) e
 		return errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r)
+	diffID, digest, size, err := m.add(ctx, r)
 	if err != nil {
 		return errors.Wrap(err, "add layer")
 	}
 
+	// Add DiffID to configuration.
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, diffID)
+
 	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerGzip,
-		Digest:    digest,
-		Size:      size,
-	})
+	m.manifest.Layers = append(m.manifest.Layers, m.layerDescriptor(false, digest, size))
 
 	// Append history.
 	history.EmptyLayer = false
@@ -289,18 +542,16 @@ func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history
 		return errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r)
+	diffID, digest, size, err := m.add(ctx, r)
 	if err != nil {
 		return errors.Wrap(err, "add non-distributable layer")
 	}
 
+	// Add DiffID to configuration.
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, diffID)
+
 	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
-		Digest:    digest,
-		Size:      size,
-	})
+	m.manifest.Layers = append(m.manifest.Layers, m.layerDescriptor(true, digest, size))
 
 	// Append history.
 	history.EmptyLayer = false
@@ -308,6 +559,83 @@ func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history
 	return nil
 }
 
+// Squash replaces the layers with indices in the inclusive range [start, end]
+// with a single layer, by reading the layer changeset blob from the provided
+// reader. As with Add, the stream must not be compressed. The caller is
+// responsible for ensuring that the new layer is equivalent to the layers it
+// replaces (see layer.SquashLayers). The history entries of the replaced
+// layers are replaced by the provided history entry, while any history
+// entries which don't correspond to a layer are retained.
+func (m *Mutator) Squash(ctx context.Context, start, end int, r io.Reader, history ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	if start < 0 || end < start || end >= len(m.manifest.Layers) {
+		return errors.Errorf("invalid layer range [%d, %d] for image with %d layers", start, end, len(m.manifest.Layers))
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("image has %d layers but %d diffids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+	for _, descriptor := range m.manifest.Layers[start : end+1] {
+		// Squashing would result in the contents of the non-distributable
+		// layer being distributed.
+		if casext.IsNonDistributableMediaType(descriptor.MediaType) {
+			return errors.Errorf("cannot squash non-distributable layer %s", descriptor.Digest)
+		}
+	}
+
+	diffID, layerDigest, size, err := m.add(ctx, r)
+	if err != nil {
+		return errors.Wrap(err, "add squashed layer")
+	}
+
+	// Replace the layers and their DiffIDs.
+	var layers []ispec.Descriptor
+	layers = append(layers, m.manifest.Layers[:start]...)
+	layers = append(layers, m.layerDescriptor(false, layerDigest, size))
+	layers = append(layers, m.manifest.Layers[end+1:]...)
+	m.manifest.Layers = layers
+
+	var diffIDs []digest.Digest
+	diffIDs = append(diffIDs, m.config.RootFS.DiffIDs[:start]...)
+	diffIDs = append(diffIDs, diffID)
+	diffIDs = append(diffIDs, m.config.RootFS.DiffIDs[end+1:]...)
+	m.config.RootFS.DiffIDs = diffIDs
+
+	// Replace the history entries. If the non-empty history entries don't
+	// match up with the layers there's nothing sensible we can do, so we
+	// leave the history alone.
+	var nonEmpty int
+	for _, entry := range m.config.History {
+		if !entry.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != len(diffIDs)+end-start {
+		return nil
+	}
+	history.EmptyLayer = false
+
+	var newHistory []ispec.History
+	idx := 0
+	for _, entry := range m.config.History {
+		if entry.EmptyLayer {
+			newHistory = append(newHistory, entry)
+			continue
+		}
+		switch {
+		case idx == end:
+			newHistory = append(newHistory, history)
+		case idx < start || idx > end:
+			newHistory = append(newHistory, entry)
+		}
+		idx++
+	}
+	m.config.History = newHistory
+	return nil
+}
+
 // Commit writes all of the temporary changes made to the configuration,
 // metadata and manifest to the engine. It then returns a new manifest
 // descriptor (which can be used in place of the source descriptor provided to
@@ -316,21 +644,52 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	if err := m.cache(ctx); err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "getting cache failed")
 	}
+	if err := m.checkSchemaVersion(m.manifest.SchemaVersion); err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "check manifest")
+	}
 
-	// We first have to commit the configuration blob.
-	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+	// We first have to commit the configuration blob, including any fields
+	// which are not defined by the image-spec.
+	configData, err := igen.MarshalImage(*m.config, m.extensions)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "marshal mutated config")
+	}
+	if m.rawConfig != nil {
+		configData, err = rawjson.Preserve(m.rawConfig, configData, *m.config)
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "marshal mutated config")
+		}
+	}
+	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, json.RawMessage(configData))
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated config blob")
 	}
 
-	m.manifest.Config = ispec.Descriptor{
-		MediaType: m.manifest.Config.MediaType,
-		Digest:    configDigest,
-		Size:      configSize,
+	// We always write OCI manifests (ispec.Manifest has no mediaType field, so
+	// we cannot write a Docker manifest), so the media types of any Docker
+	// descriptors need to be converted. Converting to OCI never fails.
+	// The other fields of the descriptor (such as its annotations) are kept.
+	configMediaType, _ := casext.ConvertMediaType(m.manifest.Config.MediaType, casext.FormatOCI)
+	m.manifest.Config.MediaType = configMediaType
+	m.manifest.Config.Digest = configDigest
+	m.manifest.Config.Size = configSize
+	for idx, layer := range m.manifest.Layers {
+		m.manifest.Layers[idx].MediaType, _ = casext.ConvertMediaType(layer.MediaType, casext.FormatOCI)
 	}
 
-	// Now commit the manifest.
-	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, m.manifest)
+	// Now commit the manifest, including any fields which are not defined by
+	// the image-spec.
+	manifestData, err := json.Marshal(m.manifest)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "marshal mutated manifest")
+	}
+	if m.rawManifest != nil {
+		manifestData, err = rawjson.Preserve(m.rawManifest, manifestData, *m.manifest)
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "marshal mutated manifest")
+		}
+	}
+	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, json.RawMessage(manifestData))
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated manifest blob")
 	}
@@ -344,10 +703,19 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	}
 	copy(newPath.Walk, m.source.Walk)
 
+	platform, err := m.Platform(ctx)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get platform")
+	}
+
 	// Replace the end of the path.
 	end := &newPath.Walk[pathLength-1]
+	end.MediaType = ispec.MediaTypeImageManifest
 	end.Digest = manifestDigest
 	end.Size = manifestSize
+	if platform.Architecture != "" && platform.OS != "" {
+		end.Platform = &platform
+	}
 
 	// Walk up the path, mutating the parent reference of each descriptor.
 	for idx := pathLength - 1; idx >= 1; idx-- {
@@ -371,10 +739,30 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 			return casext.DescriptorPath{}, errors.Wrapf(err, "rewrite parent-%d blob", idx)
 		}
 
-		// Re-commit the blob.
+		// Re-commit the blob, preserving any fields of OCI indexes which are
+		// not defined by the image-spec.
 		// TODO: This won't handle foreign blobs correctly, we need to make it
 		//       possible to write a modified blob through the blob API.
-		blobDigest, blobSize, err := m.engine.PutBlobJSON(ctx, parentBlob.Data)
+		var parentData interface{} = parentBlob.Data
+		if parentBlob.MediaType == ispec.MediaTypeImageIndex {
+			if err := m.checkSchemaVersion(parentBlob.Data.(ispec.Index).SchemaVersion); err != nil {
+				return casext.DescriptorPath{}, errors.Wrapf(err, "check parent-%d blob", idx)
+			}
+			oldData, err := m.readBlob(ctx, parentBlob.Digest)
+			if err != nil {
+				return casext.DescriptorPath{}, errors.Wrapf(err, "read parent-%d blob", idx)
+			}
+			newData, err := json.Marshal(parentBlob.Data)
+			if err != nil {
+				return casext.DescriptorPath{}, errors.Wrapf(err, "marshal parent-%d blob", idx)
+			}
+			newData, err = rawjson.Preserve(oldData, newData, parentBlob.Data)
+			if err != nil {
+				return casext.DescriptorPath{}, errors.Wrapf(err, "marshal parent-%d blob", idx)
+			}
+			parentData = json.RawMessage(newData)
+		}
+		blobDigest, blobSize, err := m.engine.PutBlobJSON(ctx, parentData)
 		if err != nil {
 			return casext.DescriptorPath{}, errors.Wrapf(err, "put json parent-%d blob", idx)
 		}
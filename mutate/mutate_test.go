@@ -20,6 +20,7 @@ package mutate
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -30,9 +31,11 @@ import (
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/opencontainers/go-digest"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 
 	// Include all known drivers.
@@ -278,6 +281,52 @@ func TestMutateAdd(t *testing.T) {
 	}
 }
 
+func TestMutateManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	// The added layer is included before the changes are committed.
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	if len(manifest.Layers) != len(oldManifest.Layers)+1 {
+		t.Fatalf("expected %d layers: got %d", len(oldManifest.Layers)+1, len(manifest.Layers))
+	}
+	if manifest.Layers[0].Digest != oldManifest.Layers[0].Digest {
+		t.Errorf("manifest.Layers[0].Digest is not the same!")
+	}
+	if manifest.Config.Digest != oldManifest.Config.Digest {
+		t.Errorf("manifest.Config.Digest was modified before Commit")
+	}
+
+	// The returned manifest is a copy.
+	manifest.Layers[1].Digest = oldManifest.Layers[0].Digest
+	if mutator.manifest.Layers[1].Digest == oldManifest.Layers[0].Digest {
+		t.Errorf("modifying the returned manifest modified the mutator")
+	}
+}
+
 func TestMutateAddNonDistributable(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestMutateAddNonDistributable")
 	if err != nil {
@@ -358,6 +407,431 @@ func TestMutateAddNonDistributable(t *testing.T) {
 	}
 }
 
+// identityCompressor is a layer.Compressor which doesn't compress anything.
+type identityCompressor struct{}
+
+func (identityCompressor) Name() string { return "test-identity" }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (identityCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (identityCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func TestMutateAddCompressor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddCompressor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator.SetCompressor(identityCompressor{})
+
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.AddNonDistributable(context.Background(), bytes.NewBufferString("foreign"), ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	mediaType, nonDistributableMediaType := layer.CompressorMediaType(identityCompressor{})
+	for idx, expected := range map[int]struct {
+		mediaType string
+		data      string
+	}{
+		1: {mediaType, "contents"},
+		2: {nonDistributableMediaType, "foreign"},
+	} {
+		descriptor := mutator.manifest.Layers[idx]
+		if descriptor.MediaType != expected.mediaType {
+			t.Errorf("manifest.Layers[%d].MediaType is the wrong value: %s", idx, descriptor.MediaType)
+		}
+		reader, err := mutator.engine.GetBlob(context.Background(), descriptor.Digest)
+		if err != nil {
+			t.Fatalf("unexpected error getting layer: %+v", err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected.data {
+			t.Errorf("manifest.Layers[%d] was not compressed by the compressor: %q", idx, data)
+		}
+	}
+}
+
+func TestMutateLayerAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateLayerAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("before"), ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	annotations := map[string]string{"org.opensuse.testannotation": "value"}
+	mutator.SetLayerAnnotations(annotations)
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("after"), ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.AddNonDistributable(context.Background(), bytes.NewBufferString("foreign"), ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	// Later changes to the map must not affect the added layers.
+	annotations["org.opensuse.testannotation"] = "modified"
+
+	for idx, expected := range []map[string]string{
+		nil,
+		nil,
+		{"org.opensuse.testannotation": "value"},
+		{"org.opensuse.testannotation": "value"},
+	} {
+		if got := mutator.manifest.Layers[idx].Annotations; !reflect.DeepEqual(got, expected) {
+			t.Errorf("manifest.Layers[%d].Annotations is the wrong value: %v", idx, got)
+		}
+	}
+}
+
+func TestMutateExtensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateExtensions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.SetExtensions(context.Background(), map[string]json.RawMessage{"config": json.RawMessage(`{}`)}); err == nil {
+		t.Errorf("expected an error setting an image-spec field as an extension")
+	}
+	extensions := map[string]json.RawMessage{"org.opensuse.testextension": json.RawMessage(`{"key":"value"}`)}
+	if err := mutator.SetExtensions(context.Background(), extensions); err != nil {
+		t.Fatalf("unexpected error setting extensions: %+v", err)
+	}
+	if err := mutator.SetRootfsType(context.Background(), "custom"); err != nil {
+		t.Fatalf("unexpected error setting rootfs type: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+
+	// Modifying the configuration with a new mutator must preserve the
+	// extensions and rootfs type.
+	mutator, err = New(engine, newDescriptorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.User = "changed:user"
+	if err := mutator.Set(context.Background(), config, meta, nil, ispec.History{}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	newDescriptorPath, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := mutator.Extensions(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting extensions: %+v", err)
+	} else if !reflect.DeepEqual(got, extensions) {
+		t.Errorf("extensions were not preserved: expected %v, got %v", extensions, got)
+	}
+	if got, err := mutator.RootfsType(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting rootfs type: %+v", err)
+	} else if got != "custom" {
+		t.Errorf("rootfs type was not preserved: got %q", got)
+	}
+	if got, err := mutator.Config(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if got.User != "changed:user" {
+		t.Errorf("config was not modified: got user %q", got.User)
+	}
+}
+
+// readTestJSON reads the blob with the given digest as a generic JSON object.
+func readTestJSON(t *testing.T, engine cas.Engine, blobDigest digest.Digest) map[string]interface{} {
+	reader, err := engine.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	var value map[string]interface{}
+	if err := json.NewDecoder(reader).Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestMutateUnknownFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateUnknownFields")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Add fields (which are not known to image-spec) to the configuration and
+	// manifest, as a newer tool might.
+	manifest := readTestJSON(t, engine, fromDescriptor.Digest)
+	config := readTestJSON(t, engine, digest.Digest(manifest["config"].(map[string]interface{})["digest"].(string)))
+	config["config"].(map[string]interface{})["Healthcheck"] = map[string]interface{}{"Test": []interface{}{"NONE"}}
+	config["history"] = []interface{}{map[string]interface{}{"created_by": "test", "org.opensuse.test": true}}
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest["config"] = map[string]interface{}{
+		"mediaType":   ispec.MediaTypeImageConfig,
+		"digest":      configDigest,
+		"size":        configSize,
+		"annotations": map[string]interface{}{"org.opensuse.test": "config"},
+	}
+	manifest["subject"] = map[string]interface{}{"mediaType": ispec.MediaTypeImageManifest, "digest": expectedManifestDigest, "size": 1}
+	manifest["layers"].([]interface{})[0].(map[string]interface{})["org.opensuse.test"] = "layer"
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageConfig, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageConfig.User = "changed:user"
+	if err := mutator.Set(context.Background(), imageConfig, meta, nil, ispec.History{CreatedBy: "TestMutateUnknownFields"}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+
+	newManifest := readTestJSON(t, engine, newDescriptorPath.Descriptor().Digest)
+	if _, ok := newManifest["subject"]; !ok {
+		t.Errorf("manifest subject was not preserved: %v", newManifest)
+	}
+	if layer := newManifest["layers"].([]interface{})[0].(map[string]interface{}); layer["org.opensuse.test"] != "layer" {
+		t.Errorf("layer descriptor field was not preserved: %v", layer)
+	}
+	newConfigDescriptor := newManifest["config"].(map[string]interface{})
+	if newConfigDescriptor["digest"] == string(configDigest) {
+		t.Errorf("config was not modified")
+	}
+	if annotations, _ := newConfigDescriptor["annotations"].(map[string]interface{}); annotations["org.opensuse.test"] != "config" {
+		t.Errorf("config descriptor annotations were not preserved: %v", newConfigDescriptor)
+	}
+
+	newConfig := readTestJSON(t, engine, digest.Digest(newConfigDescriptor["digest"].(string)))
+	runtimeConfig := newConfig["config"].(map[string]interface{})
+	if runtimeConfig["User"] != "changed:user" {
+		t.Errorf("config was not modified: %v", runtimeConfig)
+	}
+	if _, ok := runtimeConfig["Healthcheck"]; !ok {
+		t.Errorf("config Healthcheck was not preserved: %v", runtimeConfig)
+	}
+	history := newConfig["history"].([]interface{})
+	if len(history) != 2 {
+		t.Fatalf("unexpected history: %v", history)
+	}
+	if entry := history[0].(map[string]interface{}); entry["org.opensuse.test"] != true {
+		t.Errorf("history entry field was not preserved: %v", entry)
+	}
+	if entry := history[1].(map[string]interface{}); entry["created_by"] != "TestMutateUnknownFields" {
+		t.Errorf("unexpected new history entry: %v", entry)
+	}
+}
+
+func TestMutateNewerSchemaVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateNewerSchemaVersion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	manifest := readTestJSON(t, engine, fromDescriptor.Digest)
+	manifest["schemaVersion"] = cas.SchemaVersion + 1
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}}
+
+	for _, policy := range []cas.NewerVersionPolicy{cas.NewerVersionsReadOnly, cas.NewerVersionsPassThrough, cas.NewerVersionsForce} {
+		policyEngine, err := cas.OpenWithOptions(filepath.Join(dir, "image"), cas.OpenOptions{NewerVersions: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer policyEngine.Close()
+
+		mutator, err := New(policyEngine, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The manifest can still be read.
+		if _, err := mutator.Config(context.Background()); err != nil {
+			t.Fatalf("unexpected error reading config: %+v", err)
+		}
+		_, err = mutator.Commit(context.Background())
+		if force := policy == cas.NewerVersionsForce; force && err != nil {
+			t.Errorf("unexpected error committing with %v: %+v", policy, err)
+		} else if !force && errors.Cause(err) != cas.ErrNewerVersion {
+			t.Errorf("expected ErrNewerVersion committing newer manifest with %v: got %+v", policy, err)
+		}
+	}
+}
+
+func TestMutateSquash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	baseLayer := mutator.manifest.Layers[0]
+
+	// Add two layers, with an empty history entry between them.
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("layer 1"), ispec.History{
+		Comment: "layer 1",
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{}, Meta{}, nil, ispec.History{
+		Comment: "config",
+	}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("layer 2"), ispec.History{
+		Comment: "layer 2",
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	// Invalid ranges must be rejected.
+	for _, r := range [][2]int{{-1, 1}, {2, 1}, {1, 3}} {
+		if err := mutator.Squash(context.Background(), r[0], r[1], bytes.NewBufferString("squashed"), ispec.History{}); err == nil {
+			t.Errorf("expected error squashing invalid range %v", r)
+		}
+	}
+
+	// This isn't a valid squash of the two layers, but whatever.
+	if err := mutator.Squash(context.Background(), 1, 2, bytes.NewBufferString("squashed"), ispec.History{
+		Comment: "squashed",
+	}); err != nil {
+		t.Fatalf("unexpected error squashing layers: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Check the layers were replaced.
+	if len(mutator.manifest.Layers) != 2 {
+		t.Fatalf("manifest.Layers has the wrong length: %d", len(mutator.manifest.Layers))
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[0], baseLayer) {
+		t.Errorf("manifest.Layers[0] was modified")
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Errorf("config.RootFS.DiffIDs has the wrong length: %d", len(mutator.config.RootFS.DiffIDs))
+	}
+
+	// Check the history of the squashed layers was replaced, but the empty
+	// history entry was kept.
+	var comments []string
+	for _, history := range mutator.config.History {
+		comments = append(comments, history.Comment)
+	}
+	if expected := []string{"", "config", "squashed"}; !reflect.DeepEqual(comments, expected) {
+		t.Errorf("config.History has the wrong entries: got %v, expected %v", comments, expected)
+	}
+	if mutator.config.History[2].EmptyLayer {
+		t.Errorf("config.History[2].EmptyLayer was set")
+	}
+}
+
 func TestMutateSet(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestMutateSet")
 	if err != nil {
@@ -431,6 +905,106 @@ func TestMutateSet(t *testing.T) {
 	}
 }
 
+func TestMutatePlatform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutatePlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config of the source image has no platform.
+	if platform, err := mutator.Platform(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting platform: %+v", err)
+	} else if platform.Architecture != "" || platform.OS != "" {
+		t.Errorf("unexpected platform for image without architecture: %#v", platform)
+	}
+
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{}, Meta{
+		Architecture: "arm",
+		OS:           "linux",
+	}, nil, ispec.History{}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// The platform is derived from the config.
+	platform := newDescriptor.Descriptor().Platform
+	if platform == nil || platform.Architecture != "arm" || platform.OS != "linux" {
+		t.Fatalf("platform was not derived from config: %#v", platform)
+	}
+
+	// Overriding the platform doesn't modify the config.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.SetPlatform(context.Background(), ispec.Platform{
+		Architecture: "arm",
+		OS:           "linux",
+		Variant:      "v7",
+	}); err != nil {
+		t.Fatalf("unexpected error setting platform: %+v", err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	platform = newDescriptor.Descriptor().Platform
+	if platform == nil || platform.Variant != "v7" {
+		t.Fatalf("platform was not overridden: %#v", platform)
+	}
+	if meta, err := mutator.Meta(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting meta: %+v", err)
+	} else if meta.Architecture != "arm" || meta.OS != "linux" {
+		t.Errorf("config was modified by SetPlatform: %#v", meta)
+	}
+
+	// The rest of the platform is kept if the architecture is unchanged.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	platform = newDescriptor.Descriptor().Platform
+	if platform == nil || platform.Variant != "v7" {
+		t.Errorf("platform variant was not kept: %#v", platform)
+	}
+
+	// But not if the architecture changed.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{}, Meta{
+		Architecture: "arm64",
+		OS:           "linux",
+	}, nil, ispec.History{}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	platform = newDescriptor.Descriptor().Platform
+	if platform == nil || platform.Architecture != "arm64" || platform.Variant != "" {
+		t.Errorf("platform was not updated: %#v", platform)
+	}
+}
+
 func walkDescriptorRoot(ctx context.Context, engine casext.Engine, root ispec.Descriptor) (casext.DescriptorPath, error) {
 	var foundPath *casext.DescriptorPath
 
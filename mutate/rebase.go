@@ -0,0 +1,180 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"reflect"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// AnnotationBaseDigest is the manifest annotation key for the digest of
+	// the manifest of the image's base image.
+	AnnotationBaseDigest = "org.opencontainers.image.base.digest"
+
+	// AnnotationBaseName is the manifest annotation key for the name of the
+	// image's base image.
+	AnnotationBaseName = "org.opencontainers.image.base.name"
+)
+
+// image is a manifest together with its configuration.
+type image struct {
+	manifest ispec.Manifest
+	config   ispec.Image
+}
+
+// getImage fetches the manifest and configuration referenced by the given
+// manifest descriptor.
+func (m *Mutator) getImage(ctx context.Context, descriptor ispec.Descriptor) (image, error) {
+	manifestBlob, err := m.engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return image{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return image{}, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: %s", manifestBlob.MediaType)
+	}
+
+	configBlob, err := m.engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return image{}, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return image{}, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+	return image{manifest: manifest, config: config}, nil
+}
+
+// baseHistoryLength returns the number of history entries at the start of the
+// image's history which correspond to the given base image. If the base
+// image has a history, it must be a prefix of the image's history. Otherwise
+// the history entries up to (and including) the entry for the last layer of
+// the base image are considered to be part of the base image.
+func baseHistoryLength(config, base ispec.Image) (int, error) {
+	if len(base.History) > 0 {
+		if len(config.History) < len(base.History) || !reflect.DeepEqual(config.History[:len(base.History)], base.History) {
+			return 0, errors.Errorf("history of the image does not start with the history of the old base image")
+		}
+		return len(base.History), nil
+	}
+
+	layers := len(base.RootFS.DiffIDs)
+	if layers == 0 {
+		return 0, nil
+	}
+	for idx, entry := range config.History {
+		if !entry.EmptyLayer {
+			layers--
+		}
+		if layers == 0 {
+			return idx + 1, nil
+		}
+	}
+	// The history doesn't cover the base layers, so there's nothing to strip.
+	return 0, nil
+}
+
+// Rebase replaces the layers of the image which come from oldBase with the
+// layers of newBase, where oldBase and newBase are descriptors of image
+// manifests in the same engine. The layers (and DiffIDs) of oldBase must be a
+// prefix of the image's layers. The history entries which came from oldBase
+// are replaced with the history of newBase, and the provided history entry
+// is appended to the image's history. The image's configuration is otherwise
+// left alone, and the manifest annotations are updated to refer to newBase
+// (named baseName, if it is not empty).
+func (m *Mutator) Rebase(ctx context.Context, oldBase, newBase ispec.Descriptor, baseName string, history ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	oldImage, err := m.getImage(ctx, oldBase)
+	if err != nil {
+		return errors.Wrap(err, "get old base image")
+	}
+	newImage, err := m.getImage(ctx, newBase)
+	if err != nil {
+		return errors.Wrap(err, "get new base image")
+	}
+
+	// Make sure that the image was actually built on top of oldBase.
+	oldLayers := oldImage.manifest.Layers
+	if len(m.manifest.Layers) < len(oldLayers) {
+		return errors.Errorf("image has fewer layers than the old base image")
+	}
+	for idx, descriptor := range oldLayers {
+		if m.manifest.Layers[idx].Digest != descriptor.Digest {
+			return errors.Errorf("layer %d of the image (%s) does not match the old base image (%s)", idx, m.manifest.Layers[idx].Digest, descriptor.Digest)
+		}
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("image has %d layers but %d diffids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+	if len(newImage.config.RootFS.DiffIDs) != len(newImage.manifest.Layers) {
+		return errors.Errorf("new base image has %d layers but %d diffids", len(newImage.manifest.Layers), len(newImage.config.RootFS.DiffIDs))
+	}
+
+	// Layers built for a different platform won't work.
+	if newImage.config.OS != m.config.OS || newImage.config.Architecture != m.config.Architecture {
+		return errors.Errorf("new base image platform %s/%s does not match image platform %s/%s", newImage.config.OS, newImage.config.Architecture, m.config.OS, m.config.Architecture)
+	}
+
+	baseHistory, err := baseHistoryLength(*m.config, oldImage.config)
+	if err != nil {
+		return errors.Wrap(err, "match image history")
+	}
+
+	// Replace the layers and their DiffIDs.
+	var layers []ispec.Descriptor
+	layers = append(layers, newImage.manifest.Layers...)
+	layers = append(layers, m.manifest.Layers[len(oldLayers):]...)
+	m.manifest.Layers = layers
+
+	var diffIDs []digest.Digest
+	diffIDs = append(diffIDs, newImage.config.RootFS.DiffIDs...)
+	diffIDs = append(diffIDs, m.config.RootFS.DiffIDs[len(oldLayers):]...)
+	m.config.RootFS.DiffIDs = diffIDs
+
+	// Replace the history.
+	var newHistory []ispec.History
+	newHistory = append(newHistory, newImage.config.History...)
+	newHistory = append(newHistory, m.config.History[baseHistory:]...)
+	history.EmptyLayer = true
+	newHistory = append(newHistory, history)
+	m.config.History = newHistory
+
+	// Update the annotations.
+	annotations := map[string]string{}
+	for k, v := range m.manifest.Annotations {
+		annotations[k] = v
+	}
+	annotations[AnnotationBaseDigest] = newBase.Digest.String()
+	delete(annotations, AnnotationBaseName)
+	if baseName != "" {
+		annotations[AnnotationBaseName] = baseName
+	}
+	m.manifest.Annotations = annotations
+	return nil
+}
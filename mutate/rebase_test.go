@@ -0,0 +1,202 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// putRebaseImage stores an image with the given (fake) layer contents and
+// history in the engine.
+func putRebaseImage(t *testing.T, engine cas.Engine, layers []string, history []ispec.History) ispec.Descriptor {
+	engineExt := casext.NewEngine(engine)
+
+	config := ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS:       ispec.RootFS{Type: "layers"},
+		History:      history,
+	}
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+	}
+	for _, layer := range layers {
+		layerDigest, layerSize, err := engine.PutBlob(context.Background(), bytes.NewBufferString(layer))
+		if err != nil {
+			t.Fatalf("unexpected error putting layer: %s", err)
+		}
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromString("diffid "+layer))
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %s", err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %s", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func TestMutateRebase(t *testing.T) {
+	engine := mem.New()
+	defer engine.Close()
+
+	oldBase := putRebaseImage(t, engine, []string{"base1", "base2"}, []ispec.History{
+		{Comment: "base1"},
+		{Comment: "base config", EmptyLayer: true},
+		{Comment: "base2"},
+	})
+	newBase := putRebaseImage(t, engine, []string{"newbase1"}, []ispec.History{
+		{Comment: "newbase1"},
+	})
+	app := putRebaseImage(t, engine, []string{"base1", "base2", "app"}, []ispec.History{
+		{Comment: "base1"},
+		{Comment: "base config", EmptyLayer: true},
+		{Comment: "base2"},
+		{Comment: "app config", EmptyLayer: true},
+		{Comment: "app"},
+	})
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{app}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	appLayers := mutator.manifest.Layers
+	appDiffIDs := mutator.config.RootFS.DiffIDs
+
+	// The new base must not be used as the old base.
+	if err := mutator.Rebase(context.Background(), newBase, oldBase, "", ispec.History{}); err == nil {
+		t.Errorf("expected error rebasing with the wrong old base")
+	}
+
+	if err := mutator.Rebase(context.Background(), oldBase, newBase, "newbase", ispec.History{
+		Comment: "rebase",
+	}); err != nil {
+		t.Fatalf("unexpected error rebasing: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Check the layers.
+	if len(mutator.manifest.Layers) != 2 {
+		t.Fatalf("manifest.Layers has the wrong length: %d", len(mutator.manifest.Layers))
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[1], appLayers[2]) {
+		t.Errorf("application layer was not kept: got %v, expected %v", mutator.manifest.Layers[1], appLayers[2])
+	}
+	expectedDiffIDs := []digest.Digest{digest.FromString("diffid newbase1"), appDiffIDs[2]}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("config.RootFS.DiffIDs is wrong: got %v, expected %v", mutator.config.RootFS.DiffIDs, expectedDiffIDs)
+	}
+
+	// Check the history.
+	var comments []string
+	for _, history := range mutator.config.History {
+		comments = append(comments, history.Comment)
+	}
+	if expected := []string{"newbase1", "app config", "app", "rebase"}; !reflect.DeepEqual(comments, expected) {
+		t.Errorf("config.History has the wrong entries: got %v, expected %v", comments, expected)
+	}
+	if !mutator.config.History[3].EmptyLayer {
+		t.Errorf("config.History[3].EmptyLayer was not set")
+	}
+
+	// Check the annotations.
+	if got := mutator.manifest.Annotations[AnnotationBaseDigest]; got != newBase.Digest.String() {
+		t.Errorf("base digest annotation is wrong: got %s, expected %s", got, newBase.Digest)
+	}
+	if got := mutator.manifest.Annotations[AnnotationBaseName]; got != "newbase" {
+		t.Errorf("base name annotation is wrong: got %s, expected newbase", got)
+	}
+}
+
+func TestMutateRebaseNoBaseHistory(t *testing.T) {
+	engine := mem.New()
+	defer engine.Close()
+
+	oldBase := putRebaseImage(t, engine, []string{"base1", "base2"}, nil)
+	newBase := putRebaseImage(t, engine, []string{"newbase1"}, nil)
+	app := putRebaseImage(t, engine, []string{"base1", "base2", "app"}, []ispec.History{
+		{Comment: "base1"},
+		{Comment: "base config", EmptyLayer: true},
+		{Comment: "base2"},
+		{Comment: "app"},
+	})
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{app}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Rebase(context.Background(), oldBase, newBase, "", ispec.History{
+		Comment: "rebase",
+	}); err != nil {
+		t.Fatalf("unexpected error rebasing: %+v", err)
+	}
+
+	var comments []string
+	for _, history := range mutator.config.History {
+		comments = append(comments, history.Comment)
+	}
+	if expected := []string{"app", "rebase"}; !reflect.DeepEqual(comments, expected) {
+		t.Errorf("config.History has the wrong entries: got %v, expected %v", comments, expected)
+	}
+	if _, ok := mutator.manifest.Annotations[AnnotationBaseName]; ok {
+		t.Errorf("base name annotation was set")
+	}
+}
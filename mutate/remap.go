@@ -0,0 +1,106 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// remapLayer returns the diffID and descriptor of a copy of the given layer
+// with its ownership remapped (see layer.RemapArchive).
+func (m *Mutator) remapLayer(ctx context.Context, descriptor ispec.Descriptor, remap layer.IDRemap) (_ digest.Digest, _ ispec.Descriptor, Err error) {
+	blob, err := m.engine.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return "", ispec.Descriptor{}, errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+
+	layerRaw, err := layer.DecompressLayer(descriptor.MediaType, blob)
+	if err != nil {
+		return "", ispec.Descriptor{}, errors.Wrap(err, "decompress layer")
+	}
+	defer func() {
+		if err := layerRaw.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close decompressed layer")
+		}
+	}()
+
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		writer.CloseWithError(layer.RemapArchive(writer, layerRaw, remap))
+	}()
+
+	diffID, layerDigest, size, err := m.add(ctx, reader)
+	if err != nil {
+		return "", ispec.Descriptor{}, err
+	}
+	return diffID, ispec.Descriptor{
+		MediaType: m.layerMediaType(casext.IsNonDistributableMediaType(descriptor.MediaType)),
+		Digest:    layerDigest,
+		Size:      size,
+	}, nil
+}
+
+// Remap rewrites the ownership of every entry in every layer of the image as
+// described by remap (see layer.IDRemap), replacing each layer with its
+// remapped copy. Layers which are unchanged by the remapping are left as-is.
+// The provided history entry is appended to the image's history.
+func (m *Mutator) Remap(ctx context.Context, remap layer.IDRemap, history ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("image has %d layers but %d diffids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+
+	var (
+		layers  []ispec.Descriptor
+		diffIDs []digest.Digest
+	)
+	for idx, descriptor := range m.manifest.Layers {
+		diffID, newDescriptor, err := m.remapLayer(ctx, descriptor, remap)
+		if err != nil {
+			return errors.Wrapf(err, "remap layer %s", descriptor.Digest)
+		}
+		if diffID == m.config.RootFS.DiffIDs[idx] {
+			// Keep the original (which may have been compressed differently),
+			// the remapped copy is garbage collected.
+			log.Debugf("remap: layer %s is unchanged", descriptor.Digest)
+			diffID, newDescriptor = m.config.RootFS.DiffIDs[idx], descriptor
+		}
+		layers = append(layers, newDescriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+	m.manifest.Layers = layers
+	m.config.RootFS.DiffIDs = diffIDs
+
+	// Append history.
+	history.EmptyLayer = true
+	m.config.History = append(m.config.History, history)
+	return nil
+}
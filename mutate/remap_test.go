@@ -0,0 +1,202 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+)
+
+// putRemapImage stores an image with one gzip layer for each of the given
+// lists of headers in the engine.
+func putRemapImage(t *testing.T, engine cas.Engine, layers [][]*tar.Header) ispec.Descriptor {
+	engineExt := casext.NewEngine(engine)
+
+	config := ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS:       ispec.RootFS{Type: "layers"},
+	}
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+	}
+	for _, headers := range layers {
+		var raw, compressed bytes.Buffer
+		tw := tar.NewWriter(&raw)
+		for _, hdr := range headers {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("unexpected error writing header: %s", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("unexpected error closing archive: %s", err)
+		}
+		gzw := gzip.NewWriter(&compressed)
+		if _, err := gzw.Write(raw.Bytes()); err != nil {
+			t.Fatalf("unexpected error compressing layer: %s", err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatalf("unexpected error compressing layer: %s", err)
+		}
+
+		layerDigest, layerSize, err := engine.PutBlob(context.Background(), &compressed)
+		if err != nil {
+			t.Fatalf("unexpected error putting layer: %s", err)
+		}
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(raw.Bytes()))
+		config.History = append(config.History, ispec.History{})
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %s", err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %s", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func TestMutateRemap(t *testing.T) {
+	engine := mem.New()
+	defer engine.Close()
+
+	image := putRemapImage(t, engine, [][]*tar.Header{
+		{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 100000, Gid: 100000},
+			{Name: "home/user/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 101000, Gid: 101000},
+		},
+		// An empty layer is unchanged by the remapping.
+		{},
+	})
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{image}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	oldLayers := mutator.manifest.Layers
+	oldDiffIDs := mutator.config.RootFS.DiffIDs
+
+	idMap := func(hostID uint32) []rspec.LinuxIDMapping {
+		return []rspec.LinuxIDMapping{{ContainerID: 0, HostID: hostID, Size: 65536}}
+	}
+	if err := mutator.Remap(context.Background(), layer.IDRemap{
+		FromUIDMappings: idMap(100000),
+		FromGIDMappings: idMap(100000),
+		ToUIDMappings:   idMap(200000),
+		ToGIDMappings:   idMap(200000),
+	}, ispec.History{Comment: "remap"}); err != nil {
+		t.Fatalf("unexpected error remapping: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 2 || len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Fatalf("image has the wrong number of layers: %d", len(mutator.manifest.Layers))
+	}
+	if mutator.manifest.Layers[0].Digest == oldLayers[0].Digest || mutator.config.RootFS.DiffIDs[0] == oldDiffIDs[0] {
+		t.Errorf("layer 0 was not remapped")
+	}
+	if mutator.manifest.Layers[1].Digest != oldLayers[1].Digest || mutator.config.RootFS.DiffIDs[1] != oldDiffIDs[1] {
+		t.Errorf("unchanged layer 1 was replaced")
+	}
+	if history := mutator.config.History; len(history) != 3 || history[2].Comment != "remap" || !history[2].EmptyLayer {
+		t.Errorf("history was not updated correctly: %v", history)
+	}
+
+	// Check the ownership of the remapped layer.
+	blob, err := mutator.engine.GetVerifiedBlob(context.Background(), mutator.manifest.Layers[0])
+	if err != nil {
+		t.Fatalf("unexpected error getting layer: %+v", err)
+	}
+	defer blob.Close()
+	raw, err := layer.DecompressLayer(mutator.manifest.Layers[0].MediaType, blob)
+	if err != nil {
+		t.Fatalf("unexpected error decompressing layer: %+v", err)
+	}
+	defer raw.Close()
+	diffIDDigester := cas.BlobAlgorithm.Digester()
+	tr := tar.NewReader(io.TeeReader(raw, diffIDDigester.Hash()))
+	expected := map[string]int{"etc/": 200000, "home/user/": 201000}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		if id := expected[hdr.Name]; hdr.Uid != id || hdr.Gid != id {
+			t.Errorf("entry %s: got owner %d:%d, expected %d:%d", hdr.Name, hdr.Uid, hdr.Gid, id, id)
+		}
+	}
+	io.Copy(diffIDDigester.Hash(), raw)
+	if diffIDDigester.Digest() != mutator.config.RootFS.DiffIDs[0] {
+		t.Errorf("diffid of remapped layer is wrong: got %s, expected %s", mutator.config.RootFS.DiffIDs[0], diffIDDigester.Digest())
+	}
+
+	// Unmapped IDs cause an error.
+	if err := mutator.Remap(context.Background(), layer.IDRemap{
+		FromUIDMappings: idMap(300000),
+		ToUIDMappings:   idMap(400000),
+	}, ispec.History{}); err == nil {
+		t.Errorf("expected error remapping with unmapped ids")
+	}
+}
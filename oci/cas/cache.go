@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// cachedEngine is a wrapper around an Engine which shares blobs with a cache
+// (see WithBlobCache).
+type cachedEngine struct {
+	Engine
+	cache Engine
+}
+
+// WithBlobCache returns a wrapper around the given Engine which uses cache
+// (usually an image layout without any references, shared between many image
+// layouts) as a cache of blobs. GetBlob falls back to the cache for blobs
+// which are missing from the image, copying them into the image so that the
+// image remains self-contained. Blobs added with PutBlob are also added to the
+// cache (failing to populate the cache is not treated as an error). Blobs from
+// the cache are verified against their digest before being used, so the cache
+// does not need to be trusted.
+//
+// The returned Engine owns cache, and will close it when it is closed.
+func WithBlobCache(engine, cache Engine) Engine {
+	return &cachedEngine{Engine: engine, cache: cache}
+}
+
+// isNotExist returns whether the given error (returned by an Engine) means
+// that the requested blob doesn't exist.
+func isNotExist(err error) bool {
+	cause := errors.Cause(err)
+	return cause == ErrNotExist || os.IsNotExist(cause)
+}
+
+// PutBlob adds a new blob to the image, and then to the cache.
+func (e *cachedEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	blobDigest, size, err := e.Engine.PutBlob(ctx, reader)
+	if err != nil {
+		return blobDigest, size, err
+	}
+	if err := e.populate(ctx, blobDigest); err != nil {
+		log.Warnf("blob cache: cannot add blob %s: %v", blobDigest, err)
+	}
+	return blobDigest, size, nil
+}
+
+// populate adds the blob with the given digest from the image to the cache,
+// if the cache doesn't already contain it.
+func (e *cachedEngine) populate(ctx context.Context, blobDigest digest.Digest) error {
+	cached, err := e.cache.GetBlob(ctx, blobDigest)
+	if err == nil {
+		return cached.Close()
+	}
+	if !isNotExist(err) {
+		return errors.Wrap(err, "get cached blob")
+	}
+
+	reader, err := e.Engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	if _, _, err := e.cache.PutBlob(ctx, reader); err != nil {
+		return errors.Wrap(err, "put cached blob")
+	}
+	log.Debugf("blob cache: added blob %s", blobDigest)
+	return nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image. If the image
+// doesn't contain the blob, it is copied from the cache (if the image is
+// read-only, the blob is read directly from the cache instead).
+func (e *cachedEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	reader, err := e.Engine.GetBlob(ctx, blobDigest)
+	if err == nil || !isNotExist(err) {
+		return reader, err
+	}
+	notExistErr := err
+
+	if err := blobDigest.Validate(); err != nil {
+		return nil, notExistErr
+	}
+	cached, err := e.cache.GetBlob(ctx, blobDigest)
+	if err != nil {
+		if !isNotExist(err) {
+			log.Warnf("blob cache: cannot get blob %s: %v", blobDigest, err)
+		}
+		return nil, notExistErr
+	}
+	verified := NewVerifiedReadCloser(cached, ispec.Descriptor{Digest: blobDigest, Size: -1})
+
+	_, _, err = e.Engine.PutBlob(ctx, verified)
+	if errors.Cause(err) == ErrReadOnly {
+		// Just return the cached blob directly.
+		cached.Close()
+		cached, err = e.cache.GetBlob(ctx, blobDigest)
+		if err != nil {
+			return nil, errors.Wrap(err, "get cached blob")
+		}
+		log.Debugf("blob cache: using cached blob %s", blobDigest)
+		return NewVerifiedReadCloser(cached, ispec.Descriptor{Digest: blobDigest, Size: -1}), nil
+	}
+	cached.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "copy cached blob %s", blobDigest)
+	}
+	log.Debugf("blob cache: copied blob %s from cache", blobDigest)
+	return e.Engine.GetBlob(ctx, blobDigest)
+}
+
+// Close releases all references held by the engine and the cache.
+func (e *cachedEngine) Close() error {
+	err := e.Engine.Close()
+	if err2 := e.cache.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
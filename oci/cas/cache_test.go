@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// mapEngine is a minimal Engine which only supports blobs.
+type mapEngine struct {
+	Engine
+	blobs  map[digest.Digest][]byte
+	closed bool
+}
+
+func newMapEngine() *mapEngine {
+	return &mapEngine{blobs: map[digest.Digest][]byte{}}
+}
+
+func (e *mapEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", -1, err
+	}
+	blobDigest := digest.FromBytes(data)
+	e.blobs[blobDigest] = data
+	return blobDigest, int64(len(data)), nil
+}
+
+func (e *mapEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	data, ok := e.blobs[blobDigest]
+	if !ok {
+		return nil, errors.Wrap(os.ErrNotExist, "get blob")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (e *mapEngine) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestBlobCache(t *testing.T) {
+	ctx := context.Background()
+
+	image, cache := newMapEngine(), newMapEngine()
+	engine := WithBlobCache(image, cache)
+
+	// Blobs added to the image are also added to the cache.
+	blobDigest, _, err := engine.PutBlob(ctx, strings.NewReader("some blob"))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if string(cache.blobs[blobDigest]) != "some blob" {
+		t.Errorf("PutBlob: blob was not added to cache")
+	}
+
+	// Blobs missing from the image are copied from the cache.
+	cachedDigest, _, _ := cache.PutBlob(ctx, strings.NewReader("cached blob"))
+	reader, err := engine.GetBlob(ctx, cachedDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "cached blob" {
+		t.Errorf("GetBlob: unexpected contents %q: %+v", data, err)
+	}
+	if string(image.blobs[cachedDigest]) != "cached blob" {
+		t.Errorf("GetBlob: cached blob was not copied into image")
+	}
+
+	// Corrupted cache entries are not used.
+	badDigest := digest.FromString("expected blob")
+	cache.blobs[badDigest] = []byte("corrupted blob")
+	if _, err := engine.GetBlob(ctx, badDigest); err == nil {
+		t.Errorf("GetBlob: expected error for corrupted cached blob")
+	}
+	if _, ok := image.blobs[badDigest]; ok {
+		t.Errorf("GetBlob: corrupted cached blob was copied into image")
+	}
+
+	// Blobs missing from both are reported as not existing.
+	if _, err := engine.GetBlob(ctx, digest.FromString("missing blob")); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("GetBlob: expected not-exist error: got %+v", err)
+	}
+
+	if err := engine.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %+v", err)
+	}
+	if !image.closed || !cache.closed {
+		t.Errorf("Close: image and cache were not both closed")
+	}
+}
+
+func TestBlobCacheReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	image, cache := newMapEngine(), newMapEngine()
+	engine := WithBlobCache(ReadOnly(image), cache)
+
+	cachedDigest, _, _ := cache.PutBlob(ctx, strings.NewReader("cached blob"))
+	reader, err := engine.GetBlob(ctx, cachedDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "cached blob" {
+		t.Errorf("GetBlob: unexpected contents %q: %+v", data, err)
+	}
+	if len(image.blobs) != 0 {
+		t.Errorf("GetBlob: blob was copied into read-only image")
+	}
+
+	badDigest := digest.FromString("expected blob")
+	cache.blobs[badDigest] = []byte("corrupted blob")
+	reader, err = engine.GetBlob(ctx, badDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != ErrDigestMismatch {
+		t.Errorf("GetBlob: expected digest mismatch reading corrupted cached blob: got %+v", err)
+	}
+	reader.Close()
+}
@@ -46,6 +46,10 @@ var (
 	// ErrInvalid is returned when an image was detected as being invalid.
 	ErrInvalid = fmt.Errorf("invalid image detected")
 
+	// ErrDigestMismatch is returned when the contents of a blob do not match
+	// the digest or size of the descriptor it was read with.
+	ErrDigestMismatch = fmt.Errorf("blob does not match its descriptor")
+
 	// ErrNotImplemented is returned when a requested operation has not been
 	// implementing the backing image store.
 	ErrNotImplemented = fmt.Errorf("operation not implemented")
@@ -53,6 +57,15 @@ var (
 	// ErrClobber is returned when a requested operation would require clobbering a
 	// reference or blob which already exists.
 	ErrClobber = fmt.Errorf("operation would clobber existing object")
+
+	// ErrReadOnly is returned when a requested operation would modify an image
+	// which was opened read-only (see ReadOnly).
+	ErrReadOnly = fmt.Errorf("image is read-only")
+
+	// ErrNewerVersion is returned when an image (or a blob within it) uses a
+	// newer version of the image-spec than is supported (see
+	// NewerVersionPolicy).
+	ErrNewerVersion = fmt.Errorf("image uses an unsupported newer version")
 )
 
 // Engine is an interface that provides methods for accessing and modifying an
@@ -18,6 +18,7 @@
 package cas
 
 import (
+	"regexp"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -48,6 +49,37 @@ type Driver interface {
 	Create(uri string) error
 }
 
+// OpenOptions are options which control how an image is opened by
+// OpenWithOptions.
+type OpenOptions struct {
+	// NewerVersions controls how images which use a newer version of the
+	// image-spec than umoci supports are handled.
+	NewerVersions NewerVersionPolicy
+}
+
+// OptionsDriver is an optional interface implemented by Drivers which support
+// OpenOptions. Drivers which don't implement it are opened with Open, and
+// ignore the options.
+type OptionsDriver interface {
+	Driver
+
+	// OpenWithOptions is equivalent to Open, except that the given options
+	// are used.
+	OpenWithOptions(uri string, opt OpenOptions) (Engine, error)
+}
+
+// uriSchemeRegexp matches the scheme of URIs of the form "scheme://...".
+var uriSchemeRegexp = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*)://`)
+
+// URIScheme returns the scheme of the given URI (such as "docker" for
+// "docker://host/repository"), or "" if the URI is a plain path.
+func URIScheme(uri string) string {
+	if match := uriSchemeRegexp.FindStringSubmatch(uri); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
 var (
 	dm      sync.RWMutex
 	drivers []Driver
@@ -79,14 +111,33 @@ func findSupported(uri string) Driver {
 // If more than one driver supports the provided URI, the first of the
 // candidate drivers to have been registered is chosen.
 func Open(uri string) (Engine, error) {
+	return OpenWithOptions(uri, OpenOptions{})
+}
+
+// OpenWithOptions is equivalent to Open, except that the given options are
+// passed to the driver (if it implements OptionsDriver).
+func OpenWithOptions(uri string, opt OpenOptions) (Engine, error) {
 	driver := findSupported(uri)
 	if driver == nil {
 		return nil, errors.Errorf("drivers: unsupported uri: %s", uri)
 	}
 
+	if optionsDriver, ok := driver.(OptionsDriver); ok {
+		return optionsDriver.OpenWithOptions(uri, opt)
+	}
 	return driver.Open(uri)
 }
 
+// OpenReadOnly is equivalent to Open, except that the returned cas.Engine is
+// read-only (see ReadOnly).
+func OpenReadOnly(uri string) (Engine, error) {
+	engine, err := Open(uri)
+	if err != nil {
+		return nil, err
+	}
+	return ReadOnly(engine), nil
+}
+
 // Create creates a new image by one of the registered drivers that support the
 // provided URI (if no such driver exists, an error is returned). If more than
 // one driver supports the provided URI, the first of the candidate drivers to
@@ -24,4 +24,7 @@ package drivers
 import (
 	// Implements directory-backed OCI layouts.
 	_ "github.com/openSUSE/umoci/oci/cas/drivers/dir"
+
+	// Implements read-only tar and zip archives of OCI layouts.
+	_ "github.com/openSUSE/umoci/oci/cas/drivers/archive"
 )
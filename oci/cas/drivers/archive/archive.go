@@ -0,0 +1,348 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package archive implements a read-only cas.Engine for OCI image layouts
+// which have been packed into a single tar or zip archive (such as the
+// archives produced by "docker buildx build -o type=oci"). Archives cannot be
+// modified in-place, so they must be converted to a directory layout (with
+// Copy) before they can be modified. Write does the reverse, packing an
+// image layout into an archive.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ImageLayoutVersion is the version of the image layout we support.
+	ImageLayoutVersion = "1.0.0"
+
+	// blobDirectory is the directory inside an archive where blobs are
+	// stored.
+	blobDirectory = "blobs"
+
+	// indexFile is the file inside an archive which contains the top-level
+	// index.
+	indexFile = "index.json"
+
+	// layoutFile is the file inside an archive which contains the image
+	// layout version.
+	layoutFile = ispec.ImageLayoutFile
+)
+
+// Format is the format of an archive.
+type Format int
+
+const (
+	// FormatTar is an (uncompressed) tar archive.
+	FormatTar Format = iota
+
+	// FormatZip is a zip archive.
+	FormatZip
+)
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatTar:
+		return "tar"
+	case FormatZip:
+		return "zip"
+	}
+	return "unknown"
+}
+
+// ParseFormat returns the format with the given name ("tar" or "zip").
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "tar":
+		return FormatTar, nil
+	case "zip":
+		return FormatZip, nil
+	}
+	return 0, errors.Errorf("unknown archive format: %q", name)
+}
+
+// FormatFromPath returns the format of an archive with the given path, based
+// on its extension. Paths ending in ".zip" are zip archives, and all other
+// paths are tar archives.
+func FormatFromPath(path string) Format {
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		return FormatZip
+	}
+	return FormatTar
+}
+
+// blobPath returns the path of the blob with the given digest inside an
+// archive.
+func blobPath(digest digest.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+	return path.Join(blobDirectory, digest.Algorithm().String(), digest.Hex()), nil
+}
+
+// openFunc opens a file inside an archive.
+type openFunc func() (io.ReadCloser, error)
+
+type archiveEngine struct {
+	closer io.Closer
+
+	// files are the regular files in the archive, indexed by their cleaned
+	// path.
+	files map[string]openFunc
+}
+
+// detectFormat returns the format of the given archive, based on its
+// contents.
+func detectFormat(fh *os.File) (Format, error) {
+	magic := make([]byte, 4)
+	if _, err := fh.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "read magic")
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return FormatZip, nil
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		return 0, errors.Wrap(cas.ErrInvalid, "compressed archives are not supported (decompress the archive first)")
+	}
+	return FormatTar, nil
+}
+
+// cleanName returns the cleaned form of the name of a file in an archive.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// indexTar records the offset of every regular file in the given tar archive,
+// so that they can be read without scanning the archive again.
+func (e *archiveEngine) indexTar(fh *os.File) error {
+	tr := tar.NewReader(fh)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read tar archive")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// tar.Reader doesn't read past the header of an entry until the next
+		// call to Next, so the offset of fh is the start of the contents.
+		offset, err := fh.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return errors.Wrap(err, "get offset of tar entry")
+		}
+		size := hdr.Size
+		e.files[cleanName(hdr.Name)] = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.NewSectionReader(fh, offset, size)), nil
+		}
+	}
+	return nil
+}
+
+// indexZip records every regular file in the given zip archive.
+func (e *archiveEngine) indexZip(zr *zip.Reader) {
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		e.files[cleanName(zf.Name)] = zf.Open
+	}
+}
+
+// validate checks that the archive contains a supported image layout.
+func (e *archiveEngine) validate() error {
+	layoutOpen, ok := e.files[layoutFile]
+	if !ok {
+		return errors.Wrap(cas.ErrInvalid, "archive is missing oci-layout")
+	}
+	layoutReader, err := layoutOpen()
+	if err != nil {
+		return errors.Wrap(err, "open oci-layout")
+	}
+	defer layoutReader.Close()
+
+	var ociLayout ispec.ImageLayout
+	if err := json.NewDecoder(layoutReader).Decode(&ociLayout); err != nil {
+		return errors.Wrap(err, "parse oci-layout")
+	}
+	// Archives are always read-only, so newer versions are only a warning.
+	if err := cas.CheckLayoutVersion(ociLayout.Version, ImageLayoutVersion); err != nil {
+		if errors.Cause(err) != cas.ErrNewerVersion {
+			return errors.Wrap(err, "check oci-layout")
+		}
+		log.Warnf("archive: image uses a newer version than supported: %v", err)
+	}
+
+	if _, ok := e.files[indexFile]; !ok {
+		return errors.Wrap(cas.ErrInvalid, "archive is missing index")
+	}
+	return nil
+}
+
+// Open opens a new reference to the image layout archived at the given path.
+// The format of the archive is detected automatically. The returned engine is
+// read-only (see cas.ReadOnly).
+func Open(path string) (cas.Engine, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open archive")
+	}
+
+	engine, err := open(fh)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return cas.ReadOnly(engine), nil
+}
+
+func open(fh *os.File) (*archiveEngine, error) {
+	format, err := detectFormat(fh)
+	if err != nil {
+		return nil, errors.Wrap(err, "detect archive format")
+	}
+
+	engine := &archiveEngine{
+		closer: fh,
+		files:  map[string]openFunc{},
+	}
+	switch format {
+	case FormatTar:
+		if err := engine.indexTar(fh); err != nil {
+			return nil, err
+		}
+	case FormatZip:
+		fi, err := fh.Stat()
+		if err != nil {
+			return nil, errors.Wrap(err, "stat archive")
+		}
+		zr, err := zip.NewReader(fh, fi.Size())
+		if err != nil {
+			return nil, errors.Wrap(err, "read zip archive")
+		}
+		engine.indexZip(zr)
+	}
+
+	if err := engine.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate")
+	}
+	return engine, nil
+}
+
+// PutBlob is not supported by archives. It is never called, because Open
+// always returns a read-only engine.
+func (e *archiveEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return "", -1, errors.Wrap(cas.ErrReadOnly, "put blob")
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *archiveEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute blob path")
+	}
+	open, ok := e.files[path]
+	if !ok {
+		return nil, errors.Wrap(os.ErrNotExist, "open blob")
+	}
+	reader, err := open()
+	return reader, errors.Wrap(err, "open blob")
+}
+
+// PutIndex is not supported by archives. It is never called, because Open
+// always returns a read-only engine.
+func (e *archiveEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return errors.Wrap(cas.ErrReadOnly, "put index")
+}
+
+// GetIndex returns the index of the OCI image.
+func (e *archiveEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	open, ok := e.files[indexFile]
+	if !ok {
+		return ispec.Index{}, errors.Wrap(cas.ErrInvalid, "read index")
+	}
+	reader, err := open()
+	if err != nil {
+		return ispec.Index{}, errors.Wrap(err, "read index")
+	}
+	defer reader.Close()
+
+	var index ispec.Index
+	if err := json.NewDecoder(reader).Decode(&index); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "parse index")
+	}
+	return index, nil
+}
+
+// DeleteBlob is not supported by archives. It is never called, because Open
+// always returns a read-only engine.
+func (e *archiveEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return errors.Wrap(cas.ErrReadOnly, "delete blob")
+}
+
+// ListBlobs returns the set of blob digests stored in the image, sorted so
+// that the output is deterministic. Files in the blob directory which are not
+// named after a valid digest are ignored.
+func (e *archiveEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	digests := []digest.Digest{}
+	for name := range e.files {
+		dir, hex := path.Split(name)
+		algorithm := path.Base(dir)
+		if path.Dir(path.Clean(dir)) != blobDirectory {
+			continue
+		}
+		blobDigest := digest.NewDigestFromHex(algorithm, hex)
+		if blobDigest.Validate() != nil {
+			continue
+		}
+		digests = append(digests, blobDigest)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+	return digests, nil
+}
+
+// Clean is a no-op, as archives are never modified.
+func (e *archiveEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close releases all references held by the engine.
+func (e *archiveEngine) Close() error {
+	return errors.Wrap(e.closer.Close(), "close archive")
+}
@@ -0,0 +1,231 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// makeImage returns an in-memory image containing the given blobs, with an
+// index referencing the first blob.
+func makeImage(t *testing.T, blobs ...string) cas.Engine {
+	ctx := context.Background()
+	engine := mem.New()
+
+	var digests []digest.Digest
+	for _, blob := range blobs {
+		blobDigest, _, err := engine.PutBlob(ctx, strings.NewReader(blob))
+		if err != nil {
+			t.Fatalf("PutBlob: unexpected error: %+v", err)
+		}
+		digests = append(digests, blobDigest)
+	}
+
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	index.Manifests = []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digests[0],
+		Size:      int64(len(blobs[0])),
+		Annotations: map[string]string{
+			ispec.AnnotationRefName: "latest",
+		},
+	}}
+	index.Annotations = map[string]string{"some": "annotation"}
+	if err := engine.PutIndex(ctx, index); err != nil {
+		t.Fatalf("PutIndex: unexpected error: %+v", err)
+	}
+	return engine
+}
+
+// checkSameImage checks that the two images have identical indexes and blobs.
+func checkSameImage(t *testing.T, expected, got cas.Engine) {
+	ctx := context.Background()
+
+	expectedIndex, err := expected.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	gotIndex, err := got.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(expectedIndex, gotIndex) {
+		t.Errorf("GetIndex: index doesn't match: expected=%#v got=%#v", expectedIndex, gotIndex)
+	}
+
+	expectedDigests, err := expected.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	gotDigests, err := got.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(expectedDigests, gotDigests) {
+		t.Fatalf("ListBlobs: blobs don't match: expected=%v got=%v", expectedDigests, gotDigests)
+	}
+
+	for _, blobDigest := range expectedDigests {
+		reader, err := got.GetBlob(ctx, blobDigest)
+		if err != nil {
+			t.Errorf("GetBlob: unexpected error: %+v", err)
+			continue
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+		}
+		if gotDigest := digest.FromBytes(data); gotDigest != blobDigest {
+			t.Errorf("GetBlob: blob contents don't match: expected=%s got=%s", blobDigest, gotDigest)
+		}
+	}
+}
+
+func TestWriteOpen(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestWriteOpen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := makeImage(t, `{"some": "manifest"}`, "", "some blob", strings.Repeat("large blob", 4096))
+
+	for _, format := range []Format{FormatTar, FormatZip} {
+		path := filepath.Join(root, "image."+format.String())
+		if got := FormatFromPath(path); got != format {
+			t.Errorf("FormatFromPath: expected %v got %v", format, got)
+		}
+
+		var buffer bytes.Buffer
+		if err := Write(ctx, &buffer, image, format); err != nil {
+			t.Fatalf("Write(%v): unexpected error: %+v", format, err)
+		}
+		if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if !Driver.Supported(path) {
+			t.Errorf("Supported(%v): expected archive to be supported", format)
+		}
+
+		engine, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open(%v): unexpected error: %+v", format, err)
+		}
+		if !cas.IsReadOnly(engine) {
+			t.Errorf("Open(%v): expected engine to be read-only", format)
+		}
+		checkSameImage(t, image, engine)
+
+		if _, err := engine.GetBlob(ctx, digest.FromString("missing")); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("GetBlob(%v): expected missing blob to not exist: got %+v", format, err)
+		}
+		if err := engine.PutIndex(ctx, ispec.Index{}); errors.Cause(err) != cas.ErrReadOnly {
+			t.Errorf("PutIndex(%v): expected ErrReadOnly: got %+v", format, err)
+		}
+
+		// Copy the archive back to a writable image.
+		copied := mem.New()
+		if err := Copy(ctx, copied, engine); err != nil {
+			t.Fatalf("Copy(%v): unexpected error: %+v", format, err)
+		}
+		checkSameImage(t, image, copied)
+
+		if err := engine.Close(); err != nil {
+			t.Errorf("Close(%v): unexpected error: %+v", format, err)
+		}
+	}
+
+	if Driver.Supported(root) {
+		t.Errorf("Supported: expected directory to not be supported")
+	}
+	if Driver.Supported(filepath.Join(root, "nonexistent")) {
+		t.Errorf("Supported: expected non-existent path to not be supported")
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestOpenInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// A tar archive which isn't an image layout.
+	var notImage bytes.Buffer
+	tw := tar.NewWriter(&notImage)
+	if err := tw.WriteHeader(&tar.Header{Name: "some-file", Mode: 0644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A compressed archive of a valid image.
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	if err := Write(context.Background(), gzw, makeImage(t, "blob"), FormatTar); err != nil {
+		t.Fatalf("Write: unexpected error: %+v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"NotImage", notImage.Bytes()},
+		{"Compressed", compressed.Bytes()},
+	} {
+		path := filepath.Join(root, test.name)
+		if err := ioutil.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if engine, err := Open(path); errors.Cause(err) != cas.ErrInvalid {
+			if err == nil {
+				engine.Close()
+			}
+			t.Errorf("Open(%s): expected ErrInvalid: got %+v", test.name, err)
+		}
+	}
+}
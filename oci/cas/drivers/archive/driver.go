@@ -0,0 +1,61 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/pkg/errors"
+)
+
+// Driver is an implementation of drivers.Driver for OCI image layouts stored
+// in a tar or zip archive.
+var Driver cas.Driver = archiveDriver{}
+
+type archiveDriver struct{}
+
+// Supported returns whether the resource at the given URI is supported by the
+// driver (used for auto-detection). If two drivers support the same URI, then
+// the earliest registered driver takes precedence.
+//
+// Note that this is _not_ a validation of the URI -- if the URI refers to an
+// invalid or non-existent resource it is expected that the URI is "supported".
+func (d archiveDriver) Supported(uri string) bool {
+	fi, err := os.Stat(uri)
+	if err != nil {
+		// Non-existent paths are handled by the dir driver.
+		return false
+	}
+	return fi.Mode().IsRegular()
+}
+
+// Open "opens" a new CAS engine accessor for the given URI.
+func (d archiveDriver) Open(uri string) (cas.Engine, error) {
+	return Open(uri)
+}
+
+// Create is not supported, as archives are read-only. Archives can be created
+// from an existing image with Write.
+func (d archiveDriver) Create(uri string) error {
+	return errors.Wrap(cas.ErrNotImplemented, "create archive")
+}
+
+func init() {
+	cas.Register(Driver)
+}
@@ -0,0 +1,235 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// fileWriter writes regular files to an archive.
+type fileWriter interface {
+	// WriteFile writes a file with the given name, whose contents (which must
+	// be exactly size bytes long) are read from r.
+	WriteFile(name string, r io.Reader, size int64) error
+
+	// Close finishes writing the archive. It does not close the underlying
+	// writer.
+	Close() error
+}
+
+type tarFileWriter struct {
+	tw      *tar.Writer
+	modTime time.Time
+}
+
+func (w tarFileWriter) WriteFile(name string, r io.Reader, size int64) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  w.modTime,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	n, err := io.Copy(w.tw, r)
+	if err != nil {
+		return errors.Wrap(err, "write contents")
+	}
+	if n != size {
+		return errors.Errorf("size mismatch: expected %d got %d", size, n)
+	}
+	return nil
+}
+
+func (w tarFileWriter) Close() error {
+	return w.tw.Close()
+}
+
+type zipFileWriter struct {
+	zw      *zip.Writer
+	modTime time.Time
+}
+
+func (w zipFileWriter) WriteFile(name string, r io.Reader, size int64) error {
+	// Blobs are stored uncompressed, since layers are usually already
+	// compressed and this allows for blobs to be read without decompression.
+	hdr := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	}
+	hdr.SetModTime(w.modTime)
+	hdr.SetMode(0644)
+
+	fw, err := w.zw.CreateHeader(hdr)
+	if err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	n, err := io.Copy(fw, r)
+	if err != nil {
+		return errors.Wrap(err, "write contents")
+	}
+	if n != size {
+		return errors.Errorf("size mismatch: expected %d got %d", size, n)
+	}
+	return nil
+}
+
+func (w zipFileWriter) Close() error {
+	return w.zw.Close()
+}
+
+// blobSize returns the size of the blob with the given digest.
+func blobSize(ctx context.Context, engine cas.Engine, blobDigest digest.Digest) (int64, error) {
+	reader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return -1, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	if statter, ok := reader.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		if fi, err := statter.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size(), nil
+		}
+	}
+	return io.Copy(ioutil.Discard, reader)
+}
+
+// Write writes an archive of the given format containing every blob and the
+// top-level index of the image to w. Unlike interop.ExportArchive, the whole
+// image layout is archived (including unreachable blobs and every reference),
+// so that Copy can restore it exactly.
+func Write(ctx context.Context, w io.Writer, engine cas.Engine, format Format) error {
+	var fw fileWriter
+	now := time.Now()
+	switch format {
+	case FormatTar:
+		fw = tarFileWriter{tw: tar.NewWriter(w), modTime: now}
+	case FormatZip:
+		fw = zipFileWriter{zw: zip.NewWriter(w), modTime: now}
+	default:
+		return errors.Errorf("unknown archive format: %v", format)
+	}
+
+	layout, err := json.Marshal(ispec.ImageLayout{Version: ImageLayoutVersion})
+	if err != nil {
+		return errors.Wrap(err, "encode oci-layout")
+	}
+	if err := fw.WriteFile(layoutFile, bytes.NewReader(layout), int64(len(layout))); err != nil {
+		return errors.Wrap(err, "write oci-layout")
+	}
+
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	indexBlob, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "encode index")
+	}
+	if err := fw.WriteFile(indexFile, bytes.NewReader(indexBlob), int64(len(indexBlob))); err != nil {
+		return errors.Wrap(err, "write index")
+	}
+
+	digests, err := engine.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list blobs")
+	}
+	for _, blobDigest := range digests {
+		if err := writeBlob(ctx, fw, engine, blobDigest); err != nil {
+			return errors.Wrapf(err, "write blob %s", blobDigest)
+		}
+	}
+	return errors.Wrap(fw.Close(), "close archive")
+}
+
+// writeBlob writes the blob with the given digest to the archive.
+func writeBlob(ctx context.Context, fw fileWriter, engine cas.Engine, blobDigest digest.Digest) error {
+	name, err := blobPath(blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "compute blob path")
+	}
+
+	// Tar archives need the size of the blob before the contents.
+	size, err := blobSize(ctx, engine, blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get blob size")
+	}
+
+	reader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+	return fw.WriteFile(name, reader, size)
+}
+
+// Copy copies every blob and the top-level index of the image src to the image
+// dst, such as to convert an archive (opened with Open) to a directory layout.
+// The digest of every blob is verified, and the index of dst is only replaced
+// once every blob has been copied.
+func Copy(ctx context.Context, dst, src cas.Engine) error {
+	digests, err := src.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list blobs")
+	}
+	for _, blobDigest := range digests {
+		if err := copyBlob(ctx, dst, src, blobDigest); err != nil {
+			return errors.Wrapf(err, "copy blob %s", blobDigest)
+		}
+	}
+
+	index, err := src.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	return errors.Wrap(dst.PutIndex(ctx, index), "put top-level index")
+}
+
+// copyBlob copies the blob with the given digest from src to dst.
+func copyBlob(ctx context.Context, dst, src cas.Engine, blobDigest digest.Digest) error {
+	reader, err := src.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	got, _, err := dst.PutBlob(ctx, reader)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if got != blobDigest {
+		return errors.Wrapf(cas.ErrInvalid, "blob digest mismatch: got %s", got)
+	}
+	return nil
+}
@@ -23,14 +23,17 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/openSUSE/umoci/pkg/telemetry"
 	"github.com/opencontainers/go-digest"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -73,6 +76,35 @@ type dirEngine struct {
 	path     string
 	temp     string
 	tempFile *os.File
+
+	// session is the path to the staging area of the image's session, or ""
+	// if the image has no session in progress. See Begin.
+	session string
+
+	// deleted is the set of blobs deleted during the session.
+	deleted map[digest.Digest]struct{}
+
+	// newer describes why the image uses a newer version of the image-spec
+	// than we support, or is nil if it doesn't.
+	newer error
+
+	// policy is how parts of the image using a newer version of the
+	// image-spec are handled (see cas.NewerVersionPolicy).
+	policy cas.NewerVersionPolicy
+}
+
+// NewerVersionPolicy returns the policy the image was opened with.
+func (e *dirEngine) NewerVersionPolicy() cas.NewerVersionPolicy {
+	return e.policy
+}
+
+// root returns the path that new blobs and the index are written to, which is
+// the staging area if the image has a session in progress.
+func (e *dirEngine) root() string {
+	if e.session != "" {
+		return e.session
+	}
+	return e.path
 }
 
 func (e *dirEngine) ensureTempDir() error {
@@ -90,7 +122,7 @@ func (e *dirEngine) ensureTempDir() error {
 		if err != nil {
 			return errors.Wrap(err, "open tempdir for lock")
 		}
-		if err := unix.Flock(int(e.tempFile.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if err := tryLock(e.tempFile); err != nil {
 			return errors.Wrap(err, "lock tempdir")
 		}
 
@@ -116,8 +148,13 @@ func (e *dirEngine) validate() error {
 
 	// XXX: Currently the meaning of this field is not adequately defined by
 	//      the spec, nor is the "official" value determined by the spec.
-	if ociLayout.Version != ImageLayoutVersion {
-		return errors.Wrap(cas.ErrInvalid, "layout version is not supported")
+	//      Newer versions are still readable, but we might not be able to
+	//      modify them safely.
+	if err := cas.CheckLayoutVersion(ociLayout.Version, ImageLayoutVersion); err != nil {
+		if errors.Cause(err) != cas.ErrNewerVersion {
+			return errors.Wrap(err, "check oci-layout")
+		}
+		e.newer = err
 	}
 
 	// Check that "blobs" and "index.json" exist in the image.
@@ -136,19 +173,41 @@ func (e *dirEngine) validate() error {
 	if fi, err := os.Stat(filepath.Join(e.path, indexFile)); err != nil {
 		if os.IsNotExist(err) {
 			err = cas.ErrInvalid
+			// Layouts created with pre-1.0 versions of the image-spec stored
+			// references in refs/ rather than the index.
+			if _, refsErr := os.Stat(filepath.Join(e.path, legacyRefsDirectory)); refsErr == nil {
+				err = errors.Wrap(err, "pre-1.0 image layout must be migrated")
+			}
 		}
 		return errors.Wrap(err, "check index")
 	} else if fi.IsDir() {
 		return errors.Wrap(cas.ErrInvalid, "index is a directory")
 	}
 
+	if e.newer == nil {
+		content, err := ioutil.ReadFile(filepath.Join(e.path, indexFile))
+		if err != nil {
+			return errors.Wrap(err, "read index")
+		}
+		var index struct {
+			SchemaVersion int `json:"schemaVersion"`
+		}
+		if err := json.Unmarshal(content, &index); err != nil {
+			return errors.Wrap(err, "parse index")
+		}
+		e.newer = cas.CheckSchemaVersion(index.SchemaVersion)
+	}
+
 	return nil
 }
 
 // PutBlob adds a new blob to the image. This is idempotent; a nil error
 // means that "the content is stored at DIGEST" without implying "because
 // of this PutBlob() call".
-func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (_ digest.Digest, _ int64, Err error) {
+	_, span := telemetry.StartSpan(ctx, "cas.put_blob", map[string]string{"path": e.path})
+	defer func() { span.End(Err) }()
+
 	if err := e.ensureTempDir(); err != nil {
 		return "", -1, errors.Wrap(err, "ensure tempdir")
 	}
@@ -164,11 +223,24 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 	tempPath := fh.Name()
 	defer fh.Close()
 
+	// Preallocate the blob if we know how large it will be, so that we fail
+	// early if there isn't enough space.
+	hint := cas.BlobSizeHint(reader)
+	if err := system.Fallocate(fh.Fd(), hint); err != nil {
+		return "", -1, errors.Wrap(err, "preallocate temporary blob")
+	}
+
 	writer := io.MultiWriter(fh, digester.Hash())
 	size, err := io.Copy(writer, reader)
 	if err != nil {
 		return "", -1, errors.Wrap(err, "copy to temporary blob")
 	}
+	// Release any unused preallocated space if the hint was wrong.
+	if size < hint {
+		if err := fh.Truncate(size); err != nil {
+			return "", -1, errors.Wrap(err, "truncate temporary blob")
+		}
+	}
 	fh.Close()
 
 	// Get the digest.
@@ -178,21 +250,42 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 	}
 
 	// Move the blob to its correct path.
-	path = filepath.Join(e.path, path)
+	path = filepath.Join(e.root(), path)
 	if err := os.Rename(tempPath, path); err != nil {
 		return "", -1, errors.Wrap(err, "rename temporary blob")
 	}
 
+	// The blob is no longer deleted if it was deleted earlier in the session.
+	if _, ok := e.deleted[digester.Digest()]; ok {
+		delete(e.deleted, digester.Digest())
+		if err := writeDeleted(e.session, e.deleted); err != nil {
+			return "", -1, errors.Wrap(err, "update session")
+		}
+	}
+
+	telemetry.AddCounter(telemetry.CounterBlobsWritten, 1)
+	telemetry.AddCounter(telemetry.CounterBytesWritten, size)
 	return digester.Digest(), int64(size), nil
 }
 
 // GetBlob returns a reader for retrieving a blob from the image, which the
 // caller must Close(). Returns os.ErrNotExist if the digest is not found.
-func (e *dirEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+func (e *dirEngine) GetBlob(ctx context.Context, digest digest.Digest) (_ io.ReadCloser, Err error) {
+	_, span := telemetry.StartSpan(ctx, "cas.get_blob", map[string]string{"path": e.path, "digest": digest.String()})
+	defer func() { span.End(Err) }()
+
 	path, err := blobPath(digest)
 	if err != nil {
 		return nil, errors.Wrap(err, "compute blob path")
 	}
+	if e.session != "" {
+		if _, ok := e.deleted[digest]; ok {
+			return nil, errors.Wrap(&os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}, "open blob")
+		}
+		if fh, err := os.Open(filepath.Join(e.session, path)); !os.IsNotExist(err) {
+			return fh, errors.Wrap(err, "open staged blob")
+		}
+	}
 	fh, err := os.Open(filepath.Join(e.path, path))
 	return fh, errors.Wrap(err, "open blob")
 }
@@ -201,7 +294,10 @@ func (e *dirEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadC
 // previously existing index. This operation is atomic; any readers attempting
 // to access the OCI image while it is being modified will only ever see the
 // new or old index.
-func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) (Err error) {
+	_, span := telemetry.StartSpan(ctx, "cas.put_index", map[string]string{"path": e.path})
+	defer func() { span.End(Err) }()
+
 	if err := e.ensureTempDir(); err != nil {
 		return errors.Wrap(err, "ensure tempdir")
 	}
@@ -222,13 +318,47 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	fh.Close()
 
 	// Move the blob to its correct path.
-	path := filepath.Join(e.path, indexFile)
+	path := filepath.Join(e.root(), indexFile)
 	if err := os.Rename(tempPath, path); err != nil {
 		return errors.Wrap(err, "rename temporary index")
 	}
 	return nil
 }
 
+// indexLockInterval is how often LockIndex retries taking the lock.
+const indexLockInterval = 10 * time.Millisecond
+
+// LockIndex takes an exclusive flock(2) on the image directory, so that
+// read-modify-write updates of the index are atomic with respect to other
+// engines for the same image (including those in other processes). See
+// cas.IndexLocker.
+func (e *dirEngine) LockIndex(ctx context.Context) (func() error, error) {
+	fh, err := os.Open(e.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open imagedir for lock")
+	}
+	for {
+		err := tryLock(fh)
+		if err == nil {
+			break
+		}
+		if !isLocked(err) {
+			fh.Close()
+			return nil, errors.Wrap(err, "lock index")
+		}
+		select {
+		case <-ctx.Done():
+			fh.Close()
+			return nil, errors.Wrap(ctx.Err(), "lock index")
+		case <-time.After(indexLockInterval):
+		}
+	}
+	return func() error {
+		defer fh.Close()
+		return errors.Wrap(unlock(fh), "unlock index")
+	}, nil
+}
+
 // GetIndex returns the index of the OCI image. Return ErrNotExist if the
 // digest is not found. If the image doesn't have an index, ErrInvalid is
 // returned (a valid OCI image MUST have an image index).
@@ -238,17 +368,21 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 // handling nested indexes. casext.Engine provides a wrapper for cas.Engine
 // that implements various reference resolution functions that should work for
 // most users.
-func (e *dirEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
-	content, err := ioutil.ReadFile(filepath.Join(e.path, indexFile))
+func (e *dirEngine) GetIndex(ctx context.Context) (_ ispec.Index, Err error) {
+	_, span := telemetry.StartSpan(ctx, "cas.get_index", map[string]string{"path": e.path})
+	defer func() { span.End(Err) }()
+
+	fh, err := os.Open(filepath.Join(e.root(), indexFile))
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = cas.ErrInvalid
 		}
 		return ispec.Index{}, errors.Wrap(err, "read index")
 	}
+	defer fh.Close()
 
 	var index ispec.Index
-	if err := json.Unmarshal(content, &index); err != nil {
+	if err := json.NewDecoder(fh).Decode(&index); err != nil {
 		return ispec.Index{}, errors.Wrap(err, "parse index")
 	}
 
@@ -258,12 +392,30 @@ func (e *dirEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
 // DeleteBlob removes a blob from the image. This is idempotent; a nil
 // error means "the content is not in the store" without implying "because
 // of this DeleteBlob() call".
-func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) (Err error) {
+	_, span := telemetry.StartSpan(ctx, "cas.delete_blob", map[string]string{"path": e.path, "digest": digest.String()})
+	defer func() { span.End(Err) }()
+
 	path, err := blobPath(digest)
 	if err != nil {
 		return errors.Wrap(err, "compute blob path")
 	}
 
+	if e.session != "" {
+		// Blobs in the image are only removed when the session is committed.
+		err = os.Remove(filepath.Join(e.session, path))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove staged blob")
+		}
+		if _, err := os.Lstat(filepath.Join(e.path, path)); err == nil {
+			e.deleted[digest] = struct{}{}
+			if err := writeDeleted(e.session, e.deleted); err != nil {
+				return errors.Wrap(err, "update session")
+			}
+		}
+		return nil
+	}
+
 	err = os.Remove(filepath.Join(e.path, path))
 	if err != nil && !os.IsNotExist(err) {
 		return errors.Wrap(err, "remove blob")
@@ -272,31 +424,40 @@ func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error
 }
 
 // ListBlobs returns the set of blob digests stored in the image.
-func (e *dirEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
-	digests := []digest.Digest{}
-	blobDir := filepath.Join(e.path, blobDirectory, cas.BlobAlgorithm.String())
-
-	if err := filepath.Walk(blobDir, func(path string, _ os.FileInfo, _ error) error {
-		// Skip the actual directory.
-		if path == blobDir {
-			return nil
-		}
+func (e *dirEngine) ListBlobs(ctx context.Context) (_ []digest.Digest, Err error) {
+	_, span := telemetry.StartSpan(ctx, "cas.list_blobs", map[string]string{"path": e.path})
+	defer func() { span.End(Err) }()
 
-		// XXX: Do we need to handle multiple-directory-deep cases?
-		digest := digest.NewDigestFromHex(cas.BlobAlgorithm.String(), filepath.Base(path))
-		digests = append(digests, digest)
-		return nil
-	}); err != nil {
-		return nil, errors.Wrap(err, "walk blobdir")
+	digests, err := listBlobs(e.path)
+	if err != nil || e.session == "" {
+		return digests, err
 	}
 
-	return digests, nil
+	staged, err := listBlobs(e.session)
+	if err != nil {
+		return nil, errors.Wrap(err, "list staged blobs")
+	}
+	seen := map[digest.Digest]struct{}{}
+	all := []digest.Digest{}
+	for _, blob := range append(digests, staged...) {
+		if _, ok := seen[blob]; ok {
+			continue
+		}
+		seen[blob] = struct{}{}
+		if _, ok := e.deleted[blob]; !ok {
+			all = append(all, blob)
+		}
+	}
+	return all, nil
 }
 
 // Clean executes a garbage collection of any non-blob garbage in the store
 // (this includes temporary files and directories not reachable from the CAS
 // interface). This MUST NOT remove any blobs or references in the store.
-func (e *dirEngine) Clean(ctx context.Context) error {
+func (e *dirEngine) Clean(ctx context.Context) (Err error) {
+	_, span := telemetry.StartSpan(ctx, "cas.clean", map[string]string{"path": e.path})
+	defer func() { span.End(Err) }()
+
 	// Effectively we are going to remove every directory except the standard
 	// directories, unless they have a lock already.
 	fh, err := os.Open(e.path)
@@ -313,7 +474,7 @@ func (e *dirEngine) Clean(ctx context.Context) error {
 	for _, child := range children {
 		// Skip any children that are expected to exist.
 		switch child.Name() {
-		case blobDirectory, indexFile, layoutFile:
+		case blobDirectory, indexFile, layoutFile, sessionDirectory, backupDirectory:
 			continue
 		}
 
@@ -326,12 +487,12 @@ func (e *dirEngine) Clean(ctx context.Context) error {
 		}
 		defer cfh.Close()
 
-		if err := unix.Flock(int(cfh.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if err := tryLock(cfh); err != nil {
 			// If we fail to get a flock(2) then it's probably already locked,
 			// so we shouldn't touch it.
 			continue
 		}
-		defer unix.Flock(int(cfh.Fd()), unix.LOCK_UN)
+		defer unlock(cfh)
 
 		if err := os.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "remove garbage path")
@@ -345,7 +506,7 @@ func (e *dirEngine) Clean(ctx context.Context) error {
 // fail.
 func (e *dirEngine) Close() error {
 	if e.temp != "" {
-		if err := unix.Flock(int(e.tempFile.Fd()), unix.LOCK_UN); err != nil {
+		if err := unlock(e.tempFile); err != nil {
 			return errors.Wrap(err, "unlock tempdir")
 		}
 		if err := e.tempFile.Close(); err != nil {
@@ -361,18 +522,76 @@ func (e *dirEngine) Close() error {
 // Open opens a new reference to the directory-backed OCI image referenced by
 // the provided path.
 func Open(path string) (cas.Engine, error) {
+	return OpenWithOptions(path, cas.OpenOptions{})
+}
+
+// OpenWithOptions is equivalent to Open, except that the given options are
+// used.
+func OpenWithOptions(path string, opt cas.OpenOptions) (cas.Engine, error) {
 	engine := &dirEngine{
-		path: path,
-		temp: "",
+		path:   path,
+		temp:   "",
+		policy: opt.NewerVersions,
 	}
 
 	if err := engine.validate(); err != nil {
 		return nil, errors.Wrap(err, "validate")
 	}
 
+	if inSession, err := InSession(path); err != nil {
+		return nil, errors.Wrap(err, "check session")
+	} else if inSession {
+		deleted, err := readDeleted(sessionPath(path))
+		if err != nil {
+			return nil, errors.Wrap(err, "open session")
+		}
+		engine.session = sessionPath(path)
+		engine.deleted = map[digest.Digest]struct{}{}
+		for _, blob := range deleted {
+			engine.deleted[blob] = struct{}{}
+		}
+	}
+
+	// Images which cannot be modified (such as images on read-only media) are
+	// opened read-only, so that any attempt to modify them fails with a clear
+	// error rather than when the first temporary file is created.
+	if !writable(path) {
+		log.Debugf("dir: image is not writable, opening read-only: %s", path)
+		return cas.ReadOnly(engine), nil
+	}
+
+	// Images which use a newer version of the image-spec are opened
+	// read-only by default, since we might not preserve the parts we don't
+	// understand.
+	if engine.newer != nil {
+		switch engine.policy {
+		case cas.NewerVersionsForce:
+			log.Warnf("dir: modifying image despite newer version: %v", engine.newer)
+		case cas.NewerVersionsPassThrough:
+			log.Warnf("dir: opening image in pass-through mode: %v", engine.newer)
+			return cas.PassThrough(engine), nil
+		default:
+			log.Warnf("dir: opening image read-only: %v", engine.newer)
+			return cas.ReadOnly(engine), nil
+		}
+	}
 	return engine, nil
 }
 
+// writable returns whether the image at the given path can be modified by the
+// current process.
+func writable(path string) bool {
+	for _, dir := range []string{
+		path,
+		filepath.Join(path, blobDirectory, cas.BlobAlgorithm.String()),
+	} {
+		if !canWrite(dir) {
+			return false
+		}
+	}
+	return true
+}
+
 // Create creates a new OCI image layout at the given path. If the path already
 // exists, os.ErrExist is returned. However, all of the parent components of
 // the path will be created if necessary.
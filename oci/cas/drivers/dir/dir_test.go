@@ -23,9 +23,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/telemetry"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
@@ -159,6 +163,9 @@ func TestEngineBlobReadonly(t *testing.T) {
 		if err != nil {
 			t.Errorf("unexpected error opening ro image: %+v", err)
 		}
+		if !cas.IsReadOnly(newEngine) {
+			t.Errorf("Open: expected ro image to be opened read-only")
+		}
 
 		blobReader, err := newEngine.GetBlob(ctx, digest)
 		if err != nil {
@@ -176,9 +183,8 @@ func TestEngineBlobReadonly(t *testing.T) {
 
 		// Make sure that writing again will FAIL.
 		_, _, err = newEngine.PutBlob(ctx, bytes.NewReader(test.bytes))
-		if err == nil {
-			t.Logf("PutBlob: e.temp = %s", newEngine.(*dirEngine).temp)
-			t.Errorf("PutBlob: expected error on ro image!")
+		if errors.Cause(err) != cas.ErrReadOnly {
+			t.Errorf("PutBlob: expected ErrReadOnly on ro image: got %+v", err)
 		}
 
 		if err := newEngine.Close(); err != nil {
@@ -190,6 +196,133 @@ func TestEngineBlobReadonly(t *testing.T) {
 	}
 }
 
+func TestOpenUnwritable(t *testing.T) {
+	ctx := context.Background()
+
+	if os.Geteuid() == 0 {
+		t.Log("unwritable tests only work without root privileges")
+		t.Skip()
+	}
+
+	root, err := ioutil.TempDir("", "umoci-TestOpenUnwritable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	if err := os.Chmod(image, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(image, 0755)
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	if !cas.IsReadOnly(engine) {
+		t.Errorf("Open: expected unwritable image to be opened read-only")
+	}
+	if _, err := engine.GetIndex(ctx); err != nil {
+		t.Errorf("GetIndex: unexpected error: %+v", err)
+	}
+	if err := engine.PutIndex(ctx, ispec.Index{}); errors.Cause(err) != cas.ErrReadOnly {
+		t.Errorf("PutIndex: expected ErrReadOnly: got %+v", err)
+	}
+}
+
+func TestOpenNewerVersion(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestOpenNewerVersion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, test := range []struct {
+		name   string
+		layout string
+		index  string
+	}{
+		{"LayoutVersion", `{"imageLayoutVersion":"1.1.0"}`, ""},
+		{"SchemaVersion", "", `{"schemaVersion":3,"manifests":[]}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			image := filepath.Join(root, test.name)
+			if err := Create(image); err != nil {
+				t.Fatalf("unexpected error creating image: %+v", err)
+			}
+			if test.layout != "" {
+				if err := ioutil.WriteFile(filepath.Join(image, layoutFile), []byte(test.layout), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.index != "" {
+				if err := ioutil.WriteFile(filepath.Join(image, indexFile), []byte(test.index), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			engine, err := Open(image)
+			if err != nil {
+				t.Fatalf("unexpected error opening image: %+v", err)
+			}
+			defer engine.Close()
+
+			if !cas.IsReadOnly(engine) {
+				t.Errorf("Open: expected newer image to be opened read-only")
+			}
+			if _, err := engine.GetIndex(ctx); err != nil {
+				t.Errorf("GetIndex: unexpected error: %+v", err)
+			}
+			if err := engine.PutIndex(ctx, ispec.Index{}); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("PutIndex: expected ErrReadOnly: got %+v", err)
+			}
+
+			// In pass-through mode the image can be modified, but no blobs
+			// can be deleted.
+			passThroughEngine, err := OpenWithOptions(image, cas.OpenOptions{NewerVersions: cas.NewerVersionsPassThrough})
+			if err != nil {
+				t.Fatalf("unexpected error opening image: %+v", err)
+			}
+			defer passThroughEngine.Close()
+			if cas.IsReadOnly(passThroughEngine) || !cas.IsPassThrough(passThroughEngine) {
+				t.Errorf("Open: expected image to be opened in pass-through mode")
+			}
+			if policy := cas.GetNewerVersionPolicy(passThroughEngine); policy != cas.NewerVersionsPassThrough {
+				t.Errorf("GetNewerVersionPolicy: expected pass-through: got %v", policy)
+			}
+			blob, _, err := passThroughEngine.PutBlob(ctx, bytes.NewBufferString("blob"))
+			if err != nil {
+				t.Errorf("PutBlob: unexpected error: %+v", err)
+			}
+			if err := passThroughEngine.DeleteBlob(ctx, blob); errors.Cause(err) != cas.ErrNewerVersion {
+				t.Errorf("DeleteBlob: expected ErrNewerVersion: got %+v", err)
+			}
+
+			// With NewerVersionsForce the image can be modified.
+			forcedEngine, err := OpenWithOptions(image, cas.OpenOptions{NewerVersions: cas.NewerVersionsForce})
+			if err != nil {
+				t.Fatalf("unexpected error opening image: %+v", err)
+			}
+			defer forcedEngine.Close()
+			if cas.IsReadOnly(forcedEngine) || cas.IsPassThrough(forcedEngine) {
+				t.Errorf("Open: expected forced image to not be restricted")
+			}
+			if err := forcedEngine.DeleteBlob(ctx, blob); err != nil {
+				t.Errorf("DeleteBlob: unexpected error: %+v", err)
+			}
+		})
+	}
+}
+
 // Make sure that openSUSE/umoci#63 doesn't have a regression where we start
 // deleting files and directories that other people are using.
 func TestEngineGCLocking(t *testing.T) {
@@ -265,3 +398,124 @@ func TestEngineGCLocking(t *testing.T) {
 		t.Errorf("expected IsNotExist for temporary dir after GC: %+v", err)
 	}
 }
+
+func TestEnginePutBlobSizeHint(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEnginePutBlobSizeHint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	data := bytes.Repeat([]byte("some blob "), 100000)
+	expectedDigest := cas.BlobAlgorithm.FromBytes(data)
+
+	// The hint must not change the stored blob, even if it is wrong.
+	for _, hint := range []int64{-1, 0, 100, int64(len(data)), 2 * int64(len(data))} {
+		digest, size, err := engine.PutBlob(ctx, cas.WithSizeHint(bytes.NewReader(data), hint))
+		if err != nil {
+			t.Fatalf("PutBlob(hint=%d): unexpected error: %+v", hint, err)
+		}
+		if digest != expectedDigest {
+			t.Errorf("PutBlob(hint=%d): digest doesn't match: expected=%s got=%s", hint, expectedDigest, digest)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("PutBlob(hint=%d): length doesn't match: expected=%d got=%d", hint, len(data), size)
+		}
+
+		path, err := blobPath(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filepath.Join(image, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(data)) {
+			t.Errorf("PutBlob(hint=%d): blob file has the wrong size: expected=%d got=%d", hint, len(data), fi.Size())
+		}
+	}
+}
+
+// testRecorder is a telemetry.Recorder which records the names of spans and
+// the values of counters.
+type testRecorder struct {
+	lock     sync.Mutex
+	spans    []string
+	counters map[string]int64
+}
+
+func (r *testRecorder) StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, func(error, time.Duration)) {
+	return ctx, func(err error, duration time.Duration) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.spans = append(r.spans, name)
+	}
+}
+
+func (r *testRecorder) AddCounter(name string, delta int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.counters[name] += delta
+}
+
+func TestEngineTelemetry(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineTelemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	recorder := &testRecorder{counters: map[string]int64{}}
+	telemetry.SetRecorder(recorder)
+	defer telemetry.SetRecorder(nil)
+
+	digest, _, err := engine.PutBlob(ctx, bytes.NewReader([]byte("some blob")))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	blob, err := engine.GetBlob(ctx, digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting blob: %+v", err)
+	}
+	blob.Close()
+	if err := engine.DeleteBlob(ctx, digest); err != nil {
+		t.Fatalf("unexpected error deleting blob: %+v", err)
+	}
+
+	expected := []string{"cas.put_blob", "cas.get_blob", "cas.delete_blob"}
+	if len(recorder.spans) != len(expected) {
+		t.Fatalf("expected spans %v, got %v", expected, recorder.spans)
+	}
+	for idx, name := range expected {
+		if recorder.spans[idx] != name {
+			t.Errorf("expected spans %v, got %v", expected, recorder.spans)
+		}
+	}
+	if recorder.counters[telemetry.CounterBlobsWritten] != 1 || recorder.counters[telemetry.CounterBytesWritten] != int64(len("some blob")) {
+		t.Errorf("unexpected counters: %v", recorder.counters)
+	}
+}
@@ -40,8 +40,9 @@ func (d dirDriver) Supported(uri string) bool {
 	if err != nil {
 		// If we got an error, we only support it if the error is that the
 		// target doesn't exist -- Create handles creating the necessary
-		// directories.
-		return os.IsNotExist(err)
+		// directories. URIs with a scheme are left to other drivers (such as
+		// plugin transports).
+		return os.IsNotExist(err) && cas.URIScheme(uri) == ""
 	}
 	// dir stands for directory
 	return fi.IsDir()
@@ -52,6 +53,12 @@ func (d dirDriver) Open(uri string) (cas.Engine, error) {
 	return Open(uri)
 }
 
+// OpenWithOptions is equivalent to Open, except that the given options are
+// used.
+func (d dirDriver) OpenWithOptions(uri string, opt cas.OpenOptions) (cas.Engine, error) {
+	return OpenWithOptions(uri, opt)
+}
+
 // Create creates a new image at the provided URI.
 func (d dirDriver) Create(uri string) error {
 	return Create(uri)
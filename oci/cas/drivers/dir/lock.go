@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLock takes an exclusive flock(2) on the given file without blocking. If
+// the file is already locked, an error satisfying isLocked is returned.
+func tryLock(fh *os.File) error {
+	return unix.Flock(int(fh.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
+
+// isLocked returns whether the given error (returned by tryLock) means that
+// the file is already locked.
+func isLocked(err error) bool {
+	return err == unix.EWOULDBLOCK
+}
+
+// unlock releases a lock taken by tryLock.
+func unlock(fh *os.File) error {
+	return unix.Flock(int(fh.Fd()), unix.LOCK_UN)
+}
+
+// canWrite returns whether the current process can modify the given
+// directory.
+func canWrite(dir string) bool {
+	return unix.Access(dir, unix.W_OK) == nil
+}
@@ -0,0 +1,46 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import "os"
+
+// Windows has no advisory locks for directories, so locking always succeeds.
+// This means that garbage collection and index updates are not protected
+// against other umoci processes using the same image at the same time.
+
+// tryLock does nothing.
+func tryLock(fh *os.File) error {
+	return nil
+}
+
+// isLocked always returns false, as tryLock never fails.
+func isLocked(err error) bool {
+	return false
+}
+
+// unlock does nothing.
+func unlock(fh *os.File) error {
+	return nil
+}
+
+// canWrite returns whether the given directory is not read-only. Windows
+// has no access(2), so only the read-only attribute is checked.
+func canWrite(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.Mode().Perm()&0200 != 0
+}
@@ -0,0 +1,599 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/rawjson"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// legacyRefsDirectory is the directory inside an image layout created with
+	// a pre-1.0 version of the image-spec that contains a descriptor file for
+	// each reference. It was replaced by the index.
+	legacyRefsDirectory = "refs"
+
+	// backupDirectory is the directory inside an OCI image that contains the
+	// backup made by Migrate, which is used by RollbackMigration.
+	backupDirectory = ".umoci-migrate-backup"
+
+	// addedFile is the file inside the backup that contains the set of blobs
+	// added by the migration.
+	addedFile = "added.json"
+)
+
+// legacyMediaTypes maps the media types used by pre-1.0 versions of the
+// image-spec to their current equivalents.
+var legacyMediaTypes = map[string]string{
+	"application/vnd.oci.image.manifest.list.v1+json":                   ispec.MediaTypeImageIndex,
+	"application/vnd.oci.image.serialization.config.v1+json":            ispec.MediaTypeImageConfig,
+	"application/vnd.oci.image.serialization.rootfs.tar.gzip":           ispec.MediaTypeImageLayerGzip,
+	"application/vnd.oci.image.layer.tar":                               ispec.MediaTypeImageLayer,
+	"application/vnd.oci.image.layer.tar+gzip":                          ispec.MediaTypeImageLayerGzip,
+	"application/vnd.oci.image.layer.nondistributable.tar":              ispec.MediaTypeImageLayerNonDistributable,
+	"application/vnd.oci.image.layer.nondistributable.tar+gzip":         ispec.MediaTypeImageLayerNonDistributableGzip,
+	"application/vnd.oci.image.serialization.nondistributable.tar.gzip": ispec.MediaTypeImageLayerNonDistributableGzip,
+}
+
+// ErrNoBackup is returned by RollbackMigration and DiscardMigrationBackup if
+// the image has no migration backup.
+var ErrNoBackup = errors.New("image has no migration backup")
+
+// ErrBackupExists is returned by Migrate if the image already has a migration
+// backup (from a previous migration which was neither rolled back nor
+// discarded).
+var ErrBackupExists = errors.New("image already has a migration backup")
+
+// backupPath returns the path to the migration backup of the given image.
+func backupPath(path string) string {
+	return filepath.Join(path, backupDirectory)
+}
+
+// HasMigrationBackup returns whether the image at the given path has a backup
+// made by Migrate.
+func HasMigrationBackup(path string) (bool, error) {
+	fi, err := os.Stat(backupPath(path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "stat backup")
+	}
+	if !fi.IsDir() {
+		return false, errors.Wrap(cas.ErrInvalid, "migration backup is not a directory")
+	}
+	return true, nil
+}
+
+// migration is a plan for migrating an image layout to the current format.
+type migration struct {
+	// path is the path to the image.
+	path string
+
+	// index is the index of the migrated image.
+	index ispec.Index
+
+	// changed is whether the image needs to be migrated.
+	changed bool
+
+	// blobs are the new blobs of the migrated image.
+	blobs map[digest.Digest][]byte
+
+	// converted maps the digests of the manifests and indexes of the image to
+	// their migrated descriptors, so that each is only migrated once.
+	converted map[digest.Digest]ispec.Descriptor
+}
+
+// readBlob returns the contents of the blob with the given digest, which can
+// be a new blob of the migration.
+func (m *migration) readBlob(blobDigest digest.Digest) ([]byte, error) {
+	if data, ok := m.blobs[blobDigest]; ok {
+		return data, nil
+	}
+	blobPath, err := blobPath(blobDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute blob path")
+	}
+	return ioutil.ReadFile(filepath.Join(m.path, blobPath))
+}
+
+// putBlob adds a new blob to the migrated image, returning its digest and size.
+func (m *migration) putBlob(data []byte) (digest.Digest, int64) {
+	blobDigest := cas.BlobAlgorithm.FromBytes(data)
+	m.blobs[blobDigest] = data
+	return blobDigest, int64(len(data))
+}
+
+// migrateMediaTypeField replaces a legacy media type in the top-level
+// "mediaType" field of the given manifest or index (which old versions of the
+// image-spec required), returning the data unmodified if it doesn't need to be
+// migrated.
+func migrateMediaTypeField(data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Wrap(err, "parse blob")
+	}
+	var mediaType string
+	if err := json.Unmarshal(fields["mediaType"], &mediaType); err != nil {
+		return data, nil
+	}
+	newMediaType, ok := legacyMediaTypes[mediaType]
+	if !ok {
+		return data, nil
+	}
+	fields["mediaType"], _ = json.Marshal(newMediaType)
+	return json.Marshal(fields)
+}
+
+// descriptor returns the migrated version of the given descriptor, migrating
+// the blob it refers to (and its children) if it is a manifest or index.
+func (m *migration) descriptor(descriptor ispec.Descriptor) (ispec.Descriptor, error) {
+	if newMediaType, ok := legacyMediaTypes[descriptor.MediaType]; ok {
+		descriptor.MediaType = newMediaType
+		m.changed = true
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest && descriptor.MediaType != ispec.MediaTypeImageIndex {
+		return descriptor, nil
+	}
+	if converted, ok := m.converted[descriptor.Digest]; ok {
+		descriptor.Digest = converted.Digest
+		descriptor.Size = converted.Size
+		return descriptor, nil
+	}
+
+	old, err := m.readBlob(descriptor.Digest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "read blob %s", descriptor.Digest)
+	}
+	fixed, err := migrateMediaTypeField(old)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "migrate blob %s", descriptor.Digest)
+	}
+	changed := string(fixed) != string(old)
+
+	// Migrate the children of the blob.
+	var value interface{}
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest:
+		var manifest ispec.Manifest
+		if err := json.Unmarshal(fixed, &manifest); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "parse manifest %s", descriptor.Digest)
+		}
+		children := append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)
+		for idx, child := range children {
+			newChild, err := m.descriptor(child)
+			if err != nil {
+				return ispec.Descriptor{}, err
+			}
+			changed = changed || newChild.MediaType != child.MediaType
+			children[idx] = newChild
+		}
+		manifest.Config = children[0]
+		manifest.Layers = children[1:]
+		value = manifest
+	case ispec.MediaTypeImageIndex:
+		var index ispec.Index
+		if err := json.Unmarshal(fixed, &index); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "parse index %s", descriptor.Digest)
+		}
+		for idx, child := range index.Manifests {
+			newChild, err := m.descriptor(child)
+			if err != nil {
+				return ispec.Descriptor{}, err
+			}
+			changed = changed || newChild.MediaType != child.MediaType || newChild.Digest != child.Digest
+			index.Manifests[idx] = newChild
+		}
+		value = index
+	}
+
+	converted := descriptor
+	if changed {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "marshal migrated blob %s", descriptor.Digest)
+		}
+		data, err = rawjson.Preserve(fixed, data, value)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "marshal migrated blob %s", descriptor.Digest)
+		}
+		converted.Digest, converted.Size = m.putBlob(data)
+		log.Debugf("migrate: rewrote blob %s as %s", descriptor.Digest, converted.Digest)
+		m.changed = true
+	}
+	m.converted[descriptor.Digest] = converted
+	return converted, nil
+}
+
+// readLegacyRefs returns the descriptors in the refs directory of a pre-1.0
+// image layout, keyed by reference name.
+func readLegacyRefs(path string) (map[string]ispec.Descriptor, error) {
+	refs := map[string]ispec.Descriptor{}
+	refsDir := filepath.Join(path, legacyRefsDirectory)
+	if err := filepath.Walk(refsDir, func(refPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && refPath == refsDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(refsDir, refPath)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(refPath)
+		if err != nil {
+			return err
+		}
+		var descriptor ispec.Descriptor
+		if err := json.Unmarshal(content, &descriptor); err != nil {
+			return errors.Wrapf(err, "parse ref %s", name)
+		}
+		refs[filepath.ToSlash(name)] = descriptor
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "walk refs")
+	}
+	return refs, nil
+}
+
+// planMigration computes the migration of the image at the given path,
+// without modifying the image.
+func planMigration(path string) (*migration, error) {
+	m := &migration{
+		path:      path,
+		blobs:     map[digest.Digest][]byte{},
+		converted: map[digest.Digest]ispec.Descriptor{},
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(path, layoutFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = cas.ErrInvalid
+		}
+		return nil, errors.Wrap(err, "read oci-layout")
+	}
+	var ociLayout ispec.ImageLayout
+	if err := json.Unmarshal(content, &ociLayout); err != nil {
+		return nil, errors.Wrap(err, "parse oci-layout")
+	}
+	// We cannot migrate images made by newer tools. Other versions (even
+	// invalid ones) are replaced.
+	if err := cas.CheckLayoutVersion(ociLayout.Version, ImageLayoutVersion); errors.Cause(err) == cas.ErrNewerVersion {
+		return nil, err
+	} else if err != nil {
+		m.changed = true
+	}
+
+	m.index = ispec.Index{Versioned: imeta.Versioned{SchemaVersion: 2}}
+	content, err = ioutil.ReadFile(filepath.Join(path, indexFile))
+	switch {
+	case os.IsNotExist(err):
+		m.changed = true
+	case err != nil:
+		return nil, errors.Wrap(err, "read index")
+	default:
+		if err := json.Unmarshal(content, &m.index); err != nil {
+			return nil, errors.Wrap(err, "parse index")
+		}
+	}
+
+	// Add the legacy references to the index, unless the index already has a
+	// reference with the same name.
+	refs, err := readLegacyRefs(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.changed = true
+		exists := false
+		for _, descriptor := range m.index.Manifests {
+			if descriptor.Annotations[ispec.AnnotationRefName] == name {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			log.Warnf("migrate: ignoring ref %s which is already in the index", name)
+			continue
+		}
+		descriptor := refs[name]
+		if descriptor.Annotations == nil {
+			descriptor.Annotations = map[string]string{}
+		}
+		descriptor.Annotations[ispec.AnnotationRefName] = name
+		m.index.Manifests = append(m.index.Manifests, descriptor)
+	}
+
+	for idx, descriptor := range m.index.Manifests {
+		newDescriptor, err := m.descriptor(descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "migrate %s", descriptor.Annotations[ispec.AnnotationRefName])
+		}
+		m.index.Manifests[idx] = newDescriptor
+	}
+	return m, nil
+}
+
+// NeedsMigration returns whether the image at the given path was created with
+// a pre-1.0 version of the image-spec (with a refs directory rather than an
+// index, or using legacy media types) and thus needs to be migrated with
+// Migrate before it can be used.
+func NeedsMigration(path string) (bool, error) {
+	m, err := planMigration(path)
+	if err != nil {
+		return false, err
+	}
+	return m.changed, nil
+}
+
+// writeFile atomically replaces the file at the given path with the given
+// contents.
+func writeFile(path string, content []byte) error {
+	fh, err := ioutil.TempFile(filepath.Dir(path), "tmp-"+filepath.Base(path)+"-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+	if _, err := fh.Write(content); err != nil {
+		return errors.Wrap(err, "write temporary file")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close temporary file")
+	}
+	if err := os.Chmod(fh.Name(), 0644); err != nil {
+		return errors.Wrap(err, "chmod temporary file")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), path), "rename temporary file")
+}
+
+// copyTree copies the regular files and directories under src to dst.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+		case fi.Mode().IsRegular():
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(target, content, fi.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// backup creates the migration backup of the image at the given path, which
+// contains copies of every file that Migrate modifies (blobs are never
+// modified) as well as the set of blobs that Migrate adds.
+func backup(path string, added []digest.Digest) error {
+	// Create the backup in a temporary directory and then move it into place,
+	// so that we never have a half-created backup.
+	staging, err := ioutil.TempDir(path, "tmp-migrate-")
+	if err != nil {
+		return errors.Wrap(err, "create backup")
+	}
+	defer os.RemoveAll(staging)
+
+	for _, name := range []string{layoutFile, indexFile, legacyRefsDirectory} {
+		if _, err := os.Lstat(filepath.Join(path, name)); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyTree(filepath.Join(path, name), filepath.Join(staging, name)); err != nil {
+			return errors.Wrapf(err, "back up %s", name)
+		}
+	}
+	content, err := json.Marshal(added)
+	if err != nil {
+		return errors.Wrap(err, "marshal added blobs")
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, addedFile), content, 0644); err != nil {
+		return errors.Wrap(err, "write added blobs")
+	}
+
+	if err := os.Rename(staging, backupPath(path)); err != nil {
+		if os.IsExist(err) || errors.Cause(err) == os.ErrExist {
+			return ErrBackupExists
+		}
+		return errors.Wrap(err, "rename backup")
+	}
+	return nil
+}
+
+// Migrate upgrades the image at the given path, which was created with a
+// pre-1.0 version of the image-spec, to the current image layout format. The
+// references in the refs directory are moved to the index, legacy media types
+// are replaced with their current equivalents (rewriting any manifests and
+// indexes which refer to them) and the oci-layout file is updated. Fields of
+// the rewritten blobs which umoci doesn't know about are preserved, and no
+// blobs are removed (so the old blobs can be removed by garbage collection).
+//
+// Before the image is modified a backup is made, which can be used to restore
+// the image with RollbackMigration (or removed with DiscardMigrationBackup).
+// If Migrate fails, the image is rolled back automatically. Migrate returns
+// whether the image needed to be migrated, and does nothing if it didn't.
+func Migrate(path string) (bool, error) {
+	if hasBackup, err := HasMigrationBackup(path); err != nil {
+		return false, err
+	} else if hasBackup {
+		return false, ErrBackupExists
+	}
+
+	m, err := planMigration(path)
+	if err != nil {
+		return false, errors.Wrap(err, "plan migration")
+	}
+	if !m.changed {
+		return false, nil
+	}
+
+	// Only blobs which don't already exist are recorded as added, so that
+	// rolling back never removes a blob which was part of the image.
+	var added []digest.Digest
+	for blob := range m.blobs {
+		blobPath, err := blobPath(blob)
+		if err != nil {
+			return false, errors.Wrap(err, "compute blob path")
+		}
+		if _, err := os.Lstat(filepath.Join(path, blobPath)); os.IsNotExist(err) {
+			added = append(added, blob)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+
+	if err := backup(path, added); err != nil {
+		return false, errors.Wrap(err, "back up image")
+	}
+	if err := m.apply(added); err != nil {
+		if rollbackErr := RollbackMigration(path); rollbackErr != nil {
+			log.Warnf("migrate: failed to roll back migration: %v", rollbackErr)
+		}
+		return false, errors.Wrap(err, "migrate image")
+	}
+	return true, nil
+}
+
+// apply modifies the image according to the migration plan, adding the given
+// new blobs.
+func (m *migration) apply(added []digest.Digest) error {
+	if err := os.MkdirAll(filepath.Join(m.path, blobDirectory, cas.BlobAlgorithm.String()), 0755); err != nil {
+		return errors.Wrap(err, "mkdir blobdir")
+	}
+	for _, blob := range added {
+		blobPath, err := blobPath(blob)
+		if err != nil {
+			return errors.Wrap(err, "compute blob path")
+		}
+		if err := writeFile(filepath.Join(m.path, blobPath), m.blobs[blob]); err != nil {
+			return errors.Wrapf(err, "write blob %s", blob)
+		}
+	}
+
+	content, err := json.Marshal(m.index)
+	if err != nil {
+		return errors.Wrap(err, "marshal index")
+	}
+	if err := writeFile(filepath.Join(m.path, indexFile), content); err != nil {
+		return errors.Wrap(err, "write index")
+	}
+	content, err = json.Marshal(ispec.ImageLayout{Version: ImageLayoutVersion})
+	if err != nil {
+		return errors.Wrap(err, "marshal oci-layout")
+	}
+	if err := writeFile(filepath.Join(m.path, layoutFile), content); err != nil {
+		return errors.Wrap(err, "write oci-layout")
+	}
+	return errors.Wrap(os.RemoveAll(filepath.Join(m.path, legacyRefsDirectory)), "remove refs")
+}
+
+// RollbackMigration restores the image at the given path to the state it was
+// in before Migrate, using the backup made by Migrate. The blobs added by the
+// migration are removed, and the backup is removed once the image has been
+// restored. If RollbackMigration fails part-way through, it can be safely
+// called again.
+func RollbackMigration(path string) error {
+	if hasBackup, err := HasMigrationBackup(path); err != nil {
+		return err
+	} else if !hasBackup {
+		return ErrNoBackup
+	}
+	backup := backupPath(path)
+
+	for _, name := range []string{layoutFile, indexFile} {
+		content, err := ioutil.ReadFile(filepath.Join(backup, name))
+		if os.IsNotExist(err) {
+			if err := os.Remove(filepath.Join(path, name)); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "remove %s", name)
+			}
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "read backup %s", name)
+		}
+		if err := writeFile(filepath.Join(path, name), content); err != nil {
+			return errors.Wrapf(err, "restore %s", name)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(backup, legacyRefsDirectory)); err == nil {
+		if err := os.RemoveAll(filepath.Join(path, legacyRefsDirectory)); err != nil {
+			return errors.Wrap(err, "remove refs")
+		}
+		if err := copyTree(filepath.Join(backup, legacyRefsDirectory), filepath.Join(path, legacyRefsDirectory)); err != nil {
+			return errors.Wrap(err, "restore refs")
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(backup, addedFile))
+	if err != nil {
+		return errors.Wrap(err, "read added blobs")
+	}
+	var added []digest.Digest
+	if err := json.Unmarshal(content, &added); err != nil {
+		return errors.Wrap(err, "parse added blobs")
+	}
+	for _, blob := range added {
+		blobPath, err := blobPath(blob)
+		if err != nil {
+			return errors.Wrap(err, "compute blob path")
+		}
+		if err := os.Remove(filepath.Join(path, blobPath)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove blob %s", blob)
+		}
+	}
+	return DiscardMigrationBackup(path)
+}
+
+// DiscardMigrationBackup removes the backup made by Migrate from the image at
+// the given path, after which the migration can no longer be rolled back.
+func DiscardMigrationBackup(path string) error {
+	if hasBackup, err := HasMigrationBackup(path); err != nil {
+		return err
+	} else if !hasBackup {
+		return ErrNoBackup
+	}
+	return errors.Wrap(os.RemoveAll(backupPath(path)), "remove backup")
+}
@@ -0,0 +1,239 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// putLegacyBlob writes a blob to the legacy image at the given path, returning
+// its digest and size.
+func putLegacyBlob(t *testing.T, image string, data []byte) (digest.Digest, int64) {
+	blobDigest := cas.BlobAlgorithm.FromBytes(data)
+	blobPath, err := blobPath(blobDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, blobPath), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return blobDigest, int64(len(data))
+}
+
+// setupLegacy creates an image layout in the format used by pre-1.0 versions
+// of the image-spec, with a single reference (in the refs directory) to a
+// manifest using legacy media types.
+func setupLegacy(t *testing.T, root string) string {
+	image := filepath.Join(root, "image")
+	if err := os.MkdirAll(filepath.Join(image, blobDirectory, cas.BlobAlgorithm.String()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(image, legacyRefsDirectory), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, layoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layerDigest, layerSize := putLegacyBlob(t, image, []byte("layer"))
+	configDigest, configSize := putLegacyBlob(t, image, []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`))
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.serialization.config.v1+json",
+			"digest":    configDigest,
+			"size":      configSize,
+		},
+		"layers": []interface{}{map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.layer.tar+gzip",
+			"digest":    layerDigest,
+			"size":      layerSize,
+		}},
+		"org.opensuse.test": "unknown",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize := putLegacyBlob(t, image, manifest)
+
+	ref, err := json.Marshal(ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, legacyRefsDirectory, "latest"), ref, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// readTree returns the contents of every file under the given path, keyed by
+// their relative paths.
+func readTree(t *testing.T, root string) map[string]string {
+	files := map[string]string{}
+	if err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		files[rel] = string(content)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestMigrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := setupLegacy(t, root)
+	before := readTree(t, image)
+
+	if _, err := Open(image); err == nil {
+		t.Errorf("expected an error opening legacy image")
+	}
+	if needed, err := NeedsMigration(image); err != nil {
+		t.Fatalf("unexpected error checking migration: %+v", err)
+	} else if !needed {
+		t.Errorf("NeedsMigration: expected legacy image to need migration")
+	}
+	if err := RollbackMigration(image); errors.Cause(err) != ErrNoBackup {
+		t.Errorf("expected ErrNoBackup rolling back without migration: got %+v", err)
+	}
+
+	if migrated, err := Migrate(image); err != nil {
+		t.Fatalf("unexpected error migrating: %+v", err)
+	} else if !migrated {
+		t.Errorf("Migrate: expected legacy image to be migrated")
+	}
+	if _, err := Migrate(image); errors.Cause(err) != ErrBackupExists {
+		t.Errorf("expected ErrBackupExists migrating with backup: got %+v", err)
+	}
+	if needed, err := NeedsMigration(image); err != nil {
+		t.Fatalf("unexpected error checking migration: %+v", err)
+	} else if needed {
+		t.Errorf("NeedsMigration: expected migrated image to not need migration")
+	}
+	if _, err := os.Lstat(filepath.Join(image, legacyRefsDirectory)); !os.IsNotExist(err) {
+		t.Errorf("expected refs to be removed: %v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening migrated image: %+v", err)
+	}
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Annotations[ispec.AnnotationRefName] != "latest" {
+		t.Fatalf("unexpected migrated index: %+v", index)
+	}
+	reader, err := engine.GetBlob(ctx, index.Manifests[0].Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	var manifest map[string]interface{}
+	err = json.NewDecoder(reader).Decode(&manifest)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType := manifest["config"].(map[string]interface{})["mediaType"]; mediaType != ispec.MediaTypeImageConfig {
+		t.Errorf("config media type not migrated: %v", mediaType)
+	}
+	if mediaType := manifest["layers"].([]interface{})[0].(map[string]interface{})["mediaType"]; mediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("layer media type not migrated: %v", mediaType)
+	}
+	if manifest["org.opensuse.test"] != "unknown" {
+		t.Errorf("unknown manifest field not preserved: %v", manifest)
+	}
+	// The migration backup must survive cleaning the image.
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("unexpected error cleaning image: %+v", err)
+	}
+	engine.Close()
+
+	if err := RollbackMigration(image); err != nil {
+		t.Fatalf("unexpected error rolling back: %+v", err)
+	}
+	if after := readTree(t, image); !reflect.DeepEqual(before, after) {
+		t.Errorf("rollback didn't restore the image: expected %v, got %v", before, after)
+	}
+
+	// Once the backup is discarded, the migration cannot be rolled back.
+	if _, err := Migrate(image); err != nil {
+		t.Fatalf("unexpected error migrating: %+v", err)
+	}
+	if err := DiscardMigrationBackup(image); err != nil {
+		t.Fatalf("unexpected error discarding backup: %+v", err)
+	}
+	if err := RollbackMigration(image); errors.Cause(err) != ErrNoBackup {
+		t.Errorf("expected ErrNoBackup rolling back discarded migration: got %+v", err)
+	}
+	if migrated, err := Migrate(image); err != nil {
+		t.Fatalf("unexpected error migrating: %+v", err)
+	} else if migrated {
+		t.Errorf("Migrate: expected migrated image to not be migrated again")
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestMigrateNewerVersion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := setupLegacy(t, root)
+	if err := ioutil.WriteFile(filepath.Join(image, layoutFile), []byte(`{"imageLayoutVersion":"2.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(image); errors.Cause(err) != cas.ErrNewerVersion {
+		t.Errorf("expected ErrNewerVersion migrating newer image: got %+v", err)
+	}
+	if hasBackup, err := HasMigrationBackup(image); err != nil || hasBackup {
+		t.Errorf("expected no backup after failed migration: %v %v", hasBackup, err)
+	}
+}
@@ -0,0 +1,253 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sessionDirectory is the directory inside an OCI image that contains the
+	// staging area of the current session. While it exists, every engine
+	// opened for the image writes new blobs and the index to the staging
+	// area rather than the image itself.
+	sessionDirectory = ".umoci-session"
+
+	// deletedFile is the file inside the staging area that contains the set
+	// of blobs deleted during the session.
+	deletedFile = "deleted.json"
+)
+
+// ErrNoSession is returned by Commit and Rollback if the image has no session.
+var ErrNoSession = errors.New("image has no session in progress")
+
+// ErrSessionExists is returned by Begin if the image already has a session.
+var ErrSessionExists = errors.New("image already has a session in progress")
+
+// sessionPath returns the path to the staging area of the given image.
+func sessionPath(path string) string {
+	return filepath.Join(path, sessionDirectory)
+}
+
+// InSession returns whether the image at the given path has a session in
+// progress.
+func InSession(path string) (bool, error) {
+	fi, err := os.Stat(sessionPath(path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "stat session")
+	}
+	if !fi.IsDir() {
+		return false, errors.Wrap(cas.ErrInvalid, "session is not a directory")
+	}
+	return true, nil
+}
+
+// Begin starts a new session for the image at the given path. Until the
+// session is committed with Commit (or discarded with Rollback), all
+// modifications made to the image through this package are staged rather
+// than being applied to the image. Other users of the image (which don't use
+// this package) will not see any of the staged modifications.
+func Begin(path string) error {
+	engine, err := Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open image")
+	}
+	defer engine.Close()
+
+	if inSession, err := InSession(path); err != nil {
+		return err
+	} else if inSession {
+		return ErrSessionExists
+	}
+
+	// Create the staging area in a temporary directory and then move it into
+	// place, so that we never have a half-created session.
+	staging, err := ioutil.TempDir(path, "tmp-session-")
+	if err != nil {
+		return errors.Wrap(err, "create staging area")
+	}
+	defer os.RemoveAll(staging)
+
+	if err := os.MkdirAll(filepath.Join(staging, blobDirectory, cas.BlobAlgorithm.String()), 0755); err != nil {
+		return errors.Wrap(err, "mkdir staging blobdir")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(path, indexFile))
+	if err != nil {
+		return errors.Wrap(err, "read index")
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, indexFile), content, 0644); err != nil {
+		return errors.Wrap(err, "write staging index")
+	}
+
+	if err := os.Rename(staging, sessionPath(path)); err != nil {
+		if os.IsExist(err) || errors.Cause(err) == os.ErrExist {
+			return ErrSessionExists
+		}
+		return errors.Wrap(err, "rename staging area")
+	}
+	return nil
+}
+
+// Commit applies all of the modifications staged in the current session of
+// the image at the given path. New blobs are added to the image first, then
+// the staged index atomically replaces the image index, and finally any blobs
+// deleted during the session are removed. Other users of the image will only
+// ever see the old or new index. If Commit fails part-way through, it can be
+// safely called again to finish committing the session.
+func Commit(path string) error {
+	if inSession, err := InSession(path); err != nil {
+		return err
+	} else if !inSession {
+		return ErrNoSession
+	}
+	session := sessionPath(path)
+
+	deleted, err := readDeleted(session)
+	if err != nil {
+		return err
+	}
+
+	// Add the new blobs to the image. Because blobs are content-addressable,
+	// this doesn't change anything visible to other users of the image.
+	staged, err := listBlobs(session)
+	if err != nil {
+		return errors.Wrap(err, "list staged blobs")
+	}
+	for _, blob := range staged {
+		blobPath, err := blobPath(blob)
+		if err != nil {
+			return errors.Wrap(err, "compute blob path")
+		}
+		if err := os.Rename(filepath.Join(session, blobPath), filepath.Join(path, blobPath)); err != nil {
+			return errors.Wrapf(err, "commit blob %s", blob)
+		}
+	}
+
+	// Atomically switch to the new index. If the staged index doesn't exist,
+	// then we have already switched to it in a previous Commit.
+	err = os.Rename(filepath.Join(session, indexFile), filepath.Join(path, indexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "commit index")
+	}
+
+	for _, blob := range deleted {
+		blobPath, err := blobPath(blob)
+		if err != nil {
+			return errors.Wrap(err, "compute blob path")
+		}
+		if err := os.Remove(filepath.Join(path, blobPath)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "delete blob %s", blob)
+		}
+	}
+
+	log.Debugf("committed session: %d new blobs, %d deleted blobs", len(staged), len(deleted))
+	return errors.Wrap(os.RemoveAll(session), "remove staging area")
+}
+
+// Rollback discards all of the modifications staged in the current session of
+// the image at the given path, leaving the image as it was when the session
+// began.
+func Rollback(path string) error {
+	if inSession, err := InSession(path); err != nil {
+		return err
+	} else if !inSession {
+		return ErrNoSession
+	}
+	return errors.Wrap(os.RemoveAll(sessionPath(path)), "remove staging area")
+}
+
+// listBlobs returns the set of blob digests stored in the given image (or
+// staging area).
+func listBlobs(path string) ([]digest.Digest, error) {
+	digests := []digest.Digest{}
+	blobDir := filepath.Join(path, blobDirectory, cas.BlobAlgorithm.String())
+
+	if err := filepath.Walk(blobDir, func(path string, _ os.FileInfo, _ error) error {
+		// Skip the actual directory.
+		if path == blobDir {
+			return nil
+		}
+
+		// XXX: Do we need to handle multiple-directory-deep cases?
+		digest := digest.NewDigestFromHex(cas.BlobAlgorithm.String(), filepath.Base(path))
+		digests = append(digests, digest)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "walk blobdir")
+	}
+
+	return digests, nil
+}
+
+// readDeleted returns the set of blobs deleted during the session with the
+// given staging area.
+func readDeleted(session string) ([]digest.Digest, error) {
+	content, err := ioutil.ReadFile(filepath.Join(session, deletedFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read deleted blobs")
+	}
+
+	var deleted []digest.Digest
+	if err := json.Unmarshal(content, &deleted); err != nil {
+		return nil, errors.Wrap(err, "parse deleted blobs")
+	}
+	return deleted, nil
+}
+
+// writeDeleted replaces the set of blobs deleted during the session with the
+// given staging area.
+func writeDeleted(session string, deleted map[digest.Digest]struct{}) error {
+	list := []digest.Digest{}
+	for blob := range deleted {
+		list = append(list, blob)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+
+	content, err := json.Marshal(list)
+	if err != nil {
+		return errors.Wrap(err, "marshal deleted blobs")
+	}
+
+	// Write to a temporary file first, to ensure the atomicity of this
+	// operation.
+	fh, err := ioutil.TempFile(session, "deleted-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary deleted blobs")
+	}
+	defer fh.Close()
+	if _, err := fh.Write(content); err != nil {
+		return errors.Wrap(err, "write temporary deleted blobs")
+	}
+	fh.Close()
+	return errors.Wrap(os.Rename(fh.Name(), filepath.Join(session, deletedFile)), "rename temporary deleted blobs")
+}
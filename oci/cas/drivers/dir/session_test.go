@@ -0,0 +1,204 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// setupSession creates an image with a single blob (which is referenced by the
+// index) and begins a session, returning the path to the image and the blob.
+func setupSession(t *testing.T, root string) (string, digest.Digest) {
+	ctx := context.Background()
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	old, _, err := engine.PutBlob(ctx, bytes.NewBufferString("old blob"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	if err := engine.PutIndex(ctx, ispec.Index{
+		Manifests: []ispec.Descriptor{{Digest: old}},
+	}); err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+
+	if err := Begin(image); err != nil {
+		t.Fatalf("unexpected error beginning session: %+v", err)
+	}
+	if err := Begin(image); errors.Cause(err) != ErrSessionExists {
+		t.Errorf("expected ErrSessionExists beginning session twice: got %+v", err)
+	}
+	return image, old
+}
+
+// modifySession adds a new blob, deletes the old blob and replaces the index
+// within the session, returning the new blob.
+func modifySession(t *testing.T, image string, old digest.Digest) digest.Digest {
+	ctx := context.Background()
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	new, _, err := engine.PutBlob(ctx, bytes.NewBufferString("new blob"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	if err := engine.DeleteBlob(ctx, old); err != nil {
+		t.Fatalf("unexpected error deleting blob: %+v", err)
+	}
+	if err := engine.PutIndex(ctx, ispec.Index{
+		Manifests: []ispec.Descriptor{{Digest: new}},
+	}); err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+
+	// The session must see its own modifications.
+	if _, err := engine.GetBlob(ctx, old); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected deleted blob to not exist in session: got %+v", err)
+	}
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error listing blobs: %+v", err)
+	} else if len(blobs) != 1 || blobs[0] != new {
+		t.Errorf("unexpected blobs in session: got %v expected %v", blobs, []digest.Digest{new})
+	}
+	return new
+}
+
+// checkImage checks that the image (outside of any session) has the given
+// blob, and that the index only references it.
+func checkImage(t *testing.T, image string, blob digest.Digest) {
+	ctx := context.Background()
+
+	// Read the image directly, to ignore the session.
+	engine := &dirEngine{path: image}
+	defer engine.Close()
+
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %+v", err)
+	}
+	if len(blobs) != 1 || blobs[0] != blob {
+		t.Errorf("unexpected blobs in image: got %v expected %v", blobs, []digest.Digest{blob})
+	}
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != blob {
+		t.Errorf("unexpected index in image: got %v expected %v", index.Manifests, blob)
+	}
+}
+
+func TestSessionCommit(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestSessionCommit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image, old := setupSession(t, root)
+	new := modifySession(t, image, old)
+
+	// Until the session is committed, the image must be unchanged.
+	checkImage(t, image, old)
+
+	if err := Commit(image); err != nil {
+		t.Fatalf("unexpected error committing session: %+v", err)
+	}
+	checkImage(t, image, new)
+
+	if inSession, err := InSession(image); err != nil || inSession {
+		t.Errorf("expected no session after commit: got %v (%+v)", inSession, err)
+	}
+	if err := Commit(image); errors.Cause(err) != ErrNoSession {
+		t.Errorf("expected ErrNoSession committing twice: got %+v", err)
+	}
+}
+
+func TestSessionRollback(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestSessionRollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image, old := setupSession(t, root)
+	modifySession(t, image, old)
+
+	if err := Rollback(image); err != nil {
+		t.Fatalf("unexpected error rolling back session: %+v", err)
+	}
+	checkImage(t, image, old)
+
+	if inSession, err := InSession(image); err != nil || inSession {
+		t.Errorf("expected no session after rollback: got %v (%+v)", inSession, err)
+	}
+	if err := Rollback(image); errors.Cause(err) != ErrNoSession {
+		t.Errorf("expected ErrNoSession rolling back twice: got %+v", err)
+	}
+}
+
+func TestSessionClean(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestSessionClean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image, old := setupSession(t, root)
+	new := modifySession(t, image, old)
+
+	// Clean must not remove the staging area.
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	if err := engine.Clean(ctx); err != nil {
+		t.Fatalf("unexpected error cleaning image: %+v", err)
+	}
+	engine.Close()
+
+	if err := Commit(image); err != nil {
+		t.Fatalf("unexpected error committing session: %+v", err)
+	}
+	checkImage(t, image, new)
+}
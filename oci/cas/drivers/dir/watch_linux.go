@@ -0,0 +1,100 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dir
+
+import (
+	"bytes"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// indexWatchMask is the set of inotify(7) events on the image directory
+	// which may indicate that the index has been modified. PutIndex renames a
+	// new index into place, but other tools may write to the index directly.
+	indexWatchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_DELETE | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+	// indexWatchTimeout is how long (in milliseconds) WatchIndex waits for
+	// events before checking whether the context has been cancelled.
+	indexWatchTimeout = 100
+)
+
+// WatchIndex uses inotify(7) to call fn whenever the index of the image is
+// modified (see cas.IndexWatcher).
+func (e *dirEngine) WatchIndex(ctx context.Context, fn func() error) error {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return errors.Wrap(os.NewSyscallError("inotify_init1", err), "watch index")
+	}
+	defer unix.Close(fd)
+
+	root := e.root()
+	if _, err := unix.InotifyAddWatch(fd, root, indexWatchMask); err != nil {
+		return errors.Wrap(&os.PathError{Op: "inotify_add_watch", Path: root, Err: err}, "watch index")
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		if n, err := unix.Poll(fds, indexWatchTimeout); err == unix.EINTR || n == 0 {
+			continue
+		} else if err != nil {
+			return errors.Wrap(os.NewSyscallError("poll", err), "watch index")
+		}
+
+		n, err := unix.Read(fd, buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return errors.Wrap(os.NewSyscallError("read", err), "watch index")
+		}
+
+		changed := false
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += unix.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[offset:offset+int(event.Len)], "\x00"))
+			offset += int(event.Len)
+
+			if event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+				return errors.Errorf("watch index: image %s was removed", root)
+			}
+			if name == indexFile {
+				changed = true
+			}
+		}
+		if changed {
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mem implements a cas.Engine which stores all blobs and the index in
+// memory. It is intended for unit tests (which shouldn't need to touch the
+// disk) and for library users that need a scratch image which doesn't outlive
+// the process. Unlike the dir driver, mem is not registered as a cas.Driver
+// (there is no URI which could refer to an in-memory image), so engines must
+// be created using New.
+package mem
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type memEngine struct {
+	lock  sync.RWMutex
+	blobs map[digest.Digest][]byte
+
+	// indexLock is the lock taken by LockIndex.
+	indexLock sync.Mutex
+
+	// index is the JSON-encoded top-level index. We store the encoded form
+	// (rather than an ispec.Index) so that callers cannot modify the index
+	// without calling PutIndex.
+	index []byte
+}
+
+// New creates a new in-memory image, containing an empty top-level index and
+// no blobs. The image is discarded once all references to the returned
+// cas.Engine are dropped.
+func New() cas.Engine {
+	index, err := json.Marshal(ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+	})
+	if err != nil {
+		// Should _never_ be reached.
+		panic(errors.Wrap(err, "[internal error] encode empty index"))
+	}
+	return &memEngine{
+		blobs: map[digest.Digest][]byte{},
+		index: index,
+	}
+}
+
+// PutBlob adds a new blob to the image. This is idempotent; a nil error
+// means that "the content is stored at DIGEST" without implying "because
+// of this PutBlob() call".
+func (e *memEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	digester := cas.BlobAlgorithm.Digester()
+	buffer := new(bytes.Buffer)
+
+	size, err := io.Copy(io.MultiWriter(buffer, digester.Hash()), reader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "copy blob")
+	}
+
+	e.lock.Lock()
+	e.blobs[digester.Digest()] = buffer.Bytes()
+	e.lock.Unlock()
+
+	return digester.Digest(), size, nil
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *memEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	if err := digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.RLock()
+	data, ok := e.blobs[digest]
+	e.lock.RUnlock()
+
+	if !ok {
+		return nil, errors.Wrap(os.ErrNotExist, "open blob")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// PutIndex sets the index of the OCI image to the given index, replacing the
+// previously existing index. This operation is atomic; any readers attempting
+// to access the OCI image while it is being modified will only ever see the
+// new or old index.
+func (e *memEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "encode index")
+	}
+
+	e.lock.Lock()
+	e.index = data
+	e.lock.Unlock()
+	return nil
+}
+
+// GetIndex returns the index of the OCI image.
+func (e *memEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	e.lock.RLock()
+	data := e.index
+	e.lock.RUnlock()
+
+	var index ispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "parse index")
+	}
+	return index, nil
+}
+
+// LockIndex locks the index against concurrent modification (see
+// cas.IndexLocker).
+func (e *memEngine) LockIndex(ctx context.Context) (func() error, error) {
+	e.indexLock.Lock()
+	return func() error {
+		e.indexLock.Unlock()
+		return nil
+	}, nil
+}
+
+// DeleteBlob removes a blob from the image. This is idempotent; a nil
+// error means "the content is not in the store" without implying "because
+// of this DeleteBlob() call".
+func (e *memEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	if err := digest.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	e.lock.Lock()
+	delete(e.blobs, digest)
+	e.lock.Unlock()
+	return nil
+}
+
+// ListBlobs returns the set of blob digests stored in the image, sorted so
+// that the output is deterministic.
+func (e *memEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	digests := []digest.Digest{}
+	for digest := range e.blobs {
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+	return digests, nil
+}
+
+// Clean is a no-op, as an in-memory image never contains any non-blob
+// garbage.
+func (e *memEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op. The contents of the image remain accessible through the
+// engine, so that a single in-memory image can be used by several callers.
+func (e *memEngine) Close() error {
+	return nil
+}
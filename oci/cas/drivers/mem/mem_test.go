@@ -0,0 +1,141 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mem
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEngineBlob(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	if blobs, err := engine.ListBlobs(ctx); err != nil {
+		t.Errorf("unexpected error getting list of blobs: %+v", err)
+	} else if len(blobs) > 0 {
+		t.Errorf("got blobs in a newly created image: %v", blobs)
+	}
+
+	for _, data := range [][]byte{
+		[]byte(""),
+		[]byte("some blob"),
+		[]byte("another blob"),
+	} {
+		expectedDigest := cas.BlobAlgorithm.FromBytes(data)
+
+		blobDigest, size, err := engine.PutBlob(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("PutBlob: unexpected error: %+v", err)
+		}
+		if blobDigest != expectedDigest {
+			t.Errorf("PutBlob: digest doesn't match: expected=%s got=%s", expectedDigest, blobDigest)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("PutBlob: length doesn't match: expected=%d got=%d", len(data), size)
+		}
+
+		blobReader, err := engine.GetBlob(ctx, blobDigest)
+		if err != nil {
+			t.Fatalf("GetBlob: unexpected error: %+v", err)
+		}
+		gotBytes, err := ioutil.ReadAll(blobReader)
+		blobReader.Close()
+		if err != nil {
+			t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+		}
+		if !bytes.Equal(data, gotBytes) {
+			t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(data), string(gotBytes))
+		}
+
+		if blobs, err := engine.ListBlobs(ctx); err != nil {
+			t.Errorf("ListBlobs: unexpected error: %+v", err)
+		} else if len(blobs) != 1 || blobs[0] != blobDigest {
+			t.Errorf("ListBlobs: expected only %s, got %v", blobDigest, blobs)
+		}
+
+		if err := engine.DeleteBlob(ctx, blobDigest); err != nil {
+			t.Errorf("DeleteBlob: unexpected error: %+v", err)
+		}
+		if _, err := engine.GetBlob(ctx, blobDigest); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("GetBlob: expected ENOENT after DeleteBlob, got: %+v", err)
+		}
+
+		// DeleteBlob is idempotent. It shouldn't cause an error.
+		if err := engine.DeleteBlob(ctx, blobDigest); err != nil {
+			t.Errorf("DeleteBlob: unexpected error on double-delete: %+v", err)
+		}
+	}
+
+	if _, err := engine.GetBlob(ctx, digest.Digest("invalid")); err == nil {
+		t.Errorf("GetBlob: expected error with invalid digest")
+	}
+}
+
+func TestEngineIndex(t *testing.T) {
+	ctx := context.Background()
+
+	engine := New()
+	defer engine.Close()
+
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if index.SchemaVersion != 2 || len(index.Manifests) > 0 {
+		t.Errorf("GetIndex: expected empty index in new image, got: %+v", index)
+	}
+
+	newIndex := ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{
+			{
+				MediaType: ispec.MediaTypeImageManifest,
+				Digest:    cas.BlobAlgorithm.FromString("manifest"),
+				Size:      8,
+			},
+		},
+	}
+	if err := engine.PutIndex(ctx, newIndex); err != nil {
+		t.Fatalf("PutIndex: unexpected error: %+v", err)
+	}
+
+	// Modifying the index after PutIndex must not modify the stored index.
+	newIndex.Manifests[0].Size = 1337
+
+	index, err = engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Size != 8 {
+		t.Errorf("GetIndex: got unexpected index: %+v", index)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"testing"
+)
+
+func TestURIScheme(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"docker://registry:5000/image": "docker",
+		"s3+https://bucket/image":      "s3+https",
+		"image":                        "",
+		"/path/to/image":               "",
+		"./image://foo":                "",
+		"image:tag":                    "",
+		"://image":                     "",
+	} {
+		if got := URIScheme(uri); got != expected {
+			t.Errorf("URIScheme(%q): got %q, expected %q", uri, got, expected)
+		}
+	}
+}
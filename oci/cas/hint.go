@@ -0,0 +1,59 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"io"
+)
+
+// sizeHintReader is an io.Reader with a size hint.
+type sizeHintReader struct {
+	io.Reader
+	size int64
+}
+
+// SizeHint returns the expected size of the blob.
+func (r sizeHintReader) SizeHint() int64 {
+	return r.size
+}
+
+// WithSizeHint returns a reader which will tell Engine.PutBlob that the blob
+// read from the given reader is expected to be size bytes long. Engines may
+// use the hint to preallocate space for the blob, but must not rely on it
+// being accurate.
+func WithSizeHint(reader io.Reader, size int64) io.Reader {
+	return sizeHintReader{Reader: reader, size: size}
+}
+
+// BlobSizeHint returns the expected size of the blob read from the given
+// reader (which was passed to Engine.PutBlob), or -1 if it is not known.
+// Readers wrapped with WithSizeHint as well as in-memory readers (such as
+// *bytes.Buffer and *bytes.Reader) provide size hints.
+func BlobSizeHint(reader io.Reader) int64 {
+	switch r := reader.(type) {
+	case interface {
+		SizeHint() int64
+	}:
+		return r.SizeHint()
+	case interface {
+		Len() int
+	}:
+		return int64(r.Len())
+	}
+	return -1
+}
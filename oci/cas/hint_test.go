@@ -0,0 +1,42 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBlobSizeHint(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		reader   io.Reader
+		expected int64
+	}{
+		{"Buffer", bytes.NewBufferString("some blob"), 9},
+		{"Reader", strings.NewReader("some blob"), 9},
+		{"WithSizeHint", WithSizeHint(strings.NewReader("some blob"), 1234), 1234},
+		{"Unknown", io.MultiReader(strings.NewReader("some blob")), -1},
+	} {
+		if hint := BlobSizeHint(test.reader); hint != test.expected {
+			t.Errorf("%s: unexpected size hint: expected=%d got=%d", test.name, test.expected, hint)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"golang.org/x/net/context"
+)
+
+// IndexLocker is an optional interface implemented by Engines which can lock
+// their index against concurrent modification by other users of the image
+// (including other processes), so that a GetIndex followed by a PutIndex can
+// be made atomic. The lock is advisory, and only excludes other users which
+// also take it.
+type IndexLocker interface {
+	// LockIndex blocks until the caller has an exclusive lock on the index
+	// (or the context is cancelled), returning a function which releases the
+	// lock.
+	LockIndex(ctx context.Context) (unlock func() error, err error)
+}
+
+// LockIndex takes an exclusive lock on the index of the given Engine (see
+// IndexLocker). If the Engine doesn't implement IndexLocker, nothing is locked
+// and the returned function does nothing.
+func LockIndex(ctx context.Context, engine Engine) (func() error, error) {
+	if locker, ok := engine.(IndexLocker); ok {
+		return locker.LockIndex(ctx)
+	}
+	return func() error { return nil }, nil
+}
+
+// LockIndex locks the index of the wrapped Engine.
+func (e *cachedEngine) LockIndex(ctx context.Context) (func() error, error) {
+	return LockIndex(ctx, e.Engine)
+}
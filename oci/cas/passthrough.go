@@ -0,0 +1,70 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// passThroughEngine is a wrapper around an Engine which refuses to delete
+// blobs (see NewerVersionsPassThrough).
+type passThroughEngine struct {
+	Engine
+}
+
+// PassThrough returns a wrapper around the given Engine which returns
+// ErrNewerVersion for DeleteBlob, and otherwise behaves like the given
+// Engine. It is used for images using a newer version of the image-spec which
+// were opened with NewerVersionsPassThrough: umoci cannot tell which blobs are
+// referenced by blobs with media types it doesn't understand, so deleting any
+// blob (such as with garbage collection) might break the image.
+func PassThrough(engine Engine) Engine {
+	if IsPassThrough(engine) || IsReadOnly(engine) {
+		return engine
+	}
+	return passThroughEngine{Engine: engine}
+}
+
+// IsPassThrough returns whether the given Engine refuses to delete blobs
+// because it was opened in pass-through mode (see PassThrough).
+func IsPassThrough(engine Engine) bool {
+	_, ok := engine.(passThroughEngine)
+	return ok
+}
+
+// DeleteBlob returns ErrNewerVersion.
+func (e passThroughEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return errors.Wrap(ErrNewerVersion, "delete blob from image opened in pass-through mode")
+}
+
+// LockIndex locks the index of the wrapped Engine.
+func (e passThroughEngine) LockIndex(ctx context.Context) (func() error, error) {
+	return LockIndex(ctx, e.Engine)
+}
+
+// WatchIndex watches the index of the wrapped Engine.
+func (e passThroughEngine) WatchIndex(ctx context.Context, fn func() error) error {
+	return WatchIndex(ctx, e.Engine, fn)
+}
+
+// NewerVersionPolicy returns the policy of the wrapped Engine.
+func (e passThroughEngine) NewerVersionPolicy() NewerVersionPolicy {
+	return GetNewerVersionPolicy(e.Engine)
+}
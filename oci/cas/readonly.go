@@ -0,0 +1,70 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// readOnlyEngine is a wrapper around an Engine which refuses to modify the
+// image.
+type readOnlyEngine struct {
+	Engine
+}
+
+// ReadOnly returns a wrapper around the given Engine which returns ErrReadOnly
+// for every operation which would modify the image (PutBlob, PutIndex and
+// DeleteBlob). Clean does nothing, since a read-only engine never creates any
+// garbage to be cleaned.
+func ReadOnly(engine Engine) Engine {
+	if IsReadOnly(engine) {
+		return engine
+	}
+	return readOnlyEngine{Engine: engine}
+}
+
+// IsReadOnly returns whether the given Engine is read-only (see ReadOnly).
+func IsReadOnly(engine Engine) bool {
+	_, ok := engine.(readOnlyEngine)
+	return ok
+}
+
+// PutBlob returns ErrReadOnly.
+func (e readOnlyEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return "", -1, errors.Wrap(ErrReadOnly, "put blob")
+}
+
+// PutIndex returns ErrReadOnly.
+func (e readOnlyEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return errors.Wrap(ErrReadOnly, "put index")
+}
+
+// DeleteBlob returns ErrReadOnly.
+func (e readOnlyEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return errors.Wrap(ErrReadOnly, "delete blob")
+}
+
+// Clean does nothing.
+func (e readOnlyEngine) Clean(ctx context.Context) error {
+	return nil
+}
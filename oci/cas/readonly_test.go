@@ -0,0 +1,60 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// nopEngine is an Engine which panics if it is used.
+type nopEngine struct {
+	Engine
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	engine := ReadOnly(nopEngine{})
+	if !IsReadOnly(engine) {
+		t.Errorf("IsReadOnly: expected read-only engine")
+	}
+	if IsReadOnly(nopEngine{}) {
+		t.Errorf("IsReadOnly: expected engine to not be read-only")
+	}
+	if again := ReadOnly(engine); again != engine {
+		t.Errorf("ReadOnly: expected read-only engine to not be wrapped again")
+	}
+
+	if _, _, err := engine.PutBlob(ctx, strings.NewReader("some blob")); errors.Cause(err) != ErrReadOnly {
+		t.Errorf("PutBlob: expected ErrReadOnly: got %+v", err)
+	}
+	if err := engine.PutIndex(ctx, ispec.Index{}); errors.Cause(err) != ErrReadOnly {
+		t.Errorf("PutIndex: expected ErrReadOnly: got %+v", err)
+	}
+	if err := engine.DeleteBlob(ctx, "sha256:0000"); errors.Cause(err) != ErrReadOnly {
+		t.Errorf("DeleteBlob: expected ErrReadOnly: got %+v", err)
+	}
+	if err := engine.Clean(ctx); err != nil {
+		t.Errorf("Clean: unexpected error: %+v", err)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// verifiedReadCloser is an io.ReadCloser which returns an error (with
+// ErrDigestMismatch as its cause) instead of io.EOF if the contents read do
+// not match the expected digest and size. Reading more than the expected size
+// fails immediately, so a corrupted blob cannot cause an unbounded amount of
+// data to be read. If the expected size is negative, the size is not known
+// (as with the layers of schema1 manifests) and only the digest is verified.
+type verifiedReadCloser struct {
+	reader   io.ReadCloser
+	verifier digest.Verifier
+	expected ispec.Descriptor
+	size     int64
+}
+
+// NewVerifiedReadCloser returns a wrapper around the given reader which
+// verifies its contents against the given descriptor while they are read:
+// instead of io.EOF, it returns an error with ErrDigestMismatch as its cause
+// if the contents do not match the descriptor's digest or size (and it never
+// returns more than the descriptor's size). Callers must read until io.EOF for
+// the digest to be verified. A negative descriptor size means that the size
+// is not known, in which case only the digest is verified. Closing the
+// returned reader closes the given reader.
+func NewVerifiedReadCloser(reader io.ReadCloser, descriptor ispec.Descriptor) io.ReadCloser {
+	return &verifiedReadCloser{
+		reader:   reader,
+		verifier: descriptor.Digest.Verifier(),
+		expected: descriptor,
+	}
+}
+
+// Read implements io.Reader.
+func (r *verifiedReadCloser) Read(p []byte) (int, error) {
+	// Read at most one byte more than the expected size, so that we can tell
+	// whether the blob is too large.
+	if r.expected.Size >= 0 && int64(len(p)) > r.expected.Size-r.size+1 {
+		p = p[:r.expected.Size-r.size+1]
+	}
+	n, err := r.reader.Read(p)
+	r.size += int64(n)
+	r.verifier.Write(p[:n])
+	if r.expected.Size >= 0 && r.size > r.expected.Size {
+		n -= int(r.size - r.expected.Size)
+		return n, errors.Wrapf(ErrDigestMismatch, "blob %s is larger than expected size %d", r.expected.Digest, r.expected.Size)
+	}
+	if err == io.EOF {
+		if r.expected.Size >= 0 && r.size != r.expected.Size {
+			return n, errors.Wrapf(ErrDigestMismatch, "blob %s has size %d, expected %d", r.expected.Digest, r.size, r.expected.Size)
+		}
+		if !r.verifier.Verified() {
+			return n, errors.Wrapf(ErrDigestMismatch, "blob does not match digest %s", r.expected.Digest)
+		}
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (r *verifiedReadCloser) Close() error {
+	return r.reader.Close()
+}
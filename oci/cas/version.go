@@ -0,0 +1,169 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaVersion is the newest schemaVersion of manifests and indexes which
+// umoci supports.
+const SchemaVersion = 2
+
+// NewerVersionPolicy controls how images which use a newer version of the
+// image-spec than umoci supports (see CheckLayoutVersion and
+// CheckSchemaVersion) are handled, since umoci might not correctly preserve
+// the parts of such images it doesn't understand. It is set when the image is
+// opened (see OpenOptions).
+type NewerVersionPolicy int
+
+const (
+	// NewerVersionsReadOnly opens images with a newer imageLayoutVersion
+	// read-only (see ReadOnly), and manifests and indexes with a newer
+	// schemaVersion cannot be modified. This is the default.
+	NewerVersionsReadOnly NewerVersionPolicy = iota
+
+	// NewerVersionsPassThrough allows blobs to be added to images with a
+	// newer imageLayoutVersion and their references to be modified, but the
+	// parts of the image umoci doesn't understand are passed through
+	// unchanged. Manifests and indexes with a newer schemaVersion cannot be
+	// modified, and no blobs can be deleted (see PassThrough), because blobs
+	// with unknown media types might refer to other blobs.
+	NewerVersionsPassThrough
+
+	// NewerVersionsForce handles images using a newer version of the
+	// image-spec as though they used a supported version.
+	NewerVersionsForce
+)
+
+// String returns the name of the policy, as used by the --newer-versions flag.
+func (p NewerVersionPolicy) String() string {
+	switch p {
+	case NewerVersionsReadOnly:
+		return "read-only"
+	case NewerVersionsPassThrough:
+		return "pass-through"
+	case NewerVersionsForce:
+		return "force"
+	}
+	return fmt.Sprintf("NewerVersionPolicy(%d)", int(p))
+}
+
+// ParseNewerVersionPolicy parses the name of a NewerVersionPolicy (see
+// NewerVersionPolicy.String).
+func ParseNewerVersionPolicy(name string) (NewerVersionPolicy, error) {
+	for _, policy := range []NewerVersionPolicy{NewerVersionsReadOnly, NewerVersionsPassThrough, NewerVersionsForce} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return NewerVersionsReadOnly, errors.Errorf("unknown newer version policy %q", name)
+}
+
+// NewerVersionPolicyEngine is an optional interface implemented by Engines
+// which were opened with a NewerVersionPolicy (see OpenWithOptions).
+type NewerVersionPolicyEngine interface {
+	// NewerVersionPolicy returns the policy the image was opened with.
+	NewerVersionPolicy() NewerVersionPolicy
+}
+
+// GetNewerVersionPolicy returns the NewerVersionPolicy the given Engine was
+// opened with. If the Engine doesn't implement NewerVersionPolicyEngine,
+// NewerVersionsReadOnly is returned.
+func GetNewerVersionPolicy(engine Engine) NewerVersionPolicy {
+	if policyEngine, ok := engine.(NewerVersionPolicyEngine); ok {
+		return policyEngine.NewerVersionPolicy()
+	}
+	return NewerVersionsReadOnly
+}
+
+// NewerVersionPolicy returns the policy of the wrapped Engine.
+func (e *cachedEngine) NewerVersionPolicy() NewerVersionPolicy {
+	return GetNewerVersionPolicy(e.Engine)
+}
+
+// NewerVersionPolicy returns the policy of the wrapped Engine.
+func (e readOnlyEngine) NewerVersionPolicy() NewerVersionPolicy {
+	return GetNewerVersionPolicy(e.Engine)
+}
+
+// parseLayoutVersion parses an imageLayoutVersion of the form
+// "major.minor.patch".
+func parseLayoutVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	parts := strings.Split(version, ".")
+	if len(parts) != len(parsed) {
+		return parsed, errors.Errorf("invalid layout version %q", version)
+	}
+	for idx, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return parsed, errors.Errorf("invalid layout version %q", version)
+		}
+		parsed[idx] = value
+	}
+	return parsed, nil
+}
+
+// CheckLayoutVersion checks whether the imageLayoutVersion of an image can be
+// handled by a driver which supports the given version. ErrNewerVersion is
+// returned if the image uses a newer version, and ErrInvalid is returned if the
+// version is invalid or has an older major version (such images need to be
+// migrated).
+func CheckLayoutVersion(version, supported string) error {
+	if version == supported {
+		return nil
+	}
+	parsed, err := parseLayoutVersion(version)
+	if err != nil {
+		return errors.Wrap(ErrInvalid, err.Error())
+	}
+	parsedSupported, err := parseLayoutVersion(supported)
+	if err != nil {
+		return errors.Wrap(err, "parse supported layout version")
+	}
+
+	for idx := range parsed {
+		switch {
+		case parsed[idx] > parsedSupported[idx]:
+			return errors.Wrapf(ErrNewerVersion, "layout version %s is newer than %s", version, supported)
+		case parsed[idx] < parsedSupported[idx]:
+			if idx == 0 {
+				return errors.Wrapf(ErrInvalid, "layout version %s is not supported", version)
+			}
+			// Older minor versions are compatible.
+			return nil
+		}
+	}
+	return nil
+}
+
+// CheckSchemaVersion checks whether the schemaVersion of a manifest or index
+// is supported, returning ErrNewerVersion if it is newer than SchemaVersion.
+// Older (or missing) schemaVersions are not treated as errors here, and are
+// left to validation.
+func CheckSchemaVersion(schemaVersion int) error {
+	if schemaVersion > SchemaVersion {
+		return errors.Wrapf(ErrNewerVersion, "schemaVersion %d is newer than %d", schemaVersion, SchemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCheckLayoutVersion(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		expected error
+	}{
+		{"1.0.0", nil},
+		{"1.0.1", ErrNewerVersion},
+		{"1.1.0", ErrNewerVersion},
+		{"2.0.0", ErrNewerVersion},
+		{"0.2.0", ErrInvalid},
+		{"", ErrInvalid},
+		{"1.0", ErrInvalid},
+		{"1.0.x", ErrInvalid},
+		{"1.-1.0", ErrInvalid},
+	} {
+		if err := CheckLayoutVersion(test.version, "1.0.0"); errors.Cause(err) != test.expected {
+			t.Errorf("CheckLayoutVersion(%q): expected %v, got %+v", test.version, test.expected, err)
+		}
+	}
+
+	// Older minor versions are compatible.
+	if err := CheckLayoutVersion("1.0.5", "1.1.0"); err != nil {
+		t.Errorf("CheckLayoutVersion: unexpected error with older minor version: %+v", err)
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	for _, test := range []struct {
+		schemaVersion int
+		expected      error
+	}{
+		{0, nil},
+		{1, nil},
+		{SchemaVersion, nil},
+		{SchemaVersion + 1, ErrNewerVersion},
+	} {
+		if err := CheckSchemaVersion(test.schemaVersion); errors.Cause(err) != test.expected {
+			t.Errorf("CheckSchemaVersion(%d): expected %v, got %+v", test.schemaVersion, test.expected, err)
+		}
+	}
+}
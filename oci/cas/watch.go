@@ -0,0 +1,58 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// IndexWatcher is an optional interface implemented by Engines which can
+// notify callers when their index has been modified (including by other
+// processes).
+type IndexWatcher interface {
+	// WatchIndex calls fn whenever the index may have been modified, until the
+	// context is cancelled (in which case nil is returned) or fn returns an
+	// error (which is returned). fn is also called once the watch has been
+	// set up, so that modifications made before then are not missed. Spurious
+	// calls to fn are permitted, so fn should compare the index to its
+	// previous value.
+	WatchIndex(ctx context.Context, fn func() error) error
+}
+
+// WatchIndex watches the index of the given Engine for modifications (see
+// IndexWatcher). If the Engine doesn't implement IndexWatcher,
+// ErrNotImplemented is returned.
+func WatchIndex(ctx context.Context, engine Engine, fn func() error) error {
+	watcher, ok := engine.(IndexWatcher)
+	if !ok {
+		return errors.Wrap(ErrNotImplemented, "watch index")
+	}
+	return watcher.WatchIndex(ctx, fn)
+}
+
+// WatchIndex watches the index of the wrapped Engine.
+func (e *cachedEngine) WatchIndex(ctx context.Context, fn func() error) error {
+	return WatchIndex(ctx, e.Engine, fn)
+}
+
+// WatchIndex watches the index of the wrapped Engine, since watching doesn't
+// modify the image.
+func (e readOnlyEngine) WatchIndex(ctx context.Context, fn func() error) error {
+	return WatchIndex(ctx, e.Engine, fn)
+}
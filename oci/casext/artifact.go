@@ -0,0 +1,116 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io"
+
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// emptyArtifactConfig is the configuration blob used for artifacts which do
+// not have a configuration of their own.
+var emptyArtifactConfig = []byte("{}")
+
+// ArtifactBlob is a blob to be included in an artifact by PutArtifact.
+type ArtifactBlob struct {
+	// MediaType is the media type of the blob's descriptor.
+	MediaType string
+
+	// Reader is the contents of the blob.
+	Reader io.Reader
+
+	// Annotations are the annotations of the blob's descriptor. The
+	// ispec.AnnotationTitle annotation is used by umoci-artifact-extract(1)
+	// as the name of the extracted file.
+	Annotations map[string]string
+}
+
+// IsArtifact returns whether the given manifest describes an artifact (an
+// arbitrary payload such as a Helm chart or WASM module) rather than a
+// container image. Artifacts are ordinary image manifests whose config has a
+// media type which is not an image configuration (see IsConfigMediaType). The
+// config media type is the "artifact type".
+func IsArtifact(manifest ispec.Manifest) bool {
+	return !IsConfigMediaType(manifest.Config.MediaType)
+}
+
+// PutArtifact stores an artifact of the given type (which must not be an
+// image configuration media type) in the image, and returns the descriptor of
+// its manifest. The blobs are stored as the manifest's layers, in order. If
+// config is nil, an empty JSON object is used as the artifact's
+// configuration. The caller is responsible for referencing the manifest (such
+// as with UpdateReference), otherwise it will be removed by GC.
+func (e Engine) PutArtifact(ctx context.Context, artifactType string, config io.Reader, blobs []ArtifactBlob, annotations map[string]string) (ispec.Descriptor, error) {
+	if !mediaTypeRegexp.MatchString(artifactType) {
+		return ispec.Descriptor{}, errors.Errorf("invalid artifact type %q", artifactType)
+	}
+	if isKnownMediaType(artifactType) {
+		return ispec.Descriptor{}, errors.Errorf("artifact type %q is reserved for images", artifactType)
+	}
+	if config == nil {
+		config = bytes.NewReader(emptyArtifactConfig)
+	}
+
+	configDigest, configSize, err := e.PutBlob(ctx, config)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put artifact config")
+	}
+	manifest := ispec.Manifest{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: artifactType,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers:      []ispec.Descriptor{},
+		Annotations: annotations,
+	}
+
+	for idx, blob := range blobs {
+		if !mediaTypeRegexp.MatchString(blob.MediaType) {
+			return ispec.Descriptor{}, errors.Errorf("blob %d: invalid media type %q", idx, blob.MediaType)
+		}
+		blobDigest, blobSize, err := e.PutBlob(ctx, blob.Reader)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "put artifact blob %d", idx)
+		}
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType:   blob.MediaType,
+			Digest:      blobDigest,
+			Size:        blobSize,
+			Annotations: blob.Annotations,
+		})
+	}
+
+	manifestDigest, manifestSize, err := e.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put artifact manifest")
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, nil
+}
@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestEnginePutArtifact(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEnginePutArtifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	const (
+		artifactType = "application/vnd.example.chart.config.v1+json"
+		blobType     = "application/vnd.example.chart.content.v1.tar+gzip"
+	)
+	descriptor, err := engineExt.PutArtifact(ctx, artifactType, nil, []ArtifactBlob{
+		{
+			MediaType:   blobType,
+			Reader:      bytes.NewReader([]byte("chart")),
+			Annotations: map[string]string{ispec.AnnotationTitle: "chart.tgz"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("PutArtifact: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "chart", descriptor); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	blob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("FromDescriptor: unexpected error: %+v", err)
+	}
+	manifest := blob.Data.(ispec.Manifest)
+	blob.Close()
+	if !IsArtifact(manifest) {
+		t.Errorf("IsArtifact: expected artifact: %v", manifest)
+	}
+	if manifest.Config.MediaType != artifactType {
+		t.Errorf("PutArtifact: unexpected artifact type: %s", manifest.Config.MediaType)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != blobType || manifest.Layers[0].Annotations[ispec.AnnotationTitle] != "chart.tgz" {
+		t.Errorf("PutArtifact: unexpected layers: %v", manifest.Layers)
+	}
+
+	// Artifacts must pass validation and survive GC, even though they don't
+	// have an image configuration.
+	if err := engineExt.Validate(ctx, descriptor); err != nil {
+		t.Errorf("Validate: unexpected error: %+v", err)
+	}
+	if err := engineExt.ValidateLayout(ctx); err != nil {
+		t.Errorf("ValidateLayout: unexpected error: %+v", err)
+	}
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	for _, d := range []ispec.Descriptor{descriptor, manifest.Config, manifest.Layers[0]} {
+		reader, err := engineExt.GetBlob(ctx, d.Digest)
+		if err != nil {
+			t.Errorf("GC: blob %s was removed: %+v", d.Digest, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Errorf("read blob %s: unexpected error: %+v", d.Digest, err)
+		}
+		if d.Digest == manifest.Config.Digest && string(data) != "{}" {
+			t.Errorf("PutArtifact: unexpected default config: %q", data)
+		}
+	}
+
+	// Image media types cannot be used as artifact types.
+	for _, bad := range []string{ispec.MediaTypeImageConfig, ispec.MediaTypeImageManifest, ispec.MediaTypeImageLayer, "not a media type"} {
+		if _, err := engineExt.PutArtifact(ctx, bad, nil, nil, nil); err == nil {
+			t.Errorf("PutArtifact(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestValidateManifestArtifact(t *testing.T) {
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: "application/vnd.example.config.v1+json",
+			Digest:    "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+			Size:      2,
+		},
+	}
+	manifest.SchemaVersion = 2
+	if err := ValidateManifest(manifest); err != nil {
+		t.Errorf("ValidateManifest: unexpected error for artifact: %+v", err)
+	}
+
+	manifest.Config.MediaType = ispec.MediaTypeImageIndex
+	if err := ValidateManifest(manifest); err == nil {
+		t.Errorf("ValidateManifest: expected error for index config")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// AttestationSubjectAnnotation is the annotation on the top-level index entry
+// of an attestation (see PutAttestation) which contains the digest of the
+// blob the attestation is about.
+const AttestationSubjectAnnotation = "org.opensuse.umoci.attestation.subject"
+
+// AttestationRefName returns the name of the reference used for the
+// attestation of the blob with the given digest. The "<algorithm>-<hex>.att"
+// naming scheme is the same one used by other tools for artifacts attached to
+// images.
+func AttestationRefName(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Hex() + ".att"
+}
+
+// PutAttestation stores the given attestation (such as an in-toto statement)
+// as a JSON blob with the given media type, and attaches it to the subject by
+// referencing it with AttestationRefName (so that it is kept by GC for as
+// long as the reference exists). Any existing attestation of the subject is
+// replaced. The descriptor of the attestation is returned.
+func (e Engine) PutAttestation(ctx context.Context, subject digest.Digest, mediaType string, attestation interface{}) (ispec.Descriptor, error) {
+	attestationDigest, attestationSize, err := e.PutBlobJSON(ctx, attestation)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put attestation")
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    attestationDigest,
+		Size:      attestationSize,
+		Annotations: map[string]string{
+			AttestationSubjectAnnotation: subject.String(),
+		},
+	}
+	if err := e.UpdateReference(ctx, AttestationRefName(subject), descriptor); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "attach attestation")
+	}
+	return descriptor, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEnginePutAttestation(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEnginePutAttestation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	subject := putValidImage(t, engineExt, []byte("layer"))
+	if err := engineExt.UpdateReference(ctx, "tag", subject); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	refname := AttestationRefName(subject.Digest)
+	if err := ValidateReferenceName(refname); err != nil {
+		t.Errorf("AttestationRefName: invalid reference name %q: %v", refname, err)
+	}
+
+	const mediaType = "application/vnd.example.attestation+json"
+	descriptor, err := engineExt.PutAttestation(ctx, subject.Digest, mediaType, map[string]string{"hello": "world"})
+	if err != nil {
+		t.Fatalf("PutAttestation: unexpected error: %+v", err)
+	}
+	if descriptor.Annotations[AttestationSubjectAnnotation] != subject.Digest.String() {
+		t.Errorf("PutAttestation: unexpected annotations: %v", descriptor.Annotations)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, refname)
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("ResolveReference: unexpected result: %v (%+v)", descriptorPaths, err)
+	}
+	if got := descriptorPaths[0].Descriptor(); got.Digest != descriptor.Digest || got.MediaType != mediaType {
+		t.Errorf("ResolveReference: got %v, expected %v", got, descriptor)
+	}
+
+	// Attestations must survive (and not break) GC and validation, even
+	// though they have an unknown media type.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	if _, err := engineExt.GetBlob(ctx, descriptor.Digest); err != nil {
+		t.Errorf("GC: attestation was removed: %+v", err)
+	}
+	if err := engineExt.Validate(ctx, descriptor); err != nil {
+		t.Errorf("Validate: unexpected error: %+v", err)
+	}
+
+	// Replacing the attestation only keeps the new one.
+	newDescriptor, err := engineExt.PutAttestation(ctx, subject.Digest, mediaType, map[string]string{"hello": "again"})
+	if err != nil {
+		t.Fatalf("PutAttestation: unexpected error: %+v", err)
+	}
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	if _, err := engineExt.GetBlob(ctx, descriptor.Digest); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("GC: expected old attestation to be removed: %+v", err)
+	}
+	if _, err := engineExt.GetBlob(ctx, newDescriptor.Digest); err != nil {
+		t.Errorf("GC: new attestation was removed: %+v", err)
+	}
+}
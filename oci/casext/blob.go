@@ -21,14 +21,149 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
 
-	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+const (
+	// MediaTypeImageLayerZstd is the media type of zstd-compressed layers
+	// (added in a later version of the image-spec than the one we vendor).
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeImageLayerNonDistributableZstd is the media type of
+	// zstd-compressed non-distributable layers.
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+
+	// MediaTypeDockerLayer is the media type used by Docker for uncompressed
+	// layers. It is semantically equivalent to ispec.MediaTypeImageLayer.
+	MediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// MediaTypeDockerLayerGzip is the media type used by Docker for
+	// gzip-compressed layers. It is semantically equivalent to
+	// ispec.MediaTypeImageLayerGzip.
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeDockerForeignLayer is the media type used by Docker for
+	// "foreign" layers, which are layers that are not distributed with the
+	// image (such as the Windows base layers). They are semantically
+	// equivalent to ispec.MediaTypeImageLayerNonDistributableGzip, and are
+	// treated as such.
+	MediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+var (
+	lm sync.RWMutex
+
+	// extraLayerMediaTypes are the layer media types registered with
+	// RegisterLayerMediaType, and whether they are non-distributable.
+	extraLayerMediaTypes = map[string]bool{}
+)
+
+// RegisterLayerMediaType registers an additional layer media type (such as
+// the media type of layers compressed by a plugin), so that it is accepted by
+// IsLayerMediaType (and IsNonDistributableMediaType if nonDistributable is
+// set).
+func RegisterLayerMediaType(mediaType string, nonDistributable bool) {
+	lm.Lock()
+	extraLayerMediaTypes[mediaType] = nonDistributable
+	lm.Unlock()
+}
+
+// extraLayerMediaType returns whether the media type was registered with
+// RegisterLayerMediaType, and whether it is non-distributable.
+func extraLayerMediaType(mediaType string) (registered, nonDistributable bool) {
+	lm.RLock()
+	defer lm.RUnlock()
+	nonDistributable, registered = extraLayerMediaTypes[mediaType]
+	return registered, nonDistributable
+}
+
+// IsLayerMediaType returns whether the media type is the media type of an
+// image layer blob. This includes both distributable and non-distributable
+// (including foreign) layers, as well as the legacy Docker layer media types
+// used by imported images and media types registered with
+// RegisterLayerMediaType.
+func IsLayerMediaType(mediaType string) bool {
+	if registered, _ := extraLayerMediaType(mediaType); registered {
+		return true
+	}
+	return mediaType == ispec.MediaTypeImageLayer ||
+		mediaType == ispec.MediaTypeImageLayerGzip ||
+		mediaType == MediaTypeImageLayerZstd ||
+		mediaType == MediaTypeDockerLayer ||
+		mediaType == MediaTypeDockerLayerGzip ||
+		IsNonDistributableMediaType(mediaType)
+}
+
+// LayerMediaTypes returns every media type accepted by IsLayerMediaType
+// (including those registered with RegisterLayerMediaType), in sorted order.
+func LayerMediaTypes() []string {
+	mediaTypes := []string{
+		ispec.MediaTypeImageLayer,
+		ispec.MediaTypeImageLayerGzip,
+		MediaTypeImageLayerZstd,
+		MediaTypeDockerLayer,
+		MediaTypeDockerLayerGzip,
+		ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerNonDistributableGzip,
+		MediaTypeImageLayerNonDistributableZstd,
+		MediaTypeDockerForeignLayer,
+	}
+	lm.RLock()
+	for mediaType := range extraLayerMediaTypes {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	lm.RUnlock()
+	sort.Strings(mediaTypes)
+	return mediaTypes
+}
+
+// IsNonDistributableMediaType returns whether the media type is the media
+// type of a non-distributable (or foreign) layer. The blobs of such layers
+// may not be present in an image.
+func IsNonDistributableMediaType(mediaType string) bool {
+	if _, nonDistributable := extraLayerMediaType(mediaType); nonDistributable {
+		return true
+	}
+	return mediaType == ispec.MediaTypeImageLayerNonDistributable ||
+		mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
+		mediaType == MediaTypeImageLayerNonDistributableZstd ||
+		mediaType == MediaTypeDockerForeignLayer
+}
+
+// MaxJSONBlobSize is the largest blob (such as a manifest or an image
+// configuration) which FromDescriptor will parse, so that a crafted image
+// cannot make us use an unbounded amount of memory. It can be raised by users
+// with legitimately huge blobs. It does not apply to layers.
+var MaxJSONBlobSize int64 = 64 << 20
+
+// maxSizeReader is an io.Reader which returns an error once more than max
+// bytes have been read from reader.
+type maxSizeReader struct {
+	reader io.Reader
+	size   int64
+	max    int64
+}
+
+// Read implements io.Reader.
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.max-r.size+1 {
+		p = p[:r.max-r.size+1]
+	}
+	n, err := r.reader.Read(p)
+	r.size += int64(n)
+	if r.size > r.max {
+		return n - int(r.size-r.max), invalidf("blob is larger than %d bytes", r.max)
+	}
+	return n, err
+}
+
 // Blob represents a "parsed" blob in an OCI image's blob store. MediaType
 // offers a type-safe way of checking what the type of Data is.
 type Blob struct {
@@ -50,25 +185,33 @@ type Blob struct {
 	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
+	// MediaTypeDockerForeignLayer => io.ReadCloser
+	// (and the other layer media types, see IsLayerMediaType) => io.ReadCloser
 	// ispec.MediaTypeImageConfig => ispec.Image
+	// MediaTypeDockerManifest => ispec.Manifest
+	// MediaTypeDockerManifestList => ispec.Index
+	// MediaTypeDockerConfig => ispec.Image
 	Data interface{}
 }
 
-func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
-	reader, err := engine.GetBlob(ctx, b.Digest)
+func (b *Blob) load(ctx context.Context, engine Engine, descriptor ispec.Descriptor) error {
+	// All blobs are verified against their descriptor as they are read, so
+	// that a corrupted (or maliciously modified) image cannot give us bad
+	// data. Layers are verified when the caller reads them.
+	reader, err := engine.GetVerifiedBlob(ctx, descriptor)
 	if err != nil {
 		return errors.Wrap(err, "get blob")
 	}
 
 	// The layer media types are special, we don't want to do any parsing (or
 	// close the blob reference).
-	switch b.MediaType {
 	// ispec.MediaTypeImageLayer => io.ReadCloser
 	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+	// MediaTypeDockerForeignLayer => io.ReadCloser
+	// (and the other layer media types, see IsLayerMediaType) => io.ReadCloser
+	if IsLayerMediaType(b.MediaType) {
 		// There isn't anything else we can practically do here.
 		b.Data = reader
 		return nil
@@ -76,6 +219,13 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 
 	defer reader.Close()
 
+	// Don't parse arbitrarily large blobs. If the size is not known, we find
+	// out while reading it.
+	if descriptor.Size > MaxJSONBlobSize {
+		return invalidf("blob %s is too large (%d bytes, maximum is %d)", descriptor.Digest, descriptor.Size, MaxJSONBlobSize)
+	}
+	var jsonReader io.Reader = &maxSizeReader{reader: reader, max: MaxJSONBlobSize}
+
 	// It would be great if this code didn't require tying the JSON decoding to
 	// the type decisions -- but because of Go's lack of generics we can't
 	// return regular structs as an interface without some ugly code.
@@ -83,31 +233,34 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 	// ispec.MediaTypeDescriptor => ispec.Descriptor
 	case ispec.MediaTypeDescriptor:
 		parsed := ispec.Descriptor{}
-		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
+		if err := json.NewDecoder(jsonReader).Decode(&parsed); err != nil {
 			return errors.Wrap(err, "parse MediaTypeDescriptor")
 		}
 		b.Data = parsed
 
 	// ispec.MediaTypeImageManifest => ispec.Manifest
-	case ispec.MediaTypeImageManifest:
+	// MediaTypeDockerManifest => ispec.Manifest
+	case ispec.MediaTypeImageManifest, MediaTypeDockerManifest:
 		parsed := ispec.Manifest{}
-		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
+		if err := json.NewDecoder(jsonReader).Decode(&parsed); err != nil {
 			return errors.Wrap(err, "parse MediaTypeImageManifest")
 		}
 		b.Data = parsed
 
 	// ispec.MediaTypeImageIndex => ispec.Index
-	case ispec.MediaTypeImageIndex:
+	// MediaTypeDockerManifestList => ispec.Index
+	case ispec.MediaTypeImageIndex, MediaTypeDockerManifestList:
 		parsed := ispec.Index{}
-		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
+		if err := json.NewDecoder(jsonReader).Decode(&parsed); err != nil {
 			return errors.Wrap(err, "parse MediaTypeImageIndex")
 		}
 		b.Data = parsed
 
 	// ispec.MediaTypeImageConfig => ispec.Image
-	case ispec.MediaTypeImageConfig:
+	// MediaTypeDockerConfig => ispec.Image
+	case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
 		parsed := ispec.Image{}
-		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
+		if err := json.NewDecoder(jsonReader).Decode(&parsed); err != nil {
 			return errors.Wrap(err, "parse MediaTypeImageConfig")
 		}
 		b.Data = parsed
@@ -116,6 +269,12 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 		return fmt.Errorf("cas blob: unsupported mediatype: %s", b.MediaType)
 	}
 
+	// The JSON decoder doesn't necessarily read until io.EOF, so we need to
+	// read the rest of the blob for it to be verified.
+	if _, err := io.Copy(ioutil.Discard, jsonReader); err != nil {
+		return errors.Wrap(err, "verify blob")
+	}
+
 	if b.Data == nil {
 		return fmt.Errorf("[internal error] b.Data was nil after parsing")
 	}
@@ -125,16 +284,18 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 
 // Close cleans up all of the resources for the opened blob.
 func (b *Blob) Close() {
-	switch b.MediaType {
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+	if IsLayerMediaType(b.MediaType) {
 		if b.Data != nil {
 			b.Data.(io.Closer).Close()
 		}
 	}
 }
 
-// FromDescriptor parses the blob referenced by the given descriptor.
+// FromDescriptor parses the blob referenced by the given descriptor. The
+// contents of the blob are verified against the descriptor (see
+// GetVerifiedBlob), though layers are only verified once they have been read
+// until io.EOF. A negative descriptor size means that the size of the blob is
+// not known.
 func (e Engine) FromDescriptor(ctx context.Context, descriptor ispec.Descriptor) (*Blob, error) {
 	blob := &Blob{
 		MediaType: descriptor.MediaType,
@@ -142,7 +303,7 @@ func (e Engine) FromDescriptor(ctx context.Context, descriptor ispec.Descriptor)
 		Data:      nil,
 	}
 
-	if err := blob.load(ctx, e); err != nil {
+	if err := blob.load(ctx, e, descriptor); err != nil {
 		return nil, errors.Wrap(err, "load")
 	}
 
@@ -0,0 +1,166 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestFromDescriptorMaxJSONBlobSize(t *testing.T) {
+	ctx := context.Background()
+
+	engine := NewEngine(mem.New())
+	defer engine.Close()
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %+v", err)
+	}
+
+	oldMax := MaxJSONBlobSize
+	defer func() { MaxJSONBlobSize = oldMax }()
+
+	for _, test := range []struct {
+		name    string
+		max     int64
+		size    int64
+		invalid bool
+	}{
+		{"WithinLimit", configSize, configSize, false},
+		{"TooLarge", configSize - 1, configSize, true},
+		{"UnknownSizeWithinLimit", configSize, -1, false},
+		{"UnknownSizeTooLarge", configSize - 1, -1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			MaxJSONBlobSize = test.max
+			blob, err := engine.FromDescriptor(ctx, ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      test.size,
+			})
+			if test.invalid {
+				if errors.Cause(err) != cas.ErrInvalid {
+					t.Errorf("expected cas.ErrInvalid, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FromDescriptor: unexpected error: %+v", err)
+			}
+			defer blob.Close()
+			if config := blob.Data.(ispec.Image); config.OS != "linux" {
+				t.Errorf("unexpected config: %v", config)
+			}
+		})
+	}
+}
+
+// putLargeManifest stores a manifest with the given number of layers (which
+// don't need to exist) and returns its descriptor.
+func putLargeManifest(b *testing.B, engine Engine, layers int) ispec.Descriptor {
+	var manifest ispec.Manifest
+	manifest.SchemaVersion = 2
+	for i := 0; i < layers; i++ {
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromString(fmt.Sprintf("layer %d", i)),
+			Size:      int64(i),
+		})
+	}
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		b.Fatalf("unexpected error putting manifest: %+v", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func BenchmarkFromDescriptor(b *testing.B) {
+	ctx := context.Background()
+
+	engine := NewEngine(mem.New())
+	defer engine.Close()
+	descriptor := putLargeManifest(b, engine, 10000)
+
+	b.ReportAllocs()
+	b.SetBytes(descriptor.Size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blob, err := engine.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			b.Fatal(err)
+		}
+		blob.Close()
+	}
+}
+
+func BenchmarkPutBlobJSON(b *testing.B) {
+	ctx := context.Background()
+
+	engine := NewEngine(mem.New())
+	defer engine.Close()
+	config := ispec.Image{OS: "linux", Architecture: "amd64"}
+	for i := 0; i < 1000; i++ {
+		config.History = append(config.History, ispec.History{CreatedBy: fmt.Sprintf("RUN step %d", i)})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := engine.PutBlobJSON(ctx, config); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLayerMediaTypes(t *testing.T) {
+	const registered = "application/vnd.opensuse.umoci.test.layer.v1.tar+lz4"
+	RegisterLayerMediaType(registered, false)
+	defer func() {
+		lm.Lock()
+		delete(extraLayerMediaTypes, registered)
+		lm.Unlock()
+	}()
+
+	mediaTypes := LayerMediaTypes()
+	if !sort.StringsAreSorted(mediaTypes) {
+		t.Errorf("LayerMediaTypes: expected sorted media types: got %v", mediaTypes)
+	}
+	found := false
+	for _, mediaType := range mediaTypes {
+		if !IsLayerMediaType(mediaType) {
+			t.Errorf("LayerMediaTypes: %q is not a layer media type", mediaType)
+		}
+		found = found || mediaType == registered
+	}
+	if !found {
+		t.Errorf("LayerMediaTypes: registered media type %q missing: got %v", registered, mediaTypes)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// BlobInfo describes a blob stored in an image, as well as how (and whether)
+// it is referenced by the rest of the image.
+type BlobInfo struct {
+	// Digest is the digest of the blob.
+	Digest digest.Digest
+
+	// Size is the size of the blob in bytes.
+	Size int64
+
+	// Reachable is whether the blob can be reached by following a
+	// descriptor path from any of the references in the image.
+	Reachable bool
+
+	// MediaTypes is the sorted set of media types of the descriptors which
+	// reference this blob. It is empty if the blob is not reachable. Because
+	// OCI blobs are not self-descriptive, it is possible (though unusual) for
+	// the same blob to be referenced with several media types.
+	MediaTypes []string
+}
+
+// BlobFilter is a predicate used to select which blobs are returned by
+// ListBlobInfo and WalkBlobs.
+type BlobFilter func(info BlobInfo) bool
+
+// MediaTypeFilter returns a BlobFilter which only matches blobs which are
+// referenced by a descriptor with one of the given media types. Note that
+// unreachable blobs never match, as their media type is unknown.
+func MediaTypeFilter(mediaTypes ...string) BlobFilter {
+	return func(info BlobInfo) bool {
+		for _, mediaType := range info.MediaTypes {
+			for _, want := range mediaTypes {
+				if mediaType == want {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// ReachableFilter returns a BlobFilter which only matches blobs whose
+// reachability is equal to the given value. ReachableFilter(false) matches
+// the set of blobs that would be removed by GC.
+func ReachableFilter(reachable bool) BlobFilter {
+	return func(info BlobInfo) bool {
+		return info.Reachable == reachable
+	}
+}
+
+// SizeFilter returns a BlobFilter which only matches blobs with a size in the
+// range [min, max]. A negative max is treated as having no upper bound.
+func SizeFilter(min, max int64) BlobFilter {
+	return func(info BlobInfo) bool {
+		return info.Size >= min && (max < 0 || info.Size <= max)
+	}
+}
+
+// BlobWalkFunc is the type of function passed to WalkBlobs. If an error is
+// returned, the walk is halted and the error is returned to the caller.
+type BlobWalkFunc func(info BlobInfo) error
+
+// roots returns the root set of descriptors in the image, which is the set of
+// descriptors referenced by each reference name.
+func (e Engine) roots(ctx context.Context) ([]ispec.Descriptor, error) {
+	var root []ispec.Descriptor
+
+	names, err := e.ListReferences(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get roots")
+	}
+
+	for _, name := range names {
+		// TODO: This code is no longer necessary once we have index.json.
+		descriptorPaths, err := e.ResolveReference(ctx, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get root %s", name)
+		}
+		if len(descriptorPaths) != 1 {
+			// TODO: Handle this more nicely.
+			return nil, errors.Errorf("tag is ambiguous: %s", name)
+		}
+		descriptor := descriptorPaths[0].Descriptor()
+		log.WithFields(log.Fields{
+			"name":   name,
+			"digest": descriptor.Digest,
+		}).Debugf("got reference")
+		root = append(root, descriptor)
+	}
+	return root, nil
+}
+
+// WalkBlobs calls walkFn for every blob stored in the image which matches all
+// of the given filters, in the order returned by ListBlobs. The reachability
+// and media types of each blob are computed by walking from every reference
+// in the image before walkFn is first called, so walkFn may safely modify the
+// set of blobs (for instance, by deleting the blob it was passed).
+func (e Engine) WalkBlobs(ctx context.Context, walkFn BlobWalkFunc, filters ...BlobFilter) error {
+	roots, err := e.roots(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Mark every reachable descriptor, recording its media types and size.
+	descriptors := map[digest.Digest][]ispec.Descriptor{}
+	for idx, root := range roots {
+		log.WithFields(log.Fields{
+			"digest": root.Digest,
+		}).Debugf("walk blobs: marking from root")
+
+		if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			descriptors[descriptor.Digest] = append(descriptors[descriptor.Digest], descriptor)
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "walk root %d", idx)
+		}
+	}
+
+	// The reflog entries are not referenced by any descriptor, but must be
+	// kept for as long as the index refers to them.
+	if err := e.WalkRefLog(ctx, func(entryDigest digest.Digest, _ RefLogEntry) error {
+		size, err := e.blobSize(ctx, entryDigest)
+		if err != nil {
+			return errors.Wrapf(err, "get size of reflog entry %s", entryDigest)
+		}
+		descriptors[entryDigest] = append(descriptors[entryDigest], ispec.Descriptor{
+			MediaType: MediaTypeRefLogEntry,
+			Digest:    entryDigest,
+			Size:      size,
+		})
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "walk reflog")
+	}
+
+	// Neither is the bundle list.
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	if listDigest := digest.Digest(index.Annotations[BundlesAnnotation]); listDigest != "" {
+		size, err := e.blobSize(ctx, listDigest)
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrapf(err, "get size of bundle list %s", listDigest)
+		}
+		if err == nil {
+			descriptors[listDigest] = append(descriptors[listDigest], ispec.Descriptor{
+				MediaType: MediaTypeBundleList,
+				Digest:    listDigest,
+				Size:      size,
+			})
+		}
+	}
+
+	blobs, err := e.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get blob list")
+	}
+
+	var infos []BlobInfo
+	for _, blobDigest := range blobs {
+		info := BlobInfo{Digest: blobDigest}
+
+		seen := map[string]struct{}{}
+		for _, descriptor := range descriptors[blobDigest] {
+			info.Reachable = true
+			info.Size = descriptor.Size
+			if _, ok := seen[descriptor.MediaType]; !ok {
+				seen[descriptor.MediaType] = struct{}{}
+				info.MediaTypes = append(info.MediaTypes, descriptor.MediaType)
+			}
+		}
+		sort.Strings(info.MediaTypes)
+
+		// Unreachable blobs have no descriptor, so we have to compute the
+		// size from the blob itself.
+		if !info.Reachable {
+			size, err := e.blobSize(ctx, blobDigest)
+			if err != nil {
+				return errors.Wrapf(err, "get size of blob %s", blobDigest)
+			}
+			info.Size = size
+		}
+
+		if matchFilters(info, filters) {
+			infos = append(infos, info)
+		}
+	}
+
+	for _, info := range infos {
+		if err := walkFn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBlobInfo returns the BlobInfo of every blob stored in the image which
+// matches all of the given filters. It is shorthand for WalkBlobs.
+func (e Engine) ListBlobInfo(ctx context.Context, filters ...BlobFilter) ([]BlobInfo, error) {
+	var infos []BlobInfo
+	err := e.WalkBlobs(ctx, func(info BlobInfo) error {
+		infos = append(infos, info)
+		return nil
+	}, filters...)
+	return infos, err
+}
+
+// matchFilters returns whether info matches every filter.
+func matchFilters(info BlobInfo, filters []BlobFilter) bool {
+	for _, filter := range filters {
+		if !filter(info) {
+			return false
+		}
+	}
+	return true
+}
+
+// blobSize returns the size of the blob with the given digest. If the engine
+// returns a reader which can be stat(2)ed (such as an *os.File) the size is
+// taken from there, otherwise the whole blob has to be read.
+func (e Engine) blobSize(ctx context.Context, blobDigest digest.Digest) (int64, error) {
+	reader, err := e.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return -1, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	if statter, ok := reader.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		if fi, err := statter.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size(), nil
+		}
+	}
+	return io.Copy(ioutil.Discard, reader)
+}
@@ -0,0 +1,155 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestListBlobInfo(t *testing.T) {
+	ctx := context.Background()
+
+	engine := NewEngine(mem.New())
+	defer engine.Close()
+
+	put := func(data string) (digest.Digest, int64) {
+		blobDigest, blobSize, err := engine.PutBlob(ctx, bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %s", err)
+		}
+		return blobDigest, blobSize
+	}
+
+	layerDigest, layerSize := put("a fake layer")
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, ispec.Image{})
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %s", err)
+	}
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{
+			{
+				MediaType: ispec.MediaTypeImageLayerGzip,
+				Digest:    layerDigest,
+				Size:      layerSize,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %s", err)
+	}
+	if err := engine.UpdateReference(ctx, "latest", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		t.Fatalf("unexpected error updating reference: %s", err)
+	}
+	garbageDigest, garbageSize := put(strings.Repeat("garbage", 4096))
+
+	for _, test := range []struct {
+		name     string
+		filters  []BlobFilter
+		expected []digest.Digest
+	}{
+		{"all", nil, []digest.Digest{layerDigest, configDigest, manifestDigest, garbageDigest}},
+		{"reachable", []BlobFilter{ReachableFilter(true)}, []digest.Digest{layerDigest, configDigest, manifestDigest}},
+		{"unreachable", []BlobFilter{ReachableFilter(false)}, []digest.Digest{garbageDigest}},
+		{"layers", []BlobFilter{MediaTypeFilter(ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip)}, []digest.Digest{layerDigest}},
+		{"manifest-or-config", []BlobFilter{MediaTypeFilter(ispec.MediaTypeImageManifest, ispec.MediaTypeImageConfig)}, []digest.Digest{configDigest, manifestDigest}},
+		{"large", []BlobFilter{SizeFilter(manifestSize+1, -1)}, []digest.Digest{garbageDigest}},
+		{"small", []BlobFilter{SizeFilter(0, configSize)}, []digest.Digest{layerDigest, configDigest}},
+		{"small-reachable-config", []BlobFilter{SizeFilter(0, configSize), ReachableFilter(true), MediaTypeFilter(ispec.MediaTypeImageConfig)}, []digest.Digest{configDigest}},
+	} {
+		infos, err := engine.ListBlobInfo(ctx, test.filters...)
+		if err != nil {
+			t.Errorf("%s: unexpected error listing blobs: %s", test.name, err)
+			continue
+		}
+
+		var got, expected []string
+		for _, info := range infos {
+			got = append(got, info.Digest.String())
+		}
+		for _, blobDigest := range test.expected {
+			expected = append(expected, blobDigest.String())
+		}
+		sort.Strings(got)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, expected, got)
+		}
+	}
+
+	// Make sure that the metadata is correct.
+	infos, err := engine.ListBlobInfo(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %s", err)
+	}
+	for _, info := range infos {
+		var expected BlobInfo
+		switch info.Digest {
+		case layerDigest:
+			expected = BlobInfo{layerDigest, layerSize, true, []string{ispec.MediaTypeImageLayerGzip}}
+		case configDigest:
+			expected = BlobInfo{configDigest, configSize, true, []string{ispec.MediaTypeImageConfig}}
+		case manifestDigest:
+			expected = BlobInfo{manifestDigest, manifestSize, true, []string{ispec.MediaTypeImageManifest}}
+		case garbageDigest:
+			expected = BlobInfo{garbageDigest, garbageSize, false, nil}
+		default:
+			t.Errorf("unexpected blob %s", info.Digest)
+			continue
+		}
+		if !reflect.DeepEqual(info, expected) {
+			t.Errorf("blob %s: expected %#v, got %#v", info.Digest, expected, info)
+		}
+	}
+
+	// GC should remove exactly the unreachable blobs.
+	if err := engine.GC(ctx); err != nil {
+		t.Fatalf("unexpected error during GC: %s", err)
+	}
+	infos, err = engine.ListBlobInfo(ctx, ReachableFilter(false))
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %s", err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("expected no unreachable blobs after GC, got %v", infos)
+	}
+	infos, err = engine.ListBlobInfo(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %s", err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("expected 3 blobs after GC, got %d", len(infos))
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// BundlesAnnotation is the annotation on the top-level index which
+	// contains the digest of the blob listing the bundles which have been
+	// unpacked from the image (a JSON list of BundleRecord). It is not
+	// present if no bundles have been recorded.
+	BundlesAnnotation = "org.opensuse.umoci.bundles"
+
+	// MediaTypeBundleList is the media type of the blob referenced by
+	// BundlesAnnotation. The blob is not referenced by any descriptor, but
+	// this media type is used to describe it in BlobInfo.
+	MediaTypeBundleList = "application/vnd.opensuse.umoci.bundles.v1+json"
+)
+
+// BundleRecord describes a bundle which was unpacked from an image.
+type BundleRecord struct {
+	// Path is the (absolute) path of the bundle.
+	Path string `json:"path"`
+
+	// Manifest is the digest of the manifest the bundle was unpacked from.
+	Manifest digest.Digest `json:"manifest"`
+
+	// RefName is the name of the reference which referred to the manifest
+	// when the bundle was unpacked.
+	RefName string `json:"ref_name,omitempty"`
+
+	// Time is when the bundle was unpacked.
+	Time time.Time `json:"time"`
+}
+
+// bundleList returns the bundles recorded in the given index. If the list has
+// been removed (such as by a tool unaware of it) no bundles are returned.
+func (e Engine) bundleList(ctx context.Context, index ispec.Index) ([]BundleRecord, error) {
+	listDigest := digest.Digest(index.Annotations[BundlesAnnotation])
+	if listDigest == "" {
+		return nil, nil
+	}
+
+	reader, err := e.GetVerifiedBlob(ctx, ispec.Descriptor{Digest: listDigest, Size: -1})
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get bundle list %s", listDigest)
+	}
+	defer reader.Close()
+
+	// Read the whole blob so that the digest is verified.
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read bundle list %s", listDigest)
+	}
+
+	var records []BundleRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, errors.Wrapf(err, "parse bundle list %s", listDigest)
+	}
+	return records, nil
+}
+
+// putBundleList stores the given bundles as the bundle list of the image,
+// replacing the existing list.
+func (e Engine) putBundleList(ctx context.Context, index ispec.Index, records []BundleRecord) error {
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+	if index.Annotations == nil {
+		index.Annotations = map[string]string{}
+	}
+	if len(records) == 0 {
+		delete(index.Annotations, BundlesAnnotation)
+	} else {
+		listDigest, _, err := e.PutBlobJSON(ctx, records)
+		if err != nil {
+			return errors.Wrap(err, "put bundle list")
+		}
+		index.Annotations[BundlesAnnotation] = listDigest.String()
+	}
+	return errors.Wrap(e.PutIndex(ctx, index), "replace index")
+}
+
+// Bundles returns every bundle recorded as having been unpacked from the
+// image, sorted by path.
+func (e Engine) Bundles(ctx context.Context) ([]BundleRecord, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+	return e.bundleList(ctx, index)
+}
+
+// AddBundle records that a bundle was unpacked from the image. Any existing
+// record of a bundle with the same path is replaced.
+func (e Engine) AddBundle(ctx context.Context, record BundleRecord) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	records, err := e.bundleList(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	var newRecords []BundleRecord
+	for _, old := range records {
+		if old.Path != record.Path {
+			newRecords = append(newRecords, old)
+		}
+	}
+	newRecords = append(newRecords, record)
+	return e.putBundleList(ctx, index, newRecords)
+}
+
+// RemoveBundles removes the records of the bundles with the given paths. It
+// is not an error if a path has no record. The bundles themselves are not
+// modified.
+func (e Engine) RemoveBundles(ctx context.Context, paths ...string) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	records, err := e.bundleList(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	remove := map[string]struct{}{}
+	for _, path := range paths {
+		remove[path] = struct{}{}
+	}
+	var newRecords []BundleRecord
+	for _, record := range records {
+		if _, ok := remove[record.Path]; !ok {
+			newRecords = append(newRecords, record)
+		}
+	}
+	if len(newRecords) == len(records) {
+		return nil
+	}
+	return e.putBundleList(ctx, index, newRecords)
+}
@@ -0,0 +1,127 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"golang.org/x/net/context"
+)
+
+func TestEngineBundles(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	a := putValidImage(t, engineExt, []byte("layer a"))
+	b := putValidImage(t, engineExt, []byte("layer b"))
+	if err := engineExt.UpdateReference(ctx, "tag", b); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	if records, err := engineExt.Bundles(ctx); err != nil || len(records) != 0 {
+		t.Errorf("Bundles: expected no bundles: got %v (%+v)", records, err)
+	}
+
+	now := time.Now().UTC()
+	for _, record := range []BundleRecord{
+		{Path: "/bundle/b", Manifest: a.Digest, RefName: "old", Time: now},
+		{Path: "/bundle/a", Manifest: a.Digest, RefName: "tag", Time: now},
+		// Replaces the first record.
+		{Path: "/bundle/b", Manifest: b.Digest, RefName: "tag", Time: now},
+	} {
+		if err := engineExt.AddBundle(ctx, record); err != nil {
+			t.Fatalf("AddBundle: unexpected error: %+v", err)
+		}
+	}
+
+	records, err := engineExt.Bundles(ctx)
+	if err != nil {
+		t.Fatalf("Bundles: unexpected error: %+v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Bundles: expected 2 bundles: got %v", records)
+	}
+	if records[0].Path != "/bundle/a" || records[0].Manifest != a.Digest {
+		t.Errorf("Bundles: unexpected first bundle: %v", records[0])
+	}
+	if records[1].Path != "/bundle/b" || records[1].Manifest != b.Digest || records[1].RefName != "tag" {
+		t.Errorf("Bundles: unexpected second bundle: %v", records[1])
+	}
+	if !records[1].Time.Equal(now) {
+		t.Errorf("Bundles: time not preserved: expected %s got %s", now, records[1].Time)
+	}
+
+	// GC must not remove the bundle list.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	if infos, err := engineExt.ListBlobInfo(ctx, MediaTypeFilter(MediaTypeBundleList)); err != nil {
+		t.Fatalf("ListBlobInfo: unexpected error: %+v", err)
+	} else if len(infos) != 1 {
+		t.Errorf("ListBlobInfo: expected one bundle list: got %v", infos)
+	}
+	if records, err := engineExt.Bundles(ctx); err != nil || len(records) != 2 {
+		t.Errorf("Bundles: expected 2 bundles after GC: got %v (%+v)", records, err)
+	}
+
+	// The list must survive changes to the references.
+	if err := engineExt.UpdateReference(ctx, "other", a); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	if err := engineExt.RemoveBundles(ctx, "/bundle/a", "/bundle/nonexistent"); err != nil {
+		t.Fatalf("RemoveBundles: unexpected error: %+v", err)
+	}
+	if records, err := engineExt.Bundles(ctx); err != nil || len(records) != 1 || records[0].Path != "/bundle/b" {
+		t.Errorf("Bundles: expected only /bundle/b after removal: got %v (%+v)", records, err)
+	}
+
+	// Removing the last bundle removes the annotation.
+	if err := engineExt.RemoveBundles(ctx, "/bundle/b"); err != nil {
+		t.Fatalf("RemoveBundles: unexpected error: %+v", err)
+	}
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if _, ok := index.Annotations[BundlesAnnotation]; ok {
+		t.Errorf("expected %s annotation to be removed", BundlesAnnotation)
+	}
+}
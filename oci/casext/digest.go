@@ -0,0 +1,107 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// blobProbe contains the fields used to determine the media type of a JSON
+// blob which doesn't have a descriptor.
+type blobProbe struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	MediaType     string             `json:"mediaType"`
+	Config        *ispec.Descriptor  `json:"config"`
+	Manifests     []ispec.Descriptor `json:"manifests"`
+}
+
+// ResolveDigest returns a descriptor for the manifest or index stored in the
+// blob with the given digest, so that blobs which are not referenced (or whose
+// descriptors are not known) can be referenced. The media type is taken from
+// the blob's "mediaType" field if it is present, otherwise it is inferred from
+// the fields of the blob. The blob is validated against the image-spec, and an
+// error is returned if it is not a valid manifest or index.
+func (e Engine) ResolveDigest(ctx context.Context, blobDigest digest.Digest) (ispec.Descriptor, error) {
+	if err := blobDigest.Validate(); err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "invalid digest %q", blobDigest)
+	}
+
+	got, size, err := e.hashBlob(ctx, blobDigest)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if got != blobDigest {
+		return ispec.Descriptor{}, invalidf("blob %s: digest mismatch: blob has %s", blobDigest, got)
+	}
+
+	reader, err := e.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "get blob %s", blobDigest)
+	}
+	var probe blobProbe
+	err = json.NewDecoder(reader).Decode(&probe)
+	reader.Close()
+	if err != nil {
+		return ispec.Descriptor{}, invalidf("blob %s is not a manifest or index: %v", blobDigest, err)
+	}
+
+	// Image configurations also have a "config" field, so only blobs with a
+	// valid schemaVersion are inferred to be manifests or indexes.
+	mediaType := probe.MediaType
+	if mediaType == "" && probe.SchemaVersion == 2 {
+		switch {
+		case probe.Config != nil:
+			mediaType = ispec.MediaTypeImageManifest
+		case probe.Manifests != nil:
+			mediaType = ispec.MediaTypeImageIndex
+		}
+	}
+
+	descriptor := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      size,
+	}
+	switch mediaType {
+	case ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex, MediaTypeDockerManifest, MediaTypeDockerManifestList:
+	default:
+		return ispec.Descriptor{}, invalidf("blob %s is not a manifest or index (media type %q)", blobDigest, mediaType)
+	}
+
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "parse blob %s", blobDigest)
+	}
+	defer blob.Close()
+
+	switch data := blob.Data.(type) {
+	case ispec.Manifest:
+		err = ValidateManifest(data)
+	case ispec.Index:
+		err = ValidateIndex(data)
+	}
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "blob %s", blobDigest)
+	}
+	return descriptor, nil
+}
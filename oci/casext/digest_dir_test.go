@@ -0,0 +1,141 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEngineResolveDigest(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineResolveDigest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	manifest := putValidImage(t, engineExt, []byte("layer"))
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{manifest},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+
+	// An index without any manifests is still an index.
+	emptyIndexDigest, _, err := engineExt.PutBlobJSON(ctx, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ispec.MediaTypeImageIndex,
+		"manifests":     []ispec.Descriptor{},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+
+	badManifestDigest, _, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: "not a media type",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %+v", err)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %+v", err)
+	}
+	configDigest := manifestBlob.Data.(ispec.Manifest).Config.Digest
+	manifestBlob.Close()
+
+	layerDigest, _, err := engineExt.PutBlob(ctx, bytes.NewBufferString("not json"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		digest    digest.Digest
+		mediaType string
+		size      int64
+	}{
+		{"Manifest", manifest.Digest, ispec.MediaTypeImageManifest, manifest.Size},
+		{"Index", indexDigest, ispec.MediaTypeImageIndex, indexSize},
+		{"EmptyIndex", emptyIndexDigest, ispec.MediaTypeImageIndex, -1},
+		{"BadManifest", badManifestDigest, "", 0},
+		{"Config", configDigest, "", 0},
+		{"Layer", layerDigest, "", 0},
+		{"Missing", digest.FromString("missing"), "", 0},
+		{"Invalid", "sha256:invalid", "", 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			descriptor, err := engineExt.ResolveDigest(ctx, test.digest)
+			if test.mediaType == "" {
+				if err == nil {
+					t.Errorf("expected error resolving %s: got %v", test.digest, descriptor)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error resolving %s: %+v", test.digest, err)
+			}
+			if descriptor.MediaType != test.mediaType || descriptor.Digest != test.digest {
+				t.Errorf("unexpected descriptor: got %v", descriptor)
+			}
+			if test.size >= 0 && descriptor.Size != test.size {
+				t.Errorf("unexpected size: got %d expected %d", descriptor.Size, test.size)
+			}
+		})
+	}
+
+	// Layers must be rejected as invalid (rather than as missing).
+	if _, err := engineExt.ResolveDigest(ctx, layerDigest); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected cas.ErrInvalid resolving layer: got %+v", err)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"github.com/apex/log"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Media types used by the Docker image manifest (version 2, schema 2) format.
+// The JSON structure of these blobs is the same as their OCI equivalents, so
+// they are parsed into the same types by FromDescriptor.
+const (
+	// MediaTypeDockerManifest is the media type of a Docker manifest. It is
+	// equivalent to ispec.MediaTypeImageManifest.
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// MediaTypeDockerManifestList is the media type of a Docker manifest
+	// list. It is equivalent to ispec.MediaTypeImageIndex.
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeDockerConfig is the media type of a Docker image
+	// configuration. It is equivalent to ispec.MediaTypeImageConfig.
+	MediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+)
+
+// IsManifestMediaType returns whether the media type is the media type of an
+// image manifest (either OCI or Docker).
+func IsManifestMediaType(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageManifest ||
+		mediaType == MediaTypeDockerManifest
+}
+
+// IsIndexMediaType returns whether the media type is the media type of an
+// image index (either an OCI index or a Docker manifest list).
+func IsIndexMediaType(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageIndex ||
+		mediaType == MediaTypeDockerManifestList
+}
+
+// IsConfigMediaType returns whether the media type is the media type of an
+// image configuration (either OCI or Docker).
+func IsConfigMediaType(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageConfig ||
+		mediaType == MediaTypeDockerConfig
+}
+
+// dockerToOCIMediaTypes maps Docker media types to their OCI equivalents.
+var dockerToOCIMediaTypes = map[string]string{
+	MediaTypeDockerManifest:     ispec.MediaTypeImageManifest,
+	MediaTypeDockerManifestList: ispec.MediaTypeImageIndex,
+	MediaTypeDockerConfig:       ispec.MediaTypeImageConfig,
+	MediaTypeDockerLayer:        ispec.MediaTypeImageLayer,
+	MediaTypeDockerLayerGzip:    ispec.MediaTypeImageLayerGzip,
+	MediaTypeDockerForeignLayer: ispec.MediaTypeImageLayerNonDistributableGzip,
+}
+
+// ociToDockerMediaTypes maps OCI media types to their Docker equivalents.
+// Not every OCI media type has a Docker equivalent (zstd-compressed layers and
+// uncompressed non-distributable layers do not).
+var ociToDockerMediaTypes = map[string]string{}
+
+func init() {
+	for docker, oci := range dockerToOCIMediaTypes {
+		ociToDockerMediaTypes[oci] = docker
+	}
+}
+
+// ManifestFormat is the format (set of media types) used for the manifests,
+// indexes and configurations of an image.
+type ManifestFormat int
+
+const (
+	// FormatOCI uses the media types defined by the image-spec.
+	FormatOCI ManifestFormat = iota
+
+	// FormatDocker uses the media types of the Docker image manifest
+	// (version 2, schema 2) format, for use with older registries and tools.
+	FormatDocker
+)
+
+// String returns the name of the format.
+func (f ManifestFormat) String() string {
+	switch f {
+	case FormatOCI:
+		return "oci"
+	case FormatDocker:
+		return "docker"
+	}
+	return "unknown"
+}
+
+// ParseManifestFormat returns the format with the given name ("oci" or
+// "docker").
+func ParseManifestFormat(name string) (ManifestFormat, error) {
+	switch name {
+	case "oci":
+		return FormatOCI, nil
+	case "docker":
+		return FormatDocker, nil
+	}
+	return 0, errors.Errorf("unknown manifest format: %q", name)
+}
+
+// ConvertMediaType returns the equivalent of the given media type in the
+// given format. Media types which are already in the requested format (or
+// which are not known) are returned unchanged, and an error is returned if
+// the media type has no equivalent in the requested format.
+func ConvertMediaType(mediaType string, format ManifestFormat) (string, error) {
+	switch format {
+	case FormatOCI:
+		if converted, ok := dockerToOCIMediaTypes[mediaType]; ok {
+			return converted, nil
+		}
+	case FormatDocker:
+		if converted, ok := ociToDockerMediaTypes[mediaType]; ok {
+			return converted, nil
+		}
+		if _, ok := dockerToOCIMediaTypes[mediaType]; !ok && IsLayerMediaType(mediaType) {
+			return "", errors.Errorf("media type %s has no docker equivalent", mediaType)
+		}
+	default:
+		return "", errors.Errorf("unknown manifest format: %v", format)
+	}
+	return mediaType, nil
+}
+
+// dockerManifest is the JSON structure of a Docker manifest, which is an OCI
+// manifest with a mandatory mediaType field.
+type dockerManifest struct {
+	MediaType string `json:"mediaType"`
+	ispec.Manifest
+}
+
+// dockerManifestList is the JSON structure of a Docker manifest list, which
+// is an OCI index with a mandatory mediaType field.
+type dockerManifestList struct {
+	MediaType string `json:"mediaType"`
+	ispec.Index
+}
+
+// ConvertManifest converts the manifest (or index) referenced by the given
+// descriptor to the given format, rewriting the media types of every
+// descriptor it references (and of any manifests referenced by an index). The
+// new blobs are stored in the image and the descriptor of the converted blob
+// is returned -- the caller is responsible for updating any references.
+// Layer and configuration blobs are not modified, as their contents are the
+// same in both formats.
+func (e Engine) ConvertManifest(ctx context.Context, descriptor ispec.Descriptor, format ManifestFormat) (ispec.Descriptor, error) {
+	mediaType, err := ConvertMediaType(descriptor.MediaType, format)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if !IsManifestMediaType(mediaType) && !IsIndexMediaType(mediaType) {
+		return ispec.Descriptor{}, errors.Errorf("cannot convert a non-manifest descriptor: invalid media type %q", descriptor.MediaType)
+	}
+
+	blob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	var newBlob interface{}
+	switch data := blob.Data.(type) {
+	case ispec.Manifest:
+		if data.Config.MediaType, err = ConvertMediaType(data.Config.MediaType, format); err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "convert config")
+		}
+		layers := make([]ispec.Descriptor, len(data.Layers))
+		for idx, layer := range data.Layers {
+			layers[idx] = layer
+			if layers[idx].MediaType, err = ConvertMediaType(layer.MediaType, format); err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "convert layer %s", layer.Digest)
+			}
+		}
+		data.Layers = layers
+		data.Versioned = ispecs.Versioned{SchemaVersion: 2}
+		newBlob = data
+		if format == FormatDocker {
+			newBlob = dockerManifest{MediaType: mediaType, Manifest: data}
+		}
+
+	case ispec.Index:
+		manifests := make([]ispec.Descriptor, len(data.Manifests))
+		for idx, manifest := range data.Manifests {
+			manifests[idx] = manifest
+			if !IsManifestMediaType(manifest.MediaType) && !IsIndexMediaType(manifest.MediaType) {
+				continue
+			}
+			converted, err := e.ConvertManifest(ctx, manifest, format)
+			if err != nil {
+				return ispec.Descriptor{}, errors.Wrapf(err, "convert manifest %s", manifest.Digest)
+			}
+			manifests[idx] = converted
+		}
+		data.Manifests = manifests
+		data.Versioned = ispecs.Versioned{SchemaVersion: 2}
+		newBlob = data
+		if format == FormatDocker {
+			newBlob = dockerManifestList{MediaType: mediaType, Index: data}
+		}
+
+	default:
+		return ispec.Descriptor{}, errors.Errorf("[internal error] unknown blob type: %s", blob.MediaType)
+	}
+
+	newDigest, newSize, err := e.PutBlobJSON(ctx, newBlob)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put converted blob")
+	}
+	log.WithFields(log.Fields{
+		"digest": newDigest,
+		"format": format,
+	}).Debugf("casext.ConvertManifest(%s) converted blob", descriptor.Digest)
+
+	converted := descriptor
+	converted.MediaType = mediaType
+	converted.Digest = newDigest
+	converted.Size = newSize
+	return converted, nil
+}
@@ -0,0 +1,179 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestConvertMediaType(t *testing.T) {
+	for _, test := range []struct {
+		mediaType string
+		format    ManifestFormat
+		expected  string
+		fail      bool
+	}{
+		{ispec.MediaTypeImageManifest, FormatDocker, MediaTypeDockerManifest, false},
+		{ispec.MediaTypeImageIndex, FormatDocker, MediaTypeDockerManifestList, false},
+		{ispec.MediaTypeImageConfig, FormatDocker, MediaTypeDockerConfig, false},
+		{ispec.MediaTypeImageLayerGzip, FormatDocker, MediaTypeDockerLayerGzip, false},
+		{ispec.MediaTypeImageLayerNonDistributableGzip, FormatDocker, MediaTypeDockerForeignLayer, false},
+		{MediaTypeDockerLayer, FormatDocker, MediaTypeDockerLayer, false},
+		{MediaTypeImageLayerZstd, FormatDocker, "", true},
+		{ispec.MediaTypeImageLayerNonDistributable, FormatDocker, "", true},
+		{MediaTypeDockerManifest, FormatOCI, ispec.MediaTypeImageManifest, false},
+		{MediaTypeDockerConfig, FormatOCI, ispec.MediaTypeImageConfig, false},
+		{MediaTypeDockerForeignLayer, FormatOCI, ispec.MediaTypeImageLayerNonDistributableGzip, false},
+		{MediaTypeImageLayerZstd, FormatOCI, MediaTypeImageLayerZstd, false},
+		{"application/x-unknown", FormatOCI, "application/x-unknown", false},
+		{"application/x-unknown", FormatDocker, "application/x-unknown", false},
+	} {
+		got, err := ConvertMediaType(test.mediaType, test.format)
+		if test.fail {
+			if err == nil {
+				t.Errorf("ConvertMediaType(%s, %v): expected error, got %s", test.mediaType, test.format, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ConvertMediaType(%s, %v): unexpected error: %+v", test.mediaType, test.format, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("ConvertMediaType(%s, %v): expected %s, got %s", test.mediaType, test.format, test.expected, got)
+		}
+	}
+}
+
+func TestEngineConvertManifest(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineConvertManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	manifest := putValidImage(t, engineExt, []byte("layer"))
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{manifest},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	index := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}
+
+	// Convert the index (and thus the manifest) to the Docker format.
+	dockerIndex, err := engineExt.ConvertManifest(ctx, index, FormatDocker)
+	if err != nil {
+		t.Fatalf("unexpected error converting index: %+v", err)
+	}
+	if dockerIndex.MediaType != MediaTypeDockerManifestList {
+		t.Errorf("converted index has unexpected media type: %s", dockerIndex.MediaType)
+	}
+	if err := engineExt.Validate(ctx, dockerIndex); err != nil {
+		t.Errorf("converted index is not valid: %+v", err)
+	}
+
+	// The manifest list must contain a mediaType field, and so must the
+	// manifests it references.
+	var probe blobProbe
+	reader, err := engineExt.GetBlob(ctx, dockerIndex.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting converted index: %+v", err)
+	}
+	err = json.NewDecoder(reader).Decode(&probe)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("unexpected error parsing converted index: %+v", err)
+	}
+	if probe.MediaType != MediaTypeDockerManifestList {
+		t.Errorf("converted index has unexpected mediaType field: %q", probe.MediaType)
+	}
+	if len(probe.Manifests) != 1 {
+		t.Fatalf("converted index has %d manifests", len(probe.Manifests))
+	}
+	dockerManifest := probe.Manifests[0]
+	if dockerManifest.MediaType != MediaTypeDockerManifest {
+		t.Errorf("converted manifest has unexpected media type: %s", dockerManifest.MediaType)
+	}
+	if resolved, err := engineExt.ResolveDigest(ctx, dockerManifest.Digest); err != nil {
+		t.Errorf("unexpected error resolving converted manifest: %+v", err)
+	} else if resolved.MediaType != MediaTypeDockerManifest {
+		t.Errorf("converted manifest has unexpected mediaType field: %q", resolved.MediaType)
+	}
+
+	blob, err := engineExt.FromDescriptor(ctx, dockerManifest)
+	if err != nil {
+		t.Fatalf("unexpected error parsing converted manifest: %+v", err)
+	}
+	parsed, ok := blob.Data.(ispec.Manifest)
+	blob.Close()
+	if !ok {
+		t.Fatalf("converted manifest was not parsed as a manifest: %T", blob.Data)
+	}
+	if parsed.Config.MediaType != MediaTypeDockerConfig {
+		t.Errorf("converted config has unexpected media type: %s", parsed.Config.MediaType)
+	}
+	if parsed.Layers[0].MediaType != MediaTypeDockerLayer {
+		t.Errorf("converted layer has unexpected media type: %s", parsed.Layers[0].MediaType)
+	}
+
+	// Converting back results in the same blobs.
+	ociIndex, err := engineExt.ConvertManifest(ctx, dockerIndex, FormatOCI)
+	if err != nil {
+		t.Fatalf("unexpected error converting index: %+v", err)
+	}
+	if ociIndex.MediaType != index.MediaType || ociIndex.Digest != index.Digest {
+		t.Errorf("round-tripped index doesn't match: expected %s (%s) got %s (%s)", index.Digest, index.MediaType, ociIndex.Digest, ociIndex.MediaType)
+	}
+
+	// Layers cannot be converted.
+	layer := parsed.Layers[0]
+	if _, err := engineExt.ConvertManifest(ctx, layer, FormatOCI); err == nil {
+		t.Errorf("expected error converting layer")
+	}
+}
@@ -0,0 +1,327 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// BlobResolver is a source of blobs outside of an image layout, such as peers
+// on the same network. Since blobs are content-addressable, the contents
+// returned by a BlobResolver do not need to be trusted -- they are verified
+// against the descriptor before being used.
+type BlobResolver interface {
+	// ResolveBlob returns the contents of the blob with the given
+	// descriptor. If the resolver doesn't have the blob, an error satisfying
+	// os.IsNotExist should be returned (possibly wrapped).
+	ResolveBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error)
+}
+
+// DeltaResolver is a BlobResolver which can transfer only the parts of a blob
+// which differ from a similar blob that is already present (the basis), such
+// as the previous version of a layer. As with ResolveBlob, the contents
+// returned are verified against the descriptor.
+type DeltaResolver interface {
+	BlobResolver
+
+	// ResolveBlobDelta returns the contents of the blob with the given
+	// descriptor, reconstructed from basis (which has size basisSize) and
+	// the parts of the blob which are not present in basis. basis must not
+	// be closed until the returned reader has been closed.
+	ResolveBlobDelta(ctx context.Context, descriptor ispec.Descriptor, basis io.ReaderAt, basisSize int64) (io.ReadCloser, error)
+}
+
+// openBasis opens the local blob with the given descriptor for use as the
+// basis of a delta transfer. ok is false if the blob cannot be used as a basis
+// (because it is missing or doesn't support random access).
+func (e Engine) openBasis(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, bool) {
+	reader, err := e.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		log.Debugf("cannot use %s as delta basis: %v", descriptor.Digest, err)
+		return nil, false
+	}
+	if _, ok := reader.(io.ReaderAt); !ok {
+		reader.Close()
+		return nil, false
+	}
+	return reader, true
+}
+
+// resolveBlob returns the contents of the blob with the given descriptor from
+// the resolver, using a delta transfer against basis (if it is not nil and
+// the resolver supports it). If the delta transfer fails, the entire blob is
+// requested instead.
+func (e Engine) resolveBlob(ctx context.Context, resolver BlobResolver, descriptor ispec.Descriptor, basis *ispec.Descriptor) (io.ReadCloser, error) {
+	if deltaResolver, ok := resolver.(DeltaResolver); ok && basis != nil {
+		if basisReader, ok := e.openBasis(ctx, *basis); ok {
+			reader, err := deltaResolver.ResolveBlobDelta(ctx, descriptor, basisReader.(io.ReaderAt), basis.Size)
+			if err == nil {
+				return &basisCloser{ReadCloser: reader, basis: basisReader}, nil
+			}
+			basisReader.Close()
+			log.Debugf("delta fetch %s (basis %s): %v", descriptor.Digest, basis.Digest, err)
+		}
+	}
+	return resolver.ResolveBlob(ctx, descriptor)
+}
+
+// basisCloser is an io.ReadCloser which also closes the basis of a delta
+// transfer when it is closed.
+type basisCloser struct {
+	io.ReadCloser
+	basis io.Closer
+}
+
+// Close implements io.Closer.
+func (c *basisCloser) Close() error {
+	err := c.ReadCloser.Close()
+	if err2 := c.basis.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// fetchBlob stores the blob with the given descriptor from the first of the
+// resolvers which has it, verifying its digest and size. If basis is not nil,
+// it is the descriptor of a local blob which is similar to the blob being
+// fetched, and is used for delta transfers.
+func (e Engine) fetchBlob(ctx context.Context, descriptor ispec.Descriptor, basis *ispec.Descriptor, resolvers []BlobResolver) error {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return errors.Wrap(err, "invalid digest")
+	}
+	for _, resolver := range resolvers {
+		reader, err := e.resolveBlob(ctx, resolver, descriptor, basis)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("fetch %s: %v", descriptor.Digest, err)
+			continue
+		}
+
+		_, _, err = e.PutBlob(ctx, cas.WithSizeHint(cas.NewVerifiedReadCloser(reader, descriptor), descriptor.Size))
+		reader.Close()
+		if err != nil {
+			// Try the next resolver, since this one might be misbehaving.
+			log.Warnf("fetch %s: %v", descriptor.Digest, err)
+			continue
+		}
+		return nil
+	}
+	return errors.Wrapf(os.ErrNotExist, "no resolver has blob %s", descriptor.Digest)
+}
+
+// FetchOptions configures how FetchMissingBlobs and SyncBlobs fetch blobs.
+type FetchOptions struct {
+	// MaxParallel is the largest number of layers (and other blobs which
+	// cannot contain descriptors) which are fetched at the same time.
+	// Manifests, indexes and configurations are always fetched one at a time,
+	// since they are needed to find the other blobs. Values less than 2 mean
+	// that every blob is fetched one at a time.
+	MaxParallel int
+}
+
+// FetchMissingBlobs walks the tree of blobs reachable from the given root
+// descriptor, and fetches every blob which is missing from the image layout
+// from the given resolvers (which are tried in order). Each blob is verified
+// before it is stored, and the blobs referenced by fetched manifests and
+// indexes are also fetched. Missing non-distributable layers are not fetched,
+// as images are not required to contain them. The digests of the fetched
+// blobs are returned, and an error is returned if any missing blob could not
+// be fetched. If layers are fetched in parallel (see FetchOptions), the order
+// of the returned digests is not deterministic.
+func (e Engine) FetchMissingBlobs(ctx context.Context, root ispec.Descriptor, resolvers []BlobResolver, opts FetchOptions) ([]digest.Digest, error) {
+	return e.fetchMissingBlobs(ctx, root, nil, resolvers, opts)
+}
+
+// fetchMissingBlobs implements FetchMissingBlobs, using the blobs in bases
+// (indexed by the digest of the blob they are similar to) as the basis of
+// delta transfers.
+func (e Engine) fetchMissingBlobs(ctx context.Context, root ispec.Descriptor, bases map[digest.Digest]ispec.Descriptor, resolvers []BlobResolver, opts FetchOptions) ([]digest.Digest, error) {
+	// Outstanding parallel fetches are cancelled if any fetch fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		slots    = make(chan struct{}, opts.MaxParallel)
+		lock     sync.Mutex
+		pending  = map[digest.Digest]struct{}{}
+		fetched  []digest.Digest
+		fetchErr error
+	)
+	fetch := func(descriptor ispec.Descriptor, basis *ispec.Descriptor) error {
+		if err := e.fetchBlob(ctx, descriptor, basis, resolvers); err != nil {
+			return errors.Wrapf(err, "fetch blob %s", descriptor.Digest)
+		}
+		log.Infof("fetched blob %s", descriptor.Digest)
+		lock.Lock()
+		fetched = append(fetched, descriptor.Digest)
+		lock.Unlock()
+		return nil
+	}
+
+	err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+
+		// The same blob might be reachable more than once, in which case it
+		// might already be being fetched.
+		lock.Lock()
+		_, isPending := pending[descriptor.Digest]
+		lock.Unlock()
+		if isPending {
+			return nil
+		}
+
+		reader, err := e.GetBlob(ctx, descriptor.Digest)
+		if err == nil {
+			reader.Close()
+			return nil
+		}
+		if !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrapf(err, "get blob %s", descriptor.Digest)
+		}
+		if descriptor.MediaType == ispec.MediaTypeImageLayerNonDistributable ||
+			descriptor.MediaType == ispec.MediaTypeImageLayerNonDistributableGzip {
+			return ErrSkipDescriptor
+		}
+
+		var basis *ispec.Descriptor
+		if base, ok := bases[descriptor.Digest]; ok {
+			basis = &base
+		}
+
+		// Walk doesn't read blobs which cannot contain descriptors, so they
+		// can be fetched in the background.
+		mediaType := descriptor.MediaType
+		if opts.MaxParallel < 2 || !(IsLayerMediaType(mediaType) || !isKnownMediaType(mediaType)) {
+			return fetch(descriptor, basis)
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if fetchErr != nil {
+			return fetchErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pending[descriptor.Digest] = struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := fetch(descriptor, basis); err != nil {
+				lock.Lock()
+				if fetchErr == nil {
+					fetchErr = err
+				}
+				lock.Unlock()
+				cancel()
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	if fetchErr != nil {
+		err = fetchErr
+	}
+	return fetched, err
+}
+
+// SyncBlobs is like FetchMissingBlobs, except that the image with the root
+// descriptor old (which must already be present in the image layout) is used
+// to reduce the amount of data transferred. If both old and new are manifests,
+// each missing layer of new is fetched using a delta transfer (with resolvers
+// which implement DeltaResolver) against the layer of old with the same index
+// and media type, so that refreshing a local mirror of an image only
+// transfers the parts of each layer which have changed. Delta transfers work
+// best with uncompressed layers, as small changes to the contents of a
+// compressed layer usually change most of the compressed data.
+func (e Engine) SyncBlobs(ctx context.Context, old, new ispec.Descriptor, resolvers []BlobResolver, opts FetchOptions) ([]digest.Digest, error) {
+	var fetched []digest.Digest
+
+	// The new manifest is needed to plan the delta transfers.
+	reader, err := e.GetBlob(ctx, new.Digest)
+	if err == nil {
+		reader.Close()
+	} else if os.IsNotExist(errors.Cause(err)) {
+		if err := e.fetchBlob(ctx, new, nil, resolvers); err != nil {
+			return nil, errors.Wrapf(err, "fetch blob %s", new.Digest)
+		}
+		log.Infof("fetched blob %s", new.Digest)
+		fetched = append(fetched, new.Digest)
+	} else {
+		return nil, errors.Wrapf(err, "get blob %s", new.Digest)
+	}
+
+	bases, err := e.deltaBases(ctx, old, new)
+	if err != nil {
+		return fetched, err
+	}
+	more, err := e.fetchMissingBlobs(ctx, new, bases, resolvers, opts)
+	return append(fetched, more...), err
+}
+
+// deltaBases returns the layers of the old manifest which should be used as
+// the basis for fetching each layer of the new manifest, indexed by the
+// digest of the new layer.
+func (e Engine) deltaBases(ctx context.Context, old, new ispec.Descriptor) (map[digest.Digest]ispec.Descriptor, error) {
+	if !IsManifestMediaType(old.MediaType) || !IsManifestMediaType(new.MediaType) {
+		return nil, nil
+	}
+
+	var manifests []ispec.Manifest
+	for _, descriptor := range []ispec.Descriptor{old, new} {
+		blob, err := e.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse manifest %s", descriptor.Digest)
+		}
+		manifest, ok := blob.Data.(ispec.Manifest)
+		blob.Close()
+		if !ok {
+			return nil, errors.Errorf("blob %s is not a manifest", descriptor.Digest)
+		}
+		manifests = append(manifests, manifest)
+	}
+	oldManifest, newManifest := manifests[0], manifests[1]
+
+	bases := map[digest.Digest]ispec.Descriptor{}
+	for idx, layer := range newManifest.Layers {
+		if idx >= len(oldManifest.Layers) {
+			break
+		}
+		basis := oldManifest.Layers[idx]
+		if basis.Digest != layer.Digest && basis.MediaType == layer.MediaType {
+			bases[layer.Digest] = basis
+		}
+	}
+	return bases, nil
+}
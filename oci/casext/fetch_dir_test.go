@@ -0,0 +1,285 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// engineResolver is a BlobResolver which resolves blobs from another image.
+type engineResolver struct {
+	engine Engine
+}
+
+func (r engineResolver) ResolveBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	return r.engine.GetBlob(ctx, descriptor.Digest)
+}
+
+// badResolver is a BlobResolver which returns the wrong contents for every
+// blob.
+type badResolver struct {
+	calls int
+}
+
+func (r *badResolver) ResolveBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	r.calls++
+	return ioutil.NopCloser(bytes.NewBufferString("bad contents")), nil
+}
+
+func TestEngineFetchMissingBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineFetchMissingBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var engines []Engine
+	for _, name := range []string{"src", "dst"} {
+		image := filepath.Join(root, name)
+		if err := cas.Create(image); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+		engine, err := cas.Open(image)
+		if err != nil {
+			t.Fatalf("unexpected error opening image: %+v", err)
+		}
+		defer engine.Close()
+		engines = append(engines, NewEngine(engine))
+	}
+	src, dst := engines[0], engines[1]
+
+	manifest := putValidImage(t, src, []byte("layer"))
+
+	// Nothing can be fetched without a resolver that has the blobs.
+	if _, err := dst.FetchMissingBlobs(ctx, manifest, nil, FetchOptions{}); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected not exist error without resolvers: got %+v", err)
+	}
+	bad := &badResolver{}
+	if _, err := dst.FetchMissingBlobs(ctx, manifest, []BlobResolver{bad}, FetchOptions{}); err == nil {
+		t.Errorf("expected error with only bad resolvers")
+	}
+	if blobs, err := dst.ListBlobs(ctx); err != nil || len(blobs) != 0 {
+		t.Errorf("expected bad blobs to not be stored: got %v (%+v)", blobs, err)
+	}
+
+	// The bad resolver must be skipped.
+	bad.calls = 0
+	fetched, err := dst.FetchMissingBlobs(ctx, manifest, []BlobResolver{bad, engineResolver{src}}, FetchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error fetching blobs: %+v", err)
+	}
+	if len(fetched) != 3 || bad.calls != 3 {
+		t.Errorf("expected 3 blobs to be fetched (with 3 bad calls): got %v (%d calls)", fetched, bad.calls)
+	}
+	if err := dst.Validate(ctx, manifest); err != nil {
+		t.Errorf("unexpected error validating fetched image: %+v", err)
+	}
+
+	// Fetching again is a no-op.
+	fetched, err = dst.FetchMissingBlobs(ctx, manifest, []BlobResolver{engineResolver{src}}, FetchOptions{})
+	if err != nil || len(fetched) != 0 {
+		t.Errorf("expected no blobs to be fetched: got %v (%+v)", fetched, err)
+	}
+}
+
+// slowResolver is a BlobResolver which resolves blobs from another image
+// slowly, and records the largest number of blobs resolved at the same time.
+type slowResolver struct {
+	engineResolver
+
+	lock      sync.Mutex
+	active    int
+	maxActive int
+	resolved  map[string]int
+}
+
+func (r *slowResolver) ResolveBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	r.lock.Lock()
+	r.active++
+	if r.active > r.maxActive {
+		r.maxActive = r.active
+	}
+	r.resolved[descriptor.Digest.String()]++
+	r.lock.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	r.lock.Lock()
+	r.active--
+	r.lock.Unlock()
+	return r.engineResolver.ResolveBlob(ctx, descriptor)
+}
+
+func TestEngineFetchMissingBlobsParallel(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineFetchMissingBlobsParallel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var engines []Engine
+	for _, name := range []string{"src", "dst"} {
+		image := filepath.Join(root, name)
+		if err := cas.Create(image); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+		engine, err := cas.Open(image)
+		if err != nil {
+			t.Fatalf("unexpected error opening image: %+v", err)
+		}
+		defer engine.Close()
+		engines = append(engines, NewEngine(engine))
+	}
+	src, dst := engines[0], engines[1]
+
+	// An index of several images (one of which is included twice, to make
+	// sure its layer is only fetched once).
+	var manifests []ispec.Descriptor
+	for _, layer := range []string{"layer1", "layer2", "layer3", "layer4"} {
+		manifests = append(manifests, putValidImage(t, src, []byte(layer)))
+	}
+	manifests = append(manifests, manifests[0])
+	indexDigest, indexSize, err := src.PutBlobJSON(ctx, ispec.Index{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Manifests: manifests,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	index := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}
+
+	resolver := &slowResolver{
+		engineResolver: engineResolver{src},
+		resolved:       map[string]int{},
+	}
+	fetched, err := dst.FetchMissingBlobs(ctx, index, []BlobResolver{resolver}, FetchOptions{MaxParallel: 2})
+	if err != nil {
+		t.Fatalf("unexpected error fetching blobs: %+v", err)
+	}
+	if len(fetched) != 13 {
+		t.Errorf("expected 13 blobs to be fetched: got %v", fetched)
+	}
+	for blob, count := range resolver.resolved {
+		if count != 1 {
+			t.Errorf("expected blob %s to be resolved once: resolved %d times", blob, count)
+		}
+	}
+	if resolver.maxActive != 2 {
+		t.Errorf("expected 2 blobs to be resolved at the same time: got %d", resolver.maxActive)
+	}
+	for _, manifest := range manifests {
+		if err := dst.Validate(ctx, manifest); err != nil {
+			t.Errorf("unexpected error validating fetched image: %+v", err)
+		}
+	}
+}
+
+// deltaResolver is a DeltaResolver which records the basis of each delta
+// transfer, and returns the blobs from another image.
+type deltaResolver struct {
+	engineResolver
+	fail  bool
+	bases []string
+}
+
+func (r *deltaResolver) ResolveBlobDelta(ctx context.Context, descriptor ispec.Descriptor, basis io.ReaderAt, basisSize int64) (io.ReadCloser, error) {
+	contents, err := ioutil.ReadAll(io.NewSectionReader(basis, 0, basisSize))
+	if err != nil {
+		return nil, err
+	}
+	r.bases = append(r.bases, string(contents))
+	if r.fail {
+		return nil, errors.New("delta transfer failed")
+	}
+	return r.ResolveBlob(ctx, descriptor)
+}
+
+func TestEngineSyncBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineSyncBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var engines []Engine
+	for _, name := range []string{"src", "dst"} {
+		image := filepath.Join(root, name)
+		if err := cas.Create(image); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+		engine, err := cas.Open(image)
+		if err != nil {
+			t.Fatalf("unexpected error opening image: %+v", err)
+		}
+		defer engine.Close()
+		engines = append(engines, NewEngine(engine))
+	}
+	src, dst := engines[0], engines[1]
+
+	old := putValidImage(t, src, []byte("old layer"))
+	if _, err := dst.FetchMissingBlobs(ctx, old, []BlobResolver{engineResolver{src}}, FetchOptions{}); err != nil {
+		t.Fatalf("unexpected error fetching old image: %+v", err)
+	}
+
+	for _, fail := range []bool{false, true} {
+		new := putValidImage(t, src, []byte("new layer"))
+		if fail {
+			new = putValidImage(t, src, []byte("newer layer"))
+		}
+
+		resolver := &deltaResolver{engineResolver: engineResolver{src}, fail: fail}
+		fetched, err := dst.SyncBlobs(ctx, old, new, []BlobResolver{resolver}, FetchOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error syncing image (fail=%v): %+v", fail, err)
+		}
+		if len(fetched) != 3 {
+			t.Errorf("expected 3 blobs to be fetched (fail=%v): got %v", fail, fetched)
+		}
+		// Only the layer has a basis, and failed delta transfers must fall
+		// back to fetching the entire blob.
+		if len(resolver.bases) != 1 || resolver.bases[0] != "old layer" {
+			t.Errorf("expected old layer to be the only basis (fail=%v): got %q", fail, resolver.bases)
+		}
+		if err := dst.Validate(ctx, new); err != nil {
+			t.Errorf("unexpected error validating synced image (fail=%v): %+v", fail, err)
+		}
+	}
+}
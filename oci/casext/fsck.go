@@ -0,0 +1,492 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// FsckIssueKind is the kind of a FsckIssue.
+type FsckIssueKind string
+
+const (
+	// FsckMisnamedBlob means that the contents of a blob do not match the
+	// digest it is stored under. It is repaired by storing the blob under
+	// the digest of its contents.
+	FsckMisnamedBlob FsckIssueKind = "misnamed-blob"
+
+	// FsckDanglingReference means that an entry in the top-level index
+	// refers to a blob which does not exist. It is repaired by removing the
+	// entry from the index.
+	FsckDanglingReference FsckIssueKind = "dangling-reference"
+
+	// FsckWrongSize means that the size of an entry in the top-level index
+	// does not match the size of the blob it refers to. It is repaired by
+	// updating the size in the index.
+	FsckWrongSize FsckIssueKind = "wrong-size"
+
+	// FsckMissingBlob means that a blob referenced by a manifest or index
+	// (other than the top-level index) does not exist. This cannot be
+	// repaired, because it would require modifying the referencing blob
+	// (which would change its digest).
+	FsckMissingBlob FsckIssueKind = "missing-blob"
+
+	// FsckOrphanManifest means that a manifest blob is not reachable from
+	// the top-level index. It is repaired by adding the manifest to the
+	// top-level index (see OrphanRefName). Orphans are only reported if
+	// FsckOptions.AdoptOrphans is set, as they are otherwise harmless.
+	FsckOrphanManifest FsckIssueKind = "orphan-manifest"
+
+	// FsckLegacyRefName means that an entry in the top-level index uses
+	// LegacyAnnotationRefName for its reference name. It is repaired by
+	// converting the entry to use "org.opencontainers.image.ref.name".
+	FsckLegacyRefName FsckIssueKind = "legacy-ref-name"
+
+	// FsckInvalidRefName means that the reference name of an entry in the
+	// top-level index does not conform to the image-layout specification.
+	// This cannot be repaired, because there is no way of picking a new name
+	// that the user would expect.
+	FsckInvalidRefName FsckIssueKind = "invalid-ref-name"
+)
+
+// FsckIssue describes a single problem found in an image layout.
+type FsckIssue struct {
+	// Kind is the kind of problem.
+	Kind FsckIssueKind `json:"kind"`
+
+	// Digest is the digest of the affected blob (or, for issues in the
+	// top-level index, the digest the index entry refers to).
+	Digest digest.Digest `json:"digest"`
+
+	// RefName is the reference name of the affected top-level index entry,
+	// if there is one.
+	RefName string `json:"ref_name,omitempty"`
+
+	// Old and New describe the problem and its repair. For FsckMisnamedBlob
+	// New is the digest of the contents, for FsckWrongSize they are the old
+	// and new sizes, and for FsckOrphanManifest New is the reference name the
+	// orphan was adopted under.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+
+	// Repaired is whether the problem was repaired.
+	Repaired bool `json:"repaired"`
+}
+
+// Repairable returns whether the issue can be repaired by Fsck.
+func (issue FsckIssue) Repairable() bool {
+	return issue.Kind != FsckMissingBlob && issue.Kind != FsckInvalidRefName
+}
+
+// String returns a human-readable description of the issue.
+func (issue FsckIssue) String() string {
+	var desc string
+	switch issue.Kind {
+	case FsckMisnamedBlob:
+		desc = fmt.Sprintf("blob %s has contents with digest %s", issue.Digest, issue.New)
+	case FsckDanglingReference:
+		desc = fmt.Sprintf("index entry refers to missing blob %s", issue.Digest)
+	case FsckWrongSize:
+		desc = fmt.Sprintf("index entry for blob %s has size %s but blob has size %s", issue.Digest, issue.Old, issue.New)
+	case FsckMissingBlob:
+		desc = fmt.Sprintf("blob %s is referenced by %s but is missing", issue.Digest, issue.Old)
+	case FsckLegacyRefName:
+		desc = fmt.Sprintf("index entry for blob %s uses legacy %s annotation", issue.Digest, LegacyAnnotationRefName)
+	case FsckInvalidRefName:
+		desc = fmt.Sprintf("index entry for blob %s has invalid reference name", issue.Digest)
+	case FsckOrphanManifest:
+		desc = fmt.Sprintf("manifest %s is not referenced", issue.Digest)
+		if issue.New != "" {
+			desc += fmt.Sprintf(" (adopting as %s)", issue.New)
+		}
+	default:
+		desc = fmt.Sprintf("%s: %s (%s -> %s)", issue.Kind, issue.Digest, issue.Old, issue.New)
+	}
+	if issue.RefName != "" {
+		desc = fmt.Sprintf("%s: %s", issue.RefName, desc)
+	}
+	return desc
+}
+
+// FsckOptions configures how Fsck checks (and repairs) an image layout.
+type FsckOptions struct {
+	// Repair causes any repairable problems to be repaired. Otherwise the
+	// image is not modified.
+	Repair bool
+
+	// AdoptOrphans causes manifests which are not reachable from the
+	// top-level index to be reported (and, if Repair is set, adopted).
+	AdoptOrphans bool
+
+	// Log, if non-nil, has a JSON record appended to it for every repair
+	// which is applied, so that there is a record of how the image was
+	// modified.
+	Log io.Writer
+}
+
+// fsckLogEntry is the record written to FsckOptions.Log for each repair.
+type fsckLogEntry struct {
+	Time time.Time `json:"time"`
+	FsckIssue
+}
+
+// OrphanRefName returns the reference name which an orphaned manifest with the
+// given digest is adopted under.
+func OrphanRefName(manifestDigest digest.Digest) string {
+	encoded := manifestDigest.Hex()
+	if len(encoded) > 12 {
+		encoded = encoded[:12]
+	}
+	return "lost-found-" + encoded
+}
+
+// fsckState stores the state of a single Fsck run.
+type fsckState struct {
+	engine Engine
+	opt    FsckOptions
+	issues []FsckIssue
+
+	// blobs is the set of (correctly-named) blobs in the image.
+	blobs map[digest.Digest]struct{}
+}
+
+// record records the given issue, logging it if it was repaired.
+func (fs *fsckState) record(issue FsckIssue) error {
+	fs.issues = append(fs.issues, issue)
+	if !issue.Repaired {
+		log.Warnf("fsck: %s", issue)
+		return nil
+	}
+	log.Infof("fsck: repaired: %s", issue)
+	if fs.opt.Log == nil {
+		return nil
+	}
+	data, err := json.Marshal(fsckLogEntry{
+		Time:      time.Now().UTC(),
+		FsckIssue: issue,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal fsck log entry")
+	}
+	_, err = fs.opt.Log.Write(append(data, '\n'))
+	return errors.Wrap(err, "write fsck log entry")
+}
+
+// checkBlobs finds (and renames) every blob whose contents don't match its
+// digest.
+func (fs *fsckState) checkBlobs(ctx context.Context) error {
+	blobs, err := fs.engine.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list blobs")
+	}
+
+	fs.blobs = map[digest.Digest]struct{}{}
+	for _, blobDigest := range blobs {
+		got, _, err := fs.engine.hashBlob(ctx, blobDigest)
+		if err != nil {
+			return err
+		}
+		if got == blobDigest {
+			fs.blobs[blobDigest] = struct{}{}
+			continue
+		}
+
+		issue := FsckIssue{
+			Kind:   FsckMisnamedBlob,
+			Digest: blobDigest,
+			New:    got.String(),
+		}
+		if fs.opt.Repair {
+			if err := fs.renameBlob(ctx, blobDigest, got); err != nil {
+				return errors.Wrapf(err, "rename blob %s", blobDigest)
+			}
+			fs.blobs[got] = struct{}{}
+			issue.Repaired = true
+		}
+		if err := fs.record(issue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameBlob stores the contents of the blob with the given digest under its
+// real digest, and then removes the misnamed blob.
+func (fs *fsckState) renameBlob(ctx context.Context, from, to digest.Digest) error {
+	reader, err := fs.engine.GetBlob(ctx, from)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	got, _, err := fs.engine.PutBlob(ctx, reader)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if got != to {
+		return errors.Errorf("blob changed while being renamed: expected %s got %s", to, got)
+	}
+	return errors.Wrap(fs.engine.DeleteBlob(ctx, from), "delete misnamed blob")
+}
+
+// checkIndex removes dangling entries in the top-level index, fixes the sizes
+// of the remaining entries, and converts legacy reference names.
+func (fs *fsckState) checkIndex(ctx context.Context) (ispec.Index, error) {
+	index, err := fs.engine.GetIndex(ctx)
+	if err != nil {
+		return ispec.Index{}, errors.Wrap(err, "get top-level index")
+	}
+
+	var manifests []ispec.Descriptor
+	changed := false
+	for _, descriptor := range index.Manifests {
+		issue := FsckIssue{
+			Digest:  descriptor.Digest,
+			RefName: descriptor.Annotations[ispec.AnnotationRefName],
+		}
+		if refname, ok := descriptor.Annotations[LegacyAnnotationRefName]; ok {
+			refIssue := issue
+			refIssue.Kind = FsckLegacyRefName
+			refIssue.RefName = refname
+			if fs.opt.Repair {
+				// This doesn't modify index.Manifests.
+				descriptor, _ = migrateReferenceName(descriptor)
+				issue.RefName = descriptor.Annotations[ispec.AnnotationRefName]
+				refIssue.Repaired = true
+				changed = true
+			}
+			if err := fs.record(refIssue); err != nil {
+				return ispec.Index{}, err
+			}
+		}
+		if refname, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+			if err := ValidateReferenceName(refname); err != nil {
+				refIssue := issue
+				refIssue.Kind = FsckInvalidRefName
+				refIssue.RefName = refname
+				if err := fs.record(refIssue); err != nil {
+					return ispec.Index{}, err
+				}
+			}
+		}
+		if _, ok := fs.blobs[descriptor.Digest]; !ok {
+			issue.Kind = FsckDanglingReference
+			if fs.opt.Repair {
+				issue.Repaired = true
+				changed = true
+			} else {
+				manifests = append(manifests, descriptor)
+			}
+			if err := fs.record(issue); err != nil {
+				return ispec.Index{}, err
+			}
+			continue
+		}
+
+		size, err := fs.engine.blobSize(ctx, descriptor.Digest)
+		if err != nil {
+			return ispec.Index{}, errors.Wrapf(err, "get size of blob %s", descriptor.Digest)
+		}
+		if size != descriptor.Size {
+			issue.Kind = FsckWrongSize
+			issue.Old = fmt.Sprintf("%d", descriptor.Size)
+			issue.New = fmt.Sprintf("%d", size)
+			if fs.opt.Repair {
+				descriptor.Size = size
+				issue.Repaired = true
+				changed = true
+			}
+			if err := fs.record(issue); err != nil {
+				return ispec.Index{}, err
+			}
+		}
+		manifests = append(manifests, descriptor)
+	}
+
+	index.Manifests = manifests
+	if changed {
+		if err := fs.engine.PutIndex(ctx, index); err != nil {
+			return ispec.Index{}, errors.Wrap(err, "put top-level index")
+		}
+	}
+	return index, nil
+}
+
+// checkReachable finds every blob referenced from the given index which is
+// missing, and returns the set of blobs reachable from the index.
+func (fs *fsckState) checkReachable(ctx context.Context, index ispec.Index) (map[digest.Digest]struct{}, error) {
+	reachable := map[digest.Digest]struct{}{}
+	for _, root := range index.Manifests {
+		if _, ok := fs.blobs[root.Digest]; !ok {
+			// Already reported as a dangling reference.
+			continue
+		}
+		// The size of the root was already checked (and reported) by
+		// checkIndex, and would otherwise stop the walk.
+		root.Size = -1
+		if err := fs.engine.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			if _, ok := fs.blobs[descriptor.Digest]; !ok {
+				// Non-distributable layers are permitted to be missing.
+				if IsNonDistributableMediaType(descriptor.MediaType) {
+					return ErrSkipDescriptor
+				}
+				parent := descriptorPath.Walk[len(descriptorPath.Walk)-2]
+				if err := fs.record(FsckIssue{
+					Kind:    FsckMissingBlob,
+					Digest:  descriptor.Digest,
+					RefName: root.Annotations[ispec.AnnotationRefName],
+					Old:     parent.Digest.String(),
+				}); err != nil {
+					return err
+				}
+				return ErrSkipDescriptor
+			}
+			reachable[descriptor.Digest] = struct{}{}
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "walk %s", root.Digest)
+		}
+	}
+	return reachable, nil
+}
+
+// parseOrphanManifest returns the size of the given blob, and whether it is a
+// manifest. Blobs which cannot be parsed are not manifests.
+func (fs *fsckState) parseOrphanManifest(ctx context.Context, blobDigest digest.Digest) (int64, bool, error) {
+	blob, err := fs.engine.FromDescriptor(ctx, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    blobDigest,
+		Size:      -1,
+	})
+	if err != nil {
+		return -1, false, nil
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok || manifest.SchemaVersion != 2 || !IsConfigMediaType(manifest.Config.MediaType) {
+		return -1, false, nil
+	}
+	size, err := fs.engine.blobSize(ctx, blobDigest)
+	return size, true, err
+}
+
+// adoptOrphans adds every manifest which is not reachable from the index to
+// the index.
+func (fs *fsckState) adoptOrphans(ctx context.Context, index ispec.Index, reachable map[digest.Digest]struct{}) error {
+	blobs, err := fs.engine.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list blobs")
+	}
+
+	changed := false
+	for _, blobDigest := range blobs {
+		if _, ok := reachable[blobDigest]; ok {
+			continue
+		}
+		if _, ok := fs.blobs[blobDigest]; !ok {
+			// Misnamed blobs cannot be referenced.
+			continue
+		}
+		size, ok, err := fs.parseOrphanManifest(ctx, blobDigest)
+		if err != nil {
+			return errors.Wrapf(err, "parse blob %s", blobDigest)
+		}
+		if !ok {
+			continue
+		}
+
+		issue := FsckIssue{
+			Kind:   FsckOrphanManifest,
+			Digest: blobDigest,
+			New:    OrphanRefName(blobDigest),
+		}
+		if fs.opt.Repair {
+			index.Manifests = append(index.Manifests, ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageManifest,
+				Digest:    blobDigest,
+				Size:      size,
+				Annotations: map[string]string{
+					ispec.AnnotationRefName: issue.New,
+				},
+			})
+			issue.Repaired = true
+			changed = true
+		}
+		if err := fs.record(issue); err != nil {
+			return err
+		}
+	}
+
+	if changed {
+		if err := fs.engine.PutIndex(ctx, index); err != nil {
+			return errors.Wrap(err, "put top-level index")
+		}
+	}
+	return nil
+}
+
+// Fsck checks the image layout for problems that make parts of the image
+// unusable, and (if opt.Repair is set) repairs them. Blobs whose contents do
+// not match their digest are renamed to the digest of their contents, entries
+// in the top-level index which refer to missing blobs are removed, and entries
+// whose size doesn't match their blob have their size corrected. Blobs which
+// are referenced by other blobs but are missing are reported, but cannot be
+// repaired. Entries using LegacyAnnotationRefName are converted, while entries
+// with invalid reference names are only reported. If opt.AdoptOrphans is set,
+// manifests that are not reachable from the top-level index are added to the
+// index (see OrphanRefName).
+//
+// Every problem found is returned, in the order it was found. Note that
+// renaming a blob can result in new dangling references, which are also
+// repaired. Fsck assumes it is the only user of the image that is making
+// modifications.
+func (e Engine) Fsck(ctx context.Context, opt FsckOptions) ([]FsckIssue, error) {
+	fs := &fsckState{
+		engine: e,
+		opt:    opt,
+	}
+
+	if err := fs.checkBlobs(ctx); err != nil {
+		return fs.issues, errors.Wrap(err, "check blobs")
+	}
+	index, err := fs.checkIndex(ctx)
+	if err != nil {
+		return fs.issues, errors.Wrap(err, "check index")
+	}
+	reachable, err := fs.checkReachable(ctx, index)
+	if err != nil {
+		return fs.issues, errors.Wrap(err, "check references")
+	}
+	if opt.AdoptOrphans {
+		if err := fs.adoptOrphans(ctx, index, reachable); err != nil {
+			return fs.issues, errors.Wrap(err, "adopt orphans")
+		}
+	}
+	return fs.issues, nil
+}
@@ -0,0 +1,246 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// fsckKinds returns the kinds of the given issues, in order.
+func fsckKinds(issues []FsckIssue) []FsckIssueKind {
+	var kinds []FsckIssueKind
+	for _, issue := range issues {
+		kinds = append(kinds, issue.Kind)
+	}
+	return kinds
+}
+
+func TestEngineFsck(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineFsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// A valid image.
+	good := putValidImage(t, engineExt, []byte("good layer"))
+	if err := engineExt.UpdateReference(ctx, "good", good); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// The same image, but with the wrong size.
+	badSize := good
+	badSize.Size++
+	if err := engineExt.UpdateReference(ctx, "bad-size", badSize); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// A reference to a blob which doesn't exist.
+	dangling := good
+	dangling.Digest = digest.FromString("does not exist")
+	if err := engineExt.UpdateReference(ctx, "dangling", dangling); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// An image which is missing its layer.
+	broken := putValidImage(t, engineExt, []byte("broken layer"))
+	if err := engineExt.DeleteBlob(ctx, digest.FromString("broken layer")); err != nil {
+		t.Fatalf("DeleteBlob: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "broken", broken); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// An image which isn't referenced.
+	orphan := putValidImage(t, engineExt, []byte("orphan layer"))
+
+	// A blob stored under the wrong digest.
+	misnamed := digest.FromString("misnamed")
+	misnamedPath := filepath.Join(image, "blobs", misnamed.Algorithm().String(), misnamed.Hex())
+	if err := ioutil.WriteFile(misnamedPath, []byte("renamed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []FsckIssueKind{FsckMisnamedBlob, FsckWrongSize, FsckDanglingReference, FsckMissingBlob, FsckOrphanManifest}
+
+	// Without repairing nothing should be modified.
+	issues, err := engineExt.Fsck(ctx, FsckOptions{AdoptOrphans: true})
+	if err != nil {
+		t.Fatalf("Fsck: unexpected error: %+v", err)
+	}
+	if kinds := fsckKinds(issues); !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Fsck: unexpected issues: got %v expected %v", kinds, expected)
+	}
+	for _, issue := range issues {
+		if issue.Repaired {
+			t.Errorf("Fsck: issue repaired without Repair: %s", issue)
+		}
+	}
+	if _, err := os.Stat(misnamedPath); err != nil {
+		t.Errorf("Fsck: misnamed blob modified without Repair: %v", err)
+	}
+
+	var log bytes.Buffer
+	issues, err = engineExt.Fsck(ctx, FsckOptions{
+		Repair:       true,
+		AdoptOrphans: true,
+		Log:          &log,
+	})
+	if err != nil {
+		t.Fatalf("Fsck: unexpected error: %+v", err)
+	}
+	if kinds := fsckKinds(issues); !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Fsck: unexpected issues: got %v expected %v", kinds, expected)
+	}
+	for _, issue := range issues {
+		if issue.Repaired != issue.Repairable() {
+			t.Errorf("Fsck: unexpected repair state: %s (repaired=%v)", issue, issue.Repaired)
+		}
+	}
+
+	// Every repair must have been logged.
+	dec := json.NewDecoder(&log)
+	var logged []FsckIssueKind
+	for dec.More() {
+		var entry fsckLogEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("unexpected error decoding log: %+v", err)
+		}
+		logged = append(logged, entry.Kind)
+	}
+	if expectedLogged := []FsckIssueKind{FsckMisnamedBlob, FsckWrongSize, FsckDanglingReference, FsckOrphanManifest}; !reflect.DeepEqual(logged, expectedLogged) {
+		t.Errorf("Fsck: unexpected log: got %v expected %v", logged, expectedLogged)
+	}
+
+	// Check the repairs.
+	if _, err := os.Stat(misnamedPath); !os.IsNotExist(err) {
+		t.Errorf("Fsck: misnamed blob still exists: %v", err)
+	}
+	if _, err := engineExt.GetBlob(ctx, digest.FromString("renamed")); err != nil {
+		t.Errorf("Fsck: renamed blob doesn't exist: %+v", err)
+	}
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	refs := map[string]ispec.Descriptor{}
+	for _, descriptor := range index.Manifests {
+		refs[descriptor.Annotations[ispec.AnnotationRefName]] = descriptor
+	}
+	if _, ok := refs["dangling"]; ok {
+		t.Errorf("Fsck: dangling reference still exists")
+	}
+	if refs["bad-size"].Size != good.Size {
+		t.Errorf("Fsck: size not repaired: got %d expected %d", refs["bad-size"].Size, good.Size)
+	}
+	if adopted := refs[OrphanRefName(orphan.Digest)]; adopted.Digest != orphan.Digest || adopted.Size != orphan.Size {
+		t.Errorf("Fsck: orphan not adopted: got %v expected %v", adopted, orphan)
+	}
+	if err := engineExt.Validate(ctx, refs["bad-size"]); err != nil {
+		t.Errorf("Fsck: repaired reference is invalid: %+v", err)
+	}
+
+	// Only the unrepairable issue should remain.
+	issues, err = engineExt.Fsck(ctx, FsckOptions{Repair: true, AdoptOrphans: true})
+	if err != nil {
+		t.Fatalf("Fsck: unexpected error: %+v", err)
+	}
+	if kinds, expected := fsckKinds(issues), []FsckIssueKind{FsckMissingBlob}; !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Fsck: unexpected issues after repair: got %v expected %v", kinds, expected)
+	}
+}
+
+func TestEngineFsckRefNames(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineFsckRefNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	manifest := putValidImage(t, engineExt, []byte("layer"))
+	legacy := manifest
+	legacy.Annotations = map[string]string{LegacyAnnotationRefName: "legacy"}
+	invalid := manifest
+	invalid.Annotations = map[string]string{ispec.AnnotationRefName: "-invalid"}
+
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting index: %+v", err)
+	}
+	index.Manifests = []ispec.Descriptor{legacy, invalid}
+	if err := engineExt.PutIndex(ctx, index); err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+
+	issues, err := engineExt.Fsck(ctx, FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatalf("Fsck: unexpected error: %+v", err)
+	}
+	if len(issues) != 2 {
+		t.Fatalf("Fsck: expected 2 issues: got %v", issues)
+	}
+	if issues[0].Kind != FsckLegacyRefName || issues[0].RefName != "legacy" || !issues[0].Repaired {
+		t.Errorf("Fsck: unexpected issue: %+v", issues[0])
+	}
+	if issues[1].Kind != FsckInvalidRefName || issues[1].RefName != "-invalid" || issues[1].Repaired || issues[1].Repairable() {
+		t.Errorf("Fsck: unexpected issue: %+v", issues[1])
+	}
+
+	if paths, err := engineExt.ResolveReference(ctx, "legacy"); err != nil || len(paths) != 1 {
+		t.Errorf("ResolveReference: expected migrated reference: got %v (%+v)", paths, err)
+	}
+}
@@ -19,8 +19,6 @@ package casext
 
 import (
 	"github.com/apex/log"
-	"github.com/opencontainers/go-digest"
-	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -36,66 +34,18 @@ import (
 // is making modifications. Things will not go well if this assumption is
 // challenged.
 func (e Engine) GC(ctx context.Context) error {
-	// Generate the root set of descriptors.
-	var root []ispec.Descriptor
-
-	names, err := e.ListReferences(ctx)
-	if err != nil {
-		return errors.Wrap(err, "get roots")
-	}
-
-	for _, name := range names {
-		// TODO: This code is no longer necessary once we have index.json.
-		descriptorPaths, err := e.ResolveReference(ctx, name)
-		if err != nil {
-			return errors.Wrapf(err, "get root %s", name)
-		}
-		if len(descriptorPaths) != 1 {
-			// TODO: Handle this more nicely.
-			return errors.Errorf("tag is ambiguous: %s", name)
-		}
-		descriptor := descriptorPaths[0].Descriptor()
-		log.WithFields(log.Fields{
-			"name":   name,
-			"digest": descriptor.Digest,
-		}).Debugf("GC: got reference")
-		root = append(root, descriptor)
-	}
-
-	// Mark from the root sets.
-	black := map[digest.Digest]struct{}{}
-	for idx, descriptor := range root {
-		log.WithFields(log.Fields{
-			"digest": descriptor.Digest,
-		}).Debugf("GC: marking from root")
-
-		reachables, err := e.Reachable(ctx, descriptor)
-		if err != nil {
-			return errors.Wrapf(err, "getting reachables from root %d", idx)
-		}
-		for _, reachable := range reachables {
-			black[reachable] = struct{}{}
-		}
-	}
-
-	// Sweep all blobs in the white set.
-	blobs, err := e.ListBlobs(ctx)
-	if err != nil {
-		return errors.Wrap(err, "get blob list")
-	}
-
+	// Mark from the root set, and sweep all blobs in the white set.
 	n := 0
-	for _, digest := range blobs {
-		if _, ok := black[digest]; ok {
-			// Digest is in the black set.
-			continue
-		}
-		log.Infof("garbage collecting blob: %s", digest)
+	if err := e.WalkBlobs(ctx, func(info BlobInfo) error {
+		log.Infof("garbage collecting blob: %s", info.Digest)
 
-		if err := e.DeleteBlob(ctx, digest); err != nil {
-			return errors.Wrapf(err, "remove unmarked blob %s", digest)
+		if err := e.DeleteBlob(ctx, info.Digest); err != nil {
+			return errors.Wrapf(err, "remove unmarked blob %s", info.Digest)
 		}
 		n++
+		return nil
+	}, ReachableFilter(false)); err != nil {
+		return err
 	}
 
 	// Finally, tell CAS to GC it.
@@ -20,12 +20,25 @@ package casext
 import (
 	"bytes"
 	"encoding/json"
+	"sync"
 
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// maxPooledJSONBuffer is the largest buffer which PutBlobJSON will return to
+// jsonBufferPool, so that a single huge blob doesn't stay in memory forever.
+const maxPooledJSONBuffer = 1 << 20
+
+// jsonBufferPool contains the *bytes.Buffers used by PutBlobJSON to encode
+// blobs, so that they don't have to be re-grown for every blob.
+var jsonBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
 // PutBlobJSON adds a new JSON blob to the image (marshalled from the given
 // interface). This is equivalent to calling PutBlob() with a JSON payload
 // as the reader. Note that due to intricacies in the Go JSON
@@ -37,9 +50,15 @@ import (
 //       map[...]... objects (which have their iteration order randomised in
 //       Go).
 func (e Engine) PutBlobJSON(ctx context.Context, data interface{}) (digest.Digest, int64, error) {
-	var buffer bytes.Buffer
-	if err := json.NewEncoder(&buffer).Encode(data); err != nil {
+	buffer := jsonBufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buffer.Cap() <= maxPooledJSONBuffer {
+			buffer.Reset()
+			jsonBufferPool.Put(buffer)
+		}
+	}()
+	if err := json.NewEncoder(buffer).Encode(data); err != nil {
 		return "", -1, errors.Wrap(err, "encode JSON")
 	}
-	return e.PutBlob(ctx, &buffer)
+	return e.PutBlob(ctx, buffer)
 }
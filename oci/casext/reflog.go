@@ -0,0 +1,212 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// RefLogAnnotation is the annotation on the top-level index which
+	// contains the digest of the most recent RefLogEntry blob. Each entry
+	// contains the digest of the entry before it, forming a chain of every
+	// change made to the references in the image. Changes are only recorded
+	// if the annotation is present (see EnableRefLog), and it is empty if no
+	// changes have been recorded yet.
+	RefLogAnnotation = "org.opensuse.umoci.reflog"
+
+	// MediaTypeRefLogEntry is the media type of RefLogEntry blobs. The
+	// entries are not referenced by any descriptor, but this media type is
+	// used to describe them in BlobInfo.
+	MediaTypeRefLogEntry = "application/vnd.opensuse.umoci.reflog.entry.v1+json"
+)
+
+// RefLogEntry describes a single change to a reference in an image.
+type RefLogEntry struct {
+	// Previous is the digest of the entry describing the previous change made
+	// to the image's references (to any reference), or "" if this is the
+	// first entry.
+	Previous digest.Digest `json:"previous,omitempty"`
+
+	// Time is when the change was made.
+	Time time.Time `json:"time"`
+
+	// User and Host are the name of the user who made the change, and the
+	// host they made it on.
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+
+	// Command is the command-line of the process which made the change.
+	Command []string `json:"command,omitempty"`
+
+	// RefName is the name of the reference which was changed.
+	RefName string `json:"ref_name"`
+
+	// Old and New are the digests the reference referred to before and after
+	// the change. Old is "" if the reference was created, and New is "" if
+	// the reference was deleted.
+	Old digest.Digest `json:"old,omitempty"`
+	New digest.Digest `json:"new,omitempty"`
+}
+
+// newRefLogEntry returns a RefLogEntry describing a change made by the current
+// process.
+func newRefLogEntry(refname string, old, new digest.Digest) RefLogEntry {
+	entry := RefLogEntry{
+		Time:    time.Now().UTC(),
+		Command: os.Args,
+		RefName: refname,
+		Old:     old,
+		New:     new,
+	}
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	} else {
+		entry.User = strconv.Itoa(os.Getuid())
+	}
+	if host, err := os.Hostname(); err == nil {
+		entry.Host = host
+	}
+	return entry
+}
+
+// referenceDigest returns the digest of the first entry in the index which
+// matches refname, or "" if there is no such entry.
+func referenceDigest(index ispec.Index, refname string) digest.Digest {
+	for _, descriptor := range index.Manifests {
+		if name, ok := referenceName(descriptor); ok && name == refname {
+			return descriptor.Digest
+		}
+	}
+	return ""
+}
+
+// appendRefLog records that refname changed from old to new in the reflog of
+// the given index, which must then be stored with PutIndex for the entry to
+// take effect. Nothing is recorded if the reference didn't change, or if the
+// reflog is not enabled.
+func (e Engine) appendRefLog(ctx context.Context, index *ispec.Index, refname string, old, new digest.Digest) error {
+	if _, ok := index.Annotations[RefLogAnnotation]; !ok || old == new {
+		return nil
+	}
+
+	entry := newRefLogEntry(refname, old, new)
+	entry.Previous = digest.Digest(index.Annotations[RefLogAnnotation])
+
+	entryDigest, _, err := e.PutBlobJSON(ctx, entry)
+	if err != nil {
+		return errors.Wrap(err, "put reflog entry")
+	}
+	index.Annotations[RefLogAnnotation] = entryDigest.String()
+	return nil
+}
+
+// RefLogEnabled returns whether changes to the image's references are recorded
+// in its reflog.
+func (e Engine) RefLogEnabled(ctx context.Context) (bool, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "get top-level index")
+	}
+	_, ok := index.Annotations[RefLogAnnotation]
+	return ok, nil
+}
+
+// EnableRefLog causes every subsequent change to the image's references (made
+// through UpdateReference, AddReferences or DeleteReference) to be recorded in
+// its reflog. It has no effect if the reflog is already enabled.
+func (e Engine) EnableRefLog(ctx context.Context) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	if _, ok := index.Annotations[RefLogAnnotation]; ok {
+		return nil
+	}
+	if index.Annotations == nil {
+		index.Annotations = map[string]string{}
+	}
+	index.Annotations[RefLogAnnotation] = ""
+	return errors.Wrap(e.PutIndex(ctx, index), "replace index")
+}
+
+// RefLogWalkFunc is the type of function passed to WalkRefLog. If an error is
+// returned, the walk is halted and the error is returned to the caller.
+type RefLogWalkFunc func(entryDigest digest.Digest, entry RefLogEntry) error
+
+// WalkRefLog calls walkFn for every entry in the image's reflog, from the most
+// recent change to the oldest. If an entry is missing (such as if it was
+// removed by a tool unaware of the reflog) the walk stops without an error.
+func (e Engine) WalkRefLog(ctx context.Context, walkFn RefLogWalkFunc) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+
+	entryDigest := digest.Digest(index.Annotations[RefLogAnnotation])
+	for entryDigest != "" {
+		reader, err := e.GetVerifiedBlob(ctx, ispec.Descriptor{Digest: entryDigest, Size: -1})
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "get reflog entry %s", entryDigest)
+		}
+		// Read the whole blob so that the digest is verified.
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "read reflog entry %s", entryDigest)
+		}
+
+		var entry RefLogEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return errors.Wrapf(err, "parse reflog entry %s", entryDigest)
+		}
+
+		if err := walkFn(entryDigest, entry); err != nil {
+			return err
+		}
+		entryDigest = entry.Previous
+	}
+	return nil
+}
+
+// RefLog returns every change made to the reference with the given name, from
+// the most recent change to the oldest. If refname is "", changes to every
+// reference are returned.
+func (e Engine) RefLog(ctx context.Context, refname string) ([]RefLogEntry, error) {
+	var entries []RefLogEntry
+	err := e.WalkRefLog(ctx, func(_ digest.Digest, entry RefLogEntry) error {
+		if refname == "" || entry.RefName == refname {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestEngineRefLog(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineRefLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	a := putValidImage(t, engineExt, []byte("layer a"))
+	b := putValidImage(t, engineExt, []byte("layer b"))
+
+	// Changes made before the reflog is enabled are not recorded.
+	if err := engineExt.UpdateReference(ctx, "untracked", a); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if entries, err := engineExt.RefLog(ctx, ""); err != nil {
+		t.Fatalf("RefLog: unexpected error: %+v", err)
+	} else if len(entries) != 0 {
+		t.Errorf("RefLog: expected no entries before enabling: got %v", entries)
+	}
+
+	if enabled, err := engineExt.RefLogEnabled(ctx); err != nil || enabled {
+		t.Errorf("RefLogEnabled: expected reflog to be disabled: got %v (%+v)", enabled, err)
+	}
+	if err := engineExt.EnableRefLog(ctx); err != nil {
+		t.Fatalf("EnableRefLog: unexpected error: %+v", err)
+	}
+	if enabled, err := engineExt.RefLogEnabled(ctx); err != nil || !enabled {
+		t.Errorf("RefLogEnabled: expected reflog to be enabled: got %v (%+v)", enabled, err)
+	}
+
+	if err := engineExt.UpdateReference(ctx, "tag", a); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	// Unchanged references are not recorded.
+	if err := engineExt.UpdateReference(ctx, "tag", a); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "other", b); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "tag", b); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.DeleteReference(ctx, "tag"); err != nil {
+		t.Fatalf("DeleteReference: unexpected error: %+v", err)
+	}
+
+	for _, test := range []struct {
+		refname  string
+		expected [][2]digest.Digest
+	}{
+		{"tag", [][2]digest.Digest{{b.Digest, ""}, {a.Digest, b.Digest}, {"", a.Digest}}},
+		{"other", [][2]digest.Digest{{"", b.Digest}}},
+		{"untracked", nil},
+		{"", [][2]digest.Digest{{b.Digest, ""}, {a.Digest, b.Digest}, {"", b.Digest}, {"", a.Digest}}},
+	} {
+		entries, err := engineExt.RefLog(ctx, test.refname)
+		if err != nil {
+			t.Errorf("RefLog(%q): unexpected error: %+v", test.refname, err)
+			continue
+		}
+		if len(entries) != len(test.expected) {
+			t.Errorf("RefLog(%q): expected %d entries, got %d: %v", test.refname, len(test.expected), len(entries), entries)
+			continue
+		}
+		for idx, entry := range entries {
+			if entry.Old != test.expected[idx][0] || entry.New != test.expected[idx][1] {
+				t.Errorf("RefLog(%q): entry %d: expected %v, got %s -> %s", test.refname, idx, test.expected[idx], entry.Old, entry.New)
+			}
+			if entry.Time.IsZero() || entry.User == "" || len(entry.Command) == 0 {
+				t.Errorf("RefLog(%q): entry %d is missing information: %#v", test.refname, idx, entry)
+			}
+		}
+	}
+
+	// GC must not remove the reflog.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	if entries, err := engineExt.RefLog(ctx, ""); err != nil {
+		t.Fatalf("RefLog: unexpected error: %+v", err)
+	} else if len(entries) != 4 {
+		t.Errorf("RefLog: expected 4 entries after GC: got %d", len(entries))
+	}
+	infos, err := engineExt.ListBlobInfo(ctx, MediaTypeFilter(MediaTypeRefLogEntry))
+	if err != nil {
+		t.Fatalf("ListBlobInfo: unexpected error: %+v", err)
+	}
+	if len(infos) != 4 {
+		t.Errorf("ListBlobInfo: expected 4 reflog entries: got %d", len(infos))
+	}
+
+	// The reflog must survive changes to the index that aren't made through
+	// the reference interfaces.
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if index.Annotations[RefLogAnnotation] == "" {
+		t.Errorf("expected index to have %s annotation", RefLogAnnotation)
+	}
+	if ref := index.Manifests[0].Annotations[ispec.AnnotationRefName]; ref != "untracked" {
+		t.Errorf("unexpected first reference: %q", ref)
+	}
+}
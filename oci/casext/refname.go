@@ -18,23 +18,85 @@
 package casext
 
 import (
+	"regexp"
+
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// LegacyAnnotationRefName is the annotation used for reference names by
+// versions of the image-spec before 1.0.0-rc6. Images created by older tools
+// may still use it, and can be converted with MigrateReferences. Until then,
+// entries using it are treated as if they used
+// "org.opencontainers.image.ref.name".
+const LegacyAnnotationRefName = "org.opencontainers.ref.name"
+
+// referenceName returns the reference name of an entry in the top-level
+// index, falling back to LegacyAnnotationRefName if the entry doesn't have an
+// "org.opencontainers.image.ref.name" annotation.
+func referenceName(descriptor ispec.Descriptor) (string, bool) {
+	if refname, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+		return refname, true
+	}
+	refname, ok := descriptor.Annotations[LegacyAnnotationRefName]
+	return refname, ok
+}
+
+// migrateReferenceName returns a copy of the given entry in the top-level
+// index which uses the "org.opencontainers.image.ref.name" annotation rather
+// than LegacyAnnotationRefName, and whether the entry had to be converted. If
+// the entry has both annotations, only the legacy annotation is removed.
+func migrateReferenceName(descriptor ispec.Descriptor) (ispec.Descriptor, bool) {
+	refname, ok := descriptor.Annotations[LegacyAnnotationRefName]
+	if !ok {
+		return descriptor, false
+	}
+	// Copy the annotations, so that the original descriptor is unmodified.
+	annotations := map[string]string{}
+	for key, value := range descriptor.Annotations {
+		annotations[key] = value
+	}
+	if _, ok := annotations[ispec.AnnotationRefName]; !ok {
+		annotations[ispec.AnnotationRefName] = refname
+	}
+	delete(annotations, LegacyAnnotationRefName)
+	descriptor.Annotations = annotations
+	return descriptor, true
+}
+
+// RefNameRegexp matches valid values of the
+// "org.opencontainers.image.ref.name" annotation, as defined by the
+// image-layout specification. Reference names are made of components
+// separated by "/", and each component is made of alphanumeric strings joined
+// by one of "-._:@+" or "--". This means that both "latest" and
+// "opensuse/leap:42.3" are valid reference names.
+//
+// Unlike the specification, any number of "_" can also be used to join
+// alphanumeric strings (such as "foo__bar"), as older versions of umoci (and
+// Docker) permitted them in tags.
+var RefNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]+(?:(?:[-.:@+]|--|_+)[A-Za-z0-9]+)*(?:/[A-Za-z0-9]+(?:(?:[-.:@+]|--|_+)[A-Za-z0-9]+)*)*$`)
+
+// ValidateReferenceName checks that the given reference name conforms to the
+// image-layout specification.
+func ValidateReferenceName(refname string) error {
+	if !RefNameRegexp.MatchString(refname) {
+		return invalidf("invalid reference name %q", refname)
+	}
+	return nil
+}
+
 // isKnownMediaType returns whether a media type is known by the spec. This
 // probably should be moved somewhere else to avoid going out of date.
 func isKnownMediaType(mediaType string) bool {
 	return mediaType == ispec.MediaTypeDescriptor ||
-		mediaType == ispec.MediaTypeImageManifest ||
-		mediaType == ispec.MediaTypeImageIndex ||
-		mediaType == ispec.MediaTypeImageLayer ||
-		mediaType == ispec.MediaTypeImageLayerGzip ||
-		mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
-		mediaType == ispec.MediaTypeImageConfig
+		IsManifestMediaType(mediaType) ||
+		IsIndexMediaType(mediaType) ||
+		IsLayerMediaType(mediaType) ||
+		IsConfigMediaType(mediaType)
 }
 
 // ResolveReference will attempt to resolve all possible descriptor paths to
@@ -42,7 +104,8 @@ func isKnownMediaType(mediaType string) bool {
 // descriptors are stored in non-standard blobs, Resolve will be unable to find
 // them but will return the top-most unknown descriptor).
 // ResolveReference assumes that "reference name" refers to the value of the
-// "org.opencontainers.image.ref.name" descriptor annotation. It is recommended
+// "org.opencontainers.image.ref.name" descriptor annotation (or of
+// LegacyAnnotationRefName for entries which don't have it). It is recommended
 // that if the returned slice of descriptors is greater than zero that the user
 // be consulted to resolve the conflict (due to ambiguity in resolution paths).
 //
@@ -63,7 +126,7 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 	// restriction in 1.0.0-rc6.
 	for _, descriptor := range index.Manifests {
 		// XXX: What should we do if refname == "".
-		if descriptor.Annotations[ispec.AnnotationRefName] == refname {
+		if name, ok := referenceName(descriptor); ok && name == refname {
 			roots = append(roots, descriptor)
 		}
 	}
@@ -78,8 +141,8 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 
 			// It is very important that we do not ignore unknown media types
 			// here. We only recurse into mediaTypes that are *known* and are
-			// also not ispec.MediaTypeImageManifest.
-			if isKnownMediaType(descriptor.MediaType) && descriptor.MediaType != ispec.MediaTypeImageManifest {
+			// also not manifests (see IsManifestMediaType).
+			if isKnownMediaType(descriptor.MediaType) && !IsManifestMediaType(descriptor.MediaType) {
 				return nil
 			}
 
@@ -102,20 +165,59 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 //      removes ambiguity with regards to which root needs to be operated on.
 //      If a user has that information we should provide them a way to use it.
 
+// ErrReferenceChanged is returned by SwapReference if the reference doesn't
+// refer to the expected blob, because it was modified concurrently.
+var ErrReferenceChanged = errors.New("reference was modified concurrently")
+
 // UpdateReference replaces an existing entry for refname with the given
 // descriptor. If there are multiple descriptors that match the refname they
-// are all replaced with the given descriptor.
+// are all replaced with the given descriptor. Any signature of the descriptor
+// (see SignatureAnnotation) is not kept.
 func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor ispec.Descriptor) error {
+	return e.swapReference(ctx, refname, nil, descriptor)
+}
+
+// SwapReference is a compare-and-swap version of UpdateReference, which only
+// replaces the entries for refname if refname currently refers to the blob
+// with the digest old (if there are multiple entries, the first is used). An
+// empty old digest means that refname must not exist. Otherwise,
+// ErrReferenceChanged is returned and the index is not modified, so that
+// callers can detect concurrent modifications of the reference and retry.
+//
+// The check and update are atomic with respect to other reference updates if
+// the underlying cas.Engine implements cas.IndexLocker.
+func (e Engine) SwapReference(ctx context.Context, refname string, old digest.Digest, descriptor ispec.Descriptor) error {
+	return e.swapReference(ctx, refname, &old, descriptor)
+}
+
+// swapReference implements UpdateReference and SwapReference. If old is nil,
+// the current value of the reference is not checked.
+func (e Engine) swapReference(ctx context.Context, refname string, old *digest.Digest, descriptor ispec.Descriptor) error {
+	if err := ValidateReferenceName(refname); err != nil {
+		return err
+	}
+
+	unlock, err := cas.LockIndex(ctx, e.Engine)
+	if err != nil {
+		return errors.Wrap(err, "lock top-level index")
+	}
+	defer unlock()
+
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
 	if err != nil {
 		return errors.Wrap(err, "get top-level index")
 	}
+	if old != nil {
+		if current := referenceDigest(index, refname); current != *old {
+			return errors.Wrapf(ErrReferenceChanged, "%s refers to %q rather than %q", refname, current, *old)
+		}
+	}
 
 	// TODO: Handle refname = "".
 	var newIndex []ispec.Descriptor
 	for _, descriptor := range index.Manifests {
-		if descriptor.Annotations[ispec.AnnotationRefName] != refname {
+		if name, ok := referenceName(descriptor); !ok || name != refname {
 			newIndex = append(newIndex, descriptor)
 		}
 	}
@@ -124,13 +226,20 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 		log.Warn("multiple references match the given reference name -- all of them have been replaced due to this ambiguity")
 	}
 
-	// Append the descriptor.
+	// Append the descriptor. Any signature is dropped, since descriptors
+	// are usually derived from the descriptor of the blob being replaced.
 	if descriptor.Annotations == nil {
 		descriptor.Annotations = map[string]string{}
 	}
+	delete(descriptor.Annotations, SignatureAnnotation)
 	descriptor.Annotations[ispec.AnnotationRefName] = refname
 	newIndex = append(newIndex, descriptor)
 
+	// Record the change.
+	if err := e.appendRefLog(ctx, &index, refname, referenceDigest(index, refname), descriptor.Digest); err != nil {
+		return errors.Wrap(err, "update reflog")
+	}
+
 	// Commit to image.
 	index.Manifests = newIndex
 	if err := e.PutIndex(ctx, index); err != nil {
@@ -149,6 +258,15 @@ func (e Engine) AddReferences(ctx context.Context, refname string, descriptors .
 		// Nothing to do.
 		return nil
 	}
+	if err := ValidateReferenceName(refname); err != nil {
+		return err
+	}
+
+	unlock, err := cas.LockIndex(ctx, e.Engine)
+	if err != nil {
+		return errors.Wrap(err, "lock top-level index")
+	}
+	defer unlock()
 
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
@@ -172,6 +290,11 @@ func (e Engine) AddReferences(ctx context.Context, refname string, descriptors .
 		convertedDescriptors = append(convertedDescriptors, descriptor)
 	}
 
+	// Record the change.
+	if err := e.appendRefLog(ctx, &index, refname, referenceDigest(index, refname), descriptors[0].Digest); err != nil {
+		return errors.Wrap(err, "update reflog")
+	}
+
 	// Commit to image.
 	index.Manifests = append(index.Manifests, convertedDescriptors...)
 	if err := e.PutIndex(ctx, index); err != nil {
@@ -183,6 +306,12 @@ func (e Engine) AddReferences(ctx context.Context, refname string, descriptors .
 // DeleteReference removes all entries in the index that match the given
 // refname.
 func (e Engine) DeleteReference(ctx context.Context, refname string) error {
+	unlock, err := cas.LockIndex(ctx, e.Engine)
+	if err != nil {
+		return errors.Wrap(err, "lock top-level index")
+	}
+	defer unlock()
+
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
 	if err != nil {
@@ -192,7 +321,7 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 	// TODO: Handle refname = "".
 	var newIndex []ispec.Descriptor
 	for _, descriptor := range index.Manifests {
-		if descriptor.Annotations[ispec.AnnotationRefName] != refname {
+		if name, ok := referenceName(descriptor); !ok || name != refname {
 			newIndex = append(newIndex, descriptor)
 		}
 	}
@@ -201,6 +330,11 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 		log.Warn("multiple references match the given reference name -- all of them have been deleted due to this ambiguity")
 	}
 
+	// Record the change.
+	if err := e.appendRefLog(ctx, &index, refname, referenceDigest(index, refname), ""); err != nil {
+		return errors.Wrap(err, "update reflog")
+	}
+
 	// Commit to image.
 	index.Manifests = newIndex
 	if err := e.PutIndex(ctx, index); err != nil {
@@ -210,7 +344,7 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 }
 
 // ListReferences returns all of the ref.name entries that are specified in the
-// top-level index. Note that the list may contain duplicates, due to the
+// top-level index (including those using LegacyAnnotationRefName). Note that the list may contain duplicates, due to the
 // nature of references in the image-spec.
 func (e Engine) ListReferences(ctx context.Context) ([]string, error) {
 	// Get index.
@@ -221,10 +355,43 @@ func (e Engine) ListReferences(ctx context.Context) ([]string, error) {
 
 	var refs []string
 	for _, descriptor := range index.Manifests {
-		ref, ok := descriptor.Annotations[ispec.AnnotationRefName]
+		ref, ok := referenceName(descriptor)
 		if ok {
 			refs = append(refs, ref)
 		}
 	}
 	return refs, nil
 }
+
+// MigrateReferences converts the reference names in the top-level index that
+// use LegacyAnnotationRefName to use the "org.opencontainers.image.ref.name"
+// annotation, so that images created by older tools can be used. Entries
+// which already have both annotations only have the legacy annotation
+// removed. The number of entries which were converted is returned.
+func (e Engine) MigrateReferences(ctx context.Context) (int, error) {
+	unlock, err := cas.LockIndex(ctx, e.Engine)
+	if err != nil {
+		return 0, errors.Wrap(err, "lock top-level index")
+	}
+	defer unlock()
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "get top-level index")
+	}
+
+	migrated := 0
+	for idx, descriptor := range index.Manifests {
+		if newDescriptor, ok := migrateReferenceName(descriptor); ok {
+			index.Manifests[idx] = newDescriptor
+			migrated++
+		}
+	}
+
+	if migrated > 0 {
+		if err := e.PutIndex(ctx, index); err != nil {
+			return 0, errors.Wrap(err, "replace index")
+		}
+	}
+	return migrated, nil
+}
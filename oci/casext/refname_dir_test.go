@@ -36,6 +36,7 @@ import (
 	"github.com/opencontainers/go-digest"
 	ispecs "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -381,3 +382,274 @@ func TestEngineReferenceReadonly(t *testing.T) {
 		readwrite(t, image)
 	}
 }
+
+func TestValidateReferenceName(t *testing.T) {
+	for _, test := range []struct {
+		refname string
+		valid   bool
+	}{
+		{"latest", true},
+		{"v1.0.0", true},
+		{"new_tag_1", true},
+		{"new__tag", true},
+		{"opensuse/leap___42.3", true},
+		{"opensuse/leap", true},
+		{"opensuse/leap:42.3", true},
+		{"registry.example.com/opensuse/leap:42.3", true},
+		{"image@sha256:abcdef", true},
+		{"a--b", true},
+		{"1.0+build", true},
+		{"", false},
+		{"-latest", false},
+		{"latest-", false},
+		{"a---b", false},
+		{"a..b", false},
+		{"_latest", false},
+		{"latest_", false},
+		{"a_-b", false},
+		{"opensuse//leap", false},
+		{"/opensuse", false},
+		{"opensuse/", false},
+		{"open suse", false},
+		{"tag\n", false},
+	} {
+		err := ValidateReferenceName(test.refname)
+		if test.valid && err != nil {
+			t.Errorf("expected %q to be valid: got %v", test.refname, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("expected %q to be invalid", test.refname)
+		}
+	}
+}
+
+func TestEngineReferenceSlashes(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferenceSlashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	manifest := putValidImage(t, engineExt, []byte("layer"))
+
+	name := "opensuse/leap:42.3"
+	if err := engineExt.UpdateReference(ctx, name, manifest); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if gotDescriptorPaths, err := engineExt.ResolveReference(ctx, name); err != nil {
+		t.Errorf("ResolveReference: unexpected error: %+v", err)
+	} else if len(gotDescriptorPaths) != 1 || gotDescriptorPaths[0].Descriptor().Digest != manifest.Digest {
+		t.Errorf("ResolveReference: got unexpected descriptors: %+v", gotDescriptorPaths)
+	}
+	if err := engineExt.ValidateLayout(ctx); err != nil {
+		t.Errorf("ValidateLayout: unexpected error: %+v", err)
+	}
+
+	// Invalid names must be rejected.
+	if err := engineExt.UpdateReference(ctx, "opensuse//leap", manifest); err == nil {
+		t.Errorf("UpdateReference: expected error with invalid name")
+	}
+	if err := engineExt.AddReferences(ctx, "-leap", manifest); err == nil {
+		t.Errorf("AddReferences: expected error with invalid name")
+	}
+}
+
+func TestEngineMigrateReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineMigrateReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	manifest := putValidImage(t, engineExt, []byte("layer"))
+
+	// Create an index like the ones created by older tools.
+	legacy := manifest
+	legacy.Annotations = map[string]string{
+		LegacyAnnotationRefName: "legacy",
+	}
+	both := manifest
+	both.Annotations = map[string]string{
+		LegacyAnnotationRefName: "old",
+		ispec.AnnotationRefName: "new",
+	}
+	if err := engineExt.PutIndex(ctx, ispec.Index{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{legacy, both},
+	}); err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+
+	if err := engineExt.ValidateLayout(ctx); err == nil {
+		t.Errorf("ValidateLayout: expected error with legacy references")
+	}
+
+	// Legacy references can be used before they are migrated.
+	if paths, err := engineExt.ResolveReference(ctx, "legacy"); err != nil || len(paths) != 1 {
+		t.Errorf("ResolveReference: expected legacy reference: got %v (%+v)", paths, err)
+	}
+	if paths, err := engineExt.ResolveReference(ctx, "old"); err != nil || len(paths) != 0 {
+		t.Errorf("ResolveReference: legacy annotation should be ignored: got %v (%+v)", paths, err)
+	}
+
+	migrated, err := engineExt.MigrateReferences(ctx)
+	if err != nil {
+		t.Fatalf("MigrateReferences: unexpected error: %+v", err)
+	}
+	if migrated != 2 {
+		t.Errorf("MigrateReferences: expected 2 migrated entries: got %d", migrated)
+	}
+
+	names, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("ListReferences: unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"legacy", "new"}) {
+		t.Errorf("ListReferences: got unexpected references: %v", names)
+	}
+	if err := engineExt.ValidateLayout(ctx); err != nil {
+		t.Errorf("ValidateLayout: unexpected error after migration: %+v", err)
+	}
+
+	// Migrating again must be a no-op.
+	if migrated, err := engineExt.MigrateReferences(ctx); err != nil || migrated != 0 {
+		t.Errorf("MigrateReferences: expected no-op: got %d (%+v)", migrated, err)
+	}
+}
+
+func TestEngineSwapReference(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineSwapReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	first := putValidImage(t, engineExt, []byte("first"))
+	second := putValidImage(t, engineExt, []byte("second"))
+
+	// An empty digest means the reference must not exist.
+	if err := engineExt.SwapReference(ctx, "tag", "", first); err != nil {
+		t.Fatalf("SwapReference: unexpected error creating reference: %+v", err)
+	}
+	if err := engineExt.SwapReference(ctx, "tag", "", second); errors.Cause(err) != ErrReferenceChanged {
+		t.Errorf("SwapReference: expected ErrReferenceChanged for existing reference: got %+v", err)
+	}
+	if err := engineExt.SwapReference(ctx, "tag", second.Digest, second); errors.Cause(err) != ErrReferenceChanged {
+		t.Errorf("SwapReference: expected ErrReferenceChanged for wrong digest: got %+v", err)
+	}
+	if err := engineExt.SwapReference(ctx, "tag", first.Digest, second); err != nil {
+		t.Fatalf("SwapReference: unexpected error: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "tag")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != second.Digest {
+		t.Errorf("ResolveReference: got unexpected descriptors: %+v", descriptorPaths)
+	}
+}
+
+func TestEngineSwapReferenceConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineSwapReferenceConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	base := putValidImage(t, engineExt, []byte("base"))
+	if err := engineExt.UpdateReference(ctx, "tag", base); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// Each builder uses its own engine (as separate processes would), and
+	// tries to replace the same version of the reference. Exactly one of them
+	// must succeed.
+	const builders = 8
+	results := make(chan error, builders)
+	for idx := 0; idx < builders; idx++ {
+		descriptor := putValidImage(t, engineExt, []byte(fmt.Sprintf("builder %d", idx)))
+		go func(descriptor ispec.Descriptor) {
+			engine, err := cas.Open(image)
+			if err != nil {
+				results <- err
+				return
+			}
+			defer engine.Close()
+			results <- NewEngine(engine).SwapReference(ctx, "tag", base.Digest, descriptor)
+		}(descriptor)
+	}
+
+	succeeded := 0
+	for idx := 0; idx < builders; idx++ {
+		err := <-results
+		switch errors.Cause(err) {
+		case nil:
+			succeeded++
+		case ErrReferenceChanged:
+		default:
+			t.Errorf("SwapReference: unexpected error: %+v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("SwapReference: expected exactly one builder to succeed: got %d", succeeded)
+	}
+}
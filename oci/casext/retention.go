@@ -0,0 +1,200 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// KeepLastRule is a RetentionPolicy rule which keeps the Count most recently
+// created references whose names start with Prefix.
+type KeepLastRule struct {
+	Prefix string
+	Count  int
+}
+
+// RetentionPolicy describes which references in an image should be kept when
+// pruning old references (see ExpiredReferences). A reference is kept if any
+// of the rules of the policy keep it. The creation time of a reference is the
+// "created" time of the image configuration it refers to.
+type RetentionPolicy struct {
+	// KeepLast are the rules which keep the most recently created references
+	// with a given prefix. If there are any such rules, only the references
+	// which start with one of their prefixes are considered for pruning.
+	KeepLast []KeepLastRule
+
+	// KeepNewerThan, if non-zero, keeps every reference created less than
+	// the given duration ago. References whose creation time is not known
+	// are also kept.
+	KeepNewerThan time.Duration
+
+	// Protect keeps every reference whose name matches any of the patterns.
+	Protect []*regexp.Regexp
+
+	// Now is the time which KeepNewerThan is relative to. If zero, the
+	// current time is used.
+	Now time.Time
+}
+
+// refCreation is a reference name and its creation time (which is zero if it
+// is not known).
+type refCreation struct {
+	name    string
+	created time.Time
+}
+
+// referenceCreated returns the creation time of the image the descriptor
+// refers to, or the zero time if it is not known (such as for image indexes,
+// or configurations without a creation time).
+func (e Engine) referenceCreated(ctx context.Context, descriptor ispec.Descriptor) (time.Time, error) {
+	if !IsManifestMediaType(descriptor.MediaType) {
+		return time.Time{}, nil
+	}
+	manifestBlob, err := e.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok || IsArtifact(manifest) {
+		return time.Time{}, nil
+	}
+
+	configBlob, err := e.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok || config.Created == nil {
+		return time.Time{}, nil
+	}
+	return *config.Created, nil
+}
+
+// ExpiredReferences returns the names of the references in the image which
+// are not kept by the given retention policy, in lexical order. The
+// references are not removed (which can be done with DeleteReference, after
+// which GC will remove any blobs which are no longer needed). An error is
+// returned if the policy has no KeepLast or KeepNewerThan rules, since every
+// reference would be expired.
+func (e Engine) ExpiredReferences(ctx context.Context, policy RetentionPolicy) ([]string, error) {
+	if len(policy.KeepLast) == 0 && policy.KeepNewerThan <= 0 {
+		return nil, errors.Errorf("retention policy has no rules")
+	}
+	now := policy.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	// The same name can be used by several descriptors, in which case the
+	// most recent creation time is used.
+	created := map[string]time.Time{}
+	for _, descriptor := range index.Manifests {
+		name, ok := descriptor.Annotations[ispec.AnnotationRefName]
+		if !ok {
+			continue
+		}
+		t, err := e.referenceCreated(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get creation time of %s", name)
+		}
+		if old, ok := created[name]; !ok || t.After(old) {
+			created[name] = t
+		}
+	}
+
+	// Newest first, with references of unknown age last. Ties are broken by
+	// name so the result is stable.
+	var refs []refCreation
+	for name, t := range created {
+		refs = append(refs, refCreation{name: name, created: t})
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if !refs[i].created.Equal(refs[j].created) {
+			return refs[i].created.After(refs[j].created)
+		}
+		return refs[i].name > refs[j].name
+	})
+
+	kept := map[string]bool{}
+	for _, rule := range policy.KeepLast {
+		n := 0
+		for _, ref := range refs {
+			if !strings.HasPrefix(ref.name, rule.Prefix) {
+				continue
+			}
+			if n < rule.Count {
+				kept[ref.name] = true
+			}
+			n++
+		}
+	}
+
+	var expired []string
+	for _, ref := range refs {
+		if kept[ref.name] || !ruleApplies(policy, ref.name) {
+			continue
+		}
+		if policy.KeepNewerThan > 0 && (ref.created.IsZero() || now.Sub(ref.created) < policy.KeepNewerThan) {
+			continue
+		}
+		if isProtected(policy, ref.name) {
+			continue
+		}
+		expired = append(expired, ref.name)
+	}
+	sort.Strings(expired)
+	return expired, nil
+}
+
+// ruleApplies returns whether the given reference is considered for pruning
+// by the policy.
+func ruleApplies(policy RetentionPolicy, name string) bool {
+	if len(policy.KeepLast) == 0 {
+		return true
+	}
+	for _, rule := range policy.KeepLast {
+		if strings.HasPrefix(name, rule.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isProtected returns whether the given reference is protected by the policy.
+func isProtected(policy RetentionPolicy, name string) bool {
+	for _, pattern := range policy.Protect {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// putCreatedImage stores an (empty) image created at the given time, and
+// returns its manifest descriptor.
+func putCreatedImage(t *testing.T, engineExt Engine, created time.Time) ispec.Descriptor {
+	ctx := context.Background()
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		Created: &created,
+		RootFS:  ispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %+v", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func TestEngineExpiredReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineExpiredReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	for name, age := range map[string]time.Duration{
+		"nightly-1": 96 * time.Hour,
+		"nightly-2": 72 * time.Hour,
+		"nightly-3": 48 * time.Hour,
+		"nightly-4": 24 * time.Hour,
+		"release-1": 72 * time.Hour,
+		"release-2": 1 * time.Hour,
+		"latest":    200 * time.Hour,
+	} {
+		descriptor := putCreatedImage(t, engineExt, now.Add(-age))
+		if err := engineExt.UpdateReference(ctx, name, descriptor); err != nil {
+			t.Fatalf("UpdateReference: unexpected error: %+v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		policy   RetentionPolicy
+		expected []string
+	}{
+		{"KeepLastPrefix", RetentionPolicy{
+			KeepLast: []KeepLastRule{{Prefix: "nightly-", Count: 2}},
+		}, []string{"nightly-1", "nightly-2"}},
+		{"KeepLastAll", RetentionPolicy{
+			KeepLast: []KeepLastRule{{Count: 3}},
+		}, []string{"latest", "nightly-1", "nightly-2", "release-1"}},
+		{"KeepLastMultiple", RetentionPolicy{
+			KeepLast: []KeepLastRule{{Prefix: "nightly-", Count: 1}, {Prefix: "release-", Count: 1}},
+		}, []string{"nightly-1", "nightly-2", "nightly-3", "release-1"}},
+		{"KeepNewerThan", RetentionPolicy{
+			KeepNewerThan: 50 * time.Hour,
+		}, []string{"latest", "nightly-1", "nightly-2", "release-1"}},
+		{"KeepNewerThanPrefix", RetentionPolicy{
+			KeepLast:      []KeepLastRule{{Prefix: "nightly-", Count: 1}},
+			KeepNewerThan: 50 * time.Hour,
+		}, []string{"nightly-1", "nightly-2"}},
+		{"Protect", RetentionPolicy{
+			KeepNewerThan: 50 * time.Hour,
+			Protect:       []*regexp.Regexp{regexp.MustCompile(`^(latest|release-.*)$`)},
+		}, []string{"nightly-1", "nightly-2"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.policy.Now = now
+			expired, err := engineExt.ExpiredReferences(ctx, test.policy)
+			if err != nil {
+				t.Fatalf("ExpiredReferences: unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(expired, test.expected) {
+				t.Errorf("ExpiredReferences: expected %v, got %v", test.expected, expired)
+			}
+		})
+	}
+
+	if _, err := engineExt.ExpiredReferences(ctx, RetentionPolicy{}); err == nil {
+		t.Errorf("ExpiredReferences: expected error with empty policy")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SignatureAnnotation is the annotation on the top-level index entry of a
+// reference which contains an ASCII-armoured OpenPGP detached signature of the
+// blob the reference refers to (usually a manifest). Since the signature only
+// applies to a single blob, it is removed by UpdateReference (and has to be
+// added again with SignReference or SetReferenceSignature).
+const SignatureAnnotation = "org.opensuse.umoci.signature.pgp"
+
+// ErrUnsigned is returned by VerifyReference if the reference has no
+// signature.
+var ErrUnsigned = errors.New("reference is not signed")
+
+// Signer produces detached signatures (such as an OpenPGP implementation).
+type Signer interface {
+	// Sign returns a detached signature of data.
+	Sign(data []byte) ([]byte, error)
+}
+
+// Verifier verifies detached signatures produced by a Signer.
+type Verifier interface {
+	// Verify returns an error if signature is not a valid (and trusted)
+	// signature of data.
+	Verify(data, signature []byte) error
+}
+
+// referenceEntry returns the index of the only entry in the top-level index
+// with the given reference name.
+func referenceEntry(index ispec.Index, refname string) (int, error) {
+	found := -1
+	for idx, descriptor := range index.Manifests {
+		if name, ok := referenceName(descriptor); !ok || name != refname {
+			continue
+		}
+		if found >= 0 {
+			return -1, errors.Errorf("reference is ambiguous: %s", refname)
+		}
+		found = idx
+	}
+	if found < 0 {
+		return -1, errors.Errorf("reference not found: %s", refname)
+	}
+	return found, nil
+}
+
+// readDescriptor returns the contents of the blob referred to by the
+// descriptor, after verifying them against the descriptor's digest.
+func (e Engine) readDescriptor(ctx context.Context, descriptor ispec.Descriptor) ([]byte, error) {
+	reader, err := e.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read blob")
+	}
+	return data, nil
+}
+
+// SetReferenceSignature sets the signature of the blob referred to by the
+// given reference (which must refer to exactly one blob).
+func (e Engine) SetReferenceSignature(ctx context.Context, refname string, signature []byte) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	idx, err := referenceEntry(index, refname)
+	if err != nil {
+		return err
+	}
+
+	// Copy the annotations to avoid modifying the map stored in the index
+	// returned by the engine.
+	annotations := map[string]string{}
+	for key, value := range index.Manifests[idx].Annotations {
+		annotations[key] = value
+	}
+	annotations[SignatureAnnotation] = string(signature)
+	index.Manifests[idx].Annotations = annotations
+
+	return errors.Wrap(e.PutIndex(ctx, index), "replace index")
+}
+
+// SignReference signs the blob referred to by the given reference (which must
+// refer to exactly one blob) with the signer, and stores the signature in the
+// top-level index (see SignatureAnnotation).
+func (e Engine) SignReference(ctx context.Context, refname string, signer Signer) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	idx, err := referenceEntry(index, refname)
+	if err != nil {
+		return err
+	}
+
+	data, err := e.readDescriptor(ctx, index.Manifests[idx])
+	if err != nil {
+		return errors.Wrapf(err, "read %s", refname)
+	}
+	signature, err := signer.Sign(data)
+	if err != nil {
+		return errors.Wrapf(err, "sign %s", refname)
+	}
+	return e.SetReferenceSignature(ctx, refname, signature)
+}
+
+// VerifyReference verifies the signature of the blob referred to by the given
+// reference (which must refer to exactly one blob) with the verifier. If the
+// reference has no signature, ErrUnsigned is returned.
+func (e Engine) VerifyReference(ctx context.Context, refname string, verifier Verifier) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	idx, err := referenceEntry(index, refname)
+	if err != nil {
+		return err
+	}
+
+	descriptor := index.Manifests[idx]
+	signature, ok := descriptor.Annotations[SignatureAnnotation]
+	if !ok {
+		return errors.Wrap(ErrUnsigned, refname)
+	}
+	data, err := e.readDescriptor(ctx, descriptor)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", refname)
+	}
+	return errors.Wrapf(verifier.Verify(data, []byte(signature)), "verify %s", refname)
+}
@@ -0,0 +1,123 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// fakeSigner is a Signer and Verifier whose signatures are the digest of the
+// signed data, prefixed with a key name.
+type fakeSigner struct {
+	key string
+}
+
+func (s fakeSigner) Sign(data []byte) ([]byte, error) {
+	return []byte(s.key + ":" + digest.SHA256.FromBytes(data).String()), nil
+}
+
+func (s fakeSigner) Verify(data, signature []byte) error {
+	expected, _ := s.Sign(data)
+	if !bytes.Equal(signature, expected) {
+		return errors.Errorf("bad signature: %s", signature)
+	}
+	return nil
+}
+
+func TestEngineSignReference(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineSignReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	a := putValidImage(t, engineExt, []byte("layer a"))
+	b := putValidImage(t, engineExt, []byte("layer b"))
+	if err := engineExt.UpdateReference(ctx, "tag", a); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	if err := engineExt.VerifyReference(ctx, "tag", fakeSigner{"key"}); errors.Cause(err) != ErrUnsigned {
+		t.Errorf("VerifyReference: expected ErrUnsigned for unsigned reference, got %+v", err)
+	}
+	if err := engineExt.SignReference(ctx, "missing", fakeSigner{"key"}); err == nil {
+		t.Errorf("SignReference: expected error for missing reference")
+	}
+
+	if err := engineExt.SignReference(ctx, "tag", fakeSigner{"key"}); err != nil {
+		t.Fatalf("SignReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.VerifyReference(ctx, "tag", fakeSigner{"key"}); err != nil {
+		t.Errorf("VerifyReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.VerifyReference(ctx, "tag", fakeSigner{"other"}); err == nil {
+		t.Errorf("VerifyReference: expected error with a different key")
+	}
+
+	// The signature is stored in the index, so the resolved descriptor has it.
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "tag")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("ResolveReference: unexpected result: %v (%+v)", descriptorPaths, err)
+	}
+	signature := descriptorPaths[0].Descriptor().Annotations[SignatureAnnotation]
+	if expected, _ := (fakeSigner{"key"}).Sign(nil); len(signature) != len(expected) {
+		t.Errorf("unexpected signature annotation: %q", signature)
+	}
+
+	// A signature copied to a different blob doesn't verify.
+	if err := engineExt.UpdateReference(ctx, "other", b); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.SetReferenceSignature(ctx, "other", []byte(signature)); err != nil {
+		t.Fatalf("SetReferenceSignature: unexpected error: %+v", err)
+	}
+	if err := engineExt.VerifyReference(ctx, "other", fakeSigner{"key"}); err == nil {
+		t.Errorf("VerifyReference: expected error with the signature of another blob")
+	}
+
+	// Updating the reference drops the signature, even if the descriptor
+	// still has it.
+	if err := engineExt.UpdateReference(ctx, "tag", descriptorPaths[0].Descriptor()); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.VerifyReference(ctx, "tag", fakeSigner{"key"}); errors.Cause(err) != ErrUnsigned {
+		t.Errorf("VerifyReference: expected ErrUnsigned after UpdateReference, got %+v", err)
+	}
+}
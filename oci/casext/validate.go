@@ -0,0 +1,282 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// mediaTypeRegexp is the regular expression that all media types must match,
+// as defined by RFC 6838 section 4.2 (which is referenced by the image-spec).
+var mediaTypeRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}$`)
+
+// invalidf returns a new error (with the given format) that wraps
+// cas.ErrInvalid, so that callers can detect validation failures with
+// errors.Cause.
+func invalidf(format string, args ...interface{}) error {
+	return errors.Wrapf(cas.ErrInvalid, format, args...)
+}
+
+// ValidateDescriptor checks that the given descriptor has all of the fields
+// required by the image-spec, and that they are well-formed. It does not
+// check whether the blob referenced by the descriptor exists.
+func ValidateDescriptor(descriptor ispec.Descriptor) error {
+	if !mediaTypeRegexp.MatchString(descriptor.MediaType) {
+		return invalidf("descriptor %s: invalid media type %q", descriptor.Digest, descriptor.MediaType)
+	}
+	if err := descriptor.Digest.Validate(); err != nil {
+		return invalidf("descriptor: invalid digest %q: %v", descriptor.Digest, err)
+	}
+	if descriptor.Size < 0 {
+		return invalidf("descriptor %s: negative size %d", descriptor.Digest, descriptor.Size)
+	}
+	return nil
+}
+
+// ValidateIndex checks that the given index conforms to the image-spec.
+func ValidateIndex(index ispec.Index) error {
+	if index.SchemaVersion != 2 {
+		return invalidf("index: unsupported schemaVersion %d", index.SchemaVersion)
+	}
+	for idx, descriptor := range index.Manifests {
+		if err := ValidateDescriptor(descriptor); err != nil {
+			return errors.Wrapf(err, "index: manifests[%d]", idx)
+		}
+	}
+	return nil
+}
+
+// ValidateManifest checks that the given manifest conforms to the
+// image-spec. Layers with media types not defined by the image-spec are
+// permitted (as the spec allows for foreign layers). The config may have any
+// media type other than a manifest, index or layer media type, in which case
+// the manifest is an artifact (see IsArtifact).
+func ValidateManifest(manifest ispec.Manifest) error {
+	if manifest.SchemaVersion != 2 {
+		return invalidf("manifest: unsupported schemaVersion %d", manifest.SchemaVersion)
+	}
+	if err := ValidateDescriptor(manifest.Config); err != nil {
+		return errors.Wrap(err, "manifest: config")
+	}
+	if IsArtifact(manifest) && isKnownMediaType(manifest.Config.MediaType) {
+		return invalidf("manifest: config has unsupported media type %q", manifest.Config.MediaType)
+	}
+	for idx, layer := range manifest.Layers {
+		if err := ValidateDescriptor(layer); err != nil {
+			return errors.Wrapf(err, "manifest: layers[%d]", idx)
+		}
+	}
+	return nil
+}
+
+// ValidateImage checks that the given image configuration conforms to the
+// image-spec.
+func ValidateImage(image ispec.Image) error {
+	if image.Architecture == "" {
+		return invalidf("config: architecture must be set")
+	}
+	if image.OS == "" {
+		return invalidf("config: os must be set")
+	}
+	if image.RootFS.Type != "layers" {
+		return invalidf("config: unsupported rootfs.type %q", image.RootFS.Type)
+	}
+	for idx, diffID := range image.RootFS.DiffIDs {
+		if err := diffID.Validate(); err != nil {
+			return invalidf("config: rootfs.diff_ids[%d]: invalid digest %q: %v", idx, diffID, err)
+		}
+	}
+
+	// If the history is provided, there must be exactly one non-empty entry
+	// for every layer.
+	if len(image.History) > 0 {
+		nonEmpty := 0
+		for _, history := range image.History {
+			if !history.EmptyLayer {
+				nonEmpty++
+			}
+		}
+		if nonEmpty != len(image.RootFS.DiffIDs) {
+			return invalidf("config: history has %d non-empty entries but there are %d diff_ids", nonEmpty, len(image.RootFS.DiffIDs))
+		}
+	}
+	return nil
+}
+
+// hashBlob reads the blob with the given digest, and returns the digest (using
+// the same algorithm as the provided digest) and size of its contents.
+func (e Engine) hashBlob(ctx context.Context, blobDigest digest.Digest) (digest.Digest, int64, error) {
+	reader, err := e.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return "", -1, errors.Wrapf(err, "get blob %s", blobDigest)
+	}
+	defer reader.Close()
+
+	digester := blobDigest.Algorithm().Digester()
+	size, err := io.Copy(digester.Hash(), reader)
+	if err != nil {
+		return "", -1, errors.Wrapf(err, "read blob %s", blobDigest)
+	}
+	return digester.Digest(), size, nil
+}
+
+// validateBlob checks that the blob referenced by the descriptor exists, and
+// that its contents match both the digest and size of the descriptor.
+func (e Engine) validateBlob(ctx context.Context, descriptor ispec.Descriptor) error {
+	got, size, err := e.hashBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	if size != descriptor.Size {
+		return invalidf("blob %s: size mismatch: descriptor has %d, blob has %d", descriptor.Digest, descriptor.Size, size)
+	}
+	if got != descriptor.Digest {
+		return invalidf("blob %s: digest mismatch: blob has %s", descriptor.Digest, got)
+	}
+	return nil
+}
+
+// validateManifestBlob does the checks for a manifest that require access to
+// other blobs, namely that the manifest and its configuration agree on the
+// number of layers. It must not be used for artifacts.
+func (e Engine) validateManifestBlob(ctx context.Context, manifest ispec.Manifest) error {
+	configBlob, err := e.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return invalidf("manifest: has %d layers but config has %d diff_ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	return nil
+}
+
+// Validate checks that every blob reachable from the given root descriptor
+// conforms to the image-spec. This includes verifying that the size and digest
+// of every descriptor match the blob they reference, and that all known JSON
+// blobs (manifests, indexes and configurations) have their required fields.
+// Blobs with unknown media types only have their digest and size verified.
+// Errors caused by validation failures have cas.ErrInvalid as their cause.
+func (e Engine) Validate(ctx context.Context, root ispec.Descriptor) error {
+	return e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+
+		log.WithFields(log.Fields{
+			"digest":    descriptor.Digest,
+			"mediatype": descriptor.MediaType,
+		}).Debugf("validating blob")
+
+		if err := ValidateDescriptor(descriptor); err != nil {
+			return err
+		}
+		if err := e.validateBlob(ctx, descriptor); err != nil {
+			// Non-distributable layers are permitted to be missing from the
+			// image, as they are usually fetched from their URLs.
+			if IsNonDistributableMediaType(descriptor.MediaType) && os.IsNotExist(errors.Cause(err)) {
+				log.Debugf("skipping missing non-distributable layer %s", descriptor.Digest)
+				return ErrSkipDescriptor
+			}
+			return err
+		}
+
+		// We can't parse (or recurse into) unknown blobs, and we've already
+		// verified the contents of the layers above.
+		if !isKnownMediaType(descriptor.MediaType) || IsLayerMediaType(descriptor.MediaType) {
+			return ErrSkipDescriptor
+		}
+
+		blob, err := e.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			return errors.Wrapf(err, "parse blob %s", descriptor.Digest)
+		}
+		defer blob.Close()
+
+		switch data := blob.Data.(type) {
+		case ispec.Index:
+			err = ValidateIndex(data)
+		case ispec.Manifest:
+			err = ValidateManifest(data)
+			if err == nil && !IsArtifact(data) {
+				err = e.validateManifestBlob(ctx, data)
+			}
+		case ispec.Image:
+			err = ValidateImage(data)
+		}
+		return errors.Wrapf(err, "blob %s", descriptor.Digest)
+	})
+}
+
+// ValidateLayout checks that the entire image conforms to the image-spec. In
+// addition to calling Validate on every descriptor in the top-level index, the
+// contents of every blob (even those that are not reachable) are checked to
+// match their digest, and the reference names in the top-level index are
+// checked to conform to the image-layout specification.
+func (e Engine) ValidateLayout(ctx context.Context) error {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	if err := ValidateIndex(index); err != nil {
+		return errors.Wrap(err, "top-level index")
+	}
+	for idx, descriptor := range index.Manifests {
+		if _, ok := descriptor.Annotations[LegacyAnnotationRefName]; ok {
+			return invalidf("top-level index: manifests[%d]: uses legacy %s annotation", idx, LegacyAnnotationRefName)
+		}
+		if refname, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+			if err := ValidateReferenceName(refname); err != nil {
+				return errors.Wrapf(err, "top-level index: manifests[%d]", idx)
+			}
+		}
+	}
+	for _, descriptor := range index.Manifests {
+		if err := e.Validate(ctx, descriptor); err != nil {
+			return errors.Wrapf(err, "validate %s", descriptor.Digest)
+		}
+	}
+
+	blobs, err := e.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list blobs")
+	}
+	for _, blobDigest := range blobs {
+		got, _, err := e.hashBlob(ctx, blobDigest)
+		if err != nil {
+			return err
+		}
+		if got != blobDigest {
+			return invalidf("blob %s: digest mismatch: blob has %s", blobDigest, got)
+		}
+	}
+	return nil
+}
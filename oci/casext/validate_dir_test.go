@@ -0,0 +1,198 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// putValidImage inserts a minimal (but valid) image into the engine, and
+// returns the descriptor of the manifest.
+func putValidImage(t *testing.T, engineExt Engine, layer []byte) ispec.Descriptor {
+	ctx := context.Background()
+
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(layer))
+	if err != nil {
+		t.Fatalf("unexpected error putting layer: %+v", err)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDigest},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %+v", err)
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{
+			{
+				MediaType: ispec.MediaTypeImageLayer,
+				Digest:    layerDigest,
+				Size:      layerSize,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %+v", err)
+	}
+
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func TestEngineValidate(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineValidate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descriptor := putValidImage(t, engineExt, []byte("not really a layer"))
+	if err := engineExt.UpdateReference(ctx, "valid", descriptor); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	if err := engineExt.Validate(ctx, descriptor); err != nil {
+		t.Errorf("Validate: unexpected error on valid image: %+v", err)
+	}
+	if err := engineExt.ValidateLayout(ctx); err != nil {
+		t.Errorf("ValidateLayout: unexpected error on valid image: %+v", err)
+	}
+
+	// Descriptors with the wrong size must be detected.
+	badSize := descriptor
+	badSize.Size++
+	if err := engineExt.Validate(ctx, badSize); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("Validate: expected ErrInvalid with bad size, got: %+v", err)
+	}
+
+	// As must descriptors with invalid media types.
+	badMediaType := descriptor
+	badMediaType.MediaType = "not a media type"
+	if err := engineExt.Validate(ctx, badMediaType); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("Validate: expected ErrInvalid with bad media type, got: %+v", err)
+	}
+
+	// Manifests with a different number of layers to diff_ids are invalid.
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS: ispec.RootFS{
+			Type: "layers",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{descriptor},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %+v", err)
+	}
+	if err := engineExt.Validate(ctx, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("Validate: expected ErrInvalid with mismatched diff_ids, got: %+v", err)
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		image ispec.Image
+		valid bool
+	}{
+		{"Empty", ispec.Image{}, false},
+		{"NoOS", ispec.Image{Architecture: "amd64", RootFS: ispec.RootFS{Type: "layers"}}, false},
+		{"NoArch", ispec.Image{OS: "linux", RootFS: ispec.RootFS{Type: "layers"}}, false},
+		{"BadRootFS", ispec.Image{OS: "linux", Architecture: "amd64", RootFS: ispec.RootFS{Type: "unknown"}}, false},
+		{"Minimal", ispec.Image{OS: "linux", Architecture: "amd64", RootFS: ispec.RootFS{Type: "layers"}}, true},
+		{"HistoryMismatch", ispec.Image{
+			OS:           "linux",
+			Architecture: "amd64",
+			RootFS:       ispec.RootFS{Type: "layers"},
+			History:      []ispec.History{{EmptyLayer: false}},
+		}, false},
+		{"HistoryEmpty", ispec.Image{
+			OS:           "linux",
+			Architecture: "amd64",
+			RootFS:       ispec.RootFS{Type: "layers"},
+			History:      []ispec.History{{EmptyLayer: true}},
+		}, true},
+	} {
+		err := ValidateImage(test.image)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+		} else if !test.valid && errors.Cause(err) != cas.ErrInvalid {
+			t.Errorf("%s: expected ErrInvalid, got: %+v", test.name, err)
+		}
+	}
+}
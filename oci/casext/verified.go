@@ -0,0 +1,46 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// GetVerifiedBlob returns a reader for the blob referenced by the given
+// descriptor, which the caller must Close(). The contents are verified
+// against the descriptor while they are read: instead of io.EOF, the reader
+// returns an error with cas.ErrDigestMismatch as its cause if the blob does
+// not match the descriptor's digest or size (and it never returns more than
+// the descriptor's size). Callers must read until io.EOF for the digest to be
+// verified. A negative descriptor size means that the size is not known, in
+// which case only the digest is verified.
+func (e Engine) GetVerifiedBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid digest")
+	}
+	reader, err := e.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return cas.NewVerifiedReadCloser(reader, descriptor), nil
+}
@@ -0,0 +1,111 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestEngineGetVerifiedBlob(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineGetVerifiedBlob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	blobDigest, blobSize, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte("contents")))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	// A blob stored under the wrong digest.
+	tampered := digest.FromString("tampered")
+	tamperedPath := filepath.Join(image, "blobs", tampered.Algorithm().String(), tampered.Hex())
+	if err := ioutil.WriteFile(tamperedPath, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		descriptor ispec.Descriptor
+		contents   string
+		mismatch   bool
+	}{
+		{"Valid", ispec.Descriptor{Digest: blobDigest, Size: blobSize}, "contents", false},
+		{"UnknownSize", ispec.Descriptor{Digest: blobDigest, Size: -1}, "contents", false},
+		{"TooSmall", ispec.Descriptor{Digest: blobDigest, Size: blobSize - 1}, "content", true},
+		{"TooLarge", ispec.Descriptor{Digest: blobDigest, Size: blobSize + 1}, "contents", true},
+		{"Tampered", ispec.Descriptor{Digest: tampered, Size: 8}, "modified", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := engineExt.GetVerifiedBlob(ctx, test.descriptor)
+			if err != nil {
+				t.Fatalf("GetVerifiedBlob: unexpected error: %+v", err)
+			}
+			defer reader.Close()
+
+			data, err := ioutil.ReadAll(reader)
+			if test.mismatch {
+				if errors.Cause(err) != cas.ErrDigestMismatch {
+					t.Errorf("expected ErrDigestMismatch, got: %+v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+			if string(data) != test.contents {
+				t.Errorf("got contents %q, expected %q", data, test.contents)
+			}
+		})
+	}
+
+	// FromDescriptor must also verify parsed blobs.
+	manifestPath := filepath.Join(image, "blobs", tampered.Algorithm().String(), tampered.Hex())
+	if err := ioutil.WriteFile(manifestPath, []byte(`{"schemaVersion": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engineExt.FromDescriptor(ctx, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    tampered,
+		Size:      20,
+	}); errors.Cause(err) != cas.ErrDigestMismatch {
+		t.Errorf("FromDescriptor: expected ErrDigestMismatch, got: %+v", err)
+	}
+}
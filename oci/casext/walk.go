@@ -116,6 +116,14 @@ func (ws *walkState) recurse(ctx context.Context, descriptorPath DescriptorPath)
 		return err
 	}
 
+	// Layers cannot contain any descriptors, so there's no need to fetch them
+	// (non-distributable layers might not even be present in the image).
+	// Blobs with unknown media types (such as attestations, see
+	// PutAttestation) are treated the same way, since we cannot parse them.
+	if mediaType := descriptorPath.Descriptor().MediaType; IsLayerMediaType(mediaType) || !isKnownMediaType(mediaType) {
+		return nil
+	}
+
 	// Get blob to recurse into.
 	blob, err := ws.engine.FromDescriptor(ctx, descriptorPath.Descriptor())
 	if err != nil {
@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Media types used by wasm images, as defined by the CNCF "Wasm OCI Artifact
+// layout". Wasm images are artifacts (see IsArtifact) whose layers are
+// WebAssembly modules or components rather than tar archives.
+const (
+	// MediaTypeWasmConfig is the media type of the config of a wasm image
+	// (see WasmConfig).
+	MediaTypeWasmConfig = "application/vnd.wasm.config.v0+json"
+
+	// MediaTypeWasmLayer is the media type of a WebAssembly module (or
+	// component) layer of a wasm image.
+	MediaTypeWasmLayer = "application/vnd.wasm.content.layer.v1+wasm"
+)
+
+// maxWasmConfigSize is the largest wasm config blob that GetWasmConfig will
+// parse.
+const maxWasmConfigSize = 1 << 20
+
+// WasmConfig is the config of a wasm image (with media type
+// MediaTypeWasmConfig). Fields which are not used by umoci are not included.
+type WasmConfig struct {
+	// Created is the time the image was created.
+	Created *time.Time `json:"created,omitempty"`
+
+	// Author is the author of the image.
+	Author string `json:"author,omitempty"`
+
+	// Architecture must be "wasm".
+	Architecture string `json:"architecture"`
+
+	// OS is the WASI version targeted by the image (such as "wasip1").
+	OS string `json:"os"`
+
+	// LayerDigests are the digests of the layers of the image, in order.
+	LayerDigests []digest.Digest `json:"layerDigests"`
+}
+
+// IsWasmManifest returns whether the given manifest is a wasm image.
+func IsWasmManifest(manifest ispec.Manifest) bool {
+	return manifest.Config.MediaType == MediaTypeWasmConfig
+}
+
+// GetWasmConfig parses the config of the given wasm image (see
+// IsWasmManifest), and checks that it is consistent with the manifest.
+func (e Engine) GetWasmConfig(ctx context.Context, manifest ispec.Manifest) (WasmConfig, error) {
+	if !IsWasmManifest(manifest) {
+		return WasmConfig{}, errors.Errorf("config has media type %s, not %s", manifest.Config.MediaType, MediaTypeWasmConfig)
+	}
+	if manifest.Config.Size < 0 || manifest.Config.Size > maxWasmConfigSize {
+		return WasmConfig{}, invalidf("wasm config is too large (%d bytes)", manifest.Config.Size)
+	}
+
+	reader, err := e.GetVerifiedBlob(ctx, manifest.Config)
+	if err != nil {
+		return WasmConfig{}, errors.Wrap(err, "get wasm config")
+	}
+	defer reader.Close()
+
+	var config WasmConfig
+	if err := json.NewDecoder(reader).Decode(&config); err != nil {
+		return WasmConfig{}, errors.Wrap(err, "parse wasm config")
+	}
+	// Read the rest of the blob so that it is verified.
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return WasmConfig{}, errors.Wrap(err, "read wasm config")
+	}
+	if config.Architecture != "wasm" {
+		return WasmConfig{}, invalidf("wasm config: unsupported architecture %q", config.Architecture)
+	}
+	if len(config.LayerDigests) != len(manifest.Layers) {
+		return WasmConfig{}, invalidf("wasm config: has %d layerDigests but manifest has %d layers", len(config.LayerDigests), len(manifest.Layers))
+	}
+	for idx, layer := range manifest.Layers {
+		if config.LayerDigests[idx] != layer.Digest {
+			return WasmConfig{}, invalidf("wasm config: layerDigests[%d] is %s but manifest layer is %s", idx, config.LayerDigests[idx], layer.Digest)
+		}
+	}
+	return config, nil
+}
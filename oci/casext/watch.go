@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"sort"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReferenceChange describes a modification of a reference in the top-level
+// index.
+type ReferenceChange struct {
+	// RefName is the name of the reference which was changed.
+	RefName string `json:"ref_name"`
+
+	// Old and New are the digests the reference referred to before and after
+	// the change. Old is "" if the reference was created, and New is "" if
+	// the reference was deleted.
+	Old digest.Digest `json:"old,omitempty"`
+	New digest.Digest `json:"new,omitempty"`
+}
+
+// DiffReferences returns the changes to the references between the old and
+// new top-level indexes, sorted by reference name. As with the reflog, only
+// the first entry for each reference is compared.
+func DiffReferences(old, new ispec.Index) []ReferenceChange {
+	refnames := map[string]struct{}{}
+	for _, index := range []ispec.Index{old, new} {
+		for _, descriptor := range index.Manifests {
+			if refname, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+				refnames[refname] = struct{}{}
+			}
+		}
+	}
+
+	var changes []ReferenceChange
+	for refname := range refnames {
+		oldDigest := referenceDigest(old, refname)
+		newDigest := referenceDigest(new, refname)
+		if oldDigest != newDigest {
+			changes = append(changes, ReferenceChange{
+				RefName: refname,
+				Old:     oldDigest,
+				New:     newDigest,
+			})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].RefName < changes[j].RefName
+	})
+	return changes
+}
+
+// WatchReferences calls fn for every change made to the given references (or
+// to every reference, if none are given) until the context is cancelled (in
+// which case nil is returned) or fn returns an error (which is returned). Only
+// changes made after WatchReferences was called are reported, and changes
+// made in quick succession may be coalesced. The underlying cas.Engine must
+// implement cas.IndexWatcher, otherwise cas.ErrNotImplemented is returned.
+func (e Engine) WatchReferences(ctx context.Context, fn func(change ReferenceChange) error, refnames ...string) error {
+	filter := map[string]struct{}{}
+	for _, refname := range refnames {
+		filter[refname] = struct{}{}
+	}
+
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+
+	return cas.WatchIndex(ctx, e.Engine, func() error {
+		newIndex, err := e.GetIndex(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get top-level index")
+		}
+		changes := DiffReferences(index, newIndex)
+		index = newIndex
+
+		for _, change := range changes {
+			if _, ok := filter[change.RefName]; len(filter) > 0 && !ok {
+				continue
+			}
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
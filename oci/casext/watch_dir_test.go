@@ -0,0 +1,182 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestDiffReferences(t *testing.T) {
+	ref := func(name string, d digest.Digest) ispec.Descriptor {
+		return ispec.Descriptor{
+			MediaType:   ispec.MediaTypeImageManifest,
+			Digest:      d,
+			Annotations: map[string]string{ispec.AnnotationRefName: name},
+		}
+	}
+	old := ispec.Index{Manifests: []ispec.Descriptor{
+		ref("same", "sha256:1"),
+		ref("changed", "sha256:2"),
+		ref("deleted", "sha256:3"),
+		{Digest: "sha256:4"},
+	}}
+	new := ispec.Index{Manifests: []ispec.Descriptor{
+		ref("created", "sha256:5"),
+		ref("same", "sha256:1"),
+		ref("changed", "sha256:6"),
+	}}
+
+	expected := []ReferenceChange{
+		{RefName: "changed", Old: "sha256:2", New: "sha256:6"},
+		{RefName: "created", New: "sha256:5"},
+		{RefName: "deleted", Old: "sha256:3"},
+	}
+	if changes := DiffReferences(old, new); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("DiffReferences: expected %+v, got %+v", expected, changes)
+	}
+	if changes := DiffReferences(new, new); len(changes) != 0 {
+		t.Errorf("DiffReferences: expected no changes, got %+v", changes)
+	}
+}
+
+func TestEngineWatchReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineWatchReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	first := putValidImage(t, engineExt, []byte("first"))
+	second := putValidImage(t, engineExt, []byte("second"))
+	if err := engineExt.UpdateReference(ctx, "watched", first); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// Watch with a separate engine, as another process would.
+	watchEngine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer watchEngine.Close()
+
+	errDone := errors.New("done")
+	changes := make(chan ReferenceChange, 16)
+	result := make(chan error, 1)
+	go func() {
+		result <- NewEngine(watchEngine).WatchReferences(ctx, func(change ReferenceChange) error {
+			changes <- change
+			if change.New == "" {
+				return errDone
+			}
+			return nil
+		}, "watched")
+	}()
+	// Give the watcher a chance to read the current index.
+	time.Sleep(100 * time.Millisecond)
+
+	// Changes to other references are ignored.
+	if err := engineExt.UpdateReference(ctx, "ignored", second); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "watched", second); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.DeleteReference(ctx, "watched"); err != nil {
+		t.Fatalf("DeleteReference: unexpected error: %+v", err)
+	}
+
+	select {
+	case err := <-result:
+		if errors.Cause(err) != errDone {
+			t.Fatalf("WatchReferences: unexpected error: %+v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("WatchReferences: timed out waiting for changes")
+	}
+	close(changes)
+
+	// Changes made in quick succession may be coalesced, so we can only check
+	// that the changes we did see are consistent.
+	last := first.Digest
+	for change := range changes {
+		if change.RefName != "watched" {
+			t.Errorf("WatchReferences: got change to unwatched reference: %+v", change)
+		}
+		if change.Old != last {
+			t.Errorf("WatchReferences: expected change from %s: got %+v", last, change)
+		}
+		last = change.New
+	}
+	if last != "" {
+		t.Errorf("WatchReferences: expected final change to delete reference: got %s", last)
+	}
+}
+
+func TestEngineWatchReferencesCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestEngineWatchReferencesCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := engineExt.WatchReferences(ctx, func(change ReferenceChange) error {
+		t.Errorf("WatchReferences: unexpected change: %+v", change)
+		return nil
+	}); err != nil {
+		t.Errorf("WatchReferences: expected no error after cancellation: got %+v", err)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/third_party/user"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -40,6 +41,27 @@ const (
 	exposedPortsAnnotation = "org.opencontainers.image.exposedPorts"
 )
 
+// Annotations used by OCI runtimes (such as crun(1)) to decide whether a
+// container should be run with a WebAssembly runtime rather than as a native
+// process. See AddWasmAnnotations.
+const (
+	WasmVariantAnnotation = "module.wasm.image/variant"
+	WasmHandlerAnnotation = "run.oci.handler"
+)
+
+// IsWasmPlatform returns whether the given image platform is WebAssembly
+// (with any version of WASI as the OS).
+func IsWasmPlatform(os, architecture string) bool {
+	return architecture == "wasm" && (os == "wasi" || strings.HasPrefix(os, "wasip"))
+}
+
+// AddWasmAnnotations adds the annotations which tell OCI runtimes that the
+// process of the given runtime configuration is a WebAssembly module.
+func AddWasmAnnotations(g rgen.Generator) {
+	g.AddAnnotation(WasmVariantAnnotation, "compat")
+	g.AddAnnotation(WasmHandlerAnnotation, "wasm")
+}
+
 // ToRuntimeSpec converts the given OCI image configuration to a runtime
 // configuration appropriate for use, which is templated on the default
 // configuration specified by the OCI runtime-tools. It is equivalent to
@@ -68,6 +90,31 @@ func parseEnv(env string) (string, string, error) {
 	return name, value, nil
 }
 
+// ResolveUser resolves the given user specification (of the form used by the
+// User field of an image configuration) to the uid, gid and additional gids
+// of the user, using the /etc/passwd and /etc/group files in rootfs (which are
+// resolved within rootfs, so that symlinks cannot point outside of it). Names
+// which are not in those files (or if the files don't exist) result in an
+// error, while numeric ids are used even if they are not in those files.
+func ResolveUser(rootfs, userSpec string) (*user.ExecUser, error) {
+	passwdPath, err := securejoin.SecureJoin(rootfs, "/etc/passwd")
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve /etc/passwd")
+	}
+	groupPath, err := securejoin.SecureJoin(rootfs, "/etc/group")
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve /etc/group")
+	}
+
+	// If the rootfs doesn't contain an /etc/passwd or /etc/group file then
+	// GetExecUserPath will just do a numerical parsing.
+	execUser, err := user.GetExecUserPath(userSpec, nil, passwdPath, groupPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse user spec: '%s'", userSpec)
+	}
+	return execUser, nil
+}
+
 // MutateRuntimeSpec mutates a given runtime specification generator with the
 // image configuration provided. It returns the original generator, and does
 // not modify any fields directly (to allow for chaining).
@@ -77,7 +124,10 @@ func MutateRuntimeSpec(g rgen.Generator, rootfs string, image ispec.Image) error
 		return errors.Wrap(err, "creating image generator")
 	}
 
-	if ig.OS() != "linux" {
+	// Images containing WebAssembly modules (rather than native binaries) are
+	// run by the WebAssembly handlers of Linux runtimes.
+	wasm := IsWasmPlatform(image.OS, image.Architecture)
+	if ig.OS() != "linux" && !wasm {
 		return errors.Errorf("unsupported OS: %s", image.OS)
 	}
 
@@ -119,25 +169,26 @@ func MutateRuntimeSpec(g rgen.Generator, rootfs string, image ispec.Image) error
 	g.AddAnnotation(authorAnnotation, ig.Author())
 	g.AddAnnotation(createdAnnotation, ig.Created().Format(igen.ISO8601))
 	g.AddAnnotation(stopSignalAnnotation, image.Config.StopSignal)
+	if wasm {
+		AddWasmAnnotations(g)
+	}
 
 	// Set parsed fields
-	// Get the *actual* uid and gid of the user. If the image doesn't contain
-	// an /etc/passwd or /etc/group file then GetExecUserPath will just do a
-	// numerical parsing.
-	var passwdPath, groupPath string
+	// Get the *actual* uid and gid of the user.
+	var execUser *user.ExecUser
 	if rootfs != "" {
-		passwdPath = filepath.Join(rootfs, "/etc/passwd")
-		groupPath = filepath.Join(rootfs, "/etc/group")
-	}
-	execUser, err := user.GetExecUserPath(ig.ConfigUser(), nil, passwdPath, groupPath)
-	if err != nil {
-		// We only log an error if were not given a rootfs, and we set execUser
-		// to the "default" (root:root).
-		if rootfs != "" {
-			return errors.Wrapf(err, "cannot parse user spec: '%s'", ig.ConfigUser())
+		execUser, err = ResolveUser(rootfs, ig.ConfigUser())
+		if err != nil {
+			return err
+		}
+	} else {
+		execUser, err = user.GetExecUser(ig.ConfigUser(), nil, nil, nil)
+		if err != nil {
+			// We only log an error if were not given a rootfs, and we set
+			// execUser to the "default" (root:root).
+			log.Warnf("could not parse user spec '%s' without a rootfs -- defaulting to root:root", ig.ConfigUser())
+			execUser = new(user.ExecUser)
 		}
-		log.Warnf("could not parse user spec '%s' without a rootfs -- defaulting to root:root", ig.ConfigUser())
-		execUser = new(user.ExecUser)
 	}
 
 	g.SetProcessUID(uint32(execUser.Uid))
@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package convert
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/third_party/user"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestResolveUser(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestResolveUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\ntestuser:x:1337:8888:test user:/home/test:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte("root:x:0:\ntestgroup:x:2581:testuser\nemptygroup:x:2222:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		spec     string
+		expected user.ExecUser
+	}{
+		{"", user.ExecUser{Uid: 0, Gid: 0, Sgids: []int{}, Home: "/root"}},
+		{"testuser", user.ExecUser{Uid: 1337, Gid: 8888, Sgids: []int{2581}, Home: "/home/test"}},
+		{"testuser:emptygroup", user.ExecUser{Uid: 1337, Gid: 2222, Sgids: []int{}, Home: "/home/test"}},
+		{"1234:5678", user.ExecUser{Uid: 1234, Gid: 5678, Sgids: []int{}}},
+	} {
+		execUser, err := ResolveUser(rootfs, test.spec)
+		if err != nil {
+			t.Errorf("ResolveUser(%q): unexpected error: %+v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(*execUser, test.expected) {
+			t.Errorf("ResolveUser(%q): expected %+v got %+v", test.spec, test.expected, *execUser)
+		}
+	}
+
+	for _, spec := range []string{"nonexistent", "testuser:nonexistent", "nonexistent:0"} {
+		if _, err := ResolveUser(rootfs, spec); err == nil {
+			t.Errorf("ResolveUser(%q): expected error", spec)
+		}
+	}
+
+	// Symlinks are resolved inside the rootfs.
+	if err := ioutil.WriteFile(filepath.Join(root, "passwd"), []byte("outside:x:1:1::/:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(rootfs, "etc", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../passwd", filepath.Join(rootfs, "etc", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveUser(rootfs, "outside"); err == nil {
+		t.Errorf("ResolveUser: symlink to host /etc/passwd was followed")
+	}
+}
+
+func TestToRuntimeSpecWasm(t *testing.T) {
+	for _, test := range []struct {
+		os, architecture string
+		wasm             bool
+	}{
+		{"linux", "amd64", false},
+		{"wasi", "wasm", true},
+		{"wasip1", "wasm", true},
+		{"wasip2", "wasm", true},
+	} {
+		image := ispec.Image{OS: test.os, Architecture: test.architecture}
+		spec, err := ToRuntimeSpec("", image)
+		if err != nil {
+			t.Errorf("ToRuntimeSpec(%s/%s): unexpected error: %+v", test.os, test.architecture, err)
+			continue
+		}
+		if got := spec.Annotations[WasmVariantAnnotation] == "compat" && spec.Annotations[WasmHandlerAnnotation] == "wasm"; got != test.wasm {
+			t.Errorf("ToRuntimeSpec(%s/%s): got wasm annotations %v, expected %v", test.os, test.architecture, got, test.wasm)
+		}
+	}
+
+	// Only the wasm architecture makes WASI a supported OS.
+	if _, err := ToRuntimeSpec("", ispec.Image{OS: "wasip1", Architecture: "amd64"}); err == nil {
+		t.Errorf("ToRuntimeSpec(wasip1/amd64): expected an error")
+	}
+}
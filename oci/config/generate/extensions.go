@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// imageFields is the set of JSON names of the top-level fields of ispec.Image.
+var imageFields = func() map[string]struct{} {
+	fields := map[string]struct{}{}
+	imageType := reflect.TypeOf(ispec.Image{})
+	for idx := 0; idx < imageType.NumField(); idx++ {
+		name := strings.Split(imageType.Field(idx).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = imageType.Field(idx).Name
+		}
+		fields[name] = struct{}{}
+	}
+	return fields
+}()
+
+// IsImageField returns whether the given name is a top-level field of the
+// image configuration defined by the image-spec, and thus cannot be used as
+// the name of an extension.
+func IsImageField(name string) bool {
+	_, ok := imageFields[name]
+	return ok
+}
+
+// ParseExtensions returns the extensions in the given JSON-encoded image
+// configuration. If there are no extensions, nil is returned.
+func ParseExtensions(data []byte) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Wrap(err, "parse image fields")
+	}
+	var extensions map[string]json.RawMessage
+	for name, value := range fields {
+		if IsImageField(name) {
+			continue
+		}
+		if extensions == nil {
+			extensions = map[string]json.RawMessage{}
+		}
+		extensions[name] = value
+	}
+	return extensions, nil
+}
+
+// MarshalImage returns the JSON encoding of the image configuration with the
+// given extensions added to it. If there are no extensions, the encoding is
+// the same as json.Marshal(image).
+func MarshalImage(image ispec.Image, extensions map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(image)
+	if err != nil || len(extensions) == 0 {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Wrap(err, "parse image fields")
+	}
+	for name, value := range extensions {
+		if IsImageField(name) {
+			return nil, errors.Errorf("extension %q is an image-spec field", name)
+		}
+		fields[name] = value
+	}
+	return json.Marshal(fields)
+}
+
+// SetExtension sets the value of the extension with the given name. An error
+// is returned if the name is a field defined by the image-spec, or if the
+// value is not valid JSON.
+func (g *Generator) SetExtension(name string, value json.RawMessage) error {
+	if name == "" {
+		return errors.Errorf("extension name cannot be empty")
+	}
+	if IsImageField(name) {
+		return errors.Errorf("extension %q is an image-spec field", name)
+	}
+	if !json.Valid(value) {
+		return errors.Errorf("extension %q has invalid json value: %s", name, value)
+	}
+	if g.extensions == nil {
+		g.extensions = map[string]json.RawMessage{}
+	}
+	g.extensions[name] = append(json.RawMessage(nil), value...)
+	return nil
+}
+
+// Extension returns the value of the extension with the given name, and
+// whether it is set.
+func (g *Generator) Extension(name string) (json.RawMessage, bool) {
+	value, ok := g.extensions[name]
+	return value, ok
+}
+
+// RemoveExtension removes the extension with the given name.
+func (g *Generator) RemoveExtension(name string) {
+	delete(g.extensions, name)
+}
+
+// ClearExtensions removes all of the extensions.
+func (g *Generator) ClearExtensions() {
+	g.extensions = nil
+}
+
+// Extensions returns a copy of the extensions, or nil if there are none.
+func (g *Generator) Extensions() map[string]json.RawMessage {
+	if len(g.extensions) == 0 {
+		return nil
+	}
+	extensions := map[string]json.RawMessage{}
+	for name, value := range g.extensions {
+		extensions[name] = value
+	}
+	return extensions
+}
+
+// ExtensionNames returns the sorted names of the extensions.
+func (g *Generator) ExtensionNames() []string {
+	var names []string
+	for name := range g.extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
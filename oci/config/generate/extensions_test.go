@@ -0,0 +1,97 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExtensions(t *testing.T) {
+	g := New()
+
+	for _, name := range []string{"", "config", "rootfs", "architecture"} {
+		if err := g.SetExtension(name, json.RawMessage(`"value"`)); err == nil {
+			t.Errorf("SetExtension(%q): expected an error", name)
+		}
+	}
+	if err := g.SetExtension("invalid", json.RawMessage(`{`)); err == nil {
+		t.Errorf("SetExtension: expected an error with invalid json")
+	}
+
+	if err := g.SetExtension("org.example.b", json.RawMessage(`{"key":1}`)); err != nil {
+		t.Fatalf("unexpected error setting extension: %+v", err)
+	}
+	if err := g.SetExtension("org.example.a", json.RawMessage(`"value"`)); err != nil {
+		t.Fatalf("unexpected error setting extension: %+v", err)
+	}
+	if value, ok := g.Extension("org.example.a"); !ok || string(value) != `"value"` {
+		t.Errorf("Extension get/set doesn't match: got %s", value)
+	}
+	if names := g.ExtensionNames(); !reflect.DeepEqual(names, []string{"org.example.a", "org.example.b"}) {
+		t.Errorf("ExtensionNames: got %v", names)
+	}
+
+	// The extensions are round-tripped through the written configuration.
+	buffer := new(bytes.Buffer)
+	if _, err := g.WriteTo(buffer); err != nil {
+		t.Fatalf("unexpected error writing: %+v", err)
+	}
+	extensions, err := ParseExtensions(buffer.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error parsing extensions: %+v", err)
+	}
+	if !reflect.DeepEqual(extensions, g.Extensions()) {
+		t.Errorf("extensions not round-tripped: expected %v, got %v", g.Extensions(), extensions)
+	}
+
+	g.RemoveExtension("org.example.a")
+	if _, ok := g.Extension("org.example.a"); ok {
+		t.Errorf("RemoveExtension didn't remove extension")
+	}
+	g.ClearExtensions()
+	if extensions := g.Extensions(); extensions != nil {
+		t.Errorf("ClearExtensions didn't clear extensions: %v", extensions)
+	}
+}
+
+func TestMarshalImageNoExtensions(t *testing.T) {
+	image := New().Image()
+
+	expected, err := json.Marshal(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := MarshalImage(image, nil)
+	if err != nil {
+		t.Fatalf("unexpected error marshalling: %+v", err)
+	}
+	if !bytes.Equal(expected, got) {
+		t.Errorf("MarshalImage without extensions changed the encoding: expected %s, got %s", expected, got)
+	}
+
+	extensions, err := ParseExtensions(got)
+	if err != nil {
+		t.Fatalf("unexpected error parsing extensions: %+v", err)
+	}
+	if extensions != nil {
+		t.Errorf("unexpected extensions: %v", extensions)
+	}
+}
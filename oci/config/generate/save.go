@@ -47,7 +47,11 @@ func (g *Generator) WriteTo(w io.Writer) (n int64, err error) {
 	var fb fakeBuffer
 	w = io.MultiWriter(w, &fb)
 
-	if err := json.NewEncoder(w).Encode(g.image); err != nil {
+	data, err := MarshalImage(g.image, g.extensions)
+	if err != nil {
+		return fb.n, errors.Wrap(err, "marshal image")
+	}
+	if err := json.NewEncoder(w).Encode(json.RawMessage(data)); err != nil {
 		return fb.n, errors.Wrap(err, "encode image")
 	}
 
@@ -18,6 +18,7 @@
 package generate
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -37,6 +38,12 @@ import (
 // configuration blobs.
 type Generator struct {
 	image ispec.Image
+
+	// extensions are the top-level fields of the image configuration which
+	// are not defined by the image-spec (such as fields added by other tools).
+	// They are kept as raw JSON so that they can be round-tripped without
+	// being understood.
+	extensions map[string]json.RawMessage
 }
 
 // init makes sure everything has a "proper" zero value.
@@ -0,0 +1,221 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// AnnotationContainerdImageName is the annotation used by containerd to
+	// store the full name of an image (such as "docker.io/library/foo:1.0")
+	// in the index of an archive. "ctr images import" uses it to name the
+	// imported image.
+	AnnotationContainerdImageName = "io.containerd.image.name"
+
+	// archiveIndexFile is the name of the index in an archive.
+	archiveIndexFile = "index.json"
+
+	// archiveBlobsDirectory is the directory containing blobs in an archive.
+	archiveBlobsDirectory = "blobs"
+)
+
+// ExportArchive writes an archive containing the image with the given
+// descriptor to w. The archive is a tar archive of an OCI image layout (the
+// format used by "ctr images export" and "ctr images import", as well as the
+// "oci-archive:" transport of skopeo) whose index only contains the given
+// descriptor, and only the blobs reachable from it. The descriptor should
+// contain the annotations (such as the reference name) that the importer of
+// the archive should use.
+func ExportArchive(ctx context.Context, engine casext.Engine, w io.Writer, descriptor ispec.Descriptor) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	layout, err := json.Marshal(ispec.ImageLayout{Version: ispec.ImageLayoutVersion})
+	if err != nil {
+		return errors.Wrap(err, "encode oci-layout")
+	}
+	if err := writeArchiveFile(tw, ispec.ImageLayoutFile, now, bytes.NewReader(layout), int64(len(layout))); err != nil {
+		return errors.Wrap(err, "write oci-layout")
+	}
+
+	index, err := json.Marshal(ispec.Index{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{descriptor},
+	})
+	if err != nil {
+		return errors.Wrap(err, "encode index")
+	}
+	if err := writeArchiveFile(tw, archiveIndexFile, now, bytes.NewReader(index), int64(len(index))); err != nil {
+		return errors.Wrap(err, "write index")
+	}
+
+	// Write every reachable blob (once).
+	seen := map[digest.Digest]struct{}{}
+	if err := engine.Walk(ctx, descriptor, func(descriptorPath casext.DescriptorPath) error {
+		child := descriptorPath.Descriptor()
+		if _, ok := seen[child.Digest]; ok {
+			return nil
+		}
+		seen[child.Digest] = struct{}{}
+
+		blob, err := engine.GetBlob(ctx, child.Digest)
+		if os.IsNotExist(errors.Cause(err)) && isNonDistributable(child.MediaType) {
+			log.Warnf("interop: skipping missing non-distributable layer %s", child.Digest)
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "get blob %s", child.Digest)
+		}
+		defer blob.Close()
+
+		name := path.Join(archiveBlobsDirectory, child.Digest.Algorithm().String(), child.Digest.Hex())
+		return errors.Wrapf(writeArchiveFile(tw, name, now, blob, child.Size), "write blob %s", child.Digest)
+	}); err != nil {
+		return errors.Wrap(err, "walk image")
+	}
+	return errors.Wrap(tw.Close(), "close archive")
+}
+
+// isNonDistributable returns whether the media type is a non-distributable
+// layer, which images are not required to contain.
+func isNonDistributable(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageLayerNonDistributable ||
+		mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
+}
+
+// writeArchiveFile writes a regular file with the given contents to the tar
+// archive. The contents must be exactly size bytes long.
+func writeArchiveFile(tw *tar.Writer, name string, modTime time.Time, r io.Reader, size int64) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return errors.Wrap(err, "write contents")
+	}
+	if n != size {
+		return errors.Errorf("size mismatch: expected %d got %d", size, n)
+	}
+	return nil
+}
+
+// ImportArchive reads an archive (in the format written by ExportArchive) from
+// r, and stores every blob it contains in the image layout. The entries of the
+// index of the archive are returned (including their annotations), and the
+// caller is responsible for creating references to them. The digest of every
+// blob is verified, and each entry is validated before ImportArchive returns.
+func ImportArchive(ctx context.Context, engine casext.Engine, r io.Reader) ([]ispec.Descriptor, error) {
+	var (
+		indexBlob []byte
+		gotLayout bool
+	)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read archive")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == ispec.ImageLayoutFile:
+			var layout ispec.ImageLayout
+			if err := json.NewDecoder(tr).Decode(&layout); err != nil {
+				return nil, errors.Wrap(err, "parse oci-layout")
+			}
+			if layout.Version != ispec.ImageLayoutVersion {
+				return nil, errors.Errorf("unsupported image layout version %q", layout.Version)
+			}
+			gotLayout = true
+
+		case name == archiveIndexFile:
+			indexBlob, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, errors.Wrap(err, "read index")
+			}
+
+		case path.Dir(path.Dir(name)) == archiveBlobsDirectory:
+			expected := digest.NewDigestFromHex(path.Base(path.Dir(name)), path.Base(name))
+			if err := expected.Validate(); err != nil {
+				return nil, errors.Wrapf(err, "invalid blob %s", name)
+			}
+			got, _, err := engine.PutBlob(ctx, tr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "put blob %s", expected)
+			}
+			if got != expected {
+				return nil, errors.Errorf("blob digest mismatch: expected %s got %s", expected, got)
+			}
+
+		default:
+			log.Debugf("interop: ignoring unknown file in archive: %s", name)
+		}
+	}
+
+	if !gotLayout {
+		return nil, errors.Errorf("archive is missing %s", ispec.ImageLayoutFile)
+	}
+	if indexBlob == nil {
+		return nil, errors.Errorf("archive is missing %s", archiveIndexFile)
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(indexBlob, &index); err != nil {
+		return nil, errors.Wrap(err, "parse index")
+	}
+	if err := casext.ValidateIndex(index); err != nil {
+		return nil, errors.Wrap(err, "validate index")
+	}
+	for _, descriptor := range index.Manifests {
+		if err := engine.Validate(ctx, descriptor); err != nil {
+			return nil, errors.Wrapf(err, "validate %s", descriptor.Digest)
+		}
+	}
+	return index.Manifests, nil
+}
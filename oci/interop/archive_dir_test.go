@@ -0,0 +1,170 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// newTestEngine creates a new image layout at the given path.
+func newTestEngine(t *testing.T, image string) casext.Engine {
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	return casext.NewEngine(engine)
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestArchiveRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Use a skopeo directory to create an image to export.
+	src := newTestEngine(t, filepath.Join(root, "src"))
+	defer src.Close()
+	dir := filepath.Join(root, "dir")
+	fakeSkopeoDir(t, dir, "1.1", ispec.MediaTypeImageManifest, ispec.MediaTypeImageConfig, ispec.MediaTypeImageLayerGzip)
+	descriptor, err := ImportSkopeoDir(ctx, src, dir)
+	if err != nil {
+		t.Fatalf("unexpected error importing: %+v", err)
+	}
+	descriptor.Annotations = map[string]string{
+		ispec.AnnotationRefName:       "latest",
+		AnnotationContainerdImageName: "docker.io/library/test:latest",
+	}
+
+	var archive bytes.Buffer
+	if err := ExportArchive(ctx, src, &archive, descriptor); err != nil {
+		t.Fatalf("unexpected error exporting: %+v", err)
+	}
+
+	// Every blob must only be included once.
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading archive: %+v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if len(names) != 5 {
+		t.Errorf("unexpected archive contents: %v", names)
+	}
+
+	dst := newTestEngine(t, filepath.Join(root, "dst"))
+	defer dst.Close()
+	descriptors, err := ImportArchive(ctx, dst, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error importing archive: %+v", err)
+	}
+	if len(descriptors) != 1 || !reflect.DeepEqual(descriptors[0], descriptor) {
+		t.Errorf("unexpected imported descriptors: %v", descriptors)
+	}
+	if err := dst.Validate(ctx, descriptor); err != nil {
+		t.Errorf("unexpected error validating imported image: %+v", err)
+	}
+}
+
+func TestImportArchiveInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImportArchiveInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := newTestEngine(t, filepath.Join(root, "image"))
+	defer engine.Close()
+
+	for _, test := range []struct {
+		name  string
+		files map[string]string
+	}{
+		{"Empty", map[string]string{}},
+		{"NoLayout", map[string]string{
+			"index.json": `{"schemaVersion": 2, "manifests": []}`,
+		}},
+		{"NoIndex", map[string]string{
+			"oci-layout": `{"imageLayoutVersion": "1.0.0"}`,
+		}},
+		{"BadLayoutVersion", map[string]string{
+			"oci-layout": `{"imageLayoutVersion": "0.1.0"}`,
+			"index.json": `{"schemaVersion": 2, "manifests": []}`,
+		}},
+		{"MisnamedBlob", map[string]string{
+			"oci-layout": `{"imageLayoutVersion": "1.0.0"}`,
+			"index.json": `{"schemaVersion": 2, "manifests": []}`,
+			"blobs/sha256/" + strings.Repeat("0", 64): "contents",
+		}},
+		{"MissingBlob", map[string]string{
+			"oci-layout": `{"imageLayoutVersion": "1.0.0"}`,
+			"index.json": `{"schemaVersion": 2, "manifests": [{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:` + strings.Repeat("0", 64) + `", "size": 1}]}`,
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			tw := tar.NewWriter(&archive)
+			for name, contents := range test.files {
+				if err := tw.WriteHeader(&tar.Header{
+					Name:     name,
+					Mode:     0644,
+					Size:     int64(len(contents)),
+					Typeflag: tar.TypeReg,
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tw.Write([]byte(contents)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := ImportArchive(ctx, engine, &archive); err == nil {
+				t.Errorf("expected error importing invalid archive")
+			}
+		})
+	}
+}
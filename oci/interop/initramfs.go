@@ -0,0 +1,372 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/cpio"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// initramfsInit is the path the kernel runs as init from an initramfs.
+const initramfsInit = "init"
+
+// defaultInits are the paths (in order of preference) that /init is linked to
+// if an image has no /init.
+var defaultInits = []string{
+	"sbin/init",
+	"usr/sbin/init",
+	"usr/lib/systemd/systemd",
+	"lib/systemd/systemd",
+}
+
+// kernelPatterns match the paths at which distributions install kernels.
+var kernelPatterns = []string{
+	"boot/vmlinuz",
+	"boot/vmlinuz-*",
+	"boot/Image",
+	"boot/Image-*",
+	"usr/lib/modules/*/vmlinuz",
+	"lib/modules/*/vmlinuz",
+}
+
+// maxSymlinkHops is the maximum number of symlinks followed when resolving a
+// path in an archive (the same limit as Linux).
+const maxSymlinkHops = 40
+
+// archiveEntry is the metadata of an entry of a root filesystem archive,
+// recorded by scanRootfs.
+type archiveEntry struct {
+	typeflag byte
+	linkname string
+}
+
+// archiveIndex is the set of entries in a root filesystem archive.
+type archiveIndex struct {
+	entries map[string]archiveEntry
+
+	// linked is the set of paths which are the target of hard links.
+	linked map[string]bool
+}
+
+// scanRootfs records the entries of the given squashed layer archive.
+func scanRootfs(squashed io.Reader) (*archiveIndex, error) {
+	index := &archiveIndex{
+		entries: map[string]archiveEntry{},
+		linked:  map[string]bool{},
+	}
+	tr := tar.NewReader(squashed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read next entry")
+		}
+		name := archivePath(hdr.Name)
+		if strings.HasPrefix(path.Base(name), ".wh.") {
+			continue
+		}
+		entry := archiveEntry{typeflag: hdr.Typeflag, linkname: hdr.Linkname}
+		if hdr.Typeflag == tar.TypeLink {
+			entry.linkname = archivePath(hdr.Linkname)
+			index.linked[entry.linkname] = true
+		}
+		index.entries[name] = entry
+	}
+	return index, nil
+}
+
+// resolve returns the path of the entry which the given path refers to, after
+// following any symlinks (as they would be resolved inside the root
+// filesystem). False is returned if the path doesn't exist.
+func (index *archiveIndex) resolve(name string) (string, bool) {
+	hops := 0
+	components := strings.Split(archivePath(name), "/")
+	resolved := "."
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+		current := path.Join(resolved, component)
+		entry, ok := index.entries[current]
+		if !ok {
+			return "", false
+		}
+		if entry.typeflag != tar.TypeSymlink {
+			resolved = current
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", false
+		}
+		target := entry.linkname
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		components = append(strings.Split(archivePath(target), "/"), components...)
+		resolved = "."
+	}
+	return resolved, true
+}
+
+// resolveRegular is like resolve, but only returns paths of regular files.
+func (index *archiveIndex) resolveRegular(name string) (string, bool) {
+	resolved, ok := index.resolve(name)
+	if !ok {
+		return "", false
+	}
+	entry := index.entries[resolved]
+	if entry.typeflag == tar.TypeLink {
+		// Only the target of the hard link has any contents.
+		resolved, entry = entry.linkname, index.entries[entry.linkname]
+	}
+	return resolved, entry.typeflag == tar.TypeReg || entry.typeflag == tar.TypeRegA
+}
+
+// findKernels returns the (resolved) paths of every kernel in the archive.
+func (index *archiveIndex) findKernels() []string {
+	found := map[string]bool{}
+	for name := range index.entries {
+		for _, pattern := range kernelPatterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				if resolved, ok := index.resolveRegular(name); ok {
+					found[resolved] = true
+				}
+			}
+		}
+	}
+	var kernels []string
+	for kernel := range found {
+		kernels = append(kernels, kernel)
+	}
+	sort.Strings(kernels)
+	return kernels
+}
+
+// InitramfsOptions are the options for ExportInitramfs.
+type InitramfsOptions struct {
+	// Kernel is the path of the kernel in the image. If empty, the kernel is
+	// found by looking at the usual paths (such as /boot/vmlinuz and
+	// /usr/lib/modules/*/vmlinuz).
+	Kernel string
+
+	// Init is the path in the image which /init is linked to if the image has
+	// no /init. If empty, the first of /sbin/init, /usr/sbin/init and
+	// /usr/lib/systemd/systemd in the image is used.
+	Init string
+}
+
+// InitramfsInfo describes an initramfs written by ExportInitramfs.
+type InitramfsInfo struct {
+	// Kernel is the path of the kernel in the image (which has been written
+	// to the kernel writer), or empty if no kernel was requested.
+	Kernel string
+
+	// Init is the path in the image which /init refers to.
+	Init string
+
+	// OSRelease is the contents of the os-release(5) file of the image, or
+	// nil if it doesn't have one.
+	OSRelease []byte
+}
+
+// ExportInitramfs writes the root filesystem of the image with the given
+// manifest to w as an (uncompressed) initramfs, which is a cpio archive in
+// the "newc" format. The layers are not extracted, so the ownership and
+// device nodes of the image are preserved regardless of privileges. If the
+// image doesn't have a /init (which the kernel runs from an initramfs), a
+// symlink to the init of the image is added.
+//
+// If kernel is not nil, the contents of the kernel in the image are also
+// written to it (and an error is returned if the image has no kernel, or
+// several kernels).
+func ExportInitramfs(ctx context.Context, engine casext.Engine, w io.Writer, manifest ispec.Manifest, opt InitramfsOptions, kernel io.Writer) (*InitramfsInfo, error) {
+	// Index the archive first, so we know what paths to look for.
+	squashed := layer.SquashLayers(ctx, engine, manifest.Layers)
+	index, err := scanRootfs(squashed)
+	squashed.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "scan root filesystem")
+	}
+
+	info := &InitramfsInfo{}
+	if kernel != nil {
+		if opt.Kernel != "" {
+			resolved, ok := index.resolveRegular(opt.Kernel)
+			if !ok {
+				return nil, errors.Errorf("kernel %s is not a regular file in the image", opt.Kernel)
+			}
+			info.Kernel = resolved
+		} else {
+			kernels := index.findKernels()
+			if len(kernels) == 0 {
+				return nil, errors.Errorf("no kernel found in the image")
+			}
+			if len(kernels) > 1 {
+				return nil, errors.Errorf("several kernels found in the image: %s", strings.Join(kernels, ", "))
+			}
+			info.Kernel = kernels[0]
+		}
+	}
+
+	addInit := false
+	if resolved, ok := index.resolve(initramfsInit); ok {
+		info.Init = resolved
+	} else {
+		inits := defaultInits
+		if opt.Init != "" {
+			inits = []string{opt.Init}
+		}
+		for _, candidate := range inits {
+			if _, ok := index.resolveRegular(candidate); ok {
+				info.Init = archivePath(candidate)
+				addInit = true
+				break
+			}
+		}
+		if info.Init == "" {
+			return nil, errors.Errorf("no init found in the image (tried %s)", strings.Join(inits, ", "))
+		}
+	}
+
+	osRelease, _ := index.resolveRegular(OSReleasePath)
+	if osRelease == "" {
+		osRelease, _ = index.resolveRegular(FallbackOSReleasePath)
+	}
+
+	type inode struct {
+		ino  uint32
+		mode uint32
+	}
+	inodes := map[string]inode{}
+	var lastIno uint32
+	cw := cpio.NewWriter(w)
+	squashed = layer.SquashLayers(ctx, engine, manifest.Layers)
+	defer squashed.Close()
+	tr := tar.NewReader(squashed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read next entry")
+		}
+		name := archivePath(hdr.Name)
+		if name == "." || strings.HasPrefix(path.Base(name), ".wh.") {
+			continue
+		}
+
+		lastIno++
+		chdr := &cpio.Header{
+			Name:    name,
+			Ino:     lastIno,
+			Mode:    uint32(hdr.Mode) & 07777,
+			Uid:     uint32(hdr.Uid),
+			Gid:     uint32(hdr.Gid),
+			Nlink:   1,
+			ModTime: hdr.ModTime,
+		}
+		var contents io.Reader
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			chdr.Mode |= cpio.TypeReg
+			chdr.Size = hdr.Size
+			contents = tr
+			// The kernel only links entries to earlier entries with the same
+			// inode if both have more than one link.
+			if index.linked[name] {
+				chdr.Nlink = 2
+			}
+		case tar.TypeLink:
+			target, ok := inodes[archivePath(hdr.Linkname)]
+			if !ok {
+				return nil, errors.Errorf("hard link %s has unknown target %s", name, hdr.Linkname)
+			}
+			chdr.Ino, chdr.Mode, chdr.Nlink = target.ino, target.mode, 2
+		case tar.TypeDir:
+			chdr.Mode |= cpio.TypeDir
+			chdr.Nlink = 2
+		case tar.TypeSymlink:
+			chdr.Mode |= cpio.TypeSymlink
+			chdr.Size = int64(len(hdr.Linkname))
+			contents = strings.NewReader(hdr.Linkname)
+		case tar.TypeChar:
+			chdr.Mode |= cpio.TypeChar
+			chdr.Devmajor, chdr.Devminor = uint32(hdr.Devmajor), uint32(hdr.Devminor)
+		case tar.TypeBlock:
+			chdr.Mode |= cpio.TypeBlock
+			chdr.Devmajor, chdr.Devminor = uint32(hdr.Devmajor), uint32(hdr.Devminor)
+		case tar.TypeFifo:
+			chdr.Mode |= cpio.TypeFifo
+		default:
+			return nil, errors.Errorf("unsupported entry type %q of %s", hdr.Typeflag, name)
+		}
+		if hdr.Typeflag != tar.TypeLink {
+			inodes[name] = inode{ino: chdr.Ino, mode: chdr.Mode}
+		}
+
+		if err := cw.WriteHeader(chdr); err != nil {
+			return nil, errors.Wrapf(err, "write header %s", name)
+		}
+		if contents != nil {
+			var writer io.Writer = cw
+			var buf bytes.Buffer
+			if name == info.Kernel && kernel != nil {
+				writer = io.MultiWriter(writer, kernel)
+			}
+			if name == osRelease {
+				writer = io.MultiWriter(writer, &buf)
+			}
+			if _, err := io.Copy(writer, contents); err != nil {
+				return nil, errors.Wrapf(err, "copy %s", name)
+			}
+			if name == osRelease {
+				info.OSRelease = buf.Bytes()
+			}
+		}
+	}
+
+	if addInit {
+		target := "/" + info.Init
+		if err := cw.WriteHeader(&cpio.Header{
+			Name:  initramfsInit,
+			Ino:   lastIno + 1,
+			Mode:  cpio.TypeSymlink | 0777,
+			Nlink: 1,
+			Size:  int64(len(target)),
+		}); err != nil {
+			return nil, errors.Wrap(err, "write init symlink")
+		}
+		if _, err := io.WriteString(cw, target); err != nil {
+			return nil, errors.Wrap(err, "write init symlink")
+		}
+	}
+	return info, errors.Wrap(cw.Close(), "close initramfs")
+}
@@ -0,0 +1,186 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/cpio"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// newcEntry is an entry read by readNewc.
+type newcEntry struct {
+	ino, mode, nlink uint32
+	contents         string
+}
+
+// readNewc parses a newc cpio archive, returning the entries by name (in
+// order).
+func readNewc(t *testing.T, archive []byte) ([]string, map[string]newcEntry) {
+	var names []string
+	entries := map[string]newcEntry{}
+	field := func(data []byte, idx int) uint32 {
+		value, err := strconv.ParseUint(string(data[6+8*idx:6+8*idx+8]), 16, 32)
+		if err != nil {
+			t.Fatalf("invalid newc header field: %v", err)
+		}
+		return uint32(value)
+	}
+	align := func(offset int) int { return (offset + 3) &^ 3 }
+	for offset := 0; ; {
+		hdr := archive[offset:]
+		if string(hdr[:6]) != "070701" {
+			t.Fatalf("invalid newc magic at offset %d", offset)
+		}
+		size, nameSize := int(field(hdr, 6)), int(field(hdr, 11))
+		name := string(hdr[110 : 110+nameSize-1])
+		dataOffset := align(offset + 110 + nameSize)
+		if name == "TRAILER!!!" {
+			break
+		}
+		names = append(names, name)
+		entries[name] = newcEntry{
+			ino:      field(hdr, 0),
+			mode:     field(hdr, 1),
+			nlink:    field(hdr, 4),
+			contents: string(archive[dataOffset : dataOffset+size]),
+		}
+		offset = align(dataOffset + size)
+	}
+	return names, entries
+}
+
+func TestExportInitramfs(t *testing.T) {
+	ctx := context.Background()
+
+	engine := casext.NewEngine(mem.New())
+	defer engine.Close()
+
+	base := putNspawnLayer(t, engine, []tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/sbin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/sbin/init", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "sbin", Typeflag: tar.TypeSymlink, Linkname: "usr/sbin"},
+		{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/os-release", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "usr/lib/modules/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/modules/6.1/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/modules/6.1/vmlinuz", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/os-release", Typeflag: tar.TypeSymlink, Linkname: "../usr/lib/os-release"},
+		{Name: "etc/old", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	}, map[string]string{
+		"usr/sbin/init":               "#!/bin/sh\n",
+		"usr/lib/os-release":          "ID=test\n",
+		"usr/lib/modules/6.1/vmlinuz": "kernel",
+		"etc/old":                     "old",
+	})
+	upper := putNspawnLayer(t, engine, []tar.Header{
+		{Name: "etc/.wh.old", Typeflag: tar.TypeReg},
+		{Name: "boot/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/vmlinuz", Typeflag: tar.TypeSymlink, Linkname: "/usr/lib/modules/6.1/vmlinuz"},
+		{Name: "boot/vmlinuz-6.1", Typeflag: tar.TypeLink, Linkname: "usr/lib/modules/6.1/vmlinuz"},
+	}, nil)
+	secondKernel := putNspawnLayer(t, engine, []tar.Header{
+		{Name: "boot/vmlinuz-5.0", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"boot/vmlinuz-5.0": "old kernel"})
+	initLayer := putNspawnLayer(t, engine, []tar.Header{
+		{Name: "init", Typeflag: tar.TypeReg, Mode: 0755},
+	}, map[string]string{"init": "#!/bin/sh\n"})
+
+	manifest := ispec.Manifest{Layers: []ispec.Descriptor{base, upper}}
+	var initramfs, kernel bytes.Buffer
+	info, err := ExportInitramfs(ctx, engine, &initramfs, manifest, InitramfsOptions{}, &kernel)
+	if err != nil {
+		t.Fatalf("unexpected error exporting initramfs: %+v", err)
+	}
+	if info.Kernel != "usr/lib/modules/6.1/vmlinuz" || kernel.String() != "kernel" {
+		t.Errorf("unexpected kernel %s: %q", info.Kernel, kernel.String())
+	}
+	if info.Init != "sbin/init" || string(info.OSRelease) != "ID=test\n" {
+		t.Errorf("unexpected initramfs info: %+v", info)
+	}
+
+	names, entries := readNewc(t, initramfs.Bytes())
+	if last := names[len(names)-1]; last != "init" {
+		t.Errorf("init symlink wasn't added last: %v", names)
+	}
+	if entry := entries["init"]; entry.mode != cpio.TypeSymlink|0777 || entry.contents != "/sbin/init" {
+		t.Errorf("unexpected init symlink: %+v", entry)
+	}
+	if _, ok := entries["etc/old"]; ok {
+		t.Errorf("removed file is in the initramfs")
+	}
+	for name := range entries {
+		if name == "." || name == "etc/.wh.old" {
+			t.Errorf("unexpected entry %s in initramfs", name)
+		}
+	}
+	if entry := entries["dev/null"]; entry.mode != cpio.TypeChar|0666 {
+		t.Errorf("unexpected dev/null mode: %o", entry.mode)
+	}
+	// The hard link must share the inode of its target.
+	target, link := entries["usr/lib/modules/6.1/vmlinuz"], entries["boot/vmlinuz-6.1"]
+	if target.ino != link.ino || target.nlink < 2 || link.nlink < 2 || link.contents != "" || target.contents != "kernel" {
+		t.Errorf("unexpected hard link: %+v %+v", target, link)
+	}
+
+	// Several kernels are ambiguous, unless the kernel is given explicitly.
+	manifest.Layers = append(manifest.Layers, secondKernel)
+	if _, err := ExportInitramfs(ctx, engine, &bytes.Buffer{}, manifest, InitramfsOptions{}, &bytes.Buffer{}); err == nil {
+		t.Errorf("expected error with several kernels")
+	}
+	kernel.Reset()
+	if _, err := ExportInitramfs(ctx, engine, &bytes.Buffer{}, manifest, InitramfsOptions{Kernel: "/boot/vmlinuz-5.0"}, &kernel); err != nil || kernel.String() != "old kernel" {
+		t.Errorf("unexpected result with explicit kernel: %q %v", kernel.String(), err)
+	}
+	// Without a kernel writer, kernels are ignored.
+	if _, err := ExportInitramfs(ctx, engine, &bytes.Buffer{}, manifest, InitramfsOptions{}, nil); err != nil {
+		t.Errorf("unexpected error without kernel: %+v", err)
+	}
+
+	// An existing /init is used as-is.
+	manifest.Layers = append(manifest.Layers, initLayer)
+	initramfs.Reset()
+	info, err = ExportInitramfs(ctx, engine, &initramfs, manifest, InitramfsOptions{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error exporting initramfs: %+v", err)
+	}
+	if _, entries := readNewc(t, initramfs.Bytes()); info.Init != "init" || entries["init"].mode != cpio.TypeReg|0755 {
+		t.Errorf("existing init was replaced: %+v", entries["init"])
+	}
+
+	// Missing inits are an error.
+	manifest.Layers = []ispec.Descriptor{secondKernel}
+	if _, err := ExportInitramfs(ctx, engine, &bytes.Buffer{}, manifest, InitramfsOptions{}, nil); err == nil {
+		t.Errorf("expected error without init")
+	}
+	manifest.Layers = []ispec.Descriptor{base}
+	if _, err := ExportInitramfs(ctx, engine, &bytes.Buffer{}, manifest, InitramfsOptions{Init: "/bin/sh"}, nil); err == nil {
+		t.Errorf("expected error with missing explicit init")
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package interop provides conversion between OCI image layouts and the image
+// formats used by other container tools.
+package interop
+
+import (
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Media types used by the Docker image manifest (version 2, schema 2) format,
+// which is also used by skopeo and containers/image.
+const (
+	MediaTypeDockerManifest       = casext.MediaTypeDockerManifest
+	MediaTypeDockerManifestList   = casext.MediaTypeDockerManifestList
+	MediaTypeDockerConfig         = casext.MediaTypeDockerConfig
+	MediaTypeDockerLayer          = casext.MediaTypeDockerLayer
+	MediaTypeDockerLayerGzip      = casext.MediaTypeDockerLayerGzip
+	MediaTypeDockerForeignLayerGz = casext.MediaTypeDockerForeignLayer
+	MediaTypeDockerSchema1        = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeDockerSchema1Signed  = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// convertDescriptor returns a copy of the given descriptor with its Docker
+// media type replaced by the equivalent OCI media type. Descriptors with OCI
+// (or unknown) media types are returned unchanged.
+func convertDescriptor(descriptor ispec.Descriptor) ispec.Descriptor {
+	// Converting to FormatOCI never fails.
+	descriptor.MediaType, _ = casext.ConvertMediaType(descriptor.MediaType, casext.FormatOCI)
+	return descriptor
+}
@@ -0,0 +1,257 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The layout of an LXD (unified) image tarball.
+const (
+	lxdMetadataPath  = "metadata.yaml"
+	lxdRootfsDir     = "rootfs"
+	lxdTemplatesDir  = "templates"
+	lxdHostnameFile  = "hostname.tpl"
+	lxdEnvironFile   = "environment.tpl"
+	lxdHostnamePath  = "/etc/hostname"
+	lxdEnvironPath   = "/etc/environment"
+	lxdHostnameValue = "{{ container.name }}\n"
+)
+
+// lxdArchitectures maps GOARCH values (as used in image configurations) to
+// the architecture names used by LXD.
+var lxdArchitectures = map[string]string{
+	"386":      "i686",
+	"amd64":    "x86_64",
+	"arm":      "armv7l",
+	"arm64":    "aarch64",
+	"ppc":      "ppc",
+	"ppc64":    "ppc64",
+	"ppc64le":  "ppc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+	"mips":     "mips",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+}
+
+// LXDTemplate is a file which LXD generates in the root filesystem of an
+// instance (from a pongo2 template) when the instance is created.
+type LXDTemplate struct {
+	// Path is the (absolute) path of the file in the instance.
+	Path string
+
+	// When is the list of events which cause the file to be generated (such as
+	// "create", "copy" and "start").
+	When []string
+
+	// Name is the name of the template in the templates directory of the
+	// image.
+	Name string
+
+	// Template is the contents of the template.
+	Template string
+}
+
+// LXDMetadata is the metadata of an LXD image, which is written to
+// metadata.yaml.
+type LXDMetadata struct {
+	// Architecture is the LXD name of the architecture of the image.
+	Architecture string
+
+	// CreationDate is the creation time of the image (as a Unix timestamp).
+	CreationDate int64
+
+	// Properties are the properties of the image, which LXD shows when
+	// listing images (such as "description", "os" and "release").
+	Properties map[string]string
+
+	// Templates are the templates used to generate files in instances of
+	// the image.
+	Templates []LXDTemplate
+}
+
+// yamlQuote returns a YAML (double-quoted) scalar with the given value. JSON
+// strings are valid YAML scalars.
+func yamlQuote(value string) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// YAML returns the contents of metadata.yaml for the metadata.
+func (m LXDMetadata) YAML() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "architecture: %s\n", yamlQuote(m.Architecture))
+	fmt.Fprintf(&buf, "creation_date: %d\n", m.CreationDate)
+
+	var keys []string
+	for key := range m.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(&buf, "properties:")
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "  %s: %s\n", yamlQuote(key), yamlQuote(m.Properties[key]))
+	}
+
+	fmt.Fprintln(&buf, "templates:")
+	for _, template := range m.Templates {
+		fmt.Fprintf(&buf, "  %s:\n", yamlQuote(template.Path))
+		fmt.Fprintln(&buf, "    when:")
+		for _, when := range template.When {
+			fmt.Fprintf(&buf, "      - %s\n", yamlQuote(when))
+		}
+		fmt.Fprintf(&buf, "    template: %s\n", yamlQuote(template.Name))
+	}
+	return buf.Bytes()
+}
+
+// pongoLiteral returns a pongo2 template which outputs the given text as-is.
+func pongoLiteral(text string) string {
+	if !strings.ContainsAny(text, "{}") {
+		return text
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `{{ "` + replacer.Replace(text) + `" }}`
+}
+
+// NewLXDMetadata returns the metadata for an LXD image of the image with the
+// given manifest and configuration. The description of the image is taken
+// from the org.opencontainers.image.title annotation (or label), defaulting
+// to the given name.
+//
+// The templates generate /etc/hostname from the name of the instance and (if
+// the configuration has any environment variables) /etc/environment from the
+// environment of the image. The entrypoint and command of the image are
+// stored in the "command" property, since LXD instances run the init system
+// of the image rather than a command.
+func NewLXDMetadata(manifest ispec.Manifest, config ispec.Image, name string) LXDMetadata {
+	arch, ok := lxdArchitectures[config.Architecture]
+	if !ok {
+		arch = config.Architecture
+	}
+	metadata := LXDMetadata{
+		Architecture: arch,
+		CreationDate: imageTime(config).Unix(),
+		Properties:   map[string]string{},
+	}
+
+	description := name
+	if title := imageAnnotation(manifest, config, ispec.AnnotationTitle); title != "" {
+		description = title
+	}
+	metadata.Properties["description"] = description
+	if config.OS != "" {
+		metadata.Properties["os"] = config.OS
+	}
+	if version := imageAnnotation(manifest, config, ispec.AnnotationVersion); version != "" {
+		metadata.Properties["release"] = version
+	}
+	if arch != "" {
+		metadata.Properties["architecture"] = arch
+	}
+	if args := append(append([]string{}, config.Config.Entrypoint...), config.Config.Cmd...); len(args) > 0 {
+		var quoted []string
+		for _, arg := range args {
+			quoted = append(quoted, nspawnQuote(arg))
+		}
+		metadata.Properties["command"] = strings.Join(quoted, " ")
+	}
+
+	metadata.Templates = append(metadata.Templates, LXDTemplate{
+		Path:     lxdHostnamePath,
+		When:     []string{"create", "copy"},
+		Name:     lxdHostnameFile,
+		Template: lxdHostnameValue,
+	})
+	if len(config.Config.Env) > 0 {
+		var environ bytes.Buffer
+		for _, value := range config.Config.Env {
+			// pam_env(8) doesn't support multi-line values.
+			value = strings.Replace(value, "\n", " ", -1)
+			fmt.Fprintln(&environ, pongoLiteral(value))
+		}
+		metadata.Templates = append(metadata.Templates, LXDTemplate{
+			Path:     lxdEnvironPath,
+			When:     []string{"create", "copy"},
+			Name:     lxdEnvironFile,
+			Template: environ.String(),
+		})
+	}
+	return metadata
+}
+
+// ExportLXDArchive writes a unified LXD image tarball (containing
+// metadata.yaml, the templates and the root filesystem of the image with the
+// given manifest) to w, which can be imported with "lxc image import". The
+// layers are not extracted, so the ownership and device nodes of the image
+// are preserved regardless of privileges.
+func ExportLXDArchive(ctx context.Context, engine casext.Engine, w io.Writer, manifest ispec.Manifest, config ispec.Image, metadata LXDMetadata) error {
+	modTime := imageTime(config)
+	tw := tar.NewWriter(w)
+
+	data := metadata.YAML()
+	if err := writeArchiveFile(tw, lxdMetadataPath, modTime, bytes.NewReader(data), int64(len(data))); err != nil {
+		return errors.Wrap(err, "write metadata")
+	}
+	if len(metadata.Templates) > 0 {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     lxdTemplatesDir + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  modTime,
+		}); err != nil {
+			return errors.Wrap(err, "write templates directory")
+		}
+	}
+	for _, template := range metadata.Templates {
+		name := path.Join(lxdTemplatesDir, template.Name)
+		if err := writeArchiveFile(tw, name, modTime, strings.NewReader(template.Template), int64(len(template.Template))); err != nil {
+			return errors.Wrapf(err, "write template %s", template.Name)
+		}
+	}
+
+	// The root directory may not be in the layers.
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     lxdRootfsDir + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  modTime,
+	}); err != nil {
+		return errors.Wrap(err, "write rootfs directory")
+	}
+	squashed := layer.SquashLayers(ctx, engine, manifest.Layers)
+	defer squashed.Close()
+	if _, err := copyRootfs(tw, squashed, lxdRootfsDir); err != nil {
+		return errors.Wrap(err, "copy root filesystem")
+	}
+	return errors.Wrap(tw.Close(), "close archive")
+}
@@ -0,0 +1,133 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestNewLXDMetadata(t *testing.T) {
+	created := time.Unix(1234567890, 0)
+	var config ispec.Image
+	config.Created = &created
+	config.OS = "linux"
+	config.Architecture = "arm64"
+	config.Config.Entrypoint = []string{"/bin/sh"}
+	config.Config.Cmd = []string{"-c", "echo hi"}
+	config.Config.Env = []string{"PATH=/bin", "TEMPLATE={{ x }}"}
+	config.Config.Labels = map[string]string{ispec.AnnotationVersion: "1.0"}
+	manifest := ispec.Manifest{Annotations: map[string]string{ispec.AnnotationTitle: "Test: \"Image\""}}
+
+	metadata := NewLXDMetadata(manifest, config, "latest")
+	expected := []string{
+		`architecture: "aarch64"`,
+		"creation_date: 1234567890",
+		"properties:",
+		`  "architecture": "aarch64"`,
+		`  "command": "/bin/sh -c \"echo hi\""`,
+		`  "description": "Test: \"Image\""`,
+		`  "os": "linux"`,
+		`  "release": "1.0"`,
+		"templates:",
+		`  "/etc/hostname":`,
+		"    when:",
+		`      - "create"`,
+		`      - "copy"`,
+		`    template: "hostname.tpl"`,
+		`  "/etc/environment":`,
+		"    when:",
+		`      - "create"`,
+		`      - "copy"`,
+		`    template: "environment.tpl"`,
+	}
+	yaml := strings.Split(strings.TrimSuffix(string(metadata.YAML()), "\n"), "\n")
+	if !reflect.DeepEqual(yaml, expected) {
+		t.Errorf("unexpected metadata.yaml:\n%s\nexpected:\n%s", strings.Join(yaml, "\n"), strings.Join(expected, "\n"))
+	}
+	if environ := metadata.Templates[1].Template; environ != "PATH=/bin\n{{ \"TEMPLATE={{ x }}\" }}\n" {
+		t.Errorf("unexpected environment template: %q", environ)
+	}
+
+	// Without an environment there is only the hostname template.
+	metadata = NewLXDMetadata(ispec.Manifest{}, ispec.Image{}, "latest")
+	if len(metadata.Templates) != 1 || metadata.Properties["description"] != "latest" {
+		t.Errorf("unexpected metadata: %#v", metadata)
+	}
+}
+
+func TestExportLXDArchive(t *testing.T) {
+	ctx := context.Background()
+
+	engine := casext.NewEngine(mem.New())
+	defer engine.Close()
+
+	layers := []ispec.Descriptor{
+		putNspawnLayer(t, engine, []tar.Header{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/old", Typeflag: tar.TypeReg, Mode: 0644},
+		}, map[string]string{
+			"etc/passwd": "root:x:0:0::/root:/bin/sh\n",
+			"etc/old":    "old",
+		}),
+		putNspawnLayer(t, engine, []tar.Header{
+			{Name: "etc/.wh.old", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/hard", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+		}, nil),
+	}
+
+	var config ispec.Image
+	config.Config.Env = []string{"PATH=/bin"}
+	manifest := ispec.Manifest{Layers: layers}
+	metadata := NewLXDMetadata(manifest, config, "latest")
+
+	var archive bytes.Buffer
+	if err := ExportLXDArchive(ctx, engine, &archive, manifest, config, metadata); err != nil {
+		t.Fatalf("unexpected error exporting: %+v", err)
+	}
+	names, contents := readArchive(t, archive.Bytes())
+	expected := []string{
+		"metadata.yaml",
+		"templates/",
+		"templates/hostname.tpl",
+		"templates/environment.tpl",
+		"rootfs/",
+		"rootfs/etc/",
+		"rootfs/etc/passwd",
+		"rootfs/etc/hard",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected archive entries: got %v, expected %v", names, expected)
+	}
+	if contents["metadata.yaml"] != string(metadata.YAML()) {
+		t.Errorf("unexpected metadata.yaml: %q", contents["metadata.yaml"])
+	}
+	if contents["templates/hostname.tpl"] != "{{ container.name }}\n" || contents["templates/environment.tpl"] != "PATH=/bin\n" {
+		t.Errorf("unexpected templates: %q", contents)
+	}
+}
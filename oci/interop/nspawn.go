@@ -0,0 +1,285 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The paths at which systemd looks for the os-release(5) file of an OS tree.
+// systemd-nspawn(1) refuses to boot a tree without one, and machinectl uses
+// it to describe the image.
+const (
+	OSReleasePath         = "etc/os-release"
+	FallbackOSReleasePath = "usr/lib/os-release"
+)
+
+// rootfsArchive is the set of paths written by copyRootfs.
+type rootfsArchive struct {
+	// entries maps each (cleaned, relative) path to its typeflag.
+	entries map[string]byte
+}
+
+// hasRegular returns whether a regular file was written to the given path.
+func (a *rootfsArchive) hasRegular(name string) bool {
+	typeflag, ok := a.entries[name]
+	return ok && (typeflag == tar.TypeReg || typeflag == tar.TypeRegA)
+}
+
+// archivePath returns the cleaned form of the given archive path, relative to
+// the root of the archive.
+func archivePath(name string) string {
+	name = strings.TrimPrefix(layer.CleanPath("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// copyRootfs copies the entries of the given squashed (uncompressed) layer
+// archive to tw as a plain root filesystem archive, with every path placed
+// under prefix. Whiteouts are dropped, since a squashed layer is applied to
+// an empty root filesystem.
+func copyRootfs(tw *tar.Writer, squashed io.Reader, prefix string) (*rootfsArchive, error) {
+	archive := &rootfsArchive{entries: map[string]byte{}}
+	tr := tar.NewReader(squashed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read next entry")
+		}
+		name := archivePath(hdr.Name)
+		if strings.HasPrefix(path.Base(name), ".wh.") {
+			continue
+		}
+		archive.entries[name] = hdr.Typeflag
+
+		hdr.Name = path.Join(prefix, name)
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join(prefix, archivePath(hdr.Linkname))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, errors.Wrapf(err, "write header %s", name)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, errors.Wrapf(err, "copy %s", name)
+		}
+	}
+	return archive, nil
+}
+
+// writeMissingFile writes a regular file with the given contents (owned by
+// root) to the path prefix/name of the archive, along with any of its parent
+// directories which are not in the archive.
+func (a *rootfsArchive) writeMissingFile(tw *tar.Writer, prefix, name string, data []byte, modTime time.Time) error {
+	var parents []string
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := a.entries[dir]; !ok {
+			parents = append([]string{dir}, parents...)
+		}
+	}
+	for _, dir := range parents {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     path.Join(prefix, dir) + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  modTime,
+		}); err != nil {
+			return errors.Wrapf(err, "write directory %s", dir)
+		}
+		a.entries[dir] = tar.TypeDir
+	}
+	a.entries[name] = tar.TypeReg
+	return writeArchiveFile(tw, path.Join(prefix, name), modTime, bytes.NewReader(data), int64(len(data)))
+}
+
+// imageTime returns the creation time of the image, or the epoch if the
+// configuration doesn't have one (so that the output is reproducible).
+func imageTime(config ispec.Image) time.Time {
+	if config.Created != nil {
+		return *config.Created
+	}
+	return time.Unix(0, 0)
+}
+
+// imageAnnotation returns the value of the given annotation of the image,
+// which is taken from the manifest annotations or the configuration labels.
+func imageAnnotation(manifest ispec.Manifest, config ispec.Image, key string) string {
+	if value, ok := manifest.Annotations[key]; ok {
+		return value
+	}
+	return config.Config.Labels[key]
+}
+
+// osReleaseIDRegexp matches the characters which are not allowed in the ID
+// and VERSION_ID fields of os-release(5).
+var osReleaseIDRegexp = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// osReleaseQuote quotes a value for use in os-release(5).
+func osReleaseQuote(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", " ")
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// NspawnOSRelease returns the contents of an os-release(5) file describing
+// the image with the given manifest and configuration, for images which do
+// not contain one. The name of the image is taken from the
+// org.opencontainers.image.title annotation (or label), defaulting to the
+// given name.
+func NspawnOSRelease(manifest ispec.Manifest, config ispec.Image, name string) []byte {
+	if title := imageAnnotation(manifest, config, ispec.AnnotationTitle); title != "" {
+		name = title
+	}
+	id := strings.Trim(osReleaseIDRegexp.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if id == "" {
+		id = "oci-image"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "NAME=%s\n", osReleaseQuote(name))
+	fmt.Fprintf(&buf, "ID=%s\n", id)
+	prettyName := name
+	if version := imageAnnotation(manifest, config, ispec.AnnotationVersion); version != "" {
+		fmt.Fprintf(&buf, "VERSION=%s\n", osReleaseQuote(version))
+		if versionID := osReleaseIDRegexp.ReplaceAllString(strings.ToLower(version), "-"); versionID != "" {
+			fmt.Fprintf(&buf, "VERSION_ID=%s\n", versionID)
+		}
+		prettyName += " " + version
+	}
+	fmt.Fprintf(&buf, "PRETTY_NAME=%s\n", osReleaseQuote(prettyName))
+	if url := imageAnnotation(manifest, config, ispec.AnnotationURL); url != "" {
+		fmt.Fprintf(&buf, "HOME_URL=%s\n", osReleaseQuote(url))
+	}
+	return buf.Bytes()
+}
+
+// ExportNspawnArchive writes the root filesystem of the image with the given
+// manifest (and configuration) to w as a tar archive which can be imported with "machinectl
+// import-tar" (and run with systemd-nspawn(1)), without extracting the
+// layers. If the image contains neither /etc/os-release nor
+// /usr/lib/os-release (which systemd requires), osRelease (such as from
+// NspawnOSRelease) is written to /usr/lib/os-release.
+func ExportNspawnArchive(ctx context.Context, engine casext.Engine, w io.Writer, manifest ispec.Manifest, config ispec.Image, osRelease []byte) error {
+	squashed := layer.SquashLayers(ctx, engine, manifest.Layers)
+	defer squashed.Close()
+
+	tw := tar.NewWriter(w)
+	archive, err := copyRootfs(tw, squashed, "")
+	if err != nil {
+		return errors.Wrap(err, "copy root filesystem")
+	}
+	if !archive.hasRegular(OSReleasePath) && !archive.hasRegular(FallbackOSReleasePath) {
+		if err := archive.writeMissingFile(tw, "", FallbackOSReleasePath, osRelease, imageTime(config)); err != nil {
+			return errors.Wrap(err, "write os-release")
+		}
+	}
+	return errors.Wrap(tw.Close(), "close archive")
+}
+
+// WriteNspawnOSRelease writes osRelease to /usr/lib/os-release of the
+// extracted root filesystem at rootfsPath, unless it already contains an
+// os-release(5) file (as required by systemd-nspawn(1)). It is the equivalent
+// of the handling of os-release by ExportNspawnArchive for "machinectl
+// import-fs".
+func WriteNspawnOSRelease(rootfsPath string, osRelease []byte) error {
+	for _, name := range []string{OSReleasePath, FallbackOSReleasePath} {
+		fullPath, err := securejoin.SecureJoin(rootfsPath, name)
+		if err != nil {
+			return errors.Wrapf(err, "resolve %s", name)
+		}
+		if fi, err := os.Lstat(fullPath); err == nil && fi.Mode().IsRegular() {
+			return nil
+		}
+	}
+
+	fullPath, err := securejoin.SecureJoin(rootfsPath, FallbackOSReleasePath)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %s", FallbackOSReleasePath)
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return errors.Wrap(err, "mkdir os-release parent")
+	}
+	return errors.Wrap(ioutil.WriteFile(fullPath, osRelease, 0644), "write os-release")
+}
+
+// nspawnQuote quotes a single argument for a systemd.nspawn(5) setting if
+// necessary.
+func nspawnQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\") {
+		return arg
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + replacer.Replace(arg) + `"`
+}
+
+// NspawnUnit returns the contents of a systemd.nspawn(5) file which runs the
+// entrypoint and command of the given image configuration (rather than
+// booting the image) with its environment, working directory and user.
+func NspawnUnit(config ispec.Image, comment string) []byte {
+	var buf bytes.Buffer
+	if comment != "" {
+		fmt.Fprintf(&buf, "# %s\n", comment)
+	}
+	fmt.Fprintln(&buf, "[Exec]")
+	fmt.Fprintln(&buf, "Boot=no")
+
+	args := append(append([]string{}, config.Config.Entrypoint...), config.Config.Cmd...)
+	if len(args) > 0 {
+		var quoted []string
+		for _, arg := range args {
+			quoted = append(quoted, nspawnQuote(arg))
+		}
+		fmt.Fprintf(&buf, "Parameters=%s\n", strings.Join(quoted, " "))
+	}
+
+	for _, value := range config.Config.Env {
+		fmt.Fprintf(&buf, "Environment=%s\n", nspawnQuote(value))
+	}
+	if config.Config.WorkingDir != "" {
+		fmt.Fprintf(&buf, "WorkingDirectory=%s\n", nspawnQuote(config.Config.WorkingDir))
+	}
+	// nspawn only supports users (not groups), which are looked up in the
+	// container.
+	if user := strings.SplitN(config.Config.User, ":", 2)[0]; user != "" {
+		fmt.Fprintf(&buf, "User=%s\n", nspawnQuote(user))
+	}
+	return buf.Bytes()
+}
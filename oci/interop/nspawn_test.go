@@ -0,0 +1,240 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// putNspawnLayer stores a gzip-compressed layer containing the given entries
+// (with the given regular file contents) in the engine.
+func putNspawnLayer(t *testing.T, engine casext.Engine, headers []tar.Header, contents map[string]string) ispec.Descriptor {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, hdr := range headers {
+		hdr.Size = int64(len(contents[hdr.Name]))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, contents[hdr.Name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	digest, size, err := engine.PutBlob(context.Background(), &buf)
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest,
+		Size:      size,
+	}
+}
+
+// readArchive returns the names and regular file contents of the entries of
+// the given tar archive.
+func readArchive(t *testing.T, archive []byte) ([]string, map[string]string) {
+	var names []string
+	contents := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading archive: %+v", err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[hdr.Name] = string(data)
+		}
+	}
+	return names, contents
+}
+
+func TestExportNspawnArchive(t *testing.T) {
+	ctx := context.Background()
+
+	engine := casext.NewEngine(mem.New())
+	defer engine.Close()
+
+	base := putNspawnLayer(t, engine, []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "./etc/old", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "./bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+		{Name: "./usr/", Typeflag: tar.TypeDir, Mode: 0755},
+	}, map[string]string{
+		"./etc/passwd": "root:x:0:0::/root:/bin/sh\n",
+		"./etc/old":    "old",
+	})
+	whiteout := putNspawnLayer(t, engine, []tar.Header{
+		{Name: "etc/.wh.old", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc/hard", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+	}, nil)
+	osRelease := putNspawnLayer(t, engine, []tar.Header{
+		{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/lib/os-release", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{
+		"usr/lib/os-release": "ID=test\n",
+	})
+
+	generated := []byte("ID=generated\n")
+	for _, test := range []struct {
+		name     string
+		layers   []ispec.Descriptor
+		expected []string
+		release  string
+	}{
+		{"Generated", []ispec.Descriptor{base, whiteout}, []string{
+			"./", "etc/", "etc/passwd", "bin", "usr/", "etc/hard", "usr/lib/", "usr/lib/os-release",
+		}, string(generated)},
+		{"Existing", []ispec.Descriptor{base, whiteout, osRelease}, []string{
+			"./", "etc/", "etc/passwd", "bin", "usr/", "etc/hard", "usr/lib/", "usr/lib/os-release",
+		}, "ID=test\n"},
+		{"Empty", nil, []string{
+			"usr/", "usr/lib/", "usr/lib/os-release",
+		}, string(generated)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			manifest := ispec.Manifest{Layers: test.layers}
+			if err := ExportNspawnArchive(ctx, engine, &archive, manifest, ispec.Image{}, generated); err != nil {
+				t.Fatalf("unexpected error exporting: %+v", err)
+			}
+			names, contents := readArchive(t, archive.Bytes())
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("unexpected archive entries: got %v, expected %v", names, test.expected)
+			}
+			if contents["usr/lib/os-release"] != test.release {
+				t.Errorf("unexpected os-release: %q", contents["usr/lib/os-release"])
+			}
+		})
+	}
+}
+
+func TestWriteNspawnOSRelease(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "umoci-TestWriteNspawnOSRelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	// An os-release symlink to a missing file doesn't count.
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../usr/lib/os-release", filepath.Join(rootfs, "etc/os-release")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNspawnOSRelease(rootfs, []byte("ID=first\n")); err != nil {
+		t.Fatalf("unexpected error writing os-release: %+v", err)
+	}
+	// The existing file must be left alone.
+	if err := WriteNspawnOSRelease(rootfs, []byte("ID=second\n")); err != nil {
+		t.Fatalf("unexpected error writing os-release: %+v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, "etc/os-release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ID=first\n" {
+		t.Errorf("unexpected os-release: %q", data)
+	}
+}
+
+func TestNspawnOSRelease(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		expected    string
+	}{
+		{"Default", nil, nil, "NAME=\"latest\"\nID=latest\nPRETTY_NAME=\"latest\"\n"},
+		{"Annotations", map[string]string{
+			ispec.AnnotationTitle:   "My \"Image\"",
+			ispec.AnnotationVersion: "1.0 Beta",
+			ispec.AnnotationURL:     "https://example.com/",
+		}, map[string]string{
+			ispec.AnnotationTitle: "ignored",
+		}, "NAME=\"My \\\"Image\\\"\"\nID=my-image\nVERSION=\"1.0 Beta\"\nVERSION_ID=1.0-beta\nPRETTY_NAME=\"My \\\"Image\\\" 1.0 Beta\"\nHOME_URL=\"https://example.com/\"\n"},
+		{"Labels", nil, map[string]string{
+			ispec.AnnotationTitle: "$$$",
+		}, "NAME=\"\\$\\$\\$\"\nID=oci-image\nPRETTY_NAME=\"\\$\\$\\$\"\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			manifest := ispec.Manifest{Annotations: test.annotations}
+			var config ispec.Image
+			config.Config.Labels = test.labels
+			if got := string(NspawnOSRelease(manifest, config, "latest")); got != test.expected {
+				t.Errorf("unexpected os-release:\n%s\nexpected:\n%s", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestNspawnUnit(t *testing.T) {
+	var config ispec.Image
+	config.Config.Entrypoint = []string{"/bin/sh", "-c"}
+	config.Config.Cmd = []string{`echo "hello world"`}
+	config.Config.Env = []string{"PATH=/bin", "A=b c"}
+	config.Config.WorkingDir = "/srv"
+	config.Config.User = "daemon:daemon"
+
+	expected := []string{
+		"# comment",
+		"[Exec]",
+		"Boot=no",
+		`Parameters=/bin/sh -c "echo \"hello world\""`,
+		"Environment=PATH=/bin",
+		`Environment="A=b c"`,
+		"WorkingDirectory=/srv",
+		"User=daemon",
+	}
+	unit := strings.Split(strings.TrimSuffix(string(NspawnUnit(config, "comment")), "\n"), "\n")
+	if !reflect.DeepEqual(unit, expected) {
+		t.Errorf("unexpected unit:\n%s\nexpected:\n%s", strings.Join(unit, "\n"), strings.Join(expected, "\n"))
+	}
+}
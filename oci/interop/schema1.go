@@ -0,0 +1,303 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// emptyLayerDigest is the digest of the gzip-compressed empty tar archive,
+// which was used by schema1 manifests for history entries which didn't
+// change the filesystem (before the "throwaway" field was added).
+const emptyLayerDigest = digest.Digest("sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4")
+
+// IsSchema1MediaType returns whether the media type is the media type of a
+// Docker (version 2, schema 1) manifest, which must be converted with
+// ConvertSchema1 before it can be used.
+func IsSchema1MediaType(mediaType string) bool {
+	return mediaType == MediaTypeDockerSchema1 ||
+		mediaType == MediaTypeDockerSchema1Signed
+}
+
+// schema1Manifest is a Docker (version 2, schema 1) manifest. The layers and
+// history are ordered from the newest to the oldest.
+type schema1Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Name          string `json:"name"`
+	Tag           string `json:"tag"`
+	Architecture  string `json:"architecture"`
+	FSLayers      []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+	Signatures []struct {
+		Protected string `json:"protected"`
+	} `json:"signatures,omitempty"`
+}
+
+// schema1Image is the (legacy) image configuration stored in each history
+// entry of a schema1 manifest. The fields of Config have the same names as
+// ispec.ImageConfig.
+type schema1Image struct {
+	ID              string             `json:"id"`
+	Created         time.Time          `json:"created"`
+	Author          string             `json:"author,omitempty"`
+	Comment         string             `json:"comment,omitempty"`
+	Architecture    string             `json:"architecture,omitempty"`
+	OS              string             `json:"os,omitempty"`
+	Config          *ispec.ImageConfig `json:"config,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+	ThrowAway bool `json:"throwaway,omitempty"`
+}
+
+// schema1Protected is the protected header of a schema1 manifest signature,
+// which describes how to reconstruct the signed payload.
+type schema1Protected struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+}
+
+// Schema1Digest returns the digest of the given schema1 manifest, as used by
+// registries to refer to it. The digest of a signed manifest is the digest of
+// its payload, which excludes the signatures.
+func Schema1Digest(manifestBlob []byte) (digest.Digest, error) {
+	var manifest schema1Manifest
+	if err := json.Unmarshal(manifestBlob, &manifest); err != nil {
+		return "", errors.Wrap(err, "parse manifest")
+	}
+	if len(manifest.Signatures) == 0 {
+		return digest.FromBytes(manifestBlob), nil
+	}
+
+	// All signatures cover the same payload, so we only need the first.
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(manifest.Signatures[0].Protected, "="))
+	if err != nil {
+		return "", errors.Wrap(err, "decode protected header")
+	}
+	var protected schema1Protected
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return "", errors.Wrap(err, "parse protected header")
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protected.FormatTail, "="))
+	if err != nil {
+		return "", errors.Wrap(err, "decode formatTail")
+	}
+	if protected.FormatLength < 0 || protected.FormatLength > len(manifestBlob) {
+		return "", errors.Errorf("invalid formatLength %d", protected.FormatLength)
+	}
+	payload := append(append([]byte{}, manifestBlob[:protected.FormatLength]...), tail...)
+	return digest.FromBytes(payload), nil
+}
+
+// ConvertSchema1 converts the given Docker (version 2, schema 1) manifest into
+// an OCI manifest and image configuration, which are stored in the image
+// layout, and returns the descriptor of the new manifest. Schema1 manifests
+// have no image configuration, so it is synthesised from the legacy
+// configuration of the newest history entry, and the history and diffIDs are
+// computed from every history entry and layer. Layers which are missing from
+// the image layout are fetched from the given resolvers (which may be nil if
+// every layer is already present). Signatures are ignored, as they are not
+// valid for the converted manifest.
+func ConvertSchema1(ctx context.Context, engine casext.Engine, manifestBlob []byte, resolvers []casext.BlobResolver) (ispec.Descriptor, error) {
+	var manifest schema1Manifest
+	if err := json.Unmarshal(manifestBlob, &manifest); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "parse manifest")
+	}
+	if manifest.SchemaVersion != 1 {
+		return ispec.Descriptor{}, errors.Errorf("unsupported manifest schemaVersion %d", manifest.SchemaVersion)
+	}
+	if len(manifest.History) == 0 || len(manifest.History) != len(manifest.FSLayers) {
+		return ispec.Descriptor{}, errors.Errorf("manifest has %d layers and %d history entries", len(manifest.FSLayers), len(manifest.History))
+	}
+
+	var (
+		newest  schema1Image
+		layers  []ispec.Descriptor
+		diffIDs []digest.Digest
+		history []ispec.History
+	)
+
+	// Schema1 manifests list the newest history entry first.
+	for idx := len(manifest.History) - 1; idx >= 0; idx-- {
+		var v1Image schema1Image
+		if err := json.Unmarshal([]byte(manifest.History[idx].V1Compatibility), &v1Image); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "parse history[%d]", idx)
+		}
+		if idx == 0 {
+			newest = v1Image
+		}
+
+		blobSum := manifest.FSLayers[idx].BlobSum
+		if err := blobSum.Validate(); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "invalid digest for fsLayers[%d]", idx)
+		}
+
+		created := v1Image.Created
+		entry := ispec.History{
+			Created:    &created,
+			CreatedBy:  strings.Join(v1Image.ContainerConfig.Cmd, " "),
+			Author:     v1Image.Author,
+			Comment:    v1Image.Comment,
+			EmptyLayer: v1Image.ThrowAway || blobSum == emptyLayerDigest,
+		}
+		history = append(history, entry)
+		if entry.EmptyLayer {
+			continue
+		}
+
+		descriptor, diffID, err := schema1Layer(ctx, engine, blobSum, resolvers)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "convert layer %s", blobSum)
+		}
+		layers = append(layers, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	image := ispec.Image{
+		Created:      &newest.Created,
+		Author:       newest.Author,
+		Architecture: newest.Architecture,
+		OS:           newest.OS,
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+		History: history,
+	}
+	if newest.Config != nil {
+		image.Config = *newest.Config
+	}
+	if image.Architecture == "" {
+		image.Architecture = manifest.Architecture
+	}
+	if image.Architecture == "" {
+		image.Architecture = runtime.GOARCH
+	}
+	if image.OS == "" {
+		image.OS = "linux"
+	}
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, image)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put config")
+	}
+
+	newManifest := ispec.Manifest{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+	if layers == nil {
+		newManifest.Layers = []ispec.Descriptor{}
+	}
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, newManifest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest")
+	}
+
+	log.WithFields(log.Fields{
+		"name":   manifest.Name,
+		"tag":    manifest.Tag,
+		"layers": len(layers),
+	}).Debugf("interop: converted schema1 manifest to %s", manifestDigest)
+
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+		Platform: &ispec.Platform{
+			Architecture: image.Architecture,
+			OS:           image.OS,
+		},
+	}, nil
+}
+
+// schema1Layer fetches the layer with the given digest (if it is missing from
+// the image layout), and returns its descriptor and diffID. Schema1 manifests
+// don't include the size of layers, and all layers are gzip-compressed.
+func schema1Layer(ctx context.Context, engine casext.Engine, blobSum digest.Digest, resolvers []casext.BlobResolver) (ispec.Descriptor, digest.Digest, error) {
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    blobSum,
+		Size:      -1,
+	}
+	if _, err := engine.FetchMissingBlobs(ctx, descriptor, resolvers, casext.FetchOptions{}); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "fetch layer")
+	}
+
+	reader, err := engine.GetBlob(ctx, blobSum)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "get layer")
+	}
+	defer reader.Close()
+
+	counter := &countingReader{reader: reader}
+	layerRaw, err := layer.DecompressLayer(descriptor.MediaType, counter)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "decompress layer")
+	}
+	defer layerRaw.Close()
+
+	digester := digest.SHA256.Digester()
+	if _, err := io.Copy(digester.Hash(), layerRaw); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "compute diffid")
+	}
+	// Make sure we've counted the entire compressed blob.
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "compute layer size")
+	}
+
+	descriptor.Size = counter.n
+	return descriptor, digester.Digest(), nil
+}
+
+// countingReader is an io.Reader which counts the number of bytes read.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+// Read implements io.Reader.
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
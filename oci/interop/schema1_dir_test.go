@@ -0,0 +1,271 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// mapResolver is a casext.BlobResolver serving blobs from a map.
+type mapResolver map[digest.Digest][]byte
+
+func (r mapResolver) ResolveBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	data, ok := r[descriptor.Digest]
+	if !ok {
+		return nil, errors.Wrap(os.ErrNotExist, "resolve blob")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// fakeSchema1Manifest returns a schema1 manifest with one layer and one empty
+// (throwaway) history entry, as well as the layer itself.
+func fakeSchema1Manifest(t *testing.T) ([]byte, []byte) {
+	layer := fakeLayer(t)
+
+	v1Compatibility := func(v map[string]interface{}) map[string]string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return map[string]string{"v1Compatibility": string(data)}
+	}
+
+	manifest, err := json.MarshalIndent(map[string]interface{}{
+		"schemaVersion": 1,
+		"name":          "library/test",
+		"tag":           "latest",
+		"architecture":  "arm64",
+		"fsLayers": []map[string]string{
+			{"blobSum": emptyLayerDigest.String()},
+			{"blobSum": digest.FromBytes(layer).String()},
+		},
+		// Newest first.
+		"history": []map[string]string{
+			v1Compatibility(map[string]interface{}{
+				"id":      "b",
+				"parent":  "a",
+				"created": "2017-10-01T00:00:00Z",
+				"os":      "linux",
+				"config": map[string]interface{}{
+					"Env": []string{"PATH=/bin"},
+					"Cmd": []string{"/bin/sh"},
+				},
+				"container_config": map[string]interface{}{
+					"Cmd": []string{"/bin/sh", "-c", "#(nop) CMD [\"/bin/sh\"]"},
+				},
+				"throwaway": true,
+			}),
+			v1Compatibility(map[string]interface{}{
+				"id":      "a",
+				"created": "2017-09-01T00:00:00Z",
+				"author":  "Some Author",
+				"container_config": map[string]interface{}{
+					"Cmd": []string{"/bin/sh", "-c", "#(nop) ADD file:abc in /"},
+				},
+			}),
+		},
+	}, "", "   ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest, layer
+}
+
+// signSchema1Manifest returns the manifest with a (fake) JWS signature, in the
+// format used by libtrust.
+func signSchema1Manifest(t *testing.T, manifest []byte) []byte {
+	// The signature is inserted before the final closing brace.
+	formatLength := bytes.LastIndex(manifest, []byte("\n}"))
+	tail := manifest[formatLength:]
+
+	protected, err := json.Marshal(map[string]interface{}{
+		"formatLength": formatLength,
+		"formatTail":   base64.RawURLEncoding.EncodeToString(tail),
+		"time":         "2017-10-01T00:00:00Z",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatures, err := json.Marshal([]map[string]interface{}{{
+		"header":    map[string]string{"alg": "ES256"},
+		"signature": "not-a-real-signature",
+		"protected": base64.URLEncoding.EncodeToString(protected),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed bytes.Buffer
+	signed.Write(manifest[:formatLength])
+	signed.WriteString(",\n   \"signatures\": ")
+	signed.Write(signatures)
+	signed.Write(tail)
+	return signed.Bytes()
+}
+
+func TestSchema1Digest(t *testing.T) {
+	manifest, _ := fakeSchema1Manifest(t)
+	signed := signSchema1Manifest(t, manifest)
+
+	if got, err := Schema1Digest(manifest); err != nil {
+		t.Errorf("unexpected error computing digest: %+v", err)
+	} else if got != digest.FromBytes(manifest) {
+		t.Errorf("unexpected digest of unsigned manifest: %s", got)
+	}
+
+	if bytes.Equal(manifest, signed) {
+		t.Fatalf("signed manifest is the same as the unsigned manifest")
+	}
+	if got, err := Schema1Digest(signed); err != nil {
+		t.Errorf("unexpected error computing digest: %+v", err)
+	} else if got != digest.FromBytes(manifest) {
+		t.Errorf("digest of signed manifest doesn't match payload: expected %s got %s", digest.FromBytes(manifest), got)
+	}
+}
+
+func TestConvertSchema1(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestConvertSchema1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt := newTestEngine(t, filepath.Join(root, "image"))
+	defer engineExt.Close()
+
+	manifestBlob, layer := fakeSchema1Manifest(t)
+	resolver := mapResolver{digest.FromBytes(layer): layer}
+
+	descriptor, err := ConvertSchema1(ctx, engineExt, signSchema1Manifest(t, manifestBlob), []casext.BlobResolver{resolver})
+	if err != nil {
+		t.Fatalf("unexpected error converting manifest: %+v", err)
+	}
+	if err := engineExt.Validate(ctx, descriptor); err != nil {
+		t.Errorf("converted manifest is not valid: %+v", err)
+	}
+	if descriptor.Platform == nil || descriptor.Platform.Architecture != "arm64" || descriptor.Platform.OS != "linux" {
+		t.Errorf("unexpected platform: %#v", descriptor.Platform)
+	}
+
+	manifestParsed, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error reading manifest: %+v", err)
+	}
+	defer manifestParsed.Close()
+	manifest := manifestParsed.Data.(ispec.Manifest)
+
+	// The empty layer is not included.
+	expectedLayer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != expectedLayer.Digest || manifest.Layers[0].Size != expectedLayer.Size || manifest.Layers[0].MediaType != expectedLayer.MediaType {
+		t.Errorf("unexpected layers: expected [%v] got %v", expectedLayer, manifest.Layers)
+	}
+
+	configParsed, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %+v", err)
+	}
+	defer configParsed.Close()
+	config := configParsed.Data.(ispec.Image)
+
+	// The diffID is the digest of the uncompressed layer.
+	gzr, err := gzip.NewReader(bytes.NewReader(layer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.RootFS.DiffIDs) != 1 || config.RootFS.DiffIDs[0] != digest.FromBytes(uncompressed) {
+		t.Errorf("unexpected diffids: %v", config.RootFS.DiffIDs)
+	}
+
+	if config.Architecture != "arm64" || config.OS != "linux" {
+		t.Errorf("unexpected platform: %s/%s", config.OS, config.Architecture)
+	}
+	if len(config.Config.Cmd) != 1 || config.Config.Cmd[0] != "/bin/sh" || len(config.Config.Env) != 1 {
+		t.Errorf("unexpected config: %#v", config.Config)
+	}
+	if len(config.History) != 2 {
+		t.Fatalf("unexpected history: %#v", config.History)
+	}
+	if config.History[0].EmptyLayer || config.History[0].Author != "Some Author" || config.History[0].CreatedBy != "/bin/sh -c #(nop) ADD file:abc in /" {
+		t.Errorf("unexpected history[0]: %#v", config.History[0])
+	}
+	if !config.History[1].EmptyLayer {
+		t.Errorf("expected history[1] to be an empty layer: %#v", config.History[1])
+	}
+
+	// Converting fails if the layers aren't available.
+	otherEngine := newTestEngine(t, filepath.Join(root, "other"))
+	defer otherEngine.Close()
+	if _, err := ConvertSchema1(ctx, otherEngine, manifestBlob, nil); err == nil {
+		t.Errorf("expected error converting manifest with missing layers")
+	}
+}
+
+func TestImportSkopeoDirSchema1(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImportSkopeoDirSchema1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt := newTestEngine(t, filepath.Join(root, "image"))
+	defer engineExt.Close()
+
+	dir := filepath.Join(root, "dir")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifestBlob, layer := fakeSchema1Manifest(t)
+	writeSkopeoBlob(t, dir, "", "", layer)
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifestBlob, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	descriptor, err := ImportSkopeoDir(ctx, engineExt, dir)
+	if err != nil {
+		t.Fatalf("unexpected error importing: %+v", err)
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("unexpected media type: %s", descriptor.MediaType)
+	}
+}
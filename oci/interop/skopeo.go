@@ -0,0 +1,235 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// skopeoManifestFile is the name of the manifest in a skopeo directory.
+	skopeoManifestFile = "manifest.json"
+
+	// skopeoVersionFile is the name of the file containing the version of
+	// the directory format. Directories created by old versions of skopeo
+	// do not contain it.
+	skopeoVersionFile = "version"
+
+	// skopeoVersionPrefix is the prefix of the contents of skopeoVersionFile.
+	skopeoVersionPrefix = "Directory Transport Version: "
+)
+
+// skopeoVersions are the versions of the skopeo directory format which are
+// supported. Version 1.0 stored layers with a ".tar" suffix.
+var skopeoVersions = map[string]struct{}{
+	"1.0": {},
+	"1.1": {},
+}
+
+// skopeoManifest contains the fields of the manifest in a skopeo directory
+// used to determine its format.
+type skopeoManifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+}
+
+// ImportSkopeoDir imports the image stored in the given directory (in the
+// format used by the "dir:" transport of skopeo and containers/image) into
+// the image layout, and returns the descriptor of the imported manifest. The
+// caller is responsible for creating a reference to the descriptor.
+//
+// The manifest may be either an OCI manifest, which is imported unchanged, or
+// a Docker (version 2, schema 1 or schema 2) manifest, which is converted to
+// an OCI manifest (see ConvertSchema1). Signatures stored in the directory are
+// ignored, as they are not valid for a converted manifest.
+func ImportSkopeoDir(ctx context.Context, engine casext.Engine, path string) (ispec.Descriptor, error) {
+	if err := checkSkopeoVersion(path); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	manifestBlob, err := ioutil.ReadFile(filepath.Join(path, skopeoManifestFile))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read manifest")
+	}
+	var probe skopeoManifest
+	if err := json.Unmarshal(manifestBlob, &probe); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "parse manifest")
+	}
+	if probe.SchemaVersion == 1 {
+		return importSkopeoSchema1(ctx, engine, path, manifestBlob)
+	}
+	if probe.SchemaVersion != 2 {
+		return ispec.Descriptor{}, errors.Errorf("unsupported manifest schemaVersion %d", probe.SchemaVersion)
+	}
+
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(manifestBlob, &manifest); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "parse manifest")
+	}
+
+	switch probe.MediaType {
+	case ispec.MediaTypeImageManifest, "":
+		// OCI manifests don't need to be converted. Note that the
+		// image-spec doesn't require manifests to contain a mediaType.
+	case MediaTypeDockerManifest:
+		manifest.Config = convertDescriptor(manifest.Config)
+		for idx, layer := range manifest.Layers {
+			manifest.Layers[idx] = convertDescriptor(layer)
+		}
+		manifestBlob = nil
+	default:
+		return ispec.Descriptor{}, errors.Errorf("unsupported manifest media type %q", probe.MediaType)
+	}
+
+	// Import every blob referenced by the manifest.
+	blobs := append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)
+	for _, descriptor := range blobs {
+		if err := importSkopeoBlob(ctx, engine, path, descriptor); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "import blob %s", descriptor.Digest)
+		}
+	}
+
+	// Store the manifest. We store the original bytes if we didn't have to
+	// convert the manifest, so that the digest is preserved.
+	var (
+		manifestDigest digest.Digest
+		manifestSize   int64
+	)
+	if manifestBlob != nil {
+		manifestDigest, manifestSize, err = engine.PutBlob(ctx, bytes.NewReader(manifestBlob))
+	} else {
+		manifest.Versioned = ispecs.Versioned{SchemaVersion: 2}
+		manifestDigest, manifestSize, err = engine.PutBlobJSON(ctx, manifest)
+	}
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest")
+	}
+
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+	if err := engine.Validate(ctx, descriptor); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "validate imported manifest")
+	}
+	return descriptor, nil
+}
+
+// importSkopeoSchema1 imports the layers referenced by the given schema1
+// manifest from the skopeo directory at the given path, and then converts the
+// manifest with ConvertSchema1.
+func importSkopeoSchema1(ctx context.Context, engine casext.Engine, path string, manifestBlob []byte) (ispec.Descriptor, error) {
+	var manifest schema1Manifest
+	if err := json.Unmarshal(manifestBlob, &manifest); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "parse manifest")
+	}
+	for _, fsLayer := range manifest.FSLayers {
+		// The empty layer is never used by the converted manifest.
+		if fsLayer.BlobSum == emptyLayerDigest {
+			continue
+		}
+		// Schema1 manifests don't include the size of layers.
+		descriptor := ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    fsLayer.BlobSum,
+			Size:      -1,
+		}
+		if err := importSkopeoBlob(ctx, engine, path, descriptor); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "import blob %s", descriptor.Digest)
+		}
+	}
+
+	descriptor, err := ConvertSchema1(ctx, engine, manifestBlob, nil)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "convert schema1 manifest")
+	}
+	if err := engine.Validate(ctx, descriptor); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "validate imported manifest")
+	}
+	return descriptor, nil
+}
+
+// checkSkopeoVersion returns an error if the skopeo directory at the given
+// path uses an unsupported version of the format.
+func checkSkopeoVersion(path string) error {
+	data, err := ioutil.ReadFile(filepath.Join(path, skopeoVersionFile))
+	if os.IsNotExist(err) {
+		log.Debugf("interop: %s has no version file, assuming version 1.0", path)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read version")
+	}
+
+	version := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(version, skopeoVersionPrefix) {
+		return errors.Errorf("invalid version file: %q", version)
+	}
+	version = strings.TrimPrefix(version, skopeoVersionPrefix)
+	if _, ok := skopeoVersions[version]; !ok {
+		return errors.Errorf("unsupported directory version %q", version)
+	}
+	return nil
+}
+
+// importSkopeoBlob stores the blob described by the given descriptor from the
+// skopeo directory at the given path, and verifies that its contents match the
+// descriptor. A negative size in the descriptor means the size is not known.
+func importSkopeoBlob(ctx context.Context, engine casext.Engine, path string, descriptor ispec.Descriptor) error {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return errors.Wrap(err, "invalid digest")
+	}
+
+	// Blobs are stored using the encoded part of their digest, and version
+	// 1.0 of the format added a ".tar" suffix to layers.
+	blobPath := filepath.Join(path, descriptor.Digest.Hex())
+	fh, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		fh, err = os.Open(blobPath + ".tar")
+	}
+	if err != nil {
+		return errors.Wrap(err, "open blob")
+	}
+	defer fh.Close()
+
+	gotDigest, gotSize, err := engine.PutBlob(ctx, fh)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if gotDigest != descriptor.Digest {
+		return errors.Errorf("blob digest mismatch: expected %s got %s", descriptor.Digest, gotDigest)
+	}
+	if descriptor.Size >= 0 && gotSize != descriptor.Size {
+		return errors.Errorf("blob size mismatch: expected %d got %d", descriptor.Size, gotSize)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interop
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	_ "github.com/openSUSE/umoci/oci/cas/drivers"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// writeSkopeoBlob writes the given blob into the skopeo directory, and returns
+// a descriptor for it.
+func writeSkopeoBlob(t *testing.T, dir, mediaType, suffix string, data []byte) ispec.Descriptor {
+	blobDigest := digest.FromBytes(data)
+	if err := ioutil.WriteFile(filepath.Join(dir, blobDigest.Hex()+suffix), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      int64(len(data)),
+	}
+}
+
+// fakeLayer returns a gzip-compressed tar archive containing a single file.
+func fakeLayer(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	gzw := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(gzw)
+	contents := []byte("some contents")
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "file",
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// fakeSkopeoDir creates a skopeo directory with a manifest of the given media
+// type (using the given media types for the config and layer).
+func fakeSkopeoDir(t *testing.T, dir, version, manifestType, configType, layerType string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, "version"), []byte(skopeoVersionPrefix+version+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layerSuffix := ""
+	if version == "1.0" {
+		layerSuffix = ".tar"
+	}
+	layer := writeSkopeoBlob(t, dir, layerType, layerSuffix, fakeLayer(t))
+
+	config, err := json.Marshal(ispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromString("not a real diffid")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestType,
+		"config":        writeSkopeoBlob(t, dir, configType, "", config),
+		"layers":        []ispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportSkopeoDir(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImportSkopeoDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	for _, test := range []struct {
+		name                                string
+		version                             string
+		manifestType, configType, layerType string
+		preserved                           bool
+	}{
+		{"OCI", "1.1", ispec.MediaTypeImageManifest, ispec.MediaTypeImageConfig, ispec.MediaTypeImageLayerGzip, true},
+		{"Docker", "1.1", MediaTypeDockerManifest, MediaTypeDockerConfig, MediaTypeDockerLayerGzip, false},
+		{"DockerV1.0", "1.0", MediaTypeDockerManifest, MediaTypeDockerConfig, MediaTypeDockerLayerGzip, false},
+		{"NoVersion", "", MediaTypeDockerManifest, MediaTypeDockerConfig, MediaTypeDockerLayerGzip, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(root, test.name)
+			fakeSkopeoDir(t, dir, test.version, test.manifestType, test.configType, test.layerType)
+
+			descriptor, err := ImportSkopeoDir(ctx, engineExt, dir)
+			if err != nil {
+				t.Fatalf("unexpected error importing: %+v", err)
+			}
+
+			manifestBlob, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preserved := descriptor.Digest == digest.FromBytes(manifestBlob); preserved != test.preserved {
+				t.Errorf("expected manifest digest preserved=%v: got %v", test.preserved, preserved)
+			}
+
+			blob, err := engineExt.FromDescriptor(ctx, descriptor)
+			if err != nil {
+				t.Fatalf("unexpected error reading manifest: %+v", err)
+			}
+			defer blob.Close()
+			manifest := blob.Data.(ispec.Manifest)
+			if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+				t.Errorf("unexpected config media type: %s", manifest.Config.MediaType)
+			}
+			if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != ispec.MediaTypeImageLayerGzip {
+				t.Errorf("unexpected layers: %v", manifest.Layers)
+			}
+		})
+	}
+}
+
+func TestImportSkopeoDirInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestImportSkopeoDirInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// Unknown versions are rejected.
+	dir := filepath.Join(root, "version")
+	fakeSkopeoDir(t, dir, "2.0", MediaTypeDockerManifest, MediaTypeDockerConfig, MediaTypeDockerLayerGzip)
+	if _, err := ImportSkopeoDir(ctx, engineExt, dir); err == nil {
+		t.Errorf("expected error importing unknown version")
+	}
+
+	// Manifest lists are not supported.
+	dir = filepath.Join(root, "list")
+	fakeSkopeoDir(t, dir, "1.1", MediaTypeDockerManifestList, MediaTypeDockerConfig, MediaTypeDockerLayerGzip)
+	if _, err := ImportSkopeoDir(ctx, engineExt, dir); err == nil {
+		t.Errorf("expected error importing manifest list")
+	}
+
+	// Corrupted blobs are rejected.
+	dir = filepath.Join(root, "corrupt")
+	fakeSkopeoDir(t, dir, "1.1", MediaTypeDockerManifest, MediaTypeDockerConfig, MediaTypeDockerLayerGzip)
+	matches, err := filepath.Glob(filepath.Join(dir, "[0-9a-f]*"))
+	if err != nil || len(matches) == 0 {
+		t.Fatalf("no blobs in skopeo directory: %v", err)
+	}
+	if err := ioutil.WriteFile(matches[0], []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportSkopeoDir(ctx, engineExt, dir); err == nil {
+		t.Errorf("expected error importing corrupted blob")
+	}
+
+	// Missing directories are rejected.
+	if _, err := ImportSkopeoDir(ctx, engineExt, filepath.Join(root, "missing")); err == nil {
+		t.Errorf("expected error importing missing directory")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// The extended attributes which store ACLs. POSIX ACLs contain numeric IDs
+// (which have to be mapped like the owner of the file), while NFSv4 ACLs
+// refer to users and groups by name and are stored as-is.
+const (
+	posixACLAccessXattr  = "system.posix_acl_access"
+	posixACLDefaultXattr = "system.posix_acl_default"
+	nfs4ACLXattr         = "system.nfs4_acl"
+)
+
+// isACLXattr returns whether the named xattr stores an ACL.
+func isACLXattr(name string) bool {
+	switch name {
+	case posixACLAccessXattr, posixACLDefaultXattr, nfs4ACLXattr:
+		return true
+	}
+	return false
+}
+
+// isPOSIXACLXattr returns whether the named xattr stores a POSIX ACL.
+func isPOSIXACLXattr(name string) bool {
+	return name == posixACLAccessXattr || name == posixACLDefaultXattr
+}
+
+// The binary format of POSIX ACL xattrs (see <linux/posix_acl_xattr.h>),
+// which is a little-endian version header followed by a list of entries.
+const (
+	posixACLVersion    = 0x0002
+	posixACLHeaderSize = 4
+	posixACLEntrySize  = 8
+
+	// Only entries with these tags have an ID.
+	posixACLTagUser  = 0x02
+	posixACLTagGroup = 0x08
+)
+
+// idMapFunc maps a single uid or gid.
+type idMapFunc func(id int) (int, error)
+
+// mapPOSIXACL returns a copy of the given POSIX ACL xattr value, with the IDs
+// of the named user entries mapped by uidFn and the IDs of the named group
+// entries mapped by gidFn.
+func mapPOSIXACL(value []byte, uidFn, gidFn idMapFunc) ([]byte, error) {
+	if len(value) < posixACLHeaderSize || (len(value)-posixACLHeaderSize)%posixACLEntrySize != 0 {
+		return nil, errors.Errorf("invalid posix acl: bad length %d", len(value))
+	}
+	if version := binary.LittleEndian.Uint32(value); version != posixACLVersion {
+		return nil, errors.Errorf("invalid posix acl: unsupported version %#x", version)
+	}
+
+	mapped := append([]byte(nil), value...)
+	for off := posixACLHeaderSize; off < len(mapped); off += posixACLEntrySize {
+		entry := mapped[off : off+posixACLEntrySize]
+
+		var mapFn idMapFunc
+		switch binary.LittleEndian.Uint16(entry[0:2]) {
+		case posixACLTagUser:
+			mapFn = uidFn
+		case posixACLTagGroup:
+			mapFn = gidFn
+		default:
+			continue
+		}
+		id, err := mapFn(int(binary.LittleEndian.Uint32(entry[4:8])))
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint32(entry[4:8], uint32(id))
+	}
+	return mapped, nil
+}
+
+// mapACLXattrs maps the IDs in the POSIX ACLs of the given header using uidFn
+// and gidFn (which may both be nil to leave them as-is), or removes all ACLs
+// from the header if strip is set. The xattrs (and PAX records) of the header
+// are replaced rather than modified, as they may be shared with a copy of the
+// header.
+func mapACLXattrs(hdr *tar.Header, strip bool, uidFn, gidFn idMapFunc) error {
+	var found bool
+	for name := range hdr.Xattrs {
+		if isACLXattr(name) {
+			found = true
+			break
+		}
+	}
+	if !found || (!strip && uidFn == nil && gidFn == nil) {
+		return nil
+	}
+
+	xattrs := map[string]string{}
+	records := map[string]string{}
+	for key, value := range hdr.PAXRecords {
+		records[key] = value
+	}
+	for name, value := range hdr.Xattrs {
+		switch {
+		case !isACLXattr(name):
+		case strip:
+			delete(records, paxSchilyXattr+name)
+			continue
+		case isPOSIXACLXattr(name):
+			mapped, err := mapPOSIXACL([]byte(value), uidFn, gidFn)
+			if err != nil {
+				return errors.Wrapf(err, "map %s", name)
+			}
+			value = string(mapped)
+			if _, ok := records[paxSchilyXattr+name]; ok {
+				records[paxSchilyXattr+name] = value
+			}
+		}
+		xattrs[name] = value
+	}
+	hdr.Xattrs = xattrs
+	if hdr.PAXRecords != nil {
+		hdr.PAXRecords = records
+	}
+	return nil
+}
+
+// paxSchilyXattr is the prefix of the PAX records which store xattrs.
+const paxSchilyXattr = "SCHILY.xattr."
+
+// isNotSupported returns whether the error (returned by a Filesystem) means
+// that the operation isn't supported by the underlying filesystem.
+func isNotSupported(err error) bool {
+	err = errors.Cause(err)
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	return err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP
+}
@@ -0,0 +1,234 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/pkg/memfs"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// posixACLEntry is a single entry of a POSIX ACL.
+type posixACLEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// makePOSIXACL returns the xattr value of a POSIX ACL with the given entries.
+func makePOSIXACL(entries ...posixACLEntry) string {
+	buf := make([]byte, posixACLHeaderSize+len(entries)*posixACLEntrySize)
+	binary.LittleEndian.PutUint32(buf, posixACLVersion)
+	for idx, entry := range entries {
+		off := posixACLHeaderSize + idx*posixACLEntrySize
+		binary.LittleEndian.PutUint16(buf[off:], entry.tag)
+		binary.LittleEndian.PutUint16(buf[off+2:], entry.perm)
+		binary.LittleEndian.PutUint32(buf[off+4:], entry.id)
+	}
+	return string(buf)
+}
+
+// testACL returns an ACL granting access to the given user and group.
+func testACL(uid, gid uint32) string {
+	return makePOSIXACL(
+		posixACLEntry{0x01, 6, 0xffffffff},
+		posixACLEntry{posixACLTagUser, 6, uid},
+		posixACLEntry{0x04, 4, 0xffffffff},
+		posixACLEntry{posixACLTagGroup, 4, gid},
+		posixACLEntry{0x10, 6, 0xffffffff},
+		posixACLEntry{0x20, 4, 0xffffffff},
+	)
+}
+
+func addOffset(offset int) idMapFunc {
+	return func(id int) (int, error) { return id + offset, nil }
+}
+
+func TestMapPOSIXACL(t *testing.T) {
+	mapped, err := mapPOSIXACL([]byte(testACL(1000, 100)), addOffset(1), addOffset(2))
+	if err != nil {
+		t.Fatalf("unexpected error mapping acl: %+v", err)
+	}
+	if expected := testACL(1001, 102); string(mapped) != expected {
+		t.Errorf("mapped acl is wrong: got %x, expected %x", mapped, expected)
+	}
+
+	for _, value := range []string{
+		"",
+		"\x02\x00\x00\x00\x01\x00",
+		makePOSIXACL()[:3],
+		"\x01\x00\x00\x00",
+	} {
+		if _, err := mapPOSIXACL([]byte(value), addOffset(0), addOffset(0)); err == nil {
+			t.Errorf("expected error mapping invalid acl %x", value)
+		}
+	}
+}
+
+func TestMapACLXattrs(t *testing.T) {
+	acl := testACL(1000, 100)
+	original := &tar.Header{
+		Xattrs: map[string]string{
+			posixACLAccessXattr:  acl,
+			posixACLDefaultXattr: acl,
+			nfs4ACLXattr:         "nfs4",
+			"user.test":          "value",
+		},
+		PAXRecords: map[string]string{
+			paxSchilyXattr + posixACLAccessXattr:  acl,
+			paxSchilyXattr + posixACLDefaultXattr: acl,
+			paxSchilyXattr + nfs4ACLXattr:         "nfs4",
+			paxSchilyXattr + "user.test":          "value",
+			"mtime":                               "1234",
+		},
+	}
+
+	hdr := *original
+	if err := mapACLXattrs(&hdr, false, addOffset(10), addOffset(20)); err != nil {
+		t.Fatalf("unexpected error mapping acls: %+v", err)
+	}
+	mappedACL := testACL(1010, 120)
+	if !reflect.DeepEqual(hdr.Xattrs, map[string]string{
+		posixACLAccessXattr:  mappedACL,
+		posixACLDefaultXattr: mappedACL,
+		nfs4ACLXattr:         "nfs4",
+		"user.test":          "value",
+	}) {
+		t.Errorf("unexpected mapped xattrs: %q", hdr.Xattrs)
+	}
+	if hdr.PAXRecords[paxSchilyXattr+posixACLAccessXattr] != mappedACL || hdr.PAXRecords["mtime"] != "1234" {
+		t.Errorf("unexpected mapped pax records: %q", hdr.PAXRecords)
+	}
+	// The original header must not be modified.
+	if original.Xattrs[posixACLAccessXattr] != acl || original.PAXRecords[paxSchilyXattr+posixACLAccessXattr] != acl {
+		t.Errorf("original header was modified")
+	}
+
+	hdr = *original
+	if err := mapACLXattrs(&hdr, true, nil, nil); err != nil {
+		t.Fatalf("unexpected error stripping acls: %+v", err)
+	}
+	if !reflect.DeepEqual(hdr.Xattrs, map[string]string{"user.test": "value"}) {
+		t.Errorf("unexpected stripped xattrs: %q", hdr.Xattrs)
+	}
+	if !reflect.DeepEqual(hdr.PAXRecords, map[string]string{paxSchilyXattr + "user.test": "value", "mtime": "1234"}) {
+		t.Errorf("unexpected stripped pax records: %q", hdr.PAXRecords)
+	}
+
+	// Headers without ACLs are left alone.
+	hdr = tar.Header{Xattrs: map[string]string{"user.test": "value"}}
+	xattrs := hdr.Xattrs
+	if err := mapACLXattrs(&hdr, true, addOffset(1), addOffset(1)); err != nil {
+		t.Fatalf("unexpected error mapping acls: %+v", err)
+	}
+	if reflect.ValueOf(hdr.Xattrs).Pointer() != reflect.ValueOf(xattrs).Pointer() {
+		t.Errorf("xattrs without acls were replaced")
+	}
+}
+
+func TestUnpackACLs(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opt      MapOptions
+		expected map[string][]byte
+	}{
+		{"Default", MapOptions{}, map[string][]byte{
+			posixACLAccessXattr: []byte(testACL(1000, 100)),
+			"user.test":         []byte("value"),
+		}},
+		{"Mapped", MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+			GIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+		}, map[string][]byte{
+			posixACLAccessXattr: []byte(testACL(101000, 200100)),
+			"user.test":         []byte("value"),
+		}},
+		{"Strip", MapOptions{StripACLs: true}, map[string][]byte{
+			"user.test": []byte("value"),
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			tw := tar.NewWriter(&buffer)
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     "file",
+				Typeflag: tar.TypeReg,
+				Mode:     0664,
+				Xattrs: map[string]string{
+					posixACLAccessXattr: testACL(1000, 100),
+					"user.test":         "value",
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			fs := memfs.New()
+			if err := fs.MkdirAll("/rootfs", 0755); err != nil {
+				t.Fatal(err)
+			}
+			opt := test.opt
+			if err := UnpackLayerFS(fs, "/rootfs", &buffer, &opt); err != nil {
+				t.Fatalf("unexpected error unpacking layer: %+v", err)
+			}
+			fi, err := fs.Lstat("/rootfs/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if xattrs := fi.Sys().(*memfs.Stat).Xattrs; !reflect.DeepEqual(xattrs, test.expected) {
+				t.Errorf("unexpected xattrs: got %q, expected %q", xattrs, test.expected)
+			}
+		})
+	}
+}
+
+func TestRemapArchiveACLs(t *testing.T) {
+	archive := makeArchive(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 100000, Gid: 100000, Xattrs: map[string]string{
+			posixACLAccessXattr: testACL(101000, 100100),
+		}},
+	})
+	idMap := func(hostID uint32) []rspec.LinuxIDMapping {
+		return []rspec.LinuxIDMapping{{ContainerID: 0, HostID: hostID, Size: 65536}}
+	}
+	remap := IDRemap{
+		FromUIDMappings: idMap(100000),
+		FromGIDMappings: idMap(100000),
+		ToUIDMappings:   idMap(200000),
+		ToGIDMappings:   idMap(300000),
+	}
+
+	var output bytes.Buffer
+	if err := RemapArchive(&output, bytes.NewReader(archive), remap); err != nil {
+		t.Fatalf("RemapArchive: unexpected error: %+v", err)
+	}
+	hdr, err := tar.NewReader(&output).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := testACL(201000, 300100); hdr.Xattrs[posixACLAccessXattr] != expected {
+		t.Errorf("acl was not remapped: got %x, expected %x", hdr.Xattrs[posixACLAccessXattr], expected)
+	}
+}
@@ -0,0 +1,330 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// MergedFile describes a regular file in the merged view of a layer stack.
+type MergedFile struct {
+	// Path is the cleaned absolute path of the file inside the rootfs.
+	Path string `json:"path"`
+
+	// Size is the size of the file's contents in bytes.
+	Size int64 `json:"size"`
+
+	// Layer is the index (in manifest order) of the layer which introduced
+	// this version of the file.
+	Layer int `json:"layer"`
+}
+
+// WastedFile describes a regular file which was added by a layer, but is not
+// visible in the merged view because it was removed or replaced by a later
+// layer. The space used by such files can only be reclaimed by squashing the
+// layers in question.
+type WastedFile struct {
+	MergedFile
+
+	// RemovedBy is the index of the layer which removed or replaced the file.
+	RemovedBy int `json:"removed_by"`
+
+	// Deleted is true if the file was removed by a whiteout (or by a parent
+	// directory being removed or replaced), and false if the file was
+	// overwritten by a new entry at the same path.
+	Deleted bool `json:"deleted"`
+}
+
+// DirectoryStat describes the cumulative size of a directory in the merged
+// view of a layer stack.
+type DirectoryStat struct {
+	// Path is the cleaned absolute path of the directory inside the rootfs.
+	Path string `json:"path"`
+
+	// Size is the total size of all regular files below the directory.
+	Size int64 `json:"size"`
+}
+
+// Analysis is the result of analysing the merged view of a layer stack.
+type Analysis struct {
+	// Files is the set of regular files in the merged view, sorted by path.
+	Files []MergedFile `json:"files"`
+
+	// Wasted is the set of files which are hidden in the merged view, in the
+	// order they were removed.
+	Wasted []WastedFile `json:"wasted"`
+}
+
+// analysisEntry is an entry in the merged view being built by an analyser.
+type analysisEntry struct {
+	typeflag byte
+	size     int64
+	layer    int
+}
+
+// analyser builds the merged view of a layer stack, with the same semantics
+// as UnpackLayer.
+type analyser struct {
+	entries map[string]analysisEntry
+	wasted  []WastedFile
+}
+
+// remove removes the given path (and everything below it) from the merged
+// view, recording any regular files as wasted.
+func (a *analyser) remove(path string, layer int, deleted bool) {
+	var paths []string
+	if entry, ok := a.entries[path]; ok && entry.typeflag != tar.TypeDir {
+		// Only directories can have children, so avoid scanning everything.
+		paths = []string{path}
+	} else {
+		// Layers don't need to include entries for parent directories, so
+		// there may be children even if the path itself doesn't exist.
+		for entryPath := range a.entries {
+			if entryPath == path || strings.HasPrefix(entryPath, path+"/") {
+				paths = append(paths, entryPath)
+			}
+		}
+		// Make sure the order of the wasted files is deterministic.
+		sort.Strings(paths)
+	}
+
+	for _, entryPath := range paths {
+		entry := a.entries[entryPath]
+		if entry.typeflag == tar.TypeReg {
+			a.wasted = append(a.wasted, WastedFile{
+				MergedFile: MergedFile{
+					Path:  entryPath,
+					Size:  entry.size,
+					Layer: entry.layer,
+				},
+				RemovedBy: layer,
+				// A file overwritten at its own path is not "deleted", but
+				// any of its children are.
+				Deleted: deleted || entryPath != path,
+			})
+		}
+		delete(a.entries, entryPath)
+	}
+}
+
+// addLayer applies the given uncompressed layer archive to the merged view.
+func (a *analyser) addLayer(layer io.Reader, idx int) error {
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		path := filepath.Join("/", hdr.Name)
+		if path == "/" {
+			continue
+		}
+		dir, file := filepath.Split(path)
+
+		// Whiteouts remove the path (and all of its children) in the same way
+		// as UnpackLayer.
+		if strings.HasPrefix(file, whPrefix) {
+			a.remove(filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), idx, true)
+			continue
+		}
+
+		typeflag := hdr.Typeflag
+		if typeflag == tar.TypeRegA {
+			typeflag = tar.TypeReg
+		}
+
+		// Directories are merged with existing directories, while anything
+		// else replaces the existing path.
+		if old, ok := a.entries[path]; ok {
+			if old.typeflag == tar.TypeDir && typeflag == tar.TypeDir {
+				continue
+			}
+			a.remove(path, idx, false)
+		}
+
+		entry := analysisEntry{
+			typeflag: typeflag,
+			layer:    idx,
+		}
+		if typeflag == tar.TypeReg {
+			entry.size = hdr.Size
+		}
+		a.entries[path] = entry
+	}
+	return nil
+}
+
+// analysis returns the Analysis of the current merged view.
+func (a *analyser) analysis() *Analysis {
+	analysis := &Analysis{Wasted: a.wasted}
+	for path, entry := range a.entries {
+		if entry.typeflag != tar.TypeReg {
+			continue
+		}
+		analysis.Files = append(analysis.Files, MergedFile{
+			Path:  path,
+			Size:  entry.size,
+			Layer: entry.layer,
+		})
+	}
+	sort.Sort(mergedFilesByPath(analysis.Files))
+	return analysis
+}
+
+// AnalyzeLayers computes the merged view of the given stack of uncompressed
+// layer archives (in the order they would be applied), as well as which files
+// in each layer are hidden by later layers.
+func AnalyzeLayers(layers []io.Reader) (*Analysis, error) {
+	a := &analyser{entries: map[string]analysisEntry{}}
+	for idx, layer := range layers {
+		if err := a.addLayer(layer, idx); err != nil {
+			return nil, errors.Wrapf(err, "layer %d", idx)
+		}
+	}
+	return a.analysis(), nil
+}
+
+// AnalyzeManifest is equivalent to AnalyzeLayers, except that the layers are
+// taken from the given manifest.
+func AnalyzeManifest(ctx context.Context, engine cas.Engine, manifest ispec.Manifest) (*Analysis, error) {
+	a := &analyser{entries: map[string]analysisEntry{}}
+	for idx, descriptor := range manifest.Layers {
+		log.Infof("analyse layer: %s", descriptor.Digest)
+
+		reader, err := openLayer(ctx, engine, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		err = a.addLayer(reader, idx)
+		reader.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s", descriptor.Digest)
+		}
+	}
+	return a.analysis(), nil
+}
+
+// LargestFiles returns at most n of the largest files in the merged view,
+// sorted by size (largest first) and then by path.
+func (a *Analysis) LargestFiles(n int) []MergedFile {
+	files := make([]MergedFile, len(a.Files))
+	copy(files, a.Files)
+	sort.Stable(mergedFilesBySize(files))
+	if n >= 0 && len(files) > n {
+		files = files[:n]
+	}
+	return files
+}
+
+// LargestDirectories returns at most n of the largest directories in the
+// merged view, sorted by size (largest first) and then by path. The size of a
+// directory is the total size of all regular files below it. The root
+// directory is not included.
+func (a *Analysis) LargestDirectories(n int) []DirectoryStat {
+	sizes := map[string]int64{}
+	for _, file := range a.Files {
+		for dir := filepath.Dir(file.Path); dir != "/"; dir = filepath.Dir(dir) {
+			sizes[dir] += file.Size
+		}
+	}
+
+	var dirs []DirectoryStat
+	for path, size := range sizes {
+		dirs = append(dirs, DirectoryStat{Path: path, Size: size})
+	}
+	sort.Sort(directoriesBySize(dirs))
+	if n >= 0 && len(dirs) > n {
+		dirs = dirs[:n]
+	}
+	return dirs
+}
+
+// LargestWasted returns at most n of the largest files which are hidden in
+// the merged view, sorted by size (largest first). Files of the same size are
+// kept in the order they were removed.
+func (a *Analysis) LargestWasted(n int) []WastedFile {
+	files := make([]WastedFile, len(a.Wasted))
+	copy(files, a.Wasted)
+	sort.Stable(wastedFilesBySize(files))
+	if n >= 0 && len(files) > n {
+		files = files[:n]
+	}
+	return files
+}
+
+// TotalSize returns the total size of all regular files in the merged view.
+func (a *Analysis) TotalSize() int64 {
+	var size int64
+	for _, file := range a.Files {
+		size += file.Size
+	}
+	return size
+}
+
+// WastedSize returns the total size of all files which are hidden in the
+// merged view.
+func (a *Analysis) WastedSize() int64 {
+	var size int64
+	for _, file := range a.Wasted {
+		size += file.Size
+	}
+	return size
+}
+
+type mergedFilesByPath []MergedFile
+
+func (f mergedFilesByPath) Len() int           { return len(f) }
+func (f mergedFilesByPath) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f mergedFilesByPath) Less(i, j int) bool { return f[i].Path < f[j].Path }
+
+type mergedFilesBySize []MergedFile
+
+func (f mergedFilesBySize) Len() int           { return len(f) }
+func (f mergedFilesBySize) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f mergedFilesBySize) Less(i, j int) bool { return f[i].Size > f[j].Size }
+
+type wastedFilesBySize []WastedFile
+
+func (f wastedFilesBySize) Len() int           { return len(f) }
+func (f wastedFilesBySize) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f wastedFilesBySize) Less(i, j int) bool { return f[i].Size > f[j].Size }
+
+type directoriesBySize []DirectoryStat
+
+func (d directoriesBySize) Len() int      { return len(d) }
+func (d directoriesBySize) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d directoriesBySize) Less(i, j int) bool {
+	if d[i].Size != d[j].Size {
+		return d[i].Size > d[j].Size
+	}
+	return d[i].Path < d[j].Path
+}
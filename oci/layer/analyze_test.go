@@ -0,0 +1,146 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testAnalyzeEntry is a single entry in a test layer. Regular files have
+// contents of the given size.
+type testAnalyzeEntry struct {
+	name     string
+	typeflag byte
+	size     int
+}
+
+func makeAnalyzeLayer(t *testing.T, entries []testAnalyzeEntry) io.Reader {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Mode:     0644,
+			Size:     int64(entry.size),
+		}
+		if entry.typeflag == tar.TypeSymlink {
+			hdr.Linkname = "target"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("unexpected error writing header %s: %s", entry.name, err)
+		}
+		if _, err := tw.Write([]byte(strings.Repeat("x", entry.size))); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", entry.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing tar writer: %s", err)
+	}
+	return buffer
+}
+
+func TestAnalyzeLayers(t *testing.T) {
+	layers := []io.Reader{
+		makeAnalyzeLayer(t, []testAnalyzeEntry{
+			{"etc/", tar.TypeDir, 0},
+			{"etc/passwd", tar.TypeReg, 100},
+			{"etc/shadow", tar.TypeReg, 50},
+			{"usr/", tar.TypeDir, 0},
+			{"usr/lib/", tar.TypeDir, 0},
+			{"usr/lib/libbig.so", tar.TypeReg, 5000},
+			{"usr/lib/libsmall.so", tar.TypeReg, 500},
+			{"var/cache/pkg.tar", tar.TypeReg, 8000},
+		}),
+		makeAnalyzeLayer(t, []testAnalyzeEntry{
+			// Overwrite a file.
+			{"etc/passwd", tar.TypeReg, 120},
+			// Remove a file with a whiteout.
+			{"etc/" + whPrefix + "shadow", tar.TypeReg, 0},
+			// Remove a directory (which has no entry of its own).
+			{"var/" + whPrefix + "cache", tar.TypeReg, 0},
+			// Re-adding an existing directory shouldn't remove its children.
+			{"usr/lib/", tar.TypeDir, 0},
+			{"usr/lib/libnew.so", tar.TypeReg, 300},
+		}),
+		makeAnalyzeLayer(t, []testAnalyzeEntry{
+			// Replace a file with a symlink.
+			{"usr/lib/libsmall.so", tar.TypeSymlink, 0},
+		}),
+	}
+
+	analysis, err := AnalyzeLayers(layers)
+	if err != nil {
+		t.Fatalf("unexpected error analysing layers: %s", err)
+	}
+
+	expectedFiles := []MergedFile{
+		{"/etc/passwd", 120, 1},
+		{"/usr/lib/libbig.so", 5000, 0},
+		{"/usr/lib/libnew.so", 300, 1},
+	}
+	if !reflect.DeepEqual(analysis.Files, expectedFiles) {
+		t.Errorf("expected files %v, got %v", expectedFiles, analysis.Files)
+	}
+
+	expectedWasted := []WastedFile{
+		{MergedFile{"/etc/passwd", 100, 0}, 1, false},
+		{MergedFile{"/etc/shadow", 50, 0}, 1, true},
+		{MergedFile{"/var/cache/pkg.tar", 8000, 0}, 1, true},
+		{MergedFile{"/usr/lib/libsmall.so", 500, 0}, 2, false},
+	}
+	if !reflect.DeepEqual(analysis.Wasted, expectedWasted) {
+		t.Errorf("expected wasted %v, got %v", expectedWasted, analysis.Wasted)
+	}
+
+	if size := analysis.TotalSize(); size != 5420 {
+		t.Errorf("expected total size 5420, got %d", size)
+	}
+	if size := analysis.WastedSize(); size != 8650 {
+		t.Errorf("expected wasted size 8650, got %d", size)
+	}
+
+	expectedLargest := []MergedFile{
+		{"/usr/lib/libbig.so", 5000, 0},
+		{"/usr/lib/libnew.so", 300, 1},
+	}
+	if largest := analysis.LargestFiles(2); !reflect.DeepEqual(largest, expectedLargest) {
+		t.Errorf("expected largest files %v, got %v", expectedLargest, largest)
+	}
+
+	expectedDirs := []DirectoryStat{
+		{"/usr", 5300},
+		{"/usr/lib", 5300},
+		{"/etc", 120},
+	}
+	if dirs := analysis.LargestDirectories(-1); !reflect.DeepEqual(dirs, expectedDirs) {
+		t.Errorf("expected largest directories %v, got %v", expectedDirs, dirs)
+	}
+
+	expectedLargestWasted := []WastedFile{
+		{MergedFile{"/var/cache/pkg.tar", 8000, 0}, 1, true},
+	}
+	if largest := analysis.LargestWasted(1); !reflect.DeepEqual(largest, expectedLargestWasted) {
+		t.Errorf("expected largest wasted %v, got %v", expectedLargestWasted, largest)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// layerCacheTempPrefix is the prefix of the temporary files used while adding
+// layers to a LayerCache.
+const layerCacheTempPrefix = ".tmp-"
+
+// layerCacheTempMaxAge is the age after which temporary files left behind in
+// a LayerCache (by a process which was killed) are removed by Evict.
+const layerCacheTempMaxAge = 24 * time.Hour
+
+// LayerCache is a cache of the uncompressed form of layers, keyed by their
+// DiffID, which allows unpacking to skip decompressing layers which have been
+// unpacked before (such as the layers of a commonly used base image). Each
+// cached layer is stored in <root>/<algorithm>/<hex>, and the modification
+// time of the file is used to track when the layer was last used.
+//
+// The contents of the cache are not trusted. Layers read from the cache are
+// verified against their DiffID by UnpackRootfs in the same way as layers
+// read from an image.
+type LayerCache struct {
+	root    string
+	maxSize int64
+}
+
+// NewLayerCache returns a LayerCache stored in the given directory (which is
+// created if it doesn't exist). If maxSize is positive, Evict removes the
+// least recently used layers until the cache is no larger than maxSize bytes.
+func NewLayerCache(root string, maxSize int64) (*LayerCache, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, errors.Wrap(err, "create layer cache")
+	}
+	return &LayerCache{root: root, maxSize: maxSize}, nil
+}
+
+// path returns the path of the cached layer with the given DiffID.
+func (c *LayerCache) path(diffID digest.Digest) (string, error) {
+	if err := diffID.Validate(); err != nil {
+		return "", errors.Wrap(err, "invalid diffid")
+	}
+	return filepath.Join(c.root, diffID.Algorithm().String(), diffID.Hex()), nil
+}
+
+// Open returns the uncompressed layer with the given DiffID from the cache. If
+// the cache doesn't contain the layer, an error satisfying os.IsNotExist is
+// returned.
+func (c *LayerCache) Open(diffID digest.Digest) (io.ReadCloser, error) {
+	path, err := c.path(diffID)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open cached layer")
+	}
+	// Mark the layer as recently used. This is only used for eviction, so
+	// errors aren't fatal.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Debugf("layer cache: cannot update times of %s: %v", diffID, err)
+	}
+	return fh, nil
+}
+
+// Remove removes the layer with the given DiffID from the cache (if it is
+// present).
+func (c *LayerCache) Remove(diffID digest.Digest) error {
+	path, err := c.path(diffID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove cached layer")
+	}
+	return nil
+}
+
+// layerCacheWriter is used to add a layer to a LayerCache. The layer is
+// written to a temporary file, which is only moved into place by commit.
+// Since the cache is only an optimisation, Write never fails (the first error
+// is instead returned by commit).
+type layerCacheWriter struct {
+	*os.File
+	path string
+	err  error
+}
+
+// Write implements io.Writer.
+func (w *layerCacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.File.Write(p)
+	}
+	return len(p), nil
+}
+
+// create returns a layerCacheWriter for adding the layer with the given
+// DiffID to the cache.
+func (c *LayerCache) create(diffID digest.Digest) (*layerCacheWriter, error) {
+	path, err := c.path(diffID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "mkdir algorithm")
+	}
+	fh, err := ioutil.TempFile(filepath.Dir(path), layerCacheTempPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "create temporary layer")
+	}
+	return &layerCacheWriter{File: fh, path: path}, nil
+}
+
+// commit adds the written layer to the cache. The caller must have verified
+// that the written layer matches its DiffID.
+func (w *layerCacheWriter) commit() error {
+	if w.err != nil {
+		w.abort()
+		return errors.Wrap(w.err, "write temporary layer")
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return errors.Wrap(err, "close temporary layer")
+	}
+	if err := os.Rename(w.File.Name(), w.path); err != nil {
+		os.Remove(w.File.Name())
+		return errors.Wrap(err, "rename temporary layer")
+	}
+	return nil
+}
+
+// abort discards the written layer.
+func (w *layerCacheWriter) abort() {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+// layerCacheEntry is a layer stored in a LayerCache.
+type layerCacheEntry struct {
+	path    string
+	size    int64
+	lastUse time.Time
+}
+
+// Evict removes the least recently used layers from the cache until the
+// total size of the cached layers is no larger than the maximum size of the
+// cache (if it has one). Stale temporary files are also removed.
+func (c *LayerCache) Evict() error {
+	var (
+		entries   []layerCacheEntry
+		totalSize int64
+	)
+	err := filepath.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Another process might have removed the file.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), layerCacheTempPrefix) {
+			if time.Since(info.ModTime()) > layerCacheTempMaxAge {
+				log.Debugf("layer cache: removing stale temporary file %s", path)
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return errors.Wrap(err, "remove stale temporary file")
+				}
+			}
+			return nil
+		}
+		entries = append(entries, layerCacheEntry{
+			path:    path,
+			size:    info.Size(),
+			lastUse: info.ModTime(),
+		})
+		totalSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "walk layer cache")
+	}
+	if c.maxSize <= 0 || totalSize <= c.maxSize {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUse.Before(entries[j].lastUse)
+	})
+	for _, entry := range entries {
+		if totalSize <= c.maxSize {
+			break
+		}
+		log.Debugf("layer cache: evicting %s (%d bytes)", entry.path, entry.size)
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "evict cached layer")
+		}
+		totalSize -= entry.size
+	}
+	return nil
+}
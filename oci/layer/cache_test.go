@@ -0,0 +1,174 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestUnpackRootfsLayerCache(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsLayerCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := putTestManifest(t, engine, []string{"a", "b"})
+	cache, err := NewLayerCache(filepath.Join(root, "cache"), 0)
+	if err != nil {
+		t.Fatalf("unexpected error creating cache: %s", err)
+	}
+	opt := testMapOptions()
+	opt.LayerCache = cache
+
+	if err := UnpackRootfs(ctx, engine, filepath.Join(root, "rootfs1"), manifest, opt); err != nil {
+		t.Fatalf("unexpected error unpacking: %s", err)
+	}
+
+	configBlob, err := casext.NewEngine(engine).FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %s", err)
+	}
+	diffIDs := configBlob.Data.(ispec.Image).RootFS.DiffIDs
+	configBlob.Close()
+
+	// Every layer must have been cached.
+	for _, diffID := range diffIDs {
+		reader, err := cache.Open(diffID)
+		if err != nil {
+			t.Fatalf("layer %s was not cached: %s", diffID, err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("unexpected error reading cached layer: %s", err)
+		}
+		if got := digest.SHA256.FromBytes(data); got != diffID {
+			t.Errorf("cached layer %s has the wrong contents: %s", diffID, got)
+		}
+	}
+
+	// The cached layers are used instead of the layer blobs.
+	for _, layerDescriptor := range manifest.Layers {
+		if err := engine.DeleteBlob(ctx, layerDescriptor.Digest); err != nil {
+			t.Fatalf("unexpected error deleting layer: %s", err)
+		}
+	}
+	rootfs := filepath.Join(root, "rootfs2")
+	if err := UnpackRootfs(ctx, engine, rootfs, manifest, opt); err != nil {
+		t.Fatalf("unexpected error unpacking from cache: %s", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		data, err := ioutil.ReadFile(filepath.Join(rootfs, name))
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %s", name, err)
+		} else if string(data) != "contents of "+name {
+			t.Errorf("%s has the wrong contents: %q", name, data)
+		}
+	}
+
+	// A corrupted cached layer is rejected and removed from the cache.
+	path, _ := cache.path(diffIDs[1])
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte{0}, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackRootfs(ctx, engine, filepath.Join(root, "rootfs3"), manifest, opt); err == nil {
+		t.Errorf("expected unpack with corrupted cached layer to fail")
+	}
+	if _, err := cache.Open(diffIDs[1]); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected corrupted cached layer to be removed: %v", err)
+	}
+}
+
+func TestLayerCacheEvict(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestLayerCacheEvict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := NewLayerCache(root, 250)
+	if err != nil {
+		t.Fatalf("unexpected error creating cache: %s", err)
+	}
+
+	// Add three layers of 100 bytes, used at different times.
+	now := time.Now()
+	var diffIDs []digest.Digest
+	for idx, age := range []time.Duration{time.Hour, 3 * time.Hour, 2 * time.Hour} {
+		data := bytes.Repeat([]byte{byte(idx)}, 100)
+		diffID := digest.SHA256.FromBytes(data)
+		w, err := cache.create(diffID)
+		if err != nil {
+			t.Fatalf("unexpected error creating cached layer: %s", err)
+		}
+		w.Write(data)
+		if err := w.commit(); err != nil {
+			t.Fatalf("unexpected error committing cached layer: %s", err)
+		}
+		path, _ := cache.path(diffID)
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	// A stale temporary file.
+	stale := filepath.Join(root, layerCacheTempPrefix+"stale")
+	if err := ioutil.WriteFile(stale, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(stale, now.Add(-2*layerCacheTempMaxAge), now.Add(-2*layerCacheTempMaxAge)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Evict(); err != nil {
+		t.Fatalf("unexpected error evicting: %s", err)
+	}
+
+	// Only the least recently used layer must have been evicted.
+	for idx, diffID := range diffIDs {
+		reader, err := cache.Open(diffID)
+		if exists := err == nil; exists != (idx != 1) {
+			t.Errorf("layer %d: unexpected exists=%v (err=%v)", idx, exists, err)
+		}
+		if reader != nil {
+			reader.Close()
+		}
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected stale temporary file to be removed: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+)
+
+// PathCollisionPolicy describes how paths which only differ in their Unicode
+// normalisation form (or, if MapOptions.CaseInsensitive is set, in their case)
+// are handled during extraction. Such paths refer to the same file on
+// filesystems which normalise names (such as HFS+ and APFS) or which are
+// case-insensitive, and so extracting them can result in one file silently
+// replacing another.
+type PathCollisionPolicy string
+
+const (
+	// PathCollisionIgnore extracts every path as-is, which is the historical
+	// behaviour.
+	PathCollisionIgnore PathCollisionPolicy = "ignore"
+
+	// PathCollisionError causes extraction to fail if a path collides with a
+	// different path which has already been extracted.
+	PathCollisionError PathCollisionPolicy = "error"
+
+	// PathCollisionNormalize renames colliding paths to the name of the path
+	// which was extracted first, logging a warning for each renamed path.
+	// This makes extraction consistent regardless of whether the target
+	// filesystem normalises names.
+	PathCollisionNormalize PathCollisionPolicy = "normalize"
+)
+
+// ParsePathCollisionPolicy parses the given path collision policy name.
+func ParsePathCollisionPolicy(name string) (PathCollisionPolicy, error) {
+	switch policy := PathCollisionPolicy(name); policy {
+	case PathCollisionIgnore, PathCollisionError, PathCollisionNormalize:
+		return policy, nil
+	}
+	return "", errors.Errorf("unknown path collision policy: %q", name)
+}
+
+// pathCollisionPolicy returns the PathCollisionPolicy for extraction, which
+// defaults to PathCollisionIgnore.
+func (opt MapOptions) pathCollisionPolicy() (PathCollisionPolicy, error) {
+	switch opt.PathCollisionPolicy {
+	case "":
+		return PathCollisionIgnore, nil
+	case PathCollisionIgnore, PathCollisionError, PathCollisionNormalize:
+		return opt.PathCollisionPolicy, nil
+	}
+	return "", errors.Errorf("unknown path collision policy: %q", opt.PathCollisionPolicy)
+}
+
+// pathIndex keeps track of the names inside each directory of a root
+// filesystem, indexed by their collision key, so that colliding paths can be
+// detected. Directories are read lazily from the filesystem the first time
+// they are used, so the index also covers paths created by earlier layers.
+type pathIndex struct {
+	policy          PathCollisionPolicy
+	caseInsensitive bool
+
+	// dirs maps a (cleaned) directory path relative to the root to the
+	// names inside that directory, indexed by their collision key.
+	dirs map[string]map[string]string
+}
+
+// newPathIndex creates a new (empty) pathIndex.
+func newPathIndex(policy PathCollisionPolicy, caseInsensitive bool) *pathIndex {
+	return &pathIndex{
+		policy:          policy,
+		caseInsensitive: caseInsensitive,
+		dirs:            map[string]map[string]string{},
+	}
+}
+
+// key returns the collision key of a single path component. Two names with
+// the same key refer to the same file on a normalising filesystem.
+func (pi *pathIndex) key(name string) string {
+	key := norm.NFC.String(name)
+	if pi.caseInsensitive {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// entries returns the index of the given directory (relative to root),
+// reading the directory from fs if it hasn't been used before.
+func (pi *pathIndex) entries(fs Filesystem, root, dir string) map[string]string {
+	if entries, ok := pi.dirs[dir]; ok {
+		return entries
+	}
+	entries := map[string]string{}
+	pi.dirs[dir] = entries
+
+	// If the directory doesn't exist (or isn't a directory) then it is empty
+	// as far as we're concerned.
+	fullDir, err := securejoin.SecureJoinVFS(root, dir, fs)
+	if err != nil {
+		return entries
+	}
+	infos, err := fs.Readdir(fullDir)
+	if err != nil {
+		return entries
+	}
+	for _, info := range infos {
+		entries[pi.key(info.Name())] = info.Name()
+	}
+	return entries
+}
+
+// lookup returns the path under which the given cleaned path (relative to
+// root) should be extracted, with any colliding components either renamed or
+// rejected according to the policy. If add is set, the path (and all of its
+// parents) are added to the index.
+func (pi *pathIndex) lookup(fs Filesystem, root, path string, add bool) (string, error) {
+	if pi.policy == PathCollisionIgnore || filepath.Join("/", path) == "/" {
+		return path, nil
+	}
+
+	dir := "/"
+	for _, name := range strings.Split(strings.TrimPrefix(filepath.Join("/", path), "/"), "/") {
+		entries := pi.entries(fs, root, dir)
+		key := pi.key(name)
+		if existing, ok := entries[key]; ok && existing != name {
+			switch pi.policy {
+			case PathCollisionError:
+				return "", errors.Errorf("path %s collides with existing path %s", filepath.Join(dir, name), filepath.Join(dir, existing))
+			case PathCollisionNormalize:
+				log.Warnf("path collision: renaming %s to %s", filepath.Join(dir, name), filepath.Join(dir, existing))
+				name = existing
+			}
+		} else if !ok && add {
+			entries[key] = name
+		}
+		dir = filepath.Join(dir, name)
+	}
+	if !filepath.IsAbs(path) {
+		dir = strings.TrimPrefix(dir, "/")
+	}
+	return dir, nil
+}
+
+// remove removes the given (already resolved) path, and everything
+// underneath it, from the index.
+func (pi *pathIndex) remove(path string) {
+	if pi.policy == PathCollisionIgnore {
+		return
+	}
+
+	path = filepath.Join("/", path)
+	dir, name := filepath.Split(path)
+	if entries, ok := pi.dirs[filepath.Clean(dir)]; ok {
+		delete(entries, pi.key(name))
+	}
+	for dir := range pi.dirs {
+		if dir == path || strings.HasPrefix(dir, path+"/") {
+			delete(pi.dirs, dir)
+		}
+	}
+}
+
+// resolveCollisions applies the path collision policy to the name (and, for
+// hardlinks, the link target) of the given header, which must have already
+// been cleaned.
+func (te *tarExtractor) resolveCollisions(root string, hdr *tar.Header) error {
+	if te.paths == nil {
+		policy, err := te.mapOptions.pathCollisionPolicy()
+		if err != nil {
+			return err
+		}
+		te.paths = newPathIndex(policy, te.mapOptions.CaseInsensitive)
+	}
+
+	dir, file := filepath.Split(hdr.Name)
+
+	// Whiteouts refer to the path they remove, but don't add anything.
+	if strings.HasPrefix(file, whPrefix) {
+		target, err := te.paths.lookup(te.fs, root, filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), false)
+		if err != nil {
+			return errors.Wrap(err, "whiteout")
+		}
+		targetDir, targetFile := filepath.Split(target)
+		hdr.Name = filepath.Join(targetDir, whPrefix+targetFile)
+		te.paths.remove(target)
+		return nil
+	}
+
+	name, err := te.paths.lookup(te.fs, root, hdr.Name, true)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	if hdr.Typeflag == tar.TypeLink {
+		linkname, err := te.paths.lookup(te.fs, root, CleanPath(hdr.Linkname), false)
+		if err != nil {
+			return errors.Wrap(err, "hardlink target")
+		}
+		hdr.Linkname = linkname
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const (
+	// nfcName and nfdName are the same name in Unicode normalisation forms C
+	// and D respectively.
+	nfcName = "caf\u00e9"
+	nfdName = "cafe\u0301"
+)
+
+func TestParsePathCollisionPolicy(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected PathCollisionPolicy
+		valid    bool
+	}{
+		{"ignore", PathCollisionIgnore, true},
+		{"error", PathCollisionError, true},
+		{"normalize", PathCollisionNormalize, true},
+		{"", "", false},
+		{"nfc", "", false},
+	} {
+		policy, err := ParsePathCollisionPolicy(test.name)
+		if test.valid != (err == nil) {
+			t.Errorf("ParsePathCollisionPolicy(%q): expected valid=%v, got err=%v", test.name, test.valid, err)
+			continue
+		}
+		if policy != test.expected {
+			t.Errorf("ParsePathCollisionPolicy(%q): got %q expected %q", test.name, policy, test.expected)
+		}
+	}
+}
+
+func TestUnpackPathCollisionPolicy(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		policy          PathCollisionPolicy
+		caseInsensitive bool
+		valid           bool
+		expected        []string
+	}{
+		{"Default", "", false, true, []string{"README", "Readme", nfdName, nfcName}},
+		{"Ignore", PathCollisionIgnore, true, true, []string{"README", "Readme", nfdName, nfcName}},
+		{"Error", PathCollisionError, false, false, nil},
+		{"Normalize", PathCollisionNormalize, false, true, []string{"README", "Readme", nfcName}},
+		{"NormalizeCaseInsensitive", PathCollisionNormalize, true, true, []string{"README", nfcName}},
+		{"Bad", "bad", false, false, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackPathCollisionPolicy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opt := testMapOptions()
+			opt.PathCollisionPolicy = test.policy
+			opt.CaseInsensitive = test.caseInsensitive
+
+			// The first layer creates the paths, and the second layer refers
+			// to them with a different name.
+			first := makeTarLayer(t, []tar.Header{
+				{Name: nfcName, Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: nfcName + "/a", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "README", Typeflag: tar.TypeReg, Mode: 0644},
+			})
+			err = UnpackLayer(dir, first, opt)
+			if test.policy == "bad" {
+				if err == nil {
+					t.Errorf("unpack first layer: expected error with bad policy")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unpack first layer: %v", err)
+			}
+
+			second := makeTarLayer(t, []tar.Header{
+				{Name: nfdName + "/b", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "Readme", Typeflag: tar.TypeReg, Mode: 0644},
+			})
+			err = UnpackLayer(dir, second, opt)
+			if test.valid != (err == nil) {
+				t.Fatalf("unpack second layer: expected valid=%v, got err=%v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+
+			names, err := readDirNames(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("unexpected root entries: got %q expected %q", names, test.expected)
+			}
+
+			if test.policy == PathCollisionNormalize {
+				names, err := readDirNames(dir + "/" + nfcName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected := []string{"a", "b"}; !reflect.DeepEqual(names, expected) {
+					t.Errorf("unexpected normalised entries: got %q expected %q", names, expected)
+				}
+
+				// Whiteouts must also be normalised.
+				third := makeTarLayer(t, []tar.Header{
+					{Name: nfdName + "/" + whPrefix + "a", Typeflag: tar.TypeReg, Mode: 0644},
+				})
+				if err := UnpackLayer(dir, third, opt); err != nil {
+					t.Fatalf("unpack third layer: %v", err)
+				}
+				names, err = readDirNames(dir + "/" + nfcName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected := []string{"b"}; !reflect.DeepEqual(names, expected) {
+					t.Errorf("unexpected entries after whiteout: got %q expected %q", names, expected)
+				}
+			}
+		})
+	}
+}
+
+// readDirNames returns the sorted names of the entries in the given directory.
+func readDirNames(path string) ([]string, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
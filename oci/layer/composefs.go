@@ -0,0 +1,414 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fsverity"
+	"github.com/openSUSE/umoci/pkg/memfs"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ComposefsObjectPath returns the path (relative to a composefs objects
+// directory) of the object with the given fs-verity digest (in hex), which is
+// the layout used by mkcomposefs(1) and the composefs mount option "basedir".
+func ComposefsObjectPath(verityDigest string) string {
+	return filepath.Join(verityDigest[:2], verityDigest[2:])
+}
+
+// composefsFilesystem is a Filesystem used to build a composefs image. The
+// metadata of the rootfs is kept in memory, while the contents of regular
+// files are stored in an objects directory (named by their fs-verity digest,
+// so that identical files are only stored once). The in-memory contents of
+// each regular file are a reference to its object (so the size returned by
+// Lstat is not the real size of the file).
+type composefsFilesystem struct {
+	*memfs.Filesystem
+
+	// objectsDir is the objects directory.
+	objectsDir string
+
+	// created is the set of objects which did not exist in the objects
+	// directory before, so that the ones which are no longer referenced
+	// (because their files were removed by a later layer) can be removed.
+	created map[string]struct{}
+}
+
+// composefsRef is the reference to an object stored as the contents of a
+// regular file in a composefsFilesystem.
+type composefsRef struct {
+	digest string
+	size   int64
+}
+
+func (ref composefsRef) String() string {
+	return fmt.Sprintf("%s %d", ref.digest, ref.size)
+}
+
+// parseComposefsRef parses a composefsRef. Empty files have no reference.
+func parseComposefsRef(data []byte) (*composefsRef, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return nil, errors.Errorf("[internal error] invalid composefs object reference %q", data)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[internal error] invalid composefs object reference %q", data)
+	}
+	return &composefsRef{digest: fields[0], size: size}, nil
+}
+
+// composefsObject is a regular file being written to a composefsFilesystem.
+type composefsObject struct {
+	fs       *composefsFilesystem
+	file     io.WriteCloser
+	tmp      *os.File
+	digester *fsverity.Digester
+	closed   bool
+}
+
+// Create writes the contents of the file to a temporary file in the objects
+// directory, which is moved into place when it is closed.
+func (fs *composefsFilesystem) Create(path string) (io.WriteCloser, error) {
+	file, err := fs.Filesystem.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(fs.objectsDir, ".umoci-object-")
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "create temporary object")
+	}
+	return &composefsObject{
+		fs:       fs,
+		file:     file,
+		tmp:      tmp,
+		digester: fsverity.New(),
+	}, nil
+}
+
+func (obj *composefsObject) Write(p []byte) (int, error) {
+	n, err := obj.tmp.Write(p)
+	obj.digester.Write(p[:n])
+	return n, err
+}
+
+// Close stores the object (unless an identical object already exists), and
+// records the reference to it in the in-memory file.
+func (obj *composefsObject) Close() error {
+	if obj.closed {
+		return nil
+	}
+	obj.closed = true
+
+	tmpPath := obj.tmp.Name()
+	defer os.Remove(tmpPath)
+	if err := obj.tmp.Close(); err != nil {
+		return errors.Wrap(err, "close temporary object")
+	}
+
+	// Empty files don't need an object.
+	if obj.digester.Size() == 0 {
+		return obj.file.Close()
+	}
+
+	ref := composefsRef{digest: obj.digester.Hex(), size: obj.digester.Size()}
+	objPath := filepath.Join(obj.fs.objectsDir, ComposefsObjectPath(ref.digest))
+	if _, err := os.Lstat(objPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(objPath), 0755); err != nil {
+			return errors.Wrap(err, "mkdir object parent")
+		}
+		if err := os.Chmod(tmpPath, 0644); err != nil {
+			return errors.Wrap(err, "chmod object")
+		}
+		if err := os.Rename(tmpPath, objPath); err != nil {
+			return errors.Wrap(err, "store object")
+		}
+		obj.fs.created[ref.digest] = struct{}{}
+	} else if err != nil {
+		return errors.Wrap(err, "lstat object")
+	}
+
+	if _, err := io.WriteString(obj.file, ref.String()); err != nil {
+		return errors.Wrap(err, "write object reference")
+	}
+	return obj.file.Close()
+}
+
+// composefsEscape escapes a field of a composefs dump file, as described in
+// composefs-dump(5). Empty fields are written as "-". If escapeEquals is set,
+// "=" is also escaped (which is needed for the names of xattrs).
+func composefsEscape(field string, escapeEquals bool) string {
+	if field == "" {
+		return "-"
+	}
+	if field == "-" {
+		return `\x2d`
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		switch {
+		case c == '\\':
+			buf.WriteString(`\\`)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c <= ' ' || c >= 0x7f || (escapeEquals && c == '='):
+			fmt.Fprintf(&buf, `\x%02x`, c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// unixMode converts an os.FileMode to a unix st_mode.
+func unixMode(mode os.FileMode) uint32 {
+	st := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		st |= syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		st |= syscall.S_IFLNK
+	case mode&os.ModeCharDevice != 0:
+		st |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		st |= syscall.S_IFBLK
+	case mode&os.ModeNamedPipe != 0:
+		st |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		st |= syscall.S_IFSOCK
+	default:
+		st |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		st |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		st |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		st |= syscall.S_ISVTX
+	}
+	return st
+}
+
+// composefsEntry is a path in a composefsFilesystem.
+type composefsEntry struct {
+	path string
+	fi   os.FileInfo
+}
+
+// writeDump writes the composefs dump file describing the filesystem to w,
+// and returns the set of objects referenced by it.
+func (fs *composefsFilesystem) writeDump(w io.Writer) (map[string]struct{}, error) {
+	var entries []composefsEntry
+	subdirs := map[string]int{}
+	if err := fs.Walk(func(path string, fi os.FileInfo) error {
+		entries = append(entries, composefsEntry{path: path, fi: fi})
+		if fi.IsDir() && path != "/" {
+			subdirs[filepath.Dir(path)]++
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]struct{}{}
+	hardlinks := map[uint64]string{}
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		path, fi := entry.path, entry.fi
+		stat := fi.Sys().(*memfs.Stat)
+		mode := unixMode(fi.Mode())
+
+		// Only the first path of a hardlinked inode is described in full.
+		if !fi.IsDir() && stat.Nlink > 1 {
+			if target, ok := hardlinks[stat.Ino]; ok {
+				fmt.Fprintf(bw, "%s 0 @%o - - - - 0.0 %s - -\n", composefsEscape(path, false), mode, composefsEscape(target, false))
+				continue
+			}
+			hardlinks[stat.Ino] = path
+		}
+
+		var size int64
+		var payload, verityDigest string
+		nlink := stat.Nlink
+		rdev := uint64(0)
+		switch {
+		case fi.IsDir():
+			nlink = 2 + subdirs[path]
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := fs.Readlink(path)
+			if err != nil {
+				return nil, err
+			}
+			size, payload = int64(len(target)), target
+		case fi.Mode().IsRegular():
+			rd, err := fs.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			data, err := ioutil.ReadAll(rd)
+			rd.Close()
+			if err != nil {
+				return nil, err
+			}
+			ref, err := parseComposefsRef(data)
+			if err != nil {
+				return nil, err
+			}
+			if ref != nil {
+				size = ref.size
+				payload = ComposefsObjectPath(ref.digest)
+				verityDigest = ref.digest
+				referenced[ref.digest] = struct{}{}
+			}
+		case fi.Mode()&os.ModeDevice != 0:
+			rdev = uint64(stat.Rdev)
+		}
+
+		mtime := fi.ModTime()
+		fmt.Fprintf(bw, "%s %d %o %d %d %d %d %d.%d %s - %s",
+			composefsEscape(path, false), size, mode, nlink, stat.Uid, stat.Gid, rdev,
+			mtime.Unix(), mtime.Nanosecond(), composefsEscape(payload, false), composefsEscape(verityDigest, false))
+
+		var names []string
+		for name := range stat.Xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(bw, " %s=%s", composefsEscape(name, true), composefsEscape(string(stat.Xattrs[name]), false))
+		}
+		fmt.Fprintln(bw)
+	}
+	return referenced, bw.Flush()
+}
+
+// WriteComposefsDump extracts the layers of the given manifest (verifying
+// their DiffIDs) into a composefs description of the image. The contents of
+// regular files are stored in objectsDir, named by their fs-verity digest (see
+// ComposefsObjectPath), and the metadata of the rootfs is written to dump in
+// the composefs-dump(5) format, which can be turned into a composefs (EROFS)
+// image with "mkcomposefs --from-file". The objects directory can be shared
+// between images, in which case identical files are only stored once.
+//
+// The rootfs is not extracted to the host filesystem, so the ownership and
+// device nodes of the image are preserved regardless of privileges. Only the
+// metadata of the rootfs is kept in memory.
+func WriteComposefsDump(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, objectsDir string, dump io.Writer) error {
+	engineExt := casext.NewEngine(engine)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return errors.Errorf("composefs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("composefs: config has %d diffids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	if err := os.MkdirAll(objectsDir, 0755); err != nil {
+		return errors.Wrap(err, "mkdir objects")
+	}
+	fs := &composefsFilesystem{
+		Filesystem: memfs.New(),
+		objectsDir: objectsDir,
+		created:    map[string]struct{}{},
+	}
+
+	// Give the root directory a fixed time (unless the layers contain the
+	// root directory), so that the image is reproducible.
+	rootTime := time.Unix(0, 0)
+	if config.Created != nil {
+		rootTime = *config.Created
+	}
+	if err := fs.Lutimes("/", rootTime, rootTime); err != nil {
+		return errors.Wrap(err, "set root directory times")
+	}
+
+	opt := &MapOptions{}
+	for idx, descriptor := range manifest.Layers {
+		log.Infof("composefs: add layer: %s", descriptor.Digest)
+
+		reader, err := openLayer(ctx, engine, descriptor)
+		if err != nil {
+			return errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		digester := digest.SHA256.Digester()
+		tee := io.TeeReader(reader, digester.Hash())
+		err = UnpackLayerFS(fs, "/", tee, opt)
+		if err == nil {
+			// Make sure any trailing padding is included in the DiffID.
+			_, err = io.Copy(ioutil.Discard, tee)
+		}
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "layer %s", descriptor.Digest)
+		}
+		if got, expected := digester.Digest(), config.RootFS.DiffIDs[idx]; got != expected {
+			return errors.Errorf("composefs: layer %s: diffid mismatch: got %s expected %s", descriptor.Digest, got, expected)
+		}
+	}
+
+	referenced, err := fs.writeDump(dump)
+	if err != nil {
+		return errors.Wrap(err, "write composefs dump")
+	}
+
+	// Remove the objects we added for files which were later removed.
+	for verityDigest := range fs.created {
+		if _, ok := referenced[verityDigest]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(objectsDir, ComposefsObjectPath(verityDigest))); err != nil {
+			return errors.Wrap(err, "remove unreferenced object")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fsverity"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// putLayersManifest stores the given uncompressed layers (and a configuration
+// with their DiffIDs) in the engine.
+func putLayersManifest(t *testing.T, engine cas.Engine, layers [][]byte) ispec.Manifest {
+	ctx := context.Background()
+
+	var manifest ispec.Manifest
+	config := ispec.Image{}
+	config.RootFS.Type = "layers"
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, putGzipBlob(t, engine, layer))
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.SHA256.FromBytes(layer))
+	}
+	configDigest, configSize, err := casext.NewEngine(engine).PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+	return manifest
+}
+
+func verityHex(t *testing.T, data string) string {
+	digest, err := fsverity.Compute(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestWriteComposefsDump(t *testing.T) {
+	ctx := context.Background()
+
+	objectsDir, err := ioutil.TempDir("", "umoci-TestWriteComposefsDump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(objectsDir)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := putLayersManifest(t, engine, [][]byte{
+		makeOwnerLayer(t, []tar.Header{
+			{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/file", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 100, Xattrs: map[string]string{"user.test": "c=d"}},
+			{Name: "etc/empty", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/link", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "file"},
+			{Name: "etc/hard", Typeflag: tar.TypeLink, Linkname: "etc/file"},
+			{Name: "etc/old", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "with space", Typeflag: tar.TypeReg, Mode: 04755},
+		}, map[string]string{
+			"etc/file":   "hello",
+			"etc/old":    "old contents",
+			"with space": "hello",
+		}),
+		makeOwnerLayer(t, []tar.Header{
+			{Name: "etc/.wh.old", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "etc/new", Typeflag: tar.TypeReg, Mode: 0644},
+		}, map[string]string{
+			"etc/new": "new",
+		}),
+	})
+
+	var dump bytes.Buffer
+	if err := WriteComposefsDump(ctx, engine, manifest, objectsDir, &dump); err != nil {
+		t.Fatalf("unexpected error writing composefs dump: %+v", err)
+	}
+
+	hello, updated := verityHex(t, "hello"), verityHex(t, "new")
+	helloPath, updatedPath := ComposefsObjectPath(hello), ComposefsObjectPath(updated)
+	lines := strings.Split(strings.TrimSuffix(dump.String(), "\n"), "\n")
+	expected := []string{
+		// The root directory isn't in the layers, and the configuration
+		// has no creation time.
+		"/ 0 40755 4 0 0 0 0.0 - - -",
+		"/dev 0 40755 2 0 0 0 1234567890.0 - - -",
+		"/dev/null 0 20666 1 0 0 259 1234567890.0 - - -",
+		"/etc 0 40755 2 0 0 0 1234567890.0 - - -",
+		"/etc/empty 0 100644 1 0 0 0 1234567890.0 - - -",
+		"/etc/file 5 100640 2 1000 100 0 1234567890.0 " + helloPath + " - " + hello + " user.test=c=d",
+		"/etc/hard 0 @100640 - - - - 0.0 /etc/file - -",
+		"/etc/link 4 120777 1 0 0 0 1234567890.0 file - -",
+		"/etc/new 3 100644 1 0 0 0 1234567890.0 " + updatedPath + " - " + updated,
+		`/with\x20space 5 104755 1 0 0 0 1234567890.0 ` + helloPath + " - " + hello,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("unexpected dump:\n%s\nexpected:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// Only the referenced objects must be stored (the object for etc/old was
+	// removed by the whiteout).
+	var objects []string
+	if err := filepath.Walk(objectsDir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			rel, _ := filepath.Rel(objectsDir, path)
+			objects = append(objects, rel)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectedObjects := []string{helloPath, updatedPath}
+	sort.Strings(expectedObjects)
+	if !reflect.DeepEqual(objects, expectedObjects) {
+		t.Errorf("unexpected objects: got %v, expected %v", objects, expectedObjects)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(objectsDir, helloPath))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("unexpected object contents: %q (%v)", data, err)
+	}
+
+	// Objects which already existed are shared, and are never removed.
+	var dump2 bytes.Buffer
+	if err := WriteComposefsDump(ctx, engine, manifest, objectsDir, &dump2); err != nil {
+		t.Fatalf("unexpected error writing second composefs dump: %+v", err)
+	}
+	if dump2.String() != dump.String() {
+		t.Errorf("second dump differs:\n%s", dump2.String())
+	}
+}
+
+func TestComposefsEscape(t *testing.T) {
+	for _, test := range []struct {
+		field, expected string
+		escapeEquals    bool
+	}{
+		{"", "-", false},
+		{"-", `\x2d`, false},
+		{"/usr/bin/a-b", "/usr/bin/a-b", false},
+		{"a b\\c\nd\te\x01\xff", `a\x20b\\c\nd\te\x01\xff`, false},
+		{"user.a=b", "user.a=b", false},
+		{"user.a=b", `user.a\x3db`, true},
+	} {
+		if got := composefsEscape(test.field, test.escapeEquals); got != test.expected {
+			t.Errorf("composefsEscape(%q): got %q, expected %q", test.field, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Compression is the compression algorithm used for a layer blob.
+type Compression int
+
+const (
+	// CompressionNone is an uncompressed tar archive.
+	CompressionNone Compression = iota
+
+	// CompressionGzip is a gzip-compressed tar archive.
+	CompressionGzip
+
+	// CompressionZstd is a zstd-compressed tar archive.
+	CompressionZstd
+)
+
+// String returns the name of the compression algorithm.
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "uncompressed"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+// Magic numbers used to detect the compression of a blob.
+var (
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// MediaTypeCompression returns the compression algorithm which the given layer
+// media type says the layer blob is compressed with. Both the OCI ("+gzip",
+// "+zstd") and legacy Docker (".gzip") suffixes are understood, and all other
+// layer media types are uncompressed.
+func MediaTypeCompression(mediaType string) Compression {
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".gzip"):
+		return CompressionGzip
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// DetectCompression returns the compression algorithm of a blob, based on
+// the first few bytes of the blob. Blobs which are not compressed with a
+// known algorithm are assumed to be uncompressed.
+func DetectCompression(header []byte) Compression {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// Compressor is a layer compression algorithm which is not built into umoci
+// (such as one provided by a plugin, see pkg/plugin). Layers compressed with a
+// Compressor have the media type of an uncompressed layer with a "+<name>"
+// suffix, and are only recognised by their media type.
+type Compressor interface {
+	// Name returns the name of the algorithm, which is used as the suffix of
+	// the media types of layers compressed with it.
+	Name() string
+
+	// Compress returns a writer which writes the compressed form of the data
+	// written to it to w. The compressed data is only guaranteed to have been
+	// written once the writer has been closed.
+	Compress(w io.Writer) (io.WriteCloser, error)
+
+	// Decompress returns a reader for the decompressed form of the data read
+	// from r. Closing the returned reader does not close r.
+	Decompress(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	cm          sync.RWMutex
+	compressors = map[string]Compressor{}
+)
+
+// RegisterCompressor registers a Compressor, so that layers with its media
+// types (see CompressorMediaType) can be unpacked and it can be returned by
+// GetCompressor. If a Compressor with the same name has already been
+// registered, it is replaced. The built-in algorithms cannot be replaced.
+func RegisterCompressor(c Compressor) error {
+	name := c.Name()
+	switch name {
+	case "", CompressionNone.String(), CompressionGzip.String(), CompressionZstd.String():
+		return errors.Errorf("register compressor: invalid name %q", name)
+	}
+
+	cm.Lock()
+	compressors[name] = c
+	cm.Unlock()
+
+	mediaType, nonDistributableMediaType := CompressorMediaType(c)
+	casext.RegisterLayerMediaType(mediaType, false)
+	casext.RegisterLayerMediaType(nonDistributableMediaType, true)
+	return nil
+}
+
+// GetCompressor returns the Compressor registered with the given name, or nil
+// if there is no such Compressor.
+func GetCompressor(name string) Compressor {
+	cm.RLock()
+	defer cm.RUnlock()
+	return compressors[name]
+}
+
+// CompressorMediaType returns the media types of layers (and
+// non-distributable layers) compressed with the given Compressor.
+func CompressorMediaType(c Compressor) (mediaType, nonDistributableMediaType string) {
+	suffix := "+" + c.Name()
+	return ispec.MediaTypeImageLayer + suffix, ispec.MediaTypeImageLayerNonDistributable + suffix
+}
+
+// mediaTypeCompressor returns the registered Compressor used by layers with
+// the given media type, or nil if the media type doesn't use one.
+func mediaTypeCompressor(mediaType string) Compressor {
+	idx := strings.LastIndex(mediaType, "+")
+	if idx == -1 {
+		return nil
+	}
+	c := GetCompressor(mediaType[idx+1:])
+	if c == nil {
+		return nil
+	}
+	if layerType, nonDistributableType := CompressorMediaType(c); mediaType != layerType && mediaType != nonDistributableType {
+		return nil
+	}
+	return c
+}
+
+// isCompressedMediaType returns whether layers with the given media type are
+// compressed (either with a built-in algorithm or a Compressor).
+func isCompressedMediaType(mediaType string) bool {
+	return MediaTypeCompression(mediaType) != CompressionNone || mediaTypeCompressor(mediaType) != nil
+}
+
+// zstdReadCloser releases the resources of a zstd.Decoder when closed.
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// DecompressLayer returns a reader for the uncompressed tar archive of a layer
+// blob with the given media type. The compression of the blob is detected from
+// its contents, and an error is returned if it doesn't match the compression
+// given by the media type (so that a layer with the wrong media type is not
+// silently accepted). Layers compressed with a registered Compressor are
+// instead decompressed with it. Closing the returned reader does not close
+// reader.
+func DecompressLayer(mediaType string, reader io.Reader) (io.ReadCloser, error) {
+	if c := mediaTypeCompressor(mediaType); c != nil {
+		rc, err := c.Decompress(reader)
+		return rc, errors.Wrapf(err, "create %s reader", c.Name())
+	}
+
+	expected := MediaTypeCompression(mediaType)
+	rc, got, err := Decompress(reader)
+	if err != nil {
+		return nil, err
+	}
+	if got != expected {
+		rc.Close()
+		return nil, errors.Errorf("layer has media type %s (%s) but the blob is %s", mediaType, expected, got)
+	}
+	return rc, nil
+}
+
+// Decompress returns a reader for the uncompressed contents of the given
+// blob, whose compression is detected from its contents (blobs which are not
+// compressed with a known algorithm are returned as-is). The detected
+// compression is also returned. Closing the returned reader does not close
+// reader.
+func Decompress(reader io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(reader)
+	header, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, CompressionNone, errors.Wrap(err, "read header")
+	}
+
+	switch compression := DetectCompression(header); compression {
+	case CompressionGzip:
+		gzr, err := newPooledGzipReader(br)
+		if err != nil {
+			return nil, compression, errors.Wrap(err, "create gzip reader")
+		}
+		return gzr, compression, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, compression, errors.Wrap(err, "create zstd reader")
+		}
+		return zstdReadCloser{zr}, compression, nil
+	}
+	return ioutil.NopCloser(br), CompressionNone, nil
+}
@@ -0,0 +1,213 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMediaTypeCompression(t *testing.T) {
+	for _, test := range []struct {
+		mediaType string
+		expected  Compression
+	}{
+		{ispec.MediaTypeImageLayer, CompressionNone},
+		{ispec.MediaTypeImageLayerNonDistributable, CompressionNone},
+		{ispec.MediaTypeImageLayerGzip, CompressionGzip},
+		{ispec.MediaTypeImageLayerNonDistributableGzip, CompressionGzip},
+		{casext.MediaTypeImageLayerZstd, CompressionZstd},
+		{casext.MediaTypeImageLayerNonDistributableZstd, CompressionZstd},
+		{casext.MediaTypeDockerLayer, CompressionNone},
+		{casext.MediaTypeDockerLayerGzip, CompressionGzip},
+		{casext.MediaTypeDockerForeignLayer, CompressionGzip},
+	} {
+		if got := MediaTypeCompression(test.mediaType); got != test.expected {
+			t.Errorf("MediaTypeCompression(%s): expected %v got %v", test.mediaType, test.expected, got)
+		}
+	}
+}
+
+func TestDecompressLayer(t *testing.T) {
+	layer := makeTarLayer(t, []tar.Header{
+		{Name: "some-file", Typeflag: tar.TypeReg, Mode: 0644},
+	}).Bytes()
+
+	var gzipped bytes.Buffer
+	gzw := gzip.NewWriter(&gzipped)
+	if _, err := gzw.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var zstded bytes.Buffer
+	zw, err := zstd.NewWriter(&zstded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := map[Compression][]byte{
+		CompressionNone: layer,
+		CompressionGzip: gzipped.Bytes(),
+		CompressionZstd: zstded.Bytes(),
+	}
+	for _, mediaType := range []string{
+		ispec.MediaTypeImageLayer,
+		ispec.MediaTypeImageLayerGzip,
+		casext.MediaTypeImageLayerZstd,
+		casext.MediaTypeDockerLayerGzip,
+	} {
+		expected := MediaTypeCompression(mediaType)
+		for compression, blob := range blobs {
+			if got := DetectCompression(blob); got != compression {
+				t.Errorf("DetectCompression: expected %v got %v", compression, got)
+			}
+
+			reader, err := DecompressLayer(mediaType, bytes.NewReader(blob))
+			if compression != expected {
+				if err == nil {
+					reader.Close()
+					t.Errorf("DecompressLayer(%s): expected error for %v blob", mediaType, compression)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("DecompressLayer(%s): unexpected error for %v blob: %+v", mediaType, compression, err)
+				continue
+			}
+			got, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Errorf("DecompressLayer(%s): unexpected error reading %v blob: %+v", mediaType, compression, err)
+			}
+			if !bytes.Equal(got, layer) {
+				t.Errorf("DecompressLayer(%s): %v blob did not decompress to the layer", mediaType, compression)
+			}
+		}
+	}
+}
+
+// xorCompressor is a Compressor which "compresses" data by inverting every
+// byte.
+type xorCompressor struct{}
+
+func (xorCompressor) Name() string { return "test-xor" }
+
+type xorWriter struct{ w io.Writer }
+
+func (x xorWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for i, b := range p {
+		buf[i] = ^b
+	}
+	return x.w.Write(buf)
+}
+
+func (x xorWriter) Close() error { return nil }
+
+type xorReader struct{ r io.Reader }
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] = ^p[i]
+	}
+	return n, err
+}
+
+func (x xorReader) Close() error { return nil }
+
+func (xorCompressor) Compress(w io.Writer) (io.WriteCloser, error) { return xorWriter{w}, nil }
+
+func (xorCompressor) Decompress(r io.Reader) (io.ReadCloser, error) { return xorReader{r}, nil }
+
+func TestRegisterCompressor(t *testing.T) {
+	for _, name := range []string{"", "gzip", "zstd", "uncompressed"} {
+		if err := RegisterCompressor(namedCompressor{xorCompressor{}, name}); err == nil {
+			t.Errorf("RegisterCompressor(%q): expected an error", name)
+		}
+	}
+
+	if err := RegisterCompressor(xorCompressor{}); err != nil {
+		t.Fatalf("RegisterCompressor: unexpected error: %+v", err)
+	}
+	if GetCompressor("test-xor") == nil {
+		t.Errorf("GetCompressor: compressor was not registered")
+	}
+	mediaType, nonDistributableMediaType := CompressorMediaType(xorCompressor{})
+	if mediaType != ispec.MediaTypeImageLayer+"+test-xor" || nonDistributableMediaType != ispec.MediaTypeImageLayerNonDistributable+"+test-xor" {
+		t.Errorf("CompressorMediaType: unexpected media types %s and %s", mediaType, nonDistributableMediaType)
+	}
+	if !casext.IsLayerMediaType(mediaType) || casext.IsNonDistributableMediaType(mediaType) {
+		t.Errorf("%s is not a distributable layer media type", mediaType)
+	}
+	if !casext.IsLayerMediaType(nonDistributableMediaType) || !casext.IsNonDistributableMediaType(nonDistributableMediaType) {
+		t.Errorf("%s is not a non-distributable layer media type", nonDistributableMediaType)
+	}
+	if mediaTypeCompressor("application/vnd.example+test-xor") != nil {
+		t.Errorf("mediaTypeCompressor: compressor used for a non-layer media type")
+	}
+
+	layer := makeTarLayer(t, []tar.Header{
+		{Name: "some-file", Typeflag: tar.TypeReg, Mode: 0644},
+	}).Bytes()
+	var compressed bytes.Buffer
+	w, _ := xorCompressor{}.Compress(&compressed)
+	w.Write(layer)
+	w.Close()
+
+	for _, mt := range []string{mediaType, nonDistributableMediaType} {
+		reader, err := DecompressLayer(mt, bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			t.Errorf("DecompressLayer(%s): unexpected error: %+v", mt, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(got, layer) {
+			t.Errorf("DecompressLayer(%s): blob did not decompress to the layer (err=%v)", mt, err)
+		}
+		if !isCompressedMediaType(mt) {
+			t.Errorf("isCompressedMediaType(%s): expected true", mt)
+		}
+	}
+}
+
+// namedCompressor overrides the name of a Compressor.
+type namedCompressor struct {
+	Compressor
+	name string
+}
+
+func (n namedCompressor) Name() string { return n.name }
@@ -0,0 +1,219 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ConflictPolicy describes how suspicious interactions between layers (such
+// as a layer replacing a directory created by an earlier layer with a
+// symlink) are handled during extraction. While such interactions are
+// permitted by the image-spec, they are often the result of a bug in the
+// tool which built the image.
+type ConflictPolicy string
+
+const (
+	// ConflictIgnore silently applies layers, which is the historical
+	// behaviour.
+	ConflictIgnore ConflictPolicy = "ignore"
+
+	// ConflictWarn logs a warning for each conflict. When extracting a
+	// rootfs, the conflicts are also recorded in an audit report (see
+	// ConflictsPath).
+	ConflictWarn ConflictPolicy = "warn"
+
+	// ConflictError causes extraction to fail if a conflict is found.
+	ConflictError ConflictPolicy = "error"
+)
+
+// ParseConflictPolicy parses the given conflict policy name.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictIgnore, ConflictWarn, ConflictError:
+		return policy, nil
+	}
+	return "", errors.Errorf("unknown conflict policy: %q", name)
+}
+
+// conflictPolicy returns the ConflictPolicy for extraction, which defaults to
+// ConflictIgnore.
+func (opt MapOptions) conflictPolicy() (ConflictPolicy, error) {
+	switch opt.ConflictPolicy {
+	case "":
+		return ConflictIgnore, nil
+	case ConflictIgnore, ConflictWarn, ConflictError:
+		return opt.ConflictPolicy, nil
+	}
+	return "", errors.Errorf("unknown conflict policy: %q", opt.ConflictPolicy)
+}
+
+// ConflictKind is the kind of a LayerConflict.
+type ConflictKind string
+
+const (
+	// ConflictTypeChange means that a layer changed the type of a path which
+	// already existed (such as replacing a directory with a symlink) without
+	// a whiteout for the path.
+	ConflictTypeChange ConflictKind = "type-change"
+
+	// ConflictSymlinkTraversal means that the parent directory of a path in
+	// a layer is a symlink, so the path was extracted somewhere other than
+	// where its name suggests.
+	ConflictSymlinkTraversal ConflictKind = "symlink-traversal"
+)
+
+// LayerConflict describes a single suspicious interaction between a layer and
+// the layers applied before it.
+type LayerConflict struct {
+	// Layer is the digest of the layer which caused the conflict, if known.
+	Layer digest.Digest `json:"layer,omitempty"`
+
+	// Path is the path (relative to '/') of the entry in the layer.
+	Path string `json:"path"`
+
+	// Kind is the kind of conflict.
+	Kind ConflictKind `json:"kind"`
+
+	// Old and New describe the conflict. For ConflictTypeChange they are the
+	// old and new types of the path, and for ConflictSymlinkTraversal they
+	// are the parent directory in the layer and the path it resolved to.
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// String returns a human-readable description of the conflict.
+func (c LayerConflict) String() string {
+	var desc string
+	switch c.Kind {
+	case ConflictTypeChange:
+		desc = fmt.Sprintf("%s replaced with %s", c.Old, c.New)
+	case ConflictSymlinkTraversal:
+		desc = fmt.Sprintf("parent directory %s resolved to %s through a symlink", c.Old, c.New)
+	default:
+		desc = fmt.Sprintf("%s (%s -> %s)", c.Kind, c.Old, c.New)
+	}
+	if c.Layer != "" {
+		return fmt.Sprintf("%s (layer %s): %s", c.Path, c.Layer, desc)
+	}
+	return fmt.Sprintf("%s: %s", c.Path, desc)
+}
+
+// conflictsSuffix is appended to the rootfs path to get the path of the
+// conflict report.
+const conflictsSuffix = ".umoci-conflicts"
+
+// ConflictsPath returns the path of the audit report in which the conflicts
+// found while extracting a rootfs with ConflictWarn are recorded. Like
+// ProgressPath, it is placed next to (rather than inside) the rootfs.
+func ConflictsPath(rootfsPath string) string {
+	return filepath.Clean(rootfsPath) + conflictsSuffix
+}
+
+// ReadLayerConflicts reads the conflicts recorded for the given rootfs, in the
+// order they were found. If no report was written, no error is returned.
+func ReadLayerConflicts(rootfsPath string) ([]LayerConflict, error) {
+	data, err := ioutil.ReadFile(ConflictsPath(rootfsPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read conflict report")
+	}
+
+	var conflicts []LayerConflict
+	if err := json.Unmarshal(data, &conflicts); err != nil {
+		return nil, errors.Wrap(err, "parse conflict report")
+	}
+	return conflicts, nil
+}
+
+// conflictReport collects the conflicts found while extracting several
+// layers.
+type conflictReport struct {
+	// layer is the digest of the layer currently being extracted.
+	layer digest.Digest
+
+	conflicts []LayerConflict
+}
+
+// add records the given conflict against the current layer.
+func (r *conflictReport) add(conflict LayerConflict) {
+	if r == nil {
+		return
+	}
+	conflict.Layer = r.layer
+	r.conflicts = append(r.conflicts, conflict)
+}
+
+// write replaces the conflict report for the given rootfs.
+func (r *conflictReport) write(rootfsPath string) error {
+	conflicts := []LayerConflict{}
+	conflicts = append(conflicts, r.conflicts...)
+
+	data, err := json.Marshal(conflicts)
+	if err != nil {
+		return errors.Wrap(err, "marshal conflict report")
+	}
+	return errors.Wrap(ioutil.WriteFile(ConflictsPath(rootfsPath), data, 0644), "write conflict report")
+}
+
+// fileTypeName returns a short name for the type of the given mode.
+func fileTypeName(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeCharDevice != 0:
+		return "char device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	}
+	return "file"
+}
+
+// reportConflict handles the given conflict according to the conflict
+// policy.
+func (te *tarExtractor) reportConflict(conflict LayerConflict) error {
+	policy, err := te.mapOptions.conflictPolicy()
+	if err != nil {
+		return err
+	}
+	switch policy {
+	case ConflictIgnore:
+		return nil
+	case ConflictError:
+		return errors.Errorf("layer conflict: %s", conflict)
+	}
+	log.Warnf("layer conflict: %s", conflict)
+	te.conflicts.add(conflict)
+	return nil
+}
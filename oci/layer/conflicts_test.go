@@ -0,0 +1,151 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected ConflictPolicy
+		valid    bool
+	}{
+		{"ignore", ConflictIgnore, true},
+		{"warn", ConflictWarn, true},
+		{"error", ConflictError, true},
+		{"", "", false},
+		{"report", "", false},
+	} {
+		policy, err := ParseConflictPolicy(test.name)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseConflictPolicy(%q): expected valid=%v, got err=%v", test.name, test.valid, err)
+			continue
+		}
+		if policy != test.expected {
+			t.Errorf("ParseConflictPolicy(%q): got %q expected %q", test.name, policy, test.expected)
+		}
+	}
+}
+
+// conflictLayers are a set of layers where the second layer replaces a
+// directory with a symlink, and the third layer adds a file through that
+// symlink.
+var conflictLayers = [][]tar.Header{
+	{
+		{Name: "dir", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/a", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "other", Typeflag: tar.TypeDir, Mode: 0755},
+	},
+	{
+		{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "/other", Mode: 0777},
+	},
+	{
+		{Name: "dir/b", Typeflag: tar.TypeReg, Mode: 0644},
+	},
+}
+
+func TestUnpackConflictPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy    ConflictPolicy
+		failLayer int
+		expected  []LayerConflict
+	}{
+		{"", -1, nil},
+		{ConflictIgnore, -1, nil},
+		{ConflictWarn, -1, []LayerConflict{
+			{Layer: "layer1", Path: "/dir", Kind: ConflictTypeChange, Old: "directory", New: "symlink"},
+			{Layer: "layer2", Path: "/dir/b", Kind: ConflictSymlinkTraversal, Old: "/dir", New: "/other"},
+		}},
+		{ConflictError, 1, nil},
+		{"bad", 1, nil},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			rootfs, err := ioutil.TempDir("", "umoci-TestUnpackConflictPolicy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(rootfs)
+
+			opt := testMapOptions()
+			opt.ConflictPolicy = test.policy
+
+			report := &conflictReport{}
+			for idx, hdrs := range conflictLayers {
+				report.layer = digest.Digest(fmt.Sprintf("layer%d", idx))
+				err := unpackLayerFS(context.Background(), OSFilesystem(*opt), rootfs, makeTarLayer(t, hdrs), opt, nil, report, nil)
+				if idx == test.failLayer {
+					if err == nil {
+						t.Fatalf("expected error unpacking layer %d", idx)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error unpacking layer %d: %+v", idx, err)
+				}
+			}
+			if !reflect.DeepEqual(report.conflicts, test.expected) {
+				t.Errorf("unexpected conflicts: got %v expected %v", report.conflicts, test.expected)
+			}
+
+			// The file must have ended up in the symlink target regardless.
+			if _, err := os.Lstat(filepath.Join(rootfs, "other", "b")); err != nil {
+				t.Errorf("expected file to be extracted through symlink: %v", err)
+			}
+
+			// Make sure the report round-trips.
+			defer os.Remove(ConflictsPath(rootfs))
+			if err := report.write(rootfs); err != nil {
+				t.Fatalf("unexpected error writing report: %+v", err)
+			}
+			conflicts, err := ReadLayerConflicts(rootfs)
+			if err != nil {
+				t.Fatalf("unexpected error reading report: %+v", err)
+			}
+			if len(conflicts) != len(test.expected) || (len(conflicts) > 0 && !reflect.DeepEqual(conflicts, test.expected)) {
+				t.Errorf("unexpected conflicts in report: got %v expected %v", conflicts, test.expected)
+			}
+		})
+	}
+}
+
+func TestReadLayerConflictsMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestReadLayerConflictsMissing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conflicts, err := ReadLayerConflicts(filepath.Join(dir, "rootfs"))
+	if err != nil {
+		t.Fatalf("unexpected error reading missing report: %+v", err)
+	}
+	if conflicts != nil {
+		t.Errorf("expected no conflicts: got %v", conflicts)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DevicePolicy describes how device nodes (character and block devices) in a
+// layer are handled when the layer is extracted.
+type DevicePolicy string
+
+const (
+	// DevicePolicyCreate creates device nodes with mknod(2). Device nodes
+	// cannot be created in rootless or portable mode, so they are replaced
+	// with empty regular files (with a mode of 0000). This is the behaviour
+	// if no DevicePolicy is specified.
+	DevicePolicyCreate DevicePolicy = "create"
+
+	// DevicePolicySkip does not create device nodes, and logs a warning for
+	// every device node which was skipped.
+	DevicePolicySkip DevicePolicy = "skip"
+
+	// DevicePolicyRecord does not create device nodes, but records them in
+	// the file returned by DevicesPath (when unpacking with UnpackRootfs or
+	// UnpackManifest) so that they are known to later operations.
+	DevicePolicyRecord DevicePolicy = "record"
+)
+
+// ParseDevicePolicy parses the given device policy name.
+func ParseDevicePolicy(name string) (DevicePolicy, error) {
+	switch policy := DevicePolicy(name); policy {
+	case DevicePolicyCreate, DevicePolicySkip, DevicePolicyRecord:
+		return policy, nil
+	}
+	return "", errors.Errorf("unknown device policy: %q", name)
+}
+
+// DeviceRecord describes a device node which was not created during
+// extraction because of DevicePolicyRecord.
+type DeviceRecord struct {
+	// Path is the path of the device node, relative to the root of the
+	// rootfs.
+	Path string `json:"path"`
+
+	// Type is either "char" or "block".
+	Type string `json:"type"`
+
+	// Major and Minor are the device numbers.
+	Major int64 `json:"major"`
+	Minor int64 `json:"minor"`
+
+	// Mode contains the permission bits of the device node.
+	Mode int64 `json:"mode"`
+
+	// UID and GID are the owner of the device node inside the container.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// devicesSuffix is appended to the rootfs path to get the path of the file
+// used to record device nodes.
+const devicesSuffix = ".umoci-devices"
+
+// DevicesPath returns the path of the file in which the device nodes that were
+// not created during extraction (because of DevicePolicyRecord) are recorded.
+// Like ProgressPath, it is placed next to (rather than inside) the rootfs.
+func DevicesPath(rootfsPath string) string {
+	return filepath.Clean(rootfsPath) + devicesSuffix
+}
+
+// ReadDeviceRecords reads the device nodes recorded for the given rootfs,
+// sorted by path. If no device nodes were recorded, no error is returned.
+func ReadDeviceRecords(rootfsPath string) ([]DeviceRecord, error) {
+	data, err := ioutil.ReadFile(DevicesPath(rootfsPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read device records")
+	}
+
+	var records []DeviceRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, errors.Wrap(err, "parse device records")
+	}
+	return records, nil
+}
+
+// deviceRecords is the set of device nodes recorded during extraction, keyed
+// by their path (relative to '/').
+type deviceRecords map[string]DeviceRecord
+
+// readDeviceRecords is a wrapper around ReadDeviceRecords which returns a
+// deviceRecords.
+func readDeviceRecords(rootfsPath string) (deviceRecords, error) {
+	list, err := ReadDeviceRecords(rootfsPath)
+	if err != nil {
+		return nil, err
+	}
+	records := deviceRecords{}
+	for _, record := range list {
+		records[record.Path] = record
+	}
+	return records, nil
+}
+
+// add records the device node described by the given (unmapped) header.
+func (d deviceRecords) add(hdr *tar.Header) {
+	if d == nil {
+		return
+	}
+	record := DeviceRecord{
+		Path:  filepath.Join("/", hdr.Name),
+		Type:  "char",
+		Major: hdr.Devmajor,
+		Minor: hdr.Devminor,
+		Mode:  hdr.Mode & 07777,
+		UID:   hdr.Uid,
+		GID:   hdr.Gid,
+	}
+	if hdr.Typeflag == tar.TypeBlock {
+		record.Type = "block"
+	}
+	d[record.Path] = record
+}
+
+// remove removes the record for the given path (relative to '/') as well as
+// (if recursive is set) the records of any of its children.
+func (d deviceRecords) remove(path string, recursive bool) {
+	path = filepath.Join("/", path)
+	delete(d, path)
+	if !recursive {
+		return
+	}
+	for name := range d {
+		if strings.HasPrefix(name, path+"/") || path == "/" {
+			delete(d, name)
+		}
+	}
+}
+
+// write replaces the recorded device nodes for the given rootfs. If there are
+// no device nodes, the file is removed.
+func (d deviceRecords) write(rootfsPath string) error {
+	path := DevicesPath(rootfsPath)
+	if len(d) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove device records")
+		}
+		return nil
+	}
+
+	records := []DeviceRecord{}
+	for _, record := range d {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "marshal device records")
+	}
+	return errors.Wrap(ioutil.WriteFile(path, data, 0644), "write device records")
+}
@@ -0,0 +1,181 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseDevicePolicy(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected DevicePolicy
+		valid    bool
+	}{
+		{"create", DevicePolicyCreate, true},
+		{"skip", DevicePolicySkip, true},
+		{"record", DevicePolicyRecord, true},
+		{"", "", false},
+		{"Create", "", false},
+		{"fake", "", false},
+	} {
+		policy, err := ParseDevicePolicy(test.name)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseDevicePolicy(%q): expected valid=%v, got err=%v", test.name, test.valid, err)
+			continue
+		}
+		if policy != test.expected {
+			t.Errorf("ParseDevicePolicy(%q): got %q expected %q", test.name, policy, test.expected)
+		}
+	}
+}
+
+// makeTarLayer creates a tar layer containing the given headers.
+func makeTarLayer(t *testing.T, hdrs []tar.Header) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		hdr.ModTime = time.Now()
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unexpected error writing header: %s", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+				t.Fatalf("unexpected error writing file: %s", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing tar: %s", err)
+	}
+	return buf
+}
+
+func TestUnpackDevicePolicy(t *testing.T) {
+	for _, policy := range []DevicePolicy{DevicePolicySkip, DevicePolicyRecord} {
+		t.Run(string(policy), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackDevicePolicy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			rootfs := filepath.Join(dir, "rootfs")
+			if err := os.Mkdir(rootfs, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			opt := testMapOptions()
+			opt.DevicePolicy = policy
+
+			layers := [][]tar.Header{
+				{
+					{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+					{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+					{Name: "dev/zero", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 5},
+					{Name: "dev/loop/", Typeflag: tar.TypeDir, Mode: 0755},
+					{Name: "dev/loop/0", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 7, Devminor: 0, Gid: 6},
+					{Name: "disk", Typeflag: tar.TypeReg, Mode: 0644},
+				},
+				{
+					// Devices replace existing files, and are removed by
+					// whiteouts or by being replaced.
+					{Name: "disk", Typeflag: tar.TypeBlock, Mode: 0600, Devmajor: 8, Devminor: 0},
+					{Name: "dev/.wh.loop", Typeflag: tar.TypeReg, Mode: 0644},
+					{Name: "dev/zero", Typeflag: tar.TypeReg, Mode: 0644},
+				},
+			}
+			devices := deviceRecords{}
+			for idx, hdrs := range layers {
+				if err := unpackLayerFS(context.Background(), OSFilesystem(*opt), rootfs, makeTarLayer(t, hdrs), opt, devices, nil, nil); err != nil {
+					t.Fatalf("unexpected error unpacking layer %d: %+v", idx, err)
+				}
+			}
+
+			// No device nodes should've been created.
+			for _, path := range []string{"dev/null", "disk", "dev/loop"} {
+				if _, err := os.Lstat(filepath.Join(rootfs, path)); !os.IsNotExist(err) {
+					t.Errorf("expected %s to not exist: got %v", path, err)
+				}
+			}
+			if fi, err := os.Lstat(filepath.Join(rootfs, "dev/zero")); err != nil || !fi.Mode().IsRegular() {
+				t.Errorf("expected dev/zero to be a regular file: got %v", err)
+			}
+
+			if err := devices.write(rootfs); err != nil {
+				t.Fatalf("unexpected error writing device records: %+v", err)
+			}
+			records, err := ReadDeviceRecords(rootfs)
+			if err != nil {
+				t.Fatalf("unexpected error reading device records: %+v", err)
+			}
+
+			var expected []DeviceRecord
+			if policy == DevicePolicyRecord {
+				expected = []DeviceRecord{
+					{Path: "/dev/null", Type: "char", Major: 1, Minor: 3, Mode: 0666},
+					{Path: "/disk", Type: "block", Major: 8, Minor: 0, Mode: 0600},
+				}
+			}
+			if !reflect.DeepEqual(records, expected) {
+				t.Errorf("got device records %+v, expected %+v", records, expected)
+			}
+		})
+	}
+}
+
+func TestDeviceRecordsWriteEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestDeviceRecordsWriteEmpty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+
+	devices := deviceRecords{"/dev/null": {Path: "/dev/null", Type: "char", Major: 1, Minor: 3}}
+	if err := devices.write(rootfs); err != nil {
+		t.Fatalf("unexpected error writing device records: %+v", err)
+	}
+	if _, err := os.Stat(DevicesPath(rootfs)); err != nil {
+		t.Fatalf("expected device records to exist: %s", err)
+	}
+
+	// Writing an empty set must remove the file.
+	devices.remove("/dev", true)
+	if err := devices.write(rootfs); err != nil {
+		t.Fatalf("unexpected error writing device records: %+v", err)
+	}
+	if _, err := os.Stat(DevicesPath(rootfs)); !os.IsNotExist(err) {
+		t.Errorf("expected device records to be removed: %v", err)
+	}
+	if records, err := ReadDeviceRecords(rootfs); err != nil || records != nil {
+		t.Errorf("expected no device records: got %v (err=%v)", records, err)
+	}
+}
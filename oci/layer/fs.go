@@ -0,0 +1,107 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/system"
+)
+
+// Filesystem is the set of filesystem operations required to apply a layer.
+// All paths passed to a Filesystem are absolute (and already scoped to the
+// root being extracted to), and none of the operations are expected to follow
+// a symlink in the final component of the path. Implementations can be backed
+// by the host filesystem (see OSFilesystem), by memory (see pkg/memfs) or by
+// anything else an embedder wishes to apply layers onto.
+type Filesystem interface {
+	// Create is equivalent to os.Create.
+	Create(path string) (io.WriteCloser, error)
+
+	// Lstat is equivalent to os.Lstat.
+	Lstat(path string) (os.FileInfo, error)
+
+	// Readdir is equivalent to os.Readdir.
+	Readdir(path string) ([]os.FileInfo, error)
+
+	// Readlink is equivalent to os.Readlink.
+	Readlink(path string) (string, error)
+
+	// Symlink is equivalent to os.Symlink.
+	Symlink(linkname, path string) error
+
+	// Link is equivalent to os.Link.
+	Link(linkname, path string) error
+
+	// Chmod is equivalent to os.Chmod.
+	Chmod(path string, mode os.FileMode) error
+
+	// Lchown is equivalent to os.Lchown.
+	Lchown(path string, uid, gid int) error
+
+	// Lutimes is equivalent to os.Lutimes.
+	Lutimes(path string, atime, mtime time.Time) error
+
+	// RemoveAll is equivalent to os.RemoveAll.
+	RemoveAll(path string) error
+
+	// MkdirAll is equivalent to os.MkdirAll.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// Mknod is equivalent to system.Mknod.
+	Mknod(path string, mode os.FileMode, dev system.Dev_t) error
+
+	// Lsetxattr is equivalent to system.Lsetxattr.
+	Lsetxattr(path, name string, value []byte, flags int) error
+
+	// Lclearxattrs is equivalent to system.Lclearxattrs.
+	Lclearxattrs(path string) error
+}
+
+// fsEvalFilesystem is a Filesystem backed by an fseval.FsEval.
+type fsEvalFilesystem struct {
+	fseval.FsEval
+}
+
+// Create is equivalent to os.Create.
+func (fs fsEvalFilesystem) Create(path string) (io.WriteCloser, error) {
+	return fs.FsEval.Create(path)
+}
+
+// Lchown is equivalent to os.Lchown.
+func (fs fsEvalFilesystem) Lchown(path string, uid, gid int) error {
+	// XXX: While unpriv.Lchown doesn't make a whole lot of sense this
+	//      should _probably_ be put inside FsEval.
+	return os.Lchown(path, uid, gid)
+}
+
+// OSFilesystem returns a Filesystem backed by the host filesystem, using the
+// fseval.FsEval implementation appropriate for the given MapOptions.
+func OSFilesystem(opt MapOptions) Filesystem {
+	fsEval := fseval.DefaultFsEval
+	if opt.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	if opt.Portable {
+		fsEval = fseval.PortableFsEval
+	}
+	return fsEvalFilesystem{fsEval}
+}
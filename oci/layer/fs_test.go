@@ -0,0 +1,121 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/memfs"
+)
+
+// Ensure that memfs.Filesystem implements Filesystem.
+var _ Filesystem = memfs.New()
+
+// TestUnpackLayerFS makes sure that layers can be applied to an in-memory
+// filesystem, which doesn't require any privileges.
+func TestUnpackLayerFS(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	for _, file := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 100, Xattrs: map[string]string{"user.test": "value"}}, "root:x:0:0::/root:/bin/sh\n"},
+		{tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600}, "root:*::0:::::\n"},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"}, ""},
+		{tar.Header{Name: "etc/symlink", Typeflag: tar.TypeSymlink, Linkname: "../../../passwd"}, ""},
+		{tar.Header{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}, ""},
+		{tar.Header{Name: "etc/" + whPrefix + "shadow", Typeflag: tar.TypeReg}, ""},
+	} {
+		hdr := file.hdr
+		hdr.Size = int64(len(file.data))
+		hdr.ModTime = time.Unix(1234567890, 0)
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unexpected error writing header %s: %s", hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(file.data)); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := memfs.New()
+	if err := fs.MkdirAll("/rootfs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayerFS(fs, "/rootfs", buffer, nil); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	fh, err := fs.Open("/rootfs/etc/passwd")
+	if err != nil {
+		t.Fatalf("unexpected error opening passwd: %s", err)
+	}
+	data, err := ioutil.ReadAll(fh)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "root:x:0:0::/root:/bin/sh\n" {
+		t.Errorf("unexpected passwd contents: %q", data)
+	}
+
+	fi, err := fs.Lstat("/rootfs/etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fi.Sys().(*memfs.Stat)
+	if stat.Uid != 1000 || stat.Gid != 100 {
+		t.Errorf("unexpected owner of passwd: %d:%d", stat.Uid, stat.Gid)
+	}
+	if stat.Nlink != 2 {
+		t.Errorf("expected passwd to be hardlinked, got nlink=%d", stat.Nlink)
+	}
+	if string(stat.Xattrs["user.test"]) != "value" {
+		t.Errorf("unexpected xattrs of passwd: %v", stat.Xattrs)
+	}
+	if fi.Mode() != 0644 {
+		t.Errorf("unexpected mode of passwd: %v", fi.Mode())
+	}
+	if !fi.ModTime().Equal(time.Unix(1234567890, 0)) {
+		t.Errorf("unexpected mtime of passwd: %v", fi.ModTime())
+	}
+
+	if linkname, err := fs.Readlink("/rootfs/etc/symlink"); err != nil || linkname != "../../../passwd" {
+		t.Errorf("unexpected symlink: %q (err=%v)", linkname, err)
+	}
+
+	if fi, err := fs.Lstat("/rootfs/dev/null"); err != nil {
+		t.Errorf("unexpected error getting device: %s", err)
+	} else if fi.Mode()&os.ModeCharDevice != os.ModeCharDevice {
+		t.Errorf("expected dev/null to be a char device: %v", fi.Mode())
+	}
+
+	if _, err := fs.Lstat("/rootfs/etc/shadow"); !os.IsNotExist(err) {
+		t.Errorf("expected whiteout to remove etc/shadow: %v", err)
+	}
+}
@@ -19,12 +19,16 @@ package layer
 
 import (
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/telemetry"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
 )
 
 // NOTE: This currently requires a version of go-mtree which has my Compare()
@@ -40,22 +44,113 @@ func (ids inodeDeltas) Len() int           { return len(ids) }
 func (ids inodeDeltas) Less(i, j int) bool { return ids[i].Path() < ids[j].Path() }
 func (ids inodeDeltas) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
 
+// linkCountOnly returns whether the only difference in the given delta is the
+// hardlink count of the path, which changes whenever other hardlinks to the
+// same inode are added or removed.
+func linkCountOnly(delta mtree.InodeDelta) bool {
+	if delta.Type() != mtree.Modified {
+		return false
+	}
+	keys := delta.Diff()
+	for _, key := range keys {
+		if key.Name() != "nlink" {
+			return false
+		}
+	}
+	return len(keys) > 0
+}
+
+// entryType returns the value of the "type" keyword of the given mtree entry
+// (such as "file", "dir" or "link"), or "" if it is not known.
+func entryType(entry *mtree.Entry) string {
+	if entry == nil {
+		return ""
+	}
+	return mtree.HasKeyword(entry.AllKeys(), "type").Value()
+}
+
+// typeChanged returns whether the given delta changes the type of the path
+// (such as replacing a directory with a symlink, or a regular file with a
+// directory). In that case a whiteout for the path is added before the new
+// entry, so that extraction implementations remove the old path rather than
+// trying to merge the two (which would result in a directory's contents
+// being extracted through a symlink, for instance).
+func typeChanged(delta mtree.InodeDelta) bool {
+	if delta.Type() != mtree.Modified {
+		return false
+	}
+	oldType, newType := entryType(delta.Old()), entryType(delta.New())
+	return oldType != "" && newType != "" && oldType != newType
+}
+
+// pruneReplacedDirs removes the mtree.Missing deltas for paths underneath
+// directories which were replaced by a different type of file, since the
+// whiteout added for the directory already removes them (and the whiteouts
+// would otherwise be extracted underneath the new path).
+func pruneReplacedDirs(deltas []mtree.InodeDelta) []mtree.InodeDelta {
+	replaced := map[string]struct{}{}
+	for _, delta := range deltas {
+		if typeChanged(delta) && entryType(delta.Old()) == "dir" {
+			replaced[CleanPath(filepath.Join("/", delta.Path()))] = struct{}{}
+		}
+	}
+	if len(replaced) == 0 {
+		return deltas
+	}
+
+	inReplacedDir := func(name string) bool {
+		name = CleanPath(filepath.Join("/", name))
+		for parent := filepath.Dir(name); parent != "/"; parent = filepath.Dir(parent) {
+			if _, ok := replaced[parent]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	var pruned []mtree.InodeDelta
+	for _, delta := range deltas {
+		if delta.Type() == mtree.Missing && inReplacedDir(delta.Path()) {
+			log.Debugf("generate layer: parent directory was replaced: %s", delta.Path())
+			continue
+		}
+		pruned = append(pruned, delta)
+	}
+	return pruned
+}
+
 // GenerateLayer creates a new OCI diff layer based on the mtree diff provided.
 // All of the mtree.Modified and mtree.Extra blobs are read relative to the
 // provided path (which should be the rootfs of the layer that was diffed). The
 // returned reader is for the *raw* tar data, it is the caller's responsibility
-// to gzip it.
+// to gzip it. Paths whose type has changed are whited-out before their new
+// entry is added. Any ChownRules and ChmodRules in the MapOptions are applied
+// to the generated entries, and if the MapOptions have a PrefetchProfile the
+// entries are ordered according to it.
 func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.ReadCloser, error) {
 	var mapOptions MapOptions
 	if opt != nil {
 		mapOptions = *opt
 	}
 
+	rewriter, err := newHeaderRewriter(mapOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate layer")
+	}
+	if _, err := mapOptions.fifoPolicy(); err != nil {
+		return nil, errors.Wrap(err, "generate layer")
+	}
+	if _, err := mapOptions.socketPolicy(); err != nil {
+		return nil, errors.Wrap(err, "generate layer")
+	}
+
 	reader, writer := io.Pipe()
 
 	go func() (Err error) {
 		// Close with the returned error.
+		_, span := telemetry.StartSpan(context.Background(), "layer.generate", map[string]string{"path": path})
 		defer func() {
+			span.End(Err)
 			writer.CloseWithError(errors.Wrap(Err, "generate layer"))
 		}()
 
@@ -63,32 +158,88 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
 		tg := newTarGenerator(writer, mapOptions)
+		tg.rewriter = rewriter
 
 		// Sort the delta paths.
 		// FIXME: We need to add whiteouts first, otherwise we might end up
 		//        doing something silly like deleting a file which we actually
 		//        meant to modify.
 		sort.Sort(inodeDeltas(deltas))
+		deltas = pruneReplacedDirs(deltas)
 
-		for _, delta := range deltas {
+		// Paths whose only change is their hardlink count don't need to be
+		// added again, as long as any new hardlinks to them are added as
+		// hardlinks to the existing paths (rather than copies).
+		if mapOptions.PreserveHardlinks {
+			var changed []mtree.InodeDelta
+			skip := map[string]struct{}{}
+			for _, delta := range deltas {
+				if linkCountOnly(delta) {
+					log.Debugf("generate layer: only hardlink count changed: %s", delta.Path())
+					continue
+				}
+				changed = append(changed, delta)
+				skip[CleanPath(delta.Path())] = struct{}{}
+			}
+			deltas = changed
+
+			if err := tg.addLinkTargets(path, skip); err != nil {
+				return errors.Wrap(err, "find hardlink targets")
+			}
+		}
+
+		addDelta := func(delta mtree.InodeDelta) error {
 			name := delta.Path()
 			fullPath := filepath.Join(path, name)
 
-			// XXX: It's possible that if we unlink a hardlink, we're going to
-			//      AddFile() for no reason. Maybe we should drop nlink= from
-			//      the set of keywords we care about?
-
 			switch delta.Type() {
 			case mtree.Modified, mtree.Extra:
+				if typeChanged(delta) {
+					if err := tg.AddWhiteout(name); err != nil {
+						log.Warnf("generate layer: could not add whiteout '%s': %s", name, err)
+						return errors.Wrap(err, "generate whiteout for type change")
+					}
+				}
 				if err := tg.AddFile(name, fullPath); err != nil {
 					log.Warnf("generate layer: could not add file '%s': %s", name, err)
 					return errors.Wrap(err, "generate layer file")
 				}
+				telemetry.AddCounter(telemetry.CounterFilesGenerated, 1)
 			case mtree.Missing:
 				if err := tg.AddWhiteout(name); err != nil {
 					log.Warnf("generate layer: could not add whiteout '%s': %s", name, err)
 					return errors.Wrap(err, "generate whiteout layer file")
 				}
+				telemetry.AddCounter(telemetry.CounterFilesGenerated, 1)
+			}
+			return nil
+		}
+
+		// Paths in the prefetch profile are added first, followed by a
+		// landmark so that lazy pulling implementations know which entries
+		// to prefetch.
+		if mapOptions.PrefetchProfile != nil {
+			var prioritised []mtree.InodeDelta
+			prioritised, deltas = prioritiseDeltas(deltas, mapOptions.PrefetchProfile)
+			log.Debugf("generate layer: %d prioritised entries", len(prioritised))
+
+			landmark := PrefetchLandmark
+			if len(prioritised) == 0 {
+				landmark = NoPrefetchLandmark
+			}
+			for _, delta := range prioritised {
+				if err := addDelta(delta); err != nil {
+					return err
+				}
+			}
+			if err := tg.AddLandmark(landmark); err != nil {
+				return errors.Wrap(err, "generate landmark")
+			}
+		}
+
+		for _, delta := range deltas {
+			if err := addDelta(delta); err != nil {
+				return err
 			}
 		}
 
@@ -102,3 +253,64 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 
 	return reader, nil
 }
+
+// GenerateInsertLayer creates a new OCI diff layer containing the file or
+// directory (recursively) at root on the host, which is added to the layer at
+// the path target. Parent directories of target are not included in the
+// layer. As with GenerateLayer, the returned reader is for the *raw* tar data
+// and any ChownRules and ChmodRules in the MapOptions are applied to the
+// generated entries.
+func GenerateInsertLayer(root, target string, opt *MapOptions) (io.ReadCloser, error) {
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
+
+	rewriter, err := newHeaderRewriter(mapOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate insert layer")
+	}
+	target = strings.TrimPrefix(CleanPath(filepath.Join("/", target)), "/")
+	if target == "" {
+		return nil, errors.Errorf("generate insert layer: cannot insert at the root directory")
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate insert layer"))
+		}()
+
+		tg := newTarGenerator(writer, mapOptions)
+		tg.rewriter = rewriter
+
+		// filepath.Walk walks in lexical order and doesn't follow symlinks.
+		if err := filepath.Walk(root, func(curPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, curPath)
+			if err != nil {
+				return err
+			}
+			name := filepath.Join(target, rel)
+			if err := tg.AddFile(name, curPath); err != nil {
+				log.Warnf("generate insert layer: could not add file '%s': %s", name, err)
+				return errors.Wrap(err, "generate layer file")
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err := tg.tw.Close(); err != nil {
+			log.Warnf("generate insert layer: could not close tar.Writer: %s", err)
+			return errors.Wrap(err, "close tar writer")
+		}
+		return nil
+	}()
+
+	return reader, nil
+}
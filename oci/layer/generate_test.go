@@ -24,9 +24,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
 )
 
 func TestGenerate(t *testing.T) {
@@ -136,6 +139,94 @@ func TestGenerate(t *testing.T) {
 	}
 }
 
+func TestGeneratePreserveHardlinks(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		preserve bool
+		expected map[string]string // name -> linkname ("" for a copy)
+	}{
+		{"Default", false, map[string]string{"c": "", "d": "", "e": "c"}},
+		{"Preserve", true, map[string]string{"d": "a", "e": "c"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestGeneratePreserveHardlinks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// a and b are hardlinks, c is a regular file.
+			if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "c"), []byte("c"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Move the b link to d (so a is unchanged), and add a new link to
+			// c (so only the hardlink count of c changes).
+			if err := os.Rename(filepath.Join(dir, "b"), filepath.Join(dir, "d")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Link(filepath.Join(dir, "c"), filepath.Join(dir, "e")); err != nil {
+				t.Fatal(err)
+			}
+
+			postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader, err := GenerateLayer(dir, diffs, &MapOptions{PreserveHardlinks: test.preserve})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			got := map[string]string{}
+			tr := tar.NewReader(reader)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				switch hdr.Typeflag {
+				case tar.TypeReg:
+					if hdr.Name != ".wh.b" {
+						got[hdr.Name] = ""
+					}
+				case tar.TypeLink:
+					got[hdr.Name] = hdr.Linkname
+				}
+			}
+
+			if len(got) != len(test.expected) {
+				t.Errorf("unexpected entries in layer: expected %v got %v", test.expected, got)
+			}
+			for name, linkname := range test.expected {
+				if gotLinkname, ok := got[name]; !ok || gotLinkname != linkname {
+					t.Errorf("unexpected entry %s in layer: expected link %q got %q (present=%v)", name, linkname, gotLinkname, ok)
+				}
+			}
+		})
+	}
+}
+
 // Make sure that openSUSE/umoci#33 doesn't regress.
 func TestGenerateMissingFileError(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestGenerateError")
@@ -270,3 +361,199 @@ func TestGenerateWrongRootError(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateInsertLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateInsertLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "src", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "src", "sub", "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/file", filepath.Join(dir, "src", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		source, target string
+		expected       []string
+	}{
+		{"src", "/opt/app", []string{"opt/app/", "opt/app/link", "opt/app/sub/", "opt/app/sub/file"}},
+		{"src/sub/file", "../../etc/file", []string{"etc/file"}},
+	} {
+		reader, err := GenerateInsertLayer(filepath.Join(dir, test.source), test.target, &MapOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading layer: %+v", err)
+			}
+			names = append(names, hdr.Name)
+			if hdr.Name == "opt/app/link" && (hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "sub/file") {
+				t.Errorf("unexpected symlink entry: %#v", hdr)
+			}
+		}
+		reader.Close()
+
+		if len(names) != len(test.expected) {
+			t.Errorf("insert %s at %s: expected entries %v, got %v", test.source, test.target, test.expected, names)
+			continue
+		}
+		for idx := range names {
+			if names[idx] != test.expected[idx] {
+				t.Errorf("insert %s at %s: expected entries %v, got %v", test.source, test.target, test.expected, names)
+				break
+			}
+		}
+	}
+
+	// Inserting at the root is not permitted.
+	if _, err := GenerateInsertLayer(filepath.Join(dir, "src"), "/", &MapOptions{}); err == nil {
+		t.Errorf("expected error inserting at the root directory")
+	}
+}
+
+// makeTypedPath creates a path of the given type ("file", "dir", "link" or
+// "fifo"). Directories are created with a child with the given name.
+func makeTypedPath(t *testing.T, path, fileType, child string) {
+	var err error
+	switch fileType {
+	case "file":
+		err = ioutil.WriteFile(path, []byte("contents of "+child), 0644)
+	case "dir":
+		if err = os.Mkdir(path, 0755); err == nil {
+			err = ioutil.WriteFile(filepath.Join(path, child), []byte(child), 0644)
+		}
+	case "link":
+		err = os.Symlink("/"+child, path)
+	case "fifo":
+		err = unix.Mkfifo(path, 0644)
+	default:
+		t.Fatalf("unknown type %q", fileType)
+	}
+	if err != nil {
+		t.Fatalf("create %s %s: %v", fileType, path, err)
+	}
+}
+
+// TestGenerateTypeChange checks that paths which change type are whited-out
+// before the new entry is added (without any whiteouts for the children of
+// replaced directories), and that the resulting layer extracts correctly.
+func TestGenerateTypeChange(t *testing.T) {
+	types := []string{"file", "dir", "link", "fifo"}
+	modes := map[string]os.FileMode{
+		"file": 0,
+		"dir":  os.ModeDir,
+		"link": os.ModeSymlink,
+		"fifo": os.ModeNamedPipe,
+	}
+	keywords := []mtree.Keyword{"size", "type", "mode", "link", "sha256digest"}
+
+	for _, oldType := range types {
+		for _, newType := range types {
+			if oldType == newType {
+				continue
+			}
+			t.Run(oldType+"-"+newType, func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "umoci-TestGenerateTypeChange")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				rootfs := filepath.Join(dir, "rootfs")
+				target := filepath.Join(dir, "target")
+				for _, root := range []string{rootfs, target} {
+					if err := os.Mkdir(root, 0755); err != nil {
+						t.Fatal(err)
+					}
+					makeTypedPath(t, filepath.Join(root, "path"), oldType, "old")
+				}
+
+				initDh, err := mtree.Walk(rootfs, nil, keywords, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.RemoveAll(filepath.Join(rootfs, "path")); err != nil {
+					t.Fatal(err)
+				}
+				makeTypedPath(t, filepath.Join(rootfs, "path"), newType, "new")
+				postDh, err := mtree.Walk(rootfs, nil, keywords, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				diffs, err := mtree.Compare(initDh, postDh, keywords)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				reader, err := GenerateLayer(rootfs, diffs, &MapOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var layer bytes.Buffer
+				if _, err := io.Copy(&layer, reader); err != nil {
+					t.Fatalf("unexpected error generating layer: %+v", err)
+				}
+				reader.Close()
+
+				var names []string
+				tr := tar.NewReader(bytes.NewReader(layer.Bytes()))
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("unexpected error reading layer: %s", err)
+					}
+					names = append(names, strings.TrimSuffix(hdr.Name, "/"))
+				}
+				expected := []string{".wh.path", "path"}
+				if newType == "dir" {
+					expected = append(expected, "path/new")
+				}
+				// The root directory is modified when the path is replaced.
+				if len(names) > 0 && (names[0] == "." || names[0] == "") {
+					names = names[1:]
+				}
+				if !reflect.DeepEqual(names, expected) {
+					t.Errorf("unexpected layer entries: got %v, expected %v", names, expected)
+				}
+
+				// The type change must not be reported as a conflict when
+				// extracting the layer.
+				opt := testMapOptions()
+				opt.ConflictPolicy = ConflictError
+				if err := UnpackLayer(target, bytes.NewReader(layer.Bytes()), opt); err != nil {
+					t.Fatalf("unexpected error unpacking layer: %+v", err)
+				}
+				fi, err := os.Lstat(filepath.Join(target, "path"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Mode()&os.ModeType != modes[newType] {
+					t.Errorf("unexpected type of extracted path: %s", fi.Mode())
+				}
+				if oldType == "dir" && newType != "link" {
+					if _, err := os.Lstat(filepath.Join(target, "path", "old")); err == nil {
+						t.Errorf("child of replaced directory still exists")
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,31 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import "os"
+
+// getFileKey always returns false, as Windows doesn't provide inode
+// information through os.FileInfo.
+func getFileKey(fi os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
+
+// isBtrfs always returns false, as btrfs is not supported on Windows.
+func isBtrfs(path string) (bool, error) {
+	return false, nil
+}
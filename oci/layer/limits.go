@@ -0,0 +1,142 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxCompressionRatio is the largest ratio between the decompressed and
+// compressed size of a layer that is extracted if MapOptions doesn't specify
+// one. Real-world layers very rarely compress better than 10:1, while
+// "decompression bombs" can reach ratios of 1000:1 (gzip) or more (zstd).
+const DefaultMaxCompressionRatio = 100
+
+// minRatioCheckSize is the number of decompressed bytes of a layer which can
+// be read before the compression ratio is checked, so that small (and highly
+// compressible) layers are not rejected.
+const minRatioCheckSize = 64 << 20
+
+// ErrLayerTooLarge is returned (as the cause of the error) when a layer is
+// larger, or compresses better, than the limits given in MapOptions.
+var ErrLayerTooLarge = fmt.Errorf("layer exceeds decompression limits")
+
+// limitedLayerReader wraps a decompressed layer and returns an error (with
+// ErrLayerTooLarge as its cause) once more than maxSize bytes have been read,
+// or once the ratio of bytes read to bytes read from compressed exceeds
+// maxRatio. A limit which is not positive is not enforced, and if compressed
+// is nil (the layer was not compressed) the ratio is not checked.
+type limitedLayerReader struct {
+	io.ReadCloser
+	compressed *countingReader
+	size       int64
+	maxSize    int64
+	maxRatio   int64
+}
+
+// Read implements io.Reader.
+func (r *limitedLayerReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.size += int64(n)
+	if r.maxSize > 0 && r.size > r.maxSize {
+		n -= int(r.size - r.maxSize)
+		return n, errors.Wrapf(ErrLayerTooLarge, "decompressed layer is larger than %d bytes", r.maxSize)
+	}
+	if r.compressed != nil && r.maxRatio > 0 && r.size > minRatioCheckSize && r.size > r.maxRatio*r.compressed.n {
+		return n, errors.Wrapf(ErrLayerTooLarge, "layer compression ratio is greater than %d:1", r.maxRatio)
+	}
+	return n, err
+}
+
+// layerLimits returns the maximum decompressed size and compression ratio of
+// layers given by opt, with the defaults filled in.
+func layerLimits(opt *MapOptions) (maxSize, maxRatio int64) {
+	maxSize, maxRatio = opt.MaxLayerSize, opt.MaxCompressionRatio
+	if maxRatio == 0 {
+		maxRatio = DefaultMaxCompressionRatio
+	}
+	return maxSize, maxRatio
+}
+
+// Defaults for the MaxLayerEntries and MaxPathDepth of MapOptions. They are
+// far larger than anything seen in real-world images, and are only meant to
+// stop pathological layers from exhausting inodes or the kernel's path limits.
+const (
+	// DefaultMaxLayerEntries is the default MapOptions.MaxLayerEntries.
+	DefaultMaxLayerEntries = 10000000
+
+	// DefaultMaxPathDepth is the default MapOptions.MaxPathDepth.
+	DefaultMaxPathDepth = 1024
+)
+
+// ErrLayerTooComplex is returned (as the cause of the error) when a layer has
+// more entries, or deeper paths, than the limits given in MapOptions.
+var ErrLayerTooComplex = fmt.Errorf("layer exceeds entry limits")
+
+// entryLimiter enforces the MaxLayerEntries and MaxPathDepth of a MapOptions
+// on the entries of a single layer, keeping track of what has been seen so
+// that the error is useful.
+type entryLimiter struct {
+	maxEntries int64
+	maxDepth   int
+	entries    int64
+	depth      int
+}
+
+// newEntryLimiter returns an entryLimiter for the limits given by opt, with
+// the defaults filled in.
+func newEntryLimiter(opt MapOptions) *entryLimiter {
+	l := &entryLimiter{maxEntries: opt.MaxLayerEntries, maxDepth: opt.MaxPathDepth}
+	if l.maxEntries == 0 {
+		l.maxEntries = DefaultMaxLayerEntries
+	}
+	if l.maxDepth == 0 {
+		l.maxDepth = DefaultMaxPathDepth
+	}
+	return l
+}
+
+// pathDepth returns the number of components in the given tar entry name.
+func pathDepth(name string) int {
+	name = strings.Trim(filepath.Clean("/"+name), "/")
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+// add records an entry with the given name, returning an error if the entry
+// exceeds the limits.
+func (l *entryLimiter) add(name string) error {
+	l.entries++
+	if depth := pathDepth(name); depth > l.depth {
+		l.depth = depth
+	}
+	if l.maxEntries > 0 && l.entries > l.maxEntries {
+		return errors.Wrapf(ErrLayerTooComplex, "layer has more than %d entries (deepest path seen has %d components)", l.maxEntries, l.depth)
+	}
+	if l.maxDepth > 0 && l.depth > l.maxDepth {
+		return errors.Wrapf(ErrLayerTooComplex, "path has %d components, more than the limit of %d (after %d entries)", l.depth, l.maxDepth, l.entries)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+func TestLimitedLayerReaderSize(t *testing.T) {
+	reader := &limitedLayerReader{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, 1000))),
+		maxSize:    100,
+	}
+	data, err := ioutil.ReadAll(reader)
+	if errors.Cause(err) != ErrLayerTooLarge {
+		t.Errorf("expected ErrLayerTooLarge, got %v", err)
+	}
+	if len(data) != 100 {
+		t.Errorf("read %d bytes, expected at most 100", len(data))
+	}
+
+	reader = &limitedLayerReader{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, 1000))),
+		maxSize:    1000,
+	}
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Errorf("unexpected error reading layer within limit: %+v", err)
+	}
+}
+
+func TestLimitedLayerReaderRatio(t *testing.T) {
+	// A "decompression bomb" which compresses at roughly 1000:1.
+	var bomb bytes.Buffer
+	gzw := gzip.NewWriter(&bomb)
+	zeros := make([]byte, 1<<20)
+	for i := 0; i < 2*minRatioCheckSize/len(zeros); i++ {
+		if _, err := gzw.Write(zeros); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		maxRatio int64
+		fail     bool
+	}{
+		{0, true},
+		{-1, false},
+		{1 << 20, false},
+	} {
+		maxSize, maxRatio := layerLimits(&MapOptions{MaxCompressionRatio: test.maxRatio})
+		compressed := &countingReader{r: bytes.NewReader(bomb.Bytes())}
+		raw, err := DecompressLayer(ispec.MediaTypeImageLayerGzip, compressed)
+		if err != nil {
+			t.Fatalf("DecompressLayer: unexpected error: %+v", err)
+		}
+		reader := &limitedLayerReader{
+			ReadCloser: raw,
+			compressed: compressed,
+			maxSize:    maxSize,
+			maxRatio:   maxRatio,
+		}
+		_, err = ioutil.ReadAll(reader)
+		reader.Close()
+		if test.fail && errors.Cause(err) != ErrLayerTooLarge {
+			t.Errorf("MaxCompressionRatio=%d: expected ErrLayerTooLarge, got %v", test.maxRatio, err)
+		} else if !test.fail && err != nil {
+			t.Errorf("MaxCompressionRatio=%d: unexpected error: %+v", test.maxRatio, err)
+		}
+	}
+}
+
+func TestPathDepth(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected int
+	}{
+		{".", 0},
+		{"/", 0},
+		{"a", 1},
+		{"./a/b/", 2},
+		{"a/../../b/c", 2},
+		{"/a//b/c/d", 4},
+	} {
+		if got := pathDepth(test.name); got != test.expected {
+			t.Errorf("pathDepth(%q): expected %d got %d", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestUnpackLayerEntryLimits(t *testing.T) {
+	var hdrs []tar.Header
+	for i := 0; i < 5; i++ {
+		hdrs = append(hdrs, tar.Header{
+			Name:     strings.Repeat("d/", i) + "file",
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+		})
+	}
+	layer := makeTarLayer(t, hdrs).Bytes()
+
+	for _, test := range []struct {
+		name       string
+		maxEntries int64
+		maxDepth   int
+		fail       bool
+	}{
+		{"Default", 0, 0, false},
+		{"Unlimited", -1, -1, false},
+		{"TooManyEntries", 4, 0, true},
+		{"TooDeep", 0, 4, true},
+		{"WithinLimits", 5, 5, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "umoci-TestUnpackLayerEntryLimits")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			opt := testMapOptions()
+			opt.MaxLayerEntries = test.maxEntries
+			opt.MaxPathDepth = test.maxDepth
+			err = UnpackLayer(filepath.Join(root, "rootfs"), bytes.NewReader(layer), opt)
+			if test.fail && errors.Cause(err) != ErrLayerTooComplex {
+				t.Errorf("expected ErrLayerTooComplex, got %v", err)
+			} else if !test.fail && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		})
+	}
+}
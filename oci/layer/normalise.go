@@ -0,0 +1,177 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// whOpaquePrefix is the prefix of the (reserved) whiteout names used by some
+// tools for opaque directories, which umoci does not support.
+const whOpaquePrefix = whPrefix + whPrefix
+
+// NormaliseArchive copies the entries of an arbitrary tar archive (which may
+// be compressed with any of the algorithms supported by Decompress) to w as a
+// layer archive, in the same form as the layers generated by GenerateLayer.
+//
+// Every entry is validated: paths (and hardlink targets) are cleaned and must
+// not point outside of the root of the archive, and only the entry types which
+// can be extracted by UnpackLayer are permitted. The root directory entry (as
+// generated by "tar -C dir .") and PAX global headers are dropped, as they
+// cannot be represented in a layer. The entries are written as PAX headers,
+// the ChownRules and ChmodRules in opt are applied, and timestamps are
+// normalised as with GenerateLayer.
+func NormaliseArchive(w io.Writer, r io.Reader, opt *MapOptions) error {
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
+	rewriter, err := newHeaderRewriter(mapOptions)
+	if err != nil {
+		return errors.Wrap(err, "parse rewrite rules")
+	}
+
+	archive, compression, err := Decompress(r)
+	if err != nil {
+		return errors.Wrap(err, "decompress archive")
+	}
+	defer archive.Close()
+	log.Debugf("normalising %s archive", compression)
+
+	tr := tar.NewReader(archive)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		keep, err := normaliseHeader(hdr, mapOptions)
+		if err != nil {
+			return errors.Wrapf(err, "normalise entry %s", hdr.Name)
+		}
+		if !keep {
+			log.Debugf("normalise: dropping entry %s", hdr.Name)
+			continue
+		}
+		rewriter.rewrite(hdr)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header for %s", hdr.Name)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := pooledCopy(tw, tr); err != nil {
+				return errors.Wrapf(err, "copy contents of %s", hdr.Name)
+			}
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
+
+// NormaliseLayer is equivalent to NormaliseArchive, except that the returned
+// reader is the normalised (uncompressed) layer archive, which is generated in
+// the background.
+func NormaliseLayer(r io.Reader, opt *MapOptions) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(NormaliseArchive(writer, r, opt))
+	}()
+	return reader
+}
+
+// normaliseArchivePath is like normalise, except that absolute paths are
+// treated as being relative to the root of the archive (as with GNU tar), and
+// paths which lexically escape the root of the archive are rejected rather
+// than being silently cleaned.
+func normaliseArchivePath(rawPath string, isDir bool) (string, error) {
+	path := filepath.Clean(strings.TrimLeft(rawPath, "/"))
+	if path == ".." || strings.HasPrefix(path, "../") {
+		return "", errors.Errorf("escape warning: path is outside tar root: %s", rawPath)
+	}
+	return normalise(path, isDir)
+}
+
+// normaliseHeader validates and normalises the given header in-place, and
+// returns whether the entry should be kept.
+func normaliseHeader(hdr *tar.Header, opt MapOptions) (bool, error) {
+	switch hdr.Typeflag {
+	case tar.TypeXGlobalHeader:
+		return false, nil
+	case tar.TypeRegA:
+		hdr.Typeflag = tar.TypeReg
+	case tar.TypeReg, tar.TypeLink, tar.TypeSymlink, tar.TypeDir, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	default:
+		return false, errors.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+
+	name, err := normaliseArchivePath(hdr.Name, hdr.Typeflag == tar.TypeDir)
+	if err != nil {
+		return false, err
+	}
+	if name == "." || name == "./" {
+		return false, nil
+	}
+	hdr.Name = name
+
+	if strings.HasPrefix(filepath.Base(name), whOpaquePrefix) {
+		return false, errors.Errorf("opaque whiteouts are not supported")
+	}
+	if strings.HasPrefix(filepath.Base(name), whPrefix) && hdr.Typeflag != tar.TypeReg {
+		return false, errors.Errorf("whiteout must be a regular file")
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		linkname, err := normaliseArchivePath(hdr.Linkname, false)
+		if err != nil {
+			return false, errors.Wrap(err, "hardlink target")
+		}
+		if linkname == "." {
+			return false, errors.Errorf("hardlink to root directory")
+		}
+		hdr.Linkname = linkname
+		hdr.Size = 0
+	case tar.TypeSymlink:
+		if hdr.Linkname == "" {
+			return false, errors.Errorf("symlink with empty target")
+		}
+		hdr.Size = 0
+	case tar.TypeReg:
+	default:
+		hdr.Size = 0
+	}
+
+	// Same as tarGenerator.setFormat.
+	hdr.Format = tar.FormatPAX
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	if !opt.SubsecondTimes {
+		hdr.ModTime = hdr.ModTime.Round(time.Second)
+	}
+	return true, nil
+}
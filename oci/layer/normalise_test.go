@@ -0,0 +1,159 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// makeArchive returns a tar archive containing the given headers. Regular
+// files contain hdr.Size bytes.
+func makeArchive(t *testing.T, headers []*tar.Header) []byte {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("unexpected error writing header: %s", err)
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			if _, err := tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size))); err != nil {
+				t.Fatalf("unexpected error writing contents: %s", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing archive: %s", err)
+	}
+	return buffer.Bytes()
+}
+
+// normalisedEntry is a summary of a normalised tar entry.
+type normalisedEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	mode     int64
+	size     int64
+}
+
+func readNormalised(t *testing.T, archive io.Reader, opt *MapOptions) ([]normalisedEntry, error) {
+	rc := NormaliseLayer(archive, opt)
+	defer rc.Close()
+
+	var entries []normalisedEntry
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) != hdr.Size {
+			t.Errorf("entry %s: header size %d doesn't match contents %d", hdr.Name, hdr.Size, len(data))
+		}
+		if !hdr.ModTime.Equal(hdr.ModTime.Round(time.Second)) {
+			t.Errorf("entry %s: mtime %s was not rounded", hdr.Name, hdr.ModTime)
+		}
+		entries = append(entries, normalisedEntry{
+			name:     hdr.Name,
+			typeflag: hdr.Typeflag,
+			linkname: hdr.Linkname,
+			mode:     hdr.Mode,
+			size:     hdr.Size,
+		})
+	}
+	return entries, nil
+}
+
+func TestNormaliseLayer(t *testing.T) {
+	mtime := time.Unix(1500000000, 123456789)
+	archive := makeArchive(t, []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "./etc", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "/etc/passwd", Typeflag: tar.TypeRegA, Mode: 0644, Size: 10, ModTime: mtime},
+		{Name: "etc/../etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: mtime},
+		{Name: "./bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/busybox", Mode: 0777, ModTime: mtime},
+		{Name: "bin/link", Typeflag: tar.TypeLink, Linkname: "./etc/passwd", ModTime: mtime},
+		{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg, ModTime: mtime},
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "git"}},
+	})
+
+	expected := []normalisedEntry{
+		{"etc/", tar.TypeDir, "", 0755, 0},
+		{"etc/passwd", tar.TypeReg, "", 0600, 10},
+		{"etc/hostname", tar.TypeReg, "", 0644, 5},
+		{"bin/sh", tar.TypeSymlink, "/bin/busybox", 0777, 0},
+		{"bin/link", tar.TypeLink, "etc/passwd", 0, 0},
+		{"etc/.wh.shadow", tar.TypeReg, "", 0, 0},
+	}
+
+	opt := &MapOptions{
+		ChmodRules: []ChmodRule{{Pattern: "/etc/passwd", Mode: 0600}},
+	}
+
+	// Both uncompressed and compressed archives are accepted.
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	gzw.Write(archive)
+	gzw.Close()
+
+	for _, input := range [][]byte{archive, compressed.Bytes()} {
+		entries, err := readNormalised(t, bytes.NewReader(input), opt)
+		if err != nil {
+			t.Fatalf("unexpected error normalising archive: %+v", err)
+		}
+		if !reflect.DeepEqual(entries, expected) {
+			t.Errorf("unexpected normalised entries:\n got %v\nwant %v", entries, expected)
+		}
+	}
+}
+
+func TestNormaliseLayerInvalid(t *testing.T) {
+	for _, hdr := range []*tar.Header{
+		{Name: "../../etc/passwd", Typeflag: tar.TypeLink, Linkname: "../../../../etc/shadow"},
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "/"},
+		{Name: "link", Typeflag: tar.TypeSymlink},
+		{Name: "dir/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "dir/.wh.file", Typeflag: tar.TypeDir},
+		{Name: "sparse", Typeflag: tar.TypeGNUSparse},
+		{Name: "cont", Typeflag: tar.TypeCont},
+	} {
+		archive := makeArchive(t, []*tar.Header{hdr})
+		if entries, err := readNormalised(t, bytes.NewReader(archive), nil); err == nil {
+			t.Errorf("expected error normalising %q (%q): got %v", hdr.Name, hdr.Typeflag, entries)
+		}
+	}
+
+	// Garbage isn't a tar archive.
+	if entries, err := readNormalised(t, bytes.NewReader(bytes.Repeat([]byte("garbage"), 100)), nil); err == nil {
+		t.Errorf("expected error normalising garbage: got %v", entries)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/cyphar/filepath-securejoin"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/third_party/user"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// OwnerNames maps between the user and group names defined by the
+// /etc/passwd and /etc/group files of an image and their IDs inside the
+// container. When set in MapOptions, the owner of each entry in a layer is
+// resolved by name (using the uname and gname fields of the tar header) rather
+// than by its numeric ID when extracting layers, and the names of the owner of
+// each entry are set when generating layers. This allows layers built on
+// systems with different numeric ID assignments to be composed. Entries whose
+// names are not known fall back to their numeric IDs.
+type OwnerNames struct {
+	users  map[string]int
+	groups map[string]int
+	uids   map[int]string
+	gids   map[int]string
+}
+
+// NewOwnerNames creates an OwnerNames from the contents of an /etc/passwd and
+// /etc/group file. Either reader may be nil, in which case no users (or
+// groups) are known. If a name or ID is listed more than once, the first
+// entry is used.
+func NewOwnerNames(passwd, group io.Reader) (*OwnerNames, error) {
+	names := &OwnerNames{
+		users:  map[string]int{},
+		groups: map[string]int{},
+		uids:   map[int]string{},
+		gids:   map[int]string{},
+	}
+	if passwd != nil {
+		users, err := user.ParsePasswd(passwd)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse passwd")
+		}
+		for _, u := range users {
+			if _, ok := names.users[u.Name]; !ok {
+				names.users[u.Name] = u.Uid
+			}
+			if _, ok := names.uids[u.Uid]; !ok {
+				names.uids[u.Uid] = u.Name
+			}
+		}
+	}
+	if group != nil {
+		groups, err := user.ParseGroup(group)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse group")
+		}
+		for _, g := range groups {
+			if _, ok := names.groups[g.Name]; !ok {
+				names.groups[g.Name] = g.Gid
+			}
+			if _, ok := names.gids[g.Gid]; !ok {
+				names.gids[g.Gid] = g.Name
+			}
+		}
+	}
+	return names, nil
+}
+
+// ImageOwnerNames creates an OwnerNames from the /etc/passwd and /etc/group
+// files in the root filesystem described by the layers of the given manifest
+// (see ReadImageFiles). Missing files are treated as being empty.
+func ImageOwnerNames(ctx context.Context, engine cas.Engine, manifest ispec.Manifest) (*OwnerNames, error) {
+	files, err := ReadImageFiles(ctx, engine, manifest, "/etc/passwd", "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	var readers [2]io.Reader
+	for idx, path := range []string{"/etc/passwd", "/etc/group"} {
+		if data, ok := files[path]; ok {
+			readers[idx] = bytes.NewReader(data)
+		}
+	}
+	return NewOwnerNames(readers[0], readers[1])
+}
+
+// RootfsOwnerNames creates an OwnerNames from the /etc/passwd and /etc/group
+// files in the given root filesystem. Missing files are treated as being
+// empty.
+func RootfsOwnerNames(rootfs string) (*OwnerNames, error) {
+	var readers [2]io.Reader
+	for idx, path := range []string{"/etc/passwd", "/etc/group"} {
+		fullPath, err := securejoin.SecureJoin(rootfs, path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve %s", path)
+		}
+		fh, err := os.Open(fullPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "open %s", path)
+		}
+		defer fh.Close()
+		readers[idx] = fh
+	}
+	return NewOwnerNames(readers[0], readers[1])
+}
+
+// resolveIDs sets the (container) owner of the header to the IDs of its
+// uname and gname, if they are known. It is a no-op if n is nil.
+func (n *OwnerNames) resolveIDs(hdr *tar.Header) {
+	if n == nil {
+		return
+	}
+	if uid, ok := n.users[hdr.Uname]; ok && hdr.Uname != "" {
+		hdr.Uid = uid
+	}
+	if gid, ok := n.groups[hdr.Gname]; ok && hdr.Gname != "" {
+		hdr.Gid = gid
+	}
+}
+
+// setNames sets the uname and gname of the header to the names of its
+// (container) owner, or clears them if they are not known. It is a no-op if
+// n is nil.
+func (n *OwnerNames) setNames(hdr *tar.Header) {
+	if n == nil {
+		return
+	}
+	hdr.Uname = n.uids[hdr.Uid]
+	hdr.Gname = n.gids[hdr.Gid]
+}
@@ -0,0 +1,169 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/pkg/memfs"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+const (
+	testPasswd = "root:x:0:0::/root:/bin/sh\nalice:x:1000:1000::/home/alice:/bin/sh\ntoor:x:0:0::/root:/bin/sh\n"
+	testGroup  = "root:x:0:\nusers:x:100:alice\n"
+)
+
+// makeOwnerLayer returns a layer archive containing the given files, where
+// data is the contents of regular files.
+func makeOwnerLayer(t *testing.T, files []tar.Header, data map[string]string) []byte {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	for _, hdr := range files {
+		hdr.Size = int64(len(data[hdr.Name]))
+		hdr.ModTime = time.Unix(1234567890, 0)
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unexpected error writing header %s: %s", hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(data[hdr.Name])); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestOwnerNames(t *testing.T) {
+	names, err := NewOwnerNames(strings.NewReader(testPasswd), strings.NewReader(testGroup))
+	if err != nil {
+		t.Fatalf("unexpected error parsing names: %+v", err)
+	}
+
+	for _, test := range []struct {
+		uname, gname         string
+		uid, gid             int
+		expectUID, expectGID int
+	}{
+		{"alice", "users", 0, 0, 1000, 100},
+		{"toor", "root", 1234, 1234, 0, 0},
+		{"bob", "", 1234, 1234, 1234, 1234},
+		{"", "users", 1234, 1234, 1234, 100},
+	} {
+		hdr := &tar.Header{Uname: test.uname, Gname: test.gname, Uid: test.uid, Gid: test.gid}
+		names.resolveIDs(hdr)
+		if hdr.Uid != test.expectUID || hdr.Gid != test.expectGID {
+			t.Errorf("resolveIDs(%s:%s): got %d:%d, expected %d:%d", test.uname, test.gname, hdr.Uid, hdr.Gid, test.expectUID, test.expectGID)
+		}
+	}
+
+	for _, test := range []struct {
+		uid, gid                 int
+		expectUname, expectGname string
+	}{
+		{0, 0, "root", "root"},
+		{1000, 100, "alice", "users"},
+		{1234, 1234, "", ""},
+	} {
+		hdr := &tar.Header{Uname: "host", Gname: "host", Uid: test.uid, Gid: test.gid}
+		names.setNames(hdr)
+		if hdr.Uname != test.expectUname || hdr.Gname != test.expectGname {
+			t.Errorf("setNames(%d:%d): got %q:%q, expected %q:%q", test.uid, test.gid, hdr.Uname, hdr.Gname, test.expectUname, test.expectGname)
+		}
+	}
+
+	// A nil OwnerNames does nothing.
+	hdr := &tar.Header{Uname: "alice", Uid: 1234}
+	(*OwnerNames)(nil).resolveIDs(hdr)
+	(*OwnerNames)(nil).setNames(hdr)
+	if hdr.Uid != 1234 || hdr.Uname != "alice" {
+		t.Errorf("nil OwnerNames modified header: %v", hdr)
+	}
+}
+
+func TestImageOwnerNames(t *testing.T) {
+	ctx := context.Background()
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{
+			putGzipBlob(t, engine, makeOwnerLayer(t, []tar.Header{
+				{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			}, map[string]string{"etc/passwd": testPasswd})),
+		},
+	}
+
+	names, err := ImageOwnerNames(ctx, engine, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error getting names: %+v", err)
+	}
+	if uid, ok := names.users["alice"]; !ok || uid != 1000 {
+		t.Errorf("user alice not resolved: %v", names.users)
+	}
+	// /etc/group doesn't exist in the image.
+	if len(names.groups) != 0 {
+		t.Errorf("unexpected groups: %v", names.groups)
+	}
+}
+
+func TestUnpackOwnerNames(t *testing.T) {
+	layer := makeOwnerLayer(t, []tar.Header{
+		{Name: "home/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "home/alice", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1500, Gid: 1500, Uname: "alice", Gname: "users"},
+		{Name: "home/bob", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1501, Gid: 1501, Uname: "bob", Gname: "bob"},
+	}, nil)
+
+	names, err := NewOwnerNames(strings.NewReader(testPasswd), strings.NewReader(testGroup))
+	if err != nil {
+		t.Fatalf("unexpected error parsing names: %+v", err)
+	}
+
+	fs := memfs.New()
+	if err := fs.MkdirAll("/rootfs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayerFS(fs, "/rootfs", bytes.NewReader(layer), &MapOptions{OwnerNames: names}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	for path, expected := range map[string][2]int{
+		// alice is resolved by name.
+		"/rootfs/home/alice": {1000, 100},
+		// bob is unknown, so the numeric ids are used.
+		"/rootfs/home/bob": {1501, 1501},
+	} {
+		fi, err := fs.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := fi.Sys().(*memfs.Stat)
+		if stat.Uid != expected[0] || stat.Gid != expected[1] {
+			t.Errorf("%s: got owner %d:%d, expected %d:%d", path, stat.Uid, stat.Gid, expected[0], expected[1])
+		}
+	}
+}
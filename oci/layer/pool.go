@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// copyBufferSize is the size of the buffers used by pooledCopy.
+const copyBufferSize = 128 << 10
+
+// copyBufferPool contains *[]byte buffers of copyBufferSize bytes.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+// pooledCopy is equivalent to io.Copy, except that the buffer is taken from
+// copyBufferPool rather than being allocated for each call (which adds up
+// when copying the contents of every file in a layer). io.ReaderFrom and
+// io.WriterTo are deliberately not used, since their fallbacks allocate a new
+// buffer and none of the readers and writers used here have a faster path.
+func pooledCopy(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buffer)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buffer)
+}
+
+// gzipReaderPool contains *gzip.Readers which are no longer in use.
+var gzipReaderPool sync.Pool
+
+// pooledGzipReader is a gzip reader which returns its *gzip.Reader to
+// gzipReaderPool when it is closed. Reading after Close returns an error.
+type pooledGzipReader struct {
+	gzr *gzip.Reader
+}
+
+// newPooledGzipReader returns a gzip reader for the given reader, re-using a
+// *gzip.Reader from gzipReaderPool if possible.
+func newPooledGzipReader(reader io.Reader) (*pooledGzipReader, error) {
+	if gzr, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		if err := gzr.Reset(reader); err != nil {
+			gzipReaderPool.Put(gzr)
+			return nil, err
+		}
+		return &pooledGzipReader{gzr: gzr}, nil
+	}
+	gzr, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledGzipReader{gzr: gzr}, nil
+}
+
+// Read implements io.Reader.
+func (r *pooledGzipReader) Read(p []byte) (int, error) {
+	if r.gzr == nil {
+		return 0, errors.Errorf("read from closed gzip reader")
+	}
+	return r.gzr.Read(p)
+}
+
+// Close implements io.Closer. It is safe to call Close more than once.
+func (r *pooledGzipReader) Close() error {
+	if r.gzr == nil {
+		return nil
+	}
+	err := r.gzr.Close()
+	gzipReaderPool.Put(r.gzr)
+	r.gzr = nil
+	return err
+}
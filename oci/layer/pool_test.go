@@ -0,0 +1,157 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func gzipBytes(t testing.TB, data []byte) []byte {
+	var buffer bytes.Buffer
+	gzw := gzip.NewWriter(&buffer)
+	if _, err := gzw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestPooledGzipReader(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		contents := []byte(fmt.Sprintf("contents %d", i))
+		gzr, err := newPooledGzipReader(bytes.NewReader(gzipBytes(t, contents)))
+		if err != nil {
+			t.Fatalf("newPooledGzipReader: unexpected error: %+v", err)
+		}
+		data, err := ioutil.ReadAll(gzr)
+		if err != nil {
+			t.Fatalf("read: unexpected error: %+v", err)
+		}
+		if !bytes.Equal(data, contents) {
+			t.Errorf("got %q, expected %q", data, contents)
+		}
+		// Closing twice must not put the reader in the pool twice.
+		if err := gzr.Close(); err != nil {
+			t.Errorf("close: unexpected error: %+v", err)
+		}
+		if err := gzr.Close(); err != nil {
+			t.Errorf("second close: unexpected error: %+v", err)
+		}
+		if _, err := gzr.Read(make([]byte, 1)); err == nil {
+			t.Errorf("expected read after close to fail")
+		}
+	}
+
+	if _, err := newPooledGzipReader(bytes.NewReader([]byte("not gzip"))); err == nil {
+		t.Errorf("expected invalid gzip stream to fail")
+	}
+}
+
+func TestPooledCopy(t *testing.T) {
+	contents := bytes.Repeat([]byte("umoci"), copyBufferSize)
+	var buffer bytes.Buffer
+	n, err := pooledCopy(&buffer, bytes.NewReader(contents))
+	if err != nil {
+		t.Fatalf("pooledCopy: unexpected error: %+v", err)
+	}
+	if n != int64(len(contents)) || !bytes.Equal(buffer.Bytes(), contents) {
+		t.Errorf("pooledCopy: copied %d bytes, expected %d", n, len(contents))
+	}
+}
+
+// makeManyFilesLayer returns a gzip-compressed layer containing the given
+// number of small files.
+func makeManyFilesLayer(b testing.TB, files int) []byte {
+	var hdrs []tar.Header
+	for i := 0; i < files; i++ {
+		hdrs = append(hdrs, tar.Header{
+			Name:     fmt.Sprintf("file-%d", i),
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+		})
+	}
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range hdrs {
+		hdr := hdr
+		hdr.Size = int64(len(hdr.Name))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(hdr.Name)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return gzipBytes(b, buffer.Bytes())
+}
+
+func BenchmarkDecompressLayer(b *testing.B) {
+	layer := makeManyFilesLayer(b, 1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(layer)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc, _, err := Decompress(bytes.NewReader(layer))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+			b.Fatal(err)
+		}
+		rc.Close()
+	}
+}
+
+func BenchmarkUnpackLayer(b *testing.B) {
+	layer := makeManyFilesLayer(b, 1000)
+	root, err := ioutil.TempDir("", "umoci-BenchmarkUnpackLayer")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc, _, err := Decompress(bytes.NewReader(layer))
+		if err != nil {
+			b.Fatal(err)
+		}
+		rootfs := filepath.Join(root, fmt.Sprintf("rootfs-%d", i))
+		if err := UnpackLayer(rootfs, rc, testMapOptions()); err != nil {
+			b.Fatal(err)
+		}
+		rc.Close()
+		b.StopTimer()
+		os.RemoveAll(rootfs)
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+const (
+	// PrefetchLandmark is the name of the landmark entry which separates the
+	// prioritised entries of a layer (which should be prefetched by lazy
+	// pulling implementations such as estargz) from the rest of the layer.
+	PrefetchLandmark = ".prefetch.landmark"
+
+	// NoPrefetchLandmark is the name of the landmark entry which is placed
+	// at the start of a layer which was generated with a prefetch profile,
+	// but contains none of the prioritised paths.
+	NoPrefetchLandmark = ".no.prefetch.landmark"
+)
+
+// landmarkContents is the contents of landmark entries (as used by estargz).
+var landmarkContents = []byte{0xf}
+
+// isPrefetchLandmark returns whether the given entry is a landmark entry
+// (which is not part of the root filesystem, and so must not be extracted).
+func isPrefetchLandmark(hdr *tar.Header) bool {
+	path := filepath.Join("/", CleanPath(hdr.Name))
+	if path != "/"+PrefetchLandmark && path != "/"+NoPrefetchLandmark {
+		return false
+	}
+	return (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) && hdr.Size == int64(len(landmarkContents))
+}
+
+// ReadPrefetchProfile reads a prefetch profile (for MapOptions.PrefetchProfile)
+// from r. Each line of the profile is a path in the root filesystem, in the
+// order the paths are accessed. Empty lines and lines starting with '#' are
+// ignored.
+func ReadPrefetchProfile(r io.Reader) ([]string, error) {
+	profile := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path := filepath.Join("/", CleanPath(line))
+		if path == "/" {
+			return nil, errors.Errorf("invalid prefetch profile entry: %q", line)
+		}
+		profile = append(profile, path)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read prefetch profile")
+	}
+	return profile, nil
+}
+
+// prioritiseDeltas splits deltas into the deltas of the paths in profile (in
+// the order of profile, with any of their parent directories in deltas placed
+// before them) and the rest of deltas (in their original order). Only new or
+// modified paths are prioritised.
+func prioritiseDeltas(deltas []mtree.InodeDelta, profile []string) (prioritised, rest []mtree.InodeDelta) {
+	byPath := map[string]int{}
+	for idx, delta := range deltas {
+		if delta.Type() == mtree.Modified || delta.Type() == mtree.Extra {
+			byPath[filepath.Join("/", CleanPath(delta.Path()))] = idx
+		}
+	}
+
+	used := make([]bool, len(deltas))
+	var add func(path string)
+	add = func(path string) {
+		idx, ok := byPath[path]
+		if !ok || used[idx] {
+			return
+		}
+		if parent := filepath.Dir(path); parent != path {
+			add(parent)
+		}
+		used[idx] = true
+		prioritised = append(prioritised, deltas[idx])
+	}
+	for _, path := range profile {
+		add(filepath.Join("/", CleanPath(path)))
+	}
+
+	for idx, delta := range deltas {
+		if !used[idx] {
+			rest = append(rest, delta)
+		}
+	}
+	return prioritised, rest
+}
+
+// AddLandmark adds a landmark entry with the given name to the tar archive.
+func (tg *tarGenerator) AddLandmark(name string) error {
+	if err := tg.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(landmarkContents)),
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return errors.Wrap(err, "write landmark header")
+	}
+	if _, err := io.Copy(tg.tw, bytes.NewReader(landmarkContents)); err != nil {
+		return errors.Wrap(err, "write landmark contents")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestReadPrefetchProfile(t *testing.T) {
+	profile, err := ReadPrefetchProfile(strings.NewReader("# comment\n/bin/sh\n\n  etc/passwd  \n/usr/../lib/libc.so\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expected := []string{"/bin/sh", "/etc/passwd", "/lib/libc.so"}
+	if !reflect.DeepEqual(profile, expected) {
+		t.Errorf("unexpected profile: expected %v, got %v", expected, profile)
+	}
+
+	if _, err := ReadPrefetchProfile(strings.NewReader("/\n")); err == nil {
+		t.Errorf("expected error with root directory in profile")
+	}
+}
+
+// generatePrefetchLayer generates a layer with all of the paths in dir, with
+// the given prefetch profile, and returns the names of the entries.
+func generatePrefetchLayer(t *testing.T, dir string, profile []string) ([]string, []byte) {
+	emptyDir, err := ioutil.TempDir("", "umoci-TestPrefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyDir)
+
+	keywords := append(mtree.DefaultKeywords, "sha256digest")
+	initDh, err := mtree.Walk(emptyDir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postDh, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, keywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &MapOptions{PrefetchProfile: profile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating layer: %+v", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names, data
+}
+
+func TestGeneratePrefetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGeneratePrefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The root directory is always in the layer (because its modification
+	// time is different).
+	for _, path := range []string{"a/x", "b/y", "c"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Prioritised paths come first (with their parent directories), followed
+	// by the landmark and the rest of the paths.
+	names, data := generatePrefetchLayer(t, dir, []string{"/c", "/b/y", "/nonexistent", "/c"})
+	expected := []string{".", "c", "b/", "b/y", PrefetchLandmark, "a/", "a/x"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected layer entries: expected %v, got %v", expected, names)
+	}
+
+	// Landmarks are not extracted.
+	root, err := ioutil.TempDir("", "umoci-TestGeneratePrefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := UnpackLayer(root, bytes.NewReader(data), &MapOptions{Rootless: os.Geteuid() != 0}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, PrefetchLandmark)); !os.IsNotExist(err) {
+		t.Errorf("landmark was extracted: %v", err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(root, "b", "y")); err != nil || string(contents) != "b/y" {
+		t.Errorf("unexpected contents of b/y: %q (%v)", contents, err)
+	}
+
+	// Without any prioritised paths, the layer starts with a different
+	// landmark.
+	names, _ = generatePrefetchLayer(t, dir, []string{"/nonexistent"})
+	expected = []string{NoPrefetchLandmark, ".", "a/", "a/x", "b/", "b/y", "c"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected layer entries: expected %v, got %v", expected, names)
+	}
+
+	// Without a profile, there are no landmarks.
+	names, _ = generatePrefetchLayer(t, dir, nil)
+	expected = []string{".", "a/", "a/x", "b/", "b/y", "c"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected layer entries: expected %v, got %v", expected, names)
+	}
+}
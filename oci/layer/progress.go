@@ -0,0 +1,144 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// progressSuffix is appended to the rootfs path to get the path of the file
+// used to record unpack progress.
+const progressSuffix = ".umoci-progress"
+
+// ProgressPath returns the path of the file used by UnpackRootfs to record
+// which layers have been applied to the given rootfs. It is placed next to
+// (rather than inside) the rootfs so that it does not end up in the rootfs
+// itself.
+func ProgressPath(rootfsPath string) string {
+	return filepath.Clean(rootfsPath) + progressSuffix
+}
+
+// unpackProgress is the on-disk record of how far an unpack has progressed.
+type unpackProgress struct {
+	// Config is the digest of the configuration of the manifest being
+	// unpacked, used to make sure we are resuming the same image.
+	Config digest.Digest `json:"config"`
+
+	// Layers is the list of layer digests (in manifest order) which have been
+	// completely applied to the rootfs.
+	Layers []digest.Digest `json:"layers"`
+
+	// MapOptions are the options the layers are being applied with (only the
+	// options which are saved in the bundle metadata are recorded), since
+	// resuming with different options would produce a rootfs which matches
+	// neither set of options.
+	MapOptions *MapOptions `json:"map_options"`
+}
+
+// newProgress returns the progress of an unpack of the given manifest with the
+// given options, which hasn't applied any layers yet.
+func newProgress(manifest ispec.Manifest, opt MapOptions) unpackProgress {
+	return unpackProgress{
+		Config:     manifest.Config.Digest,
+		MapOptions: &opt,
+	}
+}
+
+// readProgress reads the recorded unpack progress for the given rootfs.
+func readProgress(rootfsPath string) (unpackProgress, error) {
+	var progress unpackProgress
+
+	data, err := ioutil.ReadFile(ProgressPath(rootfsPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errors.Errorf("no unpack progress recorded for %s", rootfsPath)
+		}
+		return progress, err
+	}
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return progress, errors.Wrap(err, "parse progress")
+	}
+	return progress, nil
+}
+
+// check verifies that the recorded progress refers to the given manifest, and
+// was recorded with the same options.
+func (p unpackProgress) check(manifest ispec.Manifest, opt MapOptions) error {
+	if p.MapOptions == nil {
+		return errors.Errorf("progress does not record the options the rootfs was unpacked with")
+	}
+	recorded, err := json.Marshal(p.MapOptions)
+	if err != nil {
+		return errors.Wrap(err, "marshal recorded map options")
+	}
+	current, err := json.Marshal(opt)
+	if err != nil {
+		return errors.Wrap(err, "marshal map options")
+	}
+	if !bytes.Equal(recorded, current) {
+		return errors.Errorf("progress recorded with different options: %s != %s", recorded, current)
+	}
+	if p.Config != manifest.Config.Digest {
+		return errors.Errorf("progress recorded for a different image: config %s != %s", p.Config, manifest.Config.Digest)
+	}
+	if len(p.Layers) > len(manifest.Layers) {
+		return errors.Errorf("progress records more layers than manifest contains: %d > %d", len(p.Layers), len(manifest.Layers))
+	}
+	for idx, layer := range p.Layers {
+		if layer != manifest.Layers[idx].Digest {
+			return errors.Errorf("progress recorded for a different image: layer %d: %s != %s", idx, layer, manifest.Layers[idx].Digest)
+		}
+	}
+	return nil
+}
+
+// write atomically replaces the recorded unpack progress for the given rootfs.
+func (p unpackProgress) write(rootfsPath string) error {
+	path := ProgressPath(rootfsPath)
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "marshal progress")
+	}
+
+	fh, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return errors.Wrap(err, "create temporary progress file")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err := fh.Write(data); err != nil {
+		return errors.Wrap(err, "write progress")
+	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync progress")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close progress")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), path), "rename progress")
+}
@@ -0,0 +1,323 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+)
+
+// putTestLayer stores a gzip-compressed layer containing a single file (with
+// the given name) in the engine, returning its descriptor and DiffID.
+func putTestLayer(t *testing.T, engine cas.Engine, name string) (ispec.Descriptor, digest.Digest) {
+	raw := new(bytes.Buffer)
+	tw := tar.NewWriter(raw)
+	data := []byte("contents of " + name)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatalf("unexpected error writing header: %s", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatalf("unexpected error writing data: %s", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing tar writer: %s", err)
+	}
+	diffID := digest.SHA256.FromBytes(raw.Bytes())
+
+	compressed := new(bytes.Buffer)
+	gzw := gzip.NewWriter(compressed)
+	if _, err := gzw.Write(raw.Bytes()); err != nil {
+		t.Fatalf("unexpected error compressing layer: %s", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("unexpected error closing gzip writer: %s", err)
+	}
+
+	layerDigest, layerSize, err := engine.PutBlob(context.Background(), compressed)
+	if err != nil {
+		t.Fatalf("unexpected error putting layer: %s", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}, diffID
+}
+
+// putTestManifest stores a manifest (and configuration) in the engine with
+// one layer for each of the given file names.
+func putTestManifest(t *testing.T, engine cas.Engine, names []string) ispec.Manifest {
+	engineExt := casext.NewEngine(engine)
+
+	var manifest ispec.Manifest
+	var config ispec.Image
+	config.OS = "linux"
+	config.RootFS.Type = "layers"
+	for _, name := range names {
+		descriptor, diffID := putTestLayer(t, engine, name)
+		manifest.Layers = append(manifest.Layers, descriptor)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %s", err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+	return manifest
+}
+
+// testMapOptions returns the MapOptions to use when unpacking as the current
+// user.
+func testMapOptions() *MapOptions {
+	return &MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    os.Geteuid() != 0,
+	}
+}
+
+func TestResumeUnpackRootfs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestResumeUnpackRootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := putTestManifest(t, engine, []string{"a", "b", "c"})
+	opt := testMapOptions()
+
+	// Resuming without any progress must fail.
+	rootfs := filepath.Join(root, "rootfs")
+	if err := ResumeUnpackRootfs(ctx, engine, rootfs, manifest, opt); err == nil {
+		t.Errorf("expected resume without progress to fail")
+	}
+
+	// Fake an interrupted unpack, where only the first layer was applied. We
+	// deliberately don't extract the first layer, so we can tell whether it
+	// was skipped.
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	progress := newProgress(manifest, *opt)
+	progress.Layers = []digest.Digest{manifest.Layers[0].Digest}
+	if err := progress.write(rootfs); err != nil {
+		t.Fatalf("unexpected error writing progress: %s", err)
+	}
+
+	// A normal unpack must not touch the existing rootfs.
+	if err := UnpackRootfs(ctx, engine, rootfs, manifest, opt); err == nil {
+		t.Errorf("expected unpack over existing rootfs to fail")
+	}
+
+	// Progress for a different manifest must be rejected.
+	otherManifest := manifest
+	otherManifest.Layers = []ispec.Descriptor{manifest.Layers[1], manifest.Layers[0], manifest.Layers[2]}
+	if err := ResumeUnpackRootfs(ctx, engine, rootfs, otherManifest, opt); err == nil {
+		t.Errorf("expected resume with mismatched layers to fail")
+	}
+
+	// Progress recorded with different options must be rejected.
+	otherOpt := *opt
+	otherOpt.ConflictPolicy = ConflictWarn
+	if err := ResumeUnpackRootfs(ctx, engine, rootfs, manifest, &otherOpt); err == nil {
+		t.Errorf("expected resume with different options to fail")
+	}
+
+	if err := ResumeUnpackRootfs(ctx, engine, rootfs, manifest, opt); err != nil {
+		t.Fatalf("unexpected error resuming unpack: %s", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		exists bool
+	}{
+		{"a", false},
+		{"b", true},
+		{"c", true},
+	} {
+		_, err := os.Lstat(filepath.Join(rootfs, test.name))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("%s: expected exists=%v, got err=%v", test.name, test.exists, err)
+		}
+	}
+
+	if _, err := os.Lstat(ProgressPath(rootfs)); !os.IsNotExist(err) {
+		t.Errorf("expected progress file to be removed after unpack: %v", err)
+	}
+	if err := ResumeUnpackRootfs(ctx, engine, rootfs, manifest, opt); err == nil {
+		t.Errorf("expected resume of completed unpack to fail")
+	}
+}
+
+func TestUnpackRootfsSkipLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsSkipLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := putTestManifest(t, engine, []string{"a", "b", "c"})
+	opt := testMapOptions()
+
+	for _, skip := range []int{-1, 4} {
+		if err := UnpackRootfsSkipLayers(ctx, engine, filepath.Join(root, "invalid"), manifest, skip, opt); err == nil {
+			t.Errorf("expected error skipping %d layers", skip)
+		}
+	}
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := UnpackRootfsSkipLayers(ctx, engine, rootfs, manifest, 2, opt); err != nil {
+		t.Fatalf("unexpected error unpacking: %s", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		exists bool
+	}{
+		{"a", false},
+		{"b", false},
+		{"c", true},
+	} {
+		_, err := os.Lstat(filepath.Join(rootfs, test.name))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("%s: expected exists=%v, got err=%v", test.name, test.exists, err)
+		}
+	}
+	if _, err := os.Lstat(ProgressPath(rootfs)); !os.IsNotExist(err) {
+		t.Errorf("expected progress file to be removed after unpack: %v", err)
+	}
+}
+
+func TestUnpackRootfsLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := putTestManifest(t, engine, []string{"a", "b", "c", "d"})
+	opt := testMapOptions()
+
+	for _, test := range [][2]int{{-1, 2}, {0, 5}, {3, 2}} {
+		if err := UnpackRootfsLayers(ctx, engine, filepath.Join(root, "invalid"), manifest, test[0], test[1], opt); err == nil {
+			t.Errorf("expected error unpacking layers [%d, %d)", test[0], test[1])
+		}
+	}
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := UnpackRootfsLayers(ctx, engine, rootfs, manifest, 1, 3, opt); err != nil {
+		t.Fatalf("unexpected error unpacking: %s", err)
+	}
+	for _, test := range []struct {
+		name   string
+		exists bool
+	}{
+		{"a", false},
+		{"b", true},
+		{"c", true},
+		{"d", false},
+	} {
+		_, err := os.Lstat(filepath.Join(rootfs, test.name))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("%s: expected exists=%v, got err=%v", test.name, test.exists, err)
+		}
+	}
+	if len(manifest.Layers) != 4 {
+		t.Errorf("manifest was modified: %d layers", len(manifest.Layers))
+	}
+
+	// The same range can be unpacked as a bundle.
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifestLayers(ctx, engine, bundle, manifest, 0, 1, opt); err != nil {
+		t.Fatalf("unexpected error unpacking bundle: %s", err)
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, "config.json")); err != nil {
+		t.Errorf("expected config.json in bundle: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, RootfsName, "b")); !os.IsNotExist(err) {
+		t.Errorf("expected b to not be unpacked: %v", err)
+	}
+}
+
+func TestProgressCheck(t *testing.T) {
+	var manifest ispec.Manifest
+	manifest.Config.Digest = digest.SHA256.FromString("config")
+	for idx := 0; idx < 3; idx++ {
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{Digest: digest.SHA256.FromString(fmt.Sprintf("layer%d", idx))})
+	}
+
+	opt := *testMapOptions()
+	otherOpt := opt
+	otherOpt.Rootless = !opt.Rootless
+	// Options which aren't saved in the bundle metadata don't matter.
+	ignoredOpt := opt
+	ignoredOpt.SkipSpaceCheck = true
+
+	for _, test := range []struct {
+		progress unpackProgress
+		valid    bool
+	}{
+		{unpackProgress{Config: manifest.Config.Digest, MapOptions: &opt}, true},
+		{unpackProgress{Config: manifest.Config.Digest, MapOptions: &ignoredOpt}, true},
+		{unpackProgress{Config: manifest.Config.Digest, MapOptions: &opt, Layers: []digest.Digest{manifest.Layers[0].Digest}}, true},
+		{unpackProgress{Config: manifest.Config.Digest, MapOptions: &opt, Layers: []digest.Digest{manifest.Layers[0].Digest, manifest.Layers[1].Digest, manifest.Layers[2].Digest}}, true},
+		{unpackProgress{Config: manifest.Config.Digest}, false},
+		{unpackProgress{Config: manifest.Config.Digest, MapOptions: &otherOpt}, false},
+		{unpackProgress{Config: digest.SHA256.FromString("other"), MapOptions: &opt}, false},
+		{unpackProgress{Config: manifest.Config.Digest, MapOptions: &opt, Layers: []digest.Digest{manifest.Layers[1].Digest}}, false},
+		{unpackProgress{Config: manifest.Config.Digest, MapOptions: &opt, Layers: []digest.Digest{manifest.Layers[0].Digest, manifest.Layers[1].Digest, manifest.Layers[2].Digest, manifest.Layers[0].Digest}}, false},
+	} {
+		err := test.progress.check(manifest, opt)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("progress %v: expected valid=%v, got err=%v", test.progress, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxReadFileLinks is the maximum number of symlinks followed by
+// ReadImageFile.
+const maxReadFileLinks = 255
+
+// imageEntry is the final state of a path in the layers of an image (see
+// scanImage).
+type imageEntry struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+// scanImage scans the layers of the given manifest and returns the entries
+// for every path (which are absolute and clean) in the resulting root
+// filesystem. The contents of regular files are only kept for the paths in
+// wanted, so that the whole root filesystem isn't kept in memory.
+func scanImage(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, wanted map[string]bool) (map[string]*imageEntry, error) {
+	entries := map[string]*imageEntry{}
+
+	// removeTree removes path and everything underneath it.
+	removeTree := func(path string) {
+		delete(entries, path)
+		for name := range entries {
+			if strings.HasPrefix(name, path+"/") {
+				delete(entries, name)
+			}
+		}
+	}
+
+	for _, descriptor := range manifest.Layers {
+		reader, err := openLayer(ctx, engine, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		err = func() error {
+			defer reader.Close()
+			tr := tar.NewReader(reader)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return errors.Wrap(err, "read next entry")
+				}
+
+				name := filepath.Join("/", CleanPath(hdr.Name))
+				dir, file := filepath.Split(name)
+				switch {
+				case strings.HasPrefix(file, whOpaquePrefix):
+					for path := range entries {
+						if strings.HasPrefix(path, dir) {
+							delete(entries, path)
+						}
+					}
+				case strings.HasPrefix(file, whPrefix):
+					removeTree(filepath.Join(dir, strings.TrimPrefix(file, whPrefix)))
+				default:
+					// A non-directory replaces everything underneath it.
+					if hdr.Typeflag != tar.TypeDir {
+						removeTree(name)
+					}
+					entry := &imageEntry{hdr: hdr}
+					if wanted[name] && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) {
+						data, err := ioutil.ReadAll(tr)
+						if err != nil {
+							return errors.Wrapf(err, "read %s", name)
+						}
+						entry.data = data
+					}
+					entries[name] = entry
+				}
+			}
+		}()
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s", descriptor.Digest)
+		}
+	}
+	return entries, nil
+}
+
+// resolveImagePath follows the symlinks (and hardlinks) at path using the
+// given entries, and returns the path and entry of the regular file it refers
+// to. Symlinks in the parent directories of path are not followed. If the
+// path doesn't exist, the returned error satisfies
+// os.IsNotExist(errors.Cause(err)).
+func resolveImagePath(entries map[string]*imageEntry, path string) (string, *imageEntry, error) {
+	for i := 0; i < maxReadFileLinks; i++ {
+		entry, ok := entries[path]
+		if !ok {
+			return "", nil, errors.Wrapf(os.ErrNotExist, "read image file %s", path)
+		}
+		switch entry.hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			return path, entry, nil
+		case tar.TypeSymlink:
+			target := entry.hdr.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			path = filepath.Join("/", CleanPath(target))
+		case tar.TypeLink:
+			path = filepath.Join("/", CleanPath(entry.hdr.Linkname))
+		default:
+			return "", nil, errors.Errorf("read image file %s: not a regular file", path)
+		}
+	}
+	return "", nil, errors.Errorf("read image file %s: too many levels of symbolic links", path)
+}
+
+// ReadImageFiles returns the contents of the regular files at the given paths
+// in the root filesystem described by the layers of the given manifest,
+// without extracting them. The returned map is keyed by the paths as they
+// were given, and paths which don't exist are not included. If a path is a
+// symlink (or hardlink) it is resolved within the root filesystem, but
+// symlinks in the parent directories of the path are not followed.
+//
+// The layers are only read once for all of the paths, unless one of them is a
+// link to a file with contents, which requires the layers to be read a second
+// time (regardless of how many paths or links there are).
+func ReadImageFiles(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, paths ...string) (map[string][]byte, error) {
+	wanted := map[string]bool{}
+	for _, path := range paths {
+		wanted[filepath.Join("/", CleanPath(path))] = true
+	}
+	entries, err := scanImage(ctx, engine, manifest, wanted)
+	if err != nil {
+		return nil, errors.Wrap(err, "read image files")
+	}
+
+	// Figure out which files the paths refer to, and whether we need to
+	// read the contents of any link targets.
+	resolved := map[string]string{}
+	targets := map[string]bool{}
+	for _, path := range paths {
+		target, entry, err := resolveImagePath(entries, filepath.Join("/", CleanPath(path)))
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		resolved[path] = target
+		if entry.data == nil && entry.hdr.Size > 0 {
+			targets[target] = true
+		}
+	}
+	if len(targets) > 0 {
+		for path := range wanted {
+			targets[path] = true
+		}
+		entries, err = scanImage(ctx, engine, manifest, targets)
+		if err != nil {
+			return nil, errors.Wrap(err, "read image files")
+		}
+	}
+
+	files := map[string][]byte{}
+	for path, target := range resolved {
+		data := entries[target].data
+		if data == nil {
+			data = []byte{}
+		}
+		files[path] = data
+	}
+	return files, nil
+}
+
+// ReadImageFile returns the contents of the regular file at path in the root
+// filesystem described by the layers of the given manifest (see
+// ReadImageFiles). If path doesn't exist, the returned error satisfies
+// os.IsNotExist(errors.Cause(err)).
+func ReadImageFile(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, path string) ([]byte, error) {
+	files, err := ReadImageFiles(ctx, engine, manifest, path)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := files[path]
+	if !ok {
+		return nil, errors.Wrapf(os.ErrNotExist, "read image file %s", path)
+	}
+	return data, nil
+}
@@ -0,0 +1,158 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// testReadFileManifest creates the layers used by the ReadImageFile tests.
+// The contents of regular files (from makeTarLayer) are their names.
+func testReadFileManifest(t *testing.T, engine cas.Engine) ispec.Manifest {
+	return ispec.Manifest{
+		Layers: []ispec.Descriptor{
+			putGzipBlob(t, engine, makeTarLayer(t, []tar.Header{
+				{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "etc/group", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600},
+				{Name: "opt/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "opt/file", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "var/file", Typeflag: tar.TypeReg, Mode: 0644},
+			}).Bytes()),
+			putGzipBlob(t, engine, makeTarLayer(t, []tar.Header{
+				{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg},
+				{Name: "etc/group", Typeflag: tar.TypeSymlink, Linkname: "../usr/group"},
+				{Name: "etc/hostname", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+				{Name: "etc/loop", Typeflag: tar.TypeSymlink, Linkname: "/etc/loop"},
+				{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "usr/group", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "opt", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "var/.wh..wh..opq", Typeflag: tar.TypeReg},
+			}).Bytes()),
+		},
+	}
+}
+
+func TestReadImageFile(t *testing.T) {
+	ctx := context.Background()
+
+	engine := mem.New()
+	defer engine.Close()
+	manifest := testReadFileManifest(t, engine)
+
+	for _, test := range []struct {
+		path, contents string
+	}{
+		{"/etc/passwd", "etc/passwd"},
+		{"etc/../etc/passwd", "etc/passwd"},
+		{"/etc/group", "usr/group"},
+		{"/etc/hostname", "etc/passwd"},
+		{"/opt", "opt"},
+	} {
+		data, err := ReadImageFile(ctx, engine, manifest, test.path)
+		if err != nil {
+			t.Errorf("ReadImageFile(%s): unexpected error: %+v", test.path, err)
+			continue
+		}
+		if string(data) != test.contents {
+			t.Errorf("ReadImageFile(%s): expected %q got %q", test.path, test.contents, data)
+		}
+	}
+
+	for _, path := range []string{"/etc/shadow", "/opt/file", "/var/file", "/nonexistent"} {
+		if _, err := ReadImageFile(ctx, engine, manifest, path); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("ReadImageFile(%s): expected not exist error, got %+v", path, err)
+		}
+	}
+	for _, path := range []string{"/etc", "/etc/loop"} {
+		if _, err := ReadImageFile(ctx, engine, manifest, path); err == nil || os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("ReadImageFile(%s): expected error, got %+v", path, err)
+		}
+	}
+}
+
+// countingEngine is a cas.Engine which counts the number of blobs read.
+type countingEngine struct {
+	cas.Engine
+	gets int
+}
+
+func (e *countingEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	e.gets++
+	return e.Engine.GetBlob(ctx, blobDigest)
+}
+
+func TestReadImageFiles(t *testing.T) {
+	ctx := context.Background()
+
+	engine := &countingEngine{Engine: mem.New()}
+	defer engine.Close()
+	manifest := testReadFileManifest(t, engine)
+
+	// Regular files are read in a single pass over the layers.
+	engine.gets = 0
+	files, err := ReadImageFiles(ctx, engine, manifest, "/etc/passwd", "/opt", "/etc/shadow")
+	if err != nil {
+		t.Fatalf("ReadImageFiles: unexpected error: %+v", err)
+	}
+	expected := map[string][]byte{
+		"/etc/passwd": []byte("etc/passwd"),
+		"/opt":        []byte("opt"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("ReadImageFiles: expected %q got %q", expected, files)
+	}
+	if engine.gets != len(manifest.Layers) {
+		t.Errorf("ReadImageFiles: expected layers to be read once: read %d blobs", engine.gets)
+	}
+
+	// Links need at most a second pass, no matter how many there are.
+	engine.gets = 0
+	files, err = ReadImageFiles(ctx, engine, manifest, "/etc/passwd", "/etc/group", "/etc/hostname")
+	if err != nil {
+		t.Fatalf("ReadImageFiles: unexpected error: %+v", err)
+	}
+	expected = map[string][]byte{
+		"/etc/passwd":   []byte("etc/passwd"),
+		"/etc/group":    []byte("usr/group"),
+		"/etc/hostname": []byte("etc/passwd"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("ReadImageFiles: expected %q got %q", expected, files)
+	}
+	if engine.gets != 2*len(manifest.Layers) {
+		t.Errorf("ReadImageFiles: expected layers to be read twice: read %d blobs", engine.gets)
+	}
+
+	if _, err := ReadImageFiles(ctx, engine, manifest, "/etc/passwd", "/etc/loop"); err == nil {
+		t.Errorf("ReadImageFiles: expected error for symlink loop")
+	}
+}
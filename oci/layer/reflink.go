@@ -0,0 +1,194 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// reflinkThreshold is the size below which regular files are not considered
+// for reflinking by MapOptions.ReflinkDuplicates, since reflinks share whole
+// filesystem blocks and small files would only add hashing overhead.
+const reflinkThreshold = 4 << 10
+
+// errReflinkUnsupported is returned by reflinker.Reflink if the files cannot
+// be reflinked (because the filesystem doesn't support reflinks).
+var errReflinkUnsupported = errors.New("reflinks not supported")
+
+// reflinker is an optional interface implemented by Filesystems which can
+// make regular files share their contents.
+type reflinker interface {
+	// Reflink replaces the contents of the regular file dst with the
+	// contents of the regular file src, sharing the underlying storage
+	// rather than copying it. Nothing other than the contents of dst is
+	// modified.
+	Reflink(dst, src string) error
+}
+
+// Reflink uses the FICLONE ioctl(2), which is only supported for the default
+// FsEval (the rootless and portable FsEvals may not be able to open the files
+// without modifying their permissions).
+func (fs fsEvalFilesystem) Reflink(dst, src string) error {
+	if fs.FsEval != fseval.DefaultFsEval {
+		return errReflinkUnsupported
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer in.Close()
+
+	// We must not truncate dst, since its contents have to be left alone if
+	// the filesystem doesn't support reflinks.
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "open destination")
+	}
+	defer out.Close()
+
+	if err := system.Clonefile(out.Fd(), in.Fd()); err != nil {
+		if system.IsCloneUnsupported(err) {
+			return errReflinkUnsupported
+		}
+		return errors.Wrap(err, "reflink")
+	}
+	return errors.Wrap(out.Close(), "close destination")
+}
+
+// fileKey uniquely identifies an inode on the host.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// reflinkSource is a previously extracted regular file whose contents can be
+// shared with duplicate files.
+type reflinkSource struct {
+	path string
+	key  fileKey
+}
+
+// reflinkIndex tracks the digests of the regular files extracted from one or
+// more layers (for MapOptions.ReflinkDuplicates), so that files with the same
+// contents as a previously extracted file can be reflinked to it.
+type reflinkIndex struct {
+	// sources maps the digest of the contents of a file to the first file
+	// extracted with those contents.
+	sources map[digest.Digest]reflinkSource
+
+	// digests is the reverse of sources, so that a source can be forgotten
+	// when its inode is modified.
+	digests map[fileKey]digest.Digest
+
+	// disabled is set once the Filesystem has been found not to support
+	// reflinks, so that we stop hashing files.
+	disabled bool
+
+	// reflinked is the number of files reflinked, and saved is the total size
+	// of their contents.
+	reflinked int
+	saved     int64
+}
+
+// newReflinkIndex creates a new, empty reflinkIndex.
+func newReflinkIndex() *reflinkIndex {
+	return &reflinkIndex{
+		sources: map[digest.Digest]reflinkSource{},
+		digests: map[fileKey]digest.Digest{},
+	}
+}
+
+// wants returns whether the contents of a regular file of the given size
+// being extracted to the Filesystem should be hashed so that it can be
+// passed to reflink.
+func (idx *reflinkIndex) wants(fs Filesystem, size int64) bool {
+	if idx == nil || idx.disabled || size < reflinkThreshold {
+		return false
+	}
+	_, ok := fs.(reflinker)
+	return ok
+}
+
+// forget removes the given file from the index, because the contents of its
+// inode are about to be modified.
+func (idx *reflinkIndex) forget(fi os.FileInfo) {
+	if idx == nil {
+		return
+	}
+	key, ok := getFileKey(fi)
+	if !ok {
+		return
+	}
+	if dgst, ok := idx.digests[key]; ok {
+		delete(idx.digests, key)
+		delete(idx.sources, dgst)
+	}
+}
+
+// reflink is called after a regular file of the given size has been
+// extracted to path, with its contents having the given digest. If a file
+// with the same contents was previously extracted (and is unchanged), the
+// contents of path are replaced with a reflink to that file. Otherwise the
+// file is recorded as the source for any later duplicates.
+func (idx *reflinkIndex) reflink(fs Filesystem, path string, dgst digest.Digest, size int64) error {
+	fi, err := fs.Lstat(path)
+	if err != nil {
+		return errors.Wrap(err, "lstat extracted file")
+	}
+	key, ok := getFileKey(fi)
+	if !ok {
+		return nil
+	}
+	// Anything recorded for this inode is stale (it may have been a removed
+	// file whose inode number has been reused).
+	idx.forget(fi)
+
+	if src, ok := idx.sources[dgst]; ok {
+		// Make sure the source is still the file we extracted, since it may
+		// have been removed or replaced by a later entry.
+		srcFi, err := fs.Lstat(src.path)
+		if err == nil && srcFi.Mode().IsRegular() && srcFi.Size() == size {
+			if srcKey, ok := getFileKey(srcFi); ok && srcKey == src.key && srcKey != key {
+				err := fs.(reflinker).Reflink(path, src.path)
+				if err == errReflinkUnsupported {
+					log.Infof("filesystem does not support reflinks, duplicate files will be extracted normally")
+					idx.disabled = true
+					return nil
+				}
+				if err != nil {
+					return errors.Wrapf(err, "reflink to %s", src.path)
+				}
+				log.Debugf("reflinked %s to duplicate file %s", path, src.path)
+				idx.reflinked++
+				idx.saved += size
+				return nil
+			}
+		}
+		// The source is stale, so use this file from now on.
+		delete(idx.digests, src.key)
+	}
+	idx.sources[dgst] = reflinkSource{path: path, key: key}
+	idx.digests[key] = dgst
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// copyReflinker is a Filesystem which implements reflinker by copying the
+// contents of files (so that it works on any filesystem), recording the
+// files it was asked to reflink.
+type copyReflinker struct {
+	Filesystem
+	reflinks [][2]string
+}
+
+func (fs *copyReflinker) Reflink(dst, src string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	fs.reflinks = append(fs.reflinks, [2]string{filepath.Base(dst), filepath.Base(src)})
+	return ioutil.WriteFile(dst, data, 0)
+}
+
+func TestUnpackReflinkDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackReflinkDuplicates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contentsA := strings.Repeat("a", reflinkThreshold)
+	contentsB := strings.Repeat("b", reflinkThreshold)
+	small := "small"
+
+	layers := [][]byte{
+		makeOwnerLayer(t, []tar.Header{
+			{Name: "a1", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "b1", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "a2", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "small1", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "small2", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "link", Typeflag: tar.TypeLink, Linkname: "b1"},
+		}, map[string]string{
+			"a1":     contentsA,
+			"b1":     contentsB,
+			"a2":     contentsA,
+			"small1": small,
+			"small2": small,
+		}),
+		makeOwnerLayer(t, []tar.Header{
+			// Duplicates in later layers are also reflinked.
+			{Name: "a3", Typeflag: tar.TypeReg, Mode: 0644},
+			// Modifying b1 through its hardlink means it can no longer be
+			// used as a source.
+			{Name: "link", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "b2", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "b3", Typeflag: tar.TypeReg, Mode: 0644},
+			// Replaced sources cannot be used either, so a4 becomes the
+			// source for any later duplicates.
+			{Name: "a1", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "a4", Typeflag: tar.TypeReg, Mode: 0644},
+		}, map[string]string{
+			"a3":   contentsA,
+			"link": "modified",
+			"b2":   contentsB,
+			"b3":   contentsB,
+			"a1":   "replaced",
+			"a4":   contentsA,
+		}),
+	}
+
+	fs := &copyReflinker{Filesystem: OSFilesystem(MapOptions{})}
+	opt := &MapOptions{ReflinkDuplicates: true}
+	reflinks := newReflinkIndex()
+	for _, layer := range layers {
+		if err := unpackLayerFS(context.Background(), fs, dir, bytes.NewReader(layer), opt, nil, nil, reflinks); err != nil {
+			t.Fatalf("unexpected error unpacking layer: %+v", err)
+		}
+	}
+
+	expected := [][2]string{
+		{"a2", "a1"},
+		{"a3", "a1"},
+		{"b3", "b2"},
+	}
+	if !reflect.DeepEqual(fs.reflinks, expected) {
+		t.Errorf("unexpected reflinks: got %v, expected %v", fs.reflinks, expected)
+	}
+	if reflinks.reflinked != len(expected) || reflinks.saved != int64(len(expected)*reflinkThreshold) {
+		t.Errorf("unexpected reflink stats: %d files, %d bytes", reflinks.reflinked, reflinks.saved)
+	}
+
+	for name, contents := range map[string]string{
+		"a1":   "replaced",
+		"a2":   contentsA,
+		"a3":   contentsA,
+		"a4":   contentsA,
+		"b1":   "modified",
+		"b2":   contentsB,
+		"b3":   contentsB,
+		"link": "modified",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("%s has unexpected contents", name)
+		}
+	}
+}
+
+func TestUnpackReflinkUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackReflinkUnsupported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := strings.Repeat("a", reflinkThreshold)
+	layer := makeOwnerLayer(t, []tar.Header{
+		{Name: "a1", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "a2", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "a3", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"a1": contents, "a2": contents, "a3": contents})
+
+	// The rootless FsEval never supports reflinks, so the files must be
+	// extracted normally.
+	opt := &MapOptions{Rootless: true, ReflinkDuplicates: true}
+	te := newTarExtractor(*opt)
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if err := te.unpackEntry(dir, hdr, tr); err != nil {
+			t.Fatalf("unexpected error unpacking %s: %+v", hdr.Name, err)
+		}
+	}
+	if !te.reflinks.disabled || te.reflinks.reflinked != 0 {
+		t.Errorf("reflinks should have been disabled")
+	}
+	for _, name := range []string{"a1", "a2", "a3"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("%s has unexpected contents", name)
+		}
+	}
+}
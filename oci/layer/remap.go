@@ -0,0 +1,92 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+
+	"github.com/openSUSE/umoci/pkg/idtools"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// IDRemap describes how the ownership of the entries in a layer is rewritten
+// by RemapArchive, in order to move a layer between hosts with different
+// subordinate ID allocations. The owner of each entry is treated as a host ID
+// under the "From" mappings, which is mapped back to its container ID and
+// then to the corresponding host ID under the "To" mappings. The mappings have
+// the same meaning as the mappings in MapOptions, and a nil mapping is the
+// identity mapping.
+type IDRemap struct {
+	FromUIDMappings []rspec.LinuxIDMapping
+	FromGIDMappings []rspec.LinuxIDMapping
+	ToUIDMappings   []rspec.LinuxIDMapping
+	ToGIDMappings   []rspec.LinuxIDMapping
+}
+
+// remapID remaps a single ID from the from mapping to the to mapping.
+func remapID(id int, from, to []rspec.LinuxIDMapping) (int, error) {
+	contID, err := idtools.ToContainer(id, from)
+	if err != nil {
+		return -1, err
+	}
+	return idtools.ToHost(contID, to)
+}
+
+// RemapArchive copies the uncompressed layer archive read from r to w, with
+// the owner and group of every entry (and the IDs in POSIX ACLs) remapped as
+// described by remap. An error is returned if any entry refers to an ID which
+// is not covered by the mappings. The archive is otherwise copied unmodified.
+func RemapArchive(w io.Writer, r io.Reader, remap IDRemap) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		uid, err := remapID(hdr.Uid, remap.FromUIDMappings, remap.ToUIDMappings)
+		if err != nil {
+			return errors.Wrapf(err, "remap uid of %s", hdr.Name)
+		}
+		gid, err := remapID(hdr.Gid, remap.FromGIDMappings, remap.ToGIDMappings)
+		if err != nil {
+			return errors.Wrapf(err, "remap gid of %s", hdr.Name)
+		}
+		hdr.Uid, hdr.Gid = uid, gid
+
+		uidFn := func(id int) (int, error) { return remapID(id, remap.FromUIDMappings, remap.ToUIDMappings) }
+		gidFn := func(id int) (int, error) { return remapID(id, remap.FromGIDMappings, remap.ToGIDMappings) }
+		if err := mapACLXattrs(hdr, false, uidFn, gidFn); err != nil {
+			return errors.Wrapf(err, "remap acls of %s", hdr.Name)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header for %s", hdr.Name)
+		}
+		if _, err := pooledCopy(tw, tr); err != nil {
+			return errors.Wrapf(err, "copy contents of %s", hdr.Name)
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
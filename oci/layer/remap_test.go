@@ -0,0 +1,92 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestRemapArchive(t *testing.T) {
+	archive := makeArchive(t, []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 100000, Gid: 100000},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10, Uid: 100000, Gid: 100005},
+		{Name: "home/user/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 101000, Gid: 101000},
+	})
+	remap := IDRemap{
+		FromUIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		FromGIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		ToUIDMappings:   []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+		ToGIDMappings:   []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 300000, Size: 65536}},
+	}
+
+	var output bytes.Buffer
+	if err := RemapArchive(&output, bytes.NewReader(archive), remap); err != nil {
+		t.Fatalf("RemapArchive: unexpected error: %+v", err)
+	}
+
+	expected := map[string][2]int{
+		"etc/":       {200000, 300000},
+		"etc/passwd": {200000, 300005},
+		"home/user/": {201000, 301000},
+	}
+	tr := tar.NewReader(&output)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading remapped archive: %+v", err)
+		}
+		ids, ok := expected[hdr.Name]
+		if !ok {
+			t.Errorf("unexpected entry %s in remapped archive", hdr.Name)
+			continue
+		}
+		delete(expected, hdr.Name)
+		if hdr.Uid != ids[0] || hdr.Gid != ids[1] {
+			t.Errorf("entry %s: got owner %d:%d, expected %d:%d", hdr.Name, hdr.Uid, hdr.Gid, ids[0], ids[1])
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil || int64(len(data)) != hdr.Size {
+			t.Errorf("entry %s: contents not copied (got %d bytes, err=%v)", hdr.Name, len(data), err)
+		}
+	}
+	for name := range expected {
+		t.Errorf("entry %s missing from remapped archive", name)
+	}
+}
+
+func TestRemapArchiveUnmapped(t *testing.T) {
+	archive := makeArchive(t, []*tar.Header{
+		{Name: "root/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 0, Gid: 0},
+	})
+	remap := IDRemap{
+		FromUIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		ToUIDMappings:   []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+	if err := RemapArchive(ioutil.Discard, bytes.NewReader(archive), remap); err == nil {
+		t.Errorf("RemapArchive: expected error for unmapped uid")
+	}
+}
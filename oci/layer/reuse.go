@@ -0,0 +1,354 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/system"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// SeedRootfs prepares rootfsPath so that ResumeUnpackRootfs (or
+// ResumeUnpackManifest) only has to apply the layers of the given manifest
+// after the first layers layers. The rootfs at srcRootfsPath, which must
+// contain exactly the first layers layers of the manifest (such as the rootfs
+// of a bundle unpacked from an image which shares those layers), is cloned to
+// rootfsPath, along with its device records and conflict report. It is the
+// caller's responsibility to verify that srcRootfsPath has not been modified
+// since it was unpacked, and that it was unpacked with the same MapOptions.
+//
+// The contents of regular files are shared using reflinks if the filesystem
+// supports them (such as btrfs and XFS), and are copied otherwise. Hardlinks
+// to the files of srcRootfsPath are never used, since extraction modifies
+// existing files in-place (so that the two rootfs would not be independent).
+// Hardlinks within srcRootfsPath are preserved.
+func SeedRootfs(srcRootfsPath, rootfsPath string, manifest ispec.Manifest, layers int, opt *MapOptions) error {
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
+	if layers < 0 || layers > len(manifest.Layers) {
+		return errors.Errorf("cannot seed %d layers of manifest with %d layers", layers, len(manifest.Layers))
+	}
+	if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
+		if err == nil {
+			err = fmt.Errorf("%s already exists", rootfsPath)
+		}
+		return errors.Wrap(err, "rootfs path empty")
+	}
+
+	fsEval := fseval.DefaultFsEval
+	if mapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	if mapOptions.Portable {
+		fsEval = fseval.PortableFsEval
+	}
+
+	// The progress file is written first, so that a failed clone can be
+	// detected (and the rootfs is not mistaken for a complete unpack).
+	progress := newProgress(manifest, mapOptions)
+	if err := os.Mkdir(rootfsPath, 0755); err != nil {
+		return errors.Wrap(err, "mkdir rootfs")
+	}
+	if err := progress.write(rootfsPath); err != nil {
+		return errors.Wrap(err, "write progress")
+	}
+
+	cloner := &rootfsCloner{
+		fsEval:   fsEval,
+		rootless: mapOptions.Rootless || mapOptions.Portable,
+		links:    map[fileID]string{},
+	}
+	if err := cloner.clone(srcRootfsPath, rootfsPath); err != nil {
+		return errors.Wrap(err, "clone rootfs")
+	}
+	log.Infof("cloned rootfs %s (%d files reflinked, %d copied)", srcRootfsPath, cloner.reflinked, cloner.copied)
+
+	for _, pathFunc := range []func(string) string{DevicesPath, ConflictsPath} {
+		if err := copyFile(pathFunc(srcRootfsPath), pathFunc(rootfsPath)); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrap(err, "copy rootfs metadata")
+		}
+	}
+
+	progress.Layers = nil
+	for _, layerDescriptor := range manifest.Layers[:layers] {
+		progress.Layers = append(progress.Layers, layerDescriptor.Digest)
+	}
+	return errors.Wrap(progress.write(rootfsPath), "write progress")
+}
+
+// copyFile copies the regular file at src to dst (which must not exist).
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create destination")
+	}
+	defer out.Close()
+
+	if err := copyFileContents(out, in); err != nil {
+		return errors.Wrap(err, "copy contents")
+	}
+	return errors.Wrap(out.Close(), "close destination")
+}
+
+// fileID uniquely identifies an inode on the host.
+type fileID struct {
+	dev, ino uint64
+}
+
+// rootfsCloner clones a directory tree, preserving its metadata.
+type rootfsCloner struct {
+	fsEval   fseval.FsEval
+	rootless bool
+
+	// links maps the inodes of files with more than one link to the path of
+	// their first clone, so that hardlinks are preserved.
+	links map[fileID]string
+
+	// dirs are the directories which have been cloned, and the times to
+	// apply to them once their contents have been cloned.
+	dirs []clonedDir
+
+	reflinked, copied int
+}
+
+// clonedDir is a directory whose times need to be restored after cloning.
+type clonedDir struct {
+	path         string
+	atime, mtime time.Time
+}
+
+// statTimes returns the access and modification times from a stat_t.
+func statTimes(st system.Stat_t) (time.Time, time.Time) {
+	return time.Unix(st.Atim.Unix()), time.Unix(st.Mtim.Unix())
+}
+
+// clone clones the tree at src to dst, which must be an existing directory.
+func (c *rootfsCloner) clone(src, dst string) error {
+	if err := c.cloneDirectory(src, dst); err != nil {
+		return err
+	}
+	// Directory times have to be restored after their contents are cloned
+	// (which would otherwise update them), deepest first.
+	for idx := len(c.dirs) - 1; idx >= 0; idx-- {
+		dir := c.dirs[idx]
+		if err := c.fsEval.Lutimes(dir.path, dir.atime, dir.mtime); err != nil {
+			return errors.Wrapf(err, "restore times of %s", dir.path)
+		}
+	}
+	return nil
+}
+
+// cloneDirectory clones the metadata and contents of the directory src to
+// the existing directory dst.
+func (c *rootfsCloner) cloneDirectory(src, dst string) error {
+	st, err := c.fsEval.Lstatx(src)
+	if err != nil {
+		return errors.Wrap(err, "lstat directory")
+	}
+	atime, mtime := statTimes(st)
+	c.dirs = append(c.dirs, clonedDir{path: dst, atime: atime, mtime: mtime})
+
+	children, err := c.fsEval.Readdir(src)
+	if err != nil {
+		return errors.Wrapf(err, "readdir %s", src)
+	}
+	for _, child := range children {
+		if err := c.cloneEntry(filepath.Join(src, child.Name()), filepath.Join(dst, child.Name())); err != nil {
+			return err
+		}
+	}
+	return c.cloneMetadata(src, dst, st)
+}
+
+// cloneEntry clones the entry (of any type) at src to dst.
+func (c *rootfsCloner) cloneEntry(src, dst string) error {
+	st, err := c.fsEval.Lstatx(src)
+	if err != nil {
+		return errors.Wrap(err, "lstat entry")
+	}
+	mode := os.FileMode(st.Mode & 07777)
+
+	// Preserve hardlinks within the tree.
+	id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR && st.Nlink > 1 {
+		if linkPath, ok := c.links[id]; ok {
+			return errors.Wrapf(c.fsEval.Link(linkPath, dst), "link %s", dst)
+		}
+		c.links[id] = dst
+	}
+
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if err := c.fsEval.Mkdir(dst, 0755); err != nil {
+			return errors.Wrapf(err, "mkdir %s", dst)
+		}
+		return c.cloneDirectory(src, dst)
+	case syscall.S_IFREG:
+		if err := c.cloneRegular(src, dst); err != nil {
+			return errors.Wrapf(err, "clone %s", src)
+		}
+	case syscall.S_IFLNK:
+		linkname, err := c.fsEval.Readlink(src)
+		if err != nil {
+			return errors.Wrapf(err, "readlink %s", src)
+		}
+		if err := c.fsEval.Symlink(linkname, dst); err != nil {
+			return errors.Wrapf(err, "symlink %s", dst)
+		}
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK:
+		fileType := map[uint32]os.FileMode{
+			syscall.S_IFCHR:  os.ModeDevice | os.ModeCharDevice,
+			syscall.S_IFBLK:  os.ModeDevice,
+			syscall.S_IFIFO:  os.ModeNamedPipe,
+			syscall.S_IFSOCK: os.ModeSocket,
+		}[uint32(st.Mode)&syscall.S_IFMT]
+		if err := c.fsEval.Mknod(dst, fileType|mode, system.Dev_t(st.Rdev)); err != nil {
+			return errors.Wrapf(err, "mknod %s", dst)
+		}
+	default:
+		return errors.Errorf("unsupported file type %o: %s", st.Mode&syscall.S_IFMT, src)
+	}
+	return c.cloneMetadata(src, dst, st)
+}
+
+// cloneRegular clones the contents of the regular file src to dst, using a
+// reflink if possible.
+func (c *rootfsCloner) cloneRegular(src, dst string) error {
+	in, err := c.fsEval.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer in.Close()
+
+	out, err := c.fsEval.Create(dst)
+	if err != nil {
+		return errors.Wrap(err, "create destination")
+	}
+	defer out.Close()
+
+	err = system.Clonefile(out.Fd(), in.Fd())
+	if err == nil {
+		c.reflinked++
+		return nil
+	}
+	if !system.IsCloneUnsupported(err) {
+		return errors.Wrap(err, "reflink")
+	}
+	if err := copyFileContents(out, in); err != nil {
+		return errors.Wrap(err, "copy contents")
+	}
+	c.copied++
+	return errors.Wrap(out.Close(), "close destination")
+}
+
+// cloneMetadata applies the ownership, mode, xattrs and times of src (with
+// the given stat_t) to dst.
+func (c *rootfsCloner) cloneMetadata(src, dst string, st system.Stat_t) error {
+	isSymlink := st.Mode&syscall.S_IFMT == syscall.S_IFLNK
+	isDir := st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+
+	// Ownership can only be preserved as root (in rootless mode, everything
+	// is owned by the current user anyway).
+	if !c.rootless {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			return errors.Wrapf(err, "lchown %s", dst)
+		}
+	}
+
+	xattrs, err := c.fsEval.Llistxattr(src)
+	if err != nil {
+		return errors.Wrapf(err, "llistxattr %s", src)
+	}
+	for _, name := range xattrs {
+		value, err := c.fsEval.Lgetxattr(src, name)
+		if err != nil {
+			return errors.Wrapf(err, "lgetxattr %s: %s", src, name)
+		}
+		if err := c.fsEval.Lsetxattr(dst, name, value, 0); err != nil {
+			// Some xattrs (such as security.*) cannot be set without
+			// privileges, which extraction also ignores in rootless mode.
+			if c.rootless {
+				log.Warnf("clone rootfs: ignoring xattr %s on %s: %v", name, dst, err)
+				continue
+			}
+			return errors.Wrapf(err, "lsetxattr %s: %s", dst, name)
+		}
+	}
+
+	// The mode has to be set after chown (which clears setuid bits).
+	if !isSymlink {
+		if err := c.fsEval.Chmod(dst, os.FileMode(st.Mode&0777)|unixModeBits(uint32(st.Mode))); err != nil {
+			return errors.Wrapf(err, "chmod %s", dst)
+		}
+	}
+	if !isDir {
+		atime, mtime := statTimes(st)
+		if err := c.fsEval.Lutimes(dst, atime, mtime); err != nil {
+			return errors.Wrapf(err, "lutimes %s", dst)
+		}
+	}
+	return nil
+}
+
+// unixModeBits converts the setuid, setgid and sticky bits of a stat_t mode to
+// an os.FileMode.
+func unixModeBits(mode uint32) os.FileMode {
+	var fileMode os.FileMode
+	if mode&syscall.S_ISUID != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
+// SharedLayers returns the number of layers of manifest which a rootfs
+// unpacked from base (with every layer applied) can be used to seed with
+// SeedRootfs. This is zero unless the layers of base are a prefix of the
+// layers of manifest.
+func SharedLayers(base, manifest ispec.Manifest) int {
+	if len(base.Layers) > len(manifest.Layers) {
+		return 0
+	}
+	for idx, layerDescriptor := range base.Layers {
+		if layerDescriptor.Digest != manifest.Layers[idx].Digest {
+			return 0
+		}
+	}
+	return len(base.Layers)
+}
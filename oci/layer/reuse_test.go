@@ -0,0 +1,129 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"golang.org/x/net/context"
+)
+
+func TestSeedRootfs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestSeedRootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	base := putTestManifest(t, engine, []string{"a", "b"})
+	manifest := putTestManifest(t, engine, []string{"a", "b", "c"})
+	opt := testMapOptions()
+
+	if n := SharedLayers(base, manifest); n != 2 {
+		t.Errorf("expected 2 shared layers, got %d", n)
+	}
+	if n := SharedLayers(manifest, base); n != 0 {
+		t.Errorf("expected no shared layers with a longer base, got %d", n)
+	}
+
+	srcRootfs := filepath.Join(root, "src")
+	if err := UnpackRootfs(ctx, engine, srcRootfs, base, opt); err != nil {
+		t.Fatalf("unexpected error unpacking base: %s", err)
+	}
+	// A hardlink within the source rootfs.
+	if err := os.Link(filepath.Join(srcRootfs, "a"), filepath.Join(srcRootfs, "a-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := SeedRootfs(srcRootfs, rootfs, manifest, 2, opt); err != nil {
+		t.Fatalf("unexpected error seeding rootfs: %s", err)
+	}
+	if err := SeedRootfs(srcRootfs, rootfs, manifest, 2, opt); err == nil {
+		t.Errorf("expected seeding an existing rootfs to fail")
+	}
+	if err := SeedRootfs(srcRootfs, filepath.Join(root, "bad"), manifest, 4, opt); err == nil {
+		t.Errorf("expected seeding too many layers to fail")
+	}
+	if err := ResumeUnpackRootfs(ctx, engine, rootfs, manifest, opt); err != nil {
+		t.Fatalf("unexpected error finishing seeded rootfs: %s", err)
+	}
+
+	for _, name := range []string{"a", "a-link", "b", "c"} {
+		data, err := ioutil.ReadFile(filepath.Join(rootfs, name))
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %s", name, err)
+			continue
+		}
+		want := "contents of " + name
+		if name == "a-link" {
+			want = "contents of a"
+		}
+		if string(data) != want {
+			t.Errorf("%s has the wrong contents: %q", name, data)
+		}
+	}
+
+	// The seeded rootfs must be independent of the source.
+	fi1, err := os.Stat(filepath.Join(rootfs, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat(filepath.Join(srcRootfs, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(fi1, fi2) {
+		t.Errorf("seeded rootfs shares inodes with the source rootfs")
+	}
+	fi3, err := os.Stat(filepath.Join(rootfs, "a-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi1, fi3) {
+		t.Errorf("hardlinks in the source rootfs were not preserved")
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "a"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(srcRootfs, "a")); err != nil || string(data) != "contents of a" {
+		t.Errorf("source rootfs was modified through the seeded rootfs: %q (%v)", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(srcRootfs, "c")); !os.IsNotExist(err) {
+		t.Errorf("layer was applied to the source rootfs: %v", err)
+	}
+
+	// Seeding with the wrong manifest is caught when resuming.
+	other := putTestManifest(t, engine, []string{"x"})
+	otherRootfs := filepath.Join(root, "other")
+	if err := SeedRootfs(srcRootfs, otherRootfs, manifest, 2, opt); err != nil {
+		t.Fatalf("unexpected error seeding rootfs: %s", err)
+	}
+	if err := ResumeUnpackRootfs(ctx, engine, otherRootfs, other, opt); err == nil {
+		t.Errorf("expected resuming a rootfs seeded for another manifest to fail")
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"strconv"
+	"strings"
+
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/pkg/errors"
+)
+
+// ChownRule changes the ownership of the entries in a generated layer whose
+// path matches Pattern (which uses the syntax described in
+// mtreefilter.GlobFilter, so a pattern matching a directory also matches
+// everything inside it). UID and GID are IDs inside the container, and a
+// value of -1 leaves the corresponding ID unchanged.
+type ChownRule struct {
+	Pattern string
+	UID     int
+	GID     int
+}
+
+// ChmodRule sets the permission bits (including the setuid, setgid and sticky
+// bits) of the entries in a generated layer whose path matches Pattern. The
+// pattern syntax is the same as for ChownRule.
+type ChmodRule struct {
+	Pattern string
+	Mode    int64
+}
+
+// ParseChownRule parses a chown rule of the form "<pattern>:<uid>:<gid>".
+// Either of <uid> or <gid> may be empty, in which case that ID is left
+// unchanged.
+func ParseChownRule(spec string) (ChownRule, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 3 {
+		return ChownRule{}, errors.Errorf("invalid chown rule %q: expected <pattern>:<uid>:<gid>", spec)
+	}
+	pattern := strings.Join(parts[:len(parts)-2], ":")
+	uid, gid := parts[len(parts)-2], parts[len(parts)-1]
+	if uid == "" && gid == "" {
+		return ChownRule{}, errors.Errorf("invalid chown rule %q: neither uid nor gid specified", spec)
+	}
+
+	rule := ChownRule{Pattern: pattern, UID: -1, GID: -1}
+	if uid != "" {
+		id, err := strconv.ParseUint(uid, 10, 31)
+		if err != nil {
+			return ChownRule{}, errors.Wrapf(err, "invalid chown rule %q: parse uid", spec)
+		}
+		rule.UID = int(id)
+	}
+	if gid != "" {
+		id, err := strconv.ParseUint(gid, 10, 31)
+		if err != nil {
+			return ChownRule{}, errors.Wrapf(err, "invalid chown rule %q: parse gid", spec)
+		}
+		rule.GID = int(id)
+	}
+	if _, err := mtreefilter.ParseGlob(rule.Pattern); err != nil {
+		return ChownRule{}, errors.Wrapf(err, "invalid chown rule %q", spec)
+	}
+	return rule, nil
+}
+
+// ParseChmodRule parses a chmod rule of the form "<pattern>:<mode>", where
+// <mode> is an octal mode as used by chmod(1).
+func ParseChmodRule(spec string) (ChmodRule, error) {
+	idx := strings.LastIndex(spec, ":")
+	if idx < 0 {
+		return ChmodRule{}, errors.Errorf("invalid chmod rule %q: expected <pattern>:<mode>", spec)
+	}
+	mode, err := strconv.ParseUint(spec[idx+1:], 8, 12)
+	if err != nil {
+		return ChmodRule{}, errors.Wrapf(err, "invalid chmod rule %q: parse mode", spec)
+	}
+
+	rule := ChmodRule{Pattern: spec[:idx], Mode: int64(mode)}
+	if _, err := mtreefilter.ParseGlob(rule.Pattern); err != nil {
+		return ChmodRule{}, errors.Wrapf(err, "invalid chmod rule %q", spec)
+	}
+	return rule, nil
+}
+
+// headerRewriter applies a set of ChownRules and ChmodRules to tar headers.
+// If several rules match the same path, the last one takes precedence.
+type headerRewriter struct {
+	chown []chownRule
+	chmod []chmodRule
+}
+
+type chownRule struct {
+	glob mtreefilter.Glob
+	ChownRule
+}
+
+type chmodRule struct {
+	glob mtreefilter.Glob
+	ChmodRule
+}
+
+// newHeaderRewriter parses the patterns of the rules in the given
+// MapOptions.
+func newHeaderRewriter(opt MapOptions) (*headerRewriter, error) {
+	rw := &headerRewriter{}
+	for _, rule := range opt.ChownRules {
+		glob, err := mtreefilter.ParseGlob(rule.Pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse chown rule")
+		}
+		rw.chown = append(rw.chown, chownRule{glob: glob, ChownRule: rule})
+	}
+	for _, rule := range opt.ChmodRules {
+		if rule.Mode&^07777 != 0 {
+			return nil, errors.Errorf("parse chmod rule: invalid mode %o", rule.Mode)
+		}
+		glob, err := mtreefilter.ParseGlob(rule.Pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse chmod rule")
+		}
+		rw.chmod = append(rw.chmod, chmodRule{glob: glob, ChmodRule: rule})
+	}
+	return rw, nil
+}
+
+// rewrite applies the rules to the given header, which must already have been
+// mapped with mapHeader.
+func (rw *headerRewriter) rewrite(hdr *tar.Header) {
+	if rw == nil {
+		return
+	}
+	for _, rule := range rw.chown {
+		if !rule.glob.Match(hdr.Name) {
+			continue
+		}
+		if rule.UID >= 0 {
+			hdr.Uid = rule.UID
+		}
+		if rule.GID >= 0 {
+			hdr.Gid = rule.GID
+		}
+	}
+	// Symlinks don't have permissions of their own.
+	if hdr.Typeflag == tar.TypeSymlink {
+		return
+	}
+	for _, rule := range rw.chmod {
+		if rule.glob.Match(hdr.Name) {
+			hdr.Mode = (hdr.Mode &^ 07777) | rule.Mode
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestParseChownRule(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		expected ChownRule
+		valid    bool
+	}{
+		{"/app:1000:1000", ChownRule{"/app", 1000, 1000}, true},
+		{"/app:1000:", ChownRule{"/app", 1000, -1}, true},
+		{"/app::100", ChownRule{"/app", -1, 100}, true},
+		{"/weird:name:0:0", ChownRule{"/weird:name", 0, 0}, true},
+		{"*.sh:0:0", ChownRule{"*.sh", 0, 0}, true},
+		{"/app::", ChownRule{}, false},
+		{"/app:1000", ChownRule{}, false},
+		{"/app:-1:0", ChownRule{}, false},
+		{"/app:user:0", ChownRule{}, false},
+		{"[:0:0", ChownRule{}, false},
+		{"/:0:0", ChownRule{}, false},
+	} {
+		rule, err := ParseChownRule(test.spec)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseChownRule(%q): expected valid=%v, got err=%v", test.spec, test.valid, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(rule, test.expected) {
+			t.Errorf("ParseChownRule(%q): got %#v expected %#v", test.spec, rule, test.expected)
+		}
+	}
+}
+
+func TestParseChmodRule(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		expected ChmodRule
+		valid    bool
+	}{
+		{"/usr/local/bin/*:0755", ChmodRule{"/usr/local/bin/*", 0755}, true},
+		{"/app:755", ChmodRule{"/app", 0755}, true},
+		{"/app:4755", ChmodRule{"/app", 04755}, true},
+		{"/weird:name:600", ChmodRule{"/weird:name", 0600}, true},
+		{"/app", ChmodRule{}, false},
+		{"/app:", ChmodRule{}, false},
+		{"/app:0999", ChmodRule{}, false},
+		{"/app:17777", ChmodRule{}, false},
+		{"/app:u+x", ChmodRule{}, false},
+		{":0755", ChmodRule{}, false},
+	} {
+		rule, err := ParseChmodRule(test.spec)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseChmodRule(%q): expected valid=%v, got err=%v", test.spec, test.valid, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(rule, test.expected) {
+			t.Errorf("ParseChmodRule(%q): got %#v expected %#v", test.spec, rule, test.expected)
+		}
+	}
+}
+
+func TestGenerateRewriteRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateRewriteRules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "app", "bin"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app", "bin", "tool"), []byte("tool"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/tool", filepath.Join(dir, "app", "tool")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &MapOptions{
+		// Make sure that the rules are applied after the ID mapping.
+		Rootless: true,
+		ChownRules: []ChownRule{
+			{Pattern: "/app", UID: 1000, GID: 1000},
+			{Pattern: "/app/bin/tool", UID: -1, GID: 100},
+		},
+		ChmodRules: []ChmodRule{
+			{Pattern: "/app", Mode: 0750},
+			{Pattern: "/app/bin/*", Mode: 0755},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	type entry struct {
+		uid, gid int
+		mode     int64
+	}
+	expected := map[string]entry{
+		"app/":         {1000, 1000, 0750},
+		"app/bin/":     {1000, 1000, 0750},
+		"app/bin/tool": {1000, 100, 0755},
+		"other":        {0, 0, 0600},
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		switch hdr.Name {
+		case ".":
+			// The root directory was modified, but isn't matched by any rules.
+			if hdr.Uid != 0 || hdr.Gid != 0 {
+				t.Errorf("root directory: got owner %d:%d expected 0:0", hdr.Uid, hdr.Gid)
+			}
+			continue
+		case "app/tool":
+			if hdr.Uid != 1000 || hdr.Gid != 1000 {
+				t.Errorf("symlink %s: got owner %d:%d expected 1000:1000", hdr.Name, hdr.Uid, hdr.Gid)
+			}
+			continue
+		}
+		exp, ok := expected[hdr.Name]
+		if !ok {
+			t.Errorf("got unexpected file: %s", hdr.Name)
+			continue
+		}
+		delete(expected, hdr.Name)
+		if got := (entry{hdr.Uid, hdr.Gid, hdr.Mode & 07777}); got != exp {
+			t.Errorf("%s: got %+v expected %+v", hdr.Name, got, exp)
+		}
+	}
+	for name := range expected {
+		t.Errorf("did not get file: %s", name)
+	}
+}
+
+func TestGenerateInvalidRule(t *testing.T) {
+	for _, opt := range []MapOptions{
+		{ChownRules: []ChownRule{{Pattern: "[", UID: 0, GID: 0}}},
+		{ChmodRules: []ChmodRule{{Pattern: "/", Mode: 0755}}},
+		{ChmodRules: []ChmodRule{{Pattern: "/app", Mode: 010000}}},
+	} {
+		if _, err := GenerateLayer(".", nil, &opt); err == nil {
+			t.Errorf("expected error generating layer with invalid rules: %#v", opt)
+		}
+	}
+}
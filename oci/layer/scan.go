@@ -0,0 +1,148 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Severities of findings, in increasing order of severity. Scanners may use
+// other severities, which are treated as SeverityUnknown when comparing.
+const (
+	SeverityUnknown  = "unknown"
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// severityLevels maps each known severity to its order.
+var severityLevels = map[string]int{
+	SeverityUnknown:  0,
+	SeverityLow:      1,
+	SeverityMedium:   2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// ValidSeverity returns whether the given severity is one of the known
+// severities.
+func ValidSeverity(severity string) bool {
+	_, ok := severityLevels[strings.ToLower(severity)]
+	return ok
+}
+
+// SeverityAtLeast returns whether severity is at least as severe as threshold
+// (both are compared case-insensitively).
+func SeverityAtLeast(severity, threshold string) bool {
+	return severityLevels[strings.ToLower(severity)] >= severityLevels[strings.ToLower(threshold)]
+}
+
+// Finding is a single issue reported by a Scanner.
+type Finding struct {
+	// Layer is the digest of the layer blob the finding was reported for. It
+	// is filled in by LayerScan, and does not need to be set by scanners.
+	Layer digest.Digest `json:"layer,omitempty"`
+
+	// ID is the identifier of the issue (such as a CVE ID).
+	ID string `json:"id"`
+
+	// Severity is the severity of the issue (see SeverityLow and friends).
+	Severity string `json:"severity,omitempty"`
+
+	// Package and Path optionally describe where the issue was found.
+	Package string `json:"package,omitempty"`
+	Path    string `json:"path,omitempty"`
+
+	// Description is a human-readable description of the issue.
+	Description string `json:"description,omitempty"`
+}
+
+// Scanner inspects the contents of layers (such as a vulnerability scanner).
+type Scanner interface {
+	// ScanLayer reads the uncompressed tar stream of a layer, and returns any
+	// issues found in it. The scanner does not need to read the entire
+	// stream. The scanner is run while the layer is unpacked or generated,
+	// so it must not retain layer after returning.
+	ScanLayer(layer io.Reader) ([]Finding, error)
+}
+
+// LayerScan feeds layers to a Scanner as they are unpacked or generated (so
+// that the layer blobs do not need to be read a second time), and collects
+// the findings. If MapOptions.Scan is set, UnpackRootfs scans every layer it
+// applies.
+type LayerScan struct {
+	// Scanner is the scanner used for every layer.
+	Scanner Scanner
+
+	// Findings is the list of findings reported for every layer scanned so
+	// far, in the order the layers were scanned.
+	Findings []Finding
+}
+
+// Tee returns a reader which reads from r, and concurrently feeds everything
+// read to the scanner. Once r has been read (completely or not), finish must
+// be called with the digest of the layer blob to wait for the scanner and
+// record its findings. finish must be called even if reading failed, and its
+// error should be ignored in that case.
+func (s *LayerScan) Tee(r io.Reader) (_ io.Reader, finish func(layer digest.Digest) error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	var (
+		findings []Finding
+		err      error
+		done     = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		findings, err = s.Scanner.ScanLayer(pipeReader)
+		// Scanners don't have to read the entire stream, but we need to
+		// consume the rest so that the layer isn't blocked.
+		io.Copy(ioutil.Discard, pipeReader)
+	}()
+
+	finish = func(layer digest.Digest) error {
+		pipeWriter.Close()
+		<-done
+		if err != nil {
+			return errors.Wrapf(err, "scan layer %s", layer)
+		}
+		for idx := range findings {
+			findings[idx].Layer = layer
+		}
+		s.Findings = append(s.Findings, findings...)
+		return nil
+	}
+	return io.TeeReader(r, pipeWriter), finish
+}
+
+// Exceeding returns the findings which are at least as severe as threshold.
+func (s *LayerScan) Exceeding(threshold string) []Finding {
+	var findings []Finding
+	for _, finding := range s.Findings {
+		if SeverityAtLeast(finding.Severity, threshold) {
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
@@ -0,0 +1,154 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// fileScanner is a Scanner which reports every file in a layer as a finding,
+// with the given severity.
+type fileScanner struct {
+	severity string
+}
+
+func (s fileScanner) ScanLayer(layer io.Reader) ([]Finding, error) {
+	var findings []Finding
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, Finding{ID: "FILE", Severity: s.severity, Path: hdr.Name})
+	}
+	return findings, nil
+}
+
+// lazyScanner is a Scanner which doesn't read the layer.
+type lazyScanner struct {
+	err error
+}
+
+func (s lazyScanner) ScanLayer(layer io.Reader) ([]Finding, error) {
+	return nil, s.err
+}
+
+func TestSeverityAtLeast(t *testing.T) {
+	for _, test := range []struct {
+		severity, threshold string
+		expected            bool
+	}{
+		{SeverityCritical, SeverityHigh, true},
+		{SeverityHigh, SeverityHigh, true},
+		{"HIGH", SeverityHigh, true},
+		{SeverityMedium, SeverityHigh, false},
+		{"", SeverityLow, false},
+		{"bogus", SeverityUnknown, true},
+		{"bogus", SeverityLow, false},
+	} {
+		if got := SeverityAtLeast(test.severity, test.threshold); got != test.expected {
+			t.Errorf("SeverityAtLeast(%q, %q): got %v expected %v", test.severity, test.threshold, got, test.expected)
+		}
+	}
+	if ValidSeverity("bogus") || !ValidSeverity("Critical") {
+		t.Errorf("ValidSeverity returned unexpected results")
+	}
+}
+
+func TestLayerScanTee(t *testing.T) {
+	data := bytes.Repeat([]byte("layer data "), 100000)
+
+	for _, scanner := range []Scanner{lazyScanner{}, lazyScanner{err: errors.New("scanner failed")}} {
+		scan := &LayerScan{Scanner: scanner}
+		reader, finish := scan.Tee(bytes.NewReader(data))
+
+		// Scanners which don't read the layer must not block reading it.
+		got, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("layer contents changed by scan")
+		}
+
+		err = finish("sha256:dummy")
+		if expected := scanner.(lazyScanner).err; (err == nil) != (expected == nil) {
+			t.Errorf("unexpected scan error: got %v expected %v", err, expected)
+		}
+		if len(scan.Findings) != 0 {
+			t.Errorf("unexpected findings: %v", scan.Findings)
+		}
+	}
+}
+
+func TestUnpackRootfsScan(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsScan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := putTestManifest(t, engine, []string{"a", "b"})
+	opt := testMapOptions()
+	opt.Scan = &LayerScan{Scanner: fileScanner{severity: SeverityMedium}}
+
+	if err := UnpackRootfs(ctx, engine, filepath.Join(root, "rootfs"), manifest, opt); err != nil {
+		t.Fatalf("unexpected error unpacking rootfs: %+v", err)
+	}
+
+	findings := opt.Scan.Findings
+	if len(findings) != 2 {
+		t.Fatalf("expected a finding for each layer: got %v", findings)
+	}
+	for idx, name := range []string{"a", "b"} {
+		if findings[idx].Path != name || findings[idx].Layer != manifest.Layers[idx].Digest {
+			t.Errorf("unexpected finding %d: got %v expected %s in %s", idx, findings[idx], name, manifest.Layers[idx].Digest)
+		}
+	}
+	if got := opt.Scan.Exceeding(SeverityMedium); len(got) != 2 {
+		t.Errorf("expected all findings to exceed medium: got %v", got)
+	}
+	if got := opt.Scan.Exceeding(SeverityHigh); len(got) != 0 {
+		t.Errorf("expected no findings to exceed high: got %v", got)
+	}
+
+	// Scan errors must fail the unpack.
+	opt.Scan = &LayerScan{Scanner: lazyScanner{err: errors.New("scanner failed")}}
+	if err := UnpackRootfs(ctx, engine, filepath.Join(root, "rootfs2"), manifest, opt); err == nil {
+		t.Errorf("expected scanner error to fail unpack")
+	}
+}
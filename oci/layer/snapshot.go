@@ -0,0 +1,321 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SnapshotDriver describes how the snapshots in a SnapshotStore are created.
+type SnapshotDriver string
+
+const (
+	// SnapshotDriverBtrfs stores snapshots as read-only btrfs subvolumes,
+	// which are created (and cloned) in constant time with btrfs(8). The
+	// rootfs being extracted is created as a subvolume so that it can be
+	// snapshotted.
+	SnapshotDriverBtrfs SnapshotDriver = "btrfs"
+
+	// SnapshotDriverCopy stores snapshots as copies of the rootfs, sharing
+	// the contents of regular files with reflinks if the filesystem supports
+	// them (as with SeedRootfs). It works on any filesystem, but snapshots
+	// take time proportional to the number of files.
+	SnapshotDriverCopy SnapshotDriver = "copy"
+)
+
+// ParseSnapshotDriver parses the given snapshot driver name. An empty name
+// (or "auto") returns an empty SnapshotDriver, which causes NewSnapshotStore
+// to pick the driver based on the filesystem of the store.
+func ParseSnapshotDriver(name string) (SnapshotDriver, error) {
+	switch driver := SnapshotDriver(name); driver {
+	case "", "auto":
+		return "", nil
+	case SnapshotDriverBtrfs, SnapshotDriverCopy:
+		return driver, nil
+	}
+	return "", errors.Errorf("unknown snapshot driver: %q", name)
+}
+
+// snapshotTempPrefix is the prefix of the temporary directories used while
+// adding snapshots to a SnapshotStore.
+const snapshotTempPrefix = ".tmp-"
+
+// SnapshotStore is a directory of snapshots of extracted root filesystems,
+// one for each chain of layers (the first n layers of an image) which has
+// been extracted, so that extracting an image whose first layers have
+// already been extracted (with the same MapOptions) only requires cloning the
+// snapshot and applying the remaining layers. Each snapshot is stored in
+// <root>/<key>/rootfs (along with its device records and conflict report),
+// where the key is derived from the ChainID of the layers and the
+// MapOptions.
+//
+// Snapshots are never modified once they have been added to the store, and
+// (like a LayerCache) are only an optimisation, so failing to add a snapshot
+// is not fatal. The contents of the store are trusted, so it must not be
+// writable by untrusted users.
+type SnapshotStore struct {
+	root   string
+	driver SnapshotDriver
+}
+
+// NewSnapshotStore returns a SnapshotStore stored in the given directory
+// (which is created if it doesn't exist). If driver is empty, the btrfs
+// driver is used if the store is on btrfs and the copy driver is used
+// otherwise. Rootfs paths used with the store should be on the same
+// filesystem as the store.
+func NewSnapshotStore(root string, driver SnapshotDriver) (*SnapshotStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, errors.Wrap(err, "create snapshot store")
+	}
+	if driver == "" {
+		btrfs, err := isBtrfs(root)
+		if err != nil {
+			return nil, errors.Wrap(err, "detect snapshot driver")
+		}
+		driver = SnapshotDriverCopy
+		if btrfs {
+			driver = SnapshotDriverBtrfs
+		}
+	}
+	return &SnapshotStore{root: root, driver: driver}, nil
+}
+
+// Driver returns the driver used by the store.
+func (s *SnapshotStore) Driver() SnapshotDriver {
+	return s.driver
+}
+
+// btrfs runs btrfs(8) with the given arguments.
+func btrfs(args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("btrfs", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "btrfs %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// snapshotKey returns the key of the snapshot of a rootfs containing the
+// given layers (identified by their DiffIDs), extracted with the given
+// MapOptions.
+func snapshotKey(diffIDs []digest.Digest, opt MapOptions) (string, error) {
+	// The ChainID of the layers, as defined by the image-spec.
+	chainID := diffIDs[0]
+	for _, diffID := range diffIDs[1:] {
+		chainID = digest.SHA256.FromString(chainID.String() + " " + diffID.String())
+	}
+
+	// Only the options saved in the bundle metadata affect the rootfs, but
+	// the umask is applied to the rootfs if requested.
+	options, err := json.Marshal(opt)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal map options")
+	}
+	if opt.ApplyUmask {
+		options = append(options, fmt.Sprintf("\numask=%o", system.Umask())...)
+	}
+	return digest.SHA256.FromString(chainID.String() + "\n" + string(options)).Hex(), nil
+}
+
+// lookup returns the rootfs of the snapshot with the given key, if it exists.
+func (s *SnapshotStore) lookup(key string) (string, bool) {
+	rootfsPath := filepath.Join(s.root, key, RootfsName)
+	_, err := os.Lstat(rootfsPath)
+	return rootfsPath, err == nil
+}
+
+// mkdirRootfs creates an empty rootfs, which can be snapshotted later.
+func (s *SnapshotStore) mkdirRootfs(rootfsPath string) error {
+	if s.driver == SnapshotDriverBtrfs {
+		return errors.Wrap(btrfs("subvolume", "create", rootfsPath), "create rootfs subvolume")
+	}
+	return errors.Wrap(os.Mkdir(rootfsPath, 0755), "mkdir rootfs")
+}
+
+// clone clones the rootfs at src to dst (which must not exist), along with
+// its device records and conflict report. If readOnly is set and the driver
+// supports it, dst is made read-only.
+func (s *SnapshotStore) clone(src, dst string, readOnly bool, opt MapOptions) error {
+	switch s.driver {
+	case SnapshotDriverBtrfs:
+		args := []string{"subvolume", "snapshot"}
+		if readOnly {
+			args = append(args, "-r")
+		}
+		if err := btrfs(append(args, src, dst)...); err != nil {
+			return errors.Wrap(err, "snapshot rootfs subvolume")
+		}
+	default:
+		if err := os.Mkdir(dst, 0755); err != nil {
+			return errors.Wrap(err, "mkdir rootfs")
+		}
+		fsEval := fseval.DefaultFsEval
+		if opt.Rootless {
+			fsEval = fseval.RootlessFsEval
+		}
+		if opt.Portable {
+			fsEval = fseval.PortableFsEval
+		}
+		cloner := &rootfsCloner{
+			fsEval:   fsEval,
+			rootless: opt.Rootless || opt.Portable,
+			links:    map[fileID]string{},
+		}
+		if err := cloner.clone(src, dst); err != nil {
+			return errors.Wrap(err, "clone rootfs")
+		}
+	}
+
+	for _, pathFunc := range []func(string) string{DevicesPath, ConflictsPath} {
+		if err := os.Remove(pathFunc(dst)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove stale rootfs metadata")
+		}
+		if err := copyFile(pathFunc(src), pathFunc(dst)); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrap(err, "copy rootfs metadata")
+		}
+	}
+	return nil
+}
+
+// remove removes a (possibly incomplete) snapshot directory.
+func (s *SnapshotStore) remove(dir string) error {
+	if s.driver == SnapshotDriverBtrfs {
+		rootfsPath := filepath.Join(dir, RootfsName)
+		if _, err := os.Lstat(rootfsPath); err == nil {
+			if err := btrfs("subvolume", "delete", rootfsPath); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.Wrap(os.RemoveAll(dir), "remove snapshot")
+}
+
+// save adds a snapshot of the rootfs (which must contain exactly the layers
+// with the given DiffIDs) to the store, unless it already exists.
+func (s *SnapshotStore) save(rootfsPath string, diffIDs []digest.Digest, opt MapOptions) error {
+	key, err := snapshotKey(diffIDs, opt)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.lookup(key); ok {
+		return nil
+	}
+
+	// The snapshot is created in a temporary directory, so that incomplete
+	// snapshots are never used.
+	tmpDir, err := ioutil.TempDir(s.root, snapshotTempPrefix+key+"-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary snapshot directory")
+	}
+	if err := s.clone(rootfsPath, filepath.Join(tmpDir, RootfsName), true, opt); err != nil {
+		s.remove(tmpDir)
+		return err
+	}
+	if err := os.Rename(tmpDir, filepath.Join(s.root, key)); err != nil {
+		s.remove(tmpDir)
+		// Someone else may have added the same snapshot concurrently.
+		if _, ok := s.lookup(key); ok {
+			return nil
+		}
+		return errors.Wrap(err, "rename snapshot into place")
+	}
+	log.Infof("saved snapshot of %d layers: %s", len(diffIDs), key)
+	return nil
+}
+
+// seed clones the snapshot containing the most layers of the given manifest
+// (if any) to rootfsPath, and records the layers of the snapshot as applied
+// so that ResumeUnpackRootfs only has to apply the remaining layers. It
+// returns whether a snapshot was found.
+func (s *SnapshotStore) seed(ctx context.Context, engineExt casext.Engine, rootfsPath string, manifest ispec.Manifest, opt MapOptions) (bool, error) {
+	diffIDs, err := manifestDiffIDs(ctx, engineExt, manifest)
+	if err != nil {
+		return false, err
+	}
+
+	for n := len(diffIDs); n > 0; n-- {
+		key, err := snapshotKey(diffIDs[:n], opt)
+		if err != nil {
+			return false, err
+		}
+		snapshotPath, ok := s.lookup(key)
+		if !ok {
+			continue
+		}
+
+		if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", rootfsPath)
+			}
+			return false, errors.Wrap(err, "rootfs path empty")
+		}
+		// The progress is written first, so that a failed clone can be
+		// detected (and the rootfs is not mistaken for a complete unpack).
+		progress := newProgress(manifest, opt)
+		if err := progress.write(rootfsPath); err != nil {
+			return false, errors.Wrap(err, "write progress")
+		}
+		if err := os.Remove(VerityPath(rootfsPath)); err != nil && !os.IsNotExist(err) {
+			return false, errors.Wrap(err, "remove verity records")
+		}
+		if err := s.clone(snapshotPath, rootfsPath, false, opt); err != nil {
+			return false, errors.Wrapf(err, "clone snapshot %s", key)
+		}
+		log.Infof("using snapshot of %d of %d layers: %s", n, len(diffIDs), key)
+
+		for _, layerDescriptor := range manifest.Layers[:n] {
+			progress.Layers = append(progress.Layers, layerDescriptor.Digest)
+		}
+		return true, errors.Wrap(progress.write(rootfsPath), "write progress")
+	}
+	return false, nil
+}
+
+// manifestDiffIDs returns the DiffIDs of the layers of the given manifest.
+func manifestDiffIDs(ctx context.Context, engineExt casext.Engine, manifest ispec.Manifest) ([]digest.Digest, error) {
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return nil, errors.Errorf("config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, errors.Errorf("config has %d diffids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	return config.RootFS.DiffIDs, nil
+}
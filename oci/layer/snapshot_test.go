@@ -0,0 +1,183 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+func TestParseSnapshotDriver(t *testing.T) {
+	for name, expected := range map[string]SnapshotDriver{
+		"":      "",
+		"auto":  "",
+		"btrfs": SnapshotDriverBtrfs,
+		"copy":  SnapshotDriverCopy,
+	} {
+		driver, err := ParseSnapshotDriver(name)
+		if err != nil || driver != expected {
+			t.Errorf("ParseSnapshotDriver(%q): got %q (%v), expected %q", name, driver, err, expected)
+		}
+	}
+	if _, err := ParseSnapshotDriver("lvm"); err == nil {
+		t.Errorf("expected error parsing unknown snapshot driver")
+	}
+}
+
+func TestSnapshotKey(t *testing.T) {
+	a, b := digest.SHA256.FromString("a"), digest.SHA256.FromString("b")
+
+	keys := map[string]struct{}{}
+	for _, test := range []struct {
+		diffIDs []digest.Digest
+		opt     MapOptions
+	}{
+		{[]digest.Digest{a}, MapOptions{}},
+		{[]digest.Digest{b}, MapOptions{}},
+		{[]digest.Digest{a, b}, MapOptions{}},
+		{[]digest.Digest{b, a}, MapOptions{}},
+		{[]digest.Digest{a}, MapOptions{Rootless: true}},
+		{[]digest.Digest{a}, MapOptions{DevicePolicy: DevicePolicySkip}},
+	} {
+		key, err := snapshotKey(test.diffIDs, test.opt)
+		if err != nil {
+			t.Fatalf("unexpected error computing snapshot key: %+v", err)
+		}
+		if _, ok := keys[key]; ok {
+			t.Errorf("duplicate snapshot key for %v %+v", test.diffIDs, test.opt)
+		}
+		keys[key] = struct{}{}
+	}
+
+	// Options which are not saved in the bundle metadata don't matter.
+	key1, _ := snapshotKey([]digest.Digest{a}, MapOptions{})
+	key2, _ := snapshotKey([]digest.Digest{a}, MapOptions{ReflinkDuplicates: true, SkipSpaceCheck: true})
+	if key1 != key2 {
+		t.Errorf("snapshot key depends on unsaved options")
+	}
+}
+
+func TestUnpackRootfsSnapshots(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackRootfsSnapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	base := makeOwnerLayer(t, []tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/base", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/base": "base"})
+	top1 := makeOwnerLayer(t, []tar.Header{
+		{Name: "etc/top", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/top": "top1"})
+	top2 := makeOwnerLayer(t, []tar.Header{
+		{Name: "etc/top", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"etc/top": "top2"})
+	manifest1 := putLayersManifest(t, engine, [][]byte{base, top1})
+	manifest2 := putLayersManifest(t, engine, [][]byte{base, top2})
+
+	snapshots, err := NewSnapshotStore(filepath.Join(dir, "snapshots"), SnapshotDriverCopy)
+	if err != nil {
+		t.Fatalf("unexpected error creating snapshot store: %+v", err)
+	}
+	opt := testMapOptions()
+	opt.Snapshots = snapshots
+
+	if err := UnpackRootfs(ctx, engine, filepath.Join(dir, "rootfs1"), manifest1, opt); err != nil {
+		t.Fatalf("unexpected error unpacking first rootfs: %+v", err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected a snapshot for each layer, got %d", len(entries))
+	}
+
+	// Mark the snapshot of the base layer, so that we can tell whether the
+	// second rootfs was cloned from it.
+	baseKey, err := snapshotKey(layerDiffIDs(t, base), *testMapOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseRootfs, ok := snapshots.lookup(baseKey)
+	if !ok {
+		t.Fatalf("snapshot of the base layer is missing")
+	}
+	if err := ioutil.WriteFile(filepath.Join(baseRootfs, "marker"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rootfs1", "marker")); !os.IsNotExist(err) {
+		t.Errorf("snapshot is not independent of the rootfs")
+	}
+
+	rootfs2 := filepath.Join(dir, "rootfs2")
+	if err := UnpackRootfs(ctx, engine, rootfs2, manifest2, opt); err != nil {
+		t.Fatalf("unexpected error unpacking second rootfs: %+v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs2, "marker")); err != nil {
+		t.Errorf("second rootfs was not cloned from the base snapshot: %v", err)
+	}
+	for name, contents := range map[string]string{"etc/base": "base", "etc/top": "top2"} {
+		data, err := ioutil.ReadFile(filepath.Join(rootfs2, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("%s has unexpected contents %q", name, data)
+		}
+	}
+	if _, err := os.Stat(ProgressPath(rootfs2)); !os.IsNotExist(err) {
+		t.Errorf("progress file was not removed")
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(dir, "snapshots")); len(entries) != 3 {
+		t.Errorf("expected a snapshot of the new layer chain, got %d snapshots", len(entries))
+	}
+
+	// Snapshots are not used with different options.
+	rootfs3 := filepath.Join(dir, "rootfs3")
+	opt.DevicePolicy = DevicePolicySkip
+	if err := UnpackRootfs(ctx, engine, rootfs3, manifest2, opt); err != nil {
+		t.Fatalf("unexpected error unpacking third rootfs: %+v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs3, "marker")); !os.IsNotExist(err) {
+		t.Errorf("snapshot was used with different options")
+	}
+}
+
+// layerDiffIDs returns the DiffIDs of the given uncompressed layers.
+func layerDiffIDs(t *testing.T, layers ...[]byte) []digest.Digest {
+	var diffIDs []digest.Digest
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, digest.SHA256.FromBytes(layer))
+	}
+	return diffIDs
+}
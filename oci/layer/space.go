@@ -0,0 +1,137 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/system"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// EstimateLayerSize returns an estimate of the uncompressed size of the given
+// layer, without decompressing it. If the layer is gzip-compressed and the
+// blob can be seeked, the size recorded in the gzip trailer is used (which is
+// only accurate modulo 4GiB, so it is adjusted to be roughly at least the
+// compressed size). Otherwise the size of the blob is used, so the estimate is
+// never larger than the real size (unless the layer has been padded or
+// concatenated).
+func EstimateLayerSize(ctx context.Context, engine cas.Engine, descriptor ispec.Descriptor) (int64, error) {
+	if MediaTypeCompression(descriptor.MediaType) != CompressionGzip {
+		return descriptor.Size, nil
+	}
+
+	blob, err := engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+
+	seeker, ok := blob.(io.ReadSeeker)
+	if !ok || descriptor.Size < 4 {
+		return descriptor.Size, nil
+	}
+	if _, err := seeker.Seek(-4, io.SeekEnd); err != nil {
+		return -1, errors.Wrap(err, "seek to gzip trailer")
+	}
+	var isize uint32
+	if err := binary.Read(seeker, binary.LittleEndian, &isize); err != nil {
+		return -1, errors.Wrap(err, "read gzip trailer")
+	}
+
+	// gzip can only make incompressible data slightly larger, so if the
+	// trailer is much smaller than the compressed size then it must have
+	// wrapped around.
+	size := int64(isize)
+	for size+size/100+1024 < descriptor.Size {
+		size += 1 << 32
+	}
+	return size, nil
+}
+
+// EstimateUnpackSize returns an estimate of the space required to extract the
+// given layers, which is the sum of their estimated uncompressed sizes (see
+// EstimateLayerSize). This doesn't take into account files which are replaced
+// or removed by later layers, nor the space used by filesystem metadata.
+func EstimateUnpackSize(ctx context.Context, engine cas.Engine, layers []ispec.Descriptor) (int64, error) {
+	var total int64
+	for _, descriptor := range layers {
+		size, err := EstimateLayerSize(ctx, engine, descriptor)
+		if err != nil {
+			return -1, errors.Wrapf(err, "estimate size of layer %s", descriptor.Digest)
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// EstimateGenerateSize returns an estimate of the (uncompressed) size of the
+// layer which GenerateLayer would generate from the given deltas of the rootfs
+// at path. This is the size of every regular file which was added or
+// modified, as well as a tar header for each delta. Because layers are
+// compressed, this is usually an overestimate of the space required to store
+// the layer.
+func EstimateGenerateSize(path string, deltas []mtree.InodeDelta) int64 {
+	var total int64
+	for _, delta := range deltas {
+		total += tarBlockSize
+		if delta.Type() == mtree.Missing {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(path, delta.Path()))
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		// Round up to the next tar block.
+		total += (fi.Size() + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+	}
+	return total
+}
+
+// tarBlockSize is the size of a tar header, and the unit that file contents
+// are padded to.
+const tarBlockSize = 512
+
+// CheckFreeSpace returns an error if the filesystem containing path has less
+// than size bytes available. If the amount of free space cannot be
+// determined, a warning is logged and no error is returned.
+func CheckFreeSpace(path string, size int64) error {
+	free, err := system.FreeSpace(path)
+	if err != nil {
+		log.Warnf("cannot check free space: %v", err)
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"path":     path,
+		"required": size,
+		"free":     free,
+	}).Debugf("checking free space")
+	if free < size {
+		return errors.Errorf("insufficient free space on %s: need approximately %s but only %s is available", path, units.BytesSize(float64(size)), units.BytesSize(float64(free)))
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// putGzipBlob stores the gzip-compressed data in the engine.
+func putGzipBlob(t *testing.T, engine cas.Engine, data []byte) ispec.Descriptor {
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+	if _, err := gzw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	digest, size, err := engine.PutBlob(context.Background(), buf)
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    digest,
+		Size:      size,
+	}
+}
+
+func TestEstimateUnpackSize(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEstimateUnpackSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	dirEngine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dirEngine.Close()
+
+	memEngine := mem.New()
+	defer memEngine.Close()
+
+	first := bytes.Repeat([]byte("a"), 100000)
+	second := bytes.Repeat([]byte("b"), 23456)
+
+	// Seekable blobs use the size from the gzip trailer.
+	layers := []ispec.Descriptor{putGzipBlob(t, dirEngine, first), putGzipBlob(t, dirEngine, second)}
+	size, err := EstimateUnpackSize(ctx, dirEngine, layers)
+	if err != nil {
+		t.Fatalf("unexpected error estimating size: %+v", err)
+	}
+	if expected := int64(len(first) + len(second)); size != expected {
+		t.Errorf("unexpected estimate for seekable blobs: expected=%d got=%d", expected, size)
+	}
+
+	// Other blobs fall back to the compressed size.
+	layers = []ispec.Descriptor{putGzipBlob(t, memEngine, first), putGzipBlob(t, memEngine, second)}
+	size, err = EstimateUnpackSize(ctx, memEngine, layers)
+	if err != nil {
+		t.Fatalf("unexpected error estimating size: %+v", err)
+	}
+	if expected := layers[0].Size + layers[1].Size; size != expected {
+		t.Errorf("unexpected estimate for non-seekable blobs: expected=%d got=%d", expected, size)
+	}
+
+	// Layers which are not gzip-compressed use the size of the blob.
+	plain := putGzipBlob(t, dirEngine, first)
+	plain.MediaType = ispec.MediaTypeImageLayer
+	size, err = EstimateUnpackSize(ctx, dirEngine, []ispec.Descriptor{plain})
+	if err != nil {
+		t.Fatalf("unexpected error estimating size: %+v", err)
+	}
+	if size != plain.Size {
+		t.Errorf("unexpected estimate for uncompressed layer: expected=%d got=%d", plain.Size, size)
+	}
+
+	// Missing blobs are an error.
+	layers[0].Digest = cas.BlobAlgorithm.FromString("missing")
+	if _, err := EstimateUnpackSize(ctx, memEngine, layers); err == nil {
+		t.Errorf("expected error estimating size of missing layer")
+	}
+}
+
+func TestEstimateGenerateSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestEstimateGenerateSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	keywords := append(mtree.DefaultKeywords, "sha256digest")
+	dh, err := mtree.Walk(root, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Check(root, dh, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every new path has a header, and the file contents are padded.
+	size := EstimateGenerateSize(root, diffs)
+	if expected := int64(len(diffs)*tarBlockSize + 1024); size != expected {
+		t.Errorf("unexpected estimate: expected=%d got=%d (%d diffs)", expected, size, len(diffs))
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestCheckFreeSpace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := CheckFreeSpace(root, 0); err != nil {
+		t.Errorf("unexpected error checking for no space: %+v", err)
+	}
+	if err := CheckFreeSpace(root, 1<<62); err == nil {
+		t.Errorf("expected error checking for huge amount of space")
+	}
+}
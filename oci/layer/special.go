@@ -0,0 +1,76 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"github.com/pkg/errors"
+)
+
+// SpecialFilePolicy describes how special files (named pipes and sockets) are
+// handled when extracting and generating layers.
+type SpecialFilePolicy string
+
+const (
+	// SpecialFileInclude creates named pipes when extracting layers, and
+	// includes them when generating layers. Sockets cannot be represented in
+	// a tar archive, so this policy cannot be used for sockets.
+	SpecialFileInclude SpecialFilePolicy = "include"
+
+	// SpecialFileSkip ignores special files, logging a warning for each file
+	// which was skipped.
+	SpecialFileSkip SpecialFilePolicy = "skip"
+
+	// SpecialFileError causes extraction or generation to fail if a special
+	// file is encountered.
+	SpecialFileError SpecialFilePolicy = "error"
+)
+
+// ParseSpecialFilePolicy parses the given special file policy name.
+func ParseSpecialFilePolicy(name string) (SpecialFilePolicy, error) {
+	switch policy := SpecialFilePolicy(name); policy {
+	case SpecialFileInclude, SpecialFileSkip, SpecialFileError:
+		return policy, nil
+	}
+	return "", errors.Errorf("unknown special file policy: %q", name)
+}
+
+// fifoPolicy returns the SpecialFilePolicy for named pipes, which defaults to
+// SpecialFileInclude.
+func (opt MapOptions) fifoPolicy() (SpecialFilePolicy, error) {
+	switch opt.FifoPolicy {
+	case "":
+		return SpecialFileInclude, nil
+	case SpecialFileInclude, SpecialFileSkip, SpecialFileError:
+		return opt.FifoPolicy, nil
+	}
+	return "", errors.Errorf("unknown fifo policy: %q", opt.FifoPolicy)
+}
+
+// socketPolicy returns the SpecialFilePolicy for sockets, which defaults to
+// SpecialFileSkip.
+func (opt MapOptions) socketPolicy() (SpecialFilePolicy, error) {
+	switch opt.SocketPolicy {
+	case "":
+		return SpecialFileSkip, nil
+	case SpecialFileSkip, SpecialFileError:
+		return opt.SocketPolicy, nil
+	case SpecialFileInclude:
+		return "", errors.Errorf("invalid socket policy %q: sockets cannot be included in layers", opt.SocketPolicy)
+	}
+	return "", errors.Errorf("unknown socket policy: %q", opt.SocketPolicy)
+}
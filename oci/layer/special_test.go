@@ -0,0 +1,203 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseSpecialFilePolicy(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected SpecialFilePolicy
+		valid    bool
+	}{
+		{"include", SpecialFileInclude, true},
+		{"skip", SpecialFileSkip, true},
+		{"error", SpecialFileError, true},
+		{"", "", false},
+		{"create", "", false},
+	} {
+		policy, err := ParseSpecialFilePolicy(test.name)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseSpecialFilePolicy(%q): expected valid=%v, got err=%v", test.name, test.valid, err)
+			continue
+		}
+		if policy != test.expected {
+			t.Errorf("ParseSpecialFilePolicy(%q): got %q expected %q", test.name, policy, test.expected)
+		}
+	}
+}
+
+func TestUnpackFifoPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy SpecialFilePolicy
+		valid  bool
+		exists bool
+	}{
+		{"", true, true},
+		{SpecialFileInclude, true, true},
+		{SpecialFileSkip, true, false},
+		{SpecialFileError, false, false},
+		{"bad", false, false},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackFifoPolicy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opt := testMapOptions()
+			opt.FifoPolicy = test.policy
+
+			layer := makeTarLayer(t, []tar.Header{
+				{Name: "fifo", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644},
+			})
+			err = UnpackLayer(dir, layer, opt)
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid=%v, got err=%v", test.valid, err)
+			}
+			if !test.valid {
+				return
+			}
+
+			fi, err := os.Lstat(filepath.Join(dir, "fifo"))
+			if !test.exists {
+				// The earlier regular file must've been removed too.
+				if !os.IsNotExist(err) {
+					t.Errorf("expected fifo to not exist: got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fi.Mode()&os.ModeNamedPipe != os.ModeNamedPipe {
+				t.Errorf("expected fifo to be a named pipe: got mode %v", fi.Mode())
+			}
+		})
+	}
+}
+
+func TestGenerateSpecialFilePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateSpecialFilePolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.Mkfifo(filepath.Join(dir, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		fifo, socket SpecialFilePolicy
+		valid        bool
+		expected     []string
+	}{
+		{"", "", true, []string{".", "fifo", "file"}},
+		{SpecialFileSkip, SpecialFileSkip, true, []string{".", "file"}},
+		{SpecialFileError, "", false, nil},
+		{"", SpecialFileError, false, nil},
+		{"", SpecialFileInclude, false, nil},
+	} {
+		reader, err := GenerateLayer(dir, diffs, &MapOptions{
+			FifoPolicy:   test.fifo,
+			SocketPolicy: test.socket,
+		})
+		if err != nil {
+			if test.valid {
+				t.Errorf("fifo=%q socket=%q: unexpected error: %+v", test.fifo, test.socket, err)
+			}
+			continue
+		}
+
+		var names []string
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if test.valid {
+					t.Errorf("fifo=%q socket=%q: unexpected error: %+v", test.fifo, test.socket, err)
+				}
+				names = nil
+				break
+			}
+			if hdr.Name == "fifo" && hdr.Typeflag != tar.TypeFifo {
+				t.Errorf("fifo=%q socket=%q: fifo has typeflag %v", test.fifo, test.socket, hdr.Typeflag)
+			}
+			names = append(names, hdr.Name)
+		}
+		reader.Close()
+
+		if !test.valid {
+			if names != nil {
+				t.Errorf("fifo=%q socket=%q: expected error, got %v", test.fifo, test.socket, names)
+			}
+			continue
+		}
+		sort.Strings(names)
+		if len(names) != len(test.expected) {
+			t.Errorf("fifo=%q socket=%q: got entries %v expected %v", test.fifo, test.socket, names, test.expected)
+			continue
+		}
+		for idx := range names {
+			if names[idx] != test.expected[idx] {
+				t.Errorf("fifo=%q socket=%q: got entries %v expected %v", test.fifo, test.socket, names, test.expected)
+				break
+			}
+		}
+	}
+}
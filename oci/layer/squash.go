@@ -0,0 +1,316 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SquashRange describes a range of layers which, if squashed into a single
+// layer, would allow some wasted space to be reclaimed.
+type SquashRange struct {
+	// Start is the index of the first layer in the range.
+	Start int `json:"start"`
+
+	// End is the index of the last layer in the range (inclusive).
+	End int `json:"end"`
+
+	// Files is the number of hidden files that would be removed.
+	Files int `json:"files"`
+
+	// Reclaimable is the total (uncompressed) size of the hidden files that
+	// would be removed.
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+// SquashSuggestions returns the smallest set of non-overlapping layer ranges
+// which need to be squashed in order to remove all of the hidden files in the
+// Analysis, sorted by Start. Only ranges which would reclaim at least minSize
+// bytes are returned.
+func (a *Analysis) SquashSuggestions(minSize int64) []SquashRange {
+	wasted := make([]WastedFile, len(a.Wasted))
+	copy(wasted, a.Wasted)
+	sort.Stable(wastedFilesByLayer(wasted))
+
+	// Merge overlapping [Layer, RemovedBy] intervals.
+	var ranges []SquashRange
+	for _, file := range wasted {
+		if n := len(ranges); n > 0 && file.Layer <= ranges[n-1].End {
+			last := &ranges[n-1]
+			if file.RemovedBy > last.End {
+				last.End = file.RemovedBy
+			}
+			last.Files++
+			last.Reclaimable += file.Size
+			continue
+		}
+		ranges = append(ranges, SquashRange{
+			Start:       file.Layer,
+			End:         file.RemovedBy,
+			Files:       1,
+			Reclaimable: file.Size,
+		})
+	}
+
+	var suggestions []SquashRange
+	for _, r := range ranges {
+		if r.Reclaimable >= minSize {
+			suggestions = append(suggestions, r)
+		}
+	}
+	return suggestions
+}
+
+type wastedFilesByLayer []WastedFile
+
+func (f wastedFilesByLayer) Len() int           { return len(f) }
+func (f wastedFilesByLayer) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f wastedFilesByLayer) Less(i, j int) bool { return f[i].Layer < f[j].Layer }
+
+// squashID identifies a single entry in a range of layers being squashed.
+type squashID struct {
+	layer, index int
+}
+
+func (id squashID) after(other squashID) bool {
+	if id.layer != other.layer {
+		return id.layer > other.layer
+	}
+	return id.index > other.index
+}
+
+// squashEntry is an entry in the merged view being built by a squasher.
+type squashEntry struct {
+	id       squashID
+	typeflag byte
+	linkname string
+}
+
+// squasher computes which entries of a range of layers are visible once all
+// of the layers in the range have been applied, and which paths need to be
+// whited out in the squashed layer.
+type squasher struct {
+	entries   map[string]squashEntry
+	removed   map[string]squashID
+	whiteouts map[string]struct{}
+}
+
+// remove removes the given path (and everything below it) from the merged
+// view. Because the path may exist in the layers below the range, a whiteout
+// is always recorded.
+func (s *squasher) remove(path string, id squashID) {
+	for entryPath := range s.entries {
+		if entryPath == path || strings.HasPrefix(entryPath, path+"/") {
+			delete(s.entries, entryPath)
+		}
+	}
+	s.removed[path] = id
+	s.whiteouts[path] = struct{}{}
+}
+
+// plan applies the given uncompressed layer archive to the merged view.
+func (s *squasher) plan(layer io.Reader, idx int) error {
+	tr := tar.NewReader(layer)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		id := squashID{layer: idx, index: index}
+		path := filepath.Join("/", hdr.Name)
+		dir, file := filepath.Split(path)
+
+		if strings.HasPrefix(file, whPrefix) {
+			s.remove(filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), id)
+			continue
+		}
+
+		typeflag := hdr.Typeflag
+		if typeflag == tar.TypeRegA {
+			typeflag = tar.TypeReg
+		}
+
+		// Directories are merged (with the newest metadata winning). If the
+		// type changed, anything that was below the old path (including
+		// paths in the layers below the range) is gone, which requires a
+		// whiteout if a directory is going to be created again.
+		if old, ok := s.entries[path]; ok {
+			if old.typeflag != tar.TypeDir || typeflag != tar.TypeDir {
+				s.remove(path, id)
+			}
+		}
+		s.entries[path] = squashEntry{
+			id:       id,
+			typeflag: typeflag,
+			linkname: filepath.Join("/", hdr.Linkname),
+		}
+	}
+	return nil
+}
+
+// check makes sure that the squashed layer will produce the same result as
+// the original layers. The only case where this isn't true is hard links,
+// which refer to the version of the target at the time the link was created.
+func (s *squasher) check() error {
+	for path, entry := range s.entries {
+		if entry.typeflag != tar.TypeLink {
+			continue
+		}
+		if target, ok := s.entries[entry.linkname]; ok && target.id.after(entry.id) {
+			return errors.Errorf("hardlink %s refers to %s, which is replaced after the link was created", path, entry.linkname)
+		}
+		for target := entry.linkname; target != "/"; target = filepath.Dir(target) {
+			if id, ok := s.removed[target]; ok && id.after(entry.id) {
+				return errors.Errorf("hardlink %s refers to %s, which is removed after the link was created", path, entry.linkname)
+			}
+		}
+	}
+	return nil
+}
+
+// neededWhiteouts returns the sorted set of whiteouts that need to be
+// included in the squashed layer. Whiteouts below another whited-out path
+// are redundant and are dropped.
+func (s *squasher) neededWhiteouts() []string {
+	var whiteouts []string
+	for path := range s.whiteouts {
+		redundant := false
+		for dir := filepath.Dir(path); dir != "/"; dir = filepath.Dir(dir) {
+			if _, ok := s.whiteouts[dir]; ok {
+				redundant = true
+				break
+			}
+		}
+		if !redundant && path != "/" {
+			whiteouts = append(whiteouts, path)
+		}
+	}
+	sort.Strings(whiteouts)
+	return whiteouts
+}
+
+// SquashReaders writes a single uncompressed layer archive to w which is
+// equivalent to applying the n given layers in order. open is called twice
+// for each layer index, and must return the uncompressed layer archive each
+// time. Files which are removed or overwritten by a later layer in the range
+// are not included in the squashed layer.
+func SquashReaders(w io.Writer, n int, open func(idx int) (io.ReadCloser, error)) error {
+	s := &squasher{
+		entries:   map[string]squashEntry{},
+		removed:   map[string]squashID{},
+		whiteouts: map[string]struct{}{},
+	}
+
+	// First pass: figure out which entries are visible at the end.
+	for idx := 0; idx < n; idx++ {
+		reader, err := open(idx)
+		if err != nil {
+			return errors.Wrapf(err, "open layer %d", idx)
+		}
+		err = s.plan(reader, idx)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "plan layer %d", idx)
+		}
+	}
+	if err := s.check(); err != nil {
+		return errors.Wrap(err, "cannot squash layers")
+	}
+	keep := map[squashID]struct{}{}
+	for _, entry := range s.entries {
+		keep[entry.id] = struct{}{}
+	}
+
+	// Second pass: write out the whiteouts and then all of the visible
+	// entries, in the same order as the original layers.
+	tw := tar.NewWriter(w)
+	for _, path := range s.neededWhiteouts() {
+		dir, file := filepath.Split(path)
+		hdr := &tar.Header{
+			Name:     filepath.Join(strings.TrimPrefix(dir, "/"), whPrefix+file),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "write whiteout header")
+		}
+	}
+	for idx := 0; idx < n; idx++ {
+		reader, err := open(idx)
+		if err != nil {
+			return errors.Wrapf(err, "open layer %d", idx)
+		}
+		err = copyKept(tw, reader, idx, keep)
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "copy layer %d", idx)
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
+
+// copyKept copies all of the entries in the given layer archive which are in
+// the keep set to tw.
+func copyKept(tw *tar.Writer, layer io.Reader, idx int, keep map[squashID]struct{}) error {
+	tr := tar.NewReader(layer)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if _, ok := keep[squashID{layer: idx, index: index}]; !ok {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "write header")
+		}
+		if _, err := pooledCopy(tw, tr); err != nil {
+			return errors.Wrap(err, "copy entry")
+		}
+	}
+	return nil
+}
+
+// SquashLayers is equivalent to SquashReaders, except that the layers are
+// taken from the given descriptors. The returned reader is the uncompressed
+// squashed layer archive, which is generated in the background.
+func SquashLayers(ctx context.Context, engine cas.Engine, layers []ispec.Descriptor) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		err := SquashReaders(writer, len(layers), func(idx int) (io.ReadCloser, error) {
+			return openLayer(ctx, engine, layers[idx])
+		})
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
@@ -0,0 +1,226 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// squashBuffers squashes the given uncompressed layer archives.
+func squashBuffers(layers [][]byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := SquashReaders(&buffer, len(layers), func(idx int) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(layers[idx])), nil
+	})
+	return buffer.Bytes(), err
+}
+
+func readLayer(t *testing.T, entries []testAnalyzeEntry) []byte {
+	data, err := ioutil.ReadAll(makeAnalyzeLayer(t, entries))
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %s", err)
+	}
+	return data
+}
+
+// mergedView returns the paths and sizes of the files in the merged view of
+// the given layers.
+func mergedView(t *testing.T, layers [][]byte) map[string]int64 {
+	var readers []io.Reader
+	for _, layer := range layers {
+		readers = append(readers, bytes.NewReader(layer))
+	}
+	analysis, err := AnalyzeLayers(readers)
+	if err != nil {
+		t.Fatalf("unexpected error analysing layers: %s", err)
+	}
+	view := map[string]int64{}
+	for _, file := range analysis.Files {
+		view[file.Path] = file.Size
+	}
+	return view
+}
+
+func TestSquashReaders(t *testing.T) {
+	base := readLayer(t, []testAnalyzeEntry{
+		{"etc/", tar.TypeDir, 0},
+		{"etc/passwd", tar.TypeReg, 100},
+		{"etc/shadow", tar.TypeReg, 50},
+		{"opt/", tar.TypeDir, 0},
+		{"opt/app/bin", tar.TypeReg, 300},
+	})
+	layers := [][]byte{
+		readLayer(t, []testAnalyzeEntry{
+			{"var/cache/pkg.tar", tar.TypeReg, 8000},
+			{"usr/lib/libfoo.so", tar.TypeReg, 500},
+			{"tmp/", tar.TypeDir, 0},
+			{"tmp/build.log", tar.TypeReg, 20},
+		}),
+		readLayer(t, []testAnalyzeEntry{
+			{"var/cache/" + whPrefix + "pkg.tar", tar.TypeReg, 0},
+			{"etc/passwd", tar.TypeReg, 120},
+			{whPrefix + "opt", tar.TypeReg, 0},
+			{"opt/", tar.TypeDir, 0},
+			{"opt/app/bin", tar.TypeReg, 400},
+		}),
+		readLayer(t, []testAnalyzeEntry{
+			{"etc/" + whPrefix + "shadow", tar.TypeReg, 0},
+			{"tmp", tar.TypeSymlink, 0},
+		}),
+	}
+
+	squashed, err := squashBuffers(layers)
+	if err != nil {
+		t.Fatalf("unexpected error squashing layers: %s", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(squashed))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading squashed layer: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	expectedNames := []string{
+		// Whiteouts come first, and redundant ones are dropped.
+		"etc/" + whPrefix + "shadow",
+		whPrefix + "opt",
+		whPrefix + "tmp",
+		"var/cache/" + whPrefix + "pkg.tar",
+		// Then the visible entries in their original order.
+		"usr/lib/libfoo.so",
+		"etc/passwd",
+		"opt/",
+		"opt/app/bin",
+		"tmp",
+	}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("unexpected squashed entries: got %v, expected %v", names, expectedNames)
+	}
+
+	expected := mergedView(t, append([][]byte{base}, layers...))
+	got := mergedView(t, [][]byte{base, squashed})
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("squashed layer has a different merged view: got %v, expected %v", got, expected)
+	}
+}
+
+func TestSquashReadersHardlink(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		layers  [][]byte
+		invalid bool
+	}{
+		{"LinkAfterReplace", [][]byte{
+			readLayer(t, []testAnalyzeEntry{{"a", tar.TypeReg, 10}}),
+			readLayer(t, []testAnalyzeEntry{{"a", tar.TypeReg, 20}}),
+			readLayer(t, []testAnalyzeEntry{{"b", tar.TypeLink, 0}}),
+		}, false},
+		{"TargetReplaced", [][]byte{
+			readLayer(t, []testAnalyzeEntry{{"a", tar.TypeReg, 10}}),
+			readLayer(t, []testAnalyzeEntry{{"b", tar.TypeLink, 0}}),
+			readLayer(t, []testAnalyzeEntry{{"a", tar.TypeReg, 20}}),
+		}, true},
+		{"TargetRemoved", [][]byte{
+			readLayer(t, []testAnalyzeEntry{{"b", tar.TypeLink, 0}}),
+			readLayer(t, []testAnalyzeEntry{{whPrefix + "a", tar.TypeReg, 0}}),
+		}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// makeAnalyzeLayer doesn't set link targets, so fix them up.
+			for idx, layer := range test.layers {
+				test.layers[idx] = relinkLayer(t, layer, "a")
+			}
+			_, err := squashBuffers(test.layers)
+			if test.invalid && err == nil {
+				t.Errorf("expected an error squashing layers")
+			} else if !test.invalid && err != nil {
+				t.Errorf("unexpected error squashing layers: %s", err)
+			}
+		})
+	}
+}
+
+// relinkLayer rewrites all of the hardlinks in the given layer to point to
+// target.
+func relinkLayer(t *testing.T, layer []byte, target string) []byte {
+	var buffer bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(layer))
+	tw := tar.NewWriter(&buffer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %s", err)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = target
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("unexpected error writing header: %s", err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			t.Fatalf("unexpected error copying entry: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing tar writer: %s", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestSquashSuggestions(t *testing.T) {
+	analysis := &Analysis{
+		Wasted: []WastedFile{
+			{MergedFile: MergedFile{Path: "/a", Size: 100, Layer: 1}, RemovedBy: 3},
+			{MergedFile: MergedFile{Path: "/b", Size: 10, Layer: 0}, RemovedBy: 1},
+			{MergedFile: MergedFile{Path: "/c", Size: 5, Layer: 5}, RemovedBy: 6},
+			{MergedFile: MergedFile{Path: "/d", Size: 1, Layer: 2}, RemovedBy: 4},
+			{MergedFile: MergedFile{Path: "/e", Size: 7, Layer: 7}, RemovedBy: 8},
+		},
+	}
+
+	expected := []SquashRange{
+		{Start: 0, End: 4, Files: 3, Reclaimable: 111},
+		{Start: 5, End: 6, Files: 1, Reclaimable: 5},
+		{Start: 7, End: 8, Files: 1, Reclaimable: 7},
+	}
+	if got := analysis.SquashSuggestions(0); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected suggestions: got %v, expected %v", got, expected)
+	}
+
+	expected = []SquashRange{
+		{Start: 0, End: 4, Files: 3, Reclaimable: 111},
+		{Start: 7, End: 8, Files: 1, Reclaimable: 7},
+	}
+	if got := analysis.SquashSuggestions(6); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected suggestions with minimum size: got %v, expected %v", got, expected)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// FileStat describes a single file inside a layer.
+type FileStat struct {
+	// Path is the cleaned absolute path of the file inside the rootfs.
+	Path string `json:"path"`
+
+	// Size is the size of the file's contents in bytes.
+	Size int64 `json:"size"`
+}
+
+// Stats contains information about the contents of a single layer.
+type Stats struct {
+	// UncompressedSize is the size of the uncompressed layer archive.
+	UncompressedSize int64 `json:"uncompressed_size"`
+
+	// Entries is the number of entries (including whiteouts) in the layer.
+	Entries int64 `json:"entries"`
+
+	// LargestFiles is the set of largest regular files in the layer, sorted
+	// by size (largest first) and then by path.
+	LargestFiles []FileStat `json:"largest_files"`
+}
+
+// countingReader counts the number of bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openLayer returns a reader for the uncompressed contents of the layer
+// referenced by the given descriptor.
+func openLayer(ctx context.Context, engine cas.Engine, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	engineExt := casext.NewEngine(engine)
+
+	layerBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get layer blob")
+	}
+	if !casext.IsLayerMediaType(layerBlob.MediaType) {
+		layerBlob.Close()
+		return nil, errors.Errorf("layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
+	}
+	layerReader, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		// Should _never_ be reached.
+		layerBlob.Close()
+		return nil, errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+	}
+
+	decompressed, err := DecompressLayer(descriptor.MediaType, layerReader)
+	if err != nil {
+		layerReader.Close()
+		return nil, errors.Wrapf(err, "layer %s", descriptor.Digest)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decompressed, layerReader}, nil
+}
+
+// LayerStats computes the Stats of the layer referenced by the given
+// descriptor. At most top entries are included in Stats.LargestFiles.
+func LayerStats(ctx context.Context, engine cas.Engine, descriptor ispec.Descriptor, top int) (Stats, error) {
+	reader, err := openLayer(ctx, engine, descriptor)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer reader.Close()
+	return ReaderStats(reader, top)
+}
+
+// ReaderStats computes the Stats of the given uncompressed layer archive. At
+// most top entries are included in Stats.LargestFiles.
+func ReaderStats(layer io.Reader, top int) (Stats, error) {
+	var stats Stats
+	if top < 0 {
+		top = 0
+	}
+
+	counter := &countingReader{r: layer}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, errors.Wrap(err, "read next entry")
+		}
+		stats.Entries++
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if strings.HasPrefix(filepath.Base(hdr.Name), whPrefix) {
+			continue
+		}
+		stats.LargestFiles = append(stats.LargestFiles, FileStat{
+			Path: filepath.Join("/", hdr.Name),
+			Size: hdr.Size,
+		})
+
+		// Keep the list bounded, so we don't hold every path in memory.
+		if len(stats.LargestFiles) > 2*top+1 {
+			sortFileStats(stats.LargestFiles)
+			stats.LargestFiles = stats.LargestFiles[:top]
+		}
+	}
+
+	// Make sure we count any trailing padding in the archive.
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return stats, errors.Wrap(err, "read trailing data")
+	}
+	stats.UncompressedSize = counter.n
+
+	sortFileStats(stats.LargestFiles)
+	if len(stats.LargestFiles) > top {
+		stats.LargestFiles = stats.LargestFiles[:top]
+	}
+	return stats, nil
+}
+
+// sortFileStats sorts the given files by size (largest first) and then by
+// path.
+func sortFileStats(files []FileStat) {
+	sort.Sort(fileStatsBySize(files))
+}
+
+type fileStatsBySize []FileStat
+
+func (f fileStatsBySize) Len() int      { return len(f) }
+func (f fileStatsBySize) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f fileStatsBySize) Less(i, j int) bool {
+	if f[i].Size != f[j].Size {
+		return f[i].Size > f[j].Size
+	}
+	return f[i].Path < f[j].Path
+}
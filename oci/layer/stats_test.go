@@ -0,0 +1,105 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"golang.org/x/net/context"
+)
+
+func TestReaderStats(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	for _, file := range []struct {
+		hdr  tar.Header
+		size int
+	}{
+		{tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}, 0},
+		{tar.Header{Name: "etc/small", Typeflag: tar.TypeReg, Mode: 0644}, 10},
+		{tar.Header{Name: "etc/medium", Typeflag: tar.TypeReg, Mode: 0644}, 1000},
+		{tar.Header{Name: "usr/large", Typeflag: tar.TypeReg, Mode: 0644}, 100000},
+		{tar.Header{Name: "usr/large2", Typeflag: tar.TypeReg, Mode: 0644}, 100000},
+		{tar.Header{Name: "usr/link", Typeflag: tar.TypeSymlink, Linkname: "large"}, 0},
+		{tar.Header{Name: "usr/" + whPrefix + "gone", Typeflag: tar.TypeReg}, 0},
+	} {
+		hdr := file.hdr
+		hdr.Size = int64(file.size)
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unexpected error writing header %s: %s", hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(strings.Repeat("x", file.size))); err != nil {
+			t.Fatalf("unexpected error writing %s: %s", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing tar writer: %s", err)
+	}
+	layerSize := int64(buffer.Len())
+
+	for _, test := range []struct {
+		top      int
+		expected []FileStat
+	}{
+		{0, nil},
+		{1, []FileStat{{"/usr/large", 100000}}},
+		{3, []FileStat{{"/usr/large", 100000}, {"/usr/large2", 100000}, {"/etc/medium", 1000}}},
+		{10, []FileStat{{"/usr/large", 100000}, {"/usr/large2", 100000}, {"/etc/medium", 1000}, {"/etc/small", 10}}},
+	} {
+		stats, err := ReaderStats(bytes.NewReader(buffer.Bytes()), test.top)
+		if err != nil {
+			t.Errorf("top=%d: unexpected error: %s", test.top, err)
+			continue
+		}
+		if stats.UncompressedSize != layerSize {
+			t.Errorf("top=%d: expected uncompressed size %d, got %d", test.top, layerSize, stats.UncompressedSize)
+		}
+		if stats.Entries != 7 {
+			t.Errorf("top=%d: expected 7 entries, got %d", test.top, stats.Entries)
+		}
+		if len(stats.LargestFiles) == 0 && len(test.expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(stats.LargestFiles, test.expected) {
+			t.Errorf("top=%d: expected largest files %v, got %v", test.top, test.expected, stats.LargestFiles)
+		}
+	}
+}
+
+func TestLayerStats(t *testing.T) {
+	engine := mem.New()
+	defer engine.Close()
+
+	descriptor, _ := putTestLayer(t, engine, "file")
+	stats, err := LayerStats(context.Background(), engine, descriptor, 10)
+	if err != nil {
+		t.Fatalf("unexpected error computing layer stats: %s", err)
+	}
+	expected := []FileStat{{"/file", int64(len("contents of file"))}}
+	if !reflect.DeepEqual(stats.LargestFiles, expected) {
+		t.Errorf("expected largest files %v, got %v", expected, stats.LargestFiles)
+	}
+	if stats.Entries != 1 {
+		t.Errorf("expected 1 entry, got %d", stats.Entries)
+	}
+}
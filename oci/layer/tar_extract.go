@@ -23,12 +23,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/cyphar/filepath-securejoin"
-	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/pkg/errors"
 )
@@ -37,21 +37,154 @@ type tarExtractor struct {
 	// mapOptions is the set of mapping options to use when extracting filesystem layers.
 	mapOptions MapOptions
 
-	// fsEval is an fseval.FsEval used for extraction.
-	fsEval fseval.FsEval
+	// fs is the Filesystem used for extraction.
+	fs Filesystem
+
+	// devices is the set of device nodes which have been recorded (rather
+	// than created) because of DevicePolicyRecord.
+	devices deviceRecords
+
+	// paths is the index of extracted paths used to detect path collisions.
+	// It is created on first use.
+	paths *pathIndex
+
+	// conflicts is the report to which conflicts are added with
+	// ConflictWarn. If nil, conflicts are only logged.
+	conflicts *conflictReport
+
+	// reflinks is the index used to reflink duplicate regular files if
+	// MapOptions.ReflinkDuplicates is set. It is nil otherwise.
+	reflinks *reflinkIndex
+
+	// umask is the process umask, which is applied to the modes of extracted
+	// entries if MapOptions.ApplyUmask is set.
+	umask os.FileMode
+
+	// dirTimes are the times of the directories extracted from the layer,
+	// which are restored by restoreDirTimes once every entry has been
+	// extracted (since extracting entries inside a directory modifies its
+	// mtime).
+	dirTimes map[string]entryTimes
 }
 
-// newTarExtractor creates a new tarExtractor.
-func newTarExtractor(opt MapOptions) *tarExtractor {
-	fsEval := fseval.DefaultFsEval
-	if opt.Rootless {
-		fsEval = fseval.RootlessFsEval
+// entryTimes are the access and modification times of an extracted entry.
+type entryTimes struct {
+	atime, mtime time.Time
+}
+
+// headerTimes returns the times described in tar.Header. Note that some
+// archives won't fill the atime and mtime fields, so we have to set them to a
+// more sane value. Otherwise Linux will start screaming at us, and nobody
+// wants that.
+func headerTimes(hdr *tar.Header) entryTimes {
+	mtime := hdr.ModTime
+	if mtime.IsZero() {
+		// XXX: Should we instead default to atime if it's non-zero?
+		mtime = time.Now()
 	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		// Default to the mtime.
+		atime = mtime
+	}
+	return entryTimes{atime: atime, mtime: mtime}
+}
+
+// appliedTimes returns the times which should be applied to the entry
+// described by tar.Header, which are the Unix epoch if MapOptions.OmitTimes is
+// set.
+func (te *tarExtractor) appliedTimes(hdr *tar.Header) entryTimes {
+	if te.mapOptions.OmitTimes {
+		epoch := time.Unix(0, 0)
+		return entryTimes{atime: epoch, mtime: epoch}
+	}
+	return headerTimes(hdr)
+}
+
+// implicitDirMode is the mode of directories which are created because the
+// parent directory of an entry is not in the layer.
+const implicitDirMode = 0755
+
+// newTarExtractor creates a new tarExtractor which extracts to the host
+// filesystem.
+func newTarExtractor(opt MapOptions) *tarExtractor {
+	return newTarExtractorFS(OSFilesystem(opt), opt)
+}
 
-	return &tarExtractor{
+// newTarExtractorFS creates a new tarExtractor which extracts to the given
+// Filesystem.
+func newTarExtractorFS(fs Filesystem, opt MapOptions) *tarExtractor {
+	te := &tarExtractor{
 		mapOptions: opt,
-		fsEval:     fsEval,
+		fs:         fs,
+		devices:    deviceRecords{},
+		dirTimes:   map[string]entryTimes{},
+	}
+	if opt.ApplyUmask {
+		te.umask = system.Umask()
 	}
+	if opt.ReflinkDuplicates {
+		te.reflinks = newReflinkIndex()
+	}
+	return te
+}
+
+// mkdirParent creates the directory dir and any of its missing parents.
+// Unless MapOptions.ApplyUmask is set, the created directories are given
+// implicitDirMode (regardless of the process umask) so that the result of
+// extracting layers that omit parent directories is deterministic.
+//
+// The times of the closest existing parent (which are modified by creating the
+// missing directories) are restored afterwards.
+func (te *tarExtractor) mkdirParent(dir string) error {
+	var (
+		missing  []string
+		existing string
+		existFi  os.FileInfo
+	)
+	for path := dir; ; path = filepath.Dir(path) {
+		fi, err := te.fs.Lstat(path)
+		if err == nil {
+			existing, existFi = path, fi
+			break
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			return errors.Wrap(err, "lstat parent")
+		}
+		missing = append(missing, path)
+		if filepath.Dir(path) == path {
+			break
+		}
+	}
+
+	if err := te.fs.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "mkdirall")
+	}
+	if len(missing) > 0 && existFi != nil && existFi.IsDir() {
+		existHdr, err := tar.FileInfoHeader(existFi, "")
+		if err != nil {
+			return errors.Wrap(err, "convert parent fi to hdr")
+		}
+		if err := te.fs.Lutimes(existing, existHdr.AccessTime, existHdr.ModTime); err != nil {
+			return errors.Wrapf(err, "restore parent times: %s", existing)
+		}
+	}
+	if te.mapOptions.OmitTimes {
+		// The missing directories are modified by extracting entries into
+		// them, so their times are applied by restoreDirTimes.
+		epoch := time.Unix(0, 0)
+		for _, path := range missing {
+			te.dirTimes[path] = entryTimes{atime: epoch, mtime: epoch}
+		}
+	}
+	if te.mapOptions.ApplyUmask {
+		return nil
+	}
+	for _, path := range missing {
+		if err := te.fs.Chmod(path, implicitDirMode); err != nil {
+			return errors.Wrapf(err, "chmod implicit directory: %s", path)
+		}
+	}
+	return nil
 }
 
 // restoreMetadata applies the state described in tar.Header to the filesystem
@@ -63,15 +196,13 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 
 	// Get the _actual_ file info to figure out if the path is a symlink.
 	isSymlink := hdr.Typeflag == tar.TypeSymlink
-	if realFi, err := te.fsEval.Lstat(path); err == nil {
+	if realFi, err := te.fs.Lstat(path); err == nil {
 		isSymlink = realFi.Mode()&os.ModeSymlink == os.ModeSymlink
 	}
 
-	// Apply owner (only used in non-rootless case).
-	if !te.mapOptions.Rootless {
-		// XXX: While unpriv.Lchown doesn't make a whole lot of sense this
-		//      should _probably_ be put inside FsEval.
-		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+	// Apply owner (only used in non-rootless and non-portable case).
+	if !te.mapOptions.Rootless && !te.mapOptions.Portable {
+		if err := te.fs.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
 			return errors.Wrapf(err, "restore chown metadata: %s", path)
 		}
 	}
@@ -81,33 +212,22 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 	// we've applied the owner because setuid bits are cleared when changing
 	// owner (in rootless we don't care because we're always the owner).
 	if !isSymlink {
-		if err := te.fsEval.Chmod(path, fi.Mode()); err != nil {
+		if err := te.fs.Chmod(path, fi.Mode()&^te.umask); err != nil {
 			return errors.Wrapf(err, "restore chmod metadata: %s", path)
 		}
 	}
 
-	// Apply access and modified time. Note that some archives won't fill the
-	// atime and mtime fields, so we have to set them to a more sane value.
-	// Otherwise Linux will start screaming at us, and nobody wants that.
-	mtime := hdr.ModTime
-	if mtime.IsZero() {
-		// XXX: Should we instead default to atime if it's non-zero?
-		mtime = time.Now()
-	}
-	atime := hdr.AccessTime
-	if atime.IsZero() {
-		// Default to the mtime.
-		atime = mtime
-	}
+	// Apply access and modified time.
+	times := te.appliedTimes(hdr)
 
 	// Apply xattrs. In order to make sure that we *only* have the xattr set we
 	// want, we first clear the set of xattrs from the file then apply the ones
 	// set in the tar.Header.
-	if err := te.fsEval.Lclearxattrs(path); err != nil {
+	if err := te.fs.Lclearxattrs(path); err != nil {
 		return errors.Wrapf(err, "clear xattr metadata: %s", path)
 	}
 	for name, value := range hdr.Xattrs {
-		if err := te.fsEval.Lsetxattr(path, name, []byte(value), 0); err != nil {
+		if err := te.fs.Lsetxattr(path, name, []byte(value), 0); err != nil {
 			// In rootless mode, some xattrs will fail (security.capability).
 			// This is _fine_ as long as we're not running as root (in which
 			// case we shouldn't be ignoring xattrs that we were told to set).
@@ -115,17 +235,55 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 				log.Warnf("restoreMetadata: ignoring EPERM on setxattr: %s: %v", name, err)
 				continue
 			}
+			// Not every filesystem supports ACLs (and NFSv4 ACLs are only
+			// supported by NFS).
+			if isACLXattr(name) && isNotSupported(err) {
+				log.Warnf("restoreMetadata: ignoring unsupported acl: %s: %v", name, err)
+				continue
+			}
 			return errors.Wrapf(err, "restore xattr metadata: %s", path)
 		}
 	}
 
-	if err := te.fsEval.Lutimes(path, atime, mtime); err != nil {
+	if err := te.fs.Lutimes(path, times.atime, times.mtime); err != nil {
 		return errors.Wrapf(err, "restore lutimes metadata: %s", path)
 	}
 
 	return nil
 }
 
+// restoreDirTimes re-applies the times of every directory extracted from the
+// layer. Even though unpackEntry restores the metadata of the parent directory
+// of each entry, directories can still be modified by later entries (such as
+// entries whose parent directories are not in the layer), so this must be
+// done once the whole layer has been extracted for the directory times to
+// match the layer.
+func (te *tarExtractor) restoreDirTimes() error {
+	paths := make([]string, 0, len(te.dirTimes))
+	for path := range te.dirTimes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		// The directory might have been removed or replaced by a later entry.
+		fi, err := te.fs.Lstat(path)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "lstat directory: %s", path)
+		}
+		if !fi.IsDir() {
+			continue
+		}
+		times := te.dirTimes[path]
+		if err := te.fs.Lutimes(path, times.atime, times.mtime); err != nil {
+			return errors.Wrapf(err, "restore directory times: %s", path)
+		}
+	}
+	return nil
+}
+
 // applyMetadata applies the state described in tar.Header to the filesystem at
 // the given path, using the state of the tarExtractor to remap information
 // within the header. This should only be used with headers from a tar layer
@@ -146,10 +304,30 @@ func (te *tarExtractor) applyMetadata(path string, hdr *tar.Header) error {
 // tar archive being iterated over. This does handle whiteouts, so a tar.Header
 // that represents a whiteout will result in the path being removed.
 func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (Err error) {
+	// PAX global headers only contain defaults for the following entries
+	// (which archive/tar has already applied), so there is nothing to
+	// extract.
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		log.Debugf("unpack entry: ignoring pax global header %s", hdr.Name)
+		return nil
+	}
+
+	// Landmark entries (see MapOptions.PrefetchProfile) are not part of the
+	// root filesystem.
+	if isPrefetchLandmark(hdr) {
+		log.Debugf("unpack entry: ignoring prefetch landmark %s", hdr.Name)
+		return nil
+	}
+
 	// Make the paths safe.
 	hdr.Name = CleanPath(hdr.Name)
 	root = filepath.Clean(root)
 
+	// Deal with paths which would collide on a normalising filesystem.
+	if err := te.resolveCollisions(root, hdr); err != nil {
+		return errors.Wrap(err, "resolve path collisions")
+	}
+
 	log.WithFields(log.Fields{
 		"root": root,
 		"path": hdr.Name,
@@ -165,21 +343,38 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		// If we got an entry for the root, then unsafeDir is the full path.
 		unsafeDir, file = hdr.Name, "."
 	}
-	dir, err := securejoin.SecureJoinVFS(root, unsafeDir, te.fsEval)
+	dir, err := securejoin.SecureJoinVFS(root, unsafeDir, te.fs)
 	if err != nil {
 		return errors.Wrap(err, "sanitise symlinks in root")
 	}
 	path := filepath.Join(dir, file)
 
+	// If one of the parent directories is a symlink, the entry is going to
+	// end up somewhere other than where its name suggests.
+	if dir != filepath.Join(root, unsafeDir) {
+		realDir, err := filepath.Rel(root, dir)
+		if err != nil {
+			return errors.Wrap(err, "get relative parent path")
+		}
+		if err := te.reportConflict(LayerConflict{
+			Path: filepath.Join("/", hdr.Name),
+			Kind: ConflictSymlinkTraversal,
+			Old:  filepath.Join("/", unsafeDir),
+			New:  filepath.Join("/", realDir),
+		}); err != nil {
+			return err
+		}
+	}
+
 	// Before we do anything, get the state of dir. Because we might be adding
 	// or removing files, our parent directory might be modified in the
 	// process. As a result, we want to be able to restore the old state
 	// (because we only apply state that we find in the archive we're iterating
 	// over). We can safely ignore an error here, because a non-existent
 	// directory will be fixed by later archive entries.
-	if dirFi, err := te.fsEval.Lstat(dir); err == nil && path != dir {
+	if dirFi, err := te.fs.Lstat(dir); err == nil && path != dir {
 		// FIXME: This is really stupid.
-		link, _ := te.fsEval.Readlink(dir)
+		link, _ := te.fs.Readlink(dir)
 		dirHdr, err := tar.FileInfoHeader(dirFi, link)
 		if err != nil {
 			return errors.Wrap(err, "convert hdr to fi")
@@ -219,17 +414,23 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 
 		// Just remove the path. The defer will reapply the correct parent
 		// metadata. We have nothing left to do here.
-		if err := te.fsEval.RemoveAll(path); err != nil {
+		if err := te.fs.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "whiteout remove all")
 		}
+		te.devices.remove(filepath.Join(unsafeDir, file), true)
 		return nil
 	}
 
+	// Whatever was at this path (and, unless it is a directory, anything
+	// underneath it) is being replaced, so any device nodes we recorded there
+	// no longer exist.
+	te.devices.remove(hdr.Name, hdr.Typeflag != tar.TypeDir)
+
 	// Get information about the path. This has to be done after we've dealt
 	// with whiteouts because it turns out that lstat(2) will return EPERM if
 	// you try to stat a whiteout on AUFS.
 	hdrFi := hdr.FileInfo()
-	fi, err := te.fsEval.Lstat(path)
+	fi, err := te.fs.Lstat(path)
 	if err != nil {
 		// File doesn't exist, just switch fi to the file header.
 		fi = hdr.FileInfo()
@@ -241,11 +442,37 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	//      whiteout in this case, or can we just assume that a change in the
 	//      type is reason enough to purge the old type.
 	if hdrFi.Mode()&os.ModeType != fi.Mode()&os.ModeType {
-		if err := te.fsEval.RemoveAll(path); err != nil {
+		if err := te.reportConflict(LayerConflict{
+			Path: filepath.Join("/", hdr.Name),
+			Kind: ConflictTypeChange,
+			Old:  fileTypeName(fi.Mode()),
+			New:  fileTypeName(hdrFi.Mode()),
+		}); err != nil {
+			return err
+		}
+		if err := te.fs.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "replace removeall")
 		}
 	}
 
+	// Named pipes may be skipped (or forbidden) entirely.
+	if hdr.Typeflag == tar.TypeFifo {
+		policy, err := te.mapOptions.fifoPolicy()
+		if err != nil {
+			return err
+		}
+		switch policy {
+		case SpecialFileSkip:
+			if err := te.fs.RemoveAll(path); err != nil {
+				return errors.Wrap(err, "remove skipped fifo old")
+			}
+			log.Warnf("skipping named pipe %s", hdr.Name)
+			return nil
+		case SpecialFileError:
+			return errors.Errorf("named pipes are not permitted by fifo policy: %s", hdr.Name)
+		}
+	}
+
 	// Attempt to create the parent directory of the path we're unpacking.
 	// We do a MkdirAll here because even though you need to have a tar entry
 	// for every component of a new path, applyMetadata will correct any
@@ -254,7 +481,7 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// FIXME: We have to make this consistent, since if the tar archive doesn't
 	//        have entries for some of these components we won't be able to
 	//        verify that we have consistent results during unpacking.
-	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+	if err := te.mkdirParent(dir); err != nil {
 		return errors.Wrap(err, "mkdir parent")
 	}
 
@@ -263,31 +490,21 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// don't care about umasks or the initial mode here, since applyMetadata
 	// will fix all of that for us.
 	switch hdr.Typeflag {
-	// regular file
-	case tar.TypeReg, tar.TypeRegA:
-		// Truncate file, then just copy the data.
-		fh, err := te.fsEval.Create(path)
-		if err != nil {
-			return errors.Wrap(err, "create regular")
-		}
-		defer fh.Close()
-
-		// We need to make sure that we copy all of the bytes.
-		if n, err := io.Copy(fh, r); err != nil {
+	// regular file (archive/tar fills in the holes of GNU sparse files, and
+	// contiguous files are just regular files on every modern system)
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse, tar.TypeCont:
+		// Truncate file (or atomically replace it, for large files), then
+		// just copy the data.
+		if err := te.writeRegular(path, hdr, r); err != nil {
 			return err
-		} else if int64(n) != hdr.Size {
-			return errors.Wrap(io.ErrShortWrite, "unpack to regular file")
 		}
 
-		// Force close here so that we don't affect the metadata.
-		fh.Close()
-
 	// directory
 	case tar.TypeDir:
 		// Attempt to create the directory. We do a MkdirAll here because even
 		// though you need to have a tar entry for every component of a new
 		// path, applyMetadata will correct any inconsistencies.
-		if err := te.fsEval.MkdirAll(path, 0777); err != nil {
+		if err := te.fs.MkdirAll(path, 0777); err != nil {
 			return errors.Wrap(err, "mkdirall")
 		}
 
@@ -301,23 +518,23 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		var linkFn func(string, string) error
 		switch hdr.Typeflag {
 		case tar.TypeLink:
-			linkFn = te.fsEval.Link
+			linkFn = te.fs.Link
 			// Because hardlinks are inode-based we need to scope the link to
 			// the rootfs using SecureJoinVFS. As before, we need to be careful
 			// that we don't resolve the last part of the link path (in case
 			// the user actually wanted to hardlink to a symlink).
 			unsafeLinkDir, linkFile := filepath.Split(CleanPath(linkname))
-			linkDir, err := securejoin.SecureJoinVFS(root, unsafeLinkDir, te.fsEval)
+			linkDir, err := securejoin.SecureJoinVFS(root, unsafeLinkDir, te.fs)
 			if err != nil {
 				return errors.Wrap(err, "sanitise hardlink target in root")
 			}
 			linkname = filepath.Join(linkDir, linkFile)
 		case tar.TypeSymlink:
-			linkFn = te.fsEval.Symlink
+			linkFn = te.fs.Symlink
 		}
 
 		// Unlink the old path, and ignore it if the path didn't exist.
-		if err := te.fsEval.RemoveAll(path); err != nil {
+		if err := te.fs.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "remove link old")
 		}
 
@@ -334,14 +551,35 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 
 	// character device node, block device node
 	case tar.TypeChar, tar.TypeBlock:
-		// In rootless mode we have to fake this.
-		if te.mapOptions.Rootless {
-			fh, err := te.fsEval.Create(path)
+		switch te.mapOptions.DevicePolicy {
+		case "", DevicePolicyCreate:
+		case DevicePolicySkip, DevicePolicyRecord:
+			// The device node still replaces whatever was at this path
+			// before, even if we don't create it.
+			if err := te.fs.RemoveAll(path); err != nil {
+				return errors.Wrap(err, "remove skipped device old")
+			}
+			if te.mapOptions.DevicePolicy == DevicePolicySkip {
+				log.Warnf("skipping device node %s (%d:%d)", hdr.Name, hdr.Devmajor, hdr.Devminor)
+			} else {
+				log.Debugf("recording device node %s (%d:%d)", hdr.Name, hdr.Devmajor, hdr.Devminor)
+				te.devices.add(hdr)
+			}
+			return nil
+		default:
+			return errors.Errorf("unknown device policy: %q", te.mapOptions.DevicePolicy)
+		}
+
+		// In rootless (and portable) mode we have to fake this.
+		if te.mapOptions.Rootless || te.mapOptions.Portable {
+			fh, err := te.fs.Create(path)
 			if err != nil {
 				return errors.Wrap(err, "create rootless block")
 			}
-			defer fh.Close()
-			if err := fh.Chmod(0); err != nil {
+			if err := fh.Close(); err != nil {
+				return errors.Wrap(err, "close rootless block")
+			}
+			if err := te.fs.Chmod(path, 0); err != nil {
 				return errors.Wrap(err, "chmod 0 rootless block")
 			}
 			goto out
@@ -359,12 +597,12 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		dev := system.Makedev(uint64(hdr.Devmajor), uint64(hdr.Devminor))
 
 		// Unlink the old path, and ignore it if the path didn't exist.
-		if err := te.fsEval.RemoveAll(path); err != nil {
+		if err := te.fs.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "remove block old")
 		}
 
 		// Create the node.
-		if err := te.fsEval.Mknod(path, os.FileMode(int64(mode)|hdr.Mode), dev); err != nil {
+		if err := te.fs.Mknod(path, os.FileMode(int64(mode)|hdr.Mode), dev); err != nil {
 			return errors.Wrap(err, "mknod")
 		}
 
@@ -383,6 +621,9 @@ out:
 			return errors.Wrap(err, "apply hdr metadata")
 		}
 	}
+	if hdr.Typeflag == tar.TypeDir {
+		te.dirTimes[path] = te.appliedTimes(hdr)
+	}
 
 	return nil
 }
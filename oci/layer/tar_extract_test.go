@@ -23,6 +23,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -202,6 +203,163 @@ func TestUnpackEntryParentDir(t *testing.T) {
 	}
 }
 
+// TestUnpackEntryUmask ensures that the modes of extracted entries (and of
+// the parent directories created for them) are not affected by the process
+// umask, unless MapOptions.ApplyUmask is set.
+func TestUnpackEntryUmask(t *testing.T) {
+	oldMask := unix.Umask(077)
+	defer unix.Umask(oldMask)
+
+	for _, test := range []struct {
+		name       string
+		applyUmask bool
+		dirMode    os.FileMode
+		fileMode   os.FileMode
+	}{
+		{"Exact", false, 0755, 0664},
+		{"ApplyUmask", true, 0700, 0600},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryUmask")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			rootfs := filepath.Join(dir, "rootfs")
+			if err := os.Mkdir(rootfs, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			ctrValue := []byte("umask test")
+			hdr := &tar.Header{
+				Name:       "a/b/file",
+				Uid:        os.Getuid(),
+				Gid:        os.Getgid(),
+				Mode:       0664,
+				Size:       int64(len(ctrValue)),
+				Typeflag:   tar.TypeReg,
+				ModTime:    time.Now(),
+				AccessTime: time.Now(),
+				ChangeTime: time.Now(),
+			}
+
+			te := newTarExtractor(MapOptions{ApplyUmask: test.applyUmask})
+			if err := te.unpackEntry(rootfs, hdr, bytes.NewBuffer(ctrValue)); err != nil {
+				t.Fatalf("unexpected unpackEntry error: %s", err)
+			}
+
+			for _, path := range []string{"a", "a/b"} {
+				fi, err := os.Lstat(filepath.Join(rootfs, path))
+				if err != nil {
+					t.Fatalf("unexpected lstat error: %s", err)
+				}
+				if got := fi.Mode().Perm(); got != test.dirMode {
+					t.Errorf("unexpected mode for %s: expected %o got %o", path, test.dirMode, got)
+				}
+			}
+			fi, err := os.Lstat(filepath.Join(rootfs, "a/b/file"))
+			if err != nil {
+				t.Fatalf("unexpected lstat error: %s", err)
+			}
+			if got := fi.Mode().Perm(); got != test.fileMode {
+				t.Errorf("unexpected mode for a/b/file: expected %o got %o", test.fileMode, got)
+			}
+		})
+	}
+}
+
+// TestUnpackLayerDirTimes ensures that the times of directories in a layer are
+// restored once the layer has been extracted, even if later entries modify the
+// directories.
+func TestUnpackLayerDirTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerDirTimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(123456789, 0)
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "a/x/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		// The parent directories of this entry are not in the layer, so a is
+		// modified when they are created.
+		{Name: "a/b/c/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		// Removing a/x/y modifies a/x.
+		{Name: "a/x/y", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "a/x/.wh.y", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("unexpected error writing header: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing tar: %s", err)
+	}
+
+	if err := UnpackLayer(dir, buf, testMapOptions()); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	for _, path := range []string{"a", "a/x", "a/b/c/file"} {
+		fi, err := os.Lstat(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatalf("unexpected lstat error: %s", err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("unexpected mtime for %s: expected %s got %s", path, mtime, fi.ModTime())
+		}
+	}
+}
+
+// TestUnpackLayerOmitTimes ensures that the times of every entry (including
+// directories created for entries whose parents are not in the layer) are set
+// to the Unix epoch with MapOptions.OmitTimes.
+func TestUnpackLayerOmitTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerOmitTimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(123456789, 0)
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "a/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, AccessTime: mtime},
+		{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "file", ModTime: mtime},
+		{Name: "b/c/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("unexpected error writing header: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing tar: %s", err)
+	}
+
+	opt := testMapOptions()
+	opt.OmitTimes = true
+	if err := UnpackLayer(dir, buf, opt); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	epoch := time.Unix(0, 0)
+	for _, path := range []string{"a", "a/file", "a/link", "b", "b/c", "b/c/file"} {
+		fi, err := os.Lstat(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatalf("unexpected lstat error: %s", err)
+		}
+		if !fi.ModTime().Equal(epoch) {
+			t.Errorf("unexpected mtime for %s: expected %s got %s", path, epoch, fi.ModTime())
+		}
+	}
+}
+
 // TestUnpackEntryWhiteout checks whether whiteout handling is done correctly,
 // as well as ensuring that the metadata of the parent is maintained.
 func TestUnpackEntryWhiteout(t *testing.T) {
@@ -613,3 +771,124 @@ func TestUnpackEntryMap(t *testing.T) {
 		}
 	}(t)
 }
+
+// TestUnpackEntryPortable makes sure that portable extraction does not create
+// device nodes and does not restore xattrs.
+func TestUnpackEntryPortable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryPortable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	te := newTarExtractor(MapOptions{Portable: true})
+	for _, hdr := range []*tar.Header{
+		{
+			Name:     "dev",
+			Mode:     0755,
+			Typeflag: tar.TypeDir,
+			ModTime:  time.Now(),
+		},
+		{
+			Name:     "dev/null",
+			Mode:     0666,
+			Typeflag: tar.TypeChar,
+			Devmajor: 1,
+			Devminor: 3,
+			ModTime:  time.Now(),
+		},
+		{
+			Name:     "fifo",
+			Mode:     0644,
+			Typeflag: tar.TypeFifo,
+			ModTime:  time.Now(),
+		},
+		{
+			Name:     "file",
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Now(),
+			Xattrs: map[string]string{
+				"user.some.xattr": "value",
+			},
+		},
+	} {
+		if err := te.unpackEntry(rootfs, hdr, bytes.NewBuffer(nil)); err != nil {
+			t.Fatalf("unexpected unpackEntry error for %s: %s", hdr.Name, err)
+		}
+	}
+
+	for _, path := range []string{"dev/null", "fifo", "file"} {
+		fi, err := os.Lstat(filepath.Join(rootfs, path))
+		if err != nil {
+			t.Errorf("unexpected lstat error for %s: %s", path, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("expected %s to be a regular file, got mode %v", path, fi.Mode())
+		}
+	}
+
+	sz, err := unix.Lgetxattr(filepath.Join(rootfs, "file"), "user.some.xattr", nil)
+	if err == nil || sz > 0 {
+		t.Errorf("expected xattr to not be set in portable mode")
+	}
+}
+
+// Layers generated by other tools may use GNU or PAX extensions.
+func TestUnpackEntryExtensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryExtensions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	longName := strings.Repeat("n", 150)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "hello"}},
+		{Name: longName, Typeflag: tar.TypeReg, Mode: 0644, Size: 4, Format: tar.FormatGNU},
+		{Name: "contiguous", Typeflag: tar.TypeCont, Mode: 0644, Size: 4},
+		{Name: "paxfile", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, Format: tar.FormatPAX, ModTime: time.Unix(100, 500)},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header %s: %s", hdr.Name, err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatalf("write %s: %s", hdr.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnpackLayer(dir, buf, &MapOptions{Rootless: true}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	for _, name := range []string{longName, "contiguous", "paxfile"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("read %s: unexpected error: %s", name, err)
+		} else if string(data) != "data" {
+			t.Errorf("%s: unexpected contents %q", name, data)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "pax_global_header")); !os.IsNotExist(err) {
+		t.Errorf("pax global header was extracted: %v", err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "paxfile")); err != nil {
+		t.Errorf("lstat paxfile: %s", err)
+	} else if !fi.ModTime().Equal(time.Unix(100, 500)) {
+		t.Errorf("paxfile: expected sub-second mtime to be restored, got %s", fi.ModTime())
+	}
+}
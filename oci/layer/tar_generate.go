@@ -22,6 +22,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/apex/log"
@@ -51,9 +52,17 @@ type tarGenerator struct {
 	// they're added to the layer.
 	mapOptions MapOptions
 
+	// rewriter applies the ownership and permission rules from mapOptions.
+	rewriter *headerRewriter
+
 	// Hardlink mapping.
 	inodes map[uint64]string
 
+	// linkTargets maps the inodes of hardlinks which are not being added to
+	// the archive (but exist in the layers below it) to one of their paths,
+	// so that entries with the same inode are added as hardlinks to them.
+	linkTargets map[uint64]string
+
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
 
@@ -68,13 +77,62 @@ func newTarGenerator(w io.Writer, opt MapOptions) *tarGenerator {
 	if opt.Rootless {
 		fsEval = fseval.RootlessFsEval
 	}
+	if opt.Portable {
+		fsEval = fseval.PortableFsEval
+	}
 
 	return &tarGenerator{
-		tw:         tar.NewWriter(w),
-		mapOptions: opt,
-		inodes:     map[uint64]string{},
-		fsEval:     fsEval,
+		tw:          tar.NewWriter(w),
+		mapOptions:  opt,
+		inodes:      map[uint64]string{},
+		linkTargets: map[uint64]string{},
+		fsEval:      fsEval,
+	}
+}
+
+// addLinkTargets records the hardlinks under root (other than the paths in
+// skip, which are relative to root) as targets for the hardlinks added to the
+// archive. Paths are walked in lexical order, so the first path of each inode
+// is used as the target.
+func (tg *tarGenerator) addLinkTargets(root string, skip map[string]struct{}) error {
+	var walk func(name string) error
+	walk = func(name string) error {
+		fis, err := tg.fsEval.Readdir(filepath.Join(root, name))
+		if err != nil {
+			return errors.Wrap(err, "readdir")
+		}
+		sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+
+		for _, fi := range fis {
+			childName := filepath.Join(name, fi.Name())
+			if fi.IsDir() {
+				if err := walk(childName); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, ok := skip[childName]; ok {
+				continue
+			}
+
+			statx, err := tg.fsEval.Lstatx(filepath.Join(root, childName))
+			if err != nil {
+				return errors.Wrapf(err, "lstatx %q", childName)
+			}
+			if statx.Nlink <= 1 {
+				continue
+			}
+			if _, ok := tg.linkTargets[statx.Ino]; !ok {
+				target, err := normalise(childName, false)
+				if err != nil {
+					return errors.Wrap(err, "normalise path")
+				}
+				tg.linkTargets[statx.Ino] = target
+			}
+		}
+		return nil
 	}
+	return walk(".")
 }
 
 // normalise converts the provided pathname to a POSIX-compliant pathname. It also will provide an error if a path looks unsafe.
@@ -115,6 +173,29 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		return errors.Wrap(err, "add file lstat")
 	}
 
+	// Special files may be skipped (or forbidden) entirely. Note that sockets
+	// cannot be represented in a tar archive.
+	var kind string
+	var policy SpecialFilePolicy
+	switch {
+	case fi.Mode()&os.ModeNamedPipe == os.ModeNamedPipe:
+		kind = "named pipe"
+		policy, err = tg.mapOptions.fifoPolicy()
+	case fi.Mode()&os.ModeSocket == os.ModeSocket:
+		kind = "socket"
+		policy, err = tg.mapOptions.socketPolicy()
+	}
+	if err != nil {
+		return err
+	}
+	switch policy {
+	case SpecialFileSkip:
+		log.Warnf("generate layer: skipping %s %s", kind, name)
+		return nil
+	case SpecialFileError:
+		return errors.Errorf("%s is not permitted by policy: %s", kind, name)
+	}
+
 	linkname := ""
 	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 		if linkname, err = tg.fsEval.Readlink(path); err != nil {
@@ -192,6 +273,13 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		hdr.Typeflag = tar.TypeLink
 		hdr.Linkname = oldpath
 		hdr.Size = 0
+	} else if target, ok := tg.linkTargets[statx.Ino]; ok && !fi.IsDir() {
+		// This is a new hardlink to a file which is already in the layers
+		// below this one.
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = target
+		hdr.Size = 0
+		tg.inodes[statx.Ino] = target
 	} else {
 		tg.inodes[statx.Ino] = name
 	}
@@ -200,6 +288,9 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	if err := mapHeader(hdr, tg.mapOptions); err != nil {
 		return errors.Wrap(err, "map header")
 	}
+	tg.rewriter.rewrite(hdr)
+	tg.mapOptions.OwnerNames.setNames(hdr)
+	tg.setFormat(hdr)
 	if err := tg.tw.WriteHeader(hdr); err != nil {
 		return errors.Wrap(err, "write header")
 	}
@@ -212,7 +303,7 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		}
 		defer fh.Close()
 
-		n, err := io.Copy(tg.tw, fh)
+		n, err := pooledCopy(tg.tw, fh)
 		if err != nil {
 			return errors.Wrap(err, "copy to layer")
 		}
@@ -224,6 +315,23 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	return nil
 }
 
+// setFormat sets the format of the given header. We always use PAX (which
+// falls back to USTAR if the header can be represented as a USTAR header), so
+// that long or non-ASCII names, large IDs and large files are stored
+// losslessly rather than using GNU extensions. The access and change times
+// are cleared, because they would make layers non-reproducible and are not
+// restored when extracting anyway. Unless SubsecondTimes is set, the
+// modification time is rounded to the nearest second (which avoids the need
+// for PAX headers for most files).
+func (tg *tarGenerator) setFormat(hdr *tar.Header) {
+	hdr.Format = tar.FormatPAX
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	if !tg.mapOptions.SubsecondTimes {
+		hdr.ModTime = hdr.ModTime.Round(time.Second)
+	}
+}
+
 const whPrefix = ".wh."
 
 // AddWhiteout adds a whiteout file for the given name inside the tar archive.
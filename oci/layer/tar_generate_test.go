@@ -377,3 +377,144 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		t.Errorf("not all paths had a whiteout entry generated (only read %d, expected %d)!", idx, len(paths))
 	}
 }
+
+func TestTarGeneratePAXRoundTrip(t *testing.T) {
+	for _, subsecond := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SubsecondTimes=%v", subsecond), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestTarGeneratePAXRoundTrip")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			src := filepath.Join(dir, "src")
+			dst := filepath.Join(dir, "dst")
+			for _, path := range []string{src, dst} {
+				if err := os.Mkdir(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			longDir := strings.Repeat("long directory name ", 10)
+			names := []string{
+				"short",
+				"ünïcødé ファイル",
+				"new\nline",
+				"tab\tand trailing space ",
+				longDir,
+				filepath.Join(longDir, strings.Repeat("x", 200)),
+			}
+			mtime := time.Unix(1500000000, 123456789)
+			for _, name := range names {
+				path := filepath.Join(src, name)
+				if name == longDir {
+					err = os.Mkdir(path, 0755)
+				} else {
+					err = ioutil.WriteFile(path, []byte(name), 0644)
+				}
+				if err != nil {
+					t.Fatalf("create %q: %s", name, err)
+				}
+			}
+			for _, name := range names {
+				if err := os.Chtimes(filepath.Join(src, name), mtime, mtime); err != nil {
+					t.Fatalf("chtimes %q: %s", name, err)
+				}
+			}
+
+			// Large IDs need PAX headers.
+			opt := MapOptions{
+				SubsecondTimes: subsecond,
+				ChownRules:     []ChownRule{{Pattern: "/short", UID: 3000000, GID: 4000000}},
+			}
+			rewriter, err := newHeaderRewriter(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := new(bytes.Buffer)
+			tg := newTarGenerator(buf, opt)
+			tg.rewriter = rewriter
+			for _, name := range names {
+				if err := tg.AddFile(name, filepath.Join(src, name)); err != nil {
+					t.Fatalf("AddFile %q: unexpected error: %s", name, err)
+				}
+			}
+			if err := tg.tw.Close(); err != nil {
+				t.Fatalf("tw.Close: unexpected error: %s", err)
+			}
+			layer := buf.Bytes()
+
+			expectedTime := mtime.Round(time.Second)
+			if subsecond {
+				expectedTime = mtime
+			}
+
+			tr := tar.NewReader(bytes.NewReader(layer))
+			for idx := 0; ; idx++ {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					if idx != len(names) {
+						t.Errorf("expected %d entries, got %d", len(names), idx)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("reading tar archive: %s", err)
+				}
+				if idx >= len(names) {
+					t.Fatalf("got unexpected entry %q", hdr.Name)
+				}
+
+				name := names[idx]
+				if name == longDir {
+					name += "/"
+				}
+				if hdr.Name != name {
+					t.Errorf("hdr.Name changed: expected %q, got %q", name, hdr.Name)
+				}
+				if hdr.Format&tar.FormatGNU == tar.FormatGNU {
+					t.Errorf("%q: GNU format used", hdr.Name)
+				}
+				if !hdr.ModTime.Equal(expectedTime) {
+					t.Errorf("%q: hdr.ModTime: expected %s, got %s", hdr.Name, expectedTime, hdr.ModTime)
+				}
+				if !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() {
+					t.Errorf("%q: hdr.AccessTime and hdr.ChangeTime should not be set", hdr.Name)
+				}
+				if name == "short" {
+					if hdr.Uid != 3000000 || hdr.Gid != 4000000 {
+						t.Errorf("%q: expected owner 3000000:4000000, got %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+					}
+					if hdr.Format == tar.FormatUSTAR {
+						t.Errorf("%q: USTAR format used for large IDs", hdr.Name)
+					}
+				}
+			}
+
+			// Make sure that the layer can be extracted again.
+			if err := UnpackLayer(dst, bytes.NewReader(layer), &MapOptions{Rootless: true}); err != nil {
+				t.Fatalf("unexpected error unpacking layer: %+v", err)
+			}
+			for _, name := range names {
+				fi, err := os.Lstat(filepath.Join(dst, name))
+				if err != nil {
+					t.Errorf("lstat %q: unexpected error: %s", name, err)
+					continue
+				}
+				if !fi.ModTime().Equal(expectedTime) {
+					t.Errorf("%q: mtime: expected %s, got %s", name, expectedTime, fi.ModTime())
+				}
+				if fi.IsDir() {
+					continue
+				}
+				data, err := ioutil.ReadFile(filepath.Join(dst, name))
+				if err != nil {
+					t.Errorf("read %q: unexpected error: %s", name, err)
+				} else if string(data) != name {
+					t.Errorf("%q: unexpected contents %q", name, data)
+				}
+			}
+		})
+	}
+}
@@ -19,9 +19,9 @@ package layer
 
 import (
 	"archive/tar"
+	"syscall"
 
 	"github.com/openSUSE/umoci/pkg/system"
-	"golang.org/x/sys/unix"
 )
 
 // These values come from new_decode_dev() inside <linux/kdev_t.h>.
@@ -34,10 +34,10 @@ func minor(device uint64) uint64 {
 	return (device & 0xff) | ((device >> 12) & 0xfff00)
 }
 
-func updateHeader(hdr *tar.Header, s unix.Stat_t) {
+func updateHeader(hdr *tar.Header, s system.Stat_t) {
 	// Currently the Go stdlib doesn't fill in the major/minor numbers of
 	// devices, so we have to do it manually.
-	if s.Mode&unix.S_IFBLK == unix.S_IFBLK || s.Mode&unix.S_IFCHR == unix.S_IFCHR {
+	if s.Mode&syscall.S_IFBLK == syscall.S_IFBLK || s.Mode&syscall.S_IFCHR == syscall.S_IFCHR {
 		hdr.Devmajor = int64(system.Majordev(system.Dev_t(s.Rdev)))
 		hdr.Devminor = int64(system.Minordev(system.Dev_t(s.Rdev)))
 	}
@@ -0,0 +1,209 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// tmpfileThreshold is the size above which regular files are extracted with
+// atomicCreator.CreateAtomic (if the Filesystem supports it), so that large
+// files never become visible with only part of their contents (such as when
+// umoci is killed during extraction).
+const tmpfileThreshold = 1 << 20
+
+// preallocateThreshold is the size above which space for regular files is
+// preallocated before they are extracted, to reduce fragmentation and to fail
+// before writing the file if there isn't enough space.
+const preallocateThreshold = 64 << 10
+
+// errAtomicUnsupported is returned by atomicCreator.CreateAtomic if a file
+// cannot be created atomically, in which case Filesystem.Create should be
+// used instead.
+var errAtomicUnsupported = errors.New("atomic file creation not supported")
+
+// atomicCreator is an optional interface implemented by Filesystems which
+// can create regular files atomically.
+type atomicCreator interface {
+	// CreateAtomic returns an atomicFile which will replace the regular file
+	// (if any) at the given path once it is committed.
+	CreateAtomic(path string) (atomicFile, error)
+}
+
+// atomicFile is a regular file which isn't visible until Commit is called.
+// Closing an atomicFile before it is committed discards it.
+type atomicFile interface {
+	io.WriteCloser
+
+	// Commit gives the file its name, replacing any existing file, and
+	// closes it.
+	Commit() error
+}
+
+// CreateAtomic creates a file with O_TMPFILE, which is only supported for
+// the default FsEval. The rootless and portable FsEvals have to work around
+// permission problems which O_TMPFILE doesn't help with.
+func (fs fsEvalFilesystem) CreateAtomic(path string) (atomicFile, error) {
+	if fs.FsEval != fseval.DefaultFsEval {
+		return nil, errAtomicUnsupported
+	}
+	file, err := system.OpenTmpfile(filepath.Dir(path), 0644)
+	if system.IsTmpfileUnsupported(err) {
+		return nil, errAtomicUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tmpfile{File: file, path: path}, nil
+}
+
+// tmpfile is an atomicFile created with O_TMPFILE.
+type tmpfile struct {
+	*os.File
+	path   string
+	closed bool
+}
+
+// Commit links the file into place. Because linkat(2) cannot replace an
+// existing file, the file is first linked to a temporary name and then
+// renamed over the path.
+func (f *tmpfile) Commit() error {
+	var tmpPath string
+	for i := 0; ; i++ {
+		tmpPath = fmt.Sprintf("%s.umoci-tmpfile-%d", f.path, i)
+		err := system.LinkTmpfile(f.File, tmpPath)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return errors.Wrap(err, "link tmpfile")
+		}
+	}
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "rename tmpfile")
+	}
+	return f.Close()
+}
+
+// Close closes the file, which discards it if it wasn't committed.
+func (f *tmpfile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	return f.File.Close()
+}
+
+// writeRegular writes the contents of a regular file entry to path, which
+// must either not exist or be a regular file.
+func (te *tarExtractor) writeRegular(path string, hdr *tar.Header, r io.Reader) error {
+	// If the file being replaced was recorded as the source for reflinking
+	// duplicate files, its inode is about to be modified.
+	if te.reflinks != nil {
+		if fi, err := te.fs.Lstat(path); err == nil {
+			te.reflinks.forget(fi)
+		}
+	}
+
+	var fh io.WriteCloser
+	var commit func() error
+	if creator, ok := te.fs.(atomicCreator); ok && hdr.Size >= tmpfileThreshold {
+		file, err := creator.CreateAtomic(path)
+		if err != nil && err != errAtomicUnsupported {
+			return errors.Wrap(err, "create regular atomic")
+		}
+		if err == nil {
+			fh, commit = file, file.Commit
+		}
+	}
+	if fh == nil {
+		file, err := te.fs.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "create regular")
+		}
+		fh, commit = file, file.Close
+	}
+	defer fh.Close()
+
+	if file, ok := fh.(interface {
+		Fd() uintptr
+	}); ok && hdr.Size >= preallocateThreshold {
+		if err := system.Fallocate(file.Fd(), hdr.Size); err != nil {
+			return errors.Wrap(err, "preallocate regular")
+		}
+	}
+
+	// Hash the contents if we might be able to reflink the file to a
+	// duplicate file extracted earlier.
+	var w io.Writer = fh
+	var digester digest.Digester
+	if te.reflinks.wants(te.fs, hdr.Size) {
+		digester = digest.SHA256.Digester()
+		w = io.MultiWriter(fh, digester.Hash())
+	}
+
+	// We need to make sure that we copy all of the bytes. Note that the
+	// contents can't be moved with splice(2) or copy_file_range(2) here, as
+	// every byte of the layer has to pass through userspace anyway so that
+	// the DiffID can be verified.
+	if n, err := pooledCopy(w, r); err != nil {
+		return err
+	} else if int64(n) != hdr.Size {
+		return errors.Wrap(io.ErrShortWrite, "unpack to regular file")
+	}
+
+	// Commit (or force close) here so that we don't affect the metadata.
+	if err := commit(); err != nil {
+		return err
+	}
+	if digester != nil {
+		if err := te.reflinks.reflink(te.fs, path, digester.Digest(), hdr.Size); err != nil {
+			return errors.Wrap(err, "reflink duplicate")
+		}
+	}
+	return nil
+}
+
+// copyFileContents copies the rest of the contents of in to out, using
+// copy_file_range(2) so the data doesn't have to be copied through userspace
+// where the kernel supports it (and sharing the underlying storage on
+// filesystems that support reflinks), and falling back to a userspace copy
+// otherwise.
+func copyFileContents(out, in *os.File) error {
+	fi, err := in.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat source")
+	}
+	if _, err := system.CopyFileRange(out.Fd(), in.Fd(), fi.Size()); err != nil && !system.IsCopyUnsupported(err) {
+		return errors.Wrap(err, "copy file range")
+	}
+	// Copy anything copy_file_range(2) didn't (either because it isn't
+	// supported, or because the file grew after we stat'd it).
+	_, err = pooledCopy(out, in)
+	return err
+}
@@ -0,0 +1,151 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnpackLargeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLargeFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The existing file is hardlinked. Large files are replaced atomically,
+	// so only the path in the layer should be replaced.
+	if err := ioutil.WriteFile(filepath.Join(dir, "large"), []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "large"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{3 * tmpfileThreshold, tmpfileThreshold, tmpfileThreshold - 1} {
+		contents := bytes.Repeat([]byte{byte(size)}, size)
+
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     "large",
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+			Size:     int64(size),
+			ModTime:  time.Now(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := UnpackLayer(dir, buf, testMapOptions()); err != nil {
+			t.Fatalf("size %d: unexpected error unpacking layer: %+v", size, err)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "large"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, contents) {
+			t.Errorf("size %d: extracted file has the wrong contents", size)
+		}
+		fi, err := os.Lstat(filepath.Join(dir, "large"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("size %d: extracted file has the wrong mode: %v", size, fi.Mode())
+		}
+
+		// No temporary files may be left behind.
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 2 {
+			t.Errorf("size %d: unexpected entries in root: %v", size, infos)
+		}
+
+		// O_TMPFILE is only used by the default FsEval.
+		if os.Geteuid() != 0 || size < tmpfileThreshold {
+			continue
+		}
+		data, err = ioutil.ReadFile(filepath.Join(dir, "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "old contents" {
+			t.Errorf("size %d: hardlink was modified by extraction: got %d bytes", size, len(data))
+		}
+	}
+}
+
+func TestCopyFileContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestCopyFileContents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, size := range []int{0, 1, 3 * tmpfileThreshold} {
+		contents := bytes.Repeat([]byte{byte(size + 1)}, size)
+		src := filepath.Join(dir, "src")
+		if err := ioutil.WriteFile(src, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		in, err := os.Open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only the rest of the source (from its current offset) is copied.
+		skip := size / 2
+		if _, err := in.Seek(int64(skip), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.Create(filepath.Join(dir, "dst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := copyFileContents(out, in); err != nil {
+			t.Fatalf("size %d: unexpected error copying: %+v", size, err)
+		}
+		in.Close()
+		out.Close()
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "dst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, contents[skip:]) {
+			t.Errorf("size %d: copied file has the wrong contents: got %d bytes", size, len(data))
+		}
+	}
+}
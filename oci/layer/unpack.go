@@ -19,22 +19,25 @@ package layer
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	// Import is necessary for go-digest.
 	_ "crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	iconv "github.com/openSUSE/umoci/oci/config/convert"
+	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/idtools"
 	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/openSUSE/umoci/pkg/telemetry"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
@@ -52,7 +55,42 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 	if opt != nil {
 		mapOptions = *opt
 	}
-	te := newTarExtractor(mapOptions)
+	return UnpackLayerFS(OSFilesystem(mapOptions), root, layer, opt)
+}
+
+// UnpackLayerFS is equivalent to UnpackLayer, except that the layer is
+// unpacked onto the given Filesystem rather than the host filesystem. This
+// allows for layers to be applied to virtual filesystems (such as a
+// memfs.Filesystem), where root is interpreted as a path within the
+// Filesystem.
+func UnpackLayerFS(fs Filesystem, root string, layer io.Reader, opt *MapOptions) error {
+	return unpackLayerFS(context.Background(), fs, root, layer, opt, nil, nil, nil)
+}
+
+// unpackLayerFS is the implementation of UnpackLayerFS. If devices is not
+// nil, it is used to track device nodes recorded because of
+// DevicePolicyRecord across several layers. Similarly, if conflicts is not
+// nil, the conflicts found with ConflictWarn are added to it, and if reflinks
+// is not nil it is used to find duplicate files across several layers with
+// MapOptions.ReflinkDuplicates.
+func unpackLayerFS(ctx context.Context, fs Filesystem, root string, layer io.Reader, opt *MapOptions, devices deviceRecords, conflicts *conflictReport, reflinks *reflinkIndex) (Err error) {
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
+
+	_, span := telemetry.StartSpan(ctx, "layer.unpack", map[string]string{"root": root})
+	defer func() { span.End(Err) }()
+
+	te := newTarExtractorFS(fs, mapOptions)
+	if devices != nil {
+		te.devices = devices
+	}
+	te.conflicts = conflicts
+	if reflinks != nil && mapOptions.ReflinkDuplicates {
+		te.reflinks = reflinks
+	}
+	limiter := newEntryLimiter(mapOptions)
 	tr := tar.NewReader(layer)
 	for {
 		hdr, err := tr.Next()
@@ -62,24 +100,23 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 		if err != nil {
 			return errors.Wrap(err, "read next entry")
 		}
+		if err := limiter.add(hdr.Name); err != nil {
+			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
+		}
+		size := hdr.Size
 		if err := te.unpackEntry(root, hdr, tr); err != nil {
 			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
 		}
+		telemetry.AddCounter(telemetry.CounterFilesExtracted, 1)
+		telemetry.AddCounter(telemetry.CounterBytesExtracted, size)
 	}
-	return nil
+	return errors.Wrap(te.restoreDirTimes(), "restore directory times")
 }
 
 // RootfsName is the name of the rootfs directory inside the bundle path when
 // generated.
 const RootfsName = "rootfs"
 
-// isLayerType returns if the given MediaType is the media type of an image
-// layer blob. This includes both distributable and non-distributable images.
-func isLayerType(mediaType string) bool {
-	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
-}
-
 // UnpackManifest extracts all of the layers in the given manifest, as well as
 // generating a runtime bundle and configuration. The rootfs is extracted to
 // <bundle>/<layer.RootfsName>. Some verification is done during image
@@ -87,7 +124,34 @@ func isLayerType(mediaType string) bool {
 //
 // FIXME: This interface is ugly.
 func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions) error {
-	engineExt := casext.NewEngine(engine)
+	return unpackManifest(ctx, engine, bundle, manifest, opt, false, 0)
+}
+
+// ResumeUnpackManifest continues an UnpackManifest of the same manifest to
+// the same bundle which did not complete. Layers which were already applied to
+// the rootfs (as recorded in the progress file) are skipped. An error is
+// returned if there is no recorded progress for the bundle.
+func ResumeUnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions) error {
+	return unpackManifest(ctx, engine, bundle, manifest, opt, true, 0)
+}
+
+// UnpackManifestLayers is the same as UnpackManifest, except that only the
+// layers of the manifest from start up to (but not including) end are applied
+// to the rootfs (see UnpackRootfsLayers).
+func UnpackManifestLayers(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, start, end int, opt *MapOptions) error {
+	if err := checkLayerRange(manifest, start, end); err != nil {
+		return err
+	}
+	manifest.Layers = manifest.Layers[:end]
+	return unpackManifest(ctx, engine, bundle, manifest, opt, false, start)
+}
+
+func unpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions, resume bool, skip int) (Err error) {
+	ctx, span := telemetry.StartSpan(ctx, "layer.unpack_manifest", map[string]string{
+		"bundle": bundle,
+		"config": manifest.Config.Digest.String(),
+	})
+	defer func() { span.End(Err) }()
 
 	// Create the bundle directory. We only error out if config.json or rootfs/
 	// already exists, because we cannot be sure that the user intended us to
@@ -106,38 +170,182 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		return errors.Wrap(err, "bundle path empty")
 	}
 
-	if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
-		if err == nil {
-			err = fmt.Errorf("%s already exists", RootfsName)
-		}
-		return errors.Wrap(err, "bundle path empty")
+	if err := unpackRootfs(ctx, engine, rootfsPath, manifest, opt, resume, skip); err != nil {
+		return errors.Wrap(err, "unpack rootfs")
 	}
 
-	if err := os.Mkdir(rootfsPath, 0755); err != nil {
-		return errors.Wrap(err, "mkdir rootfs")
+	// Generate a runtime configuration file from ispec.Image.
+	log.Infof("unpack configuration: %s", manifest.Config.Digest)
+	configFile, err := os.Create(configPath)
+	if err != nil {
+		return errors.Wrap(err, "open config.json")
 	}
+	defer configFile.Close()
 
-	// Make sure that the owner is correct.
-	rootUID, err := idtools.ToHost(0, opt.UIDMappings)
-	if err != nil {
-		return errors.Wrap(err, "ensure rootuid has mapping")
+	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, opt); err != nil {
+		return errors.Wrap(err, "unpack config.json")
 	}
-	rootGID, err := idtools.ToHost(0, opt.GIDMappings)
-	if err != nil {
-		return errors.Wrap(err, "ensure rootgid has mapping")
+	return nil
+}
+
+// UnpackRootfs extracts all of the layers in the given manifest to the rootfs
+// path (which must not already exist), without generating a runtime
+// configuration. The DiffIDs of each layer are verified during extraction.
+//
+// While unpacking, the set of layers which have been completely applied is
+// recorded in a progress file (see ProgressPath), so that the extraction can
+// be continued with ResumeUnpackRootfs if it is interrupted. The progress
+// file is removed once all layers have been applied. With DevicePolicyRecord,
+// the device nodes in the final rootfs are recorded in the file returned by
+// DevicesPath, and with ConflictWarn the conflicts between layers are
+// recorded in the file returned by ConflictsPath. With MapOptions.Verity,
+// fs-verity is enabled on the regular files of the final rootfs and their
+// digests are recorded in the file returned by VerityPath. With
+// MapOptions.Snapshots, the extraction starts from the snapshot with the most
+// layers of the manifest, and a snapshot is saved after each layer.
+func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *MapOptions) error {
+	return unpackRootfs(ctx, engine, rootfsPath, manifest, opt, false, 0)
+}
+
+// UnpackRootfsSkipLayers is the same as UnpackRootfs, except that the first
+// skip layers of the manifest (usually the layers of a base image which has
+// already been extracted elsewhere) are not applied. The result is a partial
+// rootfs which only contains the changes made by the remaining layers.
+// Whiteouts of paths which only exist in the skipped layers have no effect.
+// The skipped layers are recorded as applied in the progress file, so
+// ResumeUnpackRootfs can be used to continue an interrupted extraction.
+func UnpackRootfsSkipLayers(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, skip int, opt *MapOptions) error {
+	if skip < 0 || skip > len(manifest.Layers) {
+		return errors.Errorf("cannot skip %d layers of manifest with %d layers", skip, len(manifest.Layers))
 	}
-	if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
-		return errors.Wrap(err, "chown rootfs")
+	return unpackRootfs(ctx, engine, rootfsPath, manifest, opt, false, skip)
+}
+
+// UnpackRootfsLayers is the same as UnpackRootfs, except that only the layers
+// of the manifest from start up to (but not including) end are applied. This
+// is mostly useful for finding which layer of an image causes a problem. The
+// result is a partial rootfs, and (as with UnpackRootfsSkipLayers) whiteouts
+// of paths which only exist in the layers before start have no effect. The
+// layers before start are recorded as applied in the progress file, so
+// ResumeUnpackRootfs can be used (with a manifest containing only the first
+// end layers) to continue an interrupted extraction.
+func UnpackRootfsLayers(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, start, end int, opt *MapOptions) error {
+	if err := checkLayerRange(manifest, start, end); err != nil {
+		return err
 	}
+	manifest.Layers = manifest.Layers[:end]
+	return unpackRootfs(ctx, engine, rootfsPath, manifest, opt, false, start)
+}
 
-	// Currently, many different images in the wild don't specify what the
-	// atime/mtime of the root directory is. This is a huge pain because it
-	// means that we can't ensure consistent unpacking. In order to get around
-	// this, we first set the mtime of the root directory to the Unix epoch
-	// (which is as good of an arbitrary choice as any).
-	epoch := time.Unix(0, 0)
-	if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
-		return errors.Wrap(err, "set initial root time")
+// checkLayerRange returns an error if [start, end) is not a valid range of
+// the layers of the manifest.
+func checkLayerRange(manifest ispec.Manifest, start, end int) error {
+	if casext.IsWasmManifest(manifest) {
+		return errors.Errorf("cannot unpack a range of layers of a wasm image")
+	}
+	if start < 0 || end > len(manifest.Layers) || start > end {
+		return errors.Errorf("invalid range of layers [%d, %d) of manifest with %d layers", start, end, len(manifest.Layers))
+	}
+	return nil
+}
+
+// ResumeUnpackRootfs continues an UnpackRootfs of the same manifest to the
+// same rootfs path which did not complete. The layer that was being applied
+// when the previous extraction was interrupted is applied again in full. An
+// error is returned if there is no recorded progress for the rootfs, or if the
+// progress was recorded for a different manifest.
+func ResumeUnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *MapOptions) error {
+	return unpackRootfs(ctx, engine, rootfsPath, manifest, opt, true, 0)
+}
+
+func unpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *MapOptions, resume bool, skip int) error {
+	engineExt := casext.NewEngine(engine)
+
+	if opt.Verity && (opt.Rootless || opt.Portable) {
+		return errors.Errorf("fs-verity cannot be enabled in rootless or portable mode")
+	}
+
+	// Wasm images contain modules rather than layers, so there is nothing to
+	// resume or skip.
+	if casext.IsWasmManifest(manifest) {
+		if resume || skip > 0 {
+			return errors.Errorf("cannot resume or skip layers of a wasm image")
+		}
+		return unpackWasmRootfs(ctx, engineExt, rootfsPath, manifest, opt)
+	}
+
+	// Start from the snapshot with the most layers of the image, which is the
+	// same as resuming an interrupted unpack.
+	snapshots := opt.Snapshots
+	if opt.OwnerNames != nil || skip > 0 {
+		snapshots = nil
+	}
+	if snapshots != nil && !resume {
+		seeded, err := snapshots.seed(ctx, engineExt, rootfsPath, manifest, *opt)
+		if err != nil {
+			return errors.Wrap(err, "seed rootfs from snapshot")
+		}
+		resume = seeded
+	}
+
+	// Skipped layers are treated as though they were already applied.
+	progress := newProgress(manifest, *opt)
+	for _, layerDescriptor := range manifest.Layers[:skip] {
+		log.Infof("skipping base layer: %s", layerDescriptor.Digest)
+		progress.Layers = append(progress.Layers, layerDescriptor.Digest)
+	}
+	devices := deviceRecords{}
+	conflicts := &conflictReport{}
+	reflinks := newReflinkIndex()
+	if resume {
+		var err error
+		progress, err = readProgress(rootfsPath)
+		if err != nil {
+			return errors.Wrap(err, "read progress")
+		}
+		devices, err = readDeviceRecords(rootfsPath)
+		if err != nil {
+			return errors.Wrap(err, "read device records")
+		}
+		conflicts.conflicts, err = ReadLayerConflicts(rootfsPath)
+		if err != nil {
+			return errors.Wrap(err, "read conflict report")
+		}
+		if err := progress.check(manifest, *opt); err != nil {
+			return errors.Wrap(err, "check progress")
+		}
+		log.Infof("resuming unpack: %d of %d layers already applied", len(progress.Layers), len(manifest.Layers))
+	} else {
+		if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", rootfsPath)
+			}
+			return errors.Wrap(err, "rootfs path empty")
+		}
+
+		if snapshots != nil {
+			if err := snapshots.mkdirRootfs(rootfsPath); err != nil {
+				return err
+			}
+		} else if err := os.Mkdir(rootfsPath, 0755); err != nil {
+			return errors.Wrap(err, "mkdir rootfs")
+		}
+		if err := progress.write(rootfsPath); err != nil {
+			return errors.Wrap(err, "write progress")
+		}
+		// Clear any stale device records and conflict reports.
+		if err := devices.write(rootfsPath); err != nil {
+			return errors.Wrap(err, "write device records")
+		}
+		if err := os.Remove(ConflictsPath(rootfsPath)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove conflict report")
+		}
+		if err := os.Remove(VerityPath(rootfsPath)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove verity records")
+		}
+		if err := initRootfs(rootfsPath, opt); err != nil {
+			return err
+		}
 	}
 
 	// In order to verify the DiffIDs as we extract layers, we have to get the
@@ -148,7 +356,7 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		return errors.Wrap(err, "get config blob")
 	}
 	defer configBlob.Close()
-	if configBlob.MediaType != ispec.MediaTypeImageConfig {
+	if !casext.IsConfigMediaType(configBlob.MediaType) {
 		return errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
 	}
 	config, ok := configBlob.Data.(ispec.Image)
@@ -162,57 +370,267 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		return errors.Errorf("unpack manifest: config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
 
+	// Make sure we have enough space to extract the remaining layers, rather
+	// than running out of space part-way through.
+	if !opt.SkipSpaceCheck && len(progress.Layers) < len(manifest.Layers) {
+		size, err := EstimateUnpackSize(ctx, engine, manifest.Layers[len(progress.Layers):])
+		if err != nil {
+			// Missing layers are handled (with a better error) below.
+			log.Warnf("cannot check free space: %v", err)
+		} else if err := CheckFreeSpace(rootfsPath, size+opt.MinFreeSpace); err != nil {
+			return err
+		}
+	}
+
 	// Layer extraction.
 	for idx, layerDescriptor := range manifest.Layers {
+		if idx < len(progress.Layers) {
+			if idx >= skip {
+				log.Infof("skipping already unpacked layer: %s", layerDescriptor.Digest)
+			}
+			continue
+		}
 		layerDiffID := config.RootFS.DiffIDs[idx]
 		log.Infof("unpack layer: %s", layerDescriptor.Digest)
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
+		layerRaw, cacheWriter, err := openUnpackLayer(ctx, engineExt, layerDescriptor, layerDiffID, opt)
 		if err != nil {
-			return errors.Wrap(err, "get layer blob")
-		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.MediaType) {
-			return errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
-		}
-		layerGzip, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+			return err
 		}
+		defer layerRaw.Close()
+		fromCache := layerRaw.blob == nil
 
-		// We have to extract a gzip'd version of the above layer. Also note
-		// that we have to check the DiffID we're extracting (which is the
-		// sha256 sum of the *uncompressed* layer).
-		layerRaw, err := gzip.NewReader(layerGzip)
-		if err != nil {
-			return errors.Wrap(err, "create gzip reader")
-		}
+		// We have to check the DiffID we're extracting (which is the sha256
+		// sum of the *uncompressed* layer).
 		layerDigester := digest.SHA256.Digester()
 		layer := io.TeeReader(layerRaw, layerDigester.Hash())
+		if cacheWriter != nil {
+			layer = io.TeeReader(layer, cacheWriter)
+		}
+
+		// Scan the layer as it is extracted.
+		finishScan := func(digest.Digest) error { return nil }
+		if opt.Scan != nil {
+			layer, finishScan = opt.Scan.Tee(layer)
+		}
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
+		conflicts.layer = layerDescriptor.Digest
+		if err := unpackLayerFS(ctx, OSFilesystem(*opt), rootfsPath, layer, opt, devices, conflicts, reflinks); err != nil {
+			finishScan(layerDescriptor.Digest)
+			if cacheWriter != nil {
+				cacheWriter.abort()
+			}
 			return errors.Wrap(err, "unpack layer")
 		}
+		// Make sure the padding after the end of the archive is included in
+		// the DiffID (and the cached layer).
+		if _, err := io.Copy(ioutil.Discard, layer); err != nil {
+			if cacheWriter != nil {
+				cacheWriter.abort()
+			}
+			return errors.Wrap(err, "read layer padding")
+		}
 		// XXX: Is it possible this breaks in the error path?
-		layerGzip.Close()
+		layerRaw.Close()
+		if err := finishScan(layerDescriptor.Digest); err != nil {
+			if cacheWriter != nil {
+				cacheWriter.abort()
+			}
+			return err
+		}
 
 		layerDigest := layerDigester.Digest()
 		if layerDigest != layerDiffID {
+			if cacheWriter != nil {
+				cacheWriter.abort()
+			}
+			if fromCache {
+				// Don't use the corrupted layer again.
+				if err := opt.LayerCache.Remove(layerDiffID); err != nil {
+					log.Warnf("layer cache: %v", err)
+				}
+			}
 			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
 		}
+		if cacheWriter != nil {
+			if err := cacheWriter.commit(); err != nil {
+				log.Warnf("layer cache: cannot add layer %s: %v", layerDiffID, err)
+			}
+		}
+
+		// The device records and conflict report must be written before the
+		// progress, so that resuming doesn't lose the records of an applied
+		// layer.
+		if opt.DevicePolicy == DevicePolicyRecord {
+			if err := devices.write(rootfsPath); err != nil {
+				return errors.Wrap(err, "write device records")
+			}
+		}
+		if opt.ConflictPolicy == ConflictWarn {
+			if err := conflicts.write(rootfsPath); err != nil {
+				return errors.Wrap(err, "write conflict report")
+			}
+		}
+		progress.Layers = append(progress.Layers, layerDescriptor.Digest)
+		if err := progress.write(rootfsPath); err != nil {
+			return errors.Wrap(err, "write progress")
+		}
+
+		// Snapshots are only an optimisation.
+		if snapshots != nil {
+			if err := snapshots.save(rootfsPath, config.RootFS.DiffIDs[:idx+1], *opt); err != nil {
+				log.Warnf("cannot save snapshot of layer %s: %v", layerDescriptor.Digest, err)
+			}
+		}
 	}
 
-	// Generate a runtime configuration file from ispec.Image.
-	log.Infof("unpack configuration: %s", configBlob.Digest)
-	configFile, err := os.Create(configPath)
+	// The progress is only removed once fs-verity has been enabled, so that
+	// an interrupted unpack can still be resumed (files on which fs-verity
+	// was already enabled are left alone).
+	if opt.Verity {
+		if err := sealRootfs(rootfsPath); err != nil {
+			return errors.Wrap(err, "enable fs-verity")
+		}
+	}
+	if err := os.Remove(ProgressPath(rootfsPath)); err != nil {
+		return errors.Wrap(err, "remove progress")
+	}
+	if reflinks.reflinked > 0 {
+		log.Infof("reflinked %d duplicate files (%s)", reflinks.reflinked, units.HumanSize(float64(reflinks.saved)))
+	}
+	if opt.LayerCache != nil {
+		if err := opt.LayerCache.Evict(); err != nil {
+			log.Warnf("layer cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// layerReader is the uncompressed form of a layer, read either from an image
+// or from a LayerCache. Closing it also closes the layer blob (if any).
+type layerReader struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+// Close implements io.Closer.
+func (r *layerReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.blob != nil {
+		if err2 := r.blob.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// openUnpackLayer returns the uncompressed form of the layer with the given
+// descriptor and DiffID. If cache is not nil and contains the layer, the
+// layer is read from the cache. Otherwise the layer blob is decompressed and,
+// if cache is not nil and the layer is compressed, a layerCacheWriter is also
+// returned so that the uncompressed layer can be added to the cache once its
+// DiffID has been verified. The returned layer is limited by the
+// MaxLayerSize and MaxCompressionRatio of opt.
+func openUnpackLayer(ctx context.Context, engineExt casext.Engine, layerDescriptor ispec.Descriptor, layerDiffID digest.Digest, opt *MapOptions) (*layerReader, *layerCacheWriter, error) {
+	maxSize, maxRatio := layerLimits(opt)
+	cache := opt.LayerCache
+	if cache != nil {
+		cached, err := cache.Open(layerDiffID)
+		if err == nil {
+			log.Infof("using cached uncompressed layer: %s", layerDiffID)
+			limited := &limitedLayerReader{ReadCloser: cached, maxSize: maxSize}
+			return &layerReader{ReadCloser: limited}, nil, nil
+		}
+		if !os.IsNotExist(errors.Cause(err)) {
+			log.Warnf("layer cache: %v", err)
+		}
+	}
+
+	layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
 	if err != nil {
-		return errors.Wrap(err, "open config.json")
+		// Non-distributable layers are not required to be present in the
+		// image, so give a more helpful error message.
+		if casext.IsNonDistributableMediaType(layerDescriptor.MediaType) && os.IsNotExist(errors.Cause(err)) {
+			return nil, nil, errors.Errorf("unpack manifest: layer %s: non-distributable layer is not present in image (urls: %v)", layerDescriptor.Digest, layerDescriptor.URLs)
+		}
+		return nil, nil, errors.Wrap(err, "get layer blob")
+	}
+	if !casext.IsLayerMediaType(layerBlob.MediaType) {
+		layerBlob.Close()
+		return nil, nil, errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
+	}
+	layerBlobReader, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		// Should _never_ be reached.
+		layerBlob.Close()
+		return nil, nil, errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
 	}
-	defer configFile.Close()
 
-	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, opt); err != nil {
-		return errors.Wrap(err, "unpack config.json")
+	// We have to decompress the above layer (according to its media type),
+	// keeping track of how much of the blob has been read so that the
+	// compression ratio can be limited.
+	compressed := &countingReader{r: layerBlobReader}
+	layerRaw, err := DecompressLayer(layerDescriptor.MediaType, compressed)
+	if err != nil {
+		layerBlob.Close()
+		return nil, nil, errors.Wrapf(err, "unpack manifest: layer %s", layerDescriptor.Digest)
+	}
+	limited := &limitedLayerReader{ReadCloser: layerRaw, maxSize: maxSize}
+	if isCompressedMediaType(layerDescriptor.MediaType) {
+		limited.compressed = compressed
+		limited.maxRatio = maxRatio
+	}
+	reader := &layerReader{ReadCloser: limited, blob: layerBlobReader}
+
+	// There's no point caching layers which aren't compressed.
+	var cacheWriter *layerCacheWriter
+	if cache != nil && isCompressedMediaType(layerDescriptor.MediaType) {
+		cacheWriter, err = cache.create(layerDiffID)
+		if err != nil {
+			log.Warnf("layer cache: cannot add layer %s: %v", layerDiffID, err)
+			cacheWriter = nil
+		}
+	}
+	return reader, cacheWriter, nil
+}
+
+// initRootfs sets the initial owner and timestamps of a newly created rootfs
+// directory.
+func initRootfs(rootfsPath string, opt *MapOptions) error {
+	// Make sure that the owner is correct.
+	rootUID, err := idtools.ToHost(0, opt.UIDMappings)
+	if err != nil {
+		return errors.Wrap(err, "ensure rootuid has mapping")
+	}
+	rootGID, err := idtools.ToHost(0, opt.GIDMappings)
+	if err != nil {
+		return errors.Wrap(err, "ensure rootgid has mapping")
+	}
+	if !opt.Portable {
+		if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
+			return errors.Wrap(err, "chown rootfs")
+		}
+	}
+
+	// The rootfs was created with a mode affected by the umask.
+	if !opt.ApplyUmask {
+		if err := os.Chmod(rootfsPath, implicitDirMode); err != nil {
+			return errors.Wrap(err, "chmod rootfs")
+		}
+	}
+
+	// Currently, many different images in the wild don't specify what the
+	// atime/mtime of the root directory is. This is a huge pain because it
+	// means that we can't ensure consistent unpacking. In order to get around
+	// this, we first set the mtime of the root directory to the Unix epoch
+	// (which is as good of an arbitrary choice as any).
+	epoch := time.Unix(0, 0)
+	lutimes := system.Lutimes
+	if opt.Portable {
+		lutimes = fseval.PortableFsEval.Lutimes
+	}
+	if err := lutimes(rootfsPath, epoch, epoch); err != nil {
+		return errors.Wrap(err, "set initial root time")
 	}
 	return nil
 }
@@ -234,26 +652,31 @@ func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Wri
 		mapOptions = *opt
 	}
 
-	// In order to verify the DiffIDs as we extract layers, we have to get the
-	// .Config blob first. But we can't extract it (generate the runtime
-	// config) until after we have the full rootfs generated.
-	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
-	if err != nil {
-		return errors.Wrap(err, "get config blob")
-	}
-	defer configBlob.Close()
-	if configBlob.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
-	}
-	config, ok := configBlob.Data.(ispec.Image)
-	if !ok {
-		// Should _never_ be reached.
-		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
-	}
-
 	g := rgen.New()
-	if err := iconv.MutateRuntimeSpec(g, rootfs, config); err != nil {
-		return errors.Wrap(err, "generate config.json")
+	if casext.IsWasmManifest(manifest) {
+		if err := mutateWasmRuntimeSpec(ctx, engineExt, g, rootfs, manifest); err != nil {
+			return errors.Wrap(err, "generate config.json")
+		}
+	} else {
+		// In order to verify the DiffIDs as we extract layers, we have to get
+		// the .Config blob first. But we can't extract it (generate the
+		// runtime config) until after we have the full rootfs generated.
+		configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+		if err != nil {
+			return errors.Wrap(err, "get config blob")
+		}
+		defer configBlob.Close()
+		if !casext.IsConfigMediaType(configBlob.MediaType) {
+			return errors.Errorf("unpack manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+		}
+		config, ok := configBlob.Data.(ispec.Image)
+		if !ok {
+			// Should _never_ be reached.
+			return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+		}
+		if err := iconv.MutateRuntimeSpec(g, rootfs, config); err != nil {
+			return errors.Wrap(err, "generate config.json")
+		}
 	}
 
 	// Add UIDMapping / GIDMapping options.
@@ -37,6 +37,157 @@ type MapOptions struct {
 
 	// Rootless specifies whether any to error out if chown fails.
 	Rootless bool `json:"rootless"`
+
+	// Portable specifies whether only operations that are available on every
+	// host operating system should be used. If set, ownership is not
+	// restored, device nodes are replaced with empty files and xattrs are
+	// dropped. Portable implies the ownership semantics of Rootless.
+	Portable bool `json:"portable,omitempty"`
+
+	// DevicePolicy specifies how device nodes are handled during extraction.
+	// If unset, DevicePolicyCreate is used.
+	DevicePolicy DevicePolicy `json:"device_policy,omitempty"`
+
+	// FifoPolicy specifies how named pipes are handled when extracting and
+	// generating layers. If unset, SpecialFileInclude is used.
+	FifoPolicy SpecialFilePolicy `json:"fifo_policy,omitempty"`
+
+	// SocketPolicy specifies how sockets are handled when generating layers
+	// (sockets cannot be stored in layers). If unset, SpecialFileSkip is used.
+	SocketPolicy SpecialFilePolicy `json:"socket_policy,omitempty"`
+
+	// PathCollisionPolicy specifies how paths which only differ in their
+	// Unicode normalisation form are handled during extraction. If
+	// CaseInsensitive is set, paths which only differ in case are also
+	// considered to collide. If unset, PathCollisionIgnore is used.
+	PathCollisionPolicy PathCollisionPolicy `json:"path_collision_policy,omitempty"`
+	CaseInsensitive     bool                `json:"case_insensitive,omitempty"`
+
+	// ConflictPolicy specifies how suspicious interactions between layers
+	// (such as replacing a directory with a symlink) are handled during
+	// extraction. If unset, ConflictIgnore is used.
+	ConflictPolicy ConflictPolicy `json:"conflict_policy,omitempty"`
+
+	// ChownRules and ChmodRules are applied to the ownership and permissions
+	// of entries (after any ID mapping) when generating layers. They are not
+	// used when unpacking layers, and are not saved in the bundle metadata.
+	ChownRules []ChownRule `json:"-"`
+	ChmodRules []ChmodRule `json:"-"`
+
+	// OwnerNames, if set, causes the owners of entries to be resolved by name
+	// when extracting layers, and their names to be recorded when generating
+	// layers (see OwnerNames). It is not saved in the bundle metadata.
+	OwnerNames *OwnerNames `json:"-"`
+
+	// SubsecondTimes specifies whether the sub-second component of
+	// modification times should be preserved when generating layers (which
+	// requires PAX headers for every entry). By default they are rounded to
+	// the nearest second. It is not saved in the bundle metadata.
+	SubsecondTimes bool `json:"-"`
+
+	// PreserveHardlinks specifies whether files which are hardlinked to files
+	// that are not in the generated layer (because they are unchanged) should
+	// be added to the layer as hardlinks to those files, so that the hardlink
+	// count of the files is preserved when the layer is extracted. Files whose
+	// only change is their hardlink count are then omitted from the layer. By
+	// default such files are copied into the layer. It is not saved in the
+	// bundle metadata.
+	PreserveHardlinks bool `json:"-"`
+
+	// PrefetchProfile, if not nil, is the list of paths (in the order they
+	// are accessed) which should be placed at the start of generated layers,
+	// followed by a PrefetchLandmark entry (or, if none of the paths are in
+	// the layer, with a NoPrefetchLandmark entry at the start of the layer).
+	// This allows lazy pulling implementations (such as estargz) to prefetch
+	// the files needed to start a container. Landmark entries are ignored
+	// when unpacking layers. It is not saved in the bundle metadata.
+	PrefetchProfile []string `json:"-"`
+
+	// MinFreeSpace is the number of bytes which must remain free (in
+	// addition to the estimated size of the layers) when extracting a rootfs,
+	// otherwise extraction fails before any layers are applied. If
+	// SkipSpaceCheck is set, the free space is not checked at all. Neither is
+	// saved in the bundle metadata.
+	MinFreeSpace   int64 `json:"-"`
+	SkipSpaceCheck bool  `json:"-"`
+
+	// MaxLayerSize is the largest decompressed size (in bytes) of a layer
+	// which will be extracted, and MaxCompressionRatio is the largest ratio
+	// between the decompressed and compressed size of a layer, so that a
+	// crafted layer cannot fill the disk (see ErrLayerTooLarge). A
+	// MaxLayerSize of zero means there is no size limit, while a
+	// MaxCompressionRatio of zero means DefaultMaxCompressionRatio (a
+	// negative ratio disables the check). Neither is saved in the bundle
+	// metadata.
+	MaxLayerSize        int64 `json:"-"`
+	MaxCompressionRatio int64 `json:"-"`
+
+	// MaxLayerEntries is the largest number of entries a single layer can
+	// have, and MaxPathDepth is the largest number of components the path of
+	// an entry can have, so that a crafted layer cannot exhaust inodes or
+	// create directory trees too deep to be handled (see
+	// ErrLayerTooComplex). Zero means DefaultMaxLayerEntries (or
+	// DefaultMaxPathDepth), and a negative value disables the check. Neither
+	// is saved in the bundle metadata.
+	MaxLayerEntries int64 `json:"-"`
+	MaxPathDepth    int   `json:"-"`
+
+	// ApplyUmask specifies whether the process umask should be applied to
+	// the modes of extracted entries (and the directories created for
+	// entries whose parent directories are not in the layer). By default,
+	// modes are applied exactly as recorded in the layer, and missing parent
+	// directories are created with mode 0755.
+	ApplyUmask bool `json:"apply_umask,omitempty"`
+
+	// OmitTimes specifies whether the access and modification times of every
+	// extracted entry (and of the directories created for entries whose parent
+	// directories are not in the layer) should be set to the Unix epoch rather
+	// than the times recorded in the layer, so that the extracted root
+	// filesystem only depends on the contents of the layers.
+	OmitTimes bool `json:"omit_times,omitempty"`
+
+	// StripACLs specifies whether ACLs (the system.posix_acl_access,
+	// system.posix_acl_default and system.nfs4_acl xattrs) should be removed
+	// when extracting and generating layers. By default they are preserved,
+	// and the IDs in POSIX ACLs are mapped in the same way as the owner of
+	// the file (except in rootless or portable mode).
+	StripACLs bool `json:"strip_acls,omitempty"`
+
+	// ReflinkDuplicates specifies whether regular files with the same
+	// contents as a file extracted earlier (from any layer of the rootfs)
+	// should be reflinked to that file, so that they share storage on
+	// filesystems which support reflinks (such as btrfs and XFS). The files
+	// remain independent copies (modifying one does not modify the other).
+	// It is ignored if the filesystem doesn't support reflinks, and is not
+	// saved in the bundle metadata.
+	ReflinkDuplicates bool `json:"-"`
+
+	// Verity specifies whether fs-verity should be enabled on every regular
+	// file once a rootfs has been extracted with UnpackRootfs, so that the
+	// kernel verifies the contents of the files whenever they are read (and
+	// the contents can no longer be modified). The digests are recorded in
+	// the file returned by VerityPath, and are checked by VerifyRootfs. It is
+	// not supported in rootless or portable mode.
+	Verity bool `json:"verity,omitempty"`
+
+	// Scan, if set, is used to scan every layer applied when extracting a
+	// rootfs (layers skipped or already applied when resuming are not
+	// scanned). It is not saved in the bundle metadata.
+	Scan *LayerScan `json:"-"`
+
+	// LayerCache, if set, is used to cache the uncompressed form of the
+	// layers applied when extracting a rootfs, so that they don't need to be
+	// decompressed when they are next extracted. It is not saved in the
+	// bundle metadata.
+	LayerCache *LayerCache `json:"-"`
+
+	// Snapshots, if set, is used to store a snapshot of the rootfs after
+	// each layer is applied by UnpackRootfs, and to start from the snapshot
+	// with the most layers of the image (rather than an empty rootfs) when
+	// unpacking a new rootfs. It is not used with OwnerNames (since the
+	// owners depend on the whole image) or when skipping layers, and is not
+	// saved in the bundle metadata.
+	Snapshots *SnapshotStore `json:"-"`
 }
 
 // mapHeader maps a tar.Header generated from the filesystem so that it
@@ -47,7 +198,7 @@ type MapOptions struct {
 func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 	// If we're in rootless mode, we assume all of the files are owned by
 	// (0, 0) in the container -- since we cannot map any other users.
-	if mapOptions.Rootless {
+	if mapOptions.Rootless || mapOptions.Portable {
 		hdr.Uid, _ = idtools.ToHost(0, mapOptions.UIDMappings)
 		hdr.Gid, _ = idtools.ToHost(0, mapOptions.GIDMappings)
 	}
@@ -63,7 +214,14 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 
 	hdr.Uid = newUID
 	hdr.Gid = newGID
-	return nil
+
+	// Map the IDs in any ACLs in the same way.
+	var uidFn, gidFn idMapFunc
+	if !mapOptions.Rootless && !mapOptions.Portable {
+		uidFn = func(id int) (int, error) { return idtools.ToContainer(id, mapOptions.UIDMappings) }
+		gidFn = func(id int) (int, error) { return idtools.ToContainer(id, mapOptions.GIDMappings) }
+	}
+	return errors.Wrap(mapACLXattrs(hdr, mapOptions.StripACLs, uidFn, gidFn), "map acls to container")
 }
 
 // unmapHeader maps a tar.Header from a tar layer stream so that it describes
@@ -71,10 +229,14 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 // involves applying an ID mapping from the container filesystem to the host
 // mappings. Returns an error if it's not possible to map the given UID.
 func unmapHeader(hdr *tar.Header, mapOptions MapOptions) error {
+	// Resolve the owner by name if requested, before applying the mapping
+	// (the names are resolved to IDs inside the container).
+	mapOptions.OwnerNames.resolveIDs(hdr)
+
 	// If we're in rootless mode we assume that all of the files in the layer
 	// are owned by (0, 0) because we cannot map any other users in the
 	// container (and we cannot Lchown to any user other than ourselves).
-	if mapOptions.Rootless {
+	if mapOptions.Rootless || mapOptions.Portable {
 		hdr.Uid = 0
 		hdr.Gid = 0
 	}
@@ -90,7 +252,14 @@ func unmapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 
 	hdr.Uid = newUID
 	hdr.Gid = newGID
-	return nil
+
+	// Map the IDs in any ACLs in the same way.
+	var uidFn, gidFn idMapFunc
+	if !mapOptions.Rootless && !mapOptions.Portable {
+		uidFn = func(id int) (int, error) { return idtools.ToHost(id, mapOptions.UIDMappings) }
+		gidFn = func(id int) (int, error) { return idtools.ToHost(id, mapOptions.GIDMappings) }
+	}
+	return errors.Wrap(mapACLXattrs(hdr, mapOptions.StripACLs, uidFn, gidFn), "map acls to host")
 }
 
 // CleanPath makes a path safe for use with filepath.Join. This is done by not
@@ -0,0 +1,495 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/fsverity"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RootfsDifferenceType is the kind of difference between a rootfs and the
+// layers it was extracted from.
+type RootfsDifferenceType string
+
+const (
+	// RootfsMissing means that a path in the layers does not exist in the
+	// rootfs.
+	RootfsMissing RootfsDifferenceType = "missing"
+
+	// RootfsExtra means that a path in the rootfs does not exist in the
+	// layers. Children of such paths are not reported.
+	RootfsExtra RootfsDifferenceType = "extra"
+
+	// RootfsModified means that a path exists in both, but some of its
+	// properties differ (see RootfsDifference.Fields).
+	RootfsModified RootfsDifferenceType = "modified"
+)
+
+// RootfsDifference describes a single path in a rootfs which does not match
+// the layers it was extracted from.
+type RootfsDifference struct {
+	// Path is the cleaned absolute path inside the rootfs.
+	Path string `json:"path"`
+
+	// Type is the kind of difference.
+	Type RootfsDifferenceType `json:"type"`
+
+	// Fields is the set of properties which differ for RootfsModified paths
+	// (one or more of "type", "mode", "uid", "gid", "size", "sha256", "link",
+	// "device" and "verity").
+	Fields []string `json:"fields,omitempty"`
+}
+
+// verifyInode is the expected state of an inode in the rootfs. Hardlinks in
+// the layers share the same verifyInode.
+type verifyInode struct {
+	typeflag byte
+	mode     os.FileMode
+	uid, gid int
+	size     int64
+	digest   digest.Digest
+	verity   string
+	linkname string
+	devmajor int64
+	devminor int64
+
+	// implicit is set for parent directories which were not included in the
+	// layers, in which case only the type is verified.
+	implicit bool
+}
+
+// modeBits are the bits of os.FileMode which are restored during extraction.
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// rootfsVerifier builds the expected state of a rootfs from a layer stack,
+// with the same semantics as UnpackLayer.
+type rootfsVerifier struct {
+	opt     MapOptions
+	umask   os.FileMode
+	entries map[string]*verifyInode
+
+	// verity is the set of fs-verity digests recorded when the rootfs was
+	// extracted (with MapOptions.Verity), keyed by path.
+	verity map[string]string
+}
+
+// remove removes the given path (and everything below it) from the expected
+// state.
+func (v *rootfsVerifier) remove(path string) {
+	for entryPath := range v.entries {
+		if entryPath == path || strings.HasPrefix(entryPath, path+"/") {
+			delete(v.entries, entryPath)
+		}
+	}
+}
+
+// addParents adds implicit directories for any of the parents of path which
+// are not in the expected state.
+func (v *rootfsVerifier) addParents(path string) {
+	for dir := filepath.Dir(path); dir != "/"; dir = filepath.Dir(dir) {
+		if _, ok := v.entries[dir]; ok {
+			break
+		}
+		v.entries[dir] = &verifyInode{typeflag: tar.TypeDir, implicit: true}
+	}
+}
+
+// addLayer applies the given uncompressed layer archive to the expected
+// state.
+func (v *rootfsVerifier) addLayer(layer io.Reader) error {
+	fifoPolicy, err := v.opt.fifoPolicy()
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		path := filepath.Join("/", hdr.Name)
+		if path == "/" || isPrefetchLandmark(hdr) {
+			continue
+		}
+		dir, file := filepath.Split(path)
+
+		if strings.HasPrefix(file, whOpaquePrefix) {
+			return errors.Errorf("%s: opaque whiteouts are not supported", path)
+		}
+		if strings.HasPrefix(file, whPrefix) {
+			v.remove(filepath.Join(dir, strings.TrimPrefix(file, whPrefix)))
+			continue
+		}
+
+		typeflag := hdr.Typeflag
+		switch typeflag {
+		case tar.TypeRegA, tar.TypeGNUSparse, tar.TypeCont:
+			typeflag = tar.TypeReg
+		}
+
+		// Directories are merged with existing directories (but still have
+		// their metadata replaced), while anything else replaces the existing
+		// path.
+		if old, ok := v.entries[path]; !ok || old.typeflag != tar.TypeDir || typeflag != tar.TypeDir {
+			v.remove(path)
+		}
+		v.addParents(path)
+
+		// Hardlinks share the inode (and thus the metadata) of their target.
+		if typeflag == tar.TypeLink {
+			target, ok := v.entries[filepath.Join("/", hdr.Linkname)]
+			if !ok {
+				return errors.Errorf("%s: hardlink target does not exist: %s", path, hdr.Linkname)
+			}
+			v.entries[path] = target
+			continue
+		}
+
+		switch typeflag {
+		case tar.TypeChar, tar.TypeBlock:
+			switch v.opt.DevicePolicy {
+			case DevicePolicySkip, DevicePolicyRecord:
+				continue
+			}
+		case tar.TypeFifo:
+			if fifoPolicy != SpecialFileInclude {
+				continue
+			}
+		}
+
+		// Use the same owner and mode that would've been restored.
+		mapped := *hdr
+		if err := unmapHeader(&mapped, v.opt); err != nil {
+			return errors.Wrapf(err, "%s: unmap header", path)
+		}
+		inode := &verifyInode{
+			typeflag: typeflag,
+			mode:     mapped.FileInfo().Mode() & modeBits &^ v.umask,
+			uid:      mapped.Uid,
+			gid:      mapped.Gid,
+			linkname: hdr.Linkname,
+			devmajor: hdr.Devmajor,
+			devminor: hdr.Devminor,
+		}
+
+		switch typeflag {
+		case tar.TypeReg:
+			digester := digest.SHA256.Digester()
+			var w io.Writer = digester.Hash()
+			var verityDigester *fsverity.Digester
+			if v.opt.Verity {
+				verityDigester = fsverity.New()
+				w = io.MultiWriter(w, verityDigester)
+			}
+			size, err := pooledCopy(w, tr)
+			if err != nil {
+				return errors.Wrapf(err, "%s: hash contents", path)
+			}
+			inode.size = size
+			inode.digest = digester.Digest()
+			if verityDigester != nil {
+				inode.verity = verityDigestPrefix + verityDigester.Hex()
+			}
+		case tar.TypeChar, tar.TypeBlock:
+			// Device nodes are faked with empty files in rootless mode.
+			if v.opt.Rootless || v.opt.Portable {
+				inode.typeflag = tar.TypeReg
+				inode.digest = digest.SHA256.FromBytes(nil)
+			}
+		}
+		v.entries[path] = inode
+	}
+	return nil
+}
+
+// fileTypeflag returns the tar typeflag corresponding to the type of the
+// given file mode.
+func fileTypeflag(mode os.FileMode) byte {
+	switch {
+	case mode.IsDir():
+		return tar.TypeDir
+	case mode&os.ModeSymlink != 0:
+		return tar.TypeSymlink
+	case mode&os.ModeNamedPipe != 0:
+		return tar.TypeFifo
+	case mode&os.ModeDevice != 0:
+		if mode&os.ModeCharDevice != 0 {
+			return tar.TypeChar
+		}
+		return tar.TypeBlock
+	case mode.IsRegular():
+		return tar.TypeReg
+	}
+	// Sockets (and anything else) can never come from a layer.
+	return 0
+}
+
+// compare returns the set of fields of the file at the given path (with the
+// given fi) which do not match the expected inode.
+func (v *rootfsVerifier) compare(fsEval fseval.FsEval, rootfsPath, path string, fi os.FileInfo, inode *verifyInode) ([]string, error) {
+	fullPath := filepath.Join(rootfsPath, path)
+	if fileTypeflag(fi.Mode()) != inode.typeflag {
+		return []string{"type"}, nil
+	}
+	if inode.implicit {
+		return nil, nil
+	}
+
+	var fields []string
+	if inode.typeflag != tar.TypeSymlink && fi.Mode()&modeBits != inode.mode {
+		fields = append(fields, "mode")
+	}
+	if !v.opt.Rootless && !v.opt.Portable {
+		st, err := fsEval.Lstatx(fullPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "lstatx")
+		}
+		if int(st.Uid) != inode.uid {
+			fields = append(fields, "uid")
+		}
+		if int(st.Gid) != inode.gid {
+			fields = append(fields, "gid")
+		}
+		if inode.typeflag == tar.TypeChar || inode.typeflag == tar.TypeBlock {
+			dev := system.Dev_t(st.Rdev)
+			if int64(system.Majordev(dev)) != inode.devmajor || int64(system.Minordev(dev)) != inode.devminor {
+				fields = append(fields, "device")
+			}
+		}
+	}
+
+	switch inode.typeflag {
+	case tar.TypeReg:
+		if fi.Size() != inode.size {
+			fields = append(fields, "size")
+			break
+		}
+		fh, err := fsEval.Open(fullPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "open")
+		}
+		defer fh.Close()
+		digester := digest.SHA256.Digester()
+		if _, err := io.Copy(digester.Hash(), fh); err != nil {
+			return nil, errors.Wrap(err, "hash contents")
+		}
+		if digester.Digest() != inode.digest {
+			fields = append(fields, "sha256")
+		}
+		if v.opt.Verity {
+			ok, err := v.checkVerity(fh, path, inode)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				fields = append(fields, "verity")
+			}
+		}
+	case tar.TypeSymlink:
+		linkname, err := fsEval.Readlink(fullPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "readlink")
+		}
+		if linkname != inode.linkname {
+			fields = append(fields, "link")
+		}
+	}
+	return fields, nil
+}
+
+// checkVerity returns whether fs-verity is enabled on the given open file
+// (at path inside the rootfs), and whether both its fs-verity digest and the
+// recorded digest match the expected inode.
+func (v *rootfsVerifier) checkVerity(fh *os.File, path string, inode *verifyInode) (bool, error) {
+	if v.verity[path] != inode.verity {
+		return false, nil
+	}
+	measured, err := system.MeasureVerity(fh.Fd())
+	if system.IsVerityNotEnabled(err) || system.IsVerityUnsupported(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "measure fs-verity")
+	}
+	return verityDigestPrefix+measured == inode.verity, nil
+}
+
+// check compares the rootfs at rootfsPath with the expected state.
+func (v *rootfsVerifier) check(rootfsPath string) ([]RootfsDifference, error) {
+	fsEval := fseval.DefaultFsEval
+	if v.opt.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	if v.opt.Portable {
+		fsEval = fseval.PortableFsEval
+	}
+
+	var diffs []RootfsDifference
+	seen := map[string]struct{}{}
+	visited := map[string]struct{}{"/": {}}
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		fis, err := fsEval.Readdir(filepath.Join(rootfsPath, dir))
+		if err != nil {
+			return errors.Wrapf(err, "readdir %s", dir)
+		}
+		for _, fi := range fis {
+			path := filepath.Join(dir, fi.Name())
+			inode, ok := v.entries[path]
+			if !ok {
+				diffs = append(diffs, RootfsDifference{Path: path, Type: RootfsExtra})
+				continue
+			}
+			seen[path] = struct{}{}
+
+			fields, err := v.compare(fsEval, rootfsPath, path, fi, inode)
+			if err != nil {
+				return errors.Wrapf(err, "compare %s", path)
+			}
+			if len(fields) > 0 {
+				diffs = append(diffs, RootfsDifference{Path: path, Type: RootfsModified, Fields: fields})
+			}
+			if fi.IsDir() && inode.typeflag == tar.TypeDir {
+				visited[path] = struct{}{}
+				if err := walk(path); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return nil, err
+	}
+
+	// Only report missing paths whose parent was checked, to avoid reporting
+	// every child of a missing (or replaced) directory.
+	for path := range v.entries {
+		if _, ok := seen[path]; ok {
+			continue
+		}
+		if _, ok := visited[filepath.Dir(path)]; ok {
+			diffs = append(diffs, RootfsDifference{Path: path, Type: RootfsMissing})
+		}
+	}
+
+	sort.Sort(rootfsDifferencesByPath(diffs))
+	return diffs, nil
+}
+
+// VerifyRootfs compares the rootfs at rootfsPath with the state it should be
+// in after the layers of the given manifest were extracted with the given
+// MapOptions (using UnpackRootfs), and returns the set of differences in the
+// type, mode, ownership, contents or link target of each path (sorted by
+// path). Unlike an mtree specification of the rootfs, the expected state is
+// derived entirely from the image, and the DiffID of each layer is verified
+// against the image configuration. Times and xattrs are not verified. With
+// MapOptions.Verity, fs-verity must be enabled on every regular file, and
+// both its fs-verity digest and the digest recorded in the file returned by
+// VerityPath must match the contents of the file in the layers.
+func VerifyRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *MapOptions) ([]RootfsDifference, error) {
+	engineExt := casext.NewEngine(engine)
+
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
+	v := &rootfsVerifier{
+		opt:     mapOptions,
+		entries: map[string]*verifyInode{},
+	}
+	if mapOptions.ApplyUmask {
+		v.umask = system.Umask()
+	}
+	if mapOptions.Verity {
+		records, err := ReadVerityRecords(rootfsPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "read verity records")
+		}
+		v.verity = map[string]string{}
+		for _, record := range records {
+			v.verity[record.Path] = record.Digest
+		}
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return nil, errors.Errorf("verify rootfs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, errors.Errorf("verify rootfs: config has %d diffids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	for idx, descriptor := range manifest.Layers {
+		log.Infof("verify layer: %s", descriptor.Digest)
+
+		reader, err := openLayer(ctx, engine, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open layer %s", descriptor.Digest)
+		}
+		digester := digest.SHA256.Digester()
+		tee := io.TeeReader(reader, digester.Hash())
+		err = v.addLayer(tee)
+		if err == nil {
+			// Make sure any trailing padding is included in the DiffID.
+			_, err = io.Copy(ioutil.Discard, tee)
+		}
+		reader.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s", descriptor.Digest)
+		}
+		if got, expected := digester.Digest(), config.RootFS.DiffIDs[idx]; got != expected {
+			return nil, errors.Errorf("verify rootfs: layer %s: diffid mismatch: got %s expected %s", descriptor.Digest, got, expected)
+		}
+	}
+
+	return v.check(rootfsPath)
+}
+
+type rootfsDifferencesByPath []RootfsDifference
+
+func (d rootfsDifferencesByPath) Len() int           { return len(d) }
+func (d rootfsDifferencesByPath) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d rootfsDifferencesByPath) Less(i, j int) bool { return d[i].Path < d[j].Path }
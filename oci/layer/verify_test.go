@@ -0,0 +1,110 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestVerifyRootfs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestVerifyRootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := putTestManifest(t, engine, []string{"a", "b", "c"})
+	opt := testMapOptions()
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := UnpackRootfs(ctx, engine, rootfs, manifest, opt); err != nil {
+		t.Fatalf("unexpected error unpacking rootfs: %s", err)
+	}
+
+	diffs, err := VerifyRootfs(ctx, engine, rootfs, manifest, opt)
+	if err != nil {
+		t.Fatalf("unexpected error verifying rootfs: %s", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("unexpected differences in unmodified rootfs: %v", diffs)
+	}
+
+	// Tamper with the rootfs.
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "a"), []byte("contents of X"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(rootfs, "b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(rootfs, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "d", "e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err = VerifyRootfs(ctx, engine, rootfs, manifest, opt)
+	if err != nil {
+		t.Fatalf("unexpected error verifying rootfs: %s", err)
+	}
+	expected := []RootfsDifference{
+		{Path: "/a", Type: RootfsModified, Fields: []string{"sha256"}},
+		{Path: "/b", Type: RootfsModified, Fields: []string{"mode"}},
+		{Path: "/c", Type: RootfsMissing},
+		{Path: "/d", Type: RootfsExtra},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("unexpected differences: got %v, expected %v", diffs, expected)
+	}
+
+	// A configuration with the wrong DiffIDs must be rejected.
+	engineExt := casext.NewEngine(engine)
+	config := ispec.Image{}
+	config.RootFS.Type = "layers"
+	for range manifest.Layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.SHA256.FromString("bad"))
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := manifest
+	bad.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+	if _, err := VerifyRootfs(ctx, engine, rootfs, bad, opt); err == nil {
+		t.Errorf("expected diffid mismatch to fail")
+	}
+}
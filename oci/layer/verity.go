@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// VerityRecord describes a regular file in a rootfs on which fs-verity was
+// enabled because of MapOptions.Verity.
+type VerityRecord struct {
+	// Path is the path of the file, relative to the root of the rootfs.
+	Path string `json:"path"`
+
+	// Digest is the fs-verity digest of the file, in the same form as
+	// printed by fsverity-measure(1) ("sha256:<hex>").
+	Digest string `json:"digest"`
+}
+
+// veritySuffix is appended to the rootfs path to get the path of the file
+// used to record fs-verity digests.
+const veritySuffix = ".umoci-verity"
+
+// verityDigestPrefix is prepended to hex fs-verity digests in VerityRecords.
+const verityDigestPrefix = "sha256:"
+
+// VerityPath returns the path of the file in which the fs-verity digests of
+// the regular files in the rootfs are recorded (with MapOptions.Verity).
+// Like ProgressPath, it is placed next to (rather than inside) the rootfs.
+func VerityPath(rootfsPath string) string {
+	return filepath.Clean(rootfsPath) + veritySuffix
+}
+
+// ReadVerityRecords reads the fs-verity digests recorded for the given
+// rootfs, sorted by path. If no digests were recorded, no error is returned.
+func ReadVerityRecords(rootfsPath string) ([]VerityRecord, error) {
+	data, err := ioutil.ReadFile(VerityPath(rootfsPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read verity records")
+	}
+
+	var records []VerityRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, errors.Wrap(err, "parse verity records")
+	}
+	return records, nil
+}
+
+// writeVerityRecords writes the given records to the file returned by
+// VerityPath.
+func writeVerityRecords(rootfsPath string, records []VerityRecord) error {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Path < records[j].Path
+	})
+	data, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "marshal verity records")
+	}
+	return errors.Wrap(ioutil.WriteFile(VerityPath(rootfsPath), data, 0644), "write verity records")
+}
+
+// enableFileVerity enables fs-verity on the regular file at path (if it isn't
+// already enabled, such as for hardlinks) and returns its fs-verity digest.
+func enableFileVerity(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "open")
+	}
+	defer fh.Close()
+
+	if err := system.EnableVerity(fh.Fd()); err != nil && !system.IsVerityEnabled(err) {
+		if system.IsVerityUnsupported(err) {
+			return "", errors.Errorf("filesystem does not support fs-verity (it may need to be enabled with tune2fs -O verity)")
+		}
+		return "", errors.Wrap(err, "enable fs-verity")
+	}
+	digest, err := system.MeasureVerity(fh.Fd())
+	if err != nil {
+		return "", errors.Wrap(err, "measure fs-verity")
+	}
+	return verityDigestPrefix + digest, nil
+}
+
+// sealRootfs enables fs-verity on every regular file in the rootfs, and
+// records their digests in the file returned by VerityPath. Enabling
+// fs-verity makes the contents of the files immutable, so this must only be
+// done once all layers have been extracted.
+func sealRootfs(rootfsPath string) error {
+	log.Info("enabling fs-verity on rootfs")
+
+	var records []VerityRecord
+	if err := filepath.Walk(rootfsPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(rootfsPath, path)
+		if err != nil {
+			return errors.Wrap(err, "get relative path")
+		}
+		digest, err := enableFileVerity(path)
+		if err != nil {
+			return errors.Wrapf(err, "seal %s", rel)
+		}
+		records = append(records, VerityRecord{
+			Path:   filepath.Join("/", rel),
+			Digest: digest,
+		})
+		return nil
+	}); err != nil {
+		return err
+	}
+	log.Infof("enabled fs-verity on %d files", len(records))
+	return writeVerityRecords(rootfsPath, records)
+}
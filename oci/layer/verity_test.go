@@ -0,0 +1,144 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"golang.org/x/net/context"
+)
+
+func TestVerityRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestVerityRecords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+
+	records, err := ReadVerityRecords(rootfs)
+	if err != nil || records != nil {
+		t.Errorf("missing verity records should be empty: %v (%v)", records, err)
+	}
+
+	written := []VerityRecord{
+		{Path: "/b", Digest: "sha256:" + verityHex(t, "b")},
+		{Path: "/a/b", Digest: "sha256:" + verityHex(t, "ab")},
+		{Path: "/a-b", Digest: "sha256:" + verityHex(t, "a-b")},
+	}
+	if err := writeVerityRecords(rootfs, written); err != nil {
+		t.Fatalf("unexpected error writing verity records: %+v", err)
+	}
+	records, err = ReadVerityRecords(rootfs)
+	if err != nil {
+		t.Fatalf("unexpected error reading verity records: %+v", err)
+	}
+	if expected := []string{"/a-b", "/a/b", "/b"}; len(records) != len(expected) {
+		t.Errorf("unexpected verity records: %v", records)
+	} else {
+		for idx, record := range records {
+			if record.Path != expected[idx] {
+				t.Errorf("verity records not sorted by path: %v", records)
+				break
+			}
+		}
+	}
+}
+
+func TestVerifyRootfsVerity(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "umoci-TestVerifyRootfsVerity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+
+	engine := mem.New()
+	defer engine.Close()
+
+	layer := makeOwnerLayer(t, []tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "empty", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "link", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "dir/file"},
+	}, map[string]string{"dir/file": "hello"})
+	manifest := putLayersManifest(t, engine, [][]byte{layer})
+
+	// The expected fs-verity digests are computed from the layers.
+	opt := testMapOptions()
+	opt.Verity = true
+	v := &rootfsVerifier{opt: *opt, entries: map[string]*verifyInode{}}
+	if err := v.addLayer(bytes.NewReader(layer)); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	for path, contents := range map[string]string{"/dir/file": "hello", "/empty": ""} {
+		if got, expected := v.entries[path].verity, "sha256:"+verityHex(t, contents); got != expected {
+			t.Errorf("%s: unexpected verity digest: got %s, expected %s", path, got, expected)
+		}
+	}
+
+	// fs-verity cannot be enabled in rootless mode.
+	rootlessOpt := *opt
+	rootlessOpt.Rootless = true
+	if err := UnpackRootfs(ctx, engine, rootfs, manifest, &rootlessOpt); err == nil {
+		t.Errorf("expected error unpacking with fs-verity in rootless mode")
+	}
+
+	// Files which don't have fs-verity enabled (or whose recorded digest is
+	// wrong) are reported.
+	plainOpt := *opt
+	plainOpt.Verity = false
+	if err := UnpackRootfs(ctx, engine, rootfs, manifest, &plainOpt); err != nil {
+		t.Fatalf("unexpected error unpacking rootfs: %+v", err)
+	}
+	if err := writeVerityRecords(rootfs, []VerityRecord{
+		{Path: "/dir/file", Digest: "sha256:" + verityHex(t, "hello")},
+		{Path: "/empty", Digest: "sha256:" + verityHex(t, "wrong")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := VerifyRootfs(ctx, engine, rootfs, manifest, opt)
+	if err != nil {
+		t.Fatalf("unexpected error verifying rootfs: %+v", err)
+	}
+	expected := []RootfsDifference{
+		{Path: "/dir/file", Type: RootfsModified, Fields: []string{"verity"}},
+		{Path: "/empty", Type: RootfsModified, Fields: []string{"verity"}},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("unexpected differences: got %v, expected %v", diffs, expected)
+	}
+
+	// Without MapOptions.Verity, fs-verity isn't checked.
+	diffs, err = VerifyRootfs(ctx, engine, rootfs, manifest, &plainOpt)
+	if err != nil {
+		t.Fatalf("unexpected error verifying rootfs: %+v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+}
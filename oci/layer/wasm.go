@@ -0,0 +1,164 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	iconv "github.com/openSUSE/umoci/oci/config/convert"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rgen "github.com/opencontainers/runtime-tools/generate"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// WasmModuleName is the name (in the rootfs) of the first module of a wasm
+// image if its layer does not have an ispec.AnnotationTitle annotation. The
+// first module is the one run by the generated runtime configuration.
+const WasmModuleName = "module.wasm"
+
+// wasmModuleName returns the name (in the rootfs) of the module in the idx-th
+// layer of a wasm image. Titles which are not plain file names are ignored.
+func wasmModuleName(descriptor ispec.Descriptor, idx int) string {
+	name := descriptor.Annotations[ispec.AnnotationTitle]
+	if name != "" && name != "." && name != ".." && !strings.Contains(name, "/") {
+		return name
+	}
+	if idx == 0 {
+		return WasmModuleName
+	}
+	return descriptor.Digest.Hex() + ".wasm"
+}
+
+// unpackWasmRootfs extracts the modules of a wasm image (see
+// casext.IsWasmManifest) to the rootfs path, which must not already exist.
+// Each module is written to the root of the rootfs (see wasmModuleName), and
+// its contents are verified against its descriptor.
+func unpackWasmRootfs(ctx context.Context, engineExt casext.Engine, rootfsPath string, manifest ispec.Manifest, opt *MapOptions) error {
+	if _, err := engineExt.GetWasmConfig(ctx, manifest); err != nil {
+		return errors.Wrap(err, "get wasm config")
+	}
+
+	if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
+		if err == nil {
+			err = fmt.Errorf("%s already exists", rootfsPath)
+		}
+		return errors.Wrap(err, "rootfs path empty")
+	}
+	if err := os.Mkdir(rootfsPath, 0755); err != nil {
+		return errors.Wrap(err, "mkdir rootfs")
+	}
+	if err := initRootfs(rootfsPath, opt); err != nil {
+		return err
+	}
+
+	rootUID, err := idtools.ToHost(0, opt.UIDMappings)
+	if err != nil {
+		return errors.Wrap(err, "ensure rootuid has mapping")
+	}
+	rootGID, err := idtools.ToHost(0, opt.GIDMappings)
+	if err != nil {
+		return errors.Wrap(err, "ensure rootgid has mapping")
+	}
+
+	for idx, layerDescriptor := range manifest.Layers {
+		if layerDescriptor.MediaType != casext.MediaTypeWasmLayer {
+			return errors.Errorf("unpack wasm: layer %s has unsupported media type %s", layerDescriptor.Digest, layerDescriptor.MediaType)
+		}
+		path := filepath.Join(rootfsPath, wasmModuleName(layerDescriptor, idx))
+		log.Infof("unpack wasm module: %s", layerDescriptor.Digest)
+		if err := unpackWasmModule(ctx, engineExt, layerDescriptor, path); err != nil {
+			return errors.Wrapf(err, "unpack wasm module %s", layerDescriptor.Digest)
+		}
+		if !opt.Portable {
+			if err := os.Lchown(path, rootUID, rootGID); err != nil {
+				return errors.Wrap(err, "chown wasm module")
+			}
+		}
+	}
+	if opt.Verity {
+		if err := sealRootfs(rootfsPath); err != nil {
+			return errors.Wrap(err, "enable fs-verity")
+		}
+	}
+	return nil
+}
+
+// unpackWasmModule writes the blob with the given descriptor to path (which
+// must not already exist), verifying its contents against the descriptor.
+func unpackWasmModule(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor, path string) (Err error) {
+	reader, err := engineExt.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create module")
+	}
+	defer func() {
+		if err := fh.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close module")
+		}
+	}()
+
+	_, err = io.Copy(fh, reader)
+	return errors.Wrap(err, "copy module")
+}
+
+// mutateWasmRuntimeSpec fills the given runtime configuration for a wasm image
+// (see casext.IsWasmManifest) unpacked to rootfs, so that the first module is
+// run by the WebAssembly handler of the runtime (see iconv.AddWasmAnnotations).
+func mutateWasmRuntimeSpec(ctx context.Context, engineExt casext.Engine, g rgen.Generator, rootfs string, manifest ispec.Manifest) error {
+	config, err := engineExt.GetWasmConfig(ctx, manifest)
+	if err != nil {
+		return errors.Wrap(err, "get wasm config")
+	}
+	if len(manifest.Layers) == 0 {
+		return errors.Errorf("wasm image has no modules")
+	}
+
+	g.SetProcessTerminal(true)
+	g.SetRootPath(filepath.Base(rootfs))
+	g.SetRootReadonly(false)
+	g.SetProcessCwd("/")
+	g.SetProcessArgs([]string{"/" + wasmModuleName(manifest.Layers[0], 0)})
+	g.SetProcessUID(0)
+	g.SetProcessGID(0)
+
+	if config.Author != "" {
+		g.AddAnnotation(ispec.AnnotationAuthors, config.Author)
+	}
+	if config.Created != nil {
+		g.AddAnnotation(ispec.AnnotationCreated, config.Created.Format(igen.ISO8601))
+	}
+	iconv.AddWasmAnnotations(g)
+
+	// Remove all seccomp rules.
+	g.Spec().Linux.Seccomp = nil
+	return nil
+}
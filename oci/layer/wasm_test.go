@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/drivers/mem"
+	"github.com/openSUSE/umoci/oci/casext"
+	iconv "github.com/openSUSE/umoci/oci/config/convert"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+)
+
+// putWasmManifest stores a wasm image with the given modules (and their
+// titles) in the engine, and returns its manifest.
+func putWasmManifest(t *testing.T, engine cas.Engine, modules, titles []string) ispec.Manifest {
+	ctx := context.Background()
+	engineExt := casext.NewEngine(engine)
+
+	var manifest ispec.Manifest
+	config := casext.WasmConfig{
+		Architecture: "wasm",
+		OS:           "wasip1",
+	}
+	for idx, module := range modules {
+		moduleDigest, moduleSize, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte(module)))
+		if err != nil {
+			t.Fatalf("unexpected error putting module: %+v", err)
+		}
+		descriptor := ispec.Descriptor{
+			MediaType: casext.MediaTypeWasmLayer,
+			Digest:    moduleDigest,
+			Size:      moduleSize,
+		}
+		if titles[idx] != "" {
+			descriptor.Annotations = map[string]string{ispec.AnnotationTitle: titles[idx]}
+		}
+		manifest.Layers = append(manifest.Layers, descriptor)
+		config.LayerDigests = append(config.LayerDigests, moduleDigest)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %+v", err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: casext.MediaTypeWasmConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+	return manifest
+}
+
+func TestUnpackManifestWasm(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestWasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+
+	manifest := putWasmManifest(t, engine, []string{"\x00asm main", "\x00asm lib", "\x00asm bad"}, []string{"", "lib.wasm", "../escape.wasm"})
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifest(ctx, engine, bundle, manifest, testMapOptions()); err != nil {
+		t.Fatalf("UnpackManifest: unexpected error: %+v", err)
+	}
+
+	for name, expected := range map[string]string{
+		WasmModuleName: "\x00asm main",
+		"lib.wasm":     "\x00asm lib",
+		manifest.Layers[2].Digest.Hex() + ".wasm": "\x00asm bad",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(bundle, RootfsName, name))
+		if err != nil {
+			t.Errorf("read module %s: unexpected error: %+v", name, err)
+			continue
+		}
+		if string(data) != expected {
+			t.Errorf("module %s: got %q, expected %q", name, data, expected)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "escape.wasm")); !os.IsNotExist(err) {
+		t.Errorf("module title escaped the rootfs: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Process.Args) != 1 || spec.Process.Args[0] != "/"+WasmModuleName {
+		t.Errorf("unexpected process args: %v", spec.Process.Args)
+	}
+	if spec.Annotations[iconv.WasmVariantAnnotation] != "compat" || spec.Annotations[iconv.WasmHandlerAnnotation] != "wasm" {
+		t.Errorf("missing wasm annotations: %v", spec.Annotations)
+	}
+}
+
+func TestUnpackManifestWasmInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestWasmInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := mem.New()
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// The config must list the layers of the manifest.
+	manifest := putWasmManifest(t, engine, []string{"\x00asm"}, []string{""})
+	badConfig := casext.WasmConfig{Architecture: "wasm", OS: "wasip1", LayerDigests: []digest.Digest{digest.FromString("other")}}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, badConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badManifest := manifest
+	badManifest.Config.Digest = configDigest
+	badManifest.Config.Size = configSize
+	if err := UnpackManifest(ctx, engine, filepath.Join(root, "config"), badManifest, testMapOptions()); err == nil {
+		t.Errorf("expected mismatched layerDigests to fail")
+	}
+
+	// Layers must be wasm modules.
+	badManifest = manifest
+	badManifest.Layers = []ispec.Descriptor{manifest.Layers[0]}
+	badManifest.Layers[0].MediaType = ispec.MediaTypeImageLayer
+	if err := UnpackManifest(ctx, engine, filepath.Join(root, "layer"), badManifest, testMapOptions()); err == nil {
+		t.Errorf("expected non-wasm layer to fail")
+	}
+
+	// Wasm images cannot be resumed.
+	if err := ResumeUnpackRootfs(ctx, engine, filepath.Join(root, "resume"), manifest, testMapOptions()); err == nil {
+		t.Errorf("expected resume of wasm image to fail")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ClientOptions configures the HTTP client returned by NewClient.
+type ClientOptions struct {
+	// Proxy returns the proxy to use for a request (see http.Transport). If
+	// nil, the proxy is configured by $HTTP_PROXY, $HTTPS_PROXY and
+	// $NO_PROXY (see http.ProxyFromEnvironment).
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// LimitRate is the largest total rate (in bytes per second) at which the
+	// bodies of responses are read, shared by every request made with the
+	// client. Zero means no limit.
+	LimitRate int64
+
+	// MaxConnections is the largest number of connections the client opens
+	// to each host. Zero means no limit.
+	MaxConnections int
+}
+
+// NewClient returns an HTTP client (for PeerResolver.Client) which is
+// configured with the given options.
+func NewClient(opts ClientOptions) *http.Client {
+	proxy := opts.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	if opts.MaxConnections > 0 {
+		transport.MaxConnsPerHost = opts.MaxConnections
+		transport.MaxIdleConnsPerHost = opts.MaxConnections
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if opts.LimitRate > 0 {
+		roundTripper = &limitedTransport{
+			RoundTripper: transport,
+			limiter:      &rateLimiter{rate: opts.LimitRate},
+		}
+	}
+	return &http.Client{Transport: roundTripper}
+}
+
+// rateLimiter limits the rate at which bytes are read by several readers. Each
+// read reserves the time it would take to transfer at the limited rate,
+// after any earlier reservations, and waits until its reservation starts.
+type rateLimiter struct {
+	rate int64
+
+	lock sync.Mutex
+	next time.Time
+}
+
+// wait reserves the transfer of n bytes, and waits until the reservation
+// starts (or the context is cancelled).
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.lock.Unlock()
+
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedChunk is the largest number of bytes read at once by a
+// limitedReader, so that the rate is limited smoothly.
+const limitedChunk = 32 * 1024
+
+// limitedReader is an io.ReadCloser which reads from a response body at the
+// rate limited by a rateLimiter.
+type limitedReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+// Read implements io.Reader.
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitedChunk {
+		p = p[:limitedChunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if err2 := r.limiter.wait(r.ctx, n); err2 != nil {
+			return 0, err2
+		}
+	}
+	return n, err
+}
+
+// limitedTransport is an http.RoundTripper which limits the rate at which the
+// bodies of responses are read.
+type limitedTransport struct {
+	http.RoundTripper
+	limiter *rateLimiter
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &limitedReader{
+		ReadCloser: resp.Body,
+		ctx:        req.Context(),
+		limiter:    t.limiter,
+	}
+	return resp, nil
+}
@@ -0,0 +1,132 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientLimitRate(t *testing.T) {
+	body := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(body)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	// Two concurrent transfers of 256K share a limit of 1M per second, so they
+	// must take at least (most of) half a second.
+	client := NewClient(ClientOptions{LimitRate: 1024 * 1024})
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Errorf("unexpected error making request: %+v", err)
+				return
+			}
+			defer resp.Body.Close()
+			got, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("unexpected error reading body: %+v", err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("unexpected body contents")
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected transfers to be rate-limited: took %s", elapsed)
+	}
+}
+
+func TestClientMaxConnections(t *testing.T) {
+	var (
+		lock      sync.Mutex
+		active    int
+		maxActive int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lock.Lock()
+		active--
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	client := NewClient(ClientOptions{MaxConnections: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Errorf("unexpected error making request: %+v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if maxActive != 2 {
+		t.Errorf("expected 2 requests to be handled at the same time: got %d", maxActive)
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(ClientOptions{Proxy: http.ProxyURL(proxyURL)})
+	resp, err := client.Get("http://registry.invalid/v2/")
+	if err != nil {
+		t.Fatalf("unexpected error making request: %+v", err)
+	}
+	resp.Body.Close()
+	if len(proxied) != 1 || proxied[0] != "http://registry.invalid/v2/" {
+		t.Errorf("expected request to be proxied: got %v", proxied)
+	}
+}
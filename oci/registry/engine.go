@@ -0,0 +1,220 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/interop"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// remoteEngine is a read-only cas.Engine backed by a peer (see
+// NewRemoteEngine).
+type remoteEngine struct {
+	peer *PeerResolver
+	tag  string
+	keep cas.Engine
+
+	indexOnce sync.Once
+	index     ispec.Index
+	indexErr  error
+}
+
+// NewRemoteEngine returns a read-only cas.Engine which reads blobs directly
+// from the given peer as they are needed, without storing them locally. The
+// index of the engine only contains the given tag (resolved using the peer).
+// Every blob is verified against its digest while it is being read, with the
+// error being returned instead of io.EOF if it doesn't match.
+//
+// If keep is not nil, every blob read from the peer is also stored in keep
+// (the rest of the blob is read from the peer when the reader is closed, so
+// that only complete blobs are stored). The engine owns keep, and will close
+// it when it is closed. Note that the tag is not added to keep's index.
+func NewRemoteEngine(peer *PeerResolver, tag string, keep cas.Engine) cas.Engine {
+	return &remoteEngine{
+		peer: peer,
+		tag:  tag,
+		keep: keep,
+	}
+}
+
+// PutBlob returns cas.ErrReadOnly.
+func (e *remoteEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return "", -1, cas.ErrReadOnly
+}
+
+// PutIndex returns cas.ErrReadOnly.
+func (e *remoteEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return cas.ErrReadOnly
+}
+
+// DeleteBlob returns cas.ErrReadOnly.
+func (e *remoteEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return cas.ErrReadOnly
+}
+
+// ListBlobs returns cas.ErrNotImplemented, because the registry API doesn't
+// allow blobs to be listed.
+func (e *remoteEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	return nil, cas.ErrNotImplemented
+}
+
+// Clean does nothing.
+func (e *remoteEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close closes keep (if it was provided).
+func (e *remoteEngine) Close() error {
+	if e.keep != nil {
+		return e.keep.Close()
+	}
+	return nil
+}
+
+// GetIndex returns an index containing only the tag the engine was created
+// with. The tag is only resolved once.
+func (e *remoteEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	e.indexOnce.Do(func() {
+		descriptor, err := e.peer.ResolveTag(ctx, e.tag)
+		if err != nil {
+			e.indexErr = errors.Wrapf(err, "resolve tag %s", e.tag)
+			return
+		}
+		// Schema1 manifests have to be converted (see interop.ConvertSchema1),
+		// which requires storing the converted manifest.
+		if interop.IsSchema1MediaType(descriptor.MediaType) {
+			e.indexErr = errors.Errorf("resolve tag %s: schema1 manifests cannot be read directly from a registry", e.tag)
+			return
+		}
+		log.Infof("resolved %s on %s: %s", e.tag, e.peer, descriptor.Digest)
+		descriptor.Annotations = map[string]string{
+			ispec.AnnotationRefName: e.tag,
+		}
+		e.index = ispec.Index{
+			Versioned: ispecs.Versioned{SchemaVersion: 2},
+			Manifests: []ispec.Descriptor{descriptor},
+		}
+	})
+	return e.index, e.indexErr
+}
+
+// open returns the contents of the blob with the given digest. Manifests and
+// indexes are not always served by the blob endpoint, so the manifest
+// endpoint is tried if the blob doesn't exist.
+func (e *remoteEngine) open(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	reader, err := e.peer.ResolveBlob(ctx, ispec.Descriptor{Digest: blobDigest})
+	if !os.IsNotExist(errors.Cause(err)) {
+		return reader, err
+	}
+	resp, err2 := e.peer.do(ctx, http.MethodGet, "manifests/"+blobDigest.String(), ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifest, casext.MediaTypeDockerManifestList)
+	if err2 != nil {
+		// Return the original error, since most blobs aren't manifests.
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetBlob returns a reader for the blob with the given digest, which is read
+// from the peer (and verified against the digest) as it is being read.
+func (e *remoteEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	if err := blobDigest.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid digest")
+	}
+	if e.keep != nil {
+		// Avoid fetching blobs we already have.
+		if reader, err := e.keep.GetBlob(ctx, blobDigest); err == nil {
+			log.Debugf("using kept blob %s", blobDigest)
+			return cas.NewVerifiedReadCloser(reader, ispec.Descriptor{Digest: blobDigest, Size: -1}), nil
+		}
+	}
+
+	reader, err := e.open(ctx, blobDigest)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrapf(cas.ErrNotExist, "get blob %s", blobDigest)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get blob %s", blobDigest)
+	}
+	verified := cas.NewVerifiedReadCloser(reader, ispec.Descriptor{Digest: blobDigest, Size: -1})
+	if e.keep == nil {
+		return verified, nil
+	}
+	return newKeepReadCloser(ctx, e.keep, verified, blobDigest), nil
+}
+
+// keepReadCloser is an io.ReadCloser which copies everything read from a
+// blob into an engine (see NewRemoteEngine).
+type keepReadCloser struct {
+	io.Reader
+	source io.ReadCloser
+	digest digest.Digest
+	pipe   *io.PipeWriter
+	done   chan error
+}
+
+// newKeepReadCloser returns a keepReadCloser which stores the contents of the
+// given blob in keep.
+func newKeepReadCloser(ctx context.Context, keep cas.Engine, source io.ReadCloser, blobDigest digest.Digest) *keepReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		gotDigest, _, err := keep.PutBlob(ctx, pipeReader)
+		if err == nil && gotDigest != blobDigest {
+			// Should never happen, since the source is verified.
+			err = errors.Errorf("kept blob has digest %s", gotDigest)
+			keep.DeleteBlob(ctx, gotDigest)
+		}
+		// Make sure the writer doesn't block if PutBlob failed early.
+		pipeReader.CloseWithError(err)
+		done <- err
+	}()
+	return &keepReadCloser{
+		Reader: io.TeeReader(source, pipeWriter),
+		source: source,
+		digest: blobDigest,
+		pipe:   pipeWriter,
+		done:   done,
+	}
+}
+
+// Close reads the rest of the blob (so that the complete blob is stored),
+// and then waits for it to be stored.
+func (r *keepReadCloser) Close() error {
+	_, err := io.Copy(ioutil.Discard, r)
+	r.pipe.CloseWithError(err)
+	if err2 := <-r.done; err == nil && err2 != nil {
+		err = errors.Wrapf(err2, "keep blob %s", r.digest)
+	}
+	if err2 := r.source.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestRemoteEngine(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestRemoteEngine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src, manifest, layerDigest := setupImage(t, filepath.Join(root, "src"), "latest")
+	defer src.Close()
+
+	server := httptest.NewServer(NewHandler(src))
+	defer server.Close()
+
+	peer, err := NewPeerResolver(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error creating resolver: %+v", err)
+	}
+	engine := NewRemoteEngine(peer, "latest", nil)
+	engineExt := casext.NewEngine(engine)
+	defer engineExt.Close()
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error resolving reference: %+v", err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Descriptor().Digest != manifest.Digest {
+		t.Errorf("unexpected descriptors for tag: %v", descriptorPaths)
+	}
+	if _, err := engineExt.ResolveReference(ctx, "other"); err != nil {
+		t.Errorf("unexpected error resolving other reference: %+v", err)
+	}
+
+	// The manifest (and everything it references) can be read.
+	if _, err := engineExt.FromDescriptor(ctx, manifest); err != nil {
+		t.Errorf("unexpected error reading manifest: %+v", err)
+	}
+	reader, err := engine.GetBlob(ctx, layerDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting layer: %+v", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "layer" {
+		t.Errorf("unexpected layer contents: %q (%+v)", data, err)
+	}
+
+	if _, err := engine.GetBlob(ctx, digest.FromString("missing")); errors.Cause(err) != cas.ErrNotExist {
+		t.Errorf("expected ErrNotExist for missing blob: got %+v", err)
+	}
+	if _, _, err := engine.PutBlob(ctx, bytes.NewReader(nil)); errors.Cause(err) != cas.ErrReadOnly {
+		t.Errorf("expected ErrReadOnly for PutBlob: got %+v", err)
+	}
+}
+
+func TestRemoteEngineTampered(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestRemoteEngineTampered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src, _, layerDigest := setupImage(t, filepath.Join(root, "src"), "latest")
+	defer src.Close()
+
+	// A peer which returns the wrong contents for the layer.
+	handler := NewHandler(src)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/blobs/"+layerDigest.String()) {
+			w.Write([]byte("tampered"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	peer, err := NewPeerResolver(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error creating resolver: %+v", err)
+	}
+
+	keepPath := filepath.Join(root, "keep")
+	if err := cas.Create(keepPath); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	keep, err := cas.Open(keepPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engine := NewRemoteEngine(peer, "latest", keep)
+	defer engine.Close()
+
+	reader, err := engine.GetBlob(ctx, layerDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting layer: %+v", err)
+	}
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != cas.ErrDigestMismatch {
+		t.Errorf("expected digest mismatch reading tampered layer: got %+v", err)
+	}
+	reader.Close()
+
+	// The tampered blob must not have been kept.
+	if _, err := keep.GetBlob(ctx, layerDigest); err == nil {
+		t.Errorf("tampered layer was kept")
+	}
+	digests, err := keep.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %+v", err)
+	}
+	if len(digests) != 0 {
+		t.Errorf("unexpected blobs kept: %v", digests)
+	}
+}
+
+func TestRemoteEngineKeep(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestRemoteEngineKeep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src, manifest, layerDigest := setupImage(t, filepath.Join(root, "src"), "latest")
+	defer src.Close()
+
+	server := httptest.NewServer(NewHandler(src))
+	defer server.Close()
+
+	peer, err := NewPeerResolver(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error creating resolver: %+v", err)
+	}
+
+	keepPath := filepath.Join(root, "keep")
+	if err := cas.Create(keepPath); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	keep, err := cas.Open(keepPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engine := NewRemoteEngine(peer, "latest", keep)
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	if _, err := engineExt.FromDescriptor(ctx, manifest); err != nil {
+		t.Errorf("unexpected error reading manifest: %+v", err)
+	}
+
+	// Only read part of the layer, the rest must still be kept.
+	reader, err := engine.GetBlob(ctx, layerDigest)
+	if err != nil {
+		t.Fatalf("unexpected error getting layer: %+v", err)
+	}
+	if _, err := reader.Read(make([]byte, 1)); err != nil {
+		t.Errorf("unexpected error reading layer: %+v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("unexpected error closing layer: %+v", err)
+	}
+
+	for _, blobDigest := range []digest.Digest{manifest.Digest, layerDigest} {
+		reader, err := keep.GetBlob(ctx, blobDigest)
+		if err != nil {
+			t.Errorf("blob %s was not kept: %+v", blobDigest, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || digest.FromBytes(data) != blobDigest {
+			t.Errorf("kept blob %s has the wrong contents (%+v)", blobDigest, err)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package registry implements a minimal, read-only server for the registry
+// API defined by the OCI distribution specification (and the Docker Registry
+// HTTP API V2), which serves the images in an OCI image layout. It also
+// implements support for accessing registries in the same way as other
+// container tools (such as resolving short image names).
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/delta"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Error codes defined by the distribution specification.
+const (
+	codeBlobUnknown     = "BLOB_UNKNOWN"
+	codeManifestUnknown = "MANIFEST_UNKNOWN"
+	codeDigestInvalid   = "DIGEST_INVALID"
+	codeNameUnknown     = "NAME_UNKNOWN"
+	codeUnsupported     = "UNSUPPORTED"
+)
+
+// routeRegexp matches the paths of the API endpoints which are implemented.
+// The repository name is matched lazily so that names containing "/blobs/" or
+// "/manifests/" are not mangled.
+var routeRegexp = regexp.MustCompile(`^/v2/(.+?)/(manifests|blobs|tags)/(.+)$`)
+
+// signaturePrefix is the prefix of the path of the umoci-specific endpoint
+// which serves the delta.Signature of a blob, used by PeerResolver to only
+// fetch the parts of a blob which differ from a local blob. It is outside of
+// any repository, so it cannot conflict with the standard endpoints.
+const signaturePrefix = "/v2/_umoci/signatures/"
+
+// Handler is an http.Handler which serves the images in an image layout using
+// the registry API. All of the tags in the image layout are available under
+// every repository name, except for tags of the form "<name>:<tag>" (see
+// casext.RefNameRegexp), which are available as "<tag>" in the "<name>"
+// repository. Only pulling is supported, and every other request is rejected.
+type Handler struct {
+	engine casext.Engine
+
+	// signatures caches the most recently served signatures (blobs are
+	// immutable, so they never need to be invalidated). signatureOrder is
+	// the order in which they were added, so the oldest can be evicted.
+	signatureLock  sync.Mutex
+	signatures     map[digest.Digest][]byte
+	signatureOrder []digest.Digest
+}
+
+// maxCachedSignatures is the number of signatures cached by a Handler.
+const maxCachedSignatures = 32
+
+// NewHandler returns a new Handler which serves the images in the given image
+// layout. The engine must remain open while the handler is in use.
+func NewHandler(engine casext.Engine) *Handler {
+	return &Handler{
+		engine:     engine,
+		signatures: map[digest.Digest][]byte{},
+	}
+}
+
+// errorResponse is the body of an error response.
+type errorResponse struct {
+	Errors []errorInfo `json:"errors"`
+}
+
+// errorInfo describes a single error in an errorResponse.
+type errorInfo struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError writes an error response with the given status and code.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{
+		Errors: []errorInfo{{Code: code, Message: message}},
+	})
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"remote": r.RemoteAddr,
+	}).Debugf("registry: request")
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, codeUnsupported, "registry is read-only")
+		return
+	}
+
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+		return
+	}
+
+	ctx := r.Context()
+	if strings.HasPrefix(r.URL.Path, signaturePrefix) {
+		h.serveSignature(ctx, w, r, strings.TrimPrefix(r.URL.Path, signaturePrefix))
+		return
+	}
+
+	match := routeRegexp.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		writeError(w, http.StatusNotFound, codeUnsupported, "unknown endpoint")
+		return
+	}
+	name, kind, reference := match[1], match[2], match[3]
+
+	switch {
+	case kind == "manifests":
+		h.serveManifest(ctx, w, r, name, reference)
+	case kind == "blobs":
+		h.serveBlob(ctx, w, r, reference)
+	case kind == "tags" && reference == "list":
+		h.serveTags(ctx, w, name)
+	default:
+		writeError(w, http.StatusNotFound, codeUnsupported, "unknown endpoint")
+	}
+}
+
+// resolveTag returns the top-level index entry for the given tag in the given
+// repository.
+func (h *Handler) resolveTag(ctx context.Context, name, tag string) (ispec.Descriptor, bool, error) {
+	index, err := h.engine.GetIndex(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, false, errors.Wrap(err, "get top-level index")
+	}
+
+	// Prefer "<name>:<tag>" over "<tag>".
+	for _, refname := range []string{name + ":" + tag, tag} {
+		for _, descriptor := range index.Manifests {
+			if descriptor.Annotations[ispec.AnnotationRefName] == refname {
+				return descriptor, true, nil
+			}
+		}
+	}
+	return ispec.Descriptor{}, false, nil
+}
+
+// errFoundManifest is used to stop walking once the manifest being searched
+// for by resolveManifestDigest has been found.
+var errFoundManifest = errors.New("found manifest")
+
+// resolveManifestDigest returns the descriptor of the manifest (or index) with
+// the given digest which is reachable from the top-level index. The media
+// type is taken from the descriptor referencing the blob, so that large blobs
+// (such as layers) are never read to figure out whether they are manifests.
+func (h *Handler) resolveManifestDigest(ctx context.Context, manifestDigest digest.Digest) (ispec.Descriptor, bool, error) {
+	index, err := h.engine.GetIndex(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, false, errors.Wrap(err, "get top-level index")
+	}
+
+	var found ispec.Descriptor
+	for _, root := range index.Manifests {
+		err := h.engine.Walk(ctx, root, func(descriptorPath casext.DescriptorPath) error {
+			descriptor := descriptorPath.Descriptor()
+			isManifest := casext.IsManifestMediaType(descriptor.MediaType)
+			if descriptor.Digest == manifestDigest && (isManifest || casext.IsIndexMediaType(descriptor.MediaType)) {
+				found = descriptor
+				return errFoundManifest
+			}
+			// Only indexes can refer to other manifests.
+			if isManifest {
+				return casext.ErrSkipDescriptor
+			}
+			return nil
+		})
+		if err == errFoundManifest {
+			return found, true, nil
+		}
+		if err != nil {
+			return ispec.Descriptor{}, false, errors.Wrapf(err, "walk %s", root.Digest)
+		}
+	}
+	return ispec.Descriptor{}, false, nil
+}
+
+// serveManifest serves the manifest (or index) with the given tag or digest.
+func (h *Handler) serveManifest(ctx context.Context, w http.ResponseWriter, r *http.Request, name, reference string) {
+	var (
+		descriptor ispec.Descriptor
+		ok         bool
+		err        error
+	)
+	if strings.Contains(reference, ":") {
+		manifestDigest := digest.Digest(reference)
+		if err := manifestDigest.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, codeDigestInvalid, err.Error())
+			return
+		}
+		descriptor, ok, err = h.resolveManifestDigest(ctx, manifestDigest)
+	} else {
+		descriptor, ok, err = h.resolveTag(ctx, name, reference)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnsupported, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, codeManifestUnknown, "manifest unknown")
+		return
+	}
+
+	w.Header().Set("Content-Type", descriptor.MediaType)
+	h.serveBlobContents(ctx, w, r, descriptor.Digest, codeManifestUnknown)
+}
+
+// serveBlob serves the blob with the given digest.
+func (h *Handler) serveBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, reference string) {
+	blobDigest := digest.Digest(reference)
+	if err := blobDigest.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, codeDigestInvalid, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	h.serveBlobContents(ctx, w, r, blobDigest, codeBlobUnknown)
+}
+
+// serveBlobContents writes the contents of the blob with the given digest. If
+// the blob doesn't exist, an error with the given code is written.
+func (h *Handler) serveBlobContents(ctx context.Context, w http.ResponseWriter, r *http.Request, blobDigest digest.Digest, unknownCode string) {
+	reader, err := h.engine.GetBlob(ctx, blobDigest)
+	if os.IsNotExist(errors.Cause(err)) {
+		writeError(w, http.StatusNotFound, unknownCode, "blob unknown")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnsupported, err.Error())
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Docker-Content-Digest", blobDigest.String())
+	w.Header().Set("Etag", `"`+blobDigest.String()+`"`)
+
+	// Blobs stored as files can be served with support for range requests.
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, seeker)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		log.Warnf("registry: error writing blob %s: %v", blobDigest, err)
+	}
+}
+
+// blobSignature returns the JSON-encoded delta.Signature of the blob with the
+// given digest. Signatures are computed when they are first requested rather
+// than being stored in the image layout, and the most recent ones are cached.
+func (h *Handler) blobSignature(ctx context.Context, blobDigest digest.Digest) ([]byte, error) {
+	h.signatureLock.Lock()
+	body, ok := h.signatures[blobDigest]
+	h.signatureLock.Unlock()
+	if ok {
+		return body, nil
+	}
+
+	reader, err := h.engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// The block size depends on the size of the blob.
+	blockSize := delta.MinBlockSize
+	if seeker, ok := reader.(io.Seeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = seeker.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "get blob size")
+		}
+		blockSize = delta.BlockSize(size)
+	}
+	signature, err := delta.NewSignature(reader, blockSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute signature")
+	}
+	body, err = json.Marshal(signature)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode signature")
+	}
+
+	h.signatureLock.Lock()
+	defer h.signatureLock.Unlock()
+	if _, ok := h.signatures[blobDigest]; !ok {
+		if len(h.signatureOrder) >= maxCachedSignatures {
+			delete(h.signatures, h.signatureOrder[0])
+			h.signatureOrder = h.signatureOrder[1:]
+		}
+		h.signatures[blobDigest] = body
+		h.signatureOrder = append(h.signatureOrder, blobDigest)
+	}
+	return body, nil
+}
+
+// serveSignature serves the delta.Signature of the blob with the given digest.
+func (h *Handler) serveSignature(ctx context.Context, w http.ResponseWriter, r *http.Request, reference string) {
+	blobDigest := digest.Digest(reference)
+	if err := blobDigest.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, codeDigestInvalid, err.Error())
+		return
+	}
+
+	body, err := h.blobSignature(ctx, blobDigest)
+	if os.IsNotExist(errors.Cause(err)) {
+		writeError(w, http.StatusNotFound, codeBlobUnknown, "blob unknown")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnsupported, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Docker-Content-Digest", blobDigest.String())
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// tagList is the body of a tag list response.
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// serveTags serves the list of tags in the given repository.
+func (h *Handler) serveTags(ctx context.Context, w http.ResponseWriter, name string) {
+	refs, err := h.engine.ListReferences(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnsupported, err.Error())
+		return
+	}
+
+	seen := map[string]struct{}{}
+	tags := []string{}
+	for _, refname := range refs {
+		tag := refname
+		if strings.HasPrefix(refname, name+":") {
+			tag = strings.TrimPrefix(refname, name+":")
+		} else if strings.ContainsAny(refname, ":/") {
+			// Belongs to a different repository.
+			continue
+		}
+		if _, ok := seen[tag]; !ok {
+			seen[tag] = struct{}{}
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		writeError(w, http.StatusNotFound, codeNameUnknown, "repository name not known to registry")
+		return
+	}
+	sort.Strings(tags)
+
+	body, err := json.Marshal(tagList{Name: name, Tags: tags})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnsupported, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
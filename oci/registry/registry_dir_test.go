@@ -0,0 +1,284 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	_ "github.com/openSUSE/umoci/oci/cas/drivers"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// putImage adds a manifest with a single layer (with the given contents) to
+// the image layout, returning its descriptor.
+func putImage(t *testing.T, engineExt casext.Engine, layer []byte) ispec.Descriptor {
+	ctx := context.Background()
+
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(layer))
+	if err != nil {
+		t.Fatalf("unexpected error putting layer: %+v", err)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDigest},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %+v", err)
+	}
+
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+// setupImage creates an image layout containing a single manifest, tagged
+// with each of the given names.
+func setupImage(t *testing.T, image string, names ...string) (casext.Engine, ispec.Descriptor, digest.Digest) {
+	ctx := context.Background()
+
+	if err := cas.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	layer := []byte("layer")
+	descriptor := putImage(t, engineExt, layer)
+	for _, name := range names {
+		if err := engineExt.UpdateReference(ctx, name, descriptor); err != nil {
+			t.Fatalf("unexpected error creating reference: %+v", err)
+		}
+	}
+	return engineExt, descriptor, digest.FromBytes(layer)
+}
+
+func TestHandler(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestHandler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine, manifest, layer := setupImage(t, filepath.Join(root, "image"), "latest", "opensuse/leap:42.3")
+	defer engine.Close()
+
+	// Manifests which aren't referenced by the index are not served.
+	unreferenced := putImage(t, engine, []byte("unreferenced"))
+
+	server := httptest.NewServer(NewHandler(engine))
+	defer server.Close()
+
+	for _, test := range []struct {
+		method      string
+		path        string
+		status      int
+		contentType string
+		digest      digest.Digest
+	}{
+		{"GET", "/v2/", http.StatusOK, "application/json", ""},
+		{"GET", "/v2/foo/manifests/latest", http.StatusOK, ispec.MediaTypeImageManifest, manifest.Digest},
+		{"HEAD", "/v2/foo/bar/manifests/latest", http.StatusOK, ispec.MediaTypeImageManifest, manifest.Digest},
+		{"GET", "/v2/opensuse/leap/manifests/42.3", http.StatusOK, ispec.MediaTypeImageManifest, manifest.Digest},
+		{"GET", "/v2/foo/manifests/" + manifest.Digest.String(), http.StatusOK, ispec.MediaTypeImageManifest, manifest.Digest},
+		{"GET", "/v2/foo/manifests/42.3", http.StatusNotFound, "application/json", ""},
+		{"GET", "/v2/foo/manifests/" + layer.String(), http.StatusNotFound, "application/json", ""},
+		{"GET", "/v2/foo/manifests/" + unreferenced.Digest.String(), http.StatusNotFound, "application/json", ""},
+		{"GET", "/v2/foo/manifests/sha256:invalid", http.StatusBadRequest, "application/json", ""},
+		{"GET", "/v2/foo/blobs/" + layer.String(), http.StatusOK, "application/octet-stream", layer},
+		{"HEAD", "/v2/foo/blobs/" + layer.String(), http.StatusOK, "application/octet-stream", layer},
+		{"GET", "/v2/foo/blobs/" + digest.FromString("missing").String(), http.StatusNotFound, "application/json", ""},
+		{"GET", "/v2/foo/blobs/uploads/", http.StatusBadRequest, "application/json", ""},
+		{"PUT", "/v2/foo/manifests/latest", http.StatusMethodNotAllowed, "application/json", ""},
+		{"DELETE", "/v2/foo/blobs/" + layer.String(), http.StatusMethodNotAllowed, "application/json", ""},
+		{"GET", "/v2/_catalog", http.StatusNotFound, "application/json", ""},
+	} {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %+v", test.method, test.path, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error reading body: %+v", test.method, test.path, err)
+		}
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: expected status %d: got %d (%s)", test.method, test.path, test.status, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s %s: expected content type %q: got %q", test.method, test.path, test.contentType, got)
+		}
+		if test.digest != "" {
+			if got := resp.Header.Get("Docker-Content-Digest"); got != test.digest.String() {
+				t.Errorf("%s %s: expected digest %s: got %s", test.method, test.path, test.digest, got)
+			}
+			if test.method == "GET" && digest.FromBytes(body) != test.digest {
+				t.Errorf("%s %s: body does not match digest %s", test.method, test.path, test.digest)
+			}
+			if test.method == "HEAD" && len(body) != 0 {
+				t.Errorf("%s %s: unexpected body in HEAD response", test.method, test.path)
+			}
+		}
+	}
+}
+
+func TestHandlerTags(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestHandlerTags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine, _, _ := setupImage(t, filepath.Join(root, "image"), "latest", "v1", "opensuse/leap:42.3", "opensuse/leap:42.2")
+	defer engine.Close()
+
+	server := httptest.NewServer(NewHandler(engine))
+	defer server.Close()
+
+	for _, test := range []struct {
+		name string
+		tags []string
+	}{
+		{"foo", []string{"latest", "v1"}},
+		{"opensuse/leap", []string{"42.2", "42.3", "latest", "v1"}},
+	} {
+		resp, err := http.Get(server.URL + "/v2/" + test.name + "/tags/list")
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		var list tagList
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error decoding tag list: %+v", err)
+		}
+		if list.Name != test.name || !reflect.DeepEqual(list.Tags, test.tags) {
+			t.Errorf("unexpected tag list for %s: got %v", test.name, list)
+		}
+	}
+
+	// Requests must not be able to escape the image.
+	resp, err := http.Get(server.URL + "/v2/foo/blobs/" + strings.Repeat("../", 5) + "etc/passwd")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("expected error for path traversal: got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerSignatureCache(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestHandlerSignatureCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine, _, layer := setupImage(t, filepath.Join(root, "image"), "latest")
+	defer engine.Close()
+
+	handler := NewHandler(engine)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var bodies [][]byte
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.URL + signaturePrefix + layer.String())
+		if err != nil {
+			t.Fatalf("unexpected error getting signature: %+v", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error reading signature: %+v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status getting signature: %d (%s)", resp.StatusCode, body)
+		}
+		bodies = append(bodies, body)
+	}
+	if !bytes.Equal(bodies[0], bodies[1]) {
+		t.Errorf("cached signature differs from the original")
+	}
+	if len(handler.signatures) != 1 {
+		t.Errorf("expected one cached signature: got %d", len(handler.signatures))
+	}
+
+	// Filling the cache evicts the oldest signature.
+	for i := 0; i < maxCachedSignatures; i++ {
+		blobDigest, _, err := engine.PutBlob(context.Background(), bytes.NewReader([]byte{byte(i)}))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %+v", err)
+		}
+		if _, err := handler.blobSignature(context.Background(), blobDigest); err != nil {
+			t.Fatalf("unexpected error computing signature: %+v", err)
+		}
+	}
+	if len(handler.signatures) != maxCachedSignatures {
+		t.Errorf("expected %d cached signatures: got %d", maxCachedSignatures, len(handler.signatures))
+	}
+	if _, ok := handler.signatures[layer]; ok {
+		t.Errorf("expected oldest signature to be evicted")
+	}
+}
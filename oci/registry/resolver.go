@@ -0,0 +1,350 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/interop"
+	"github.com/openSUSE/umoci/pkg/delta"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// defaultPeerRepository is the repository used to fetch blobs from a peer if
+// the peer URL doesn't contain one. Handler serves every blob in every
+// repository, so the name is only significant for other registries.
+const defaultPeerRepository = "umoci"
+
+// PeerResolver is a casext.BlobResolver which fetches blobs from a peer
+// serving the registry API (such as another machine running "umoci serve").
+// The blobs are fetched without credentials, but anonymous bearer tokens are
+// requested from registries which require them (such as Docker Hub). If the
+// peer is running
+// "umoci serve", PeerResolver also implements delta transfers (see
+// casext.DeltaResolver) using range requests.
+type PeerResolver struct {
+	// Client is the HTTP client used to make requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	base       *url.URL
+	repository string
+
+	tokenLock sync.Mutex
+	token     string
+}
+
+// NewPeerResolver returns a PeerResolver for the peer at the given URL, which
+// is of the form "http://host:port[/repository]".
+func NewPeerResolver(peer string) (*PeerResolver, error) {
+	base, err := url.Parse(peer)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse peer url")
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.Errorf("unsupported peer url scheme: %q", base.Scheme)
+	}
+	if base.Host == "" {
+		return nil, errors.Errorf("peer url is missing a host: %q", peer)
+	}
+
+	repository := strings.Trim(base.Path, "/")
+	if repository == "" {
+		repository = defaultPeerRepository
+	}
+	base.Path = ""
+	// Docker Hub's registry API isn't served from its name.
+	if base.Host == dockerHub {
+		base.Host = dockerHubHost
+	}
+	return &PeerResolver{
+		base:       base,
+		repository: repository,
+	}, nil
+}
+
+// String returns the URL of the peer.
+func (p *PeerResolver) String() string {
+	return p.base.String() + "/" + p.repository
+}
+
+// do makes a request for the given endpoint of the peer's repository. A 404
+// response is returned as an error satisfying os.IsNotExist.
+func (p *PeerResolver) do(ctx context.Context, method, endpoint string, accept ...string) (*http.Response, error) {
+	header := http.Header{}
+	for _, mediaType := range accept {
+		header.Add("Accept", mediaType)
+	}
+	return p.doPath(ctx, method, "/v2/"+p.repository+"/"+endpoint, header, http.StatusOK)
+}
+
+// doPath makes a request for the given path of the peer, with the given
+// headers. Responses without the expected status are returned as errors, and
+// a 404 response is returned as an error satisfying os.IsNotExist.
+func (p *PeerResolver) doPath(ctx context.Context, method, path string, header http.Header, expected int) (*http.Response, error) {
+	endpointURL := *p.base
+	endpointURL.Path = path
+
+	// If the peer requires a token we don't have (or the token expired), we
+	// request one and retry once.
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, endpointURL.String(), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "create request")
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		p.tokenLock.Lock()
+		if p.token != "" {
+			req.Header.Set("Authorization", "Bearer "+p.token)
+		}
+		p.tokenLock.Unlock()
+
+		resp, err = p.client().Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s %s", method, endpointURL.String())
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || !strings.HasPrefix(challenge, "Bearer ") {
+			break
+		}
+		resp.Body.Close()
+		if err := p.requestToken(ctx, challenge); err != nil {
+			return nil, errors.Wrapf(err, "%s %s: request token", method, endpointURL.String())
+		}
+	}
+	switch resp.StatusCode {
+	case expected:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errors.Wrapf(os.ErrNotExist, "%s %s", method, endpointURL.String())
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("%s %s: unexpected status %s", method, endpointURL.String(), resp.Status)
+	}
+}
+
+// client returns the HTTP client used to make requests.
+func (p *PeerResolver) client() *http.Client {
+	if p.Client == nil {
+		return http.DefaultClient
+	}
+	return p.Client
+}
+
+// requestToken requests an anonymous token for the given "Bearer"
+// WWW-Authenticate challenge, which is used for all subsequent requests.
+func (p *PeerResolver) requestToken(ctx context.Context, challenge string) error {
+	params := parseChallenge(strings.TrimPrefix(challenge, "Bearer "))
+	realm, err := url.Parse(params["realm"])
+	if err != nil || (realm.Scheme != "http" && realm.Scheme != "https") {
+		return errors.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value, ok := params[key]; ok {
+			query.Set(key, value)
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	resp, err := p.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "GET %s", realm.String())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s: unexpected status %s", realm.String(), resp.Status)
+	}
+
+	// The token is returned as "token" by Docker Hub and as "access_token" by
+	// OAuth2-compatible servers.
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return errors.Wrap(err, "parse token")
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errors.Errorf("GET %s: no token returned", realm.String())
+	}
+
+	p.tokenLock.Lock()
+	p.token = token.Token
+	p.tokenLock.Unlock()
+	return nil
+}
+
+// parseChallenge parses the parameters of a WWW-Authenticate challenge (of
+// the form `key="value",key="value"`), without the scheme.
+func parseChallenge(challenge string) map[string]string {
+	params := map[string]string{}
+	for challenge != "" {
+		sep := strings.Index(challenge, "=")
+		if sep == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(challenge[:sep]))
+		challenge = challenge[sep+1:]
+
+		var value string
+		if strings.HasPrefix(challenge, `"`) {
+			end := strings.Index(challenge[1:], `"`)
+			if end == -1 {
+				break
+			}
+			value = challenge[1 : end+1]
+			challenge = challenge[end+2:]
+		} else {
+			end := strings.Index(challenge, ",")
+			if end == -1 {
+				end = len(challenge)
+			}
+			value = strings.TrimSpace(challenge[:end])
+			challenge = challenge[end:]
+		}
+		params[key] = value
+		challenge = strings.TrimLeft(challenge, ", ")
+	}
+	return params
+}
+
+// ResolveTag returns the descriptor of the manifest (or index) with the given
+// tag in the peer's repository. The peer is trusted to return the correct
+// digest for the tag, but the contents of the manifest are verified against
+// the digest when it is fetched.
+func (p *PeerResolver) ResolveTag(ctx context.Context, tag string) (ispec.Descriptor, error) {
+	resp, err := p.do(ctx, http.MethodHead, "manifests/"+tag, ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifest, casext.MediaTypeDockerManifestList, interop.MediaTypeDockerSchema1Signed, interop.MediaTypeDockerSchema1)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	resp.Body.Close()
+
+	descriptor := ispec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digest.Digest(resp.Header.Get("Docker-Content-Digest")),
+		Size:      resp.ContentLength,
+	}
+	if err := descriptor.Digest.Validate(); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "peer returned invalid digest")
+	}
+	if !casext.IsManifestMediaType(descriptor.MediaType) && !casext.IsIndexMediaType(descriptor.MediaType) && !interop.IsSchema1MediaType(descriptor.MediaType) {
+		return ispec.Descriptor{}, errors.Errorf("peer returned unsupported media type %q", descriptor.MediaType)
+	}
+	if descriptor.Size < 0 {
+		return ispec.Descriptor{}, errors.Errorf("peer did not return manifest size")
+	}
+	return descriptor, nil
+}
+
+// ResolveBlob implements casext.BlobResolver.
+func (p *PeerResolver) ResolveBlob(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	resp, err := p.do(ctx, http.MethodGet, "blobs/"+descriptor.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ResolveManifest returns the contents of the manifest with the given
+// descriptor, using the manifest endpoint of the registry API rather than the
+// blob endpoint. This is necessary for manifests which registries don't serve
+// as blobs (such as schema1 manifests). The caller must verify the contents.
+func (p *PeerResolver) ResolveManifest(ctx context.Context, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	resp, err := p.do(ctx, http.MethodGet, "manifests/"+descriptor.Digest.String(), descriptor.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// signature returns the delta.Signature of the blob with the given
+// descriptor, which is only served by peers running "umoci serve".
+func (p *PeerResolver) signature(ctx context.Context, descriptor ispec.Descriptor) (*delta.Signature, error) {
+	resp, err := p.doPath(ctx, http.MethodGet, signaturePrefix+descriptor.Digest.String(), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var signature delta.Signature
+	if err := json.NewDecoder(resp.Body).Decode(&signature); err != nil {
+		return nil, errors.Wrap(err, "parse signature")
+	}
+	if signature.Size != descriptor.Size {
+		return nil, errors.Errorf("signature has size %d, expected %d", signature.Size, descriptor.Size)
+	}
+	if signature.BlockSize <= 0 || int64(len(signature.Blocks)) != (signature.Size+int64(signature.BlockSize)-1)/int64(signature.BlockSize) {
+		return nil, errors.Errorf("signature is malformed")
+	}
+	return &signature, nil
+}
+
+// ResolveBlobDelta implements casext.DeltaResolver. The blocks of the blob
+// which are not present in basis are fetched using range requests.
+func (p *PeerResolver) ResolveBlobDelta(ctx context.Context, descriptor ispec.Descriptor, basis io.ReaderAt, basisSize int64) (io.ReadCloser, error) {
+	signature, err := p.signature(ctx, descriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get signature")
+	}
+	segments, err := signature.Plan(io.NewSectionReader(basis, 0, basisSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "plan delta")
+	}
+	log.Infof("delta fetch %s: fetching %d of %d bytes from peer %s", descriptor.Digest, delta.FetchedBytes(segments), descriptor.Size, p)
+
+	endpoint := "/v2/" + p.repository + "/blobs/" + descriptor.Digest.String()
+	fetch := func(offset, length int64) (io.ReadCloser, error) {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		resp, err := p.doPath(ctx, http.MethodGet, endpoint, header, http.StatusPartialContent)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(delta.Assemble(writer, segments, basis, fetch))
+	}()
+	return reader, nil
+}
@@ -0,0 +1,299 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestNewPeerResolver(t *testing.T) {
+	for _, test := range []struct {
+		peer     string
+		expected string
+	}{
+		{"http://localhost:5000", "http://localhost:5000/umoci"},
+		{"http://localhost:5000/", "http://localhost:5000/umoci"},
+		{"https://peer/opensuse/leap", "https://peer/opensuse/leap"},
+		{"https://docker.io/library/alpine", "https://registry-1.docker.io/library/alpine"},
+		{"ftp://peer", ""},
+		{"localhost:5000", ""},
+		{"http://", ""},
+	} {
+		resolver, err := NewPeerResolver(test.peer)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("expected error with peer %q: got %s", test.peer, resolver)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error with peer %q: %+v", test.peer, err)
+			continue
+		}
+		if resolver.String() != test.expected {
+			t.Errorf("unexpected resolver for %q: got %s expected %s", test.peer, resolver, test.expected)
+		}
+	}
+}
+
+func TestPeerResolver(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPeerResolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src, manifest, _ := setupImage(t, filepath.Join(root, "src"), "latest")
+	defer src.Close()
+
+	server := httptest.NewServer(NewHandler(src))
+	defer server.Close()
+
+	dstPath := filepath.Join(root, "dst")
+	if err := cas.Create(dstPath); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(dstPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	dst := casext.NewEngine(engine)
+	defer dst.Close()
+
+	resolver, err := NewPeerResolver(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error creating resolver: %+v", err)
+	}
+
+	// Missing blobs must be reported as not existing.
+	if _, err := resolver.ResolveBlob(ctx, ispec.Descriptor{Digest: digest.FromString("missing")}); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected not exist error for missing blob: got %+v", err)
+	}
+
+	if _, err := resolver.ResolveTag(ctx, "missing"); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected not exist error for missing tag: got %+v", err)
+	}
+	descriptor, err := resolver.ResolveTag(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error resolving tag: %+v", err)
+	}
+	if !reflect.DeepEqual(descriptor, manifest) {
+		t.Errorf("unexpected descriptor for tag: got %v expected %v", descriptor, manifest)
+	}
+
+	// Manifests can also be fetched from the manifest endpoint.
+	manifestReader, err := resolver.ResolveManifest(ctx, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error resolving manifest: %+v", err)
+	}
+	manifestBlob, err := ioutil.ReadAll(manifestReader)
+	manifestReader.Close()
+	if err != nil {
+		t.Fatalf("unexpected error reading manifest: %+v", err)
+	}
+	if got := digest.FromBytes(manifestBlob); got != manifest.Digest {
+		t.Errorf("unexpected manifest contents: got digest %s expected %s", got, manifest.Digest)
+	}
+
+	fetched, err := dst.FetchMissingBlobs(ctx, manifest, []casext.BlobResolver{resolver}, casext.FetchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error fetching blobs: %+v", err)
+	}
+	if len(fetched) != 3 {
+		t.Errorf("expected 3 blobs to be fetched: got %v", fetched)
+	}
+	if err := dst.Validate(ctx, manifest); err != nil {
+		t.Errorf("unexpected error validating fetched image: %+v", err)
+	}
+}
+
+func TestPeerResolverToken(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPeerResolverToken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src, manifest, _ := setupImage(t, filepath.Join(root, "src"), "latest")
+	defer src.Close()
+
+	// The registry requires a token, which is handed out anonymously by the
+	// token server.
+	var tokens int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("service") != "test-registry" || r.URL.Query().Get("scope") != "repository:umoci:pull" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&tokens, 1)
+		w.Write([]byte(`{"access_token": "secret"}`))
+	}))
+	defer tokenServer.Close()
+
+	handler := NewHandler(src)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenServer.URL+`/token",service="test-registry",scope="repository:umoci:pull"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	resolver, err := NewPeerResolver(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error creating resolver: %+v", err)
+	}
+	descriptor, err := resolver.ResolveTag(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error resolving tag: %+v", err)
+	}
+	if !reflect.DeepEqual(descriptor, manifest) {
+		t.Errorf("unexpected descriptor for tag: got %v expected %v", descriptor, manifest)
+	}
+	reader, err := resolver.ResolveBlob(ctx, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error resolving blob: %+v", err)
+	}
+	reader.Close()
+
+	// The token must be reused.
+	if got := atomic.LoadInt32(&tokens); got != 1 {
+		t.Errorf("expected one token to be requested: got %d", got)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	params := parseChallenge(`realm="https://auth.docker.io/token",service="registry.docker.io", scope="repository:library/alpine:pull,push",error=invalid_token`)
+	expected := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/alpine:pull,push",
+		"error":   "invalid_token",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("unexpected challenge parameters: got %v expected %v", params, expected)
+	}
+}
+
+// countingWriter is an http.ResponseWriter which counts the bytes written.
+type countingWriter struct {
+	http.ResponseWriter
+	written *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(w.written, int64(n))
+	return n, err
+}
+
+func TestPeerResolverDelta(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPeerResolverDelta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src, _, _ := setupImage(t, filepath.Join(root, "src"))
+	defer src.Close()
+
+	// The new layer has some data inserted and modified in the middle.
+	rng := rand.New(rand.NewSource(1))
+	oldLayer := make([]byte, 256*1024)
+	rng.Read(oldLayer)
+	newLayer := append([]byte{}, oldLayer[:100000]...)
+	newLayer = append(newLayer, []byte("inserted data")...)
+	newLayer = append(newLayer, oldLayer[100000:]...)
+	copy(newLayer[200000:], "modified data")
+
+	oldManifest := putImage(t, src, oldLayer)
+	newManifest := putImage(t, src, newLayer)
+
+	// Count the number of bytes of blobs served.
+	var written int64
+	handler := NewHandler(src)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			w = countingWriter{ResponseWriter: w, written: &written}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	dstPath := filepath.Join(root, "dst")
+	if err := cas.Create(dstPath); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := cas.Open(dstPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	dst := casext.NewEngine(engine)
+	defer dst.Close()
+
+	resolver, err := NewPeerResolver(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error creating resolver: %+v", err)
+	}
+
+	if _, err := dst.FetchMissingBlobs(ctx, oldManifest, []casext.BlobResolver{resolver}, casext.FetchOptions{}); err != nil {
+		t.Fatalf("unexpected error fetching old image: %+v", err)
+	}
+	if n := atomic.LoadInt64(&written); n < int64(len(oldLayer)) {
+		t.Errorf("expected entire old layer to be fetched: fetched %d bytes", n)
+	}
+
+	atomic.StoreInt64(&written, 0)
+	fetched, err := dst.SyncBlobs(ctx, oldManifest, newManifest, []casext.BlobResolver{resolver}, casext.FetchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error syncing new image: %+v", err)
+	}
+	if len(fetched) != 3 {
+		t.Errorf("expected 3 blobs to be fetched: got %v", fetched)
+	}
+	if err := dst.Validate(ctx, newManifest); err != nil {
+		t.Errorf("unexpected error validating synced image: %+v", err)
+	}
+	if n := atomic.LoadInt64(&written); n > int64(len(newLayer))/4 {
+		t.Errorf("expected delta transfer of new layer: fetched %d of %d bytes", n, len(newLayer))
+	}
+}
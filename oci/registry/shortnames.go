@@ -0,0 +1,203 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// Short-name resolution modes, as defined by containers-registries.conf(5).
+const (
+	// ShortNameModeEnforcing only allows a short name to be resolved if there
+	// is an alias for it or only one unqualified search registry. Other
+	// container tools prompt the user to pick a registry in this case, but
+	// umoci never prompts.
+	ShortNameModeEnforcing = "enforcing"
+
+	// ShortNameModePermissive tries each unqualified search registry in turn
+	// (since umoci never prompts).
+	ShortNameModePermissive = "permissive"
+
+	// ShortNameModeDisabled tries each unqualified search registry in turn.
+	ShortNameModeDisabled = "disabled"
+)
+
+// dockerHub is the name of the Docker Hub registry, which has a "library/"
+// namespace for single-component repository names and is served from
+// dockerHubHost.
+const (
+	dockerHub     = "docker.io"
+	dockerHubHost = "registry-1.docker.io"
+)
+
+// ShortNames is the short-name resolution configuration of the host, in the
+// format used by podman and Buildah (see containers-registries.conf(5)).
+type ShortNames struct {
+	// SearchRegistries are the registries in which short names without an
+	// alias are looked up, in order.
+	SearchRegistries []string
+
+	// Mode is the short-name resolution mode (ShortNameMode*).
+	Mode string
+
+	// Aliases maps short names to the fully-qualified names they refer to.
+	Aliases map[string]string
+}
+
+// registriesConf is the subset of containers-registries.conf(5) used for
+// short-name resolution. All other keys are ignored.
+type registriesConf struct {
+	UnqualifiedSearchRegistries *[]string         `toml:"unqualified-search-registries"`
+	ShortNameMode               string            `toml:"short-name-mode"`
+	Aliases                     map[string]string `toml:"aliases"`
+}
+
+// ShortNamesPaths returns the paths of the containers-registries.conf(5)
+// files of the host, in the order they should be loaded. If
+// $CONTAINERS_REGISTRIES_CONF is set, only that file is used (along with its
+// drop-in directory). Otherwise the user's registries.conf is used in place of
+// /etc/containers/registries.conf if it exists. Drop-in files ("*.conf" in the
+// directory with the name of the file and a ".d" suffix) are loaded after the
+// main file, in lexical order.
+func ShortNamesPaths() ([]string, error) {
+	var mainPath string
+	var dropinDirs []string
+	if path := os.Getenv("CONTAINERS_REGISTRIES_CONF"); path != "" {
+		mainPath = path
+		dropinDirs = []string{path + ".d"}
+	} else {
+		systemPath := "/etc/containers/registries.conf"
+		mainPath = systemPath
+		dropinDirs = []string{systemPath + ".d"}
+
+		configHome := os.Getenv("XDG_CONFIG_HOME")
+		if configHome == "" {
+			if home := os.Getenv("HOME"); home != "" {
+				configHome = filepath.Join(home, ".config")
+			}
+		}
+		if configHome != "" {
+			userPath := filepath.Join(configHome, "containers", "registries.conf")
+			if _, err := os.Stat(userPath); err == nil {
+				mainPath = userPath
+			}
+			dropinDirs = append(dropinDirs, userPath+".d")
+		}
+	}
+
+	paths := []string{mainPath}
+	for _, dir := range dropinDirs {
+		dropins, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "list drop-ins in %s", dir)
+		}
+		sort.Strings(dropins)
+		paths = append(paths, dropins...)
+	}
+	return paths, nil
+}
+
+// LoadShortNames loads the short-name resolution configuration from the given
+// containers-registries.conf(5) files (see ShortNamesPaths). Files which
+// don't exist are skipped. Later files override the search registries and
+// mode set by earlier files, and their aliases are merged with (and take
+// precedence over) the aliases of earlier files.
+func LoadShortNames(paths []string) (*ShortNames, error) {
+	shortNames := &ShortNames{
+		Mode:    ShortNameModeEnforcing,
+		Aliases: map[string]string{},
+	}
+	for _, path := range paths {
+		var conf registriesConf
+		if _, err := toml.DecodeFile(path, &conf); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "load %s", path)
+		}
+
+		if conf.UnqualifiedSearchRegistries != nil {
+			shortNames.SearchRegistries = *conf.UnqualifiedSearchRegistries
+		}
+		switch conf.ShortNameMode {
+		case "":
+		case ShortNameModeEnforcing, ShortNameModePermissive, ShortNameModeDisabled:
+			shortNames.Mode = conf.ShortNameMode
+		default:
+			return nil, errors.Errorf("load %s: invalid short-name-mode %q", path, conf.ShortNameMode)
+		}
+		for alias, name := range conf.Aliases {
+			if !IsShortName(alias) {
+				return nil, errors.Errorf("load %s: alias %q is not a short name", path, alias)
+			}
+			if IsShortName(name) {
+				return nil, errors.Errorf("load %s: alias %q refers to short name %q", path, alias, name)
+			}
+			shortNames.Aliases[alias] = NormalizeName(name)
+		}
+	}
+	return shortNames, nil
+}
+
+// IsShortName returns whether the given repository name (without a tag) is a
+// short name, which doesn't start with the host of a registry. As with other
+// container tools, the first component of the name is a host if it contains
+// a "." or ":" or is "localhost".
+func IsShortName(name string) bool {
+	host := strings.SplitN(name, "/", 2)[0]
+	return !strings.ContainsAny(host, ".:") && host != "localhost"
+}
+
+// NormalizeName returns the given fully-qualified repository name, with the
+// "library/" namespace added for single-component Docker Hub repositories.
+func NormalizeName(name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	if parts[0] == dockerHub && len(parts) == 2 && !strings.Contains(parts[1], "/") {
+		return dockerHub + "/library/" + parts[1]
+	}
+	return name
+}
+
+// Candidates returns the fully-qualified names which the given short name can
+// refer to, in the order they should be tried. If the short name has an alias
+// it is the only candidate, otherwise the name is looked up in each of the
+// search registries. An error is returned if there are no candidates, or if
+// there are several and the mode is ShortNameModeEnforcing.
+func (s *ShortNames) Candidates(name string) ([]string, error) {
+	if alias, ok := s.Aliases[name]; ok {
+		return []string{alias}, nil
+	}
+	if len(s.SearchRegistries) == 0 {
+		return nil, errors.Errorf("short name %q has no alias and no unqualified-search-registries are configured", name)
+	}
+	if len(s.SearchRegistries) > 1 && s.Mode == ShortNameModeEnforcing {
+		return nil, errors.Errorf("short name %q is ambiguous with short-name-mode %q: use a fully-qualified name or add an alias", name, s.Mode)
+	}
+
+	var candidates []string
+	for _, registry := range s.SearchRegistries {
+		candidates = append(candidates, NormalizeName(registry+"/"+name))
+	}
+	return candidates, nil
+}
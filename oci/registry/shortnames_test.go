@@ -0,0 +1,156 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsShortName(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		short bool
+	}{
+		{"alpine", true},
+		{"opensuse/leap", true},
+		{"docker.io/library/alpine", false},
+		{"localhost/image", false},
+		{"127.0.0.1:5000/image", false},
+		{"registry:5000/image", false},
+	} {
+		if got := IsShortName(test.name); got != test.short {
+			t.Errorf("IsShortName(%q): got %v expected %v", test.name, got, test.short)
+		}
+	}
+}
+
+func TestShortNames(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestShortNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mainPath := filepath.Join(root, "registries.conf")
+	if err := ioutil.WriteFile(mainPath, []byte(`
+unqualified-search-registries = ["docker.io", "quay.io"]
+
+[[registry]]
+location = "registry.example.com"
+insecure = true
+
+[aliases]
+"leap" = "registry.opensuse.org/opensuse/leap"
+"busybox" = "quay.io/busybox"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dropinPath := filepath.Join(root, "registries.conf.d", "shortnames.conf")
+	if err := os.MkdirAll(filepath.Dir(dropinPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dropinPath, []byte(`
+short-name-mode = "permissive"
+
+[aliases]
+"busybox" = "docker.io/busybox"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CONTAINERS_REGISTRIES_CONF", mainPath)
+	defer os.Unsetenv("CONTAINERS_REGISTRIES_CONF")
+	paths, err := ShortNamesPaths()
+	if err != nil {
+		t.Fatalf("unexpected error finding paths: %+v", err)
+	}
+	if expected := []string{mainPath, dropinPath}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected paths: got %v expected %v", paths, expected)
+	}
+
+	// Missing files are skipped.
+	shortNames, err := LoadShortNames(append(paths, filepath.Join(root, "missing.conf")))
+	if err != nil {
+		t.Fatalf("unexpected error loading short names: %+v", err)
+	}
+	if shortNames.Mode != ShortNameModePermissive {
+		t.Errorf("unexpected mode: got %q", shortNames.Mode)
+	}
+
+	for _, test := range []struct {
+		name       string
+		candidates []string
+	}{
+		{"leap", []string{"registry.opensuse.org/opensuse/leap"}},
+		{"busybox", []string{"docker.io/library/busybox"}},
+		{"alpine", []string{"docker.io/library/alpine", "quay.io/alpine"}},
+		{"opensuse/tumbleweed", []string{"docker.io/opensuse/tumbleweed", "quay.io/opensuse/tumbleweed"}},
+	} {
+		candidates, err := shortNames.Candidates(test.name)
+		if err != nil {
+			t.Errorf("unexpected error resolving %q: %+v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(candidates, test.candidates) {
+			t.Errorf("unexpected candidates for %q: got %v expected %v", test.name, candidates, test.candidates)
+		}
+	}
+
+	// Ambiguous short names cannot be resolved in enforcing mode, but aliases
+	// can still be used.
+	shortNames.Mode = ShortNameModeEnforcing
+	if candidates, err := shortNames.Candidates("alpine"); err == nil {
+		t.Errorf("expected error resolving ambiguous short name: got %v", candidates)
+	}
+	if _, err := shortNames.Candidates("leap"); err != nil {
+		t.Errorf("unexpected error resolving alias in enforcing mode: %+v", err)
+	}
+
+	// Without search registries only aliases can be resolved.
+	shortNames.SearchRegistries = nil
+	if candidates, err := shortNames.Candidates("alpine"); err == nil {
+		t.Errorf("expected error resolving short name without search registries: got %v", candidates)
+	}
+}
+
+func TestShortNamesInvalid(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestShortNamesInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for idx, conf := range []string{
+		`short-name-mode = "sometimes"`,
+		"[aliases]\n\"docker.io/alpine\" = \"docker.io/library/alpine\"",
+		"[aliases]\n\"alpine\" = \"library/alpine\"",
+		`unqualified-search-registries = "docker.io"`,
+	} {
+		path := filepath.Join(root, "registries.conf")
+		if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if shortNames, err := LoadShortNames([]string{path}); err == nil {
+			t.Errorf("expected error loading config %d: got %v", idx, shortNames)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package bench implements reproducible benchmarks of the common umoci
+// operations (unpack, repack and gc) on synthetic images, so that performance
+// regressions can be caught and users can measure how umoci performs on their
+// storage. The benchmarks are exposed both as Go benchmarks and through the
+// (hidden) umoci-bench command.
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/drivers/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// Workload describes a synthetic image. The contents of the image only depend
+// on the Workload, so results are comparable between runs and machines.
+type Workload struct {
+	// Name is the name of the workload (used by umoci-bench --workload).
+	Name string
+
+	// Description is a short human-readable description of the workload.
+	Description string
+
+	// Files is the number of regular files in the image, and FileSize is the
+	// size of each of them.
+	Files    int
+	FileSize int64
+
+	// FilesPerDir is the number of files in each directory tree, and Depth is
+	// the depth of each directory tree (the files of a tree are all in its
+	// deepest directory).
+	FilesPerDir int
+	Depth       int
+}
+
+// Workloads are the standard workloads.
+var Workloads = []Workload{
+	{
+		Name:        "small-files",
+		Description: "many small files in shallow directories",
+		Files:       20000,
+		FileSize:    1 << 10,
+		FilesPerDir: 100,
+		Depth:       1,
+	},
+	{
+		Name:        "large-files",
+		Description: "a few huge files",
+		Files:       4,
+		FileSize:    256 << 20,
+		FilesPerDir: 4,
+		Depth:       1,
+	},
+	{
+		Name:        "deep-tree",
+		Description: "files at the bottom of very deep directory trees",
+		Files:       1000,
+		FileSize:    64,
+		FilesPerDir: 100,
+		Depth:       128,
+	},
+}
+
+// GetWorkload returns the standard workload with the given name.
+func GetWorkload(name string) (Workload, error) {
+	for _, workload := range Workloads {
+		if workload.Name == name {
+			return workload, nil
+		}
+	}
+	return Workload{}, errors.Errorf("unknown workload: %s", name)
+}
+
+// Scale returns a copy of the workload with the number and size of its files
+// multiplied by factor (each is at least 1), which is useful for quickly
+// checking a workload or for benchmarking slow storage.
+func (w Workload) Scale(factor float64) Workload {
+	w.Files = int(float64(w.Files) * factor)
+	if w.Files < 1 {
+		w.Files = 1
+	}
+	w.FileSize = int64(float64(w.FileSize) * factor)
+	if w.FileSize < 1 {
+		w.FileSize = 1
+	}
+	return w
+}
+
+// Size returns the total size of the files in the workload.
+func (w Workload) Size() int64 {
+	return int64(w.Files) * w.FileSize
+}
+
+// path returns the path (relative to the root of the workload) of the idx-th
+// file.
+func (w Workload) path(idx int) string {
+	components := []string{fmt.Sprintf("tree-%d", idx/w.FilesPerDir)}
+	for i := 1; i < w.Depth; i++ {
+		components = append(components, "d")
+	}
+	components = append(components, fmt.Sprintf("file-%d", idx))
+	return filepath.Join(components...)
+}
+
+// Seeds for the pseudo-random contents of the workload files.
+const (
+	generateSeed = 1
+	modifySeed   = 2
+)
+
+// Generate creates the files of the workload inside root (which is created if
+// it doesn't exist). The contents, modes and timestamps are always the same
+// for a given workload.
+func (w Workload) Generate(root string) error {
+	rng := rand.New(rand.NewSource(generateSeed))
+	buffer := make([]byte, 1<<20)
+	for idx := 0; idx < w.Files; idx++ {
+		path := filepath.Join(root, w.path(idx))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Wrap(err, "mkdir workload directory")
+		}
+		if err := writeRandomFile(path, w.FileSize, rng, buffer); err != nil {
+			return errors.Wrapf(err, "write workload file %s", path)
+		}
+	}
+
+	// Make the metadata independent of the umask and the current time. This
+	// has to be done after all of the files are written, since creating a
+	// file changes the mtime of its directory.
+	epoch := time.Unix(0, 0)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(0644)
+		if info.IsDir() {
+			mode = 0755
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return errors.Wrap(err, "chmod workload file")
+		}
+		return errors.Wrap(os.Chtimes(path, epoch, epoch), "set workload file times")
+	})
+}
+
+// modify changes the contents of every tenth file in the workload (which was
+// generated inside root), as a user would before running umoci-repack(1).
+func (w Workload) modify(root string) error {
+	rng := rand.New(rand.NewSource(modifySeed))
+	buffer := make([]byte, 1<<20)
+	for idx := 0; idx < w.Files; idx += 10 {
+		path := filepath.Join(root, w.path(idx))
+		if err := writeRandomFile(path, w.FileSize, rng, buffer); err != nil {
+			return errors.Wrapf(err, "modify workload file %s", path)
+		}
+	}
+	return nil
+}
+
+// writeRandomFile writes size bytes from rng to path, using buffer to avoid
+// allocations.
+func writeRandomFile(path string, size int64, rng *rand.Rand, buffer []byte) (Err error) {
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fh.Close(); err != nil && Err == nil {
+			Err = err
+		}
+	}()
+	for size > 0 {
+		chunk := buffer
+		if int64(len(chunk)) > size {
+			chunk = chunk[:size]
+		}
+		rng.Read(chunk)
+		if _, err := fh.Write(chunk); err != nil {
+			return err
+		}
+		size -= int64(len(chunk))
+	}
+	return nil
+}
+
+// Phase is an operation which is benchmarked.
+type Phase string
+
+// The phases of a benchmark, in the order they are run by Run.
+const (
+	// PhaseUnpack extracts the image to a bundle and generates the mtree
+	// manifest of its rootfs, like umoci-unpack(1).
+	PhaseUnpack Phase = "unpack"
+
+	// PhaseRepack computes the diff of the (modified) rootfs, and adds it to
+	// the image as a new layer, like umoci-repack(1).
+	PhaseRepack Phase = "repack"
+
+	// PhaseGC removes all of the blobs of the image (after its tag has been
+	// removed), like umoci-gc(1).
+	PhaseGC Phase = "gc"
+)
+
+// Phases are all of the phases, in the order they are run by Run.
+var Phases = []Phase{PhaseUnpack, PhaseRepack, PhaseGC}
+
+// Result is the result of benchmarking one phase of a workload.
+type Result struct {
+	// Workload is the name of the workload.
+	Workload string
+
+	// Phase is the phase which was benchmarked.
+	Phase Phase
+
+	// Duration is how long the phase took.
+	Duration time.Duration
+}
+
+// Options are the options used by Run.
+type Options struct {
+	// MapOptions are the options used to unpack and repack the image.
+	MapOptions layer.MapOptions
+
+	// Keywords are the mtree keywords used to generate the manifest of the
+	// rootfs. If empty, mtree.DefaultKeywords are used.
+	Keywords []mtree.Keyword
+}
+
+// benchTag is the tag used for the synthetic image.
+const benchTag = "bench"
+
+// Run creates an image containing the workload inside root (which must be an
+// empty directory, and can be removed afterwards) and then benchmarks each of
+// the Phases on it. Creating the image is not included in the results.
+func Run(ctx context.Context, root string, w Workload, opt Options) ([]Result, error) {
+	keywords := opt.Keywords
+	if len(keywords) == 0 {
+		keywords = mtree.DefaultKeywords
+	}
+	fsEval := fseval.DefaultFsEval
+	if opt.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	if opt.MapOptions.Portable {
+		fsEval = fseval.PortableFsEval
+	}
+
+	imagePath := filepath.Join(root, "image")
+	if err := dir.Driver.Create(imagePath); err != nil {
+		return nil, errors.Wrap(err, "create image")
+	}
+	engine, err := dir.Driver.Open(imagePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open image")
+	}
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Set up the image (which isn't part of the benchmark).
+	source := filepath.Join(root, "source")
+	if err := w.Generate(source); err != nil {
+		return nil, errors.Wrap(err, "generate workload")
+	}
+	from, err := createImage(ctx, engineExt, source, &opt.MapOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(source); err != nil {
+		return nil, errors.Wrap(err, "remove workload source")
+	}
+
+	var results []Result
+	timed := func(phase Phase, fn func() error) error {
+		start := time.Now()
+		if err := fn(); err != nil {
+			return errors.Wrapf(err, "benchmark %s", phase)
+		}
+		results = append(results, Result{
+			Workload: w.Name,
+			Phase:    phase,
+			Duration: time.Since(start),
+		})
+		return nil
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	rootfs := filepath.Join(bundle, layer.RootfsName)
+	var spec *mtree.DirectoryHierarchy
+	if err := timed(PhaseUnpack, func() error {
+		blob, err := engineExt.FromDescriptor(ctx, from.Descriptor())
+		if err != nil {
+			return errors.Wrap(err, "get manifest")
+		}
+		defer blob.Close()
+		manifest, ok := blob.Data.(ispec.Manifest)
+		if !ok {
+			return errors.Errorf("[internal error] unexpected manifest type %T", blob.Data)
+		}
+		if err := layer.UnpackManifest(ctx, engine, bundle, manifest, &opt.MapOptions); err != nil {
+			return errors.Wrap(err, "unpack manifest")
+		}
+		spec, err = mtree.Walk(rootfs, nil, keywords, fsEval)
+		return errors.Wrap(err, "generate mtree spec")
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := w.modify(filepath.Join(rootfs, workloadTarget)); err != nil {
+		return nil, err
+	}
+	if err := timed(PhaseRepack, func() error {
+		diffs, err := mtreefilter.Check(rootfs, spec, keywords, fsEval)
+		if err != nil {
+			return errors.Wrap(err, "check mtree")
+		}
+		reader, err := layer.GenerateLayer(rootfs, diffs, &opt.MapOptions)
+		if err != nil {
+			return errors.Wrap(err, "generate diff layer")
+		}
+		defer reader.Close()
+		_, err = addLayer(ctx, engineExt, from, reader)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := engineExt.DeleteReference(ctx, benchTag); err != nil {
+		return nil, errors.Wrap(err, "delete tag")
+	}
+	if err := timed(PhaseGC, func() error {
+		return engineExt.GC(ctx)
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// workloadTarget is the path in the image where the workload is stored.
+const workloadTarget = "data"
+
+// createImage creates an image (tagged as benchTag) containing a single
+// layer, which contains the workload generated in source at workloadTarget.
+func createImage(ctx context.Context, engineExt casext.Engine, source string, opt *layer.MapOptions) (casext.DescriptorPath, error) {
+	g := igen.New()
+	g.SetCreated(time.Unix(0, 0))
+	g.SetOS("linux")
+	g.SetArchitecture("amd64")
+	g.ClearHistory()
+	g.SetRootfsType("layers")
+	g.ClearRootfsDiffIDs()
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, g.Image())
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "put config blob")
+	}
+	manifest := ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "put manifest blob")
+	}
+	base := casext.DescriptorPath{
+		Walk: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}},
+	}
+
+	reader, err := layer.GenerateInsertLayer(source, workloadTarget, opt)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "generate workload layer")
+	}
+	defer reader.Close()
+	return addLayer(ctx, engineExt, base, reader)
+}
+
+// addLayer adds the given (uncompressed) layer to the image at from, and
+// updates benchTag to refer to the new image.
+func addLayer(ctx context.Context, engineExt casext.Engine, from casext.DescriptorPath, reader io.Reader) (casext.DescriptorPath, error) {
+	mutator, err := mutate.New(engineExt, from)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "create mutator")
+	}
+	created := time.Unix(0, 0)
+	if err := mutator.Add(ctx, reader, ispec.History{
+		Created:   &created,
+		CreatedBy: "umoci bench",
+	}); err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "add layer")
+	}
+	path, err := mutator.Commit(ctx)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "commit image")
+	}
+	if err := engineExt.UpdateReference(ctx, benchTag, path.Root()); err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "update tag")
+	}
+	return path, nil
+}
@@ -0,0 +1,166 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bench
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/layer"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+)
+
+var benchScale = flag.Float64("bench.scale", 0.05, "scale of the workloads used by the benchmarks (see Workload.Scale)")
+
+func testOptions() Options {
+	return Options{
+		MapOptions: layer.MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    os.Geteuid() != 0,
+		},
+	}
+}
+
+func TestWorkloadGenerate(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestWorkloadGenerate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	workload := Workload{Name: "test", Files: 5, FileSize: 100, FilesPerDir: 2, Depth: 3}
+	for _, dir := range []string{"a", "b"} {
+		if err := workload.Generate(filepath.Join(root, dir)); err != nil {
+			t.Fatalf("Generate: unexpected error: %+v", err)
+		}
+	}
+
+	for idx := 0; idx < workload.Files; idx++ {
+		a, err := ioutil.ReadFile(filepath.Join(root, "a", workload.path(idx)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(root, "b", workload.path(idx)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(a)) != workload.FileSize || !bytes.Equal(a, b) {
+			t.Errorf("file %d: workload is not reproducible", idx)
+		}
+	}
+	if path := workload.path(4); path != filepath.Join("tree-2", "d", "d", "file-4") {
+		t.Errorf("unexpected path of file 4: %s", path)
+	}
+	fi, err := os.Stat(filepath.Join(root, "a", "tree-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.ModTime().Unix() != 0 {
+		t.Errorf("workload directory has non-reproducible mtime: %v", fi.ModTime())
+	}
+}
+
+func TestGetWorkload(t *testing.T) {
+	for _, workload := range Workloads {
+		got, err := GetWorkload(workload.Name)
+		if err != nil || got.Name != workload.Name {
+			t.Errorf("GetWorkload(%s): got %v, %v", workload.Name, got, err)
+		}
+	}
+	if _, err := GetWorkload("nonexistent"); err == nil {
+		t.Errorf("GetWorkload: expected an error for unknown workload")
+	}
+}
+
+func TestRun(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	workload := Workload{Name: "test", Files: 20, FileSize: 10, FilesPerDir: 5, Depth: 2}
+	results, err := Run(context.Background(), root, workload, testOptions())
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %+v", err)
+	}
+	if len(results) != len(Phases) {
+		t.Fatalf("Run: expected %d results, got %v", len(Phases), results)
+	}
+	for idx, result := range results {
+		if result.Workload != workload.Name || result.Phase != Phases[idx] {
+			t.Errorf("Run: unexpected result %d: %v", idx, result)
+		}
+	}
+
+	// The workload must have been unpacked into the bundle.
+	data, err := ioutil.ReadFile(filepath.Join(root, "bundle", layer.RootfsName, workloadTarget, workload.path(1)))
+	if err != nil {
+		t.Fatalf("workload file missing from bundle: %+v", err)
+	}
+	if int64(len(data)) != workload.FileSize {
+		t.Errorf("unexpected size of unpacked workload file: %d", len(data))
+	}
+
+	// Everything must have been garbage collected.
+	blobs, err := ioutil.ReadDir(filepath.Join(root, "image", "blobs", "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("expected all blobs to be garbage collected, %d remain", len(blobs))
+	}
+}
+
+func BenchmarkWorkloads(b *testing.B) {
+	for _, workload := range Workloads {
+		workload := workload.Scale(*benchScale)
+		b.Run(workload.Name, func(b *testing.B) {
+			totals := map[Phase]float64{}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				root, err := ioutil.TempDir("", "umoci-BenchmarkWorkloads")
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				results, err := Run(context.Background(), root, workload, testOptions())
+				if err != nil {
+					b.Fatalf("Run: unexpected error: %+v", err)
+				}
+				for _, result := range results {
+					totals[result.Phase] += float64(result.Duration.Nanoseconds())
+				}
+
+				b.StopTimer()
+				os.RemoveAll(root)
+				b.StartTimer()
+			}
+			for phase, total := range totals {
+				b.ReportMetric(total/float64(b.N), string(phase)+"-ns/op")
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package buildfile parses the minimal declarative build files used by
+// "umoci build". The syntax is a small subset of the Dockerfile syntax: each
+// line contains a single instruction (lines ending with a backslash are
+// continued on the next line), and lines starting with "#" are comments.
+//
+// The supported instructions are:
+//
+//	FROM <tag>|scratch
+//	COPY <src>... <dest>
+//	RUN <command>|["executable", "arg"...]
+//	ENV <name>=<value>...
+//	LABEL <name>=<value>...
+//	CMD <command>|["executable", "arg"...]
+//	ENTRYPOINT <command>|["executable", "arg"...]
+//	WORKDIR <path>
+//	USER <user>[:<group>]
+//
+// The first instruction must be FROM, and it cannot be used again.
+package buildfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Scratch is the FROM argument which builds an image from an empty image
+// rather than an existing tag.
+const Scratch = "scratch"
+
+// Instruction commands.
+const (
+	From       = "FROM"
+	Copy       = "COPY"
+	Run        = "RUN"
+	Env        = "ENV"
+	Label      = "LABEL"
+	Cmd        = "CMD"
+	Entrypoint = "ENTRYPOINT"
+	Workdir    = "WORKDIR"
+	User       = "USER"
+)
+
+// Instruction is a single parsed instruction from a build file.
+type Instruction struct {
+	// Command is the (upper-case) name of the instruction, such as "COPY".
+	Command string
+
+	// Args are the arguments of the instruction. For the instructions which
+	// take a command (RUN, CMD and ENTRYPOINT), commands given in the shell
+	// form are converted to ["/bin/sh", "-c", "<command>"].
+	Args []string
+
+	// Line is the line number (starting from 1) that the instruction started
+	// on, for error messages.
+	Line int
+
+	// Original is the original text of the instruction (with continuation
+	// lines joined), for use in image history.
+	Original string
+}
+
+// BuildFile is a parsed build file.
+type BuildFile struct {
+	// From is the tag of the base image, or Scratch.
+	From string
+
+	// Instructions are the instructions following FROM, in order.
+	Instructions []Instruction
+}
+
+// logicalLine is a line of a build file with continuations joined.
+type logicalLine struct {
+	text string
+	line int
+}
+
+// readLines returns the non-empty, non-comment logical lines of the build
+// file.
+func readLines(r io.Reader) ([]logicalLine, error) {
+	var (
+		lines   []logicalLine
+		current []string
+		start   int
+	)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		text := strings.TrimSpace(scanner.Text())
+		// Comments are only permitted at the start of a logical line.
+		if len(current) == 0 && (text == "" || strings.HasPrefix(text, "#")) {
+			continue
+		}
+		if len(current) == 0 {
+			start = lineNo
+		}
+		if strings.HasSuffix(text, "\\") {
+			current = append(current, strings.TrimSpace(strings.TrimSuffix(text, "\\")))
+			continue
+		}
+		current = append(current, text)
+		lines = append(lines, logicalLine{text: strings.Join(current, " "), line: start})
+		current = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read build file")
+	}
+	if len(current) != 0 {
+		return nil, errors.Errorf("line %d: unterminated line continuation", start)
+	}
+	return lines, nil
+}
+
+// parseCommand parses the argument of an instruction which takes a command,
+// in either the exec (JSON array) or shell form.
+func parseCommand(rest string) ([]string, error) {
+	if strings.HasPrefix(rest, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(rest), &args); err != nil {
+			return nil, errors.Wrap(err, "parse exec form")
+		}
+		if len(args) == 0 {
+			return nil, errors.Errorf("exec form must not be empty")
+		}
+		return args, nil
+	}
+	return []string{"/bin/sh", "-c", rest}, nil
+}
+
+// parseInstruction parses a single logical line.
+func parseInstruction(line logicalLine) (Instruction, error) {
+	fields := strings.Fields(line.text)
+	command := strings.ToUpper(fields[0])
+	rest := strings.TrimSpace(strings.TrimPrefix(line.text, fields[0]))
+	args := fields[1:]
+
+	inst := Instruction{
+		Command:  command,
+		Line:     line.line,
+		Original: line.text,
+	}
+	switch command {
+	case From, Workdir, User:
+		if len(args) != 1 {
+			return inst, errors.Errorf("%s requires exactly one argument", command)
+		}
+		inst.Args = args
+	case Copy:
+		if len(args) < 2 {
+			return inst, errors.Errorf("%s requires at least two arguments", command)
+		}
+		inst.Args = args
+	case Env, Label:
+		if len(args) == 0 {
+			return inst, errors.Errorf("%s requires at least one argument", command)
+		}
+		for _, arg := range args {
+			if idx := strings.Index(arg, "="); idx <= 0 {
+				return inst, errors.Errorf("%s argument must be of the form <name>=<value>: %q", command, arg)
+			}
+		}
+		inst.Args = args
+	case Run, Cmd, Entrypoint:
+		if rest == "" {
+			return inst, errors.Errorf("%s requires a command", command)
+		}
+		cmdArgs, err := parseCommand(rest)
+		if err != nil {
+			return inst, err
+		}
+		inst.Args = cmdArgs
+	default:
+		return inst, errors.Errorf("unknown instruction %s", fields[0])
+	}
+	return inst, nil
+}
+
+// Parse parses the build file read from r.
+func Parse(r io.Reader) (*BuildFile, error) {
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.Errorf("build file contains no instructions")
+	}
+
+	var buildFile BuildFile
+	for idx, line := range lines {
+		inst, err := parseInstruction(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line.line)
+		}
+		if (idx == 0) != (inst.Command == From) {
+			return nil, errors.Errorf("line %d: FROM must be the first instruction (and only appear once)", line.line)
+		}
+		if inst.Command == From {
+			buildFile.From = inst.Args[0]
+			continue
+		}
+		buildFile.Instructions = append(buildFile.Instructions, inst)
+	}
+	return &buildFile, nil
+}
@@ -0,0 +1,102 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	buildFile, err := Parse(strings.NewReader(`# A comment.
+from base
+
+COPY a b /dest/
+run apk add \
+    --no-cache foo
+RUN ["/bin/echo", "hello world"]
+ENV A=1 B=two=2
+LABEL org.example.label=value
+CMD ["/bin/sh"]
+ENTRYPOINT /entrypoint.sh --flag
+WORKDIR /app
+USER 1000:1000
+`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing build file: %+v", err)
+	}
+
+	if buildFile.From != "base" {
+		t.Errorf("unexpected FROM: %q", buildFile.From)
+	}
+
+	expected := []Instruction{
+		{Command: Copy, Args: []string{"a", "b", "/dest/"}, Line: 4, Original: "COPY a b /dest/"},
+		{Command: Run, Args: []string{"/bin/sh", "-c", "apk add --no-cache foo"}, Line: 5, Original: "run apk add --no-cache foo"},
+		{Command: Run, Args: []string{"/bin/echo", "hello world"}, Line: 7, Original: `RUN ["/bin/echo", "hello world"]`},
+		{Command: Env, Args: []string{"A=1", "B=two=2"}, Line: 8, Original: "ENV A=1 B=two=2"},
+		{Command: Label, Args: []string{"org.example.label=value"}, Line: 9, Original: "LABEL org.example.label=value"},
+		{Command: Cmd, Args: []string{"/bin/sh"}, Line: 10, Original: `CMD ["/bin/sh"]`},
+		{Command: Entrypoint, Args: []string{"/bin/sh", "-c", "/entrypoint.sh --flag"}, Line: 11, Original: "ENTRYPOINT /entrypoint.sh --flag"},
+		{Command: Workdir, Args: []string{"/app"}, Line: 12, Original: "WORKDIR /app"},
+		{Command: User, Args: []string{"1000:1000"}, Line: 13, Original: "USER 1000:1000"},
+	}
+	if !reflect.DeepEqual(buildFile.Instructions, expected) {
+		t.Errorf("unexpected instructions:\n got %#v\nwant %#v", buildFile.Instructions, expected)
+	}
+}
+
+func TestParseScratch(t *testing.T) {
+	buildFile, err := Parse(strings.NewReader("FROM scratch\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing build file: %+v", err)
+	}
+	if buildFile.From != Scratch {
+		t.Errorf("unexpected FROM: %q", buildFile.From)
+	}
+	if len(buildFile.Instructions) != 0 {
+		t.Errorf("unexpected instructions: %#v", buildFile.Instructions)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"# only a comment\n",
+		"COPY a /b\n",
+		"FROM a\nFROM b\n",
+		"FROM\n",
+		"FROM a b\n",
+		"FROM a\nCOPY a\n",
+		"FROM a\nENV A\n",
+		"FROM a\nENV =b\n",
+		"FROM a\nLABEL\n",
+		"FROM a\nRUN\n",
+		"FROM a\nCMD []\n",
+		"FROM a\nCMD [\"unterminated\"\n",
+		"FROM a\nWORKDIR\n",
+		"FROM a\nUSER a b\n",
+		"FROM a\nADD a /b\n",
+		"FROM a\nRUN foo \\\n",
+	} {
+		if buildFile, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("expected error parsing %q: got %#v", input, buildFile)
+		}
+	}
+}
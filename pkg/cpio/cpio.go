@@ -0,0 +1,166 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cpio writes cpio archives in the "newc" (SVR4 without checksums)
+// format, which is the format the Linux kernel accepts for initramfs images
+// (see https://docs.kernel.org/driver-api/early-userspace/buffer-format.html).
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The file type bits of Header.Mode.
+const (
+	TypeFifo    = 0010000
+	TypeChar    = 0020000
+	TypeDir     = 0040000
+	TypeBlock   = 0060000
+	TypeReg     = 0100000
+	TypeSymlink = 0120000
+	TypeSocket  = 0140000
+	TypeMask    = 0170000
+)
+
+// The magic number of newc headers, and the name of the trailer entry.
+const (
+	newcMagic   = "070701"
+	trailerName = "TRAILER!!!"
+)
+
+// Header is the header of an entry in a cpio archive.
+type Header struct {
+	// Name is the path of the entry, which should not have a leading "/".
+	Name string
+
+	// Ino is the inode number of the entry. Entries with the same Ino (and
+	// Nlink of at least 2) are hard links to each other, and only the first
+	// of them needs any contents.
+	Ino uint32
+
+	// Mode is the file type (one of the Type* constants) and permission bits
+	// of the entry.
+	Mode uint32
+
+	// Uid and Gid are the owner of the entry.
+	Uid, Gid uint32
+
+	// Nlink is the number of links to the inode.
+	Nlink uint32
+
+	// ModTime is the modification time of the entry.
+	ModTime time.Time
+
+	// Size is the size of the contents of the entry. For symlinks, the
+	// contents are the target of the symlink.
+	Size int64
+
+	// Devmajor and Devminor are the device numbers of character and block
+	// devices.
+	Devmajor, Devminor uint32
+}
+
+// Writer writes a newc cpio archive.
+type Writer struct {
+	w         io.Writer
+	offset    int64
+	remaining int64
+	closed    bool
+}
+
+// NewWriter creates a new Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// write writes data, keeping track of the offset in the archive.
+func (cw *Writer) write(data []byte) error {
+	n, err := cw.w.Write(data)
+	cw.offset += int64(n)
+	return err
+}
+
+// pad writes NULs until the offset in the archive is a multiple of 4.
+func (cw *Writer) pad() error {
+	if rem := cw.offset % 4; rem != 0 {
+		return cw.write(make([]byte, 4-rem))
+	}
+	return nil
+}
+
+// WriteHeader writes the header of a new entry, which must be followed by
+// exactly hdr.Size bytes of contents written with Write.
+func (cw *Writer) WriteHeader(hdr *Header) error {
+	if cw.closed {
+		return errors.New("write header to closed cpio archive")
+	}
+	if cw.remaining != 0 {
+		return errors.Errorf("missing %d bytes of contents of previous entry", cw.remaining)
+	}
+	if err := cw.pad(); err != nil {
+		return errors.Wrap(err, "pad contents")
+	}
+	if hdr.Size < 0 || hdr.Size > 0xffffffff {
+		return errors.Errorf("%s: invalid size %d", hdr.Name, hdr.Size)
+	}
+	mtime := hdr.ModTime.Unix()
+	if mtime < 0 {
+		mtime = 0
+	} else if mtime > 0xffffffff {
+		mtime = 0xffffffff
+	}
+
+	fields := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		newcMagic, hdr.Ino, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Nlink, mtime, hdr.Size,
+		0, 0, hdr.Devmajor, hdr.Devminor, len(hdr.Name)+1, 0)
+	if err := cw.write([]byte(fields + hdr.Name + "\x00")); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	if err := cw.pad(); err != nil {
+		return errors.Wrap(err, "pad header")
+	}
+	cw.remaining = hdr.Size
+	return nil
+}
+
+// Write writes to the contents of the current entry.
+func (cw *Writer) Write(data []byte) (int, error) {
+	if int64(len(data)) > cw.remaining {
+		return 0, errors.Errorf("write too long: %d bytes remaining", cw.remaining)
+	}
+	n, err := cw.w.Write(data)
+	cw.offset += int64(n)
+	cw.remaining -= int64(n)
+	return n, err
+}
+
+// Close writes the trailer of the archive. It doesn't close the underlying
+// writer.
+func (cw *Writer) Close() error {
+	if cw.closed {
+		return nil
+	}
+	if err := cw.WriteHeader(&Header{Name: trailerName, Nlink: 1}); err != nil {
+		return errors.Wrap(err, "write trailer")
+	}
+	cw.closed = true
+	return errors.Wrap(cw.pad(), "pad trailer")
+}
@@ -0,0 +1,96 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cpio
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	cw := NewWriter(&buf)
+	mtime := time.Unix(0x5a5a5a5a, 0)
+	for _, entry := range []struct {
+		hdr      Header
+		contents string
+	}{
+		{Header{Name: "dir", Ino: 1, Mode: TypeDir | 0755, Nlink: 2, ModTime: mtime}, ""},
+		{Header{Name: "dir/file", Ino: 2, Mode: TypeReg | 0644, Uid: 1000, Gid: 100, Nlink: 1, ModTime: mtime, Size: 5}, "hello"},
+		{Header{Name: "link", Ino: 3, Mode: TypeSymlink | 0777, Nlink: 1, Size: 8}, "dir/file"},
+		{Header{Name: "null", Ino: 4, Mode: TypeChar | 0666, Nlink: 1, Devmajor: 1, Devminor: 3}, ""},
+	} {
+		hdr := entry.hdr
+		if err := cw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unexpected error writing header %s: %+v", hdr.Name, err)
+		}
+		if _, err := io.WriteString(cw, entry.contents); err != nil {
+			t.Fatalf("unexpected error writing %s: %+v", hdr.Name, err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("unexpected error closing archive: %+v", err)
+	}
+
+	archive := buf.String()
+	expectedFile := "070701" + "00000002" + "000081a4" + "000003e8" + "00000064" + "00000001" + "5a5a5a5a" + "00000005" +
+		"00000000" + "00000000" + "00000000" + "00000000" + "00000009" + "00000000" + "dir/file\x00" + "\x00" + "hello"
+	if !strings.Contains(archive, expectedFile) {
+		t.Errorf("archive doesn't contain expected entry for dir/file:\n%q", archive)
+	}
+	if len(archive)%4 != 0 {
+		t.Errorf("archive is not padded: %d bytes", len(archive))
+	}
+	if !strings.Contains(archive, trailerName+"\x00") {
+		t.Errorf("archive doesn't have a trailer")
+	}
+
+	// Check the archive with cpio(1) if it's available.
+	if _, err := exec.LookPath("cpio"); err == nil {
+		cmd := exec.Command("cpio", "-it", "--quiet")
+		cmd.Stdin = bytes.NewReader(buf.Bytes())
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("cpio failed to read archive: %v", err)
+		}
+		if list := strings.Fields(string(out)); strings.Join(list, " ") != "dir dir/file link null" {
+			t.Errorf("unexpected cpio listing: %v", list)
+		}
+	}
+}
+
+func TestWriterInvalid(t *testing.T) {
+	cw := NewWriter(&bytes.Buffer{})
+	if err := cw.WriteHeader(&Header{Name: "file", Mode: TypeReg, Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.Write([]byte("too long")); err == nil {
+		t.Errorf("expected error writing too much")
+	}
+	if err := cw.WriteHeader(&Header{Name: "next", Mode: TypeReg}); err == nil {
+		t.Errorf("expected error writing header before contents")
+	}
+	cw = NewWriter(&bytes.Buffer{})
+	if err := cw.WriteHeader(&Header{Name: "negative", Mode: TypeReg, Size: -1}); err == nil {
+		t.Errorf("expected error with negative size")
+	}
+}
@@ -0,0 +1,336 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package delta implements zsync-style delta transfers, where a file is
+// reconstructed from a similar local file (the basis) by only transferring the
+// blocks of the file which cannot be found in the basis. The sender publishes
+// a Signature containing a weak rolling checksum and a strong checksum of
+// every block, and the receiver uses the rolling checksum to find matching
+// blocks at any offset in the basis.
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinBlockSize and MaxBlockSize are the bounds of the block size picked
+	// by BlockSize.
+	MinBlockSize = 4 * 1024
+	MaxBlockSize = 1024 * 1024
+
+	// strongSize is the number of bytes of the SHA-256 of a block used as the
+	// strong checksum. It doesn't need to be collision resistant, as the
+	// digest of the reconstructed file must be verified by the receiver.
+	strongSize = 16
+)
+
+// BlockSize returns the block size which should be used for a file of the
+// given size, which is roughly the square root of the size.
+func BlockSize(size int64) int {
+	blockSize := MinBlockSize
+	for blockSize < MaxBlockSize && int64(blockSize)*int64(blockSize) < size {
+		blockSize *= 2
+	}
+	return blockSize
+}
+
+// Block contains the checksums of a single block of a file.
+type Block struct {
+	// Weak is the rolling checksum of the block.
+	Weak uint32 `json:"weak"`
+
+	// Strong is the hex-encoded (truncated) SHA-256 of the block.
+	Strong string `json:"strong"`
+}
+
+// Signature contains the checksums of every block of a file.
+type Signature struct {
+	// BlockSize is the size of each block. The final block of the file may
+	// be shorter, and is never matched.
+	BlockSize int `json:"block_size"`
+
+	// Size is the size of the file.
+	Size int64 `json:"size"`
+
+	// Blocks are the checksums of each block, in order.
+	Blocks []Block `json:"blocks"`
+}
+
+// weakSum computes the rsync rolling checksum of a block.
+type weakSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakSum(block []byte) weakSum {
+	sum := weakSum{n: uint32(len(block))}
+	for idx, c := range block {
+		sum.a += uint32(c)
+		sum.b += uint32(len(block)-idx) * uint32(c)
+	}
+	return sum
+}
+
+// roll updates the checksum to remove the byte out from the start of the
+// block and add the byte in to the end of the block.
+func (s *weakSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s weakSum) sum() uint32 {
+	return (s.a & 0xffff) | (s.b << 16)
+}
+
+func strongSum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:strongSize])
+}
+
+// NewSignature computes the signature of the file read from r.
+func NewSignature(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, errors.Errorf("invalid block size %d", blockSize)
+	}
+
+	sig := &Signature{BlockSize: blockSize}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		sig.Size += int64(n)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{
+				Weak:   newWeakSum(block[:n]).sum(),
+				Strong: strongSum(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read block")
+		}
+	}
+	return sig, nil
+}
+
+// Segment is a contiguous part of the file being reconstructed, which is
+// either copied from the basis or must be fetched from the sender.
+type Segment struct {
+	// Offset and Length describe the part of the file.
+	Offset int64
+	Length int64
+
+	// BasisOffset is the offset of the segment in the basis, or -1 if the
+	// segment must be fetched.
+	BasisOffset int64
+}
+
+// fullBlocks returns the number of blocks which are of size BlockSize, and
+// thus can be matched in the basis.
+func (s *Signature) fullBlocks() int {
+	if s.Size%int64(s.BlockSize) == 0 {
+		return len(s.Blocks)
+	}
+	return len(s.Blocks) - 1
+}
+
+// Plan finds the blocks of the file described by the signature which are
+// present in the basis (at any offset), and returns the list of segments
+// needed to reconstruct the file.
+func (s *Signature) Plan(basis io.Reader) ([]Segment, error) {
+	blockSize := s.BlockSize
+	fullBlocks := s.fullBlocks()
+
+	// Index the blocks we're looking for by their weak checksum.
+	weakIndex := map[uint32][]int{}
+	for idx := 0; idx < fullBlocks; idx++ {
+		weak := s.Blocks[idx].Weak
+		weakIndex[weak] = append(weakIndex[weak], idx)
+	}
+
+	found := make([]int64, len(s.Blocks))
+	for idx := range found {
+		found[idx] = -1
+	}
+
+	if fullBlocks > 0 {
+		if err := s.scan(bufio.NewReader(basis), blockSize, weakIndex, found); err != nil {
+			return nil, err
+		}
+	}
+
+	// Convert the matches to segments, merging contiguous segments.
+	var segments []Segment
+	for idx := range s.Blocks {
+		offset := int64(idx) * int64(blockSize)
+		length := int64(blockSize)
+		if offset+length > s.Size {
+			length = s.Size - offset
+		}
+
+		if len(segments) > 0 {
+			last := &segments[len(segments)-1]
+			if (last.BasisOffset < 0 && found[idx] < 0) ||
+				(last.BasisOffset >= 0 && found[idx] == last.BasisOffset+last.Length) {
+				last.Length += length
+				continue
+			}
+		}
+		segments = append(segments, Segment{
+			Offset:      offset,
+			Length:      length,
+			BasisOffset: found[idx],
+		})
+	}
+	return segments, nil
+}
+
+// scan reads the basis, and records the offset of the first match of every
+// block in found.
+func (s *Signature) scan(basis io.ByteReader, blockSize int, weakIndex map[uint32][]int, found []int64) error {
+	// window is a ring buffer containing the current block of the basis,
+	// starting at window[start].
+	window := make([]byte, blockSize)
+	ordered := make([]byte, blockSize)
+
+	var (
+		offset int64 // offset of the start of the window
+		start  int
+		filled int
+		sum    weakSum
+	)
+	for {
+		// Fill the window.
+		eof := false
+		for filled < blockSize {
+			c, err := basis.ReadByte()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "read basis")
+			}
+			window[(start+filled)%blockSize] = c
+			filled++
+			if filled == blockSize {
+				sum = newWeakSum(orderedWindow(window, start, ordered))
+			}
+		}
+		if eof {
+			return nil
+		}
+
+		matched := false
+		if candidates, ok := weakIndex[sum.sum()]; ok {
+			strong := strongSum(orderedWindow(window, start, ordered))
+			for _, idx := range candidates {
+				if found[idx] < 0 && s.Blocks[idx].Strong == strong {
+					found[idx] = offset
+					matched = true
+				}
+			}
+		}
+
+		if matched {
+			// Skip past the matched block.
+			offset += int64(blockSize)
+			start, filled = 0, 0
+			continue
+		}
+
+		// Roll the window forward by one byte.
+		c, err := basis.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read basis")
+		}
+		out := window[start]
+		window[start] = c
+		start = (start + 1) % blockSize
+		offset++
+		sum.roll(out, c)
+	}
+}
+
+// orderedWindow copies the ring buffer into ordered, starting at start.
+func orderedWindow(window []byte, start int, ordered []byte) []byte {
+	n := copy(ordered, window[start:])
+	copy(ordered[n:], window[:start])
+	return ordered
+}
+
+// FetchFunc returns the contents of the given range of the file being
+// reconstructed.
+type FetchFunc func(offset, length int64) (io.ReadCloser, error)
+
+// Assemble reconstructs the file described by the segments, writing it to w.
+// Segments present in the basis are copied from it, and the others are
+// fetched using fetch. The reconstructed file must be verified by the caller.
+func Assemble(w io.Writer, segments []Segment, basis io.ReaderAt, fetch FetchFunc) error {
+	for _, segment := range segments {
+		if err := assembleSegment(w, segment, basis, fetch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assembleSegment copies a single segment to w. Fetched ranges are closed
+// before returning, so that only one is open at a time.
+func assembleSegment(w io.Writer, segment Segment, basis io.ReaderAt, fetch FetchFunc) error {
+	var r io.Reader
+	if segment.BasisOffset >= 0 {
+		r = io.NewSectionReader(basis, segment.BasisOffset, segment.Length)
+	} else {
+		rc, err := fetch(segment.Offset, segment.Length)
+		if err != nil {
+			return errors.Wrapf(err, "fetch range %d+%d", segment.Offset, segment.Length)
+		}
+		defer rc.Close()
+		r = rc
+	}
+	n, err := io.Copy(w, io.LimitReader(r, segment.Length))
+	if err != nil {
+		return errors.Wrapf(err, "copy range %d+%d", segment.Offset, segment.Length)
+	}
+	if n != segment.Length {
+		return errors.Errorf("short range %d+%d: got %d bytes", segment.Offset, segment.Length, n)
+	}
+	return nil
+}
+
+// FetchedBytes returns the number of bytes which must be fetched to
+// reconstruct the file described by the segments.
+func FetchedBytes(segments []Segment) int64 {
+	var fetched int64
+	for _, segment := range segments {
+		if segment.BasisOffset < 0 {
+			fetched += segment.Length
+		}
+	}
+	return fetched
+}
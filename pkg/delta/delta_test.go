@@ -0,0 +1,162 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package delta
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func randomData(rng *rand.Rand, size int) []byte {
+	data := make([]byte, size)
+	rng.Read(data)
+	return data
+}
+
+func TestBlockSize(t *testing.T) {
+	for _, test := range []struct {
+		size     int64
+		expected int
+	}{
+		{0, MinBlockSize},
+		{1024, MinBlockSize},
+		{64 * 1024 * 1024, 8 * 1024},
+		{1 << 40, MaxBlockSize},
+	} {
+		if got := BlockSize(test.size); got != test.expected {
+			t.Errorf("BlockSize(%d): got %d expected %d", test.size, got, test.expected)
+		}
+	}
+}
+
+func TestWeakSumRoll(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := randomData(rng, 256)
+
+	const blockSize = 32
+	sum := newWeakSum(data[:blockSize])
+	for idx := 1; idx+blockSize <= len(data); idx++ {
+		sum.roll(data[idx-1], data[idx+blockSize-1])
+		if expected := newWeakSum(data[idx : idx+blockSize]).sum(); sum.sum() != expected {
+			t.Fatalf("rolled checksum at %d: got %x expected %x", idx, sum.sum(), expected)
+		}
+	}
+}
+
+// closeCounter is an io.ReadCloser which decrements *open when closed.
+type closeCounter struct {
+	io.Reader
+	open *int
+}
+
+func (c *closeCounter) Close() error {
+	*c.open--
+	return nil
+}
+
+// reconstruct plans and assembles new from old, returning the number of bytes
+// fetched.
+func reconstruct(t *testing.T, old, new []byte, blockSize int) int64 {
+	sig, err := NewSignature(bytes.NewReader(new), blockSize)
+	if err != nil {
+		t.Fatalf("unexpected error computing signature: %+v", err)
+	}
+	if sig.Size != int64(len(new)) {
+		t.Errorf("signature has wrong size: got %d expected %d", sig.Size, len(new))
+	}
+
+	segments, err := sig.Plan(bytes.NewReader(old))
+	if err != nil {
+		t.Fatalf("unexpected error planning: %+v", err)
+	}
+
+	var fetched int64
+	var open int
+	fetch := func(offset, length int64) (io.ReadCloser, error) {
+		// Each fetched range must be closed before the next is fetched.
+		if open != 0 {
+			t.Errorf("range %d+%d fetched while %d ranges are still open", offset, length, open)
+		}
+		open++
+		fetched += length
+		return &closeCounter{Reader: bytes.NewReader(new[offset : offset+length]), open: &open}, nil
+	}
+
+	var out bytes.Buffer
+	if err := Assemble(&out, segments, bytes.NewReader(old), fetch); err != nil {
+		t.Fatalf("unexpected error assembling: %+v", err)
+	}
+	if open != 0 {
+		t.Errorf("%d fetched ranges were not closed", open)
+	}
+	if !bytes.Equal(out.Bytes(), new) {
+		t.Fatalf("reconstructed file differs from original")
+	}
+	if got := FetchedBytes(segments); got != fetched {
+		t.Errorf("FetchedBytes: got %d expected %d", got, fetched)
+	}
+	return fetched
+}
+
+func TestDeltaIdentical(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	data := randomData(rng, 64*1024)
+
+	if fetched := reconstruct(t, data, data, 4096); fetched != 0 {
+		t.Errorf("expected nothing to be fetched: fetched %d bytes", fetched)
+	}
+}
+
+func TestDeltaShifted(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	old := randomData(rng, 64*1024)
+
+	// Insert some data in the middle, shifting every later block.
+	new := append([]byte{}, old[:20000]...)
+	new = append(new, randomData(rng, 123)...)
+	new = append(new, old[20000:]...)
+	new = append(new, randomData(rng, 1000)...)
+
+	fetched := reconstruct(t, old, new, 4096)
+	// At most the block with the insertion, its neighbour and the trailing
+	// (modified) part of the file should be fetched.
+	if max := int64(3*4096 + 1000); fetched > max {
+		t.Errorf("fetched too much: fetched %d bytes (expected at most %d)", fetched, max)
+	}
+}
+
+func TestDeltaUnrelated(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	old := randomData(rng, 10000)
+	new := randomData(rng, 30000)
+
+	if fetched := reconstruct(t, old, new, 4096); fetched != int64(len(new)) {
+		t.Errorf("expected entire file to be fetched: fetched %d of %d bytes", fetched, len(new))
+	}
+}
+
+func TestDeltaEmpty(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	data := randomData(rng, 5000)
+
+	reconstruct(t, nil, data, 4096)
+	reconstruct(t, data, nil, 4096)
+	reconstruct(t, data[:100], data[:100], 4096)
+}
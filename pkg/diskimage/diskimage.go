@@ -0,0 +1,179 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package diskimage builds disk images containing a root filesystem, for use
+// with virtual machines (such as QEMU or Firecracker). The filesystems are
+// generated from an extracted root filesystem with the usual mkfs tools
+// (which are run without mounting anything), and can optionally be placed in
+// a partition of a GPT-partitioned disk.
+package diskimage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Filesystem is a filesystem type which can be generated by MakeFilesystem.
+type Filesystem string
+
+// The supported filesystems.
+const (
+	// Ext4 is generated with mkfs.ext4(8). The image has a fixed size.
+	Ext4 Filesystem = "ext4"
+
+	// Btrfs is generated with mkfs.btrfs(8). The image has a fixed size.
+	Btrfs Filesystem = "btrfs"
+
+	// EROFS is generated with mkfs.erofs(1), and is read-only.
+	EROFS Filesystem = "erofs"
+
+	// SquashFS is generated with mksquashfs(1), and is read-only.
+	SquashFS Filesystem = "squashfs"
+)
+
+// ParseFilesystem returns the Filesystem with the given name.
+func ParseFilesystem(name string) (Filesystem, error) {
+	switch fs := Filesystem(name); fs {
+	case Ext4, Btrfs, EROFS, SquashFS:
+		return fs, nil
+	}
+	return "", errors.Errorf("unknown filesystem: %q", name)
+}
+
+// ReadOnly returns whether the filesystem is read-only, in which case its
+// size is determined by its contents.
+func (fs Filesystem) ReadOnly() bool {
+	return fs == EROFS || fs == SquashFS
+}
+
+// MinSize is the smallest size used for writable filesystems (btrfs refuses
+// to create smaller filesystems).
+const MinSize = 256 << 20
+
+// EstimateSize returns a size for a writable filesystem with the contents of
+// the given root filesystem, which leaves some space for the metadata of the
+// filesystem and for modifications by the virtual machine. The size is a
+// multiple of 1MiB, and at least MinSize.
+func EstimateSize(rootfs string) (int64, error) {
+	var used int64
+	if err := filepath.Walk(rootfs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Round up to the block size, and account for the inode.
+		used += (fi.Size()+4095)/4096*4096 + 256
+		return nil
+	}); err != nil {
+		return 0, errors.Wrap(err, "walk rootfs")
+	}
+
+	size := used + used/2 + 64<<20
+	if size < MinSize {
+		size = MinSize
+	}
+	return (size + 1<<20 - 1) &^ (1<<20 - 1), nil
+}
+
+// Options are the options for MakeFilesystem.
+type Options struct {
+	// Size is the size of writable filesystems (see EstimateSize). It is
+	// ignored for read-only filesystems.
+	Size int64
+
+	// Label is the label of the filesystem.
+	Label string
+
+	// Seed is used to derive the UUIDs of the filesystem (and of the GPT disk
+	// and partition written by WriteGPTDisk), so that the same Seed (such as
+	// the digest of an image) results in the same UUIDs.
+	Seed []byte
+}
+
+// UUID returns a (version 4) UUID derived from the Seed of the options and
+// the given purpose.
+func (opt Options) UUID(purpose string) [16]byte {
+	var uuid [16]byte
+	sum := sha256.Sum256(append(append([]byte{}, opt.Seed...), purpose...))
+	copy(uuid[:], sum[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return uuid
+}
+
+// formatUUID returns the usual textual form of a UUID.
+func formatUUID(uuid [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// mkfsCommand returns the command which generates a filesystem image at
+// output with the contents of rootfs.
+func mkfsCommand(fs Filesystem, rootfs, output string, opt Options) *exec.Cmd {
+	uuid := formatUUID(opt.UUID("filesystem"))
+	switch fs {
+	case Ext4:
+		return exec.Command("mkfs.ext4", "-q", "-F", "-L", opt.Label, "-U", uuid, "-E", "hash_seed="+uuid, "-d", rootfs, output)
+	case Btrfs:
+		return exec.Command("mkfs.btrfs", "-q", "-f", "-L", opt.Label, "-U", uuid, "-r", rootfs, output)
+	case EROFS:
+		return exec.Command("mkfs.erofs", "-L", opt.Label, "-U", uuid, output, rootfs)
+	case SquashFS:
+		return exec.Command("mksquashfs", rootfs, output, "-noappend", "-quiet")
+	}
+	return nil
+}
+
+// MakeFilesystem generates a filesystem image of the given type at output,
+// containing the files in the extracted root filesystem at rootfs (including
+// their ownership, which the mkfs tools copy from the host filesystem).
+func MakeFilesystem(fs Filesystem, rootfs, output string, opt Options) error {
+	cmd := mkfsCommand(fs, rootfs, output, opt)
+	if cmd == nil {
+		return errors.Errorf("unknown filesystem: %q", fs)
+	}
+
+	if fs.ReadOnly() {
+		// mksquashfs would add the rootfs to an existing image.
+		if err := os.Remove(output); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove old image")
+		}
+	} else {
+		if opt.Size <= 0 {
+			return errors.Errorf("size of %s filesystem must be positive", fs)
+		}
+		fh, err := os.Create(output)
+		if err != nil {
+			return errors.Wrap(err, "create image")
+		}
+		// The image is sparse, so unused space doesn't take up any room.
+		err = fh.Truncate(opt.Size)
+		fh.Close()
+		if err != nil {
+			return errors.Wrap(err, "truncate image")
+		}
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "run %s: %s", cmd.Args[0], out)
+	}
+	return nil
+}
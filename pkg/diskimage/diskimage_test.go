@@ -0,0 +1,115 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diskimage
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFilesystem(t *testing.T) {
+	for _, name := range []string{"ext4", "btrfs", "erofs", "squashfs"} {
+		fs, err := ParseFilesystem(name)
+		if err != nil || string(fs) != name {
+			t.Errorf("ParseFilesystem(%q): got %q, %v", name, fs, err)
+		}
+	}
+	for _, name := range []string{"", "xfs", "EXT4"} {
+		if _, err := ParseFilesystem(name); err == nil {
+			t.Errorf("expected error parsing filesystem %q", name)
+		}
+	}
+	if Ext4.ReadOnly() || !SquashFS.ReadOnly() {
+		t.Errorf("unexpected ReadOnly results")
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestEstimateSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	size, err := EstimateSize(dir)
+	if err != nil {
+		t.Fatalf("unexpected error estimating size: %+v", err)
+	}
+	if size != MinSize {
+		t.Errorf("unexpected size of empty rootfs: %d", size)
+	}
+
+	fh, err := os.Create(filepath.Join(dir, "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fh.Truncate(MinSize)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err = EstimateSize(dir)
+	if err != nil {
+		t.Fatalf("unexpected error estimating size: %+v", err)
+	}
+	if size < MinSize+MinSize/2 || size%(1<<20) != 0 {
+		t.Errorf("unexpected size of large rootfs: %d", size)
+	}
+}
+
+func TestMakeFilesystemExt4(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("test requires mkfs.ext4")
+	}
+	dir, err := ioutil.TempDir("", "umoci-TestMakeFilesystemExt4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "fs.img")
+	if err := MakeFilesystem(Ext4, rootfs, output, Options{}); err == nil {
+		t.Errorf("expected error without size")
+	}
+	if err := MakeFilesystem(Ext4, rootfs, output, Options{Size: 16 << 20, Label: "root", Seed: []byte("seed")}); err != nil {
+		t.Fatalf("unexpected error making filesystem: %+v", err)
+	}
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The magic number and UUID of the ext4 superblock.
+	if len(data) != 16<<20 || data[1024+0x38] != 0x53 || data[1024+0x39] != 0xef {
+		t.Fatalf("output is not an ext4 filesystem")
+	}
+	uuid := Options{Seed: []byte("seed")}.UUID("filesystem")
+	if string(data[1024+0x68:1024+0x78]) != string(uuid[:]) {
+		t.Errorf("unexpected filesystem uuid: %x", data[1024+0x68:1024+0x78])
+	}
+}
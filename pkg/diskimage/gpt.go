@@ -0,0 +1,274 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// SectorSize is the size of the logical blocks of the disks written by
+// WriteGPTDisk.
+const SectorSize = 512
+
+// The layout of the disks written by WriteGPTDisk.
+const (
+	gptEntries       = 128
+	gptEntrySize     = 128
+	gptHeaderSize    = 92
+	gptEntrySectors  = gptEntries * gptEntrySize / SectorSize
+	gptRevision      = 0x00010000
+	gptSignature     = "EFI PART"
+	gptNameSize      = 72
+	partitionAlign   = (1 << 20) / SectorSize
+	mbrProtectiveGPT = 0xee
+)
+
+// GUID is a GUID in its on-disk (mixed-endian) form.
+type GUID [16]byte
+
+// ParseGUID parses a GUID in its textual form (as used in the Discoverable
+// Partitions Specification).
+func ParseGUID(text string) (GUID, error) {
+	var guid GUID
+	data, err := hex.DecodeString(strings.Replace(text, "-", "", -1))
+	if err != nil || len(data) != 16 || len(text) != 36 {
+		return guid, errors.Errorf("invalid guid: %q", text)
+	}
+	copy(guid[:], data)
+	guid.swap()
+	return guid, nil
+}
+
+// MustParseGUID is like ParseGUID but panics if the GUID is invalid.
+func MustParseGUID(text string) GUID {
+	guid, err := ParseGUID(text)
+	if err != nil {
+		panic(err)
+	}
+	return guid
+}
+
+// swap converts the GUID between its on-disk and textual byte order (the
+// first three fields are little-endian on-disk).
+func (guid *GUID) swap() {
+	guid[0], guid[1], guid[2], guid[3] = guid[3], guid[2], guid[1], guid[0]
+	guid[4], guid[5] = guid[5], guid[4]
+	guid[6], guid[7] = guid[7], guid[6]
+}
+
+// guidFromUUID returns the GUID with the same textual form as the UUID.
+func guidFromUUID(uuid [16]byte) GUID {
+	guid := GUID(uuid)
+	guid.swap()
+	return guid
+}
+
+// String returns the textual form of the GUID.
+func (guid GUID) String() string {
+	guid.swap()
+	return strings.ToUpper(formatUUID(guid))
+}
+
+// LinuxFilesystemGUID is the partition type GUID for generic Linux
+// filesystems.
+var LinuxFilesystemGUID = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+
+// rootPartitionGUIDs are the partition type GUIDs of root partitions for each
+// GOARCH, from the Discoverable Partitions Specification.
+var rootPartitionGUIDs = map[string]GUID{
+	"386":     MustParseGUID("44479540-F297-41B2-9AF7-D131D5F0458A"),
+	"amd64":   MustParseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"),
+	"arm":     MustParseGUID("69DAD710-2CE4-4E3C-B16C-21A1D49ABED3"),
+	"arm64":   MustParseGUID("B921B045-1DF0-41C3-AF44-4C6F280D3FAE"),
+	"ppc64le": MustParseGUID("C31C45E6-3F39-412E-80FB-4809C4980599"),
+	"riscv64": MustParseGUID("72EC70A6-CF74-40E6-BD49-4BDA08E8F224"),
+	"s390x":   MustParseGUID("5EEAD9A9-FE09-4A1E-A1D7-520D00531306"),
+}
+
+// RootPartitionGUID returns the partition type GUID of a root partition for
+// the given architecture (as used in image configurations), so that
+// systemd-gpt-auto-generator(8) can find the root partition. If there is no
+// such GUID for the architecture, LinuxFilesystemGUID is returned.
+func RootPartitionGUID(arch string) GUID {
+	if guid, ok := rootPartitionGUIDs[arch]; ok {
+		return guid
+	}
+	return LinuxFilesystemGUID
+}
+
+// Partition describes the partition of a disk written by WriteGPTDisk.
+type Partition struct {
+	// Offset is the offset of the partition in the disk (in bytes).
+	Offset int64
+
+	// Size is the size of the partition (in bytes).
+	Size int64
+}
+
+// gptHeader returns a GPT header (padded to a sector), given the CRC32 of its
+// partition entries.
+func gptHeader(diskGUID GUID, current, backup, firstUsable, lastUsable, entries uint64, entriesCRC uint32) []byte {
+	header := make([]byte, SectorSize)
+	copy(header[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(header[8:], gptRevision)
+	binary.LittleEndian.PutUint32(header[12:], gptHeaderSize)
+	binary.LittleEndian.PutUint64(header[24:], current)
+	binary.LittleEndian.PutUint64(header[32:], backup)
+	binary.LittleEndian.PutUint64(header[40:], firstUsable)
+	binary.LittleEndian.PutUint64(header[48:], lastUsable)
+	copy(header[56:72], diskGUID[:])
+	binary.LittleEndian.PutUint64(header[72:], entries)
+	binary.LittleEndian.PutUint32(header[80:], gptEntries)
+	binary.LittleEndian.PutUint32(header[84:], gptEntrySize)
+	binary.LittleEndian.PutUint32(header[88:], entriesCRC)
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:gptHeaderSize]))
+	return header
+}
+
+// protectiveMBR returns a protective MBR for a GPT disk with the given number
+// of sectors.
+func protectiveMBR(sectors uint64) []byte {
+	mbr := make([]byte, SectorSize)
+	entry := mbr[446:462]
+	// The CHS addresses are (0, 0, 2) and the maximum.
+	entry[1], entry[2], entry[3] = 0x00, 0x02, 0x00
+	entry[4] = mbrProtectiveGPT
+	entry[5], entry[6], entry[7] = 0xff, 0xff, 0xff
+	binary.LittleEndian.PutUint32(entry[8:], 1)
+	size := sectors - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(entry[12:], uint32(size))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
+
+// WriteGPTDisk writes a GPT-partitioned disk image to output, with a single
+// partition (of the given type and name) containing the filesystem image at
+// fsImage. The partition is aligned to 1MiB. The disk and partition GUIDs are
+// derived from opt.Seed.
+func WriteGPTDisk(output, fsImage string, partType GUID, name string, opt Options) (_ Partition, Err error) {
+	in, err := os.Open(fsImage)
+	if err != nil {
+		return Partition{}, errors.Wrap(err, "open filesystem image")
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return Partition{}, errors.Wrap(err, "stat filesystem image")
+	}
+
+	partSectors := (uint64(fi.Size()) + SectorSize - 1) / SectorSize
+	firstLBA := uint64(partitionAlign)
+	lastLBA := firstLBA + partSectors - 1
+	// Leave the rest of the last 1MiB (and at least enough space for the
+	// backup GPT) after the partition.
+	sectors := (lastLBA+1+gptEntrySectors+1+partitionAlign-1)/partitionAlign*partitionAlign + partitionAlign
+	backupLBA := sectors - 1
+	backupEntriesLBA := backupLBA - gptEntrySectors
+	firstUsable := uint64(2 + gptEntrySectors)
+	lastUsable := backupEntriesLBA - 1
+
+	diskGUID, partGUID := guidFromUUID(opt.UUID("gpt disk")), guidFromUUID(opt.UUID("gpt partition"))
+	entries := make([]byte, gptEntries*gptEntrySize)
+	copy(entries[0:16], partType[:])
+	copy(entries[16:32], partGUID[:])
+	binary.LittleEndian.PutUint64(entries[32:], firstLBA)
+	binary.LittleEndian.PutUint64(entries[40:], lastLBA)
+	utf16Name := utf16.Encode([]rune(name))
+	if len(utf16Name)*2 > gptNameSize {
+		return Partition{}, errors.Errorf("partition name %q is too long", name)
+	}
+	for idx, char := range utf16Name {
+		binary.LittleEndian.PutUint16(entries[56+2*idx:], char)
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	out, err := os.Create(output)
+	if err != nil {
+		return Partition{}, errors.Wrap(err, "create disk image")
+	}
+	defer func() {
+		if err := out.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close disk image")
+		}
+	}()
+	if err := out.Truncate(int64(sectors * SectorSize)); err != nil {
+		return Partition{}, errors.Wrap(err, "truncate disk image")
+	}
+
+	for _, write := range []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, protectiveMBR(sectors)},
+		{1, gptHeader(diskGUID, 1, backupLBA, firstUsable, lastUsable, 2, entriesCRC)},
+		{2, entries},
+		{backupEntriesLBA, entries},
+		{backupLBA, gptHeader(diskGUID, backupLBA, 1, firstUsable, lastUsable, backupEntriesLBA, entriesCRC)},
+	} {
+		if _, err := out.WriteAt(write.data, int64(write.lba*SectorSize)); err != nil {
+			return Partition{}, errors.Wrap(err, "write partition table")
+		}
+	}
+
+	partition := Partition{
+		Offset: int64(firstLBA * SectorSize),
+		Size:   int64(partSectors * SectorSize),
+	}
+	if err := sparseCopy(out, partition.Offset, in); err != nil {
+		return Partition{}, errors.Wrap(err, "copy filesystem image")
+	}
+	return partition, nil
+}
+
+// sparseCopyChunk is the size of the chunks copied by sparseCopy.
+const sparseCopyChunk = 64 << 10
+
+// sparseCopy copies the contents of r to out (which must already be large
+// enough, and zero-filled) at the given offset. Chunks which only contain
+// zeroes are skipped, so that holes in sparse filesystem images stay holes.
+func sparseCopy(out *os.File, offset int64, r io.Reader) error {
+	buf := make([]byte, sparseCopyChunk)
+	zero := make([]byte, sparseCopyChunk)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := out.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestParseGUID(t *testing.T) {
+	guid, err := ParseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+	if err != nil {
+		t.Fatalf("unexpected error parsing guid: %+v", err)
+	}
+	expected := GUID{0xe3, 0xbc, 0x68, 0x4f, 0xcd, 0xe8, 0xb1, 0x4d, 0x96, 0xe7, 0xfb, 0xca, 0xf9, 0x84, 0xb7, 0x09}
+	if guid != expected {
+		t.Errorf("unexpected on-disk guid: %x", guid)
+	}
+	if text := guid.String(); text != "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709" {
+		t.Errorf("unexpected guid string: %s", text)
+	}
+	if RootPartitionGUID("amd64") != guid || RootPartitionGUID("unknown") != LinuxFilesystemGUID {
+		t.Errorf("unexpected root partition guids")
+	}
+
+	for _, text := range []string{"", "4F68BCE3", "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B7", "ZF68BCE3-E8CD-4DB1-96E7-FBCAF984B709"} {
+		if _, err := ParseGUID(text); err == nil {
+			t.Errorf("expected error parsing invalid guid %q", text)
+		}
+	}
+}
+
+// checkGPTHeader checks the GPT header at the given LBA of the disk, and
+// returns its partition entries.
+func checkGPTHeader(t *testing.T, disk []byte, lba, backupLBA uint64) []byte {
+	header := disk[lba*SectorSize : lba*SectorSize+gptHeaderSize]
+	if string(header[:8]) != gptSignature {
+		t.Fatalf("gpt header at lba %d has invalid signature", lba)
+	}
+	crc := binary.LittleEndian.Uint32(header[16:])
+	check := append([]byte{}, header...)
+	binary.LittleEndian.PutUint32(check[16:], 0)
+	if crc32.ChecksumIEEE(check) != crc {
+		t.Errorf("gpt header at lba %d has invalid crc", lba)
+	}
+	if current, backup := binary.LittleEndian.Uint64(header[24:]), binary.LittleEndian.Uint64(header[32:]); current != lba || backup != backupLBA {
+		t.Errorf("gpt header at lba %d has invalid lbas: %d %d", lba, current, backup)
+	}
+	entriesLBA := binary.LittleEndian.Uint64(header[72:])
+	entries := disk[entriesLBA*SectorSize : entriesLBA*SectorSize+gptEntries*gptEntrySize]
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+		t.Errorf("gpt entries of header at lba %d have invalid crc", lba)
+	}
+	return entries
+}
+
+func TestWriteGPTDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestWriteGPTDisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The filesystem image isn't a multiple of the sector size, and contains
+	// a hole.
+	fsImage := append(bytes.Repeat([]byte("a"), sparseCopyChunk+100), make([]byte, 2*sparseCopyChunk)...)
+	fsImage = append(fsImage, "end"...)
+	fsPath := filepath.Join(dir, "fs.img")
+	if err := ioutil.WriteFile(fsPath, fsImage, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diskPath := filepath.Join(dir, "disk.img")
+	opt := Options{Seed: []byte("seed")}
+	partType := RootPartitionGUID("arm64")
+	partition, err := WriteGPTDisk(diskPath, fsPath, partType, "root", opt)
+	if err != nil {
+		t.Fatalf("unexpected error writing disk: %+v", err)
+	}
+	if partition.Offset != 1<<20 || partition.Size != int64(len(fsImage)+SectorSize-1)/SectorSize*SectorSize {
+		t.Errorf("unexpected partition: %+v", partition)
+	}
+
+	disk, err := ioutil.ReadFile(diskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disk)%(1<<20) != 0 {
+		t.Errorf("disk size %d is not aligned", len(disk))
+	}
+	if !bytes.Equal(disk[partition.Offset:partition.Offset+int64(len(fsImage))], fsImage) {
+		t.Errorf("partition does not contain the filesystem image")
+	}
+
+	// Protective MBR.
+	sectors := uint64(len(disk) / SectorSize)
+	if disk[510] != 0x55 || disk[511] != 0xaa || disk[446+4] != mbrProtectiveGPT {
+		t.Errorf("invalid protective mbr")
+	}
+
+	// Both headers must describe the same partition.
+	primary := checkGPTHeader(t, disk, 1, sectors-1)
+	backup := checkGPTHeader(t, disk, sectors-1, 1)
+	if !bytes.Equal(primary, backup) {
+		t.Errorf("primary and backup partition entries differ")
+	}
+	if !bytes.Equal(primary[0:16], partType[:]) {
+		t.Errorf("unexpected partition type: %x", primary[0:16])
+	}
+	firstLBA, lastLBA := binary.LittleEndian.Uint64(primary[32:]), binary.LittleEndian.Uint64(primary[40:])
+	if int64(firstLBA*SectorSize) != partition.Offset || int64((lastLBA-firstLBA+1)*SectorSize) != partition.Size {
+		t.Errorf("unexpected partition lbas: %d-%d", firstLBA, lastLBA)
+	}
+	lastUsable := binary.LittleEndian.Uint64(disk[SectorSize+48:])
+	if lastLBA > lastUsable {
+		t.Errorf("partition ends after last usable lba %d", lastUsable)
+	}
+	name := make([]uint16, 4)
+	for idx := range name {
+		name[idx] = binary.LittleEndian.Uint16(primary[56+2*idx:])
+	}
+	if string(utf16.Decode(name)) != "root" {
+		t.Errorf("unexpected partition name: %v", name)
+	}
+
+	// The GUIDs are reproducible.
+	diskPath2 := filepath.Join(dir, "disk2.img")
+	if _, err := WriteGPTDisk(diskPath2, fsPath, partType, "root", opt); err != nil {
+		t.Fatalf("unexpected error writing disk: %+v", err)
+	}
+	disk2, err := ioutil.ReadFile(diskPath2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(disk, disk2) {
+		t.Errorf("disk images are not reproducible")
+	}
+
+	if _, err := WriteGPTDisk(diskPath, fsPath, partType, "a very long partition name which doesn't fit", opt); err == nil {
+		t.Errorf("expected error with long partition name")
+	}
+}
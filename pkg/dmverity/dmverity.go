@@ -0,0 +1,200 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package dmverity generates the hash trees used by Linux's dm-verity to
+// verify block devices (see
+// https://docs.kernel.org/admin-guide/device-mapper/verity.html), in the
+// same format as veritysetup-format(8). Only SHA-256 with 4096-byte data and
+// hash blocks (the defaults used by veritysetup) is supported.
+package dmverity
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// BlockSize is the size of the data and hash blocks.
+const BlockSize = 4096
+
+// MaxSaltSize is the largest salt which can be stored in the superblock.
+const MaxSaltSize = 256
+
+// The values stored in the superblock (struct verity_sb in cryptsetup).
+const (
+	superblockSize    = 512
+	superblockVersion = 1
+	hashTypeNormal    = 1
+	algorithmName     = "sha256"
+)
+
+// hashesPerBlock is the number of hashes stored in each hash block.
+const hashesPerBlock = BlockSize / sha256.Size
+
+// Tree describes a hash tree appended to a file by Append.
+type Tree struct {
+	// RootHash is the hash of the top level of the tree, which has to be
+	// given to veritysetup-open(8).
+	RootHash []byte
+
+	// Salt is the salt used for every hash in the tree.
+	Salt []byte
+
+	// DataBlocks is the number of BlockSize blocks of data protected by the
+	// tree.
+	DataBlocks uint64
+
+	// HashOffset is the offset in the file of the superblock, which is
+	// followed by the hash tree (--hash-offset for veritysetup-open(8)).
+	HashOffset int64
+
+	// UUID is the UUID stored in the superblock, which is derived from the
+	// root hash so that the output is reproducible.
+	UUID [16]byte
+}
+
+// RootHashHex returns the root hash as a hex string.
+func (t *Tree) RootHashHex() string {
+	return hex.EncodeToString(t.RootHash)
+}
+
+// hashBlock returns the hash of the given block, with the salt prepended (as
+// in version 1 of the dm-verity format).
+func hashBlock(salt, block []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// hashLevel hashes count blocks of the file starting at src, and writes the
+// hashes (in whole hash blocks, padded with zeroes) to the file starting at
+// dst.
+func hashLevel(file *os.File, salt []byte, src int64, count uint64, dst int64) error {
+	block := make([]byte, BlockSize)
+	hashes := make([]byte, BlockSize)
+	for idx := uint64(0); idx < count; idx += hashesPerBlock {
+		for i := range hashes {
+			hashes[i] = 0
+		}
+		for i := uint64(0); i < hashesPerBlock && idx+i < count; i++ {
+			if _, err := file.ReadAt(block, src+int64(idx+i)*BlockSize); err != nil {
+				return errors.Wrap(err, "read block")
+			}
+			copy(hashes[i*sha256.Size:], hashBlock(salt, block))
+		}
+		if _, err := file.WriteAt(hashes, dst+int64(idx/hashesPerBlock)*BlockSize); err != nil {
+			return errors.Wrap(err, "write hash block")
+		}
+	}
+	return nil
+}
+
+// levelSizes returns the number of hash blocks in each level of the tree for
+// the given number of data blocks, starting with the level containing the
+// hashes of the data blocks. If there is only one data block, there are no
+// levels and the root hash is the hash of the data block.
+func levelSizes(dataBlocks uint64) []uint64 {
+	var sizes []uint64
+	for count := dataBlocks; count > 1; {
+		count = (count + hashesPerBlock - 1) / hashesPerBlock
+		sizes = append(sizes, count)
+	}
+	return sizes
+}
+
+// Append pads the given file (opened for reading and writing) with zeroes to
+// a multiple of BlockSize, and appends a superblock and hash tree for its
+// contents using the given salt (which may be empty). The file can then be
+// opened with "veritysetup open <file> <name> <file> <root-hash>
+// --hash-offset=<offset>".
+func Append(file *os.File, salt []byte) (*Tree, error) {
+	if len(salt) > MaxSaltSize {
+		return nil, errors.Errorf("salt is larger than %d bytes", MaxSaltSize)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat data")
+	}
+	if fi.Size() == 0 {
+		return nil, errors.Errorf("cannot create hash tree for empty data")
+	}
+	hashOffset := (fi.Size() + BlockSize - 1) / BlockSize * BlockSize
+	if err := file.Truncate(hashOffset); err != nil {
+		return nil, errors.Wrap(err, "pad data")
+	}
+	tree := &Tree{
+		Salt:       append([]byte{}, salt...),
+		DataBlocks: uint64(hashOffset / BlockSize),
+		HashOffset: hashOffset,
+	}
+
+	// The levels are stored with the top of the tree first, after the block
+	// containing the superblock.
+	sizes := levelSizes(tree.DataBlocks)
+	offsets := make([]int64, len(sizes))
+	end := hashOffset + BlockSize
+	for idx := len(sizes) - 1; idx >= 0; idx-- {
+		offsets[idx] = end
+		end += int64(sizes[idx]) * BlockSize
+	}
+	if err := file.Truncate(end); err != nil {
+		return nil, errors.Wrap(err, "allocate hash tree")
+	}
+
+	src, count := int64(0), tree.DataBlocks
+	for idx, size := range sizes {
+		if err := hashLevel(file, salt, src, count, offsets[idx]); err != nil {
+			return nil, errors.Wrapf(err, "hash level %d", idx)
+		}
+		src, count = offsets[idx], size
+	}
+	top := make([]byte, BlockSize)
+	if _, err := file.ReadAt(top, src); err != nil {
+		return nil, errors.Wrap(err, "read top block")
+	}
+	tree.RootHash = hashBlock(salt, top)
+
+	// Make the UUID look like a random (version 4) UUID.
+	copy(tree.UUID[:], tree.RootHash)
+	tree.UUID[6] = tree.UUID[6]&0x0f | 0x40
+	tree.UUID[8] = tree.UUID[8]&0x3f | 0x80
+
+	if _, err := file.WriteAt(tree.superblock(), hashOffset); err != nil {
+		return nil, errors.Wrap(err, "write superblock")
+	}
+	return tree, nil
+}
+
+// superblock returns the encoded superblock describing the tree.
+func (t *Tree) superblock() []byte {
+	sb := make([]byte, superblockSize)
+	copy(sb[0:8], "verity")
+	binary.LittleEndian.PutUint32(sb[8:], superblockVersion)
+	binary.LittleEndian.PutUint32(sb[12:], hashTypeNormal)
+	copy(sb[16:32], t.UUID[:])
+	copy(sb[32:64], algorithmName)
+	binary.LittleEndian.PutUint32(sb[64:], BlockSize)
+	binary.LittleEndian.PutUint32(sb[68:], BlockSize)
+	binary.LittleEndian.PutUint64(sb[72:], t.DataBlocks)
+	binary.LittleEndian.PutUint16(sb[80:], uint16(len(t.Salt)))
+	copy(sb[88:88+MaxSaltSize], t.Salt)
+	return sb
+}
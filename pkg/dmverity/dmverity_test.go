@@ -0,0 +1,174 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dmverity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// simpleTree builds the hash tree of data (which must be a multiple of
+// BlockSize) in memory, returning the root hash and the levels of the tree
+// as stored on disk (with the top of the tree first).
+func simpleTree(data, salt []byte) ([]byte, []byte) {
+	hash := func(block []byte) []byte {
+		sum := sha256.Sum256(append(append([]byte{}, salt...), block...))
+		return sum[:]
+	}
+
+	var levels [][]byte
+	level := data
+	for len(level) > BlockSize {
+		var hashes []byte
+		for off := 0; off < len(level); off += BlockSize {
+			hashes = append(hashes, hash(level[off:off+BlockSize])...)
+			// Each hash block is padded with zeroes.
+			if len(hashes)%BlockSize == 0 || off+BlockSize == len(level) {
+				hashes = append(hashes, make([]byte, (BlockSize-len(hashes)%BlockSize)%BlockSize)...)
+			}
+		}
+		levels = append([][]byte{hashes}, levels...)
+		level = hashes
+	}
+	return hash(level), bytes.Join(levels, nil)
+}
+
+func TestAppend(t *testing.T) {
+	rand.Seed(1)
+	for _, test := range []struct {
+		name string
+		size int
+		salt []byte
+	}{
+		{"OneBlock", BlockSize, nil},
+		{"Padded", 100, nil},
+		{"TwoBlocks", 2 * BlockSize, nil},
+		{"FullLevel", hashesPerBlock * BlockSize, nil},
+		{"TwoLevels", (hashesPerBlock + 1) * BlockSize, nil},
+		{"Salted", 300*BlockSize + 1, []byte("salt")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.size)
+			rand.Read(data)
+
+			file, err := ioutil.TempFile("", "umoci-TestAppend")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			defer file.Close()
+			if _, err := file.Write(data); err != nil {
+				t.Fatal(err)
+			}
+
+			tree, err := Append(file, test.salt)
+			if err != nil {
+				t.Fatalf("unexpected error appending hash tree: %+v", err)
+			}
+
+			padded := append(data, make([]byte, (BlockSize-len(data)%BlockSize)%BlockSize)...)
+			root, levels := simpleTree(padded, test.salt)
+			if !bytes.Equal(tree.RootHash, root) {
+				t.Errorf("unexpected root hash: got %x, expected %x", tree.RootHash, root)
+			}
+			if tree.HashOffset != int64(len(padded)) || tree.DataBlocks != uint64(len(padded)/BlockSize) {
+				t.Errorf("unexpected hash offset %d and data blocks %d", tree.HashOffset, tree.DataBlocks)
+			}
+
+			contents, err := ioutil.ReadFile(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(contents) != len(padded)+BlockSize+len(levels) {
+				t.Fatalf("unexpected file size %d", len(contents))
+			}
+			if !bytes.Equal(contents[:len(padded)], padded) {
+				t.Errorf("data was modified")
+			}
+			if !bytes.Equal(contents[len(padded)+BlockSize:], levels) {
+				t.Errorf("unexpected hash tree")
+			}
+
+			sb := contents[len(padded) : len(padded)+BlockSize]
+			if string(sb[:8]) != "verity\x00\x00" || binary.LittleEndian.Uint32(sb[8:]) != 1 || binary.LittleEndian.Uint32(sb[12:]) != 1 {
+				t.Errorf("unexpected superblock header: %x", sb[:16])
+			}
+			if string(bytes.TrimRight(sb[32:64], "\x00")) != "sha256" {
+				t.Errorf("unexpected superblock algorithm: %q", sb[32:64])
+			}
+			if binary.LittleEndian.Uint32(sb[64:]) != BlockSize || binary.LittleEndian.Uint32(sb[68:]) != BlockSize {
+				t.Errorf("unexpected superblock block sizes")
+			}
+			if binary.LittleEndian.Uint64(sb[72:]) != tree.DataBlocks {
+				t.Errorf("unexpected superblock data blocks: %d", binary.LittleEndian.Uint64(sb[72:]))
+			}
+			saltSize := binary.LittleEndian.Uint16(sb[80:])
+			if !bytes.Equal(sb[88:88+int(saltSize)], test.salt) {
+				t.Errorf("unexpected superblock salt: %x", sb[88:88+int(saltSize)])
+			}
+			if !bytes.Equal(sb[88+int(saltSize):], make([]byte, BlockSize-88-int(saltSize))) {
+				t.Errorf("superblock is not padded with zeroes")
+			}
+		})
+	}
+}
+
+func TestAppendZeroes(t *testing.T) {
+	file, err := ioutil.TempFile("", "umoci-TestAppendZeroes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := file.Truncate(BlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a single data block, the root hash is the hash of the block.
+	tree, err := Append(file, nil)
+	if err != nil {
+		t.Fatalf("unexpected error appending hash tree: %+v", err)
+	}
+	if expected := "ad7facb2586fc6e966c004d7d1d16b024f5805ff7cb47c7a85dabd8b48892ca7"; tree.RootHashHex() != expected {
+		t.Errorf("unexpected root hash: got %s, expected %s", tree.RootHashHex(), expected)
+	}
+}
+
+func TestAppendInvalid(t *testing.T) {
+	file, err := ioutil.TempFile("", "umoci-TestAppendInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := Append(file, nil); err == nil {
+		t.Errorf("expected error appending hash tree to empty file")
+	}
+	if _, err := file.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Append(file, make([]byte, MaxSaltSize+1)); err == nil {
+		t.Errorf("expected error with oversized salt")
+	}
+}
@@ -23,7 +23,6 @@ import (
 
 	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/vbatts/go-mtree"
-	"golang.org/x/sys/unix"
 )
 
 // Ensure that mtree.FsEval is implemented by FsEval.
@@ -46,8 +45,8 @@ type FsEval interface {
 	// Lstat is equivalent to os.Lstat.
 	Lstat(path string) (os.FileInfo, error)
 
-	// Lstatx is equivalent to unix.Lstat.
-	Lstatx(path string) (unix.Stat_t, error)
+	// Lstatx is equivalent to system.Lstat.
+	Lstatx(path string) (system.Stat_t, error)
 
 	// Readlink is equivalent to os.Readlink.
 	Readlink(path string) (string, error)
@@ -23,7 +23,6 @@ import (
 
 	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/vbatts/go-mtree"
-	"golang.org/x/sys/unix"
 )
 
 // DefaultFsEval is the "identity" form of FsEval. In particular, it does not
@@ -60,10 +59,10 @@ func (fs osFsEval) Lstat(path string) (os.FileInfo, error) {
 	return os.Lstat(path)
 }
 
-// Lstatx is equivalent to unix.Lstat.
-func (fs osFsEval) Lstatx(path string) (unix.Stat_t, error) {
-	var s unix.Stat_t
-	err := unix.Lstat(path, &s)
+// Lstatx is equivalent to system.Lstat.
+func (fs osFsEval) Lstatx(path string) (system.Stat_t, error) {
+	var s system.Stat_t
+	err := system.Lstat(path, &s)
 	return s, err
 }
 
@@ -124,12 +123,12 @@ func (fs osFsEval) Llistxattr(path string) ([]string, error) {
 
 // Lremovexattr is equivalent to system.Lremovexattr
 func (fs osFsEval) Lremovexattr(path, name string) error {
-	return unix.Lremovexattr(path, name)
+	return system.Lremovexattr(path, name)
 }
 
 // Lsetxattr is equivalent to system.Lsetxattr
 func (fs osFsEval) Lsetxattr(path, name string, value []byte, flags int) error {
-	return unix.Lsetxattr(path, name, value, flags)
+	return system.Lsetxattr(path, name, value, flags)
 }
 
 // Lgetxattr is equivalent to system.Lgetxattr
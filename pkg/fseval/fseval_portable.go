@@ -0,0 +1,160 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fseval
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/vbatts/go-mtree"
+)
+
+// PortableFsEval is a VFS-style FsEval implementation that only uses
+// operations which are available on every host operating system. In
+// particular, it does not create device nodes (an empty placeholder file is
+// created instead), it does not support extended attributes (they are silently
+// dropped) and it does not modify the timestamps of symlinks. This is intended
+// to allow for the inspection of images on hosts which cannot represent the
+// full set of inode metadata found in Linux images.
+var PortableFsEval FsEval = portableFsEval(0)
+
+// Ensure that mtree.FsEval is implemented by PortableFsEval.
+var _ mtree.FsEval = PortableFsEval
+
+// portableFsEval is a hack to be able to make PortableFsEval a const.
+type portableFsEval int
+
+// Open is equivalent to os.Open.
+func (fs portableFsEval) Open(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+// Create is equivalent to os.Create.
+func (fs portableFsEval) Create(path string) (*os.File, error) {
+	return os.Create(path)
+}
+
+// Readdir is equivalent to os.Readdir.
+func (fs portableFsEval) Readdir(path string) ([]os.FileInfo, error) {
+	return DefaultFsEval.Readdir(path)
+}
+
+// Lstat is equivalent to os.Lstat.
+func (fs portableFsEval) Lstat(path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+// Lstatx is equivalent to system.Lstat.
+func (fs portableFsEval) Lstatx(path string) (system.Stat_t, error) {
+	return DefaultFsEval.Lstatx(path)
+}
+
+// Readlink is equivalent to os.Readlink.
+func (fs portableFsEval) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+// Symlink is equivalent to os.Symlink.
+func (fs portableFsEval) Symlink(linkname, path string) error {
+	return os.Symlink(linkname, path)
+}
+
+// Link is equivalent to os.Link.
+func (fs portableFsEval) Link(linkname, path string) error {
+	return os.Link(linkname, path)
+}
+
+// Chmod is equivalent to os.Chmod.
+func (fs portableFsEval) Chmod(path string, mode os.FileMode) error {
+	return os.Chmod(path, mode)
+}
+
+// Lutimes is equivalent to os.Chtimes, except that it is a no-op for symlinks
+// (not all operating systems support changing the timestamps of a symlink).
+func (fs portableFsEval) Lutimes(path string, atime, mtime time.Time) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		return nil
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+// Remove is equivalent to os.Remove.
+func (fs portableFsEval) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// RemoveAll is equivalent to os.RemoveAll.
+func (fs portableFsEval) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// Mkdir is equivalent to os.Mkdir.
+func (fs portableFsEval) Mkdir(path string, perm os.FileMode) error {
+	return os.Mkdir(path, perm)
+}
+
+// Mknod creates an empty regular file in place of the requested inode, because
+// device nodes and FIFOs cannot be created portably.
+func (fs portableFsEval) Mknod(path string, mode os.FileMode, dev system.Dev_t) error {
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// MkdirAll is equivalent to os.MkdirAll.
+func (fs portableFsEval) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Llistxattr always returns an empty set of xattrs.
+func (fs portableFsEval) Llistxattr(path string) ([]string, error) {
+	return nil, nil
+}
+
+// Lremovexattr is a no-op.
+func (fs portableFsEval) Lremovexattr(path, name string) error {
+	return nil
+}
+
+// Lsetxattr is a no-op, and the xattr is silently dropped.
+func (fs portableFsEval) Lsetxattr(path, name string, value []byte, flags int) error {
+	return nil
+}
+
+// Lgetxattr always returns ENODATA, as no xattrs are ever set.
+func (fs portableFsEval) Lgetxattr(path string, name string) ([]byte, error) {
+	return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: syscall.ENODATA}
+}
+
+// Lclearxattrs is a no-op.
+func (fs portableFsEval) Lclearxattrs(path string) error {
+	return nil
+}
+
+// KeywordFunc returns a wrapper around the given mtree.KeywordFunc.
+func (fs portableFsEval) KeywordFunc(fn mtree.KeywordFunc) mtree.KeywordFunc {
+	return fn
+}
@@ -25,7 +25,6 @@ import (
 	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/openSUSE/umoci/pkg/unpriv"
 	"github.com/vbatts/go-mtree"
-	"golang.org/x/sys/unix"
 )
 
 // RootlessFsEval is an FsEval implementation that uses "umoci/pkg/unpriv".*
@@ -58,7 +57,7 @@ func (fs unprivFsEval) Lstat(path string) (os.FileInfo, error) {
 	return unpriv.Lstat(path)
 }
 
-func (fs unprivFsEval) Lstatx(path string) (unix.Stat_t, error) {
+func (fs unprivFsEval) Lstatx(path string) (system.Stat_t, error) {
 	return unpriv.Lstatx(path)
 }
 
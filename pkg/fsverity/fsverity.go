@@ -0,0 +1,174 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fsverity computes the digests that Linux's fs-verity uses to
+// identify the contents of files (see
+// https://www.kernel.org/doc/html/latest/filesystems/fsverity.html). Only
+// SHA-256 with 4096-byte blocks and no salt (the defaults used by
+// fsverity(1) and composefs) is supported.
+package fsverity
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+)
+
+// BlockSize is the size of the data and Merkle tree blocks.
+const BlockSize = 4096
+
+// The values stored in the fs-verity descriptor (struct fsverity_descriptor
+// in <linux/fsverity.h>).
+const (
+	descriptorVersion   = 1
+	hashAlgorithmSHA256 = 1
+	logBlockSize        = 12
+	descriptorSize      = 256
+)
+
+// hashBlock returns the SHA-256 hash of the given block, which is padded with
+// zeroes to BlockSize.
+func hashBlock(block []byte) []byte {
+	h := sha256.New()
+	h.Write(block)
+	h.Write(make([]byte, BlockSize-len(block)))
+	return h.Sum(nil)
+}
+
+// level is a level of the Merkle tree being built.
+type level struct {
+	// buf contains the hashes which have not yet filled a block.
+	buf []byte
+
+	// count is the total number of hashes added to the level.
+	count int
+}
+
+// Digester computes the fs-verity digest of the data written to it. The zero
+// value is ready to use.
+type Digester struct {
+	buf    []byte
+	levels []*level
+	size   int64
+}
+
+// New returns a new Digester.
+func New() *Digester {
+	return &Digester{}
+}
+
+// push adds the hash of a block to the given level of the Merkle tree.
+func (d *Digester) push(idx int, hash []byte) {
+	if idx == len(d.levels) {
+		d.levels = append(d.levels, &level{})
+	}
+	l := d.levels[idx]
+	l.buf = append(l.buf, hash...)
+	l.count++
+	if len(l.buf) == BlockSize {
+		hash := hashBlock(l.buf)
+		l.buf = l.buf[:0]
+		d.push(idx+1, hash)
+	}
+}
+
+// Write adds data to the file being digested. It never returns an error.
+func (d *Digester) Write(p []byte) (int, error) {
+	n := len(p)
+	d.size += int64(n)
+	for len(p) > 0 {
+		chunk := BlockSize - len(d.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		d.buf = append(d.buf, p[:chunk]...)
+		p = p[chunk:]
+		if len(d.buf) == BlockSize {
+			d.push(0, hashBlock(d.buf))
+			d.buf = d.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Size returns the number of bytes written to the Digester.
+func (d *Digester) Size() int64 {
+	return d.size
+}
+
+// rootHash returns the root hash of the Merkle tree of the data written so
+// far, without modifying the Digester.
+func (d *Digester) rootHash() []byte {
+	// The root hash of an empty file is all zeroes.
+	if d.size == 0 {
+		return make([]byte, sha256.Size)
+	}
+
+	tree := &Digester{}
+	for _, l := range d.levels {
+		tree.levels = append(tree.levels, &level{
+			buf:   append([]byte(nil), l.buf...),
+			count: l.count,
+		})
+	}
+	if len(d.buf) > 0 {
+		tree.push(0, hashBlock(d.buf))
+	}
+	// Pad the partial blocks of each level until we reach a level with a
+	// single hash (the hash of the root block). A file with a single data
+	// block has no Merkle tree, and its root hash is the hash of that block.
+	for idx := 0; ; idx++ {
+		l := tree.levels[idx]
+		if l.count == 1 && idx == len(tree.levels)-1 {
+			return l.buf
+		}
+		if len(l.buf) > 0 {
+			tree.push(idx+1, hashBlock(l.buf))
+			l.buf = nil
+		}
+	}
+}
+
+// Sum returns the fs-verity digest of the data written so far (the SHA-256
+// hash of the fs-verity descriptor of the file), without modifying the
+// Digester.
+func (d *Digester) Sum() []byte {
+	desc := make([]byte, descriptorSize)
+	desc[0] = descriptorVersion
+	desc[1] = hashAlgorithmSHA256
+	desc[2] = logBlockSize
+	binary.LittleEndian.PutUint64(desc[8:], uint64(d.size))
+	copy(desc[16:], d.rootHash())
+
+	sum := sha256.Sum256(desc)
+	return sum[:]
+}
+
+// Hex returns Sum as a hex string (as printed by "fsverity digest").
+func (d *Digester) Hex() string {
+	return hex.EncodeToString(d.Sum())
+}
+
+// Compute returns the fs-verity digest of the contents of r, as a hex string.
+func Compute(r io.Reader) (string, error) {
+	d := New()
+	if _, err := io.Copy(d, r); err != nil {
+		return "", err
+	}
+	return d.Hex(), nil
+}
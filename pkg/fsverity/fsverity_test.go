@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fsverity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+// simpleDigest computes the fs-verity digest of data by building the whole
+// Merkle tree in memory, one level at a time.
+func simpleDigest(data []byte) string {
+	root := make([]byte, sha256.Size)
+	if len(data) > 0 {
+		level := data
+		for {
+			var hashes []byte
+			for off := 0; off < len(level); off += BlockSize {
+				end := off + BlockSize
+				if end > len(level) {
+					end = len(level)
+				}
+				block := make([]byte, BlockSize)
+				copy(block, level[off:end])
+				sum := sha256.Sum256(block)
+				hashes = append(hashes, sum[:]...)
+			}
+			if len(hashes) == sha256.Size {
+				root = hashes
+				break
+			}
+			level = hashes
+		}
+	}
+
+	desc := make([]byte, 256)
+	desc[0], desc[1], desc[2] = 1, 1, 12
+	binary.LittleEndian.PutUint64(desc[8:], uint64(len(data)))
+	copy(desc[16:], root)
+	sum := sha256.Sum256(desc)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDigester(t *testing.T) {
+	hashesPerBlock := BlockSize / sha256.Size
+	for _, size := range []int{
+		0,
+		1,
+		BlockSize - 1,
+		BlockSize,
+		BlockSize + 1,
+		hashesPerBlock * BlockSize,
+		hashesPerBlock*BlockSize + 1,
+		hashesPerBlock*hashesPerBlock*BlockSize + 3*BlockSize + 17,
+	} {
+		data := make([]byte, size)
+		rand.Read(data)
+		expected := simpleDigest(data)
+
+		// Write the data in uneven chunks.
+		d := New()
+		for off := 0; off < len(data); {
+			end := off + 1 + rand.Intn(3*BlockSize)
+			if end > len(data) {
+				end = len(data)
+			}
+			d.Write(data[off:end])
+			off = end
+		}
+		if d.Size() != int64(size) {
+			t.Errorf("size %d: unexpected Size %d", size, d.Size())
+		}
+		if got := d.Hex(); got != expected {
+			t.Errorf("size %d: got digest %s, expected %s", size, got, expected)
+		}
+		// Sum must not modify the Digester.
+		if got := d.Hex(); got != expected {
+			t.Errorf("size %d: second digest %s differs from %s", size, got, expected)
+		}
+
+		got, err := Compute(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expected {
+			t.Errorf("size %d: Compute returned %s, expected %s", size, got, expected)
+		}
+	}
+}
+
+func TestDigesterContinue(t *testing.T) {
+	data := make([]byte, 3*BlockSize+5)
+	rand.Read(data)
+
+	// Taking the digest part-way through must not affect the final digest.
+	d := New()
+	d.Write(data[:BlockSize+3])
+	if got, expected := d.Hex(), simpleDigest(data[:BlockSize+3]); got != expected {
+		t.Errorf("partial digest %s, expected %s", got, expected)
+	}
+	d.Write(data[BlockSize+3:])
+	if got, expected := d.Hex(), simpleDigest(data); got != expected {
+		t.Errorf("digest %s, expected %s", got, expected)
+	}
+}
@@ -0,0 +1,507 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package memfs provides an in-memory filesystem that implements the
+// operations required by "oci/layer".Filesystem. It allows for layers to be
+// applied without root privileges (or without touching the host filesystem at
+// all), which is useful for testing as well as for inspecting the contents of
+// an image.
+//
+// The filesystem is intentionally simple. Paths are never resolved through
+// symlinks (the layer extraction code does its own scoped resolution using
+// Lstat and Readlink), and there is no notion of permission checking.
+package memfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/system"
+)
+
+// inode contains all of the metadata and contents of a single file. Hardlinks
+// are represented by multiple paths referencing the same inode.
+type inode struct {
+	ino      uint64
+	mode     os.FileMode
+	uid, gid int
+	rdev     system.Dev_t
+	atime    time.Time
+	mtime    time.Time
+	data     []byte
+	linkname string
+	xattrs   map[string][]byte
+	nlink    int
+}
+
+// Stat is the value returned by os.FileInfo.Sys() for files in a Filesystem.
+type Stat struct {
+	// Ino is the inode number of the file, which is unique within a
+	// Filesystem (paths which are hardlinks of each other have the same Ino).
+	Ino uint64
+
+	// Uid is the owner of the file.
+	Uid int
+
+	// Gid is the group owner of the file.
+	Gid int
+
+	// Rdev is the device number of the file (for device nodes).
+	Rdev system.Dev_t
+
+	// Nlink is the number of paths that reference the file.
+	Nlink int
+
+	// Atime is the access time of the file.
+	Atime time.Time
+
+	// Xattrs is the set of extended attributes of the file.
+	Xattrs map[string][]byte
+}
+
+// fileInfo is an os.FileInfo for an inode.
+type fileInfo struct {
+	name  string
+	inode inode
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return int64(len(fi.inode.data)) }
+func (fi fileInfo) Mode() os.FileMode  { return fi.inode.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.inode.mtime }
+func (fi fileInfo) IsDir() bool        { return fi.inode.mode.IsDir() }
+
+func (fi fileInfo) Sys() interface{} {
+	xattrs := map[string][]byte{}
+	for name, value := range fi.inode.xattrs {
+		xattrs[name] = append([]byte(nil), value...)
+	}
+	return &Stat{
+		Ino:    fi.inode.ino,
+		Uid:    fi.inode.uid,
+		Gid:    fi.inode.gid,
+		Rdev:   fi.inode.rdev,
+		Nlink:  fi.inode.nlink,
+		Atime:  fi.inode.atime,
+		Xattrs: xattrs,
+	}
+}
+
+// Filesystem is an in-memory filesystem. It is safe for concurrent use. The
+// zero value is not usable, use New to create a Filesystem.
+type Filesystem struct {
+	lock    sync.Mutex
+	inodes  map[string]*inode
+	lastIno uint64
+}
+
+// New creates a new Filesystem containing only an empty root directory.
+func New() *Filesystem {
+	now := time.Now()
+	return &Filesystem{
+		inodes: map[string]*inode{
+			"/": {
+				ino:   1,
+				mode:  os.ModeDir | 0755,
+				atime: now,
+				mtime: now,
+				nlink: 1,
+			},
+		},
+		lastIno: 1,
+	}
+}
+
+// clean returns the canonical form of the given path.
+func clean(path string) string {
+	return filepath.Clean("/" + path)
+}
+
+func pathError(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// lookup returns the inode at the given path. fs.lock must be held.
+func (fs *Filesystem) lookup(op, path string) (*inode, error) {
+	ino, ok := fs.inodes[clean(path)]
+	if !ok {
+		return nil, pathError(op, path, syscall.ENOENT)
+	}
+	return ino, nil
+}
+
+// insert adds the inode at the given path, ensuring that the parent exists
+// and that the path does not already exist. New inodes are given an inode
+// number. fs.lock must be held.
+func (fs *Filesystem) insert(op, path string, ino *inode) error {
+	path = clean(path)
+	if _, ok := fs.inodes[path]; ok {
+		return pathError(op, path, syscall.EEXIST)
+	}
+	parent, ok := fs.inodes[filepath.Dir(path)]
+	if !ok {
+		return pathError(op, path, syscall.ENOENT)
+	}
+	if !parent.mode.IsDir() {
+		return pathError(op, path, syscall.ENOTDIR)
+	}
+	if ino.ino == 0 {
+		fs.lastIno++
+		ino.ino = fs.lastIno
+	}
+	ino.nlink++
+	fs.inodes[path] = ino
+	return nil
+}
+
+// newInode returns a new inode with the given mode and the current time.
+func newInode(mode os.FileMode) *inode {
+	now := time.Now()
+	return &inode{
+		mode:  mode,
+		atime: now,
+		mtime: now,
+	}
+}
+
+// fileWriter appends all writes to the contents of an inode.
+type fileWriter struct {
+	fs    *Filesystem
+	inode *inode
+}
+
+func (w fileWriter) Write(p []byte) (int, error) {
+	w.fs.lock.Lock()
+	defer w.fs.lock.Unlock()
+
+	w.inode.data = append(w.inode.data, p...)
+	w.inode.mtime = time.Now()
+	return len(p), nil
+}
+
+func (w fileWriter) Close() error {
+	return nil
+}
+
+// Create is equivalent to os.Create. If the path already exists it must be a
+// regular file, which is truncated.
+func (fs *Filesystem) Create(path string) (io.WriteCloser, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("create", path)
+	if err != nil {
+		ino = newInode(0666)
+		if err := fs.insert("create", path, ino); err != nil {
+			return nil, err
+		}
+	}
+	if !ino.mode.IsRegular() {
+		return nil, pathError("create", path, syscall.EISDIR)
+	}
+	ino.data = nil
+	return fileWriter{fs: fs, inode: ino}, nil
+}
+
+// Open returns a reader for the contents of the regular file at the given
+// path. The contents are copied, so later writes to the file are not visible
+// through the reader.
+func (fs *Filesystem) Open(path string) (io.ReadCloser, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if !ino.mode.IsRegular() {
+		return nil, pathError("open", path, syscall.EINVAL)
+	}
+	return ioutil.NopCloser(bytes.NewReader(append([]byte(nil), ino.data...))), nil
+}
+
+// Lstat is equivalent to os.Lstat.
+func (fs *Filesystem) Lstat(path string) (os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("lstat", path)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{name: filepath.Base(clean(path)), inode: *ino}, nil
+}
+
+// Readdir returns the os.FileInfo for every entry in the given directory,
+// sorted by name.
+func (fs *Filesystem) Readdir(path string) ([]os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	if !ino.mode.IsDir() {
+		return nil, pathError("readdir", path, syscall.ENOTDIR)
+	}
+
+	dir := clean(path)
+	var infos []os.FileInfo
+	for name, child := range fs.inodes {
+		if name != "/" && filepath.Dir(name) == dir {
+			infos = append(infos, fileInfo{name: filepath.Base(name), inode: *child})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Walk calls fn for every path in the Filesystem (including the root
+// directory) in lexical order, so that directories are visited before their
+// contents. Unlike calling Readdir for every directory, this only requires a
+// single pass over the Filesystem. fn must not modify the Filesystem, and if
+// it returns an error the walk is stopped and the error is returned.
+func (fs *Filesystem) Walk(fn func(path string, fi os.FileInfo) error) error {
+	fs.lock.Lock()
+	paths := make([]string, 0, len(fs.inodes))
+	infos := map[string]os.FileInfo{}
+	for path, ino := range fs.inodes {
+		paths = append(paths, path)
+		infos[path] = fileInfo{name: filepath.Base(path), inode: *ino}
+	}
+	fs.lock.Unlock()
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := fn(path, infos[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Readlink is equivalent to os.Readlink.
+func (fs *Filesystem) Readlink(path string) (string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("readlink", path)
+	if err != nil {
+		return "", err
+	}
+	if ino.mode&os.ModeSymlink != os.ModeSymlink {
+		return "", pathError("readlink", path, syscall.EINVAL)
+	}
+	return ino.linkname, nil
+}
+
+// Symlink is equivalent to os.Symlink.
+func (fs *Filesystem) Symlink(linkname, path string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino := newInode(os.ModeSymlink | 0777)
+	ino.linkname = linkname
+	return fs.insert("symlink", path, ino)
+}
+
+// Link is equivalent to os.Link.
+func (fs *Filesystem) Link(linkname, path string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("link", linkname)
+	if err != nil {
+		return err
+	}
+	if ino.mode.IsDir() {
+		return pathError("link", linkname, syscall.EPERM)
+	}
+	return fs.insert("link", path, ino)
+}
+
+// Chmod is equivalent to os.Chmod, except that it does not follow symlinks.
+func (fs *Filesystem) Chmod(path string, mode os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("chmod", path)
+	if err != nil {
+		return err
+	}
+	permMask := os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	ino.mode = (ino.mode &^ permMask) | (mode & permMask)
+	return nil
+}
+
+// Lchown is equivalent to os.Lchown.
+func (fs *Filesystem) Lchown(path string, uid, gid int) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("lchown", path)
+	if err != nil {
+		return err
+	}
+	if uid >= 0 {
+		ino.uid = uid
+	}
+	if gid >= 0 {
+		ino.gid = gid
+	}
+	return nil
+}
+
+// Lutimes is equivalent to system.Lutimes.
+func (fs *Filesystem) Lutimes(path string, atime, mtime time.Time) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("lutimes", path)
+	if err != nil {
+		return err
+	}
+	ino.atime = atime
+	ino.mtime = mtime
+	return nil
+}
+
+// RemoveAll is equivalent to os.RemoveAll. The root directory itself is never
+// removed.
+func (fs *Filesystem) RemoveAll(path string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	path = clean(path)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for name, ino := range fs.inodes {
+		if name == "/" {
+			continue
+		}
+		if name == path || strings.HasPrefix(name, prefix) {
+			ino.nlink--
+			delete(fs.inodes, name)
+		}
+	}
+	return nil
+}
+
+// MkdirAll is equivalent to os.MkdirAll, except that it does not follow
+// symlinks in any of the path components.
+func (fs *Filesystem) MkdirAll(path string, perm os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	path = clean(path)
+	current := "/"
+	for _, part := range strings.Split(path, "/") {
+		if part == "" {
+			continue
+		}
+		current = filepath.Join(current, part)
+		if ino, ok := fs.inodes[current]; ok {
+			if !ino.mode.IsDir() {
+				return pathError("mkdir", current, syscall.ENOTDIR)
+			}
+			continue
+		}
+		if err := fs.insert("mkdir", current, newInode(os.ModeDir|(perm&os.ModePerm))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mknod is equivalent to system.Mknod. The mode is expected to contain the
+// syscall.S_IF* type of the inode being created.
+func (fs *Filesystem) Mknod(path string, mode os.FileMode, dev system.Dev_t) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	var typ os.FileMode
+	switch uint32(mode) & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		typ = os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		typ = os.ModeDevice
+	case syscall.S_IFIFO:
+		typ = os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		typ = os.ModeSocket
+	case syscall.S_IFREG, 0:
+		typ = 0
+	default:
+		return pathError("mknod", path, syscall.EINVAL)
+	}
+	ino := newInode(typ | (mode & os.ModePerm))
+	ino.rdev = dev
+	return fs.insert("mknod", path, ino)
+}
+
+// Lsetxattr is equivalent to system.Lsetxattr.
+func (fs *Filesystem) Lsetxattr(path, name string, value []byte, flags int) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("lsetxattr", path)
+	if err != nil {
+		return err
+	}
+	if ino.xattrs == nil {
+		ino.xattrs = map[string][]byte{}
+	}
+	ino.xattrs[name] = append([]byte(nil), value...)
+	return nil
+}
+
+// Lgetxattr is equivalent to system.Lgetxattr.
+func (fs *Filesystem) Lgetxattr(path, name string) ([]byte, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("lgetxattr", path)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := ino.xattrs[name]
+	if !ok {
+		return nil, pathError("lgetxattr", path, syscall.ENODATA)
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// Lclearxattrs is equivalent to system.Lclearxattrs.
+func (fs *Filesystem) Lclearxattrs(path string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	ino, err := fs.lookup("lclearxattrs", path)
+	if err != nil {
+		return err
+	}
+	ino.xattrs = nil
+	return nil
+}
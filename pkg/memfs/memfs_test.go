@@ -0,0 +1,130 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package memfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCreateRequiresParent(t *testing.T) {
+	fs := New()
+	if _, err := fs.Create("/a/b"); !os.IsNotExist(err) {
+		t.Errorf("expected ENOENT creating file without parent, got: %v", err)
+	}
+	if err := fs.MkdirAll("/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := fs.Create("/a/b")
+	if err != nil {
+		t.Fatalf("unexpected error creating file: %s", err)
+	}
+	fh.Close()
+	if err := fs.MkdirAll("/a/b/c", 0755); err == nil {
+		t.Errorf("expected error creating directory under regular file")
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	fs := New()
+	for _, dir := range []string{"/a/b/c", "/ab"} {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fh, err := fs.Create("/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	if err := fs.Link("/a/b/file", "/ab/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Fatalf("unexpected error in RemoveAll: %s", err)
+	}
+	for _, path := range []string{"/a", "/a/b", "/a/b/c", "/a/b/file"} {
+		if _, err := fs.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got: %v", path, err)
+		}
+	}
+
+	// Paths sharing a string prefix (but not a path prefix) must be kept, and
+	// the link count of the remaining hardlink must be updated.
+	fi, err := fs.Lstat("/ab/link")
+	if err != nil {
+		t.Fatalf("expected /ab/link to still exist: %s", err)
+	}
+	if nlink := fi.Sys().(*Stat).Nlink; nlink != 1 {
+		t.Errorf("expected nlink of 1 after removing hardlink, got %d", nlink)
+	}
+
+	if err := fs.RemoveAll("/"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := fs.Lstat("/"); err != nil || !fi.IsDir() {
+		t.Errorf("root directory must not be removed: %v", err)
+	}
+	if infos, err := fs.Readdir("/"); err != nil || len(infos) != 0 {
+		t.Errorf("expected root directory to be empty: %v (err=%v)", infos, err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	fs := New()
+	if err := fs.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a-file", "/a/b/file"} {
+		fh, err := fs.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fh.Close()
+	}
+	if err := fs.Link("/a/b/file", "/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	inos := map[string]uint64{}
+	if err := fs.Walk(func(path string, fi os.FileInfo) error {
+		paths = append(paths, path)
+		inos[path] = fi.Sys().(*Stat).Ino
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error in Walk: %s", err)
+	}
+
+	expected := []string{"/", "/a", "/a-file", "/a/b", "/a/b/file", "/link"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected walk order: got %v, expected %v", paths, expected)
+	}
+	if inos["/link"] != inos["/a/b/file"] {
+		t.Errorf("hardlinks have different inode numbers: %v", inos)
+	}
+	seen := map[uint64]string{}
+	for _, path := range []string{"/", "/a", "/a-file", "/a/b", "/a/b/file"} {
+		if other, ok := seen[inos[path]]; ok {
+			t.Errorf("%s and %s have the same inode number %d", path, other, inos[path])
+		}
+		seen[inos[path]] = path
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// Glob is a parsed glob pattern, using the pattern syntax described in
+// GlobFilter.
+type Glob struct {
+	raw        string
+	pattern    string
+	anchored   bool
+	components int
+}
+
+// ParseGlob parses and validates the given glob pattern.
+func ParseGlob(pattern string) (Glob, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return Glob{}, errors.Wrapf(err, "invalid glob pattern %q", pattern)
+	}
+
+	cleaned := strings.Trim(filepath.Clean(pattern), "/")
+	if cleaned == "" || cleaned == "." {
+		return Glob{}, errors.Errorf("invalid glob pattern %q: matches everything", pattern)
+	}
+	return Glob{
+		raw:        pattern,
+		pattern:    cleaned,
+		anchored:   strings.HasPrefix(pattern, "/"),
+		components: len(strings.Split(cleaned, "/")),
+	}, nil
+}
+
+// String returns the pattern as it was passed to ParseGlob.
+func (g Glob) String() string {
+	return g.raw
+}
+
+// Match returns whether the pattern matches the given path (relative to '/'),
+// or any of its parent directories.
+func (g Glob) Match(path string) bool {
+	path = filepath.Join("/", path)
+	if path == "/" {
+		return false
+	}
+	return g.match(strings.Split(strings.TrimPrefix(path, "/"), "/"))
+}
+
+// match is the same as Match, except it operates on a path which has already
+// been split into its components.
+func (g Glob) match(components []string) bool {
+	for end := 1; end <= len(components); end++ {
+		start := end - g.components
+		if start < 0 || (g.anchored && start != 0) {
+			continue
+		}
+		if ok, _ := filepath.Match(g.pattern, strings.Join(components[start:end], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobFilter is a factory for FilterFuncs that will only include InodeDelta
+// paths which match at least one of the include patterns (or all paths, if
+// there are no include patterns) and none of the exclude patterns. Patterns
+// use the syntax of filepath.Match. Patterns starting with '/' are matched
+// against the full path (relative to '/'), while other patterns are matched
+// against any trailing set of path components -- so "*.pyc" matches every
+// file with a .pyc extension and "node_modules/.cache" matches every
+// node_modules/.cache directory. A pattern which matches a directory also
+// matches everything inside it.
+func GlobFilter(include, exclude []string) (FilterFunc, error) {
+	var includes, excludes []Glob
+	for _, pattern := range include {
+		glob, err := ParseGlob(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse include pattern")
+		}
+		includes = append(includes, glob)
+	}
+	for _, pattern := range exclude {
+		glob, err := ParseGlob(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse exclude pattern")
+		}
+		excludes = append(excludes, glob)
+	}
+
+	return func(path string) bool {
+		path = filepath.Join("/", path)
+		if path == "/" {
+			return len(includes) == 0
+		}
+		components := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+		if len(includes) > 0 {
+			included := false
+			for _, glob := range includes {
+				if glob.match(components) {
+					included = true
+					break
+				}
+			}
+			if !included {
+				log.Debugf("globfilter: ignoring path %q not matched by any include pattern", path)
+				return false
+			}
+		}
+
+		for _, glob := range excludes {
+			if glob.match(components) {
+				log.Debugf("globfilter: ignoring path %q matched by exclude pattern %q", path, glob)
+				return false
+			}
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"testing"
+)
+
+func TestGlobFilter(t *testing.T) {
+	for _, test := range []struct {
+		include, exclude []string
+		path             string
+		expected         bool
+	}{
+		// No patterns include everything.
+		{nil, nil, "/", true},
+		{nil, nil, "/a/b/c", true},
+		// Unanchored patterns match the basename anywhere.
+		{nil, []string{"*.pyc"}, "/app/module.pyc", false},
+		{nil, []string{"*.pyc"}, "module.pyc", false},
+		{nil, []string{"*.pyc"}, "/app/module.py", true},
+		{nil, []string{"core.[0-9]*"}, "/var/core.1234", false},
+		// Unanchored patterns with several components match any trailing
+		// set of components, including parent directories.
+		{nil, []string{"node_modules/.cache"}, "/app/node_modules/.cache", false},
+		{nil, []string{"node_modules/.cache"}, "/app/node_modules/.cache/x/y", false},
+		{nil, []string{"node_modules/.cache"}, "/app/node_modules/.cachex", true},
+		{nil, []string{"node_modules/.cache"}, "/app/node_modules", true},
+		// Anchored patterns only match from the root.
+		{nil, []string{"/tmp"}, "/tmp/file", false},
+		{nil, []string{"/tmp"}, "/var/tmp/file", true},
+		{nil, []string{"/var/*/file"}, "/var/tmp/file", false},
+		{nil, []string{"/var/*"}, "/var/tmp/file", false},
+		// '*' doesn't match across directories.
+		{nil, []string{"/a*c"}, "/ab/c", true},
+		// Include patterns restrict the set of paths.
+		{[]string{"/app"}, nil, "/app/bin", true},
+		{[]string{"/app"}, nil, "/etc/passwd", false},
+		{[]string{"/app"}, nil, "/", false},
+		{[]string{"/app", "*.conf"}, nil, "/etc/app.conf", true},
+		// Exclude patterns take priority over include patterns.
+		{[]string{"/app"}, []string{"*.pyc"}, "/app/module.pyc", false},
+		{[]string{"/app"}, []string{"*.pyc"}, "/app/module.py", true},
+	} {
+		filter, err := GlobFilter(test.include, test.exclude)
+		if err != nil {
+			t.Errorf("unexpected error creating filter include=%v exclude=%v: %s", test.include, test.exclude, err)
+			continue
+		}
+		if got := filter(test.path); got != test.expected {
+			t.Errorf("GlobFilter(%v, %v)(%q) got %v expected %v", test.include, test.exclude, test.path, got, test.expected)
+		}
+	}
+}
+
+func TestGlobFilterInvalid(t *testing.T) {
+	for _, pattern := range []string{"[", "/", "", "."} {
+		if _, err := GlobFilter(nil, []string{pattern}); err == nil {
+			t.Errorf("expected error with exclude pattern %q", pattern)
+		}
+		if _, err := GlobFilter([]string{pattern}, nil); err == nil {
+			t.Errorf("expected error with include pattern %q", pattern)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"/usr/local/bin/*", "/usr/local/bin/tool", true},
+		{"/usr/local/bin/*", "usr/local/bin/tool", true},
+		{"/usr/local/bin/*", "/usr/local/bin", false},
+		{"/usr/local/bin/*", "/usr/local/bin/dir/tool", true},
+		{"/app", "/app/", true},
+		{"/app", "/", false},
+		{"/app", "/application", false},
+		{"bin", "/usr/local/bin", true},
+	} {
+		glob, err := ParseGlob(test.pattern)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", test.pattern, err)
+			continue
+		}
+		if glob.String() != test.pattern {
+			t.Errorf("glob.String() got %q expected %q", glob.String(), test.pattern)
+		}
+		if got := glob.Match(test.path); got != test.expected {
+			t.Errorf("ParseGlob(%q).Match(%q) got %v expected %v", test.pattern, test.path, got, test.expected)
+		}
+	}
+}
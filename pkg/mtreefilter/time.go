@@ -0,0 +1,166 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// timeKeywords are the keywords which describe the modification time of an
+// inode. "time" has nanosecond resolution, while "tar_time" only has the
+// one-second resolution of (non-PAX) tar archives.
+var timeKeywords = []mtree.Keyword{"time", "tar_time"}
+
+// Check is equivalent to mtree.Check, except that if keywords contains
+// "tar_time" the modification times of inodes are compared with one-second
+// resolution regardless of how they were recorded in the specification. This
+// means that specifications with nanosecond times ("time"), specifications
+// generated from filesystems ("tar_time", which truncates to the second) and
+// specifications generated from tar streams (where the times were rounded to
+// the nearest second when the layer was generated) can all be checked
+// against a filesystem without reporting every inode as modified.
+func Check(root string, dh *mtree.DirectoryHierarchy, keywords []mtree.Keyword, fs mtree.FsEval) ([]mtree.InodeDelta, error) {
+	if !mtree.InKeywordSlice("tar_time", keywords) {
+		return mtree.Check(root, dh, keywords, fs)
+	}
+
+	// Walk the filesystem with nanosecond times, so that we know how the
+	// times would have been rounded when generating a layer.
+	var walkKeywords []mtree.Keyword
+	for _, keyword := range keywords {
+		if keyword != "tar_time" {
+			walkKeywords = append(walkKeywords, keyword)
+		}
+	}
+	walkKeywords = append(walkKeywords, "time")
+	compareKeywords := append(walkKeywords, "tar_time")
+
+	newDh, err := mtree.Walk(root, nil, walkKeywords, fs)
+	if err != nil {
+		return nil, err
+	}
+	deltas, err := mtree.Compare(dh, newDh, compareKeywords)
+	if err != nil {
+		return nil, err
+	}
+	return filterTimeDeltas(deltas)
+}
+
+// filterTimeDeltas removes the mtree.Modified deltas where only the
+// modification time differs, and the old and new times are equal with
+// one-second resolution (see timeEqual).
+func filterTimeDeltas(deltas []mtree.InodeDelta) ([]mtree.InodeDelta, error) {
+	var filtered []mtree.InodeDelta
+	for _, delta := range deltas {
+		onlyTime := delta.Type() == mtree.Modified
+		for _, keyDelta := range delta.Diff() {
+			if !mtree.InKeywordSlice(keyDelta.Name(), timeKeywords) {
+				onlyTime = false
+				break
+			}
+		}
+		if onlyTime {
+			equal, err := timeEqual(inodeTime(delta.Old()), inodeTime(delta.New()))
+			if err != nil {
+				return nil, errors.Wrapf(err, "compare times: %s", delta.Path())
+			}
+			if equal {
+				log.Debugf("mtreefilter: ignoring sub-second time change: %s", delta.Path())
+				continue
+			}
+		}
+		filtered = append(filtered, delta)
+	}
+	return filtered, nil
+}
+
+// inodeTime returns the value of the time keyword of the entry (preferring
+// the "time" keyword), or "" if the entry has no time.
+func inodeTime(entry *mtree.Entry) string {
+	if entry == nil {
+		return ""
+	}
+	keys := entry.AllKeys()
+	for _, keyword := range timeKeywords {
+		if kv := mtree.HasKeyword(keys, keyword); kv != "" {
+			return kv.Value()
+		}
+	}
+	return ""
+}
+
+// parseTime parses the value of a time keyword ("<sec>.<nsec>") without
+// losing precision.
+func parseTime(value string) (sec, nsec int64, err error) {
+	parts := strings.SplitN(value, ".", 2)
+	sec, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parse time %q", value)
+	}
+	if len(parts) == 2 {
+		frac := parts[1]
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		frac += strings.Repeat("0", 9-len(frac))
+		nsec, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "parse time %q", value)
+		}
+	}
+	return sec, nsec, nil
+}
+
+// timeEqual returns whether the two time values are equal with one-second
+// resolution. Two times are equal if they are in the same second (which is
+// how "tar_time" truncates times), or if one of them is a whole second which
+// the other time rounds to (which is how umoci rounds times when generating
+// layers).
+func timeEqual(a, b string) (bool, error) {
+	if a == "" || b == "" {
+		return a == b, nil
+	}
+	aSec, aNsec, err := parseTime(a)
+	if err != nil {
+		return false, err
+	}
+	bSec, bNsec, err := parseTime(b)
+	if err != nil {
+		return false, err
+	}
+	round := func(sec, nsec int64) int64 {
+		if nsec >= 500000000 {
+			sec++
+		}
+		return sec
+	}
+	switch {
+	case aSec == bSec:
+		return true, nil
+	case aNsec == 0:
+		return aSec == round(bSec, bNsec), nil
+	case bNsec == 0:
+		return bSec == round(aSec, aNsec), nil
+	}
+	return false, nil
+}
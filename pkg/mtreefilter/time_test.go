@@ -0,0 +1,144 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestTimeEqual(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{"100.000000000", "100.000000000", true},
+		{"100.000000000", "100.999999999", true},
+		{"100.300000000", "100.700000000", true},
+		// Rounded to the nearest second when generating a layer.
+		{"101.000000000", "100.500000000", true},
+		{"100.500000000", "101.000000000", true},
+		{"101.000000000", "100.499999999", false},
+		{"100.000000000", "101.000000000", false},
+		{"100.700000000", "101.200000000", false},
+		// Large times must not lose precision.
+		{"1700000000.000000000", "1700000000.999999999", true},
+		{"1700000001.000000000", "1700000000.499999999", false},
+		{"100", "100.5", true},
+		{"", "", true},
+		{"", "100.000000000", false},
+	} {
+		got, err := timeEqual(test.a, test.b)
+		if err != nil {
+			t.Errorf("timeEqual(%q, %q): unexpected error: %+v", test.a, test.b, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("timeEqual(%q, %q): got %v expected %v", test.a, test.b, got, test.expected)
+		}
+	}
+
+	if _, err := timeEqual("abc", "100.000000000"); err == nil {
+		t.Errorf("timeEqual: expected an error with an invalid time")
+	}
+}
+
+func TestCheckTarTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCheckTarTime-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keywords := []mtree.Keyword{"size", "type", "mode", "tar_time", "sha256digest"}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Writing the file modifies the directory, so its time is reset as well.
+	chtimes := func(sec, nsec int64) {
+		mtime := time.Unix(sec, nsec)
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The specification has the whole-second time of a layer entry.
+	chtimes(1700000001, 0)
+	spec, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		sec, nsec int64
+		modified  bool
+	}{
+		{1700000001, 0, false},
+		{1700000001, 999999999, false},
+		// A time which was rounded up when generating the layer.
+		{1700000000, 500000000, false},
+		{1700000000, 499999999, true},
+		{1700000002, 0, true},
+	} {
+		chtimes(test.sec, test.nsec)
+		diffs, err := Check(dir, spec, keywords, nil)
+		if err != nil {
+			t.Fatalf("unexpected error checking spec: %+v", err)
+		}
+		if got := len(diffs) > 0; got != test.modified {
+			t.Errorf("Check with mtime %d.%09d: got modified=%v expected %v (%v)", test.sec, test.nsec, got, test.modified, diffs)
+		}
+	}
+
+	// Changes to other keywords are still detected.
+	if err := ioutil.WriteFile(file, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chtimes(1700000001, 0)
+	diffs, err := Check(dir, spec, keywords, nil)
+	if err != nil {
+		t.Fatalf("unexpected error checking spec: %+v", err)
+	}
+	if len(diffs) != 1 || diffs[0].Type() != mtree.Modified {
+		t.Errorf("expected file to be modified: %v", diffs)
+	}
+
+	// Specifications with nanosecond times are compared with one-second
+	// resolution.
+	spec, err = mtree.Walk(dir, nil, []mtree.Keyword{"size", "type", "mode", "time", "sha256digest"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chtimes(1700000001, 700000000)
+	diffs, err = Check(dir, spec, keywords, nil)
+	if err != nil {
+		t.Fatalf("unexpected error checking spec: %+v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("unexpected diffs with nanosecond spec: %v", diffs)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// compressor is a layer.Compressor which uses a compressor plugin.
+type compressor struct {
+	plugin Plugin
+}
+
+// Name returns the name of the plugin.
+func (c *compressor) Name() string {
+	return c.plugin.Name
+}
+
+// Compress starts "<plugin> compress", which writes the compressed data to w.
+func (c *compressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	var stderr bytes.Buffer
+	args := []string{"compress"}
+	cmd := exec.Command(c.plugin.Path, args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "compress")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "run plugin %s", c.plugin)
+	}
+	return &commandWriter{
+		WriteCloser: stdin,
+		wait: func() error {
+			return wrapExitError(c.plugin, args, &stderr, cmd.Wait())
+		},
+	}, nil
+}
+
+// Decompress starts "<plugin> decompress", which reads the compressed data
+// from r.
+func (c *compressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	var stderr bytes.Buffer
+	args := []string{"decompress"}
+	cmd := exec.Command(c.plugin.Path, args...)
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "run plugin %s", c.plugin)
+	}
+	return &commandReader{
+		Reader: stdout,
+		wait: func() error {
+			return wrapExitError(c.plugin, args, &stderr, cmd.Wait())
+		},
+		kill: func() {
+			cmd.Process.Kill()
+		},
+	}, nil
+}
+
+// commandWriter is an io.WriteCloser for the stdin of a running command.
+// Closing it waits for the command to exit, and returns its error. It is safe
+// to call Close more than once.
+type commandWriter struct {
+	io.WriteCloser
+	wait func() error
+	once sync.Once
+	err  error
+}
+
+// Close closes the stdin of the command and waits for it to exit.
+func (w *commandWriter) Close() error {
+	w.once.Do(func() {
+		w.WriteCloser.Close()
+		w.err = w.wait()
+	})
+	return w.err
+}
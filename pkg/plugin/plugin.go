@@ -0,0 +1,254 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package plugin implements umoci's plugins, which allow third parties to add
+// transports and layer compression algorithms to umoci without modifying it.
+// Plugins are executables in a plugin directory, and are run once for each
+// operation (with the operation and its arguments given as arguments).
+//
+// A transport plugin is named "umoci-transport-<scheme>", and is used to open
+// images with URIs of the form "<scheme>://..." (see cas.Open). It is run as
+// "umoci-transport-<scheme> <operation> <uri> [<args>...]", with the
+// following operations:
+//
+//	create                 create a new (empty) image
+//	open                   check that the image exists
+//	get-blob <digest>      write the blob to stdout
+//	put-blob <digest>      store the blob read from stdin
+//	delete-blob <digest>   remove the blob
+//	list-blobs             write the digests of all blobs to stdout, one per line
+//	get-index              write the index (as JSON) to stdout
+//	put-index              replace the index with the JSON read from stdin
+//	clean                  remove any temporary data
+//
+// A compressor plugin is named "umoci-compressor-<name>", and is used for
+// layers with the media type "application/vnd.oci.image.layer.v1.tar+<name>"
+// (see layer.Compressor). It is run as "umoci-compressor-<name> compress" or
+// "umoci-compressor-<name> decompress", and must write the compressed (or
+// decompressed) form of stdin to stdout.
+//
+// Plugins must exit with ExitNotExist if a blob (or image) doesn't exist, and
+// with ExitNotSupported if they do not support an operation. Any other
+// non-zero exit status is treated as a failure, and anything written to
+// stderr is included in the error.
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+)
+
+// Exit statuses with a special meaning to umoci.
+const (
+	// ExitNotExist is the exit status of a plugin if the requested blob (or
+	// image) doesn't exist.
+	ExitNotExist = 3
+
+	// ExitNotSupported is the exit status of a plugin if it doesn't support
+	// the requested operation.
+	ExitNotSupported = 4
+)
+
+// Kind is the kind of a plugin.
+type Kind string
+
+const (
+	// KindTransport is the kind of transport plugins.
+	KindTransport Kind = "transport"
+
+	// KindCompressor is the kind of compressor plugins.
+	KindCompressor Kind = "compressor"
+)
+
+// namePrefix is the prefix of the file names of plugins. The full file name
+// is "<namePrefix><kind>-<name>".
+const namePrefix = "umoci-"
+
+// nameRegexp matches valid plugin names. Transport names are URI schemes, and
+// compressor names are media type suffixes.
+var nameRegexp = regexp.MustCompile(`^[a-z][a-z0-9.-]*$`)
+
+// Plugin is a plugin found in a plugin directory.
+type Plugin struct {
+	// Kind is the kind of the plugin.
+	Kind Kind
+
+	// Name is the URI scheme (for transports) or media type suffix (for
+	// compressors) handled by the plugin.
+	Name string
+
+	// Path is the path of the plugin executable.
+	Path string
+}
+
+// String returns the file name of the plugin.
+func (p Plugin) String() string {
+	return fmt.Sprintf("%s%s-%s", namePrefix, p.Kind, p.Name)
+}
+
+// Discover returns the plugins in the given directory, sorted by kind and
+// name. Files which are not executable or do not have the name of a plugin
+// are ignored. If the directory doesn't exist, no plugins are returned.
+func Discover(dir string) ([]Plugin, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read plugin directory")
+	}
+
+	var plugins []Plugin
+	for _, fi := range fis {
+		for _, kind := range []Kind{KindTransport, KindCompressor} {
+			prefix := namePrefix + string(kind) + "-"
+			if !strings.HasPrefix(fi.Name(), prefix) {
+				continue
+			}
+			name := strings.TrimPrefix(fi.Name(), prefix)
+			path := filepath.Join(dir, fi.Name())
+			if !nameRegexp.MatchString(name) {
+				log.Warnf("plugin: ignoring %s: invalid name %q", path, name)
+				continue
+			}
+			// Follow symlinks, so that plugins can be installed elsewhere.
+			if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+				log.Debugf("plugin: ignoring %s: not an executable file", path)
+				continue
+			}
+			plugins = append(plugins, Plugin{Kind: kind, Name: name, Path: path})
+		}
+	}
+	sort.Slice(plugins, func(i, j int) bool {
+		if plugins[i].Kind != plugins[j].Kind {
+			return plugins[i].Kind < plugins[j].Kind
+		}
+		return plugins[i].Name < plugins[j].Name
+	})
+	return plugins, nil
+}
+
+var (
+	lm sync.Mutex
+
+	// loaded are the plugins which have been registered by Load, keyed by
+	// kind and name.
+	loaded = map[Kind]map[string]string{
+		KindTransport:  {},
+		KindCompressor: {},
+	}
+)
+
+// Load discovers the plugins in the given directory (see Discover), and
+// registers them so that they are used by umoci: transports are registered
+// with cas.Register and compressors with layer.RegisterCompressor. Plugins
+// which have already been loaded (from any directory) are not registered
+// again, and the plugin loaded first takes precedence. Plugins which cannot
+// be registered (such as compressors with the same name as a built-in
+// compressor) are ignored with a warning, like plugins with invalid names, so
+// that a stray plugin cannot break every command. The plugins which were
+// loaded (now or by a previous call) are returned.
+func Load(dir string) ([]Plugin, error) {
+	plugins, err := Discover(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lm.Lock()
+	defer lm.Unlock()
+
+	var loadedPlugins []Plugin
+	for _, p := range plugins {
+		if path, ok := loaded[p.Kind][p.Name]; ok {
+			if path != p.Path {
+				log.Warnf("plugin: ignoring %s: %s was already loaded from %s", p.Path, p, path)
+			} else {
+				loadedPlugins = append(loadedPlugins, p)
+			}
+			continue
+		}
+		switch p.Kind {
+		case KindTransport:
+			cas.Register(&transportDriver{plugin: p})
+		case KindCompressor:
+			if err := layer.RegisterCompressor(&compressor{plugin: p}); err != nil {
+				log.Warnf("plugin: ignoring %s: %v", p.Path, err)
+				continue
+			}
+		}
+		loaded[p.Kind][p.Name] = p.Path
+		loadedPlugins = append(loadedPlugins, p)
+		log.Debugf("plugin: loaded %s from %s", p, p.Path)
+	}
+	return loadedPlugins, nil
+}
+
+// exitError is the error returned when a plugin fails.
+type exitError struct {
+	plugin Plugin
+	args   []string
+	status int
+	stderr string
+}
+
+// Error implements error.
+func (e *exitError) Error() string {
+	msg := fmt.Sprintf("plugin %s %s: exit status %d", e.plugin, strings.Join(e.args, " "), e.status)
+	if e.stderr != "" {
+		msg += ": " + e.stderr
+	}
+	return msg
+}
+
+// wrapExitError converts an error returned by exec.Cmd.Wait into the error
+// returned by umoci, which is cas.ErrNotExist or cas.ErrNotImplemented if the
+// plugin exited with ExitNotExist or ExitNotSupported.
+func wrapExitError(p Plugin, args []string, stderr *bytes.Buffer, err error) error {
+	if err == nil {
+		return nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return errors.Wrapf(err, "run plugin %s", p)
+	}
+	perr := &exitError{
+		plugin: p,
+		args:   args,
+		status: exitErr.ExitCode(),
+		stderr: strings.TrimSpace(stderr.String()),
+	}
+	switch perr.status {
+	case ExitNotExist:
+		return errors.Wrap(cas.ErrNotExist, perr.Error())
+	case ExitNotSupported:
+		return errors.Wrap(cas.ErrNotImplemented, perr.Error())
+	}
+	return perr
+}
@@ -0,0 +1,262 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// testTransport is a transport plugin which stores images in a directory.
+const testTransport = `#!/bin/sh
+root="${2#*://}"
+case "$1" in
+create) mkdir -p "$root/blobs" && echo '{"schemaVersion":2,"manifests":[]}' >"$root/index.json" ;;
+open) [ -f "$root/index.json" ] || exit 3 ;;
+get-blob) [ -f "$root/blobs/$3" ] || exit 3; cat "$root/blobs/$3" ;;
+put-blob) cat >"$root/blobs/$3" ;;
+delete-blob) [ -f "$root/blobs/$3" ] || exit 3; rm "$root/blobs/$3" ;;
+list-blobs) ls "$root/blobs" ;;
+get-index) cat "$root/index.json" ;;
+put-index) cat >"$root/index.json" ;;
+*) exit 4 ;;
+esac
+`
+
+// testCompressor is a compressor plugin which uses gzip(1).
+const testCompressor = `#!/bin/sh
+case "$1" in
+compress) exec gzip -c ;;
+decompress) exec gzip -dc ;;
+*) exit 4 ;;
+esac
+`
+
+// writePlugins creates a plugin directory containing the given files.
+func writePlugins(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "umoci-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDiscover(t *testing.T) {
+	dir := writePlugins(t, map[string]string{
+		"umoci-transport-discover":   testTransport,
+		"umoci-compressor-discover":  testCompressor,
+		"umoci-transport-Bad_Name":   testTransport,
+		"umoci-unknown-discover":     testTransport,
+		"umoci-transport-nonexec":    testTransport,
+		"README":                     "not a plugin",
+		"umoci-compressor-discover2": testCompressor,
+	})
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(filepath.Join(dir, "umoci-transport-nonexec"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plugins, err := Discover(dir)
+	if err != nil {
+		t.Fatalf("Discover: unexpected error: %+v", err)
+	}
+	expected := []Plugin{
+		{KindCompressor, "discover", filepath.Join(dir, "umoci-compressor-discover")},
+		{KindCompressor, "discover2", filepath.Join(dir, "umoci-compressor-discover2")},
+		{KindTransport, "discover", filepath.Join(dir, "umoci-transport-discover")},
+	}
+	if !reflect.DeepEqual(plugins, expected) {
+		t.Errorf("Discover: got %v, expected %v", plugins, expected)
+	}
+
+	// A missing plugin directory has no plugins.
+	plugins, err = Discover(filepath.Join(dir, "nonexistent"))
+	if err != nil || len(plugins) != 0 {
+		t.Errorf("Discover: expected no plugins in missing directory: %v %v", plugins, err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	ctx := context.Background()
+
+	dir := writePlugins(t, map[string]string{"umoci-transport-testtransport": testTransport})
+	defer os.RemoveAll(dir)
+	if _, err := Load(dir); err != nil {
+		t.Fatalf("Load: unexpected error: %+v", err)
+	}
+	// Loading the plugins again is a no-op.
+	if _, err := Load(dir); err != nil {
+		t.Fatalf("Load: unexpected error: %+v", err)
+	}
+
+	root, err := ioutil.TempDir("", "umoci-TestTransport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	uri := "testtransport://" + filepath.Join(root, "image")
+
+	if _, err := cas.Open(uri); errors.Cause(err) != cas.ErrNotExist {
+		t.Errorf("Open: expected ErrNotExist for missing image: %+v", err)
+	}
+	if err := cas.Create(uri); err != nil {
+		t.Fatalf("Create: unexpected error: %+v", err)
+	}
+	engine, err := cas.Open(uri)
+	if err != nil {
+		t.Fatalf("Open: unexpected error: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	blobDigest, size, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte("some blob")))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if size != int64(len("some blob")) {
+		t.Errorf("PutBlob: unexpected size %d", size)
+	}
+	emptyDigest, _, err := engineExt.PutBlob(ctx, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+
+	for d, expected := range map[digest.Digest]string{blobDigest: "some blob", emptyDigest: ""} {
+		reader, err := engineExt.GetVerifiedBlob(ctx, ispec.Descriptor{Digest: d, Size: int64(len(expected))})
+		if err != nil {
+			t.Errorf("GetBlob(%s): unexpected error: %+v", d, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(data) != expected {
+			t.Errorf("GetBlob(%s): got %q (err=%v), expected %q", d, data, err, expected)
+		}
+	}
+	if _, err := engine.GetBlob(ctx, cas.BlobAlgorithm.FromString("missing")); errors.Cause(err) != cas.ErrNotExist {
+		t.Errorf("GetBlob: expected ErrNotExist for missing blob: %+v", err)
+	}
+
+	descriptor, err := engineExt.PutArtifact(ctx, "application/vnd.example.v1+json", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("PutArtifact: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "tag", descriptor); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if paths, err := engineExt.ResolveReference(ctx, "tag"); err != nil || len(paths) != 1 {
+		t.Errorf("ResolveReference: unexpected result: %v %+v", paths, err)
+	}
+
+	// The unreferenced blobs are removed by GC.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	for _, d := range blobs {
+		if d == blobDigest {
+			t.Errorf("GC: unreferenced blob %s was not removed", d)
+		}
+	}
+	if len(blobs) != 2 {
+		t.Errorf("ListBlobs: expected the artifact's manifest and config: %v", blobs)
+	}
+}
+
+func TestCompressor(t *testing.T) {
+	dir := writePlugins(t, map[string]string{
+		"umoci-compressor-testgz":   testCompressor,
+		"umoci-compressor-testfail": "#!/bin/sh\necho 'it broke' >&2\nexit 1\n",
+		// Plugins cannot replace the built-in compressors, but they must not
+		// stop the other plugins from being loaded.
+		"umoci-compressor-gzip": testCompressor,
+	})
+	defer os.RemoveAll(dir)
+	plugins, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load: unexpected error: %+v", err)
+	}
+	for _, p := range plugins {
+		if p.Name == "gzip" {
+			t.Errorf("Load: plugin replacing built-in compressor was loaded: %s", p.Path)
+		}
+	}
+	if len(plugins) != 2 {
+		t.Errorf("Load: expected 2 plugins to be loaded: got %v", plugins)
+	}
+
+	c := layer.GetCompressor("testgz")
+	if c == nil {
+		t.Fatalf("GetCompressor: compressor plugin was not registered")
+	}
+	var compressed bytes.Buffer
+	w, err := c.Compress(&compressed)
+	if err != nil {
+		t.Fatalf("Compress: unexpected error: %+v", err)
+	}
+	if _, err := w.Write([]byte("some data")); err != nil {
+		t.Fatalf("Compress: unexpected write error: %+v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Compress: unexpected close error: %+v", err)
+	}
+	if got := layer.DetectCompression(compressed.Bytes()); got != layer.CompressionGzip {
+		t.Errorf("Compress: plugin was not used (got %v data)", got)
+	}
+
+	r, err := c.Decompress(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatalf("Decompress: unexpected error: %+v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "some data" {
+		t.Errorf("Decompress: got %q (err=%v)", data, err)
+	}
+
+	// Failures of the plugin are reported, including its stderr.
+	r, err = layer.GetCompressor("testfail").Decompress(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatalf("Decompress: unexpected error: %+v", err)
+	}
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	if err == nil || !bytes.Contains([]byte(err.Error()), []byte("it broke")) {
+		t.Errorf("Decompress: expected plugin failure to be reported: %v", err)
+	}
+}
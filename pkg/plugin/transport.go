@@ -0,0 +1,263 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// transportDriver is a cas.Driver for the URIs handled by a transport plugin.
+type transportDriver struct {
+	plugin Plugin
+}
+
+// Supported returns whether the URI has the scheme of the plugin.
+func (d *transportDriver) Supported(uri string) bool {
+	return cas.URIScheme(uri) == d.plugin.Name
+}
+
+// Open checks that the image exists, and returns an engine which uses the
+// plugin to access it.
+func (d *transportDriver) Open(uri string) (cas.Engine, error) {
+	engine := &transportEngine{plugin: d.plugin, uri: uri}
+	if err := engine.run(context.Background(), nil, nil, "open"); err != nil {
+		return nil, errors.Wrap(err, "open image")
+	}
+	return engine, nil
+}
+
+// Create creates a new image using the plugin.
+func (d *transportDriver) Create(uri string) error {
+	engine := &transportEngine{plugin: d.plugin, uri: uri}
+	return errors.Wrap(engine.run(context.Background(), nil, nil, "create"), "create image")
+}
+
+// transportEngine is a cas.Engine which accesses an image using a transport
+// plugin.
+type transportEngine struct {
+	plugin Plugin
+	uri    string
+}
+
+// command returns the command which runs the given operation of the plugin,
+// and the arguments given to the plugin.
+func (e *transportEngine) command(ctx context.Context, op string, args ...string) (*exec.Cmd, []string) {
+	args = append([]string{op, e.uri}, args...)
+	return exec.CommandContext(ctx, e.plugin.Path, args...), args
+}
+
+// run runs the given operation of the plugin, with the given stdin and
+// stdout (which may be nil).
+func (e *transportEngine) run(ctx context.Context, stdin io.Reader, stdout io.Writer, op string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd, args := e.command(ctx, op, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	return wrapExitError(e.plugin, args, &stderr, cmd.Run())
+}
+
+// PutBlob adds a new blob to the image. The blob is buffered in a temporary
+// file so that its digest can be given to the plugin.
+func (e *transportEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	fh, err := ioutil.TempFile("", "umoci-plugin-blob")
+	if err != nil {
+		return "", -1, errors.Wrap(err, "create temporary blob")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	digester := cas.BlobAlgorithm.Digester()
+	size, err := io.Copy(io.MultiWriter(fh, digester.Hash()), reader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "copy to temporary blob")
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return "", -1, errors.Wrap(err, "seek temporary blob")
+	}
+
+	blobDigest := digester.Digest()
+	if err := e.run(ctx, fh, nil, "put-blob", blobDigest.String()); err != nil {
+		return "", -1, errors.Wrap(err, "put blob")
+	}
+	return blobDigest, size, nil
+}
+
+// GetBlob returns a reader for the blob with the given digest, which is
+// streamed from the plugin.
+func (e *transportEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	if err := blobDigest.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid digest")
+	}
+	var stderr bytes.Buffer
+	cmd, args := e.command(ctx, "get-blob", blobDigest.String())
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "run plugin %s", e.plugin)
+	}
+	br := bufio.NewReader(stdout)
+	reader := &commandReader{
+		Reader: br,
+		wait: func() error {
+			return wrapExitError(e.plugin, args, &stderr, cmd.Wait())
+		},
+		kill: func() {
+			cmd.Process.Kill()
+		},
+	}
+
+	// Wait for the first byte of output, so that missing blobs are reported
+	// by GetBlob (as required by cas.Engine) rather than by Read.
+	if _, err := br.Peek(1); err != nil {
+		reader.done = true
+		reader.err = reader.wait()
+		if reader.err != nil {
+			return nil, errors.Wrap(reader.err, "get blob")
+		}
+	}
+	return reader, nil
+}
+
+// PutIndex replaces the index of the image.
+func (e *transportEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "encode index")
+	}
+	return errors.Wrap(e.run(ctx, bytes.NewReader(data), nil, "put-index"), "put index")
+}
+
+// GetIndex returns the index of the image.
+func (e *transportEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	var stdout bytes.Buffer
+	if err := e.run(ctx, nil, &stdout, "get-index"); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "get index")
+	}
+	var index ispec.Index
+	if err := json.Unmarshal(stdout.Bytes(), &index); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "decode index")
+	}
+	return index, nil
+}
+
+// DeleteBlob removes the blob with the given digest from the image.
+func (e *transportEngine) DeleteBlob(ctx context.Context, blobDigest digest.Digest) error {
+	if err := blobDigest.Validate(); err != nil {
+		return errors.Wrap(err, "invalid digest")
+	}
+	err := e.run(ctx, nil, nil, "delete-blob", blobDigest.String())
+	if errors.Cause(err) == cas.ErrNotExist {
+		// Deleting a blob which doesn't exist is not an error.
+		err = nil
+	}
+	return errors.Wrap(err, "delete blob")
+}
+
+// ListBlobs returns the digests of all blobs in the image.
+func (e *transportEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	var stdout bytes.Buffer
+	if err := e.run(ctx, nil, &stdout, "list-blobs"); err != nil {
+		return nil, errors.Wrap(err, "list blobs")
+	}
+	var digests []digest.Digest
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		blobDigest, err := digest.Parse(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list blobs: invalid digest %q", line)
+		}
+		digests = append(digests, blobDigest)
+	}
+	return digests, nil
+}
+
+// Clean removes any temporary data of the plugin. Plugins don't need to
+// support this operation.
+func (e *transportEngine) Clean(ctx context.Context) error {
+	err := e.run(ctx, nil, nil, "clean")
+	if errors.Cause(err) == cas.ErrNotImplemented {
+		err = nil
+	}
+	return errors.Wrap(err, "clean")
+}
+
+// Close does nothing, as the plugin is run for each operation.
+func (e *transportEngine) Close() error {
+	return nil
+}
+
+// commandReader is an io.ReadCloser for the stdout of a running command. The
+// exit status of the command is checked once all of its output has been read
+// (so that a failure is not mistaken for the end of the output), and the
+// command is killed if the reader is closed before then.
+type commandReader struct {
+	io.Reader
+	wait func() error
+	kill func()
+	done bool
+	err  error
+}
+
+// Read implements io.Reader.
+func (r *commandReader) Read(p []byte) (int, error) {
+	if r.done {
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.done = true
+		r.err = r.wait()
+		if r.err != nil {
+			err = r.err
+		}
+	}
+	return n, err
+}
+
+// Close kills the command (if it is still running) and returns its error.
+func (r *commandReader) Close() error {
+	if !r.done {
+		r.kill()
+		r.done = true
+		r.wait()
+	}
+	return r.err
+}
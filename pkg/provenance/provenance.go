@@ -0,0 +1,120 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package provenance implements the subset of the in-toto attestation
+// framework and the SLSA provenance predicate needed to describe how an image
+// was built by umoci.
+package provenance
+
+import (
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// StatementType is the type of in-toto statements.
+	StatementType = "https://in-toto.io/Statement/v0.1"
+
+	// PredicateSLSAProvenance is the predicate type of SLSA provenance.
+	PredicateSLSAProvenance = "https://slsa.dev/provenance/v0.2"
+
+	// MediaTypeStatement is the media type of in-toto statements.
+	MediaTypeStatement = "application/vnd.in-toto+json"
+)
+
+// DigestSet is a set of digests of the same artifact, keyed by algorithm.
+type DigestSet map[string]string
+
+// NewDigestSet returns a DigestSet containing the given digest.
+func NewDigestSet(d digest.Digest) DigestSet {
+	return DigestSet{d.Algorithm().String(): d.Hex()}
+}
+
+// Subject is an artifact which a Statement is about.
+type Subject struct {
+	Name   string    `json:"name"`
+	Digest DigestSet `json:"digest"`
+}
+
+// Statement is an in-toto statement with a SLSA provenance predicate.
+type Statement struct {
+	Type          string     `json:"_type"`
+	PredicateType string     `json:"predicateType"`
+	Subject       []Subject  `json:"subject"`
+	Predicate     Provenance `json:"predicate"`
+}
+
+// Builder identifies the entity which produced the subjects.
+type Builder struct {
+	ID string `json:"id"`
+}
+
+// ConfigSource describes where the build definition came from.
+type ConfigSource struct {
+	URI        string    `json:"uri,omitempty"`
+	Digest     DigestSet `json:"digest,omitempty"`
+	EntryPoint string    `json:"entryPoint,omitempty"`
+}
+
+// Invocation describes how the build was invoked.
+type Invocation struct {
+	ConfigSource *ConfigSource          `json:"configSource,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+	Environment  map[string]interface{} `json:"environment,omitempty"`
+}
+
+// Completeness describes whether the other fields are complete.
+type Completeness struct {
+	Parameters  bool `json:"parameters"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+// Metadata contains other properties of the build.
+type Metadata struct {
+	BuildInvocationID string       `json:"buildInvocationId,omitempty"`
+	BuildStartedOn    *time.Time   `json:"buildStartedOn,omitempty"`
+	BuildFinishedOn   *time.Time   `json:"buildFinishedOn,omitempty"`
+	Completeness      Completeness `json:"completeness"`
+	Reproducible      bool         `json:"reproducible"`
+}
+
+// Material is an artifact which influenced the build.
+type Material struct {
+	URI    string    `json:"uri"`
+	Digest DigestSet `json:"digest,omitempty"`
+}
+
+// Provenance is a SLSA provenance predicate.
+type Provenance struct {
+	Builder    Builder    `json:"builder"`
+	BuildType  string     `json:"buildType"`
+	Invocation Invocation `json:"invocation"`
+	Metadata   *Metadata  `json:"metadata,omitempty"`
+	Materials  []Material `json:"materials,omitempty"`
+}
+
+// NewStatement returns a Statement with the given provenance of the subjects.
+func NewStatement(provenance Provenance, subjects ...Subject) Statement {
+	return Statement{
+		Type:          StatementType,
+		PredicateType: PredicateSLSAProvenance,
+		Subject:       subjects,
+		Predicate:     provenance,
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package rawjson preserves the fields of JSON documents which are not known
+// to the Go types they are decoded into. Decoding a blob written by a newer
+// tool (or a newer version of a specification) into a struct and encoding it
+// again silently drops every field the struct doesn't have, so modified blobs
+// are instead patched with the unknown fields of the original.
+package rawjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	marshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// Preserve returns data (the JSON encoding of a value with the same type as
+// value) with the fields of old (the original JSON document that was decoded
+// into such a value before it was modified) which are not known to the type
+// added back. Fields are matched recursively:
+//
+//   - Objects decoded into structs are matched field by field, and unknown
+//     fields of old which are not in data are added.
+//   - Each element of an array is matched with the first unmatched element of
+//     old whose known fields are all identical (so that elements which were
+//     added, removed, reordered or modified are handled correctly).
+//   - Values of objects decoded into maps are matched by key.
+//
+// Objects with a "digest" field (such as descriptors) are only matched if they
+// have the same digest, because their unknown fields may describe the content
+// (such as the "data" field of descriptors). Known fields which are not in
+// data are not added back, because they were removed by the modification. If
+// there are no unknown fields, data is returned unmodified.
+func Preserve(old, data []byte, value interface{}) ([]byte, error) {
+	merged, err := preserve(old, data, reflect.TypeOf(value))
+	if err != nil {
+		return nil, errors.Wrap(err, "preserve unknown fields")
+	}
+	return merged, nil
+}
+
+// preserve implements Preserve for a value of the given type.
+func preserve(old, data json.RawMessage, typ reflect.Type) (json.RawMessage, error) {
+	if typ == nil {
+		return data, nil
+	}
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	// Types with custom encodings (such as time.Time) are opaque.
+	if typ.Implements(marshalerType) || reflect.PtrTo(typ).Implements(unmarshalerType) {
+		return data, nil
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		return preserveStruct(old, data, typ)
+	case reflect.Slice, reflect.Array:
+		return preserveArray(old, data, typ.Elem())
+	case reflect.Map:
+		return preserveMap(old, data, typ.Elem())
+	}
+	return data, nil
+}
+
+// structFields returns the types of the fields of the struct, keyed by their
+// JSON names (including the fields of embedded structs).
+func structFields(typ reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for idx := 0; idx < typ.NumField(); idx++ {
+		field := typ.Field(idx)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" && field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for embeddedName, embeddedType := range structFields(field.Type) {
+				fields[embeddedName] = embeddedType
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// isContainer returns whether values of the type can have unknown fields.
+func isContainer(typ reflect.Type) bool {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
+
+// preserveStruct implements preserve for objects decoded into structs.
+func preserveStruct(old, data json.RawMessage, typ reflect.Type) (json.RawMessage, error) {
+	var oldFields, newFields map[string]json.RawMessage
+	if json.Unmarshal(old, &oldFields) != nil || json.Unmarshal(data, &newFields) != nil || oldFields == nil || newFields == nil {
+		return data, nil
+	}
+	if !bytes.Equal(oldFields["digest"], newFields["digest"]) {
+		return data, nil
+	}
+
+	known := structFields(typ)
+	changed := false
+	for name, oldValue := range oldFields {
+		newValue, ok := newFields[name]
+		fieldType, isKnown := known[name]
+		switch {
+		case !isKnown && !ok:
+			newFields[name] = oldValue
+			changed = true
+		case isKnown && ok && isContainer(fieldType):
+			merged, err := preserve(oldValue, newValue, fieldType)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %q", name)
+			}
+			if !bytes.Equal(merged, newValue) {
+				newFields[name] = merged
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(newFields)
+}
+
+// knownEqual returns whether the fields of old known to the type are equal to
+// data (which is the encoding of a value of the type).
+func knownEqual(old, data json.RawMessage, typ reflect.Type) bool {
+	value := reflect.New(typ)
+	if err := json.Unmarshal(old, value.Interface()); err != nil {
+		return false
+	}
+	known, err := json.Marshal(value.Elem().Interface())
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(known, data)
+}
+
+// preserveArray implements preserve for arrays.
+func preserveArray(old, data json.RawMessage, elemType reflect.Type) (json.RawMessage, error) {
+	if !isContainer(elemType) {
+		return data, nil
+	}
+	var oldElems, newElems []json.RawMessage
+	if json.Unmarshal(old, &oldElems) != nil || json.Unmarshal(data, &newElems) != nil {
+		return data, nil
+	}
+
+	used := make([]bool, len(oldElems))
+	changed := false
+	for idx, newElem := range newElems {
+		for oldIdx, oldElem := range oldElems {
+			if used[oldIdx] || !knownEqual(oldElem, newElem, elemType) {
+				continue
+			}
+			used[oldIdx] = true
+			merged, err := preserve(oldElem, newElem, elemType)
+			if err != nil {
+				return nil, errors.Wrapf(err, "element %d", idx)
+			}
+			if !bytes.Equal(merged, newElem) {
+				newElems[idx] = merged
+				changed = true
+			}
+			break
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(newElems)
+}
+
+// preserveMap implements preserve for objects decoded into maps.
+func preserveMap(old, data json.RawMessage, elemType reflect.Type) (json.RawMessage, error) {
+	if !isContainer(elemType) {
+		return data, nil
+	}
+	var oldValues, newValues map[string]json.RawMessage
+	if json.Unmarshal(old, &oldValues) != nil || json.Unmarshal(data, &newValues) != nil {
+		return data, nil
+	}
+
+	changed := false
+	for key, newValue := range newValues {
+		oldValue, ok := oldValues[key]
+		if !ok {
+			continue
+		}
+		merged, err := preserve(oldValue, newValue, elemType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %q", key)
+		}
+		if !bytes.Equal(merged, newValue) {
+			newValues[key] = merged
+			changed = true
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(newValues)
+}
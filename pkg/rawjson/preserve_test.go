@@ -0,0 +1,161 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rawjson
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testVersioned struct {
+	Version int `json:"version"`
+}
+
+type testDescriptor struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+type testEntry struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+type testDocument struct {
+	testVersioned
+	Config  testDescriptor            `json:"config"`
+	Layers  []testDescriptor          `json:"layers"`
+	Entries []testEntry               `json:"entries,omitempty"`
+	Named   map[string]testDescriptor `json:"named,omitempty"`
+	Labels  map[string]string         `json:"labels,omitempty"`
+	ignored string
+}
+
+func TestPreserve(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		old      string
+		modify   func(*testDocument)
+		expected string
+	}{
+		{
+			name:     "NoUnknown",
+			old:      `{"version":2,"config":{"digest":"a","size":1},"layers":[]}`,
+			modify:   func(doc *testDocument) { doc.Labels = map[string]string{"key": "value"} },
+			expected: `{"version":2,"config":{"digest":"a","size":1},"layers":[],"labels":{"key":"value"}}`,
+		},
+		{
+			name:     "TopLevel",
+			old:      `{"version":2,"config":{"digest":"a","size":1},"layers":[],"subject":{"digest":"s"},"mediaType":"x"}`,
+			modify:   func(doc *testDocument) { doc.Version = 3 },
+			expected: `{"version":3,"config":{"digest":"a","size":1},"layers":[],"subject":{"digest":"s"},"mediaType":"x"}`,
+		},
+		{
+			name:     "SameDigest",
+			old:      `{"version":2,"config":{"digest":"a","size":1,"artifactType":"t"},"layers":[]}`,
+			modify:   func(doc *testDocument) { doc.Config.Size = 2 },
+			expected: `{"version":2,"config":{"digest":"a","size":2,"artifactType":"t"},"layers":[]}`,
+		},
+		{
+			name:     "ChangedDigest",
+			old:      `{"version":2,"config":{"digest":"a","size":1,"data":"AA=="},"layers":[]}`,
+			modify:   func(doc *testDocument) { doc.Config.Digest = "b" },
+			expected: `{"version":2,"config":{"digest":"b","size":1},"layers":[]}`,
+		},
+		{
+			name: "Array",
+			old:  `{"version":2,"config":{"digest":"a","size":1},"layers":[{"digest":"l1","size":1,"x":1},{"digest":"l2","size":2,"x":2}]}`,
+			modify: func(doc *testDocument) {
+				doc.Layers = []testDescriptor{{"l0", 0}, doc.Layers[1], {"l1", 3}, doc.Layers[0]}
+			},
+			expected: `{"version":2,"config":{"digest":"a","size":1},"layers":[{"digest":"l0","size":0},{"digest":"l2","size":2,"x":2},{"digest":"l1","size":3},{"digest":"l1","size":1,"x":1}]}`,
+		},
+		{
+			name:     "OpaqueTypes",
+			old:      `{"version":2,"config":{"digest":"a","size":1},"layers":[],"entries":[{"name":"e","created":"2017-01-01T00:00:00Z","extra":true}]}`,
+			modify:   func(doc *testDocument) { doc.Version = 3 },
+			expected: `{"version":3,"config":{"digest":"a","size":1},"layers":[],"entries":[{"name":"e","created":"2017-01-01T00:00:00Z","extra":true}]}`,
+		},
+		{
+			name: "Map",
+			old:  `{"version":2,"config":{"digest":"a","size":1},"layers":[],"named":{"one":{"digest":"n","size":1,"x":1},"two":{"digest":"m","size":1,"x":2}}}`,
+			modify: func(doc *testDocument) {
+				delete(doc.Named, "two")
+			},
+			expected: `{"version":2,"config":{"digest":"a","size":1},"layers":[],"named":{"one":{"digest":"n","size":1,"x":1}}}`,
+		},
+		{
+			name:     "RemovedKnown",
+			old:      `{"version":2,"config":{"digest":"a","size":1},"layers":[],"labels":{"key":"value"},"unknown":null}`,
+			modify:   func(doc *testDocument) { doc.Labels = nil },
+			expected: `{"version":2,"config":{"digest":"a","size":1},"layers":[],"unknown":null}`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var doc testDocument
+			if err := json.Unmarshal([]byte(test.old), &doc); err != nil {
+				t.Fatal(err)
+			}
+			test.modify(&doc)
+			data, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Preserve([]byte(test.old), data, doc)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			var gotValue, expectedValue interface{}
+			if err := json.Unmarshal(got, &gotValue); err != nil {
+				t.Fatalf("invalid json %s: %v", got, err)
+			}
+			if err := json.Unmarshal([]byte(test.expected), &expectedValue); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotValue, expectedValue) {
+				t.Errorf("got %s, expected %s", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestPreserveUnmodified(t *testing.T) {
+	old := `{"version":2,"config":{"digest":"a","size":1},"layers":[{"digest":"l","size":1}]}`
+	var doc testDocument
+	if err := json.Unmarshal([]byte(old), &doc); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without unknown fields, the encoding must be byte-for-byte identical so
+	// that digests don't change.
+	got, err := Preserve([]byte(old), data, doc)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("data was modified: got %s, expected %s", got, data)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package shlex splits command lines into words using the quoting rules of
+// the POSIX shell, without performing any expansions. Command lines which
+// would need a shell to be interpreted correctly (because they contain
+// unquoted operators or expansions) are rejected rather than being split
+// into something the user didn't intend.
+package shlex
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// operators are the characters which have a special meaning to the shell when
+// they are not quoted, and so cannot be handled by Split.
+const operators = "|&;<>()$`*?[~#"
+
+// doubleQuoteEscapes are the characters which can be escaped with a backslash
+// inside double quotes.
+const doubleQuoteEscapes = "$`\"\\\n"
+
+// Split splits the given command line into words, following the quoting rules
+// of the POSIX shell: words are separated by unquoted whitespace, single
+// quotes preserve every character literally, double quotes preserve every
+// character except for backslash escapes (of "$", "`", '"', "\" and newline),
+// and a backslash outside of quotes preserves the following character.
+//
+// No expansions are performed, so an error is returned if the command line
+// contains unquoted shell operators (such as "|" or ";"), globs, comments, or
+// any (unescaped) parameter or command substitutions.
+func Split(line string) ([]string, error) {
+	var (
+		words   []string
+		word    bytes.Buffer
+		inWord  bool
+		escaped bool
+		quote   rune
+	)
+	for idx, ch := range line {
+		switch {
+		case escaped:
+			escaped = false
+			if quote == '"' && !strings.ContainsRune(doubleQuoteEscapes, ch) {
+				word.WriteRune('\\')
+			}
+			// A backslash-newline is a line continuation.
+			if ch != '\n' {
+				word.WriteRune(ch)
+			}
+		case quote == '\'':
+			if ch == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(ch)
+			}
+		case quote == '"':
+			switch ch {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			case '$', '`':
+				return nil, errors.Errorf("offset %d: expansions are not supported: %q", idx, ch)
+			default:
+				word.WriteRune(ch)
+			}
+		case ch == '\\':
+			inWord = true
+			escaped = true
+		case ch == '\'' || ch == '"':
+			inWord = true
+			quote = ch
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.ContainsRune(operators, ch):
+			return nil, errors.Errorf("offset %d: unquoted %q requires a shell", idx, ch)
+		default:
+			inWord = true
+			word.WriteRune(ch)
+		}
+	}
+	if escaped {
+		return nil, errors.Errorf("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// ParseCommand parses a command given either in the exec form (a JSON array
+// of strings, as used by the CMD and ENTRYPOINT Dockerfile instructions) or
+// as a command line which is split into words with Split. If strict is set,
+// only the exec form is accepted. The returned command is never empty.
+func ParseCommand(value string, strict bool) ([]string, error) {
+	var args []string
+	if trimmed := strings.TrimSpace(value); strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal([]byte(trimmed), &args); err != nil {
+			return nil, errors.Wrap(err, "parse exec form")
+		}
+	} else if strict {
+		return nil, errors.Errorf("command must be in the exec form (a JSON array of strings): %q", value)
+	} else {
+		words, err := Split(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "split command line %q", value)
+		}
+		args = words
+	}
+	if len(args) == 0 {
+		return nil, errors.Errorf("command must not be empty")
+	}
+	if args[0] == "" {
+		return nil, errors.Errorf("command executable must not be empty")
+	}
+	return args, nil
+}
@@ -0,0 +1,119 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shlex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"ls", []string{"ls"}},
+		{"  ls  -la\t/tmp\n", []string{"ls", "-la", "/tmp"}},
+		{`echo 'hello world'`, []string{"echo", "hello world"}},
+		{`echo "hello   world"`, []string{"echo", "hello   world"}},
+		{`echo ''`, []string{"echo", ""}},
+		{`echo a""b`, []string{"echo", "ab"}},
+		{`echo 'it'\''s'`, []string{"echo", "it's"}},
+		{`echo "a \"quoted\" \$word \\ \n"`, []string{"echo", `a "quoted" $word \ \n`}},
+		{`echo '$HOME | ; *'`, []string{"echo", "$HOME | ; *"}},
+		{`echo \$HOME\ dir \|`, []string{"echo", "$HOME dir", "|"}},
+		{"echo a\\\nb", []string{"echo", "ab"}},
+		{"a=b", []string{"a=b"}},
+		{"--flag=x,y:z@host%", []string{"--flag=x,y:z@host%"}},
+	} {
+		words, err := Split(test.line)
+		if err != nil {
+			t.Errorf("Split(%q): unexpected error: %+v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(words, test.expected) {
+			t.Errorf("Split(%q): expected %q got %q", test.line, test.expected, words)
+		}
+	}
+
+	for _, line := range []string{
+		`echo 'unterminated`,
+		`echo "unterminated`,
+		`echo trailing\`,
+		`echo $HOME`,
+		"echo `id`",
+		`echo "$HOME"`,
+		`echo "$(id)"`,
+		`ls | grep x`,
+		`true && false`,
+		`a; b`,
+		`cat <file`,
+		`echo > file`,
+		`(subshell)`,
+		`ls *.go`,
+		`ls file?`,
+		`ls [ab]`,
+		`ls ~`,
+		`ls # comment`,
+	} {
+		if words, err := Split(line); err == nil {
+			t.Errorf("Split(%q): expected error, got %q", line, words)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		strict   bool
+		expected []string
+	}{
+		{`["/bin/sh", "-c", "echo $HOME"]`, false, []string{"/bin/sh", "-c", "echo $HOME"}},
+		{`  ["ls"]  `, true, []string{"ls"}},
+		{`/bin/app --flag 'some value'`, false, []string{"/bin/app", "--flag", "some value"}},
+	} {
+		args, err := ParseCommand(test.value, test.strict)
+		if err != nil {
+			t.Errorf("ParseCommand(%q, %v): unexpected error: %+v", test.value, test.strict, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("ParseCommand(%q, %v): expected %q got %q", test.value, test.strict, test.expected, args)
+		}
+	}
+
+	for _, test := range []struct {
+		value  string
+		strict bool
+	}{
+		{`/bin/app --flag`, true},
+		{`[]`, false},
+		{`[""]`, false},
+		{``, false},
+		{`["unterminated"`, false},
+		{`["a", 1]`, false},
+		{`["a"] trailing`, false},
+		{`echo $HOME`, false},
+	} {
+		if args, err := ParseCommand(test.value, test.strict); err == nil {
+			t.Errorf("ParseCommand(%q, %v): expected error, got %q", test.value, test.strict, args)
+		}
+	}
+}
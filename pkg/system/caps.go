@@ -0,0 +1,40 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+// Capability is a Linux capability number (see capabilities(7)).
+type Capability uint
+
+// The capabilities which umoci needs in order to operate without --rootless.
+const (
+	CapChown       Capability = 0
+	CapDacOverride Capability = 1
+	CapFowner      Capability = 3
+	CapSysChroot   Capability = 18
+	CapSysAdmin    Capability = 21
+	CapMknod       Capability = 27
+)
+
+// CapabilitySet is a set of Linux capabilities, in the same bitmask format
+// used by the kernel.
+type CapabilitySet uint64
+
+// Has returns whether the set contains the given capability.
+func (s CapabilitySet) Has(c Capability) bool {
+	return s&(1<<c) != 0
+}
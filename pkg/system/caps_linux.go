@@ -0,0 +1,54 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package system
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EffectiveCapabilities returns the effective capability set of the current
+// process, as reported by /proc/self/status. Note that the set is only
+// meaningful within the current user namespace.
+func EffectiveCapabilities() (CapabilitySet, error) {
+	fh, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, errors.Wrap(err, "open process status")
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		set, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "parse effective capabilities")
+		}
+		return CapabilitySet(set), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrap(err, "read process status")
+	}
+	return 0, errors.Errorf("no effective capabilities in process status")
+}
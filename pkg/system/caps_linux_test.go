@@ -0,0 +1,45 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package system
+
+import (
+	"testing"
+)
+
+func TestCapabilitySet(t *testing.T) {
+	set := CapabilitySet(1<<CapChown | 1<<CapMknod)
+	for _, test := range []struct {
+		capability Capability
+		expected   bool
+	}{
+		{CapChown, true},
+		{CapDacOverride, false},
+		{CapFowner, false},
+		{CapSysAdmin, false},
+		{CapMknod, true},
+	} {
+		if got := set.Has(test.capability); got != test.expected {
+			t.Errorf("Has(%d): expected %v, got %v", test.capability, test.expected, got)
+		}
+	}
+}
+
+func TestEffectiveCapabilities(t *testing.T) {
+	if _, err := EffectiveCapabilities(); err != nil {
+		t.Fatalf("unexpected error getting capabilities: %+v", err)
+	}
+}
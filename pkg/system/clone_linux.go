@@ -0,0 +1,54 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ficlone is the FICLONE ioctl(2) request, which isn't defined by
+// golang.org/x/sys/unix.
+const ficlone = 0x40049409
+
+// Clonefile makes the file with the file descriptor dst share the contents of
+// the file with the file descriptor src (a "reflink"), without copying any
+// data. Both files must be on the same filesystem, and the filesystem must
+// support reflinks (such as btrfs and XFS). IsCloneUnsupported returns whether
+// an error means that the files cannot be reflinked, in which case the
+// contents have to be copied instead.
+func Clonefile(dst, src uintptr) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dst, ficlone, src)
+	if errno != 0 {
+		return os.NewSyscallError("ficlone", errno)
+	}
+	return nil
+}
+
+// IsCloneUnsupported returns whether the given error (returned by Clonefile)
+// means that the files cannot be reflinked.
+func IsCloneUnsupported(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		switch err.Err {
+		case unix.EOPNOTSUPP, unix.ENOTTY, unix.EXDEV, unix.EINVAL, unix.ENOSYS:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyFileRange copies up to n bytes from the current offset of the file with
+// the file descriptor src to the current offset of the file with the file
+// descriptor dst using copy_file_range(2), so that the contents never have to
+// be copied through userspace (and can be shared by filesystems which support
+// reflinks). The number of bytes copied is returned, which is only less than n
+// if src reached EOF. IsCopyUnsupported returns whether an error means that
+// the contents have to be copied some other way.
+func CopyFileRange(dst, src uintptr, n int64) (int64, error) {
+	var copied int64
+	for copied < n {
+		chunk := n - copied
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+		m, err := unix.CopyFileRange(int(src), nil, int(dst), nil, int(chunk), 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return copied, os.NewSyscallError("copy_file_range", err)
+		}
+		if m == 0 {
+			break
+		}
+		copied += int64(m)
+	}
+	return copied, nil
+}
+
+// IsCopyUnsupported returns whether the given error (returned by
+// CopyFileRange) means that copy_file_range(2) cannot be used for the files,
+// such as on kernels which don't support it or (before Linux 5.3) when the
+// files are on different filesystems.
+func IsCopyUnsupported(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		switch err.Err {
+		case unix.EOPNOTSUPP, unix.EXDEV, unix.EINVAL, unix.ENOSYS, unix.EBADF:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Fallocate preallocates size bytes of disk space for the file with the given
+// file descriptor, without changing its apparent size. This both reduces
+// fragmentation and ensures that running out of disk space is detected before
+// any data is written. If the filesystem doesn't support preallocation, nil
+// is returned.
+func Fallocate(fd uintptr, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(fd), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	switch err {
+	case nil, unix.EOPNOTSUPP, unix.ENOSYS:
+		return nil
+	}
+	return os.NewSyscallError("fallocate", err)
+}
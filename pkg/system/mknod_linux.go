@@ -18,53 +18,11 @@
 package system
 
 import (
-	"archive/tar"
 	"os"
 
 	"golang.org/x/sys/unix"
 )
 
-// Dev_t represents a dev_t structure.
-type Dev_t uint64
-
-// Tarmode takes a Typeflag (from a tar.Header for example) and returns the
-// corresponding os.Filemode bit. Unknown typeflags are treated like regular
-// files.
-func Tarmode(typeflag byte) uint32 {
-	switch typeflag {
-	case tar.TypeSymlink:
-		return unix.S_IFLNK
-	case tar.TypeChar:
-		return unix.S_IFCHR
-	case tar.TypeBlock:
-		return unix.S_IFBLK
-	case tar.TypeFifo:
-		return unix.S_IFIFO
-	case tar.TypeDir:
-		return unix.S_IFDIR
-	}
-	return 0
-}
-
-// Makedev produces a dev_t from the individual major and minor numbers,
-// similar to makedev(3).
-func Makedev(major, minor uint64) Dev_t {
-	// These values come from new_envode_dev inside <linux/kdev_t.h>.
-	return Dev_t((minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12))
-}
-
-// Majordev returns the major device number given a dev_t, similar to major(3).
-func Majordev(device Dev_t) uint64 {
-	// These values come from new_decode_dev() inside <linux/kdev_t.h>.
-	return uint64((device & 0xfff00) >> 8)
-}
-
-// Minordev returns the minor device number given a dev_t, similar to minor(3).
-func Minordev(device Dev_t) uint64 {
-	// These values come from new_decode_dev() inside <linux/kdev_t.h>.
-	return uint64((device & 0xff) | ((device >> 12) & 0xfff00))
-}
-
 // Mknod is a wrapper around mknod(2).
 func Mknod(path string, mode os.FileMode, dev Dev_t) error {
 	return unix.Mknod(path, uint32(mode), int(dev))
@@ -0,0 +1,72 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFallocate(t *testing.T) {
+	file, err := ioutil.TempFile("", "umoci-system.TestFallocate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := Fallocate(file.Fd(), 1<<20); err != nil {
+		t.Fatalf("unexpected error preallocating file: %s", err)
+	}
+
+	// The apparent size must not change.
+	var st unix.Stat_t
+	if err := unix.Fstat(int(file.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != 0 {
+		t.Errorf("preallocated file has the wrong size: got %d", st.Size)
+	}
+
+	// Ridiculous sizes must fail.
+	if err := Fallocate(file.Fd(), 1<<62); err == nil {
+		t.Errorf("expected error preallocating huge file")
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-system.TestFreeSpace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	free, err := FreeSpace(dir)
+	if err != nil {
+		t.Fatalf("unexpected error getting free space: %s", err)
+	}
+	if free < 0 {
+		t.Errorf("unexpected free space: %d", free)
+	}
+
+	if _, err := FreeSpace(dir + "/nonexistent"); !os.IsNotExist(err) {
+		t.Errorf("expected IsNotExist error for missing path: got %v", err)
+	}
+}
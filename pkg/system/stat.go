@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import "golang.org/x/sys/unix"
+
+// Stat_t is the stat(2) structure of the host.
+type Stat_t = unix.Stat_t
+
+// Lstat is a wrapper around lstat(2).
+func Lstat(path string, st *Stat_t) error {
+	return unix.Lstat(path, st)
+}
@@ -0,0 +1,82 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"syscall"
+)
+
+// Timespec is a time with nanosecond precision, like the timespec structure
+// of unix hosts.
+type Timespec struct {
+	Sec  int64
+	Nsec int64
+}
+
+// Unix returns the time stored in ts as seconds plus nanoseconds.
+func (ts *Timespec) Unix() (sec int64, nsec int64) {
+	return ts.Sec, ts.Nsec
+}
+
+// Stat_t has the same fields as the stat(2) structure of unix hosts, so that
+// the same code can be used to inspect files on Windows. Only the fields
+// which can be filled from an os.FileInfo are set (see Lstat).
+type Stat_t struct {
+	Dev   uint64
+	Ino   uint64
+	Nlink uint64
+	Mode  uint32
+	Uid   uint32
+	Gid   uint32
+	Rdev  uint64
+	Size  int64
+	Atim  Timespec
+	Mtim  Timespec
+	Ctim  Timespec
+}
+
+// Lstat fills st from os.Lstat. Windows has no inode numbers or ownership,
+// so every file is treated as having a single link and being owned by root.
+func Lstat(path string, st *Stat_t) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	mode := uint32(fi.Mode().Perm())
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	case fi.IsDir():
+		mode |= syscall.S_IFDIR
+	default:
+		mode |= syscall.S_IFREG
+	}
+	mtime := Timespec{Sec: fi.ModTime().Unix(), Nsec: int64(fi.ModTime().Nanosecond())}
+
+	*st = Stat_t{
+		Nlink: 1,
+		Mode:  mode,
+		Size:  fi.Size(),
+		Atim:  mtime,
+		Mtim:  mtime,
+		Ctim:  mtime,
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenTmpfile creates a new unnamed regular file inside the given directory
+// using O_TMPFILE. The file is not visible in the filesystem until it is given
+// a name with LinkTmpfile, and is removed if it is closed before then. Not all
+// filesystems support O_TMPFILE, in which case an error is returned (use
+// IsTmpfileUnsupported to check for this case).
+func OpenTmpfile(dir string, perm os.FileMode) (*os.File, error) {
+	fd, err := unix.Open(dir, unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open_tmpfile", Path: dir, Err: err}
+	}
+	return os.NewFile(uintptr(fd), dir), nil
+}
+
+// IsTmpfileUnsupported returns whether the given error from OpenTmpfile
+// indicates that the kernel or filesystem doesn't support O_TMPFILE.
+func IsTmpfileUnsupported(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	switch err {
+	case unix.EOPNOTSUPP, unix.EISDIR, unix.EINVAL:
+		return true
+	}
+	return false
+}
+
+// LinkTmpfile gives the unnamed file created by OpenTmpfile the given name,
+// which must not already exist. This is done through /proc/self/fd (rather
+// than AT_EMPTY_PATH) because linkat(2) with AT_EMPTY_PATH requires
+// CAP_DAC_READ_SEARCH.
+func LinkTmpfile(file *os.File, path string) error {
+	procPath := fmt.Sprintf("/proc/self/fd/%d", file.Fd())
+	if err := unix.Linkat(unix.AT_FDCWD, procPath, unix.AT_FDCWD, path, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return &os.LinkError{Op: "link_tmpfile", Old: procPath, New: path, Err: err}
+	}
+	return nil
+}
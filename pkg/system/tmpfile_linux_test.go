@@ -0,0 +1,70 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTmpfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-system.TestTmpfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := OpenTmpfile(dir, 0644)
+	if IsTmpfileUnsupported(err) {
+		t.Skipf("O_TMPFILE not supported: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error opening tmpfile: %s", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write([]byte("some contents")); err != nil {
+		t.Fatalf("unexpected error writing tmpfile: %s", err)
+	}
+
+	// The file must not be visible before it is linked.
+	if names, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Errorf("tmpfile visible before being linked: %v", names)
+	}
+
+	path := filepath.Join(dir, "file")
+	if err := LinkTmpfile(file, path); err != nil {
+		t.Fatalf("unexpected error linking tmpfile: %s", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading linked tmpfile: %s", err)
+	}
+	if string(data) != "some contents" {
+		t.Errorf("linked tmpfile has the wrong contents: %q", data)
+	}
+
+	// Linking over an existing file must fail.
+	if err := LinkTmpfile(file, path); err == nil {
+		t.Errorf("expected error linking tmpfile over existing file")
+	}
+}
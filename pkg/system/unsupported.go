@@ -0,0 +1,162 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The functions in this file are used on hosts other than Linux, which are
+// only supported for inspecting and unpacking images in portable mode (see
+// fseval.PortableFsEval). Operations which need Linux-specific interfaces
+// fail with ENOTSUP, and the Is*Unsupported helpers recognise those errors so
+// that callers fall back to their portable paths. syscall.ENOTSUP is used
+// rather than unix.ENOTSUP, as golang.org/x/sys/unix doesn't support Windows.
+
+// EffectiveCapabilities always returns an error, as capabilities(7) are
+// specific to Linux.
+func EffectiveCapabilities() (CapabilitySet, error) {
+	return 0, errors.Wrap(syscall.ENOTSUP, "effective capabilities")
+}
+
+// Clonefile always returns ENOTSUP, so the contents have to be copied.
+func Clonefile(dst, src uintptr) error {
+	return os.NewSyscallError("ficlone", syscall.ENOTSUP)
+}
+
+// IsCloneUnsupported returns whether the given error (returned by Clonefile)
+// means that the files cannot be reflinked.
+func IsCloneUnsupported(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		return err.Err == syscall.ENOTSUP
+	}
+	return false
+}
+
+// CopyFileRange always returns ENOTSUP, so the contents have to be copied
+// through userspace.
+func CopyFileRange(dst, src uintptr, n int64) (int64, error) {
+	return 0, os.NewSyscallError("copy_file_range", syscall.ENOTSUP)
+}
+
+// IsCopyUnsupported returns whether the given error (returned by
+// CopyFileRange) means that the contents have to be copied some other way.
+func IsCopyUnsupported(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		return err.Err == syscall.ENOTSUP
+	}
+	return false
+}
+
+// Fallocate does nothing, as preallocation is not supported.
+func Fallocate(fd uintptr, size int64) error {
+	return nil
+}
+
+// Mknod always returns ENOTSUP, as Dev_t uses the Linux encoding of device
+// numbers.
+func Mknod(path string, mode os.FileMode, dev Dev_t) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: syscall.ENOTSUP}
+}
+
+// OpenTmpfile always returns ENOTSUP, as O_TMPFILE is specific to Linux.
+func OpenTmpfile(dir string, perm os.FileMode) (*os.File, error) {
+	return nil, &os.PathError{Op: "open_tmpfile", Path: dir, Err: syscall.ENOTSUP}
+}
+
+// IsTmpfileUnsupported returns whether the given error from OpenTmpfile
+// indicates that O_TMPFILE is not supported.
+func IsTmpfileUnsupported(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.ENOTSUP
+}
+
+// LinkTmpfile always returns ENOTSUP, as OpenTmpfile never succeeds.
+func LinkTmpfile(file *os.File, path string) error {
+	return &os.LinkError{Op: "link_tmpfile", Old: file.Name(), New: path, Err: syscall.ENOTSUP}
+}
+
+// Lutimes always returns ENOTSUP, as changing the timestamps of a symlink
+// cannot be done portably.
+func Lutimes(path string, atime, mtime time.Time) error {
+	return &os.PathError{Op: "lutimes", Path: path, Err: syscall.ENOTSUP}
+}
+
+// Llistxattr always returns ENOTSUP.
+func Llistxattr(path string) ([]string, error) {
+	return nil, &os.PathError{Op: "llistxattr", Path: path, Err: syscall.ENOTSUP}
+}
+
+// Lgetxattr always returns ENOTSUP.
+func Lgetxattr(path string, name string) ([]byte, error) {
+	return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: syscall.ENOTSUP}
+}
+
+// Lsetxattr always returns ENOTSUP.
+func Lsetxattr(path string, name string, value []byte, flags int) error {
+	return &os.PathError{Op: "lsetxattr", Path: path, Err: syscall.ENOTSUP}
+}
+
+// Lremovexattr always returns ENOTSUP.
+func Lremovexattr(path string, name string) error {
+	return &os.PathError{Op: "lremovexattr", Path: path, Err: syscall.ENOTSUP}
+}
+
+// Lclearxattrs does nothing, as no xattrs can be set.
+func Lclearxattrs(path string) error {
+	return nil
+}
+
+// EnableVerity always returns ENOTSUP, as fs-verity is specific to Linux.
+func EnableVerity(fd uintptr) error {
+	return os.NewSyscallError("fs_ioc_enable_verity", syscall.ENOTSUP)
+}
+
+// MeasureVerity always returns ENOTSUP, as fs-verity is specific to Linux.
+func MeasureVerity(fd uintptr) (string, error) {
+	return "", os.NewSyscallError("fs_ioc_measure_verity", syscall.ENOTSUP)
+}
+
+// IsVerityUnsupported returns whether the given error (returned by
+// EnableVerity or MeasureVerity) means that fs-verity is not supported.
+func IsVerityUnsupported(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		return err.Err == syscall.ENOTSUP
+	}
+	return false
+}
+
+// IsVerityEnabled always returns false, as fs-verity is never enabled.
+func IsVerityEnabled(err error) bool {
+	return false
+}
+
+// IsVerityNotEnabled always returns false, as MeasureVerity only ever fails
+// with ENOTSUP.
+func IsVerityNotEnabled(err error) bool {
+	return false
+}
@@ -0,0 +1,49 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"syscall"
+)
+
+// The functions in this file replace those which use golang.org/x/sys/unix
+// (which doesn't support Windows) on other hosts. Windows is only supported
+// for inspecting images, so they only need to behave sensibly enough for the
+// commands that don't touch a root filesystem.
+
+// Unlink removes the given file (which must not be a directory).
+func Unlink(path string) error {
+	return syscall.Unlink(path)
+}
+
+// FreeSpace always returns ENOTSUP, so callers must assume that there is
+// enough space.
+func FreeSpace(path string) (int64, error) {
+	return -1, &os.PathError{Op: "statfs", Path: path, Err: syscall.ENOTSUP}
+}
+
+// Umask always returns 0, as Windows has no umask.
+func Umask() os.FileMode {
+	return 0
+}
+
+// SetUmask does nothing and returns 0, as Windows has no umask.
+func SetUmask(mask os.FileMode) os.FileMode {
+	return 0
+}
@@ -1,3 +1,6 @@
+//go:build !windows
+// +build !windows
+
 /*
  * umoci: Umoci Modifies Open Containers' Images
  * Copyright (C) 2016, 2017 SUSE LLC.
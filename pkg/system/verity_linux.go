@@ -0,0 +1,119 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"encoding/hex"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The fs-verity ioctl(2) requests, which aren't defined by golang.org/x/sys/unix.
+const (
+	fsIocEnableVerity  = 0x40806685
+	fsIocMeasureVerity = 0xc0046686
+)
+
+// fsverityHashSHA256 is FS_VERITY_HASH_ALG_SHA256.
+const fsverityHashSHA256 = 1
+
+// fsverityEnableArg is struct fsverity_enable_arg.
+type fsverityEnableArg struct {
+	version       uint32
+	hashAlgorithm uint32
+	blockSize     uint32
+	saltSize      uint32
+	saltPtr       uint64
+	sigSize       uint32
+	reserved1     uint32
+	sigPtr        uint64
+	reserved2     [11]uint64
+}
+
+// EnableVerity enables fs-verity (with SHA-256, a block size of 4096 and no
+// salt) on the regular file with the file descriptor fd, which must have been
+// opened read-only and must not be open for writing anywhere. Once enabled,
+// the contents of the file can never be modified and every read is verified
+// by the kernel. IsVerityUnsupported returns whether an error means that the
+// filesystem doesn't support fs-verity, and IsVerityEnabled returns whether
+// it means fs-verity was already enabled on the file.
+func EnableVerity(fd uintptr) error {
+	arg := fsverityEnableArg{
+		version:       1,
+		hashAlgorithm: fsverityHashSHA256,
+		blockSize:     4096,
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, fsIocEnableVerity, uintptr(unsafe.Pointer(&arg)))
+	if errno != 0 {
+		return os.NewSyscallError("fs_ioc_enable_verity", errno)
+	}
+	return nil
+}
+
+// MeasureVerity returns the fs-verity digest of the regular file with the
+// file descriptor fd as a hex string, as computed by the kernel. An error
+// satisfying IsVerityNotEnabled is returned if fs-verity isn't enabled on the
+// file.
+func MeasureVerity(fd uintptr) (string, error) {
+	// struct fsverity_digest, with enough space for any digest.
+	var buf [4 + 64]byte
+	*(*uint16)(unsafe.Pointer(&buf[2])) = uint16(len(buf) - 4)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, fsIocMeasureVerity, uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return "", os.NewSyscallError("fs_ioc_measure_verity", errno)
+	}
+	algorithm := *(*uint16)(unsafe.Pointer(&buf[0]))
+	size := *(*uint16)(unsafe.Pointer(&buf[2]))
+	if algorithm != fsverityHashSHA256 || int(size) > len(buf)-4 {
+		return "", os.NewSyscallError("fs_ioc_measure_verity", unix.EOPNOTSUPP)
+	}
+	return hex.EncodeToString(buf[4 : 4+size]), nil
+}
+
+// IsVerityUnsupported returns whether the given error (returned by
+// EnableVerity or MeasureVerity) means that the filesystem doesn't support
+// fs-verity (or that it hasn't been enabled for the filesystem).
+func IsVerityUnsupported(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		switch err.Err {
+		case unix.EOPNOTSUPP, unix.ENOTTY, unix.ENOSYS:
+			return true
+		}
+	}
+	return false
+}
+
+// IsVerityEnabled returns whether the given error (returned by EnableVerity)
+// means that fs-verity was already enabled on the file.
+func IsVerityEnabled(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		return err.Err == unix.EEXIST
+	}
+	return false
+}
+
+// IsVerityNotEnabled returns whether the given error (returned by
+// MeasureVerity) means that fs-verity isn't enabled on the file.
+func IsVerityNotEnabled(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		return err.Err == unix.ENODATA
+	}
+	return false
+}
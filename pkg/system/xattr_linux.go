@@ -96,6 +96,16 @@ func Lgetxattr(path string, name string) ([]byte, error) {
 	return buffer, nil
 }
 
+// Lsetxattr is a wrapper around lsetxattr(2).
+func Lsetxattr(path string, name string, value []byte, flags int) error {
+	return unix.Lsetxattr(path, name, value, flags)
+}
+
+// Lremovexattr is a wrapper around lremovexattr(2).
+func Lremovexattr(path string, name string) error {
+	return unix.Lremovexattr(path, name)
+}
+
 // Lclearxattrs is a wrapper around Llistxattr and Lremovexattr, which attempts
 // to remove all xattrs from a given file.
 func Lclearxattrs(path string) error {
@@ -104,7 +114,7 @@ func Lclearxattrs(path string) error {
 		return errors.Wrap(err, "lclearxattrs: get list")
 	}
 	for _, name := range names {
-		if err := unix.Lremovexattr(path, name); err != nil {
+		if err := Lremovexattr(path, name); err != nil {
 			// Ignore permission errors, because hitting a permission error
 			// means that it's a security.* xattr label or something similar.
 			if os.IsPermission(errors.Cause(err)) {
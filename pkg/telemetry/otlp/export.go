@@ -0,0 +1,444 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlp
+
+import (
+	"bytes"
+	// The OpenTelemetry SDK interfaces use the standard library context.
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// exportTimeout is the longest a single export request may take.
+const exportTimeout = 10 * time.Second
+
+// client sends OTLP/HTTP export requests (encoded as JSON) to a collector.
+type client struct {
+	url  string
+	http *http.Client
+}
+
+// newClient returns a client for the given signal path (such as "v1/traces")
+// relative to the base endpoint.
+func newClient(base *url.URL, signal string) *client {
+	u := *base
+	u.Path = path.Join("/", u.Path, signal)
+	return &client{
+		url:  u.String(),
+		http: &http.Client{Timeout: exportTimeout},
+	}
+}
+
+// send POSTs the JSON encoding of the given request to the collector.
+func (c *client) send(ctx context.Context, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, "encode export request")
+	}
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "create export request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "send export request")
+	}
+	defer resp.Body.Close()
+	// Make sure the connection can be re-used.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("export to %s failed: %s", c.url, resp.Status)
+	}
+	return nil
+}
+
+// spanExporter is a sdktrace.SpanExporter which sends spans to a collector.
+type spanExporter struct {
+	client *client
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *spanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	return e.client.send(ctx, encodeSpans(spans))
+}
+
+// Shutdown implements sdktrace.SpanExporter.
+func (e *spanExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// metricExporter is a sdkmetric.Exporter which sends counters to a
+// collector.
+type metricExporter struct {
+	client *client
+}
+
+// Temporality implements sdkmetric.Exporter.
+func (e *metricExporter) Temporality(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+	return sdkmetric.DefaultTemporalitySelector(kind)
+}
+
+// Aggregation implements sdkmetric.Exporter.
+func (e *metricExporter) Aggregation(kind sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(kind)
+}
+
+// Export implements sdkmetric.Exporter.
+func (e *metricExporter) Export(ctx context.Context, metrics *metricdata.ResourceMetrics) error {
+	request := encodeMetrics(metrics)
+	if len(request.ResourceMetrics) == 0 {
+		return nil
+	}
+	return e.client.send(ctx, request)
+}
+
+// ForceFlush implements sdkmetric.Exporter.
+func (e *metricExporter) ForceFlush(ctx context.Context) error {
+	return nil
+}
+
+// Shutdown implements sdkmetric.Exporter.
+func (e *metricExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// The types below are the JSON encoding of the OTLP protobuf messages (see
+// opentelemetry-proto). Note that 64-bit integers are encoded as strings, and
+// trace and span ids are hex-encoded.
+
+type exportTraceRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   otlpResource `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type scopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type exportMetricsRequest struct {
+	ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     otlpResource   `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type scopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Unit        string  `json:"unit,omitempty"`
+	Sum         otlpSum `json:"sum"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             string          `json:"asInt,omitempty"`
+	AsDouble          *float64        `json:"asDouble,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpValue `json:"values"`
+}
+
+// OTLP enum values which differ from the OpenTelemetry API.
+const (
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+// unixNano returns the OTLP encoding of a timestamp.
+func unixNano(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// encodeValue returns the OTLP encoding of an attribute value.
+func encodeValue(value attribute.Value) otlpValue {
+	var v otlpValue
+	switch value.Type() {
+	case attribute.BOOL:
+		b := value.AsBool()
+		v.BoolValue = &b
+	case attribute.INT64:
+		i := strconv.FormatInt(value.AsInt64(), 10)
+		v.IntValue = &i
+	case attribute.FLOAT64:
+		f := value.AsFloat64()
+		v.DoubleValue = &f
+	case attribute.BOOLSLICE:
+		v.ArrayValue = &otlpArrayValue{}
+		for _, b := range value.AsBoolSlice() {
+			v.ArrayValue.Values = append(v.ArrayValue.Values, encodeValue(attribute.BoolValue(b)))
+		}
+	case attribute.INT64SLICE:
+		v.ArrayValue = &otlpArrayValue{}
+		for _, i := range value.AsInt64Slice() {
+			v.ArrayValue.Values = append(v.ArrayValue.Values, encodeValue(attribute.Int64Value(i)))
+		}
+	case attribute.FLOAT64SLICE:
+		v.ArrayValue = &otlpArrayValue{}
+		for _, f := range value.AsFloat64Slice() {
+			v.ArrayValue.Values = append(v.ArrayValue.Values, encodeValue(attribute.Float64Value(f)))
+		}
+	case attribute.STRINGSLICE:
+		v.ArrayValue = &otlpArrayValue{}
+		for _, s := range value.AsStringSlice() {
+			v.ArrayValue.Values = append(v.ArrayValue.Values, encodeValue(attribute.StringValue(s)))
+		}
+	default:
+		s := value.Emit()
+		v.StringValue = &s
+	}
+	return v
+}
+
+// encodeAttributes returns the OTLP encoding of a list of attributes.
+func encodeAttributes(kvs []attribute.KeyValue) []otlpAttribute {
+	var attrs []otlpAttribute
+	for _, kv := range kvs {
+		attrs = append(attrs, otlpAttribute{Key: string(kv.Key), Value: encodeValue(kv.Value)})
+	}
+	return attrs
+}
+
+// encodeResource returns the OTLP encoding of a resource.
+func encodeResource(res *resource.Resource) otlpResource {
+	if res == nil {
+		return otlpResource{}
+	}
+	return otlpResource{Attributes: encodeAttributes(res.Attributes())}
+}
+
+// encodeScope returns the OTLP encoding of an instrumentation scope.
+func encodeScope(scope instrumentation.Scope) otlpScope {
+	return otlpScope{Name: scope.Name, Version: scope.Version}
+}
+
+// encodeSpans returns the OTLP export request for the given spans, which are
+// grouped by their resource and instrumentation scope.
+func encodeSpans(spans []sdktrace.ReadOnlySpan) exportTraceRequest {
+	var request exportTraceRequest
+	resourceIdx := map[*resource.Resource]int{}
+	scopeIdx := map[*resource.Resource]map[instrumentation.Scope]int{}
+	for _, span := range spans {
+		res := span.Resource()
+		ri, ok := resourceIdx[res]
+		if !ok {
+			ri = len(request.ResourceSpans)
+			resourceIdx[res] = ri
+			scopeIdx[res] = map[instrumentation.Scope]int{}
+			request.ResourceSpans = append(request.ResourceSpans, resourceSpans{Resource: encodeResource(res)})
+		}
+		scope := span.InstrumentationScope()
+		si, ok := scopeIdx[res][scope]
+		if !ok {
+			si = len(request.ResourceSpans[ri].ScopeSpans)
+			scopeIdx[res][scope] = si
+			request.ResourceSpans[ri].ScopeSpans = append(request.ResourceSpans[ri].ScopeSpans, scopeSpans{Scope: encodeScope(scope)})
+		}
+
+		sc := span.SpanContext()
+		encoded := otlpSpan{
+			TraceID:           sc.TraceID().String(),
+			SpanID:            sc.SpanID().String(),
+			Name:              span.Name(),
+			Kind:              int(span.SpanKind()),
+			StartTimeUnixNano: unixNano(span.StartTime()),
+			EndTimeUnixNano:   unixNano(span.EndTime()),
+			Attributes:        encodeAttributes(span.Attributes()),
+		}
+		if parent := span.Parent(); parent.IsValid() {
+			encoded.ParentSpanID = parent.SpanID().String()
+		}
+		for _, event := range span.Events() {
+			encoded.Events = append(encoded.Events, otlpEvent{
+				TimeUnixNano: unixNano(event.Time),
+				Name:         event.Name,
+				Attributes:   encodeAttributes(event.Attributes),
+			})
+		}
+		switch status := span.Status(); status.Code {
+		case codes.Ok:
+			encoded.Status.Code = otlpStatusOk
+		case codes.Error:
+			encoded.Status.Code = otlpStatusError
+			encoded.Status.Message = status.Description
+		}
+
+		ss := &request.ResourceSpans[ri].ScopeSpans[si]
+		ss.Spans = append(ss.Spans, encoded)
+	}
+	return request
+}
+
+// encodeSum returns the OTLP encoding of a sum (the aggregation used for
+// counters). Other aggregations are not used by umoci.
+func encodeSum(metric metricdata.Metrics) (otlpMetric, bool) {
+	encoded := otlpMetric{
+		Name:        metric.Name,
+		Description: metric.Description,
+		Unit:        metric.Unit,
+	}
+	temporality := otlpTemporalityCumulative
+	switch data := metric.Data.(type) {
+	case metricdata.Sum[int64]:
+		if data.Temporality == metricdata.DeltaTemporality {
+			temporality = otlpTemporalityDelta
+		}
+		encoded.Sum.IsMonotonic = data.IsMonotonic
+		for _, dp := range data.DataPoints {
+			encoded.Sum.DataPoints = append(encoded.Sum.DataPoints, otlpDataPoint{
+				Attributes:        encodeAttributes(dp.Attributes.ToSlice()),
+				StartTimeUnixNano: unixNano(dp.StartTime),
+				TimeUnixNano:      unixNano(dp.Time),
+				AsInt:             strconv.FormatInt(dp.Value, 10),
+			})
+		}
+	case metricdata.Sum[float64]:
+		if data.Temporality == metricdata.DeltaTemporality {
+			temporality = otlpTemporalityDelta
+		}
+		encoded.Sum.IsMonotonic = data.IsMonotonic
+		for _, dp := range data.DataPoints {
+			value := dp.Value
+			encoded.Sum.DataPoints = append(encoded.Sum.DataPoints, otlpDataPoint{
+				Attributes:        encodeAttributes(dp.Attributes.ToSlice()),
+				StartTimeUnixNano: unixNano(dp.StartTime),
+				TimeUnixNano:      unixNano(dp.Time),
+				AsDouble:          &value,
+			})
+		}
+	default:
+		return otlpMetric{}, false
+	}
+	encoded.Sum.AggregationTemporality = temporality
+	return encoded, true
+}
+
+// encodeMetrics returns the OTLP export request for the given metrics.
+func encodeMetrics(metrics *metricdata.ResourceMetrics) exportMetricsRequest {
+	var request exportMetricsRequest
+	rm := resourceMetrics{Resource: encodeResource(metrics.Resource)}
+	for _, sm := range metrics.ScopeMetrics {
+		encoded := scopeMetrics{Scope: encodeScope(sm.Scope)}
+		for _, metric := range sm.Metrics {
+			if m, ok := encodeSum(metric); ok {
+				encoded.Metrics = append(encoded.Metrics, m)
+			}
+		}
+		if len(encoded.Metrics) > 0 {
+			rm.ScopeMetrics = append(rm.ScopeMetrics, encoded)
+		}
+	}
+	if len(rm.ScopeMetrics) > 0 {
+		request.ResourceMetrics = append(request.ResourceMetrics, rm)
+	}
+	return request
+}
@@ -0,0 +1,182 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package otlp provides a telemetry.Recorder which records umoci's spans and
+// counters with the OpenTelemetry SDK, and exports them to a collector using
+// the OTLP/HTTP protocol (with JSON encoding).
+package otlp
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// instrumentationName is the name of the instrumentation scope of the spans
+// and counters recorded by umoci.
+const instrumentationName = "github.com/openSUSE/umoci"
+
+// Options are optional settings for NewRecorder.
+type Options struct {
+	// ServiceVersion is the version of umoci, recorded as the
+	// service.version of the exported telemetry.
+	ServiceVersion string
+
+	// OnError is called with any errors encountered while exporting
+	// telemetry in the background. Note that this replaces the global
+	// OpenTelemetry error handler. If nil, the global handler is unchanged.
+	OnError func(error)
+}
+
+// Recorder is a telemetry.Recorder which exports spans and counters to an
+// OTLP/HTTP collector. It must be shut down with Shutdown once it is no longer
+// used, so that any buffered telemetry is exported.
+type Recorder struct {
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	tracer         trace.Tracer
+	meter          metric.Meter
+
+	lock     sync.Mutex
+	root     context.Context
+	counters map[string]metric.Int64Counter
+}
+
+// NewRecorder returns a Recorder which exports to the OTLP/HTTP collector at
+// the given endpoint (such as "http://localhost:4318"). Spans are sent to
+// <endpoint>/v1/traces and counters to <endpoint>/v1/metrics.
+func NewRecorder(endpoint string, opts Options) (*Recorder, error) {
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse endpoint")
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.Errorf("unsupported endpoint scheme %q: must be http or https", base.Scheme)
+	}
+	if base.Host == "" {
+		return nil, errors.Errorf("endpoint %q has no host", endpoint)
+	}
+
+	if opts.OnError != nil {
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(opts.OnError))
+	}
+
+	attrs := []attribute.KeyValue{attribute.String("service.name", "umoci")}
+	if opts.ServiceVersion != "" {
+		attrs = append(attrs, attribute.String("service.version", opts.ServiceVersion))
+	}
+	res := resource.NewSchemaless(attrs...)
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithBatcher(&spanExporter{client: newClient(base, "v1/traces")}),
+	)
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(&metricExporter{client: newClient(base, "v1/metrics")})),
+	)
+	return &Recorder{
+		tracerProvider: tracerProvider,
+		meterProvider:  meterProvider,
+		tracer:         tracerProvider.Tracer(instrumentationName),
+		meter:          meterProvider.Meter(instrumentationName),
+		root:           context.Background(),
+		counters:       map[string]metric.Int64Counter{},
+	}, nil
+}
+
+// StartRoot starts a span which is used as the parent of every span started
+// with a context that doesn't already contain a span, so that all of the
+// operations of (for instance) a single umoci command are part of the same
+// trace. The returned function must be called once the root operation has
+// completed.
+func (r *Recorder) StartRoot(name string, attrs map[string]string) func(err error) {
+	ctx, end := r.StartSpan(context.Background(), name, attrs)
+	r.lock.Lock()
+	r.root = ctx
+	r.lock.Unlock()
+	return func(err error) {
+		r.lock.Lock()
+		r.root = context.Background()
+		r.lock.Unlock()
+		end(err, 0)
+	}
+}
+
+// StartSpan implements telemetry.Recorder.
+func (r *Recorder) StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, func(err error, duration time.Duration)) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		r.lock.Lock()
+		root := r.root
+		r.lock.Unlock()
+		if span := trace.SpanFromContext(root); span.SpanContext().IsValid() {
+			ctx = trace.ContextWithSpan(ctx, span)
+		}
+	}
+
+	var kvs []attribute.KeyValue
+	for key, value := range attrs {
+		kvs = append(kvs, attribute.String(key, value))
+	}
+	ctx, span := r.tracer.Start(ctx, name, trace.WithAttributes(kvs...))
+	return ctx, func(err error, duration time.Duration) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// AddCounter implements telemetry.Recorder.
+func (r *Recorder) AddCounter(name string, delta int64) {
+	r.lock.Lock()
+	counter, ok := r.counters[name]
+	if !ok {
+		var err error
+		counter, err = r.meter.Int64Counter(name)
+		if err != nil {
+			r.lock.Unlock()
+			otel.Handle(errors.Wrapf(err, "create counter %s", name))
+			return
+		}
+		r.counters[name] = counter
+	}
+	r.lock.Unlock()
+	counter.Add(context.Background(), delta)
+}
+
+// Shutdown exports any buffered spans and counters, and stops the Recorder.
+// The Recorder must not be used after it has been shut down.
+func (r *Recorder) Shutdown(ctx context.Context) error {
+	err := errors.Wrap(r.tracerProvider.Shutdown(ctx), "shutdown tracer")
+	if err2 := r.meterProvider.Shutdown(ctx); err == nil {
+		err = errors.Wrap(err2, "shutdown meter")
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otlp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// collector is a fake OTLP/HTTP collector which records the requests it
+// receives.
+type collector struct {
+	lock    sync.Mutex
+	traces  []exportTraceRequest
+	metrics []exportMetricsRequest
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var err error
+	switch r.URL.Path {
+	case "/otlp/v1/traces":
+		var request exportTraceRequest
+		err = json.NewDecoder(r.Body).Decode(&request)
+		c.traces = append(c.traces, request)
+	case "/otlp/v1/metrics":
+		var request exportMetricsRequest
+		err = json.NewDecoder(r.Body).Decode(&request)
+		c.metrics = append(c.metrics, request)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	recorder, err := NewRecorder(server.URL+"/otlp", Options{ServiceVersion: "1.2.3"})
+	if err != nil {
+		t.Fatalf("unexpected error creating recorder: %+v", err)
+	}
+
+	endRoot := recorder.StartRoot("umoci test", nil)
+	// Spans without a parent in their context are part of the root span.
+	ctx, end := recorder.StartSpan(context.Background(), "parent", map[string]string{"key": "value"})
+	_, endChild := recorder.StartSpan(ctx, "child", nil)
+	endChild(fmt.Errorf("some error"), 0)
+	end(nil, 0)
+	endRoot(nil)
+	recorder.AddCounter("test.counter", 2)
+	recorder.AddCounter("test.counter", 3)
+
+	if err := recorder.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error shutting down recorder: %+v", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	spans := map[string]otlpSpan{}
+	for _, request := range c.traces {
+		for _, rs := range request.ResourceSpans {
+			if len(rs.Resource.Attributes) != 2 || *rs.Resource.Attributes[1].Value.StringValue != "1.2.3" {
+				t.Errorf("unexpected resource attributes: %+v", rs.Resource.Attributes)
+			}
+			for _, ss := range rs.ScopeSpans {
+				if ss.Scope.Name != instrumentationName {
+					t.Errorf("unexpected scope: %+v", ss.Scope)
+				}
+				for _, span := range ss.Spans {
+					spans[span.Name] = span
+				}
+			}
+		}
+	}
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans to be exported, got %+v", spans)
+	}
+	root, parent, child := spans["umoci test"], spans["parent"], spans["child"]
+	if root.ParentSpanID != "" || parent.ParentSpanID != root.SpanID || child.ParentSpanID != parent.SpanID {
+		t.Errorf("spans have the wrong parents: root=%+v parent=%+v child=%+v", root, parent, child)
+	}
+	if root.TraceID != parent.TraceID || parent.TraceID != child.TraceID {
+		t.Errorf("spans are not part of the same trace")
+	}
+	if len(parent.Attributes) != 1 || parent.Attributes[0].Key != "key" || *parent.Attributes[0].Value.StringValue != "value" {
+		t.Errorf("unexpected attributes: %+v", parent.Attributes)
+	}
+	if child.Status.Code != otlpStatusError || child.Status.Message != "some error" || parent.Status.Code != 0 {
+		t.Errorf("unexpected status: parent=%+v child=%+v", parent.Status, child.Status)
+	}
+
+	var counter string
+	for _, request := range c.metrics {
+		for _, rm := range request.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, metric := range sm.Metrics {
+					if metric.Name == "test.counter" && len(metric.Sum.DataPoints) == 1 {
+						counter = metric.Sum.DataPoints[0].AsInt
+					}
+				}
+			}
+		}
+	}
+	if counter != "5" {
+		t.Errorf("expected counter to be exported with value 5, got %q", counter)
+	}
+}
+
+func TestNewRecorderInvalid(t *testing.T) {
+	for _, endpoint := range []string{
+		"",
+		"localhost:4318",
+		"file:///tmp/traces",
+		"http://",
+	} {
+		if _, err := NewRecorder(endpoint, Options{}); err == nil {
+			t.Errorf("expected an error for endpoint %q", endpoint)
+		}
+	}
+}
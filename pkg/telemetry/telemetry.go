@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package telemetry provides hooks that allow library users to observe the
+// operations umoci performs (such as unpacking and repacking layers, and
+// operations on the blobs of an image). By default no telemetry is recorded.
+// Users wishing to export traces and counters to a tracing system can do so by
+// implementing Recorder and registering it with SetRecorder. The otlp
+// subpackage provides a Recorder which exports OpenTelemetry spans and
+// counters to a collector.
+package telemetry
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Recorder is the interface implemented by telemetry backends. All methods
+// must be safe for concurrent use.
+type Recorder interface {
+	// StartSpan is called when an operation with the given name starts. The
+	// context is that of the caller, and may contain the span of an enclosing
+	// operation (as returned by an earlier StartSpan). The attributes
+	// describe the operation and must not be modified. The returned context
+	// is used for any operations started as part of this one, and the
+	// returned function is called exactly once, when the operation has
+	// completed, with the error the operation failed with (or nil) and how
+	// long the operation took.
+	StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, func(err error, duration time.Duration))
+
+	// AddCounter adds delta to the counter with the given name.
+	AddCounter(name string, delta int64)
+}
+
+// Names of the counters recorded by umoci.
+const (
+	// CounterFilesExtracted is the number of tar entries extracted.
+	CounterFilesExtracted = "layer.files_extracted"
+
+	// CounterBytesExtracted is the number of bytes of file contents
+	// extracted.
+	CounterBytesExtracted = "layer.bytes_extracted"
+
+	// CounterFilesGenerated is the number of tar entries generated when
+	// creating a new layer.
+	CounterFilesGenerated = "layer.files_generated"
+
+	// CounterBytesUncompressed is the number of uncompressed layer bytes
+	// added to an image.
+	CounterBytesUncompressed = "mutate.bytes_uncompressed"
+
+	// CounterBytesCompressed is the number of compressed layer bytes added to
+	// an image.
+	CounterBytesCompressed = "mutate.bytes_compressed"
+
+	// CounterBlobsWritten is the number of blobs written to an image.
+	CounterBlobsWritten = "cas.blobs_written"
+
+	// CounterBytesWritten is the number of bytes of blobs written to an
+	// image.
+	CounterBytesWritten = "cas.bytes_written"
+)
+
+var (
+	rm       sync.RWMutex
+	recorder Recorder
+)
+
+// SetRecorder registers the Recorder that all future telemetry will be sent
+// to. Passing nil disables telemetry.
+func SetRecorder(r Recorder) {
+	rm.Lock()
+	recorder = r
+	rm.Unlock()
+}
+
+func getRecorder() Recorder {
+	rm.RLock()
+	defer rm.RUnlock()
+	return recorder
+}
+
+// Span is an in-progress operation, returned by StartSpan.
+type Span struct {
+	start time.Time
+	end   func(err error, duration time.Duration)
+}
+
+// StartSpan starts a new span with the given name and attributes, as part of
+// the operation (if any) in ctx. The returned context should be passed to any
+// operations started as part of this one. The caller must call End once the
+// operation has completed. If no Recorder is registered this is a no-op.
+func StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, *Span) {
+	r := getRecorder()
+	if r == nil {
+		return ctx, &Span{}
+	}
+	start := time.Now()
+	ctx, end := r.StartSpan(ctx, name, attrs)
+	return ctx, &Span{
+		start: start,
+		end:   end,
+	}
+}
+
+// End completes the span, recording whether the operation failed. Only the
+// first call to End has any effect.
+func (s *Span) End(err error) {
+	if s.end == nil {
+		return
+	}
+	s.end(err, time.Since(s.start))
+	s.end = nil
+}
+
+// AddCounter adds delta to the counter with the given name. If no Recorder is
+// registered this is a no-op.
+func AddCounter(name string, delta int64) {
+	if r := getRecorder(); r != nil {
+		r.AddCounter(name, delta)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type testRecorder struct {
+	lock     sync.Mutex
+	spans    []string
+	parents  []string
+	errors   []error
+	counters map[string]int64
+}
+
+type testSpanKey struct{}
+
+func (r *testRecorder) StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, func(error, time.Duration)) {
+	parent, _ := ctx.Value(testSpanKey{}).(string)
+	return context.WithValue(ctx, testSpanKey{}, name), func(err error, duration time.Duration) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.spans = append(r.spans, name)
+		r.parents = append(r.parents, parent)
+		r.errors = append(r.errors, err)
+	}
+}
+
+func (r *testRecorder) AddCounter(name string, delta int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.counters[name] += delta
+}
+
+func TestRecorder(t *testing.T) {
+	// Without a recorder everything is a no-op.
+	ctx := context.Background()
+	if noopCtx, span := StartSpan(ctx, "noop", nil); noopCtx != ctx {
+		t.Errorf("StartSpan without a recorder modified the context")
+	} else {
+		span.End(nil)
+	}
+	AddCounter("noop", 1)
+
+	recorder := &testRecorder{counters: map[string]int64{}}
+	SetRecorder(recorder)
+	defer SetRecorder(nil)
+
+	spanErr := fmt.Errorf("some error")
+	spanCtx, span := StartSpan(ctx, "test", map[string]string{"key": "value"})
+	_, child := StartSpan(spanCtx, "child", nil)
+	child.End(nil)
+	span.End(spanErr)
+	span.End(nil)
+	AddCounter("counter", 2)
+	AddCounter("counter", 3)
+
+	if len(recorder.spans) != 2 || recorder.spans[1] != "test" || recorder.errors[1] != spanErr {
+		t.Errorf("expected exactly one span with an error, got: %v %v", recorder.spans, recorder.errors)
+	}
+	if recorder.spans[0] != "child" || recorder.parents[0] != "test" || recorder.parents[1] != "" {
+		t.Errorf("expected child span to be part of test span, got: %v %v", recorder.spans, recorder.parents)
+	}
+	if got := recorder.counters["counter"]; got != 5 {
+		t.Errorf("expected counter to be 5, got %d", got)
+	}
+	if _, ok := recorder.counters["noop"]; ok {
+		t.Errorf("counter recorded before recorder was registered")
+	}
+}
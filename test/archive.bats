@@ -0,0 +1,105 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci archive" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	tags="$output"
+
+	for format in tar zip; do
+		ARCHIVE="$ARCHIVE_DIR/image.$format"
+
+		umoci archive --layout "${IMAGE}" "$ARCHIVE"
+		[ "$status" -eq 0 ]
+		[ -f "$ARCHIVE" ]
+
+		# The archive contains every tag of the image.
+		umoci ls --layout "$ARCHIVE"
+		[ "$status" -eq 0 ]
+		[ "$output" = "$tags" ]
+
+		# Archives can be unpacked directly.
+		rm -rf "$BUNDLE"
+		umoci unpack --image "$ARCHIVE:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+
+		# But they cannot be modified.
+		umoci tag --image "$ARCHIVE:${TAG}" "${TAG}-new"
+		[ "$status" -ne 0 ]
+		[[ "$output" == *"read-only"* ]]
+	done
+
+	# The format can be overridden.
+	umoci archive --layout "${IMAGE}" --format zip "$ARCHIVE_DIR/image"
+	[ "$status" -eq 0 ]
+	[ "$(head -c2 "$ARCHIVE_DIR/image")" = "PK" ]
+
+	umoci archive --layout "${IMAGE}" --format rar "$ARCHIVE_DIR/image.rar"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unarchive" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+	NEW_IMAGE="$(setup_tmpdir)/image"
+
+	image-verify "${IMAGE}"
+
+	umoci archive --layout "${IMAGE}" "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+
+	umoci unarchive --layout "$NEW_IMAGE" "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+	image-verify "$NEW_IMAGE"
+
+	# The new image is identical to the original.
+	diff -r "${IMAGE}/blobs" "$NEW_IMAGE/blobs"
+	diff <(jq -S . "${IMAGE}/index.json") <(jq -S . "$NEW_IMAGE/index.json")
+
+	# And it can be modified.
+	umoci tag --image "$NEW_IMAGE:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	# The image must not already exist.
+	umoci unarchive --layout "$NEW_IMAGE" "$ARCHIVE_DIR/image.tar"
+	[ "$status" -ne 0 ]
+
+	# Compressed archives are rejected.
+	gzip -k "$ARCHIVE_DIR/image.tar"
+	umoci unarchive --layout "$NEW_IMAGE-gz" "$ARCHIVE_DIR/image.tar.gz"
+	[ "$status" -ne 0 ]
+	[ ! -e "$NEW_IMAGE-gz" ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,110 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci artifact put+extract" {
+	image-verify "${IMAGE}"
+
+	FILES="$(setup_tmpdir)"
+	echo "chart contents" > "$FILES/chart.tgz"
+	echo '{"name": "chart"}' > "$FILES/config.json"
+	echo "module contents" > "$FILES/module.wasm"
+
+	# Store one of the blobs separately.
+	umoci artifact push-blob --layout "${IMAGE}" "$FILES/module.wasm"
+	[ "$status" -eq 0 ]
+	blob="${lines[-1]}"
+	[[ "$blob" == "sha256:"* ]]
+
+	# Create the artifact.
+	umoci artifact put --image "${IMAGE}:chart" \
+		--artifact-type "application/vnd.example.chart.config.v1+json" \
+		--config "$FILES/config.json" \
+		--manifest.annotation "org.opencontainers.image.version=1.0.0" \
+		"$FILES/chart.tgz:application/vnd.example.chart.content.v1.tar+gzip" \
+		"$blob"
+	[ "$status" -eq 0 ]
+
+	# The artifact must survive gc and pass validation.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci validate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# Check the manifest.
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "chart") | .digest' "${IMAGE}/index.json" | sed 's|:|/|')"
+	sane_run jq -r '.config.mediaType' "${IMAGE}/blobs/$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.example.chart.config.v1+json" ]]
+	sane_run jq -r '.layers[] | .mediaType' "${IMAGE}/blobs/$manifest"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "application/vnd.example.chart.content.v1.tar+gzip" ]]
+	[[ "${lines[1]}" == "application/octet-stream" ]]
+	sane_run jq -r '.annotations["org.opencontainers.image.version"]' "${IMAGE}/blobs/$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1.0.0" ]]
+
+	# Extract the artifact.
+	DIR="$(setup_tmpdir)"
+	umoci artifact extract --image "${IMAGE}:chart" "$DIR/out"
+	[ "$status" -eq 0 ]
+	cmp "$FILES/chart.tgz" "$DIR/out/chart.tgz"
+	cmp "$FILES/module.wasm" "$DIR/out/${blob#sha256:}"
+
+	# Existing files are not overwritten.
+	umoci artifact extract --image "${IMAGE}:chart" "$DIR/out"
+	[ "$status" -ne 0 ]
+
+	# Artifacts cannot be unpacked.
+	umoci unpack --image "${IMAGE}:chart" "$DIR/bundle"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci artifact put [invalid arguments]" {
+	FILES="$(setup_tmpdir)"
+	echo "contents" > "$FILES/file"
+
+	# --artifact-type is mandatory.
+	umoci artifact put --image "${IMAGE}:artifact" "$FILES/file"
+	[ "$status" -ne 0 ]
+
+	# Image media types cannot be artifact types.
+	umoci artifact put --image "${IMAGE}:artifact" --artifact-type "application/vnd.oci.image.config.v1+json" "$FILES/file"
+	[ "$status" -ne 0 ]
+	umoci artifact put --image "${IMAGE}:artifact" --artifact-type "not a media type" "$FILES/file"
+	[ "$status" -ne 0 ]
+
+	# Missing files and blobs.
+	umoci artifact put --image "${IMAGE}:artifact" --artifact-type "application/vnd.example+json" "$FILES/missing"
+	[ "$status" -ne 0 ]
+	umoci artifact put --image "${IMAGE}:artifact" --artifact-type "application/vnd.example+json" "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	[ "$status" -ne 0 ]
+
+	umoci stat --image "${IMAGE}:artifact"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,47 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function teardown() {
+	teardown_tmpdirs
+}
+
+@test "umoci bench" {
+	TMPDIR="$(setup_tmpdir)"
+
+	umoci bench --tmpdir "$TMPDIR" --scale 0.01
+	[ "$status" -eq 0 ]
+	for workload in small-files large-files deep-tree; do
+		for phase in unpack repack gc; do
+			echo "$output" | grep -E "^$workload +.* $phase "
+		done
+	done
+
+	# The images are removed afterwards.
+	[ -z "$(ls -A "$TMPDIR")" ]
+
+	# Only the given workloads are run.
+	umoci bench --tmpdir "$TMPDIR" --scale 0.01 --workload deep-tree
+	[ "$status" -eq 0 ]
+	! echo "$output" | grep small-files
+	echo "$output" | grep deep-tree
+
+	umoci bench --workload nonexistent
+	[ "$status" -ne 0 ]
+	umoci bench --scale 0
+	[ "$status" -ne 0 ]
+}
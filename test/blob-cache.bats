@@ -0,0 +1,73 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	unset UMOCI_BLOB_CACHE_DIR
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci --blob-cache" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+	CACHE="$(setup_tmpdir)/cache"
+
+	# A copy of the image without the blobs added below.
+	NEWIMAGE="$(setup_tmpdir)/image"
+	cp -r "${IMAGE}" "$NEWIMAGE"
+
+	# Blobs added to an image are added to the cache.
+	echo "cached file" >"$SOURCE/file"
+	export UMOCI_BLOB_CACHE_DIR="$CACHE"
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-cached" --file "$SOURCE/file:/cached"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	image-verify "$CACHE"
+	[[ "$(find "$CACHE/blobs" -type f | wc -l)" -ge 3 ]]
+	unset UMOCI_BLOB_CACHE_DIR
+
+	# Without the cache, the new blobs are missing.
+	cp "${IMAGE}/index.json" "$NEWIMAGE/index.json"
+	umoci unpack --image "${NEWIMAGE}:${TAG}-cached" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+	rm -rf "$BUNDLE/bundle"
+
+	# With the cache, the missing blobs are copied from the cache.
+	export UMOCI_BLOB_CACHE_DIR="$CACHE"
+	umoci unpack --image "${NEWIMAGE}:${TAG}-cached" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+	[[ "$(cat "$BUNDLE/bundle/rootfs/cached")" == "cached file" ]]
+	unset UMOCI_BLOB_CACHE_DIR
+	image-verify "$NEWIMAGE"
+
+	# Corrupted cache entries are never used.
+	rm -rf "$BUNDLE/bundle"
+	manifest="$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-cached"'") | .digest' "${IMAGE}/index.json")"
+	rm "$NEWIMAGE/blobs/sha256/${manifest#sha256:}"
+	chmod u+w "$CACHE/blobs/sha256/${manifest#sha256:}"
+	echo "corrupted" >"$CACHE/blobs/sha256/${manifest#sha256:}"
+	export UMOCI_BLOB_CACHE_DIR="$CACHE"
+	umoci unpack --image "${NEWIMAGE}:${TAG}-cached" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+	[ ! -e "$NEWIMAGE/blobs/sha256/${manifest#sha256:}" ]
+}
@@ -0,0 +1,192 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci build [missing args]" {
+	CONTEXT="$(setup_tmpdir)"
+
+	umoci build
+	[ "$status" -ne 0 ]
+
+	# No build file.
+	umoci build --image "${IMAGE}:${TAG}-new" "$CONTEXT"
+	[ "$status" -ne 0 ]
+
+	echo "FROM ${TAG}" >"$CONTEXT/Umocifile"
+	umoci build --image "${IMAGE}:${TAG}-new" "$CONTEXT" too-many
+	[ "$status" -ne 0 ]
+
+	# Invalid build files.
+	echo "FROM ${TAG}-nonexistent" >"$CONTEXT/Umocifile"
+	umoci build --image "${IMAGE}:${TAG}-new" "$CONTEXT"
+	[ "$status" -ne 0 ]
+
+	echo "COPY a /b" >"$CONTEXT/Umocifile"
+	umoci build --image "${IMAGE}:${TAG}-new" "$CONTEXT"
+	[ "$status" -ne 0 ]
+
+	printf 'FROM %s\nADD a /b\n' "$TAG" >"$CONTEXT/Umocifile"
+	umoci build --image "${IMAGE}:${TAG}-new" "$CONTEXT"
+	[ "$status" -ne 0 ]
+
+	# Sources cannot be outside of the context.
+	printf 'FROM %s\nCOPY ../a /b\n' "$TAG" >"$CONTEXT/Umocifile"
+	umoci build --image "${IMAGE}:${TAG}-new" "$CONTEXT"
+	[ "$status" -ne 0 ]
+
+	# The tag must not have been created.
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-new"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci build [scratch]" {
+	CONTEXT="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	echo "hello world" >"$CONTEXT/hello"
+	chmod 0750 "$CONTEXT/hello"
+	mkdir -p "$CONTEXT/dir/sub"
+	echo "nested" >"$CONTEXT/dir/sub/file"
+	ln -s ../hello "$CONTEXT/dir/link"
+	cat >"$CONTEXT/build-file" <<-EOF
+	# Build from an empty image.
+	FROM scratch
+	COPY hello /usr/bin/
+	COPY dir /opt/dir
+	ENV GREETING=hello \\
+	    NAME=world
+	LABEL org.opensuse.umoci.test=build
+	WORKDIR /work
+	USER 1000:100
+	ENTRYPOINT ["/usr/bin/hello"]
+	CMD ["--flag"]
+	EOF
+
+	umoci build --image "${IMAGE}:${TAG}-built" --file "$CONTEXT/build-file" "$CONTEXT"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-built" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The files must have been copied.
+	[[ "$(cat "$BUNDLE/rootfs/usr/bin/hello")" == "hello world" ]]
+	[[ "$(stat -c '%a' "$BUNDLE/rootfs/usr/bin/hello")" == "750" ]]
+	[[ "$(cat "$BUNDLE/rootfs/opt/dir/sub/file")" == "nested" ]]
+	[ -L "$BUNDLE/rootfs/opt/dir/link" ]
+	[[ "$(readlink "$BUNDLE/rootfs/opt/dir/link")" == "../hello" ]]
+	[ -d "$BUNDLE/rootfs/work" ]
+
+	# The configuration must have been updated.
+	sane_run jq -SMr '.process.env[]' "$BUNDLE/config.json"
+	[[ "$output" == *"GREETING=hello"* ]]
+	[[ "$output" == *"NAME=world"* ]]
+	sane_run jq -SMr '.process.args | join(" ")' "$BUNDLE/config.json"
+	[[ "$output" == "/usr/bin/hello --flag" ]]
+	sane_run jq -SMr '.process.cwd' "$BUNDLE/config.json"
+	[[ "$output" == "/work" ]]
+	sane_run jq -SMr '.annotations["org.opensuse.umoci.test"]' "$BUNDLE/config.json"
+	[[ "$output" == "build" ]]
+
+	# There is one layer and two history entries.
+	umoci stat --image "${IMAGE}:${TAG}-built" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == 2 ]]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == 1 ]]
+}
+
+@test "umoci build [from tag]" {
+	CONTEXT="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nhistory="$(echo "$output" | jq -SM '.history | length')"
+
+	echo "new file" >"$CONTEXT/newfile"
+	cat >"$CONTEXT/Umocifile" <<-EOF
+	FROM ${TAG}
+	COPY newfile /etc/newfile
+	EOF
+
+	umoci build --image "${IMAGE}:${TAG}-new" "$CONTEXT"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The base image contents are still present.
+	[ -f "$BUNDLE/rootfs/etc/passwd" ]
+	[[ "$(cat "$BUNDLE/rootfs/etc/newfile")" == "new file" ]]
+
+	# Only a layer was added.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "$((nhistory + 1))" ]]
+}
+
+@test "umoci build [run]" {
+	requires root
+
+	CONTEXT="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	cat >"$CONTEXT/Umocifile" <<-EOF
+	FROM ${TAG}
+	ENV VALUE=from-env
+	WORKDIR /srv
+	RUN echo "\$VALUE \$(pwd)" >output
+	RUN ["/bin/sh", "-c", "rm /etc/passwd"]
+	EOF
+
+	umoci build --image "${IMAGE}:${TAG}-run" "$CONTEXT"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-run" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[[ "$(cat "$BUNDLE/rootfs/srv/output")" == "from-env /srv" ]]
+	[ ! -e "$BUNDLE/rootfs/etc/passwd" ]
+
+	# A failing command fails the build.
+	cat >"$CONTEXT/Umocifile" <<-EOF
+	FROM ${TAG}
+	RUN exit 1
+	EOF
+
+	umoci build --image "${IMAGE}:${TAG}-fail" "$CONTEXT"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,119 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci bundles ls" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# No bundles are recorded initially.
+	umoci bundles ls --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 0 ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}" --rootfs-only "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+
+	umoci bundles ls --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 2 ]
+	[ "$(echo "$output" | jq -r '[.[] | select(.status == "ok")] | length')" -eq 2 ]
+	[ "$(echo "$output" | jq -r '[.[] | select(.ref_name == "'"$TAG"'")] | length')" -eq 2 ]
+	echo "$output" | jq -r '.[].path' | grep -Fx "$(readlink -f "$BUNDLE_A")"
+
+	# Removed bundles are missing.
+	rm -rf "$BUNDLE_B"
+	umoci bundles ls --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -r '[.[] | select(.status == "missing")] | length')" -eq 1 ]
+
+	# The human-readable output has a header.
+	umoci bundles ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == *"STATUS"* ]]
+
+	# No positional arguments are accepted.
+	umoci bundles ls --layout "${IMAGE}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci bundles prune" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-orphan"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-orphan" --config.user "1234:1234"
+	[ "$status" -eq 0 ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-orphan" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+
+	# Orphan the last bundle.
+	umoci rm --image "${IMAGE}:${TAG}-orphan"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	rm -rf "$BUNDLE_B"
+
+	umoci bundles ls --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -r '[.[] | select(.status == "missing")] | length')" -eq 1 ]
+	[ "$(echo "$output" | jq -r '[.[] | select(.status == "orphaned")] | length')" -eq 1 ]
+
+	# Only the missing bundle is pruned by default.
+	umoci bundles prune --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci bundles ls --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 2 ]
+	[ -d "$BUNDLE_C" ]
+
+	# Orphaned bundles can be removed.
+	umoci bundles prune --layout "${IMAGE}" --remove-orphaned
+	[ "$status" -eq 0 ]
+	umoci bundles ls --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 1 ]
+	[ "$(echo "$output" | jq -r '.[0].status')" == "ok" ]
+	! [ -e "$BUNDLE_C" ]
+
+	image-verify "${IMAGE}"
+}
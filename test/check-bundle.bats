@@ -0,0 +1,83 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci check-bundle" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# A freshly unpacked bundle must not have any drift.
+	umoci check-bundle --layout "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Modify the rootfs.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	rm -rf "$BUNDLE/rootfs/etc"
+
+	# The drift must be reported.
+	umoci check-bundle --layout "${IMAGE}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep -E '^extra	/?newfile$'
+	echo "$output" | grep -E '^missing	/?etc$'
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci check-bundle [missing manifest]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Remove the source manifest from the image.
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# The bundle can no longer be verified.
+	umoci check-bundle --layout "${IMAGE}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci check-bundle [missing args]" {
+	umoci check-bundle
+	[ "$status" -ne 0 ]
+
+	umoci check-bundle --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+}
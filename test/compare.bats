@@ -0,0 +1,103 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci compare [missing args]" {
+	umoci compare
+	[ "$status" -ne 0 ]
+
+	umoci compare --layout "${IMAGE}" "${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci compare --layout "${IMAGE}" "${TAG}" "${TAG}" too-many
+	[ "$status" -ne 0 ]
+
+	umoci compare --layout "${IMAGE}" "${TAG}" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci compare [identical]" {
+	umoci compare --layout "${IMAGE}" --json "${TAG}" "${TAG}"
+	[ "$status" -eq 0 ]
+
+	compareFile="$(setup_tmpdir)/compare"
+	echo "$output" > "$compareFile"
+
+	sane_run jq -SMr '.size_delta == 0 and (.added_layers | length) == 0 and (.removed_layers | length) == 0 and (.config | length) == 0 and (.annotations | length) == 0' "$compareFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci compare --json" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Add a new layer and change the configuration.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	umoci config --image "${IMAGE}:${TAG}-new" --config.label "compare=label" --config.env "COMPARE=env" --manifest.annotation "compare=annotation"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci compare --layout "${IMAGE}" --json "${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	compareFile="$(setup_tmpdir)/compare"
+	echo "$output" > "$compareFile"
+
+	# Exactly one layer was added.
+	sane_run jq -SMr '(.added_layers | length) == 1 and (.removed_layers | length) == 0 and .size_delta > 0' "$compareFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# The configuration changes are reported per-key.
+	sane_run jq -SMr '.config[] | select(.field == "config.Labels.compare") | .new' "$compareFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "label" ]]
+	sane_run jq -SMr '.config[] | select(.field == "config.Env.COMPARE") | .old' "$compareFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+	sane_run jq -SMr '.annotations[] | select(.field == "compare") | .new' "$compareFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "annotation" ]]
+
+	# The comparison is symmetric.
+	umoci compare --layout "${IMAGE}" --json "${TAG}-new" "${TAG}"
+	[ "$status" -eq 0 ]
+	echo "$output" > "$compareFile"
+	sane_run jq -SMr '(.added_layers | length) == 0 and (.removed_layers | length) == 1 and .size_delta < 0' "$compareFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,73 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci completion bash" {
+	umoci completion bash
+	[ "$status" -eq 0 ]
+	echo "$output" > "$BATS_TMPDIR/umoci-completion.bash"
+
+	# The script must be valid, and complete tags from the image. The script
+	# runs "umoci ls", so we need to make sure it uses the right binary.
+	export UMOCI COVER
+	sane_run bash -c '
+		function umoci() {
+			if [ "$COVER" -eq 1 ]; then
+				"$UMOCI" __DEVEL--i-heard-you-like-tests "$@"
+			else
+				"$UMOCI" "$@"
+			fi
+		}
+		source "$1"
+		COMP_WORDS=(umoci unpack --image "$2:")
+		COMP_CWORD=3
+		_umoci
+		printf "%s\n" "${COMPREPLY[@]}"
+	' -- "$BATS_TMPDIR/umoci-completion.bash" "${IMAGE}"
+	[ "$status" -eq 0 ]
+	printf '%s\n' "${lines[@]}" | grep -Fx "${IMAGE}:${TAG}"
+}
+
+@test "umoci completion [other shells]" {
+	umoci completion zsh
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "#compdef umoci" ]]
+
+	umoci completion fish
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"complete -c umoci"* ]]
+}
+
+@test "umoci completion [invalid arguments]" {
+	umoci completion
+	[ "$status" -ne 0 ]
+
+	umoci completion tcsh
+	[ "$status" -ne 0 ]
+
+	umoci completion bash fish
+	[ "$status" -ne 0 ]
+}
@@ -286,8 +286,15 @@ function teardown() {
 @test "umoci config --config.user 'user:group' [non-existent user]" {
 	BUNDLE="$(setup_tmpdir)"
 
-	# Modify the user.
+	# Users which don't exist in the image are rejected.
 	umoci config --image "${IMAGE}:${TAG}" --config.user="testuser:emptygroup"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.user="root:emptygroup"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Modify the user.
+	umoci config --image "${IMAGE}:${TAG}" --no-user-check --config.user="testuser:emptygroup"
 	[ "$status" -eq 0 ]
 	image-verify "${IMAGE}"
 
@@ -525,6 +532,54 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --config.[entrypoint+cmd].string" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Command lines are split using shell quoting rules, and the exec form is
+	# used verbatim.
+	umoci config --image "${IMAGE}:${TAG}" --config.entrypoint.string "/bin/app --name 'some value' \"a \\\"b\\\"\"" --config.cmd.string '["sh", "-c", "echo $HOME"]'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run jq -SMr 'reduce .process.args[] as $arg (""; . + $arg + ";")' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '/bin/app;--name;some value;a "b";sh;-c;echo $HOME;' ]]
+
+	# Command lines which need a shell are rejected.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.cmd.string 'echo $HOME'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.cmd.string 'ls | grep x'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.cmd.string "echo 'unterminated"
+	[ "$status" -ne 0 ]
+
+	# Invalid or empty commands are rejected.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.cmd.string '[]'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.cmd.string '["a", 1]'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.cmd.string ''
+	[ "$status" -ne 0 ]
+
+	# They cannot be combined with the old flags.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.cmd "ls" --config.cmd.string 'ls'
+	[ "$status" -ne 0 ]
+
+	# Only the exec form is accepted with --strict-exec-form.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --strict-exec-form --config.entrypoint.string '/bin/app'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --strict-exec-form --config.entrypoint.string '["/bin/app"]'
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 # XXX: This test is somewhat dodgy (since we don't actually set anything other than the destination for a volume).
 @test "umoci config --config.volume" {
 	BUNDLE_A="$(setup_tmpdir)"
@@ -765,3 +820,116 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci config --rootfs.type --extension" {
+	image-verify "${IMAGE}"
+
+	# Fields defined by the image-spec and invalid values are rejected.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --extension 'architecture="arm64"'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --extension 'org.opensuse.test={'
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --rootfs.type ""
+	[ "$status" -ne 0 ]
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--extension 'org.opensuse.test={"key": "value"}' --rootfs.type custom
+	[ "$status" -eq 0 ]
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.rootfs_type' <<<"$output")" == "custom" ]]
+	[[ "$(jq -SMr '.extensions["org.opensuse.test"].key' <<<"$output")" == "value" ]]
+
+	# Other modifications preserve the extension and rootfs type.
+	umoci config --image "${IMAGE}:${TAG}-new" --config.workingdir "/umoci"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.config.digest' "${IMAGE}/blobs/${output/://}"
+	[ "$status" -eq 0 ]
+	config="${IMAGE}/blobs/${output/://}"
+	[[ "$(jq -SMr '.["org.opensuse.test"].key' "$config")" == "value" ]]
+	[[ "$(jq -SMr '.rootfs.type' "$config")" == "custom" ]]
+	[[ "$(jq -SMr '.config.WorkingDir' "$config")" == "/umoci" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep "org.opensuse.test"
+
+	# The extensions can be cleared.
+	umoci config --image "${IMAGE}:${TAG}-new" --clear=extensions --rootfs.type layers
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.rootfs_type' <<<"$output")" == "layers" ]]
+	[[ "$(jq -SMr '.extensions' <<<"$output")" == "null" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config [unknown fields]" {
+	image-verify "${IMAGE}"
+
+	# Add fields unknown to umoci to the manifest, as a newer tool might.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	oldManifest="${IMAGE}/blobs/${output/://}"
+	newManifest="$(setup_tmpdir)/manifest.json"
+	jq -cM '.["org.opensuse.test"] = "manifest" | .layers[0]["org.opensuse.test"] = "layer" | .config.annotations["org.opensuse.test"] = "config"' "$oldManifest" >"$newManifest"
+	digest="$(sha256sum "$newManifest" | cut -d' ' -f1)"
+	size="$(stat -c '%s' "$newManifest")"
+	cp "$newManifest" "${IMAGE}/blobs/sha256/$digest"
+	jq -cM '.manifests += [{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:'"$digest"'", "size": '"$size"', "annotations": {"org.opencontainers.image.ref.name": "'"${TAG}-unknown"'"}}]' "${IMAGE}/index.json" >"$newManifest"
+	mv "$newManifest" "${IMAGE}/index.json"
+
+	umoci config --image "${IMAGE}:${TAG}-unknown" --config.workingdir "/umoci"
+	[ "$status" -eq 0 ]
+
+	# The unknown fields must not be dropped by the modification.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-unknown"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	manifest="${IMAGE}/blobs/${output/://}"
+	[[ "$(jq -SMr '.["org.opensuse.test"]' "$manifest")" == "manifest" ]]
+	[[ "$(jq -SMr '.layers[0]["org.opensuse.test"]' "$manifest")" == "layer" ]]
+	[[ "$(jq -SMr '.config.annotations["org.opensuse.test"]' "$manifest")" == "config" ]]
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.config.WorkingDir' "${IMAGE}/blobs/${output/://}")" == "/umoci" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config [newer layout version]" {
+	image-verify "${IMAGE}"
+
+	# Images using a newer version of the image-spec are read-only.
+	echo '{"imageLayoutVersion": "1.1.0"}' >"${IMAGE}/oci-layout"
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user "1234:1332"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "read-only"
+
+	# In pass-through mode new images can be added, but nothing can be removed.
+	UMOCI_NEWER_VERSIONS=pass-through umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-pt" --config.user "1234:1332"
+	[ "$status" -eq 0 ]
+	UMOCI_NEWER_VERSIONS=pass-through umoci stat --image "${IMAGE}:${TAG}-pt"
+	[ "$status" -eq 0 ]
+	UMOCI_NEWER_VERSIONS=pass-through umoci rm --image "${IMAGE}:${TAG}-pt"
+	[ "$status" -eq 0 ]
+	UMOCI_NEWER_VERSIONS=pass-through umoci gc --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	UMOCI_FORCE=1 UMOCI_NEWER_VERSIONS=pass-through umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Unless --force is used.
+	UMOCI_FORCE=1 umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user "1234:1332"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.config.digest' "${IMAGE}/blobs/${output/://}"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.config.User' "${IMAGE}/blobs/${output/://}")" == "1234:1332" ]]
+}
@@ -0,0 +1,85 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# manifest_digest returns the digest of the manifest with the given tag.
+function manifest_digest() {
+	jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$1"'") | .digest' "${IMAGE}/index.json"
+}
+
+@test "umoci convert [missing args]" {
+	umoci convert
+	[ "$status" -ne 0 ]
+
+	# --to is mandatory.
+	umoci convert --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci convert --image "${IMAGE}:${TAG}" --to invalid
+	[ "$status" -ne 0 ]
+
+	umoci convert --image "${IMAGE}:${TAG}" --to docker too many arguments
+	[ "$status" -ne 0 ]
+
+	umoci convert --image "${IMAGE}:${TAG}-nonexistent" --to docker
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci convert --to docker" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci convert --image "${IMAGE}:${TAG}" --to docker --tag "${TAG}-docker"
+	[ "$status" -eq 0 ]
+
+	# The manifest and its descriptors must use the Docker media types.
+	[[ "$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-docker"'") | .mediaType' "${IMAGE}/index.json")" == "application/vnd.docker.distribution.manifest.v2+json" ]]
+	manifest="${IMAGE}/blobs/sha256/$(manifest_digest "${TAG}-docker" | cut -d: -f2)"
+	[[ "$(jq -r '.mediaType' "$manifest")" == "application/vnd.docker.distribution.manifest.v2+json" ]]
+	[[ "$(jq -r '.config.mediaType' "$manifest")" == "application/vnd.docker.container.image.v1+json" ]]
+	[[ "$(jq -r '.layers[].mediaType' "$manifest" | sort -u)" == "application/vnd.docker.image.rootfs.diff.tar.gzip" ]]
+
+	# The converted image can still be used.
+	umoci stat --image "${IMAGE}:${TAG}-docker"
+	[ "$status" -eq 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-docker" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Modifying it produces an OCI image.
+	echo "modified" > "$BUNDLE/rootfs/umoci-convert"
+	umoci repack --image "${IMAGE}:${TAG}-modified" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-modified"'") | .mediaType' "${IMAGE}/index.json")" == "application/vnd.oci.image.manifest.v1+json" ]]
+
+	# Converting back to OCI results in the original manifest.
+	umoci convert --image "${IMAGE}:${TAG}-docker" --to oci
+	[ "$status" -eq 0 ]
+	[[ "$(manifest_digest "${TAG}-docker")" == "$(manifest_digest "${TAG}")" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,140 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	if [ -n "$DAEMON_PID" ]; then
+		kill "$DAEMON_PID" || true
+	fi
+	teardown_tmpdirs
+	teardown_image
+}
+
+# start_daemon starts a daemon listening on $SOCKET in the background, with the
+# given global options. It is run directly (rather than with the umoci helper)
+# since it doesn't exit.
+function start_daemon() {
+	"$UMOCI" "$@" daemon start --socket "$SOCKET" &
+	DAEMON_PID=$!
+	for _ in $(seq 50); do
+		[ -S "$SOCKET" ] && return 0
+		sleep 0.1
+	done
+	fail "daemon did not create $SOCKET"
+}
+
+@test "umoci daemon [unpack, config, repack, gc]" {
+	SOCKET="$(setup_tmpdir)/umoci.sock"
+	BUNDLE="$(setup_tmpdir)"
+	start_daemon
+
+	# The socket is only accessible by us.
+	[[ "$(stat -c '%a' "$SOCKET")" == "600" ]]
+
+	# Unpack the image using the daemon, with a relative bundle path.
+	args=()
+	if [[ "$ROOTLESS" != 0 ]]; then
+		args+=("--rootless")
+	fi
+	cd "$(dirname "$BUNDLE")"
+	umoci daemon exec --socket "$SOCKET" unpack "${args[@]}" --image "${IMAGE}:${TAG}" "$(basename "$BUNDLE")/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+
+	# Modify the config and the rootfs.
+	UMOCI_DAEMON_SOCKET="$SOCKET" umoci daemon exec config --image "${IMAGE}:${TAG}" --config.workingdir /daemon
+	[ "$status" -eq 0 ]
+	echo "daemon" > "$BUNDLE/bundle/rootfs/daemon-file"
+	umoci daemon exec --socket "$SOCKET" repack --image "${IMAGE}:${TAG}-daemon" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	umoci daemon exec --socket "$SOCKET" gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-daemon"
+	[ "$status" -eq 0 ]
+	umoci raw config --image "${IMAGE}:${TAG}" "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.process.cwd' "$BUNDLE/config.json")" == "/daemon" ]]
+
+	# Errors from the command are returned.
+	umoci daemon exec --socket "$SOCKET" unpack "${args[@]}" --image "${IMAGE}:does-not-exist" "$BUNDLE/bad"
+	[ "$status" -ne 0 ]
+
+	# Only some commands can be run.
+	umoci daemon exec --socket "$SOCKET" stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci daemon exec --socket "$SOCKET" --log debug unpack --image "${IMAGE}:${TAG}" "$BUNDLE/bad"
+	[ "$status" -ne 0 ]
+
+	# The daemon removes its socket when it is stopped.
+	kill "$DAEMON_PID"
+	wait "$DAEMON_PID" || true
+	DAEMON_PID=
+	[ ! -e "$SOCKET" ]
+}
+
+@test "umoci daemon [relative paths]" {
+	SOCKET="$(setup_tmpdir)/umoci.sock"
+	BUNDLE="$(setup_tmpdir)"
+	start_daemon --log info
+
+	args=()
+	if [[ "$ROOTLESS" != 0 ]]; then
+		args+=("--rootless")
+	fi
+
+	# Paths are resolved against the directory of the client, not the daemon.
+	cd "$BUNDLE"
+	cp -r "$IMAGE" image
+	umoci daemon exec --socket "$SOCKET" unpack "${args[@]}" --image "image:${TAG}" --mtree-output rootfs.mtree bundle
+	[ "$status" -eq 0 ]
+	[ -f "$BUNDLE/rootfs.mtree" ]
+	bundle-verify "$BUNDLE/bundle"
+
+	# The log messages of the command are returned to the client.
+	echo "relative" > "$BUNDLE/bundle/rootfs/relative-file"
+	umoci daemon exec --socket "$SOCKET" repack --image "image:${TAG}-relative" --mtree rootfs.mtree bundle
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"new image manifest created"* ]]
+	image-verify "$BUNDLE/image"
+
+	# Images which are replaced are opened again.
+	rm -rf image
+	cp -r "$IMAGE" image
+	umoci daemon exec --socket "$SOCKET" config --image "image:${TAG}" --config.workingdir /relative
+	[ "$status" -eq 0 ]
+	umoci daemon exec --socket "$SOCKET" gc --layout image
+	[ "$status" -eq 0 ]
+	image-verify "$BUNDLE/image"
+}
+
+@test "umoci daemon [missing socket]" {
+	umoci daemon start
+	[ "$status" -ne 0 ]
+
+	umoci daemon exec unpack --image "${IMAGE}:${TAG}" bundle
+	[ "$status" -ne 0 ]
+
+	# There is no daemon listening.
+	umoci daemon exec --socket "$(setup_tmpdir)/umoci.sock" unpack --image "${IMAGE}:${TAG}" bundle
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,66 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function teardown() {
+	teardown_tmpdirs
+}
+
+@test "umoci doctor" {
+	DIR="$(setup_tmpdir)"
+
+	umoci doctor "$DIR"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"PROBE"*"FEATURE"* ]]
+
+	# No temporary files are left behind.
+	sane_run find "$DIR" -mindepth 1
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
+
+@test "umoci doctor --json" {
+	DIR="$(setup_tmpdir)"
+
+	umoci doctor --json "$DIR"
+	[ "$status" -eq 0 ]
+	report="$output"
+
+	[[ "$(echo "$report" | jq -r '.path')" == "$DIR" ]]
+	[ "$(echo "$report" | jq '.probes | length')" -gt 0 ]
+
+	# Rootless unpacking always works.
+	[[ "$(echo "$report" | jq -r '.features[] | select(.name == "unpack-rootless") | .available')" == "true" ]]
+
+	# Unpacking without --rootless must agree with umoci-version(1).
+	unpack="$(echo "$report" | jq -r '.features[] | select(.name == "unpack") | .available')"
+	umoci version --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.features.rootless')" != "$unpack" ]]
+
+	# Features are only available if all of their probes succeeded.
+	sane_run jq -e '.probes as $probes | .features | all(.available == ((.requires // []) | all(. as $name | $probes | map(select(.name == $name)) | .[0].ok)))' <<<"$report"
+	[ "$status" -eq 0 ]
+}
+
+@test "umoci doctor [invalid arguments]" {
+	umoci doctor /nonexistent
+	[ "$status" -ne 0 ]
+
+	umoci doctor "$(setup_tmpdir)" "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,158 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+ADDRESS="127.0.0.1:5124"
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	[ -z "$SERVE_PID" ] || kill "$SERVE_PID"
+	teardown_tmpdirs
+	teardown_image
+}
+
+function start_serve() {
+	"$UMOCI" serve --layout "${IMAGE}" --address "$ADDRESS" &
+	SERVE_PID="$!"
+	for _ in $(seq 50); do
+		(exec 3<>"/dev/tcp/${ADDRESS%:*}/${ADDRESS#*:}") 2>/dev/null && break
+		sleep 0.1
+	done
+}
+
+@test "umoci fetch" {
+	start_serve
+
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	# Unreachable peers must be skipped.
+	umoci fetch --image "${NEWIMAGE}:fetched" --peer "http://127.0.0.1:1" --peer "http://$ADDRESS" "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${NEWIMAGE}:fetched" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	# Fetching again must not fetch any blobs.
+	umoci --log=info fetch --image "${NEWIMAGE}:fetched" --peer "http://$ADDRESS" "${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"fetched 0 blobs"* ]]
+
+	image-verify "$NEWIMAGE"
+	image-verify "${IMAGE}"
+}
+
+@test "umoci fetch --delta" {
+	start_serve
+
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	# Without an existing tag, the entire image is fetched.
+	umoci --log=info fetch --delta --image "${NEWIMAGE}:fetched" --peer "http://$ADDRESS" "${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"no delta basis"* ]]
+	image-verify "$NEWIMAGE"
+
+	# Modify the image being served, and refresh the fetched image.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "new file" > "$BUNDLE/rootfs/delta-file"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	umoci --log=info fetch --delta --image "${NEWIMAGE}:fetched" --peer "http://$ADDRESS" "${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"as delta basis"* ]]
+	image-verify "$NEWIMAGE"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${NEWIMAGE}:fetched" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci fetch --limit-rate --max-connections" {
+	start_serve
+
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	umoci --log=info fetch --limit-rate 1M --max-connections 4 --image "${NEWIMAGE}:fetched" --peer "http://$ADDRESS" "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+
+	# The fetched image must be the same as the served one.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${NEWIMAGE}:fetched" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	# Invalid limits must be rejected.
+	umoci fetch --limit-rate -1M --image "${NEWIMAGE}:fetched" --peer "http://$ADDRESS" "${TAG}"
+	[ "$status" -ne 0 ]
+	umoci fetch --limit-rate fast --image "${NEWIMAGE}:fetched" --peer "http://$ADDRESS" "${TAG}"
+	[ "$status" -ne 0 ]
+	umoci fetch --max-connections -1 --image "${NEWIMAGE}:fetched" --peer "http://$ADDRESS" "${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "$NEWIMAGE"
+	image-verify "${IMAGE}"
+}
+
+@test "umoci fetch [missing tag]" {
+	start_serve
+
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	umoci fetch --image "${NEWIMAGE}:fetched" --peer "http://$ADDRESS" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+
+	umoci ls --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	image-verify "$NEWIMAGE"
+}
+
+@test "umoci fetch [missing args]" {
+	umoci fetch --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci fetch --image "${IMAGE}:${TAG}" --peer "localhost:5000"
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,140 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci fsck" {
+	image-verify "${IMAGE}"
+
+	# A valid image has no problems.
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci fsck --layout "${IMAGE}" --repair
+	[ "$status" -eq 0 ]
+
+	# --log requires --repair.
+	umoci fsck --layout "${IMAGE}" --log /dev/null
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci fsck --repair" {
+	image-verify "${IMAGE}"
+	LOG="$(setup_tmpdir)/fsck.log"
+
+	# Store a blob under the wrong digest.
+	misnamed="${IMAGE}/blobs/sha256/$(echo -n "misnamed" | sha256sum | cut -d' ' -f1)"
+	echo -n "contents" > "$misnamed"
+
+	# Add a dangling reference.
+	jq '.manifests += [.manifests[0] | .digest = "sha256:'"$(echo -n "missing" | sha256sum | cut -d' ' -f1)"'" | .annotations["org.opencontainers.image.ref.name"] = "dangling"]' \
+		"${IMAGE}/index.json" > "${IMAGE}/index.json.new"
+	mv "${IMAGE}/index.json.new" "${IMAGE}/index.json"
+
+	# Make sure the problems are found, but not repaired.
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[ -f "$misnamed" ]
+
+	umoci fsck --layout "${IMAGE}" --repair --log "$LOG"
+	[ "$status" -eq 0 ]
+	[ ! -e "$misnamed" ]
+	[ -f "${IMAGE}/blobs/sha256/$(echo -n "contents" | sha256sum | cut -d' ' -f1)" ]
+
+	# The dangling tag must be gone.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"dangling"* ]]
+
+	# Every repair must be logged.
+	[ "$(wc -l < "$LOG")" -eq 2 ]
+	jq -se '.[0].kind == "misnamed-blob" and .[1].kind == "dangling-reference"' "$LOG"
+
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci fsck --repair [legacy ref.name]" {
+	image-verify "${IMAGE}"
+
+	# Convert a tag to use the legacy annotation.
+	jq '.manifests[0].annotations |= (with_entries(if .key == "org.opencontainers.image.ref.name" then .key = "org.opencontainers.ref.name" else . end))' \
+		"${IMAGE}/index.json" > "${IMAGE}/index.json.new"
+	mv "${IMAGE}/index.json.new" "${IMAGE}/index.json"
+	sane_run jq -SMr '.manifests[0].annotations["org.opencontainers.ref.name"]' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	legacy="$output"
+
+	# The tag can still be used before it is converted.
+	umoci stat --image "${IMAGE}:${legacy}"
+	[ "$status" -eq 0 ]
+
+	umoci validate --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci fsck --layout "${IMAGE}" --repair
+	[ "$status" -eq 0 ]
+
+	# The tag must be usable again.
+	umoci stat --image "${IMAGE}:${legacy}"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMe '[.manifests[].annotations | has("org.opencontainers.ref.name")] | any | not' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+
+	umoci validate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci fsck --adopt-orphans" {
+	image-verify "${IMAGE}"
+
+	# Remove the tag, leaving the manifest orphaned.
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json")"
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	# Orphans aren't a problem unless requested.
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci fsck --layout "${IMAGE}" --adopt-orphans
+	[ "$status" -ne 0 ]
+
+	umoci fsck --layout "${IMAGE}" --adopt-orphans --repair
+	[ "$status" -eq 0 ]
+
+	# The manifest must have been adopted.
+	adopted="lost-found-$(echo "$manifest" | cut -d: -f2 | head -c12)"
+	umoci stat --image "${IMAGE}:${adopted}"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
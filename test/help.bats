@@ -114,6 +114,62 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci raw runtime-config"+ ]]
 
+	umoci artifact --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact"+ ]]
+
+	umoci artifact -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact"+ ]]
+
+	umoci artifact push-blob --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact push-blob"+ ]]
+
+	umoci artifact push-blob -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact push-blob"+ ]]
+
+	umoci artifact put --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact put"+ ]]
+
+	umoci artifact put -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact put"+ ]]
+
+	umoci artifact extract --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact extract"+ ]]
+
+	umoci artifact extract -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci artifact extract"+ ]]
+
+	umoci daemon --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci daemon"+ ]]
+
+	umoci daemon -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci daemon"+ ]]
+
+	umoci daemon start --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci daemon start"+ ]]
+
+	umoci daemon start -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci daemon start"+ ]]
+
+	umoci daemon exec --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci daemon exec"+ ]]
+
+	umoci daemon exec -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci daemon exec"+ ]]
+
 	umoci remove --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci remove"+ ]]
@@ -138,6 +194,86 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci stat"+ ]]
 
+	umoci stats --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci stats"+ ]]
+
+	umoci stats -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci stats"+ ]]
+
+	umoci compare --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci compare"+ ]]
+
+	umoci compare -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci compare"+ ]]
+
+	umoci top-files --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci top-files"+ ]]
+
+	umoci top-files -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci top-files"+ ]]
+
+	umoci wasted-space --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci wasted-space"+ ]]
+
+	umoci wasted-space -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci wasted-space"+ ]]
+
+	umoci rebase --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rebase"+ ]]
+
+	umoci rebase -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rebase"+ ]]
+
+	umoci convert --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci convert"+ ]]
+
+	umoci convert -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci convert"+ ]]
+
+	umoci remap --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci remap"+ ]]
+
+	umoci remap -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci remap"+ ]]
+
+	umoci initramfs --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci initramfs"+ ]]
+
+	umoci initramfs -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci initramfs"+ ]]
+
+	umoci build --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci build"+ ]]
+
+	umoci build -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci build"+ ]]
+
+	umoci insert --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci insert"+ ]]
+
+	umoci insert -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci insert"+ ]]
+
 	umoci gc --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
@@ -146,6 +282,198 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
 
+	umoci prune --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci prune"+ ]]
+
+	umoci prune -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci prune"+ ]]
+
+	umoci check-bundle --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci check-bundle"+ ]]
+
+	umoci check-bundle -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci check-bundle"+ ]]
+
+	umoci verify-rootfs --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify-rootfs"+ ]]
+
+	umoci verify-rootfs -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify-rootfs"+ ]]
+
+	umoci bundles --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci bundles"+ ]]
+
+	umoci bundles -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci bundles"+ ]]
+
+	umoci bundles list --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci bundles list"+ ]]
+
+	umoci bundles list -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci bundles list"+ ]]
+
+	umoci bundles ls --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci bundles list"+ ]]
+
+	umoci bundles ls -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci bundles list"+ ]]
+
+	umoci bundles prune --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci bundles prune"+ ]]
+
+	umoci bundles prune -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci bundles prune"+ ]]
+
+	umoci validate --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci validate"+ ]]
+
+	umoci validate -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci validate"+ ]]
+
+	umoci fsck --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci fsck"+ ]]
+
+	umoci fsck -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci fsck"+ ]]
+
+	umoci begin --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci begin"+ ]]
+
+	umoci begin -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci begin"+ ]]
+
+	umoci commit --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci commit"+ ]]
+
+	umoci commit -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci commit"+ ]]
+
+	umoci rollback --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rollback"+ ]]
+
+	umoci rollback -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rollback"+ ]]
+
+	umoci migrate --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci migrate"+ ]]
+
+	umoci migrate -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci migrate"+ ]]
+
+	umoci log --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci log"+ ]]
+
+	umoci log -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci log"+ ]]
+
+	umoci watch --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci watch"+ ]]
+
+	umoci watch -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci watch"+ ]]
+
+	umoci import --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import"+ ]]
+
+	umoci import -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import"+ ]]
+
+	umoci export --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci export"+ ]]
+
+	umoci export -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci export"+ ]]
+
+	umoci archive --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci archive"+ ]]
+
+	umoci archive -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci archive"+ ]]
+
+	umoci unarchive --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci unarchive"+ ]]
+
+	umoci unarchive -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci unarchive"+ ]]
+
+	umoci serve --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci serve"+ ]]
+
+	umoci serve -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci serve"+ ]]
+
+	umoci fetch --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci fetch"+ ]]
+
+	umoci fetch -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci fetch"+ ]]
+
+	umoci completion --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci completion"+ ]]
+
+	umoci completion -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci completion"+ ]]
+
+	umoci version --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci version"+ ]]
+
+	umoci version -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci version"+ ]]
+
+	umoci doctor --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci doctor"+ ]]
+
+	umoci doctor -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci doctor"+ ]]
+
 	umoci init --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci init"+ ]]
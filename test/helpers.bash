@@ -78,8 +78,8 @@ function umoci() {
 	# Set the first argument (the subcommand).
 	args+=("$1")
 
-	# We're rootless if we're asked to unpack something.
-	if [[ "$ROOTLESS" != 0 && "$1" == "unpack" ]]; then
+	# We're rootless if we're asked to unpack (or build, insert or benchmark) something.
+	if [[ "$ROOTLESS" != 0 && ( "$1" == "unpack" || "$1" == "build" || "$1" == "insert" || "$1" == "bench" ) ]]; then
 		args+=("--rootless")
 	fi
 
@@ -0,0 +1,334 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# export_dir copies the given tag into a skopeo directory.
+function export_dir() {
+	local tag="$1" dir="$2"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$tag"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	local manifest="${output#sha256:}"
+
+	echo "Directory Transport Version: 1.1" > "$dir/version"
+	cp "${IMAGE}/blobs/sha256/$manifest" "$dir/manifest.json"
+	for blob in $(jq -r '.config.digest, .layers[].digest' "$dir/manifest.json"); do
+		cp "${IMAGE}/blobs/sha256/${blob#sha256:}" "$dir/${blob#sha256:}"
+	done
+}
+
+@test "umoci import dir:" {
+	DIR="$(setup_tmpdir)"
+	export_dir "${TAG}" "$DIR"
+
+	umoci import --image "${IMAGE}:${TAG}-imported" "dir:$DIR"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# OCI manifests must be imported unchanged.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${IMAGE}:${TAG}-imported" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci import dir: [docker]" {
+	DIR="$(setup_tmpdir)"
+	export_dir "${TAG}" "$DIR"
+
+	# Convert the manifest to a Docker manifest.
+	jq '.mediaType = "application/vnd.docker.distribution.manifest.v2+json" |
+		.config.mediaType = "application/vnd.docker.container.image.v1+json" |
+		.layers[].mediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip"' \
+		"$DIR/manifest.json" > "$DIR/manifest.json.new"
+	mv "$DIR/manifest.json.new" "$DIR/manifest.json"
+
+	umoci import --image "${IMAGE}:${TAG}-imported" "dir:$DIR"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The manifest must have been converted.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-imported" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci import [invalid]" {
+	DIR="$(setup_tmpdir)"
+	export_dir "${TAG}" "$DIR"
+
+	# Unknown transports.
+	umoci import --image "${IMAGE}:${TAG}-imported" "containers-storage:$DIR"
+	[ "$status" -ne 0 ]
+	umoci import --image "${IMAGE}:${TAG}-imported" "$DIR"
+	[ "$status" -ne 0 ]
+
+	# Corrupted blobs.
+	for blob in $(jq -r '.layers[].digest' "$DIR/manifest.json"); do
+		echo "corrupted" > "$DIR/${blob#sha256:}"
+	done
+	umoci import --image "${IMAGE}:${TAG}-imported" "dir:$DIR"
+	[ "$status" -ne 0 ]
+
+	# The tag must not have been created.
+	umoci stat --image "${IMAGE}:${TAG}-imported"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export oci-archive:" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+
+	umoci export --image "${IMAGE}:${TAG}" --name "docker.io/library/test:${TAG}" "oci-archive:$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The archive must only contain the tagged image.
+	sane_run tar -xOf "$ARCHIVE" index.json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -r '.manifests | length')" -eq 1 ]
+	[[ "$(echo "$output" | jq -r '.manifests[0].annotations["org.opencontainers.image.ref.name"]')" == "${TAG}" ]]
+	[[ "$(echo "$output" | jq -r '.manifests[0].annotations["io.containerd.image.name"]')" == "docker.io/library/test:${TAG}" ]]
+
+	# Import it into a new image.
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+	umoci import --image "${NEWIMAGE}:imported" "oci-archive:$ARCHIVE"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${NEWIMAGE}:imported" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export composefs:" {
+	DIR="$(setup_tmpdir)"
+
+	umoci export --image "${IMAGE}:${TAG}" --composefs.dump-only "composefs:$DIR/image"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The dump must describe the root filesystem, with the contents of every
+	# non-empty regular file stored as an object.
+	[ -f "$DIR/image/image.dump" ]
+	[ ! -e "$DIR/image/image.cfs" ]
+	[[ "$(head -n1 "$DIR/image/image.dump")" == "/ "* ]]
+	grep -q '^/etc ' "$DIR/image/image.dump"
+	nobjects="$(awk '$3 ~ /^10/ && $9 != "-" { print $9 }' "$DIR/image/image.dump" | sort -u | wc -l)"
+	[ "$nobjects" -gt 0 ]
+	[ "$(find "$DIR/image/objects" -type f | wc -l)" -eq "$nobjects" ]
+	awk '$3 ~ /^10/ && $9 != "-" { print $9 }' "$DIR/image/image.dump" | while read -r object; do
+		[ -f "$DIR/image/objects/$object" ]
+	done
+
+	# A second image sharing the objects directory reuses the objects.
+	umoci export --image "${IMAGE}:${TAG}" --composefs.dump-only --composefs.objects "$DIR/image/objects" "composefs:$DIR/image2"
+	[ "$status" -eq 0 ]
+	[ ! -e "$DIR/image2/objects" ]
+	[ "$(find "$DIR/image/objects" -type f | wc -l)" -eq "$nobjects" ]
+	cmp "$DIR/image/image.dump" "$DIR/image2/image.dump"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export composefs: [mkcomposefs]" {
+	command -v mkcomposefs >/dev/null || skip "test requires mkcomposefs"
+	DIR="$(setup_tmpdir)"
+
+	umoci export --image "${IMAGE}:${TAG}" "composefs:$DIR"
+	[ "$status" -eq 0 ]
+	[ -f "$DIR/image.cfs" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export composefs: [dm-verity]" {
+	DIR="$(setup_tmpdir)"
+
+	# Use a fake mkcomposefs which generates a two-block image.
+	cat >"$DIR/mkcomposefs" <<-EOF
+	#!/bin/sh
+	head -c 8192 /dev/zero >"\$3"
+	EOF
+	chmod +x "$DIR/mkcomposefs"
+
+	umoci export --image "${IMAGE}:${TAG}" --composefs.mkcomposefs "$DIR/mkcomposefs" --composefs.dm-verity "composefs:$DIR/image"
+	[ "$status" -eq 0 ]
+	[[ "$output" =~ ^[0-9a-f]{64}\ 8192$ ]]
+	# The image is followed by the superblock and a single hash block.
+	[ "$(stat -c '%s' "$DIR/image/image.cfs")" -eq $((4 * 4096)) ]
+	[[ "$(dd if="$DIR/image/image.cfs" bs=1 skip=8192 count=6 2>/dev/null)" == "verity" ]]
+
+	# The output is reproducible, and depends on the salt.
+	roothash="${output%% *}"
+	umoci export --image "${IMAGE}:${TAG}" --composefs.mkcomposefs "$DIR/mkcomposefs" --composefs.dm-verity "composefs:$DIR/image2"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$roothash 8192" ]]
+	umoci export --image "${IMAGE}:${TAG}" --composefs.mkcomposefs "$DIR/mkcomposefs" --composefs.dm-verity --composefs.dm-verity-salt 00ff "composefs:$DIR/image3"
+	[ "$status" -eq 0 ]
+	[[ "$output" != "$roothash 8192" ]]
+
+	umoci export --image "${IMAGE}:${TAG}" --composefs.dump-only --composefs.dm-verity "composefs:$DIR/image4"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" --composefs.mkcomposefs "$DIR/mkcomposefs" --composefs.dm-verity --composefs.dm-verity-salt zz "composefs:$DIR/image5"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export nspawn:" {
+	DIR="$(setup_tmpdir)"
+
+	umoci export --image "${IMAGE}:${TAG}" --nspawn.unit "$DIR/image.nspawn" "nspawn:$DIR/image.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The archive is a plain root filesystem, with an os-release file.
+	tar -tf "$DIR/image.tar" >"$DIR/entries"
+	grep -qx 'etc/' "$DIR/entries"
+	! grep -q '\.wh\.' "$DIR/entries"
+	grep -qE '^(etc|usr/lib)/os-release$' "$DIR/entries"
+	grep -qx '\[Exec\]' "$DIR/image.nspawn"
+	grep -qx 'Boot=no' "$DIR/image.nspawn"
+
+	umoci export --image "${IMAGE}:${TAG}" --nspawn.format directory --rootless "nspawn:$DIR/rootfs"
+	[ "$status" -eq 0 ]
+	[ -d "$DIR/rootfs/etc" ]
+	[ -f "$DIR/rootfs/etc/os-release" ] || [ -f "$DIR/rootfs/usr/lib/os-release" ]
+
+	umoci export --image "${IMAGE}:${TAG}" --nspawn.format invalid "nspawn:$DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" --nspawn.format directory "nspawn:-"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" --rootless "nspawn:$DIR/invalid.tar"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export lxd:" {
+	DIR="$(setup_tmpdir)"
+
+	umoci export --image "${IMAGE}:${TAG}" "lxd:$DIR/image.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The tarball contains the metadata, templates and the root filesystem.
+	tar -tf "$DIR/image.tar" >"$DIR/entries"
+	grep -qx 'metadata.yaml' "$DIR/entries"
+	grep -qx 'templates/hostname.tpl' "$DIR/entries"
+	grep -qx 'rootfs/' "$DIR/entries"
+	grep -qx 'rootfs/etc/' "$DIR/entries"
+	! grep -v -E '^(metadata.yaml|templates/|rootfs/)' "$DIR/entries"
+	! grep -q '\.wh\.' "$DIR/entries"
+
+	sane_run tar -xOf "$DIR/image.tar" metadata.yaml
+	[ "$status" -eq 0 ]
+	[[ "$output" == *'"/etc/hostname":'* ]]
+	[[ "$output" == *'"description": '* ]]
+
+	umoci export --image "${IMAGE}:${TAG}" --name "docker.io/library/test:${TAG}" "lxd:$DIR/invalid.tar"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export disk:" {
+	command -v mkfs.ext4 >/dev/null || skip "test requires mkfs.ext4"
+	DIR="$(setup_tmpdir)"
+
+	# The hook is run with the rootfs and with the finished disk.
+	cat >"$DIR/hook" <<-EOF
+	#!/bin/sh
+	echo "\$UMOCI_DISK_STAGE \$#" >>"$DIR/hook.log"
+	[ "\$UMOCI_DISK_STAGE" != rootfs ] || [ -d "\$1/etc" ]
+	EOF
+	chmod +x "$DIR/hook"
+
+	umoci export --image "${IMAGE}:${TAG}" --rootless --disk.hook "$DIR/hook" "disk:$DIR/disk.raw"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ -f "$DIR/disk.raw" ]
+	[[ "$(cat "$DIR/hook.log")" == "rootfs 1"$'\n'"disk 2" ]]
+	# The disk has a protective MBR, a GPT and an ext4 filesystem at 1MiB.
+	[[ "$(od -An -tx1 -j510 -N2 "$DIR/disk.raw")" == " 55 aa" ]]
+	[[ "$(dd if="$DIR/disk.raw" bs=1 skip=512 count=8 2>/dev/null)" == "EFI PART" ]]
+	[[ "$(od -An -tx1 -j$((1048576 + 1080)) -N2 "$DIR/disk.raw")" == " 53 ef" ]]
+	# No temporary files are left behind.
+	[ -z "$(find "$DIR" -name '.umoci-disk-*')" ]
+
+	umoci export --image "${IMAGE}:${TAG}" --rootless --disk.partition-table none --disk.size 512M "disk:$DIR/rootfs.ext4"
+	[ "$status" -eq 0 ]
+	[ "$(stat -c '%s' "$DIR/rootfs.ext4")" -eq $((512 * 1024 * 1024)) ]
+	[[ "$(od -An -tx1 -j1080 -N2 "$DIR/rootfs.ext4")" == " 53 ef" ]]
+
+	# A failing hook aborts the export.
+	umoci export --image "${IMAGE}:${TAG}" --rootless --disk.hook /bin/false "disk:$DIR/invalid.raw"
+	[ "$status" -ne 0 ]
+	[ ! -e "$DIR/invalid.raw" ]
+	umoci export --image "${IMAGE}:${TAG}" --disk.filesystem xfs "disk:$DIR/invalid.raw"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" --disk.filesystem erofs --disk.size 1G "disk:$DIR/invalid.raw"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" --disk.format vmdk "disk:$DIR/invalid.raw"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" "disk:-"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export [invalid]" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+
+	umoci export --image "${IMAGE}:${TAG}-nonexistent" "oci-archive:$ARCHIVE"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" "dir:$ARCHIVE"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" --name "docker.io/library/test:${TAG}" "composefs:$ARCHIVE"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" --composefs.mkcomposefs /nonexistent "composefs:$ARCHIVE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,113 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+
+# setup_kernel_image tags an image containing a kernel and an init as
+# "${TAG}-kernel".
+function setup_kernel_image() {
+	mkdir -p "$1/boot"
+	echo "not really a kernel" >"$1/boot/vmlinuz-test"
+	printf '#!/bin/sh\nexec /bin/sh\n' >"$1/myinit"
+	chmod +x "$1/myinit"
+
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-kernel" --file "$1/boot/vmlinuz-test:/boot/vmlinuz-test" --file "$1/myinit:/usr/local/bin/myinit"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci initramfs [missing args]" {
+	umoci initramfs
+	[ "$status" -ne 0 ]
+	umoci initramfs --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci initramfs --image "${IMAGE}:${TAG}-nonexistent" "$(setup_tmpdir)/initrd"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci initramfs" {
+	DIR="$(setup_tmpdir)"
+	setup_kernel_image "$DIR"
+
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --init /usr/local/bin/myinit --kernel-output "$DIR/vmlinuz" "$DIR/initrd.gz"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The kernel is extracted, and the initramfs is a newc cpio archive.
+	cmp "$DIR/vmlinuz" "$DIR/boot/vmlinuz-test"
+	[[ "$(zcat "$DIR/initrd.gz" | head -c6)" == "070701" ]]
+	zcat "$DIR/initrd.gz" | grep -aq '/usr/local/bin/myinit'
+	zcat "$DIR/initrd.gz" | grep -aq 'TRAILER!!!'
+
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --init /usr/local/bin/myinit --compress none "$DIR/initrd"
+	[ "$status" -eq 0 ]
+	[[ "$(head -c6 "$DIR/initrd")" == "070701" ]]
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --init /usr/local/bin/myinit --compress zstd "$DIR/initrd.zst"
+	[ "$status" -eq 0 ]
+	[[ "$(od -An -tx1 -N4 "$DIR/initrd.zst")" == " 28 b5 2f fd" ]]
+
+	# A missing init is an error.
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --init /nonexistent "$DIR/invalid"
+	[ "$status" -ne 0 ]
+	[ ! -e "$DIR/invalid" ]
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --compress lzma "$DIR/invalid"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci initramfs --uki" {
+	DIR="$(setup_tmpdir)"
+	setup_kernel_image "$DIR"
+
+	# Use a fake ukify which records its arguments and the kernel.
+	cat >"$DIR/ukify" <<-EOF
+	#!/bin/sh
+	echo "\$@" >"$DIR/ukify.args"
+	for arg; do
+		case "\$arg" in
+		--linux=*) cp "\${arg#--linux=}" "$DIR/ukify.linux" ;;
+		--os-release=@*) cp "\${arg#--os-release=@}" "$DIR/ukify.os-release" ;;
+		esac
+	done
+	EOF
+	chmod +x "$DIR/ukify"
+
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --init /usr/local/bin/myinit --uki "$DIR/image.efi" --uki.ukify "$DIR/ukify" --uki.cmdline "console=ttyS0" "$DIR/initrd.gz"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	[[ "$(cat "$DIR/ukify.args")" == "build "*"--initrd=$DIR/initrd.gz "*"--output=$DIR/image.efi --cmdline=console=ttyS0" ]]
+	cmp "$DIR/ukify.linux" "$DIR/boot/vmlinuz-test"
+	grep -q '^ID=' "$DIR/ukify.os-release"
+
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --uki "$DIR/image.efi" -
+	[ "$status" -ne 0 ]
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --uki.cmdline "console=ttyS0" "$DIR/invalid"
+	[ "$status" -ne 0 ]
+	umoci initramfs --image "${IMAGE}:${TAG}-kernel" --init /usr/local/bin/myinit --uki "$DIR/image.efi" --uki.ukify /bin/false "$DIR/invalid"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,215 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci insert [missing args]" {
+	umoci insert
+	[ "$status" -ne 0 ]
+
+	# --tar is mandatory.
+	umoci insert --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}" --tar /nonexistent
+	[ "$status" -ne 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}-nonexistent" --tar - </dev/null
+	[ "$status" -ne 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}" --tar - too many
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci insert --tar" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nhistory="$(echo "$output" | jq -SM '.history | length')"
+
+	mkdir -p "$SOURCE/opt/app"
+	echo "inserted" >"$SOURCE/opt/app/file"
+	ln -s file "$SOURCE/opt/app/link"
+	sane_run tar -cf "$BATS_TMPDIR/insert.tar" -C "$SOURCE" .
+	[ "$status" -eq 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}" --tar "$BATS_TMPDIR/insert.tar" --tag "${TAG}-new" --history.comment "inserted layer"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must have been added.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "$((nhistory + 1))" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "inserted layer" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci insert" ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[[ "$(cat "$BUNDLE/rootfs/opt/app/file")" == "inserted" ]]
+	[[ "$(readlink "$BUNDLE/rootfs/opt/app/link")" == "file" ]]
+	# The base image is still present.
+	[ -f "$BUNDLE/rootfs/etc/passwd" ]
+}
+
+@test "umoci insert --tar -" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	echo "from stdin" >"$SOURCE/stdin-file"
+	mkdir -p "$SOURCE/etc"
+	touch "$SOURCE/etc/.wh.shadow"
+
+	# Compressed archives from stdin are accepted, and whiteouts are kept.
+	sane_run tar -czf "$BATS_TMPDIR/stdin.tar.gz" -C "$SOURCE" stdin-file etc/.wh.shadow
+	[ "$status" -eq 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --tar - --chmod /stdin-file:0600 <"$BATS_TMPDIR/stdin.tar.gz"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[[ "$(cat "$BUNDLE/rootfs/stdin-file")" == "from stdin" ]]
+	[[ "$(stat -c '%a' "$BUNDLE/rootfs/stdin-file")" == "600" ]]
+	[ -f "$BUNDLE/rootfs/etc/passwd" ]
+	[ ! -e "$BUNDLE/rootfs/etc/shadow" ]
+}
+
+@test "umoci insert --tar [invalid archive]" {
+	# Garbage is not a tar archive.
+	head -c 4096 /dev/urandom >"$BATS_TMPDIR/garbage.tar"
+	umoci insert --image "${IMAGE}:${TAG}" --tar "$BATS_TMPDIR/garbage.tar" --tag "${TAG}-new"
+	[ "$status" -ne 0 ]
+
+	# The tag must not have been created.
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-new"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci insert [multiple layers]" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nhistory="$(echo "$output" | jq -SM '.history | length')"
+	nblobs="$(find "${IMAGE}/blobs" -type f | wc -l)"
+
+	mkdir -p "$SOURCE/archive/opt" "$SOURCE/dir/sub"
+	echo "from archive" >"$SOURCE/archive/opt/archived"
+	echo "from file" >"$SOURCE/file"
+	echo "from dir" >"$SOURCE/dir/sub/nested"
+	sane_run tar -cf "$BATS_TMPDIR/multi.tar" -C "$SOURCE/archive" opt
+	[ "$status" -eq 0 ]
+
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-multi" \
+		--tar "$BATS_TMPDIR/multi.tar" \
+		--file "$SOURCE/file:/usr/bin/inserted" \
+		--file "$SOURCE/dir:/srv/dir" \
+		--config.env "INSERTED=yes" --config.cmd "/usr/bin/inserted"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Three layers and a configuration change were added.
+	umoci stat --image "${IMAGE}:${TAG}-multi" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "$((nhistory + 4))" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].empty_layer')" == "true" ]]
+
+	# Only one new manifest and configuration were created (as well as the
+	# three layers).
+	[[ "$(find "${IMAGE}/blobs" -type f | wc -l)" == "$((nblobs + 5))" ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-multi" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[[ "$(cat "$BUNDLE/rootfs/opt/archived")" == "from archive" ]]
+	[[ "$(cat "$BUNDLE/rootfs/usr/bin/inserted")" == "from file" ]]
+	[[ "$(cat "$BUNDLE/rootfs/srv/dir/sub/nested")" == "from dir" ]]
+
+	sane_run jq -SMr '.process.env[]' "$BUNDLE/config.json"
+	[[ "$output" == *"INSERTED=yes"* ]]
+	sane_run jq -SMr '.process.args[]' "$BUNDLE/config.json"
+	[[ "$output" == "/usr/bin/inserted" ]]
+
+	# Invalid --file arguments.
+	umoci insert --image "${IMAGE}:${TAG}" --file "$SOURCE/file"
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --file "$SOURCE/file:/"
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --tar - --tar - </dev/null
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci insert --config.user" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	# The user doesn't exist in the base image.
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user "appuser"
+	[ "$status" -ne 0 ]
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-new"* ]]
+
+	# ... but it is checked against the new layers.
+	mkdir -p "$SOURCE/etc"
+	cat >"$SOURCE/etc/passwd" <<-EOF
+	root:x:0:0:root:/root:/bin/sh
+	appuser:x:1234:5678:app user:/app:/bin/sh
+	EOF
+	echo "appgroup:x:5678:" >"$SOURCE/etc/group"
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --file "$SOURCE/etc:/etc" --config.user "appuser:appgroup"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run jq -SMr '.process.user.uid, .process.user.gid' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == 1234 ]]
+	[[ "${lines[1]}" == 5678 ]]
+
+	# The check can be disabled.
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-unchecked" --no-user-check --config.user "nonexistent"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,91 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci log" {
+	image-verify "${IMAGE}"
+
+	# Nothing is recorded until the reflog is enabled.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-before"
+	[ "$status" -eq 0 ]
+	umoci log --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 0 ]
+
+	umoci log --layout "${IMAGE}" --enable
+	[ "$status" -eq 0 ]
+
+	# Make some changes.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --config.user "1000:1000"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${IMAGE}:${TAG}-before"
+	[ "$status" -eq 0 ]
+
+	umoci log --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 3 ]
+	[ "$(echo "$output" | jq -r '.[0].ref_name')" == "${TAG}-before" ]
+	[ "$(echo "$output" | jq -r '.[0].new')" == "null" ]
+
+	# Only show the changes to one tag.
+	umoci log --layout "${IMAGE}" --json "${TAG}-new"
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 2 ]
+	[ "$(echo "$output" | jq -r '.[1].old')" == "null" ]
+	[ "$(echo "$output" | jq -r '.[0].old')" == "$(echo "$output" | jq -r '.[1].new')" ]
+	[[ "$(echo "$output" | jq -r '.[0].command | join(" ")')" == *"config"* ]]
+
+	# The default output should include the tags.
+	umoci log --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${TAG}-new"* ]]
+
+	# The reflog must survive garbage collection.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci log --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 3 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci init --reflog" {
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	umoci init --layout "$NEWIMAGE" --reflog
+	[ "$status" -eq 0 ]
+	umoci new --image "${NEWIMAGE}:latest"
+	[ "$status" -eq 0 ]
+
+	umoci log --layout "$NEWIMAGE" --json latest
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq 'length')" -eq 1 ]
+
+	image-verify "$NEWIMAGE"
+}
@@ -0,0 +1,133 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# make_legacy converts the image to the layout used by pre-1.0 versions of the
+# image-spec, with references stored in refs/ and the layers of the manifest
+# referenced by ${TAG} using a legacy media type.
+function make_legacy() {
+	mkdir -p "${IMAGE}/refs"
+	for name in $(jq -SMr '.manifests[] | .annotations["org.opencontainers.image.ref.name"]' "${IMAGE}/index.json"); do
+		jq -cM '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$name"'") | del(.annotations)' "${IMAGE}/index.json" >"${IMAGE}/refs/$name"
+	done
+
+	manifest="${IMAGE}/blobs/$(jq -SMr '.digest' "${IMAGE}/refs/${TAG}" | tr : /)"
+	legacy="$(setup_tmpdir)/manifest.json"
+	jq -cM '.layers[].mediaType = "application/vnd.oci.image.layer.tar+gzip"' "$manifest" >"$legacy"
+	digest="$(sha256sum "$legacy" | cut -d' ' -f1)"
+	size="$(stat -c '%s' "$legacy")"
+	mv "$legacy" "${IMAGE}/blobs/sha256/$digest"
+	jq -cM '.digest = "sha256:'"$digest"'" | .size = '"$size" "${IMAGE}/refs/${TAG}" >"$legacy"
+	mv "$legacy" "${IMAGE}/refs/${TAG}"
+
+	rm "${IMAGE}/index.json"
+}
+
+@test "umoci migrate" {
+	BUNDLE="$(setup_tmpdir)"
+	image-verify "${IMAGE}"
+
+	make_legacy
+	legacyRef="$(cat "${IMAGE}/refs/${TAG}")"
+
+	# The legacy image cannot be used until it is migrated.
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci migrate --layout "${IMAGE}" --check
+	[ "$status" -ne 0 ]
+	umoci migrate --layout "${IMAGE}" --rollback
+	[ "$status" -ne 0 ]
+
+	umoci migrate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ ! -d "${IMAGE}/refs" ]
+	image-verify "${IMAGE}"
+
+	umoci migrate --layout "${IMAGE}" --check
+	[ "$status" -eq 0 ]
+
+	# The references were moved to the index, and the media types updated.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.layers[].mediaType' "${IMAGE}/blobs/${output/://}"
+	[ "$status" -eq 0 ]
+	! echo "$output" | grep -v "application/vnd.oci.image.layer.v1.tar"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Another migration cannot be started while the backup exists.
+	umoci migrate --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	# Rolling back restores the legacy layout.
+	umoci migrate --layout "${IMAGE}" --rollback
+	[ "$status" -eq 0 ]
+	[ ! -f "${IMAGE}/index.json" ]
+	[[ "$(cat "${IMAGE}/refs/${TAG}")" == "$legacyRef" ]]
+
+	# Migrate again and discard the backup.
+	umoci migrate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci migrate --layout "${IMAGE}" --discard-backup
+	[ "$status" -eq 0 ]
+	umoci migrate --layout "${IMAGE}" --rollback
+	[ "$status" -ne 0 ]
+
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci migrate [legacy ref.name]" {
+	image-verify "${IMAGE}"
+
+	# Convert the tags to use the legacy annotation.
+	jq '.manifests[].annotations |= (with_entries(if .key == "org.opencontainers.image.ref.name" then .key = "org.opencontainers.ref.name" else . end))' \
+		"${IMAGE}/index.json" > "${IMAGE}/index.json.new"
+	mv "${IMAGE}/index.json.new" "${IMAGE}/index.json"
+
+	# The tag can still be used, but the image needs to be migrated.
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci migrate --layout "${IMAGE}" --check
+	[ "$status" -ne 0 ]
+
+	umoci migrate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci migrate --layout "${IMAGE}" --check
+	[ "$status" -eq 0 ]
+	sane_run jq -SMe '[.manifests[].annotations | has("org.opencontainers.ref.name")] | any | not' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci validate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,127 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+	export UMOCI_PLUGIN_DIR="$(setup_tmpdir)"
+
+	# A compressor plugin which uses gzip(1).
+	cat >"$UMOCI_PLUGIN_DIR/umoci-compressor-testgz" <<-'PLUGIN'
+	#!/bin/sh
+	case "$1" in
+	compress) exec gzip -c ;;
+	decompress) exec gzip -dc ;;
+	*) exit 4 ;;
+	esac
+	PLUGIN
+
+	# A transport plugin which stores images in a directory.
+	cat >"$UMOCI_PLUGIN_DIR/umoci-transport-testdir" <<-'PLUGIN'
+	#!/bin/sh
+	root="${2#testdir://}"
+	case "$1" in
+	create) mkdir -p "$root/blobs" && echo '{"schemaVersion":2,"manifests":[]}' >"$root/index.json" ;;
+	open) [ -f "$root/index.json" ] || exit 3 ;;
+	get-blob) [ -f "$root/blobs/$3" ] || exit 3; cat "$root/blobs/$3" ;;
+	put-blob) cat >"$root/blobs/$3" ;;
+	delete-blob) [ -f "$root/blobs/$3" ] || exit 3; rm "$root/blobs/$3" ;;
+	list-blobs) ls "$root/blobs" ;;
+	get-index) cat "$root/index.json" ;;
+	put-index) cat >"$root/index.json" ;;
+	*) exit 4 ;;
+	esac
+	PLUGIN
+
+	chmod +x "$UMOCI_PLUGIN_DIR"/umoci-*
+}
+
+function teardown() {
+	unset UMOCI_PLUGIN_DIR
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci repack --compress [plugin]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	echo "plugin" > "$BUNDLE_A/rootfs/plugin-file"
+
+	umoci repack --compress testgz --image "${IMAGE}:${TAG}-plugin" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+
+	# The new layer uses the media type of the plugin.
+	manifest=$(cat "${IMAGE}/index.json" | jq -r ".manifests[] | select(.annotations[\"org.opencontainers.image.ref.name\"] == \"${TAG}-plugin\") | .digest")
+	mediatype=$(jq -r '.layers[-1].mediaType' "${IMAGE}/blobs/${manifest/://}")
+	[[ "$mediatype" == "application/vnd.oci.image.layer.v1.tar+testgz" ]]
+
+	# ... and can be unpacked using the plugin.
+	umoci unpack --image "${IMAGE}:${TAG}-plugin" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$BUNDLE_B/rootfs/plugin-file")" == "plugin" ]]
+
+	# ... but not without it.
+	UMOCI_PLUGIN_DIR="$(setup_tmpdir)" umoci unpack --image "${IMAGE}:${TAG}-plugin" "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+	UMOCI_NO_PLUGINS=1 umoci unpack --image "${IMAGE}:${TAG}-plugin" "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+
+	# Unknown algorithms are rejected.
+	umoci repack --compress nonexistent --image "${IMAGE}:${TAG}-bad" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci [transport plugin]" {
+	REMOTE="testdir://$(setup_tmpdir)/image"
+
+	umoci init --layout "$REMOTE"
+	[ "$status" -eq 0 ]
+	umoci new --image "$REMOTE:new"
+	[ "$status" -eq 0 ]
+	umoci config --image "$REMOTE:new" --config.user 1000 --tag configured
+	[ "$status" -eq 0 ]
+
+	umoci ls --layout "$REMOTE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"configured"* ]]
+
+	umoci gc --layout "$REMOTE"
+	[ "$status" -eq 0 ]
+
+	# Missing images are reported.
+	umoci stat --image "testdir://$(setup_tmpdir)/nonexistent:latest"
+	[ "$status" -ne 0 ]
+
+	# Unknown schemes are rejected.
+	umoci stat --image "unknown://image:latest"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci [invalid plugins]" {
+	# Plugins cannot replace built-in compressors, but they are only ignored.
+	cp "$UMOCI_PLUGIN_DIR/umoci-compressor-testgz" "$UMOCI_PLUGIN_DIR/umoci-compressor-gzip"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${TAG}"* ]]
+
+	umoci --help
+	[ "$status" -eq 0 ]
+}
@@ -0,0 +1,59 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci --cpuprofile --memprofile --trace" {
+	PROFILES="$(setup_tmpdir)"
+
+	umoci --cpuprofile "$PROFILES/cpu.prof" --memprofile "$PROFILES/mem.prof" --trace "$PROFILES/trace.out" \
+		stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ -s "$PROFILES/cpu.prof" ]
+	[ -s "$PROFILES/mem.prof" ]
+	[ -s "$PROFILES/trace.out" ]
+
+	# Profiles are still written if the command fails.
+	umoci --cpuprofile "$PROFILES/cpu-fail.prof" stat --image "${IMAGE}:does-not-exist"
+	[ "$status" -ne 0 ]
+	[ -s "$PROFILES/cpu-fail.prof" ]
+
+	# The profile paths must be writeable.
+	umoci --cpuprofile "$PROFILES/nonexistent/cpu.prof" stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci --trace-endpoint" {
+	# The endpoint must be an http(s) URL.
+	umoci --trace-endpoint "ftp://localhost/traces" stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	UMOCI_TRACE_ENDPOINT="localhost:4318" umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Failing to export telemetry doesn't cause the command to fail.
+	umoci --trace-endpoint "http://127.0.0.1:1" stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"trace export"* ]]
+}
@@ -0,0 +1,119 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci prune [missing args]" {
+	umoci prune
+	[ "$status" -ne 0 ]
+
+	# At least one rule is required.
+	umoci prune --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci prune --layout "${IMAGE}" --keep-last "nightly-=x"
+	[ "$status" -ne 0 ]
+
+	umoci prune --layout "${IMAGE}" --keep-newer-than "forever"
+	[ "$status" -ne 0 ]
+
+	umoci prune --layout "${IMAGE}" --keep-last 1 --protect "("
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci prune --keep-last" {
+	for i in 1 2 3 4; do
+		umoci config --image "${IMAGE}:${TAG}" --tag "nightly-$i" --created "2017-10-0${i}T00:00:00Z"
+		[ "$status" -eq 0 ]
+	done
+	image-verify "${IMAGE}"
+
+	# Nothing is removed in dry-run mode.
+	umoci prune --layout "${IMAGE}" --keep-last "nightly-=2" --dry-run
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[0]}" == "nightly-1" ]]
+	[[ "${lines[1]}" == "nightly-2" ]]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 5 ]
+
+	# Only the two most recent nightly tags are kept, and other tags are not
+	# touched.
+	umoci prune --layout "${IMAGE}" --keep-last "nightly-=2" --protect "^nightly-1$"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 4 ]
+	[[ "$output" == *"${TAG}"* ]]
+	[[ "$output" == *"nightly-1"* ]]
+	[[ "$output" != *"nightly-2"* ]]
+	[[ "$output" == *"nightly-3"* ]]
+	[[ "$output" == *"nightly-4"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci prune --keep-newer-than" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Create an old image with its own layer.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "old" > "$BUNDLE/rootfs/umoci-old"
+	umoci repack --image "${IMAGE}:old" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:old" --created "2000-01-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "new" --created "$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	umoci prune --layout "${IMAGE}" --keep-newer-than 24h --protect "^${TAG}$"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "old" ]]
+	image-verify "${IMAGE}"
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"old"* ]]
+	[[ "$output" == *"new"* ]]
+
+	# The blobs only used by the old image were garbage collected.
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -lt "$nblobs" ]
+
+	image-verify "${IMAGE}"
+}
@@ -220,8 +220,9 @@ function teardown() {
 @test "umoci raw runtime-config --config.user 'user:group' [non-existent user]" {
 	BUNDLE="$(setup_tmpdir)"
 
-	# Modify the user.
-	umoci config --image "${IMAGE}:${TAG}" --config.user="testuser:emptygroup"
+	# Modify the user. The user doesn't exist in the image, so umoci-config(1)
+	# would refuse to set it without --no-user-check.
+	umoci config --image "${IMAGE}:${TAG}" --no-user-check --config.user="testuser:emptygroup"
 	[ "$status" -eq 0 ]
 	image-verify "${IMAGE}"
 
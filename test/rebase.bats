@@ -0,0 +1,120 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci rebase [missing args]" {
+	umoci rebase
+	[ "$status" -ne 0 ]
+
+	# --new-base is mandatory.
+	umoci rebase --image "${IMAGE}:${TAG}" --old-base "${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci rebase --image "${IMAGE}:${TAG}" --new-base "${TAG}" too many arguments
+	[ "$status" -ne 0 ]
+
+	# Without a recorded base image, --old-base is mandatory.
+	umoci rebase --image "${IMAGE}:${TAG}" --new-base "${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci rebase --image "${IMAGE}:${TAG}" --old-base "${TAG}-nonexistent" --new-base "${TAG}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci rebase" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Create an application image on top of the base image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "application" > "$BUNDLE_A/rootfs/umoci-app"
+	umoci repack --image "${IMAGE}:${TAG}-app" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}-app" --config.user "1234:5678"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Create an updated base image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	echo "update" > "$BUNDLE_B/rootfs/umoci-update"
+	umoci repack --image "${IMAGE}:${TAG}-update" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The base layers don't match.
+	umoci rebase --image "${IMAGE}:${TAG}-app" --old-base "${TAG}-update" --new-base "${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Rebase the application image.
+	umoci rebase --image "${IMAGE}:${TAG}-app" --old-base "${TAG}" --new-base "${TAG}-update" --tag "${TAG}-rebased"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-update" --json
+	[ "$status" -eq 0 ]
+	nbaselayers="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+
+	umoci stat --image "${IMAGE}:${TAG}-rebased" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq "$((nbaselayers + 1))" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci rebase" ]]
+
+	# The rootfs should contain both the update and the application, and the
+	# configuration should be kept.
+	umoci unpack --image "${IMAGE}:${TAG}-rebased" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	[[ "$(cat "$BUNDLE_C/rootfs/umoci-app")" == "application" ]]
+	[[ "$(cat "$BUNDLE_C/rootfs/umoci-update")" == "update" ]]
+	[[ "$(jq -SMr '.process.user.uid' "$BUNDLE_C/config.json")" -eq 1234 ]]
+
+	# Rebasing again should use the recorded base image.
+	umoci rebase --image "${IMAGE}:${TAG}-rebased" --new-base "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nbaselayers="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+
+	umoci stat --image "${IMAGE}:${TAG}-rebased" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')" -eq "$((nbaselayers + 1))" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,108 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# diff_ids returns the diff_ids of the image with the given tag.
+function diff_ids() {
+	manifest="$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$1"'") | .digest' "${IMAGE}/index.json" | cut -d: -f2)"
+	config="$(jq -r '.config.digest' "${IMAGE}/blobs/sha256/$manifest" | cut -d: -f2)"
+	jq -r '.rootfs.diff_ids[]' "${IMAGE}/blobs/sha256/$config"
+}
+
+@test "umoci remap [missing args]" {
+	umoci remap
+	[ "$status" -ne 0 ]
+
+	# --from-map and --to-map are mandatory.
+	umoci remap --image "${IMAGE}:${TAG}" --from-map 0:0:65536
+	[ "$status" -ne 0 ]
+	umoci remap --image "${IMAGE}:${TAG}" --to-map 0:1337:65536
+	[ "$status" -ne 0 ]
+
+	umoci remap --image "${IMAGE}:${TAG}" --from-map invalid --to-map 0:1337:65536
+	[ "$status" -ne 0 ]
+
+	umoci remap --image "${IMAGE}:${TAG}" --from-map 0:0:65536 --to-map 0:1337:65536 too many arguments
+	[ "$status" -ne 0 ]
+
+	umoci remap --image "${IMAGE}:${TAG}-nonexistent" --from-map 0:0:65536 --to-map 0:1337:65536
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci remap" {
+	umoci remap --image "${IMAGE}:${TAG}" --from-map 0:0:65536 --to-map 0:1337:65536 --tag "${TAG}-remapped"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The layers have been rewritten.
+	[[ "$(diff_ids "${TAG}")" != "$(diff_ids "${TAG}-remapped")" ]]
+
+	# Remapping them back results in the same layers as an identity remapping
+	# (the original layers may not have been generated by umoci).
+	umoci remap --image "${IMAGE}:${TAG}-remapped" --from-map 0:1337:65536 --to-map 0:0:65536 --tag "${TAG}-restored"
+	[ "$status" -eq 0 ]
+	umoci remap --image "${IMAGE}:${TAG}" --from-map 0:0:65536 --to-map 0:0:65536 --tag "${TAG}-identity"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(diff_ids "${TAG}-identity")" == "$(diff_ids "${TAG}-restored")" ]]
+
+	# The history of the image records the remapping.
+	umoci stat --image "${IMAGE}:${TAG}-restored" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.history[-1].created_by')" == "umoci remap" ]]
+
+	# Ids outside of the mapping are rejected.
+	umoci remap --image "${IMAGE}:${TAG}" --from-map 0:1000:100 --to-map 0:2000:100
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci remap [unpack]" {
+	# We need to be able to create files owned by arbitrary ids.
+	requires root
+
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci remap --image "${IMAGE}:${TAG}" --from-map 0:0:65536 --to-map 0:1337:65536 --tag "${TAG}-remapped"
+	[ "$status" -eq 0 ]
+
+	umoci unpack --image "${IMAGE}:${TAG}-remapped" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Check that all of the files have an owner >=1337.
+	find "$BUNDLE/rootfs" -mindepth 1 | xargs stat -c '%u:%g' | awk -F: '{
+		if ($1 < 1337 || $1 >= 1337 + 65536)
+			exit 1;
+		if ($2 < 1337 || $2 >= 1337 + 65536)
+			exit 1;
+	}'
+
+	image-verify "${IMAGE}"
+}
@@ -213,6 +213,23 @@ function teardown() {
 	[ "$status" -eq 0 ]
 	[[ "$(echo "$output" | jq -SM '.history[-1].empty_layer')" == "null" ]]
 
+	# The replaced paths are whited-out before their new entries, and there are
+	# no whiteouts underneath the replaced directory.
+	layer="$(jq -SMr '.history[-1].layer.digest' <<<"$output")"
+	sane_run tar -tzf "$IMAGE/blobs/${layer/://}"
+	[ "$status" -eq 0 ]
+	entries="$(tr '\n' ' ' <<<"$output")"
+	[[ "$entries" == *".wh.etc etc "* ]]
+	[[ "$entries" == *"bin/.wh.sh bin/sh/ "* ]]
+	[[ "$entries" == *"usr/bin/.wh.env usr/bin/env "* ]]
+	[[ "$entries" != *"etc/.wh."* ]]
+
+	# The layer is extracted without any conflicts.
+	BUNDLE_C="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" --conflict-policy error "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
 	image-verify "${IMAGE}"
 }
 
@@ -323,6 +340,98 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci {un,re}pack --preserve-hardlink-count" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create a file and a hardlink to it.
+	echo "hardlinked" > "$BUNDLE_A/rootfs/hardlink_file"
+	ln -f "$BUNDLE_A/rootfs/hardlink_file" "$BUNDLE_A/rootfs/hardlink_old"
+
+	umoci repack --image "${IMAGE}:${TAG}-links" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-links" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Move the hardlink, so the file itself is unchanged.
+	mv "$BUNDLE_B/rootfs/hardlink_old" "$BUNDLE_B/rootfs/hardlink_new"
+
+	umoci repack --image "${IMAGE}:${TAG}-moved" --preserve-hardlink-count "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-moved" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	# The moved hardlink must still be linked to the file.
+	! [ -e "$BUNDLE_C/rootfs/hardlink_old" ]
+	sane_run stat -c 'ino=%i nlink=%h' "$BUNDLE_C/rootfs/hardlink_file"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"nlink=2" ]]
+	original="$output"
+	sane_run stat -c 'ino=%i nlink=%h' "$BUNDLE_C/rootfs/hardlink_new"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$original" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci {un,re}pack --mtree-output and --mtree" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	MTREE_DIR="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image, storing the mtree specification outside the bundle.
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-output "$MTREE_DIR/spec.mtree" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+
+	[ -f "$MTREE_DIR/spec.mtree" ]
+	! ls "$BUNDLE_A"/*.mtree
+	[[ "$(jq -SMr '.mtree_path' "$BUNDLE_A/umoci.json")" == "$MTREE_DIR/spec.mtree" ]]
+
+	# --mtree-output doesn't make sense with --rootfs-only.
+	umoci unpack --image "${IMAGE}:${TAG}" --rootfs-only --mtree-output "$MTREE_DIR/other.mtree" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	# Repack uses the recorded specification.
+	echo "mtree output" > "$BUNDLE_A/rootfs/mtree_file"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# An explicit specification can be given.
+	umoci repack --image "${IMAGE}:${TAG}-explicit" --mtree "$MTREE_DIR/spec.mtree" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci repack --image "${IMAGE}:${TAG}-missing" --mtree "$MTREE_DIR/nonexistent.mtree" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# The new layers must be the same.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	newLayer="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+	umoci stat --image "${IMAGE}:${TAG}-explicit" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].layer.digest')" == "$newLayer" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack [unpriv]" {
 	BUNDLE_A="$(setup_tmpdir)"
 	BUNDLE_B="$(setup_tmpdir)"
@@ -615,3 +724,434 @@ function teardown() {
 	! [ -e "$BUNDLE_D/rootfs/some nutty/path name" ]
 	! [ -e "$BUNDLE_D/rootfs/some nutty/path name/ here" ]
 }
+
+@test "umoci repack [--include and --exclude]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create some files, some of which should be filtered.
+	mkdir -p "$BUNDLE_A/rootfs/app/node_modules/.cache/pkg"
+	echo "cached" > "$BUNDLE_A/rootfs/app/node_modules/.cache/pkg/data"
+	echo "module" > "$BUNDLE_A/rootfs/app/node_modules/module.js"
+	echo "source" > "$BUNDLE_A/rootfs/app/main.py"
+	echo "compiled" > "$BUNDLE_A/rootfs/app/main.pyc"
+	echo "outside" > "$BUNDLE_A/rootfs/outside"
+
+	# Invalid patterns must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --exclude "[" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Repack the image with filters.
+	umoci repack --image "${IMAGE}:${TAG}-new" --include /app --exclude "*.pyc" --exclude "node_modules/.cache" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Re-extract to verify that the filtered paths weren't included.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[ -f "$BUNDLE_B/rootfs/app/main.py" ]
+	[[ "$(cat "$BUNDLE_B/rootfs/app/main.py")" == "source" ]]
+	[ -f "$BUNDLE_B/rootfs/app/node_modules/module.js" ]
+	! [ -e "$BUNDLE_B/rootfs/app/main.pyc" ]
+	! [ -e "$BUNDLE_B/rootfs/app/node_modules/.cache" ]
+	! [ -e "$BUNDLE_B/rootfs/outside" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [--chown and --chmod]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create some files.
+	mkdir -p "$BUNDLE_A/rootfs/app/bin"
+	echo "data" > "$BUNDLE_A/rootfs/app/data"
+	echo "tool" > "$BUNDLE_A/rootfs/app/bin/tool"
+	chmod 0600 "$BUNDLE_A/rootfs/app/bin/tool"
+	echo "other" > "$BUNDLE_A/rootfs/other"
+	chmod 0600 "$BUNDLE_A/rootfs/other"
+
+	# Invalid rules must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --chown /app:1000 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-new" --chmod /app:0999 "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Repack the image with rules.
+	umoci repack --image "${IMAGE}:${TAG}-new" --chown /app:1000:1000 --chmod "/app/bin/*:0755" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The bundle itself must not have been modified.
+	sane_run stat -c '%a' "$BUNDLE_A/rootfs/app/bin/tool"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "600" ]]
+
+	# Re-extract to verify the rules were applied.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run stat -c '%a' "$BUNDLE_B/rootfs/app/bin/tool"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "755" ]]
+	sane_run stat -c '%a' "$BUNDLE_B/rootfs/other"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "600" ]]
+
+	# Ownership can only be checked if we're not rootless.
+	if [ "$ROOTLESS" -eq 0 ]; then
+		for path in app app/bin app/data app/bin/tool; do
+			sane_run stat -c '%u:%g' "$BUNDLE_B/rootfs/$path"
+			[ "$status" -eq 0 ]
+			[[ "$output" == "1000:1000" ]]
+		done
+		sane_run stat -c '%u:%g' "$BUNDLE_B/rootfs/other"
+		[ "$status" -eq 0 ]
+		[[ "$output" == "0:0" ]]
+	fi
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci {un,re}pack --min-free-space" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	# Invalid sizes must be rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --min-free-space fake "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --min-free-space 1G --skip-space-check "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# Nobody has this much free space.
+	umoci unpack --image "${IMAGE}:${TAG}" --min-free-space 1000000T "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"insufficient free space"* ]]
+	rm -rf "$BUNDLE_A"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --min-free-space 1M "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Make some changes.
+	dd if=/dev/zero of="$BUNDLE_A/rootfs/large" bs=1M count=4
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --min-free-space 1000000T "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"insufficient free space"* ]]
+	image-verify "${IMAGE}"
+
+	# The tag must not have been created.
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --skip-space-check "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[ -f "$BUNDLE_B/rootfs/large" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci {un,re}pack --scan-cmd" {
+	BUNDLE="$(setup_tmpdir)"
+	SCANDIR="$(setup_tmpdir)"
+
+	# A scanner which reports a finding for every layer containing "/vulnerable".
+	cat >"$SCANDIR/scan.sh" <<'SCAN'
+#!/bin/sh
+if tar -t | grep -qx 'vulnerable'; then
+	echo '[{"id": "TEST-0001", "severity": "high", "path": "/vulnerable"}]'
+fi
+SCAN
+	chmod +x "$SCANDIR/scan.sh"
+
+	# --scan-fail-on and --scan-report require --scan-cmd.
+	umoci unpack --image "${IMAGE}:${TAG}" --scan-fail-on high "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --scan-cmd "$SCANDIR/scan.sh" --scan-fail-on bogus "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" --scan-cmd "$SCANDIR/scan.sh" --scan-fail-on high --scan-report "$SCANDIR/unpack.json" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run jq -SMr 'length' "$SCANDIR/unpack.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	echo "bad" > "$BUNDLE/rootfs/vulnerable"
+
+	# A finding at or above the threshold must stop the tag being created.
+	umoci repack --image "${IMAGE}:${TAG}-new" --scan-cmd "$SCANDIR/scan.sh" --scan-fail-on high --scan-report "$SCANDIR/repack.json" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"TEST-0001"* ]]
+	image-verify "${IMAGE}"
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+	sane_run jq -SMr '.[0].id' "$SCANDIR/repack.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "TEST-0001" ]]
+
+	# Findings below the threshold are only reported.
+	umoci repack --image "${IMAGE}:${TAG}-new" --scan-cmd "$SCANDIR/scan.sh" --scan-fail-on critical "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Scanner failures are fatal.
+	umoci repack --image "${IMAGE}:${TAG}-new2" --scan-cmd "exit 1" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new2"
+	[ "$status" -ne 0 ]
+
+	# The findings are attributed to the new layer when unpacking.
+	NEWBUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-new" --scan-cmd "$SCANDIR/scan.sh" --scan-report "$SCANDIR/unpack.json" "$NEWBUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$NEWBUNDLE"
+	newLayer="$(jq -SMr '.[0].layer' "$SCANDIR/unpack.json")"
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].layer.digest')" == "$newLayer" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --platform.*" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The platform is derived from the configuration.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .platform.os' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "linux" ]]
+
+	# The platform can be overridden.
+	umoci repack --image "${IMAGE}:${TAG}-new" --platform.architecture arm --platform.variant v7 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .platform.architecture + "/" + .platform.variant' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "arm/v7" ]]
+
+	# The os and architecture cannot be empty.
+	umoci repack --image "${IMAGE}:${TAG}-new" --platform.os "" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --provenance" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	touch "$BUNDLE/rootfs/provenance-file"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --provenance-builder-id "https://example.com/builder" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The statement is tagged after the digest of the new manifest.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$output"
+	atttag="${manifest/:/-}.att"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$atttag"'") | .mediaType + " " + .annotations["org.opensuse.umoci.attestation.subject"]' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.in-toto+json $manifest" ]]
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$atttag"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	statement="$IMAGE/blobs/${output/://}"
+
+	sane_run jq -SMr '.predicateType + " " + .predicate.builder.id + " " + .subject[0].digest.sha256' "$statement"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "https://slsa.dev/provenance/v0.2 https://example.com/builder ${manifest#sha256:}" ]]
+
+	# The materials include the original manifest.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.predicate.materials[] | select(.uri == "oci:'"$output"'") | .uri' "$statement"
+	[ "$status" -eq 0 ]
+	[ -n "$output" ]
+
+	# The statement survives garbage collection.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "$statement" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --layer-provenance" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	touch "$BUNDLE/rootfs/provenance-file"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --layer-provenance "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	source="$output"
+
+	# Only the new layer has the annotations.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	statjson="$output"
+	sane_run jq -SMr '[.history[] | select(.layer != null) | .layer.annotations["org.opensuse.umoci.layer.source"] // "none"] | join(" ")' <<<"$statjson"
+	[ "$status" -eq 0 ]
+	[[ "$output" =~ ^(none )*${source}$ ]]
+
+	sane_run jq -SMr '[.history[] | select(.layer != null)][-1].layer.annotations["org.opensuse.umoci.layer.hostname"]' <<<"$statjson"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(hostname)" ]]
+
+	sane_run jq -SMr '[.history[] | select(.layer != null)][-1].layer.annotations["org.opensuse.umoci.layer.bundle"]' <<<"$statjson"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "sha256:$(echo -n "$(realpath -s "$BUNDLE")" | sha256sum | cut -d' ' -f1)" ]]
+
+	# The provenance is also displayed without --json.
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep "HOSTNAME"
+	echo "$output" | grep "$source"
+
+	# Images without provenance don't display it.
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	! echo "$output" | grep "HOSTNAME"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --prefetch-profile" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir -p "$BUNDLE_A/rootfs/prefetch/cold" "$BUNDLE_A/rootfs/prefetch/hot"
+	echo "cold" > "$BUNDLE_A/rootfs/prefetch/cold/file"
+	echo "hot" > "$BUNDLE_A/rootfs/prefetch/hot/file"
+
+	PROFILE="$(setup_tmpdir)/profile"
+	cat >"$PROFILE" <<-EOF
+	# Files accessed on startup.
+	/prefetch/hot/file
+	/prefetch/nonexistent
+	EOF
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --prefetch-profile "$PROFILE" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The hot file comes before the landmark, and the cold file after it.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layer="$(jq -SMr '.history[-1].layer.digest' <<<"$output")"
+	sane_run tar -tzf "$IMAGE/blobs/${layer/://}"
+	[ "$status" -eq 0 ]
+	entries="$(tr '\n' ' ' <<<"$output")"
+	[[ "$entries" == *"prefetch/hot/file .prefetch.landmark "*"prefetch/cold/file"* ]]
+
+	# Landmarks are not extracted.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	! [ -e "$BUNDLE_B/rootfs/.prefetch.landmark" ]
+	[[ "$(cat "$BUNDLE_B/rootfs/prefetch/hot/file")" == "hot" ]]
+
+	# Without any of the paths in the new layer, there is a different landmark.
+	echo "/nonexistent" >"$PROFILE"
+	touch "$BUNDLE_B/rootfs/prefetch/other"
+	umoci repack --image "${IMAGE}:${TAG}-new2" --prefetch-profile "$PROFILE" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new2" --json
+	[ "$status" -eq 0 ]
+	layer="$(jq -SMr '.history[-1].layer.digest' <<<"$output")"
+	sane_run tar -tzf "$IMAGE/blobs/${layer/://}"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == ".no.prefetch.landmark" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --ignore-keyword" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Only change the mode of an existing file, and add a new file.
+	chmod 0600 "$BUNDLE/rootfs/etc/passwd"
+	echo "new" > "$BUNDLE/rootfs/newfile"
+
+	# Unknown keywords are rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --ignore-keyword mode,bogus "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --ignore-keyword mode,uid --ignore-keyword gid "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The mode change is not in the new layer.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	layer="$(jq -SMr '.history[-1].layer.digest' <<<"$output")"
+	sane_run tar -tzf "$IMAGE/blobs/${layer/://}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" != *"etc/passwd"* ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,78 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+ADDRESS="127.0.0.1:5123"
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	[ -z "$SERVE_PID" ] || kill "$SERVE_PID"
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci serve" {
+	command -v curl >/dev/null || skip "test requires curl"
+
+	"$UMOCI" serve --layout "${IMAGE}" --address "$ADDRESS" &
+	SERVE_PID="$!"
+	for _ in $(seq 50); do
+		curl -sf "http://$ADDRESS/v2/" && break
+		sleep 0.1
+	done
+
+	# Get the manifest of the tag.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$output"
+
+	sane_run curl -sf "http://$ADDRESS/v2/test/manifests/${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$(echo -n "$output" | sha256sum | cut -d' ' -f1)" == "${manifest#sha256:}" ]]
+
+	sane_run curl -sf "http://$ADDRESS/v2/test/manifests/$manifest"
+	[ "$status" -eq 0 ]
+
+	# Every blob must be available.
+	for blob in $(jq -r '.config.digest, .layers[].digest' "${IMAGE}/blobs/sha256/${manifest#sha256:}"); do
+		[[ "$(curl -sf "http://$ADDRESS/v2/test/blobs/$blob" | sha256sum | cut -d' ' -f1)" == "${blob#sha256:}" ]]
+	done
+
+	# The tag must be listed.
+	sane_run curl -sf "http://$ADDRESS/v2/test/tags/list"
+	[ "$status" -eq 0 ]
+	echo "$output" | jq -e '.tags | index("'"${TAG}"'")'
+
+	# Missing tags and pushes must fail.
+	sane_run curl -sf "http://$ADDRESS/v2/test/manifests/${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+	sane_run curl -sf -X PUT "http://$ADDRESS/v2/test/manifests/${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci serve [missing args]" {
+	umoci serve
+	[ "$status" -ne 0 ]
+
+	umoci serve --layout "${IMAGE}" extra
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,100 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci begin + commit" {
+	BUNDLE="$(setup_tmpdir)"
+	image-verify "${IMAGE}"
+
+	# There is no session yet.
+	umoci commit --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	umoci rollback --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci begin --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# Only one session at a time.
+	umoci begin --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	# Make some changes within the session.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "session" > "$BUNDLE/rootfs/session"
+	umoci repack --image "${IMAGE}:${TAG}-session" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-session" --config.user "1000:1000"
+	[ "$status" -eq 0 ]
+
+	# The session can see the new tag, but the image itself is unchanged.
+	umoci stat --image "${IMAGE}:${TAG}-session"
+	[ "$status" -eq 0 ]
+	[ "$(jq '[.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-session"'")] | length' "${IMAGE}/index.json")" -eq 0 ]
+
+	umoci commit --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ ! -e "${IMAGE}/.umoci-session" ]
+	image-verify "${IMAGE}"
+
+	# The new tag must now be part of the image.
+	[ "$(jq '[.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-session"'")] | length' "${IMAGE}/index.json")" -eq 1 ]
+	umoci validate --layout "${IMAGE}" "${TAG}-session"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci begin + rollback" {
+	image-verify "${IMAGE}"
+	cp "${IMAGE}/index.json" "$BATS_TMPDIR/index.json"
+	find "${IMAGE}/blobs" -type f | sort > "$BATS_TMPDIR/blobs"
+
+	umoci begin --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# Remove the tag and garbage collect within the session.
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci rollback --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ ! -e "${IMAGE}/.umoci-session" ]
+
+	# The image must be unchanged.
+	cmp "${IMAGE}/index.json" "$BATS_TMPDIR/index.json"
+	find "${IMAGE}/blobs" -type f | sort | cmp - "$BATS_TMPDIR/blobs"
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,95 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+
+	# Use a throwaway keyring with a single (passphrase-less) key.
+	export GNUPGHOME="$(setup_tmpdir)"
+	sane_run gpg --batch --passphrase "" --quick-gen-key "umoci test <umoci-test@example.com>" default default never
+	[ "$status" -eq 0 ]
+}
+
+function teardown() {
+	unset GNUPGHOME
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci repack --sign-key" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A/bundle"
+	[ "$status" -eq 0 ]
+
+	# Unsigned images fail verification.
+	umoci unpack --image "${IMAGE}:${TAG}" --verify-key "" "$BUNDLE_B/unsigned"
+	[ "$status" -ne 0 ]
+
+	touch "$BUNDLE_A/bundle/rootfs/umoci-signed"
+	umoci repack --image "${IMAGE}:${TAG}-signed" --sign-key "umoci-test@example.com" "$BUNDLE_A/bundle"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The signature is stored in the index.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-signed"'") | .annotations["org.opensuse.umoci.signature.pgp"]' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"BEGIN PGP SIGNATURE"* ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-signed" --verify-key "umoci-test@example.com" "$BUNDLE_B/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B/bundle"
+
+	# The signature must be made by the given key.
+	sane_run gpg --batch --passphrase "" --quick-gen-key "umoci other <umoci-other@example.com>" default default never
+	[ "$status" -eq 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-signed" --verify-key "umoci-other@example.com" "$BUNDLE_B/other"
+	[ "$status" -ne 0 ]
+
+	# Copying the tag keeps the signature, but modifying the image drops it.
+	umoci tag --image "${IMAGE}:${TAG}-signed" "${TAG}-copy"
+	[ "$status" -eq 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-copy" --verify-key "" "$BUNDLE_B/copy"
+	[ "$status" -eq 0 ]
+
+	umoci config --image "${IMAGE}:${TAG}-copy" --config.user "1000:1000"
+	[ "$status" -eq 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-copy" --verify-key "" "$BUNDLE_B/modified"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci tag --sign-key" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci tag --image "${IMAGE}:${TAG}" --sign-key "umoci-test@example.com" "${TAG}-signed"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-signed" --verify-key "umoci-test@example.com" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+
+	# Signing with a key which doesn't exist fails.
+	umoci tag --image "${IMAGE}:${TAG}" --sign-key "umoci-missing@example.com" "${TAG}-missing"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
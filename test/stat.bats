@@ -48,6 +48,38 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci stat --format" {
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	# The template is executed for each history entry.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.CreatedBy}}'
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.history | length' "$statFile"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$output" ]
+
+	# Empty layers have no layer descriptor.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{if .Layer}}{{.Layer.Digest}}{{else}}empty{{end}} {{json .EmptyLayer}}'
+	[ "$status" -eq 0 ]
+	for line in "${lines[@]}"; do
+		[[ "$line" == "sha256:"*" false" ]] || [[ "$line" == "empty true" ]]
+	done
+
+	# --format and --json are mutually exclusive, and invalid templates are
+	# rejected.
+	umoci stat --image "${IMAGE}:${TAG}" --json --format '{{.CreatedBy}}'
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.CreatedBy'
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 # We can't really test the output for non-JSON output, but we can smoke test it.
 @test "umoci stat [smoke]" {
 	image-verify "${IMAGE}"
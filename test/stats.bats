@@ -0,0 +1,100 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci stats [missing args]" {
+	umoci stats
+	[ "$status" -ne 0 ]
+
+	umoci stats --layout "${IMAGE}" --top -1
+	[ "$status" -ne 0 ]
+
+	umoci stats --layout "${IMAGE}" too many arguments
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci stats --json" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Add a new layer with a large file on top of the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	dd if=/dev/zero of="$BUNDLE/rootfs/bigfile" bs=1M count=4
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stats --layout "${IMAGE}" --top 1 --json
+	[ "$status" -eq 0 ]
+
+	statsFile="$(setup_tmpdir)/stats"
+	echo "$output" > "$statsFile"
+
+	# Both tags should be listed.
+	sane_run jq -SMr '[.images[] | .tag] | index("'"${TAG}-new"'") != null' "$statsFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# The new tag has exactly one more layer than the original.
+	numLayersA="$(jq -SMr '.images[] | select(.tag == "'"$TAG"'") | .layers | length' "$statsFile")"
+	numLayersB="$(jq -SMr '.images[] | select(.tag == "'"${TAG}-new"'") | .layers | length' "$statsFile")"
+	[ "$numLayersB" -eq "$((numLayersA + 1))" ]
+
+	# The new layer's largest file must be the one we added.
+	newLayer="$(jq -SMr '.images[] | select(.tag == "'"${TAG}-new"'") | .layers[-1]' "$statsFile")"
+	sane_run jq -SMr '.layers[] | select(.layer.digest == "'"$newLayer"'") | .stats.largest_files[0].path' "$statsFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "/bigfile" ]]
+	sane_run jq -SMr '.layers[] | select(.layer.digest == "'"$newLayer"'") | .stats.uncompressed_size >= 4194304' "$statsFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# The base layers are shared between both tags.
+	sane_run jq -SMr '.shared_size > 0 and .unique_size > 0 and .total_size == .shared_size + .unique_size' "$statsFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	image-verify "${IMAGE}"
+}
+
+# We can't really test the output for non-JSON output, but we can smoke test it.
+@test "umoci stats [smoke]" {
+	image-verify "${IMAGE}"
+
+	umoci stats --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# We should have some layer and size information.
+	echo "$output" | grep 'LAYER'
+	echo "$output" | grep 'TOTAL'
+	echo "$output" | grep "$TAG"
+
+	image-verify "${IMAGE}"
+}
@@ -51,6 +51,29 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci list --format" {
+	image-verify "${IMAGE}"
+
+	# Output the name and digest of each tag.
+	umoci ls --layout "${IMAGE}" --format '{{.Name}} {{.Digest}} {{.MediaType}}'
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -gt 0 ]
+	for line in "${lines[@]}"; do
+		[[ "$line" == *" sha256:"*" application/vnd.oci.image.manifest.v1+json" ]]
+	done
+
+	# The tag we're using must be in the output.
+	umoci ls --layout "${IMAGE}" --format '{{.Name}}'
+	[ "$status" -eq 0 ]
+	printf '%s\n' "${lines[@]}" | grep -Fx "${TAG}"
+
+	# Invalid templates are an error.
+	umoci ls --layout "${IMAGE}" --format '{{.Name'
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci list [missing args]" {
 	umoci ls
 	[ "$status" -ne 0 ]
@@ -130,6 +153,137 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci tag --digest" {
+	# Get the digest of the manifest the tag references.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$output"
+
+	# Untag the manifest, and then tag it by digest.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-copy"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci rm --image "${IMAGE}:${TAG}-copy"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci tag --image "${IMAGE}" --digest "$manifest" "${TAG}-digest"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Make sure that the new tag is the same.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${IMAGE}:${TAG}-digest" --json
+	[ "$status" -eq 0 ]
+	newOutput="$output"
+	[[ "$oldOutput" == "$newOutput" ]]
+
+	# Configuration blobs cannot be tagged.
+	sane_run jq -SMr '.config.digest' "${IMAGE}/blobs/sha256/${manifest#sha256:}"
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}" --digest "$output" "${TAG}-config"
+	[ "$status" -ne 0 ]
+
+	# Missing blobs cannot be tagged.
+	umoci tag --image "${IMAGE}" --digest "sha256:$(printf '%064d' 0)" "${TAG}-missing"
+	[ "$status" -ne 0 ]
+
+	# A source tag cannot be used with --digest.
+	umoci tag --image "${IMAGE}:${TAG}" --digest "$manifest" "${TAG}-both"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci tag --expect-digest" {
+	# Create a new image to swap the tag to.
+	image-verify "${IMAGE}"
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user "1234:1234"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	oldManifest="$output"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	newManifest="$output"
+
+	# An empty digest requires the tag to not exist.
+	umoci tag --image "${IMAGE}:${TAG}" --expect-digest "" "${TAG}-swap"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci tag --image "${IMAGE}:${TAG}-new" --expect-digest "" "${TAG}-swap"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# A stale digest must not clobber the tag.
+	umoci tag --image "${IMAGE}:${TAG}-new" --expect-digest "$newManifest" "${TAG}-swap"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-swap"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$oldManifest" ]]
+
+	# The current digest allows the tag to be replaced.
+	umoci tag --image "${IMAGE}:${TAG}-new" --expect-digest "$oldManifest" "${TAG}-swap"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-swap"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$newManifest" ]]
+
+	# Invalid digests are rejected.
+	umoci tag --image "${IMAGE}:${TAG}" --expect-digest "sha256:invalid" "${TAG}-swap"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci tag [reference names]" {
+	# Names with slashes and registry-style tags are valid.
+	for name in "opensuse/leap" "opensuse/leap:42.3" "registry.example.com/opensuse/leap:42.3"; do
+		umoci tag --image "${IMAGE}:${TAG}" "$name"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+
+		umoci stat --image "${IMAGE}:${TAG}" --json
+		[ "$status" -eq 0 ]
+		oldOutput="$output"
+		umoci stat --image "${IMAGE}:${name}" --json
+		[ "$status" -eq 0 ]
+		[[ "$oldOutput" == "$output" ]]
+
+		umoci ls --layout "${IMAGE}"
+		[ "$status" -eq 0 ]
+		printf '%s\n' "${lines[@]}" | grep -Fx -- "$name"
+
+		umoci rm --image "${IMAGE}:${name}"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+
+	# Names joined by several "_" are still valid, as they were accepted by
+	# older versions of umoci.
+	umoci tag --image "${IMAGE}:${TAG}" "foo__bar"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:foo__bar" --json
+	[ "$status" -eq 0 ]
+	umoci fsck --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${IMAGE}:foo__bar"
+	[ "$status" -eq 0 ]
+
+	# Names which don't conform to the image-layout spec are not.
+	for name in "-leading" "trailing-" "opensuse//leap" "/opensuse" "a..b" "with space"; do
+		umoci tag --image "${IMAGE}:${TAG}" "$name"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci remove" {
 	# How many tags?
 	umoci list --layout "${IMAGE}"
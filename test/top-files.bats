@@ -0,0 +1,99 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci top-files [missing args]" {
+	umoci top-files
+	[ "$status" -ne 0 ]
+
+	umoci top-files --image "${IMAGE}:${TAG}" --top -1
+	[ "$status" -ne 0 ]
+
+	umoci top-files --image "${IMAGE}:${TAG}" too many arguments
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci top-files --json" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Add a large file in one layer.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir -p "$BUNDLE_A/rootfs/umoci-test"
+	dd if=/dev/zero of="$BUNDLE_A/rootfs/umoci-test/bigfile" bs=1M count=16
+	umoci repack --image "${IMAGE}:${TAG}-big" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci top-files --image "${IMAGE}:${TAG}-big" --top 1 --json
+	[ "$status" -eq 0 ]
+
+	# The file should be the largest file, and its directory the largest
+	# directory.
+	[[ "$(echo "$output" | jq -SMr '.files[0].path')" == "/umoci-test/bigfile" ]]
+	[[ "$(echo "$output" | jq -SMr '.files[0].size')" -eq 16777216 ]]
+	[[ "$(echo "$output" | jq -SMr '.directories[0].path')" == "/umoci-test" ]]
+	[[ "$(echo "$output" | jq -SMr '.wasted | length')" -eq 0 ]]
+
+	# Now remove the file in another layer.
+	umoci unpack --image "${IMAGE}:${TAG}-big" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	rm -rf "$BUNDLE_B/rootfs/umoci-test"
+	umoci repack --image "${IMAGE}:${TAG}-removed" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci top-files --image "${IMAGE}:${TAG}-removed" --top 1 --json
+	[ "$status" -eq 0 ]
+
+	# The file should now be wasted space.
+	[[ "$(echo "$output" | jq -SMr '.files[0].path')" != "/umoci-test/bigfile" ]]
+	[[ "$(echo "$output" | jq -SMr '.wasted[0].path')" == "/umoci-test/bigfile" ]]
+	[[ "$(echo "$output" | jq -SMr '.wasted[0].deleted')" == "true" ]]
+	[[ "$(echo "$output" | jq -SMr '.wasted_size')" -ge 16777216 ]]
+
+	image-verify "${IMAGE}"
+}
+
+# We can't really test the output for non-JSON output, but we can smoke test it.
+@test "umoci top-files [smoke]" {
+	image-verify "${IMAGE}"
+
+	umoci top-files --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	echo "$output" | grep 'FILE'
+	echo "$output" | grep 'WASTED'
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,194 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+ADDRESS="127.0.0.1:5125"
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	[ -z "$SERVE_PID" ] || kill "$SERVE_PID"
+	teardown_tmpdirs
+	teardown_image
+}
+
+function start_serve() {
+	"$UMOCI" serve --layout "${IMAGE}" --address "$ADDRESS" &
+	SERVE_PID="$!"
+	for _ in $(seq 50); do
+		(exec 3<>"/dev/tcp/${ADDRESS%:*}/${ADDRESS#*:}") 2>/dev/null && break
+		sleep 0.1
+	done
+}
+
+@test "umoci unpack [registry]" {
+	start_serve
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A/bundle"
+
+	umoci unpack --plain-http --image "docker://$ADDRESS/image:${TAG}" "$BUNDLE_B/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B/bundle"
+
+	# The two bundles must be identical.
+	sane_run diff -r --no-dereference "$BUNDLE_A/bundle/rootfs" "$BUNDLE_B/bundle/rootfs"
+	[ "$status" -eq 0 ]
+
+	# HTTPS is used by default.
+	umoci unpack --image "docker://$ADDRESS/image:${TAG}" "$BUNDLE_B/bundle2"
+	[ "$status" -ne 0 ]
+
+	# Missing tags must fail.
+	umoci unpack --plain-http --image "docker://$ADDRESS/image:${TAG}-nonexistent" "$BUNDLE_B/bundle3"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [registry] --keep-blobs" {
+	start_serve
+
+	BUNDLE="$(setup_tmpdir)"
+	KEEP="$(setup_tmpdir)/image"
+
+	umoci unpack --plain-http --keep-blobs "$KEEP" --image "docker://$ADDRESS/image:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+	image-verify "$KEEP"
+
+	# The tag must have been created in the kept image.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+	umoci stat --image "${KEEP}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	# The bundle can be repacked using the kept image.
+	echo "modified" > "$BUNDLE/bundle/rootfs/umoci-modified"
+	umoci repack --image "${KEEP}:${TAG}-new" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	image-verify "$KEEP"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [registry] --limit-rate --max-connections" {
+	start_serve
+
+	BUNDLE="$(setup_tmpdir)"
+	KEEP="$(setup_tmpdir)/image"
+
+	# A single connection must be enough, even when keeping blobs.
+	umoci unpack --plain-http --limit-rate 1M --max-connections 1 --keep-blobs "$KEEP" --image "docker://$ADDRESS/image:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+	image-verify "$KEEP"
+
+	# Invalid limits must be rejected.
+	umoci unpack --plain-http --limit-rate -1M --image "docker://$ADDRESS/image:${TAG}" "$BUNDLE/bundle2"
+	[ "$status" -ne 0 ]
+	umoci unpack --plain-http --max-connections -1 --image "docker://$ADDRESS/image:${TAG}" "$BUNDLE/bundle2"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [registry] short names" {
+	start_serve
+
+	BUNDLE="$(setup_tmpdir)"
+	CONFIG="$(setup_tmpdir)/registries.conf"
+	export CONTAINERS_REGISTRIES_CONF="$CONFIG"
+
+	# Without any configuration, short names cannot be resolved.
+	umoci unpack --plain-http --image "docker://image:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+
+	# A single search registry is used, even in enforcing mode.
+	cat >"$CONFIG" <<-EOF
+	unqualified-search-registries = ["$ADDRESS"]
+	EOF
+	umoci unpack --plain-http --image "docker://image:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+
+	# Several search registries are ambiguous in enforcing mode.
+	cat >"$CONFIG" <<-EOF
+	unqualified-search-registries = ["127.0.0.1:1", "$ADDRESS"]
+	EOF
+	umoci unpack --plain-http --image "docker://image:${TAG}" "$BUNDLE/bundle2"
+	[ "$status" -ne 0 ]
+
+	# But are tried in turn in permissive mode (set in a drop-in).
+	mkdir "$CONFIG.d"
+	cat >"$CONFIG.d/mode.conf" <<-EOF
+	short-name-mode = "permissive"
+	EOF
+	umoci unpack --plain-http --image "docker://image:${TAG}" "$BUNDLE/bundle2"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle2"
+
+	# Aliases take precedence over search registries.
+	cat >"$CONFIG" <<-EOF
+	unqualified-search-registries = ["127.0.0.1:1"]
+
+	[aliases]
+	"myimage" = "$ADDRESS/image"
+	EOF
+	umoci unpack --plain-http --image "docker://myimage:${TAG}" "$BUNDLE/bundle3"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle3"
+
+	# Missing tags must fail in every search registry.
+	umoci unpack --plain-http --image "docker://image:${TAG}-nonexistent" "$BUNDLE/bundle4"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [registry] invalid arguments" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# --keep-blobs, --plain-http, --limit-rate and --max-connections only make
+	# sense with registries.
+	umoci unpack --keep-blobs "$(setup_tmpdir)/image" --image "${IMAGE}:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+	umoci unpack --plain-http --image "${IMAGE}:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+	umoci unpack --limit-rate 1M --image "${IMAGE}:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+	umoci unpack --max-connections 2 --image "${IMAGE}:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+
+	# --reuse-bundles needs a local image.
+	umoci unpack --reuse-bundles --image "docker://$ADDRESS/image:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+
+	# Other commands don't support registries.
+	umoci stat --image "docker://$ADDRESS/image:${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
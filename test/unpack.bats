@@ -64,6 +64,521 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack --rootfs-only" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack only the rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}" --rootfs-only "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# There should be a rootfs, but no config.json or mtree.
+	[ -d "$BUNDLE/rootfs" ]
+	[ -e "$BUNDLE/rootfs/bin/sh" ]
+	[ -e "$BUNDLE/rootfs/etc/passwd" ]
+	! [ -e "$BUNDLE/config.json" ]
+	! ls "$BUNDLE"/sha256_*.mtree
+
+	# The bundle must not be repackable.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --resume" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Resuming a bundle without any recorded progress must fail.
+	umoci unpack --image "${IMAGE}:${TAG}" --resume "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	! [ -e "$BUNDLE_A/rootfs" ]
+
+	# Do a full unpack to compare against.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	! [ -e "$BUNDLE_A/rootfs.umoci-progress" ]
+
+	# Fake an unpack that was interrupted before any layers were applied.
+	umoci ls --layout "${IMAGE}" --format '{{.Name}} {{.Digest}}'
+	[ "$status" -eq 0 ]
+	manifest="$(echo "$output" | awk -v tag="$TAG" '$1 == tag { print $2 }')"
+	config="$(jq -r '.config.digest' "$IMAGE/blobs/sha256/${manifest#sha256:}")"
+	mkdir "$BUNDLE_B/rootfs"
+	map_options="$(jq -c '.map_options' "$BUNDLE_A/umoci.json")"
+	echo '{"config": "'"$config"'", "layers": [], "map_options": '"$map_options"'}' >"$BUNDLE_B/rootfs.umoci-progress"
+
+	# A normal unpack must refuse to touch the bundle.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	# Resuming with different options must fail.
+	umoci unpack --image "${IMAGE}:${TAG}" --conflict-policy warn --resume "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+	[ -e "$BUNDLE_B/rootfs.umoci-progress" ]
+
+	# Resuming should finish the unpack.
+	umoci unpack --image "${IMAGE}:${TAG}" --resume "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	! [ -e "$BUNDLE_B/rootfs.umoci-progress" ]
+
+	# Both bundles should be identical.
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --skip-space-check" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --skip-space-check "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --skip-base-layers" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	BUNDLE_D="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# --skip-base-layers requires --rootfs-only.
+	umoci unpack --image "${IMAGE}:${TAG}" --skip-base-layers "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	# Without a recorded base image, there's nothing to skip.
+	umoci unpack --image "${IMAGE}:${TAG}" --rootfs-only --skip-base-layers "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	# Create an image on top of the base image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "application" > "$BUNDLE_A/rootfs/umoci-app"
+	umoci repack --image "${IMAGE}:${TAG}-app" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Record the base image by rebasing onto the same base.
+	umoci rebase --image "${IMAGE}:${TAG}-app" --old-base "${TAG}" --new-base "${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-app" --rootfs-only --skip-base-layers "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+
+	# Only the application layer should have been extracted.
+	[[ "$(ls -A "$BUNDLE_C/rootfs")" == "umoci-app" ]]
+	[[ "$(jq -SMr '.skipped_layers' "$BUNDLE_C/umoci.json")" -gt 0 ]]
+
+	# The same can be done by specifying the last base layer.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	baselayer="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)][-1].layer.digest')"
+
+	umoci unpack --image "${IMAGE}:${TAG}-app" --rootfs-only --base-layer "$baselayer" "$BUNDLE_D"
+	[ "$status" -eq 0 ]
+	[[ "$(ls -A "$BUNDLE_D/rootfs")" == "umoci-app" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --start-from-layer --stop-at-layer" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	BUNDLE_D="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Create an image with two extra layers.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	echo "first" > "$BUNDLE_A/rootfs/umoci-first"
+	umoci repack --image "${IMAGE}:${TAG}-first" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-first" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	echo "second" > "$BUNDLE_B/rootfs/umoci-second"
+	umoci repack --image "${IMAGE}:${TAG}-second" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-second" --json
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SMr '[.history[] | select(.layer != null)] | length')"
+
+	# Invalid ranges are rejected.
+	umoci unpack --image "${IMAGE}:${TAG}-second" --stop-at-layer "$nlayers" "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-second" --start-from-layer 1 --stop-at-layer 0 "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-second" --start-from-layer 1 --skip-base-layers --rootfs-only "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+
+	# Only extract the layer containing umoci-first.
+	umoci unpack --image "${IMAGE}:${TAG}-second" --start-from-layer "$((nlayers - 2))" --stop-at-layer "$((nlayers - 2))" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	[[ "$(ls -A "$BUNDLE_C/rootfs")" == "umoci-first" ]]
+	[[ "$(jq -SMr '.partial_layers.start' "$BUNDLE_C/umoci.json")" == "$((nlayers - 2))" ]]
+	[[ "$(jq -SMr '.partial_layers.stop' "$BUNDLE_C/umoci.json")" == "$((nlayers - 2))" ]]
+
+	# Partial bundles cannot be repacked.
+	umoci repack --image "${IMAGE}:${TAG}-partial" "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+
+	# Without --start-from-layer, the rootfs contains every layer up to the
+	# given layer.
+	umoci unpack --image "${IMAGE}:${TAG}-second" --rootfs-only --stop-at-layer "$((nlayers - 2))" "$BUNDLE_D"
+	[ "$status" -eq 0 ]
+	[ -f "$BUNDLE_D/rootfs/umoci-first" ]
+	! [ -e "$BUNDLE_D/rootfs/umoci-second" ]
+	[ -d "$BUNDLE_D/rootfs/etc" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --device-policy" {
+	requires root
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	BUNDLE_D="$(setup_tmpdir)"
+
+	# Create an image with some device nodes.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir -p "$BUNDLE_A/rootfs/umoci-dev"
+	mknod "$BUNDLE_A/rootfs/umoci-dev/null" c 1 3
+	mknod "$BUNDLE_A/rootfs/umoci-dev/loop0" b 7 0
+
+	umoci repack --image "${IMAGE}:${TAG}-dev" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Invalid policies must be rejected.
+	umoci unpack --image "${IMAGE}:${TAG}-dev" --device-policy=fake "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-dev" --device-policy=skip --allow-devices "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	# By default the device nodes are recorded but not created.
+	umoci unpack --image "${IMAGE}:${TAG}-dev" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[ -d "$BUNDLE_B/rootfs/umoci-dev" ]
+	! [ -e "$BUNDLE_B/rootfs/umoci-dev/null" ]
+	! [ -e "$BUNDLE_B/rootfs/umoci-dev/loop0" ]
+	sane_run jq -SMr '.[] | "\(.path) \(.type) \(.major):\(.minor)"' "$BUNDLE_B/rootfs.umoci-devices"
+	[ "$status" -eq 0 ]
+	[[ "${lines[*]}" == "/umoci-dev/loop0 block 7:0 /umoci-dev/null char 1:3" ]]
+
+	# Repacking must not remove the device nodes from the image.
+	touch "$BUNDLE_B/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-dev" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# With --allow-devices they are created.
+	umoci unpack --image "${IMAGE}:${TAG}-dev" --allow-devices "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	[ -c "$BUNDLE_C/rootfs/umoci-dev/null" ]
+	[ -b "$BUNDLE_C/rootfs/umoci-dev/loop0" ]
+	[ -f "$BUNDLE_C/rootfs/newfile" ]
+	! [ -e "$BUNDLE_C/rootfs.umoci-devices" ]
+
+	# With --device-policy=skip they are neither created nor recorded.
+	umoci unpack --image "${IMAGE}:${TAG}-dev" --device-policy=skip "$BUNDLE_D"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_D"
+
+	! [ -e "$BUNDLE_D/rootfs/umoci-dev/null" ]
+	! [ -e "$BUNDLE_D/rootfs.umoci-devices" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci {un,re}pack --fifo-policy and --socket-policy" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create a named pipe and a socket.
+	mkfifo "$BUNDLE_A/rootfs/fifo"
+	python3 -c 'import socket, sys; socket.socket(socket.AF_UNIX).bind(sys.argv[1])' "$BUNDLE_A/rootfs/socket"
+
+	# Invalid policies must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-special" --socket-policy include "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-special" --fifo-policy fake "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# Sockets cause errors if requested.
+	umoci repack --image "${IMAGE}:${TAG}-special" --socket-policy error "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# By default sockets are skipped and named pipes are included.
+	umoci repack --image "${IMAGE}:${TAG}-special" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-special" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[ -p "$BUNDLE_B/rootfs/fifo" ]
+	! [ -e "$BUNDLE_B/rootfs/socket" ]
+
+	# Named pipes can be skipped or forbidden when unpacking.
+	umoci unpack --image "${IMAGE}:${TAG}-special" --fifo-policy error "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+	rm -rf "$BUNDLE_C"
+
+	umoci unpack --image "${IMAGE}:${TAG}-special" --fifo-policy skip "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	! [ -e "$BUNDLE_C/rootfs/fifo" ]
+	[[ "$(jq -SMr '.map_options.fifo_policy' "$BUNDLE_C/umoci.json")" == "skip" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --path-collisions" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create paths which only differ in their normalisation form and case.
+	nfc="$(printf 'caf\xc3\xa9')"
+	nfd="$(printf 'cafe\xcc\x81')"
+	echo "nfc" > "$BUNDLE_A/rootfs/$nfc"
+	echo "nfd" > "$BUNDLE_A/rootfs/$nfd"
+	echo "upper" > "$BUNDLE_A/rootfs/README"
+	echo "lower" > "$BUNDLE_A/rootfs/readme"
+
+	umoci repack --image "${IMAGE}:${TAG}-collide" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# By default the paths are extracted as-is.
+	umoci unpack --image "${IMAGE}:${TAG}-collide" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[ -f "$BUNDLE_B/rootfs/$nfc" ]
+	[ -f "$BUNDLE_B/rootfs/$nfd" ]
+
+	# Collisions can be rejected.
+	umoci unpack --image "${IMAGE}:${TAG}-collide" --path-collisions error "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+	rm -rf "$BUNDLE_C"
+
+	umoci unpack --image "${IMAGE}:${TAG}-collide" --path-collisions fake "$BUNDLE_C"
+	[ "$status" -ne 0 ]
+	rm -rf "$BUNDLE_C"
+
+	# Or normalised, so only one of each set of paths is extracted.
+	umoci unpack --image "${IMAGE}:${TAG}-collide" --path-collisions normalize --case-insensitive "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	[ -f "$BUNDLE_C/rootfs/$nfc" ] || [ -f "$BUNDLE_C/rootfs/$nfd" ]
+	! ( [ -f "$BUNDLE_C/rootfs/$nfc" ] && [ -f "$BUNDLE_C/rootfs/$nfd" ] )
+	[ -f "$BUNDLE_C/rootfs/README" ] || [ -f "$BUNDLE_C/rootfs/readme" ]
+	! ( [ -f "$BUNDLE_C/rootfs/README" ] && [ -f "$BUNDLE_C/rootfs/readme" ] )
+	[[ "$(jq -SMr '.map_options.path_collision_policy' "$BUNDLE_C/umoci.json")" == "normalize" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --conflict-policy" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	# Invalid policies must be rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --conflict-policy fake "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	rm -rf "$BUNDLE_A"
+
+	# Unpack the image, generating an audit report.
+	umoci unpack --image "${IMAGE}:${TAG}" --conflict-policy warn "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	[ -f "$BUNDLE_A/rootfs.umoci-conflicts" ]
+	[[ "$(jq -SMr '.map_options.conflict_policy' "$BUNDLE_A/umoci.json")" == "warn" ]]
+
+	# Layers generated by umoci don't have any conflicts.
+	[[ "$(jq -SMr 'length' "$BUNDLE_A/rootfs.umoci-conflicts")" == 0 ]]
+	umoci unpack --image "${IMAGE}:${TAG}" --conflict-policy error "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	! [ -e "$BUNDLE_B/rootfs.umoci-conflicts" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --apply-umask" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create a file with a known mode.
+	echo "umask" > "$BUNDLE_A/rootfs/umask-file"
+	chmod 0644 "$BUNDLE_A/rootfs/umask-file"
+
+	umoci repack --image "${IMAGE}:${TAG}-umask" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	old_umask="$(umask)"
+	umask 077
+
+	# By default the umask doesn't affect the extracted modes.
+	umoci unpack --image "${IMAGE}:${TAG}-umask" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# With --apply-umask it does.
+	umoci unpack --image "${IMAGE}:${TAG}-umask" --apply-umask "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	umask "$old_umask"
+
+	[[ "$(stat -c '%a' "$BUNDLE_B/rootfs/umask-file")" == 644 ]]
+	[[ "$(stat -c '%a' "$BUNDLE_C/rootfs/umask-file")" == 600 ]]
+	[[ "$(jq -SMr '.map_options.apply_umask' "$BUNDLE_C/umoci.json")" == "true" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --omit-times" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --omit-times "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(jq -SMr '.map_options.omit_times' "$BUNDLE/umoci.json")" == "true" ]]
+
+	# Every file has the epoch as its mtime.
+	[ -z "$(find "$BUNDLE/rootfs" -newermt "@0")" ]
+
+	# The mtree specification doesn't contain any times.
+	! grep -q "time=" "$BUNDLE"/*.mtree
+
+	# Changing only the times of files is not detected.
+	touch "$BUNDLE/rootfs/etc" "$BUNDLE/rootfs/bin/sh"
+	umoci check-bundle --layout "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# But changing their contents is.
+	echo "modified" >> "$BUNDLE/rootfs/etc/passwd"
+	umoci check-bundle --layout "${IMAGE}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep -E '/?etc/passwd'
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --owner-names" {
+	# We need to be able to create files owned by arbitrary users.
+	requires root
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	BUNDLE_D="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Add a user to the image, and a file owned by them.
+	echo "umocitest:x:4242:4242::/:/bin/sh" >> "$BUNDLE_A/rootfs/etc/passwd"
+	echo "umocitest:x:4242:" >> "$BUNDLE_A/rootfs/etc/group"
+	echo "owned" > "$BUNDLE_A/rootfs/owned-file"
+	chown 4242:4242 "$BUNDLE_A/rootfs/owned-file"
+
+	umoci repack --image "${IMAGE}:${TAG}-owners" --owner-names "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Change the numeric id of the user in a new layer.
+	umoci unpack --image "${IMAGE}:${TAG}-owners" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	sed -i 's/^umocitest:x:4242:4242:/umocitest:x:5353:5353:/' "$BUNDLE_B/rootfs/etc/passwd"
+	sed -i 's/^umocitest:x:4242:/umocitest:x:5353:/' "$BUNDLE_B/rootfs/etc/group"
+	umoci repack --image "${IMAGE}:${TAG}-owners" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# By default the numeric ids are used.
+	umoci unpack --image "${IMAGE}:${TAG}-owners" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	[[ "$(stat -c '%u:%g' "$BUNDLE_C/rootfs/owned-file")" == "4242:4242" ]]
+
+	# With --owner-names the owner is resolved using the image's passwd.
+	umoci unpack --image "${IMAGE}:${TAG}-owners" --owner-names "$BUNDLE_D"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_D"
+	[[ "$(stat -c '%u:%g' "$BUNDLE_D/rootfs/owned-file")" == "5353:5353" ]]
+	[[ "$(jq -SMr '.owner_names' "$BUNDLE_D/umoci.json")" == "true" ]]
+
+	umoci verify-rootfs --layout "${IMAGE}" "$BUNDLE_D"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci unpack [missing args]" {
 	BUNDLE="$(setup_tmpdir)"
 
@@ -152,3 +667,294 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci unpack [read-only image]" {
+	# We need to be able to mount the image read-only.
+	requires root
+
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Make the image read-only.
+	mount --bind "${IMAGE}" "${IMAGE}"
+	mount -o remount,bind,ro "${IMAGE}"
+
+	# Unpacking should still work.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	status_ro="$status"
+
+	# But modifying the image should fail.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	status_tag="$status"
+	output_tag="$output"
+
+	umount "${IMAGE}"
+
+	[ "$status_ro" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ "$status_tag" -ne 0 ]
+	[[ "$output_tag" == *"read-only"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [--layer-cache]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	CACHE="$(setup_tmpdir)/cache"
+
+	export UMOCI_LAYER_CACHE_DIR="$CACHE"
+
+	# The first unpack populates the cache.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A/bundle"
+	[[ "$(find "$CACHE" -type f | wc -l)" -gt 0 ]]
+
+	# The second unpack uses the cached layers, even if the layer blobs are
+	# missing from the image.
+	NEWIMAGE="$(setup_tmpdir)/image"
+	cp -r "${IMAGE}" "$NEWIMAGE"
+	umoci stat --image "${NEWIMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	for layer in $(jq -SMr '.history[] | select(.empty_layer != true) | .layer.digest' <<<"$output"); do
+		rm -f "$NEWIMAGE/blobs/sha256/${layer#sha256:}"
+	done
+	umoci unpack --image "${NEWIMAGE}:${TAG}" "$BUNDLE_B/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B/bundle"
+
+	# Both bundles must be identical.
+	sane_run diff -r --no-dereference "$BUNDLE_A/bundle/rootfs" "$BUNDLE_B/bundle/rootfs"
+	[ "$status" -eq 0 ]
+
+	# The cache can be limited in size.
+	export UMOCI_LAYER_CACHE_SIZE=1
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A/bundle2"
+	[ "$status" -eq 0 ]
+	[[ "$(find "$CACHE" -type f | wc -l)" -eq 0 ]]
+
+	unset UMOCI_LAYER_CACHE_DIR UMOCI_LAYER_CACHE_SIZE
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [--reuse-bundles]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A/bundle"
+
+	# Create an image on top of the base image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B/bundle"
+	[ "$status" -eq 0 ]
+	echo "application" > "$BUNDLE_B/bundle/rootfs/umoci-app"
+	umoci repack --image "${IMAGE}:${TAG}-app" "$BUNDLE_B/bundle"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Remove the base layers from a copy of the image, so that the unpack can
+	# only succeed if an existing bundle is reused.
+	NEWIMAGE="$(setup_tmpdir)/image"
+	cp -r "${IMAGE}" "$NEWIMAGE"
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	for layer in $(jq -SMr '.history[] | select(.empty_layer != true) | .layer.digest' <<<"$output"); do
+		rm -f "$NEWIMAGE/blobs/sha256/${layer#sha256:}"
+	done
+
+	umoci unpack --reuse-bundles --image "${NEWIMAGE}:${TAG}-app" "$BUNDLE_C/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C/bundle"
+	[[ "$(cat "$BUNDLE_C/bundle/rootfs/umoci-app")" == "application" ]]
+	sane_run diff -r --no-dereference "$BUNDLE_B/bundle/rootfs" "$BUNDLE_C/bundle/rootfs"
+	[ "$status" -eq 0 ]
+
+	# The bundles are independent.
+	echo "modified" > "$BUNDLE_C/bundle/rootfs/umoci-app"
+	[[ "$(cat "$BUNDLE_B/bundle/rootfs/umoci-app")" == "application" ]]
+
+	# Bundles which have been modified since they were unpacked are not reused.
+	echo "modified" > "$BUNDLE_A/bundle/rootfs/umoci-modified"
+	echo "modified" > "$BUNDLE_B/bundle/rootfs/umoci-modified"
+	umoci unpack --reuse-bundles --image "${NEWIMAGE}:${TAG}-app" "$BUNDLE_C/bundle2"
+	[ "$status" -ne 0 ]
+
+	# --reuse-bundles cannot be combined with --resume.
+	umoci unpack --reuse-bundles --resume --image "${IMAGE}:${TAG}" "$BUNDLE_C/bundle3"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --into-existing-snapshot" {
+	BUNDLE="$(setup_tmpdir)"
+	STORE="$(setup_tmpdir)/snapshots"
+
+	# Create an image on top of the base image.
+	umoci unpack --image "${IMAGE}:${TAG}" --into-existing-snapshot "$STORE" --snapshot-driver copy "$BUNDLE/base"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/base"
+	nsnapshots="$(find "$STORE" -mindepth 1 -maxdepth 1 | wc -l)"
+	[ "$nsnapshots" -gt 0 ]
+
+	echo "application" > "$BUNDLE/base/rootfs/umoci-app"
+	umoci repack --image "${IMAGE}:${TAG}-app" "$BUNDLE/base"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Remove the base layers from a copy of the image, so that the unpack can
+	# only succeed if the snapshot is used.
+	NEWIMAGE="$(setup_tmpdir)/image"
+	cp -r "${IMAGE}" "$NEWIMAGE"
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	for layer in $(jq -SMr '.history[] | select(.empty_layer != true) | .layer.digest' <<<"$output"); do
+		rm -f "$NEWIMAGE/blobs/sha256/${layer#sha256:}"
+	done
+
+	umoci unpack --image "${NEWIMAGE}:${TAG}-app" --into-existing-snapshot "$STORE" --snapshot-driver copy "$BUNDLE/app"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/app"
+	[[ "$(cat "$BUNDLE/app/rootfs/umoci-app")" == "application" ]]
+	[ "$(find "$STORE" -mindepth 1 -maxdepth 1 | wc -l)" -eq "$((nsnapshots + 1))" ]
+
+	# The bundle is independent of the snapshots.
+	echo "modified" > "$BUNDLE/app/rootfs/umoci-app"
+	umoci unpack --image "${NEWIMAGE}:${TAG}-app" --into-existing-snapshot "$STORE" --snapshot-driver copy "$BUNDLE/app2"
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$BUNDLE/app2/rootfs/umoci-app")" == "application" ]]
+
+	# Invalid combinations.
+	umoci unpack --image "${IMAGE}:${TAG}" --into-existing-snapshot "$STORE" --reuse-bundles "$BUNDLE/bad1"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --into-existing-snapshot "$STORE" --snapshot-driver lvm "$BUNDLE/bad2"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --snapshot-driver copy "$BUNDLE/bad3"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [wasm]" {
+	FILES="$(setup_tmpdir)"
+	printf '\0asm\1\0\0\0' > "$FILES/main.wasm"
+
+	# Create a wasm image. The config must list the digests of the modules.
+	umoci artifact push-blob --layout "${IMAGE}" "$FILES/main.wasm"
+	[ "$status" -eq 0 ]
+	module="${lines[-1]}"
+	echo '{"architecture": "wasm", "os": "wasip1", "layerDigests": ["'"$module"'"]}' > "$FILES/config.json"
+	umoci artifact put --image "${IMAGE}:wasm" \
+		--artifact-type "application/vnd.wasm.config.v0+json" \
+		--config "$FILES/config.json" \
+		"$module:application/vnd.wasm.content.layer.v1+wasm"
+	[ "$status" -eq 0 ]
+
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:wasm" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	cmp "$FILES/main.wasm" "$BUNDLE/bundle/rootfs/module.wasm"
+
+	sane_run jq -SMr '.process.args[0]' "$BUNDLE/bundle/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "/module.wasm" ]]
+	sane_run jq -SMr '.annotations["module.wasm.image/variant"]' "$BUNDLE/bundle/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "compat" ]]
+
+	# Modules which don't match the config are rejected.
+	echo '{"architecture": "wasm", "os": "wasip1", "layerDigests": []}' > "$FILES/config.json"
+	umoci artifact put --image "${IMAGE}:wasm-bad" \
+		--artifact-type "application/vnd.wasm.config.v0+json" \
+		--config "$FILES/config.json" \
+		"$module:application/vnd.wasm.content.layer.v1+wasm"
+	[ "$status" -eq 0 ]
+	umoci unpack --image "${IMAGE}:wasm-bad" "$BUNDLE/bundle-bad"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci unpack [decompression limits]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Layers larger than --max-layer-size are rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --max-layer-size 1K "$BUNDLE/small"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "decompression limits"
+
+	# As are blobs larger than --max-json-size.
+	umoci --max-json-size 16 unpack --image "${IMAGE}:${TAG}" "$BUNDLE/json"
+	[ "$status" -ne 0 ]
+
+	# Create a layer which compresses far better than 100:1.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+	dd if=/dev/zero of="$BUNDLE/bundle/rootfs/zeros" bs=1M count=128
+	umoci repack --image "${IMAGE}:bomb" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:bomb" "$BUNDLE/bomb"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "compression ratio"
+
+	# ... but it can still be extracted if the limit is disabled.
+	umoci unpack --image "${IMAGE}:bomb" --max-compression-ratio 0 "$BUNDLE/bomb-ok"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bomb-ok"
+	[ "$(stat -c '%s' "$BUNDLE/bomb-ok/rootfs/zeros")" -eq $((128 * 1024 * 1024)) ]
+}
+
+@test "umoci unpack [entry limits]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --max-layer-entries 10 "$BUNDLE/entries"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "more than 10 entries"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --max-path-depth 1 "$BUNDLE/depth"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "more than the limit of 1"
+
+	umoci unpack --image "${IMAGE}:${TAG}" --max-layer-entries 0 --max-path-depth 0 "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+}
+
+@test "umoci unpack --fsverity" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# fs-verity cannot be enabled in rootless mode.
+	umoci unpack --image "${IMAGE}:${TAG}" --rootless --fsverity "$BUNDLE/rootless"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "rootless"
+
+	requires root
+	umoci unpack --image "${IMAGE}:${TAG}" --fsverity "$BUNDLE/bundle"
+	if echo "$output" | grep -q "does not support fs-verity"; then
+		skip "test requires a filesystem supporting fs-verity"
+	fi
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+	[[ "$(jq -SMr '.map_options.verity' "$BUNDLE/bundle/umoci.json")" == "true" ]]
+
+	# Every regular file has a recorded digest, and cannot be modified.
+	[ "$(jq -SMr 'length' "$BUNDLE/bundle/rootfs.umoci-verity")" -eq "$(find "$BUNDLE/bundle/rootfs" -type f | wc -l)" ]
+	path="$(jq -SMr '.[0].path' "$BUNDLE/bundle/rootfs.umoci-verity")"
+	! echo "modified" >> "$BUNDLE/bundle/rootfs/$path"
+
+	umoci verify-rootfs --layout "${IMAGE}" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+
+	# Replacing a file removes fs-verity, which is detected.
+	cp "$BUNDLE/bundle/rootfs/$path" "$BUNDLE/copy"
+	rm -f "$BUNDLE/bundle/rootfs/$path"
+	cp -p "$BUNDLE/copy" "$BUNDLE/bundle/rootfs/$path"
+	umoci verify-rootfs --layout "${IMAGE}" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep -E "^modified	$path	verity$"
+}
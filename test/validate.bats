@@ -0,0 +1,86 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci validate" {
+	image-verify "${IMAGE}"
+
+	# The whole layout should be valid.
+	umoci validate --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# As should the tag.
+	umoci validate --layout "${IMAGE}" "${TAG}"
+	[ "$status" -eq 0 ]
+
+	# Non-existent tags are an error.
+	umoci validate --layout "${IMAGE}" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci validate [corrupted blob]" {
+	image-verify "${IMAGE}"
+
+	# Corrupt a blob in the image.
+	blob="$(find "${IMAGE}/blobs/sha256" -type f | head -n1)"
+	echo "corruption" >> "$blob"
+
+	# The layout must now fail validation.
+	umoci validate --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --strict" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Repack with validation.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci repack --strict --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Modify the configuration with validation.
+	umoci config --strict --image "${IMAGE}:${TAG}-new" --config.user="1000:1000"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci validate --layout "${IMAGE}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+}
+
+@test "umoci validate [missing args]" {
+	umoci validate
+	[ "$status" -ne 0 ]
+}
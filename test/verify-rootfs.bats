@@ -0,0 +1,111 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci verify-rootfs" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# A freshly unpacked rootfs must match the layers.
+	umoci verify-rootfs --layout "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Modify the rootfs.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	rm -rf "$BUNDLE/rootfs/etc"
+	chmod 0700 "$BUNDLE/rootfs/bin"
+
+	# The differences must be reported.
+	umoci verify-rootfs --layout "${IMAGE}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep -E '^extra	/newfile$'
+	echo "$output" | grep -E '^missing	/etc$'
+	echo "$output" | grep -E '^modified	/bin	mode$'
+	# Children of missing directories are not reported.
+	! echo "$output" | grep -E '^missing	/etc/'
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci verify-rootfs [repacked]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Create a new layer with a variety of file types.
+	mkdir -p "$BUNDLE_A/rootfs/verify/dir"
+	echo "contents" > "$BUNDLE_A/rootfs/verify/file"
+	ln "$BUNDLE_A/rootfs/verify/file" "$BUNDLE_A/rootfs/verify/hardlink"
+	ln -s ../verify/file "$BUNDLE_A/rootfs/verify/symlink"
+	chmod 4755 "$BUNDLE_A/rootfs/verify/dir"
+	rm -rf "$BUNDLE_A/rootfs/etc"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	umoci verify-rootfs --layout "${IMAGE}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Modify the new layer's files.
+	echo "tampered" > "$BUNDLE_B/rootfs/verify/file"
+	ln -sf /elsewhere "$BUNDLE_B/rootfs/verify/symlink"
+	chmod 0755 "$BUNDLE_B/rootfs/verify/dir"
+
+	umoci verify-rootfs --layout "${IMAGE}" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep -E '^modified	/verify/file	size$'
+	echo "$output" | grep -E '^modified	/verify/hardlink	size$'
+	echo "$output" | grep -E '^modified	/verify/symlink	link$'
+	echo "$output" | grep -E '^modified	/verify/dir	mode$'
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci verify-rootfs [missing bundle]" {
+	umoci verify-rootfs --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci verify-rootfs --layout "${IMAGE}" ""
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,51 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+@test "umoci version" {
+	umoci version
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"Version:"* ]]
+	[[ "$output" == *"application/vnd.oci.image.layer.v1.tar+gzip"* ]]
+}
+
+@test "umoci version --json" {
+	umoci version --json
+	[ "$status" -eq 0 ]
+	info="$output"
+
+	# The version must match --version.
+	umoci --version
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"$(echo "$info" | jq -r '.version')" ]]
+
+	# Every layer media type of the image-spec is supported.
+	for mediaType in "application/vnd.oci.image.layer.v1.tar" "application/vnd.oci.image.layer.v1.tar+gzip"; do
+		echo "$info" | jq -e --arg mt "$mediaType" '.media_types.layers | index($mt)'
+	done
+
+	# Whether --rootless is needed must be detected correctly.
+	if [[ "$(id -u)" != 0 ]]; then
+		[[ "$(echo "$info" | jq -r '.features.rootless')" == "true" ]]
+	fi
+	[[ "$(echo "$info" | jq -r '.static')" != "$(echo "$info" | jq -r '.features.cgo')" ]]
+}
+
+@test "umoci version [invalid arguments]" {
+	umoci version extra
+	[ "$status" -ne 0 ]
+}
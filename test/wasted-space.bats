@@ -0,0 +1,137 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci wasted-space [missing args]" {
+	umoci wasted-space
+	[ "$status" -ne 0 ]
+
+	umoci wasted-space --image "${IMAGE}:${TAG}" --top -1
+	[ "$status" -ne 0 ]
+
+	umoci wasted-space --image "${IMAGE}:${TAG}" --min-size notasize
+	[ "$status" -ne 0 ]
+
+	umoci wasted-space --image "${IMAGE}:${TAG}" too many arguments
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci wasted-space --auto-squash" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	BUNDLE_D="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Add a large file in one layer.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir -p "$BUNDLE_A/rootfs/umoci-test"
+	dd if=/dev/zero of="$BUNDLE_A/rootfs/umoci-test/bigfile" bs=1M count=16
+	echo "original" > "$BUNDLE_A/rootfs/umoci-test/smallfile"
+	umoci repack --image "${IMAGE}:${TAG}-big" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Then remove it (and change another file) in another layer.
+	umoci unpack --image "${IMAGE}:${TAG}-big" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	rm "$BUNDLE_B/rootfs/umoci-test/bigfile"
+	echo "modified" > "$BUNDLE_B/rootfs/umoci-test/smallfile"
+	umoci repack --image "${IMAGE}:${TAG}-removed" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-removed" --json
+	[ "$status" -eq 0 ]
+	nhistory="$(echo "$output" | jq -SMr '.history | length')"
+
+	# Make sure that the wasted space is detected.
+	umoci wasted-space --image "${IMAGE}:${TAG}-removed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.wasted[0].path')" == "/umoci-test/bigfile" ]]
+	[[ "$(echo "$output" | jq -SMr '.suggestions | length')" -eq 1 ]]
+	[[ "$(echo "$output" | jq -SMr '.reclaimable')" -ge 16777216 ]]
+	[[ "$(echo "$output" | jq -SMr '.squashed')" == "false" ]]
+
+	# Nothing should be suggested with a high enough threshold.
+	umoci wasted-space --image "${IMAGE}:${TAG}-removed" --min-size 1GB --auto-squash --tag "${TAG}-nothing" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.suggestions | length')" -eq 0 ]]
+	[[ "$(echo "$output" | jq -SMr '.squashed')" == "false" ]]
+	umoci stat --image "${IMAGE}:${TAG}-nothing"
+	[ "$status" -ne 0 ]
+
+	# Squash the layers.
+	umoci wasted-space --image "${IMAGE}:${TAG}-removed" --auto-squash --tag "${TAG}-squashed" --history.comment "squash test" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.squashed')" == "true" ]]
+	image-verify "${IMAGE}"
+
+	# The wasted space should be gone, and the two history entries replaced
+	# with a single one.
+	umoci wasted-space --image "${IMAGE}:${TAG}-squashed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.wasted_size')" -eq 0 ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-squashed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history | length')" -eq "$((nhistory - 1))" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "squash test" ]]
+
+	# Both images should produce the same rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}-removed" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	umoci unpack --image "${IMAGE}:${TAG}-squashed" "$BUNDLE_D"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_D"
+
+	diff -r "$BUNDLE_C/rootfs" "$BUNDLE_D/rootfs"
+	[[ "$(cat "$BUNDLE_D/rootfs/umoci-test/smallfile")" == "modified" ]]
+	! [ -e "$BUNDLE_D/rootfs/umoci-test/bigfile" ]
+
+	image-verify "${IMAGE}"
+}
+
+# We can't really test the output for non-JSON output, but we can smoke test it.
+@test "umoci wasted-space [smoke]" {
+	image-verify "${IMAGE}"
+
+	umoci wasted-space --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	echo "$output" | grep 'WASTED'
+	echo "$output" | grep 'RECLAIMABLE'
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,127 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	if [ -n "$WATCH_PID" ]; then
+		kill "$WATCH_PID" || true
+	fi
+	teardown_tmpdirs
+	teardown_image
+}
+
+# start_watch runs umoci watch in the background, with its output written to
+# $WATCH_OUTPUT. It is run directly (rather than with the umoci helper) since it
+# doesn't exit until a change is made.
+function start_watch() {
+	WATCH_OUTPUT="$(setup_tmpdir)/output"
+	"$UMOCI" watch --layout "${IMAGE}" "$@" >"$WATCH_OUTPUT" &
+	WATCH_PID=$!
+	# Give umoci a chance to start watching the image.
+	sleep 0.5
+}
+
+# wait_watch waits for the background umoci watch to exit, and checks that it
+# was successful.
+function wait_watch() {
+	for _ in $(seq 50); do
+		kill -0 "$WATCH_PID" 2>/dev/null || break
+		sleep 0.1
+	done
+	wait "$WATCH_PID"
+	WATCH_PID=
+}
+
+@test "umoci watch --json" {
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$output"
+
+	# Changes to tags which aren't being watched are ignored.
+	start_watch --once --json "${TAG}-new"
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-ignored"
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+	wait_watch
+
+	sane_run jq -SMr '.ref_name' "$WATCH_OUTPUT"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "${TAG}-new" ]]
+	sane_run jq -SMr '.old' "$WATCH_OUTPUT"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+	sane_run jq -SMr '.new' "$WATCH_OUTPUT"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$manifest" ]]
+
+	# Removing a tag is also a change.
+	start_watch --once --json
+	umoci rm --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	wait_watch
+
+	sane_run jq -SMr '.ref_name' "$WATCH_OUTPUT"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "${TAG}-new" ]]
+	sane_run jq -SMr '.new' "$WATCH_OUTPUT"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci watch --exec" {
+	image-verify "${IMAGE}"
+
+	# The command is given the details of the change, and its failure doesn't
+	# cause umoci to fail.
+	start_watch --once --exec 'echo "$UMOCI_TAG $UMOCI_OLD_DIGEST $UMOCI_NEW_DIGEST"; exit 1'
+	umoci config --image "${IMAGE}:${TAG}" --config.user "1000:1000"
+	[ "$status" -eq 0 ]
+	wait_watch
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$output"
+
+	sane_run cat "$WATCH_OUTPUT"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "${TAG} sha256:"*" $manifest" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci watch [invalid arguments]" {
+	umoci watch --layout "${IMAGE}" --exec "true" --json
+	[ "$status" -ne 0 ]
+
+	umoci watch --layout "${IMAGE}" --exec ""
+	[ "$status" -ne 0 ]
+
+	umoci watch --layout "${IMAGE}" "invalid tag"
+	[ "$status" -ne 0 ]
+
+	umoci watch
+	[ "$status" -ne 0 ]
+}